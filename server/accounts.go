@@ -29,6 +29,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nats-io/jwt/v2"
@@ -71,6 +72,9 @@ type Account struct {
 	exports      exportMap
 	js           *jsAccount
 	jsLimits     *JetStreamAccountLimits
+	jsKey        []byte
+	jsUsage      atomic.Value // *jsUsageNotifier
+	jsPrefix     string
 	limits
 	expired      bool
 	incomplete   bool
@@ -1546,6 +1550,13 @@ func (a *Account) removeServiceImport(subject string) {
 	}
 }
 
+// removeServiceExport will remove the service export by subject.
+func (a *Account) removeServiceExport(subject string) {
+	a.mu.Lock()
+	delete(a.exports.services, subject)
+	a.mu.Unlock()
+}
+
 // This tracks responses to service requests mappings. This is used for cleanup.
 func (a *Account) addReverseRespMapEntry(acc *Account, reply, from string) {
 	a.mu.Lock()
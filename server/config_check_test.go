@@ -1465,6 +1465,36 @@ func TestConfigCheck(t *testing.T) {
 			errorLine: 6,
 			errorPos:  10,
 		},
+		{
+			name: "jetstream account limit for concurrent api ops is not an integer",
+			config: `
+				accounts {
+					A {
+						jetstream {
+							max_concurrent_api_ops: "many"
+						}
+					}
+				}
+			`,
+			err:       fmt.Errorf("Expected an integer for %q, got %v", "max_concurrent_api_ops", "many"),
+			errorLine: 5,
+			errorPos:  8,
+		},
+		{
+			name: "jetstream account limit for concurrent api ops has no alias",
+			config: `
+				accounts {
+					A {
+						jetstream {
+							max_api_ops: 10
+						}
+					}
+				}
+			`,
+			err:       fmt.Errorf("unknown field %q", "max_api_ops"),
+			errorLine: 5,
+			errorPos:  8,
+		},
 	}
 
 	checkConfig := func(config string) error {
@@ -25,6 +25,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nats-io/nuid"
@@ -42,6 +43,8 @@ type ConsumerInfo struct {
 	NumRedelivered int            `json:"num_redelivered"`
 	NumWaiting     int            `json:"num_waiting"`
 	NumPending     uint64         `json:"num_pending"`
+	// RecoveredEphemeral is set for ephemerals restored on startup whose client has not reconnected.
+	RecoveredEphemeral bool `json:"recovered_ephemeral,omitempty"`
 }
 
 type ConsumerConfig struct {
@@ -59,6 +62,9 @@ type ConsumerConfig struct {
 	SampleFrequency string        `json:"sample_freq,omitempty"`
 	MaxWaiting      int           `json:"max_waiting,omitempty"`
 	MaxAckPending   int           `json:"max_ack_pending,omitempty"`
+	// InactiveThreshold will delete the consumer once it has had no interest
+	// or activity for this long. Zero means never.
+	InactiveThreshold time.Duration `json:"inactive_threshold,omitempty"`
 
 	// These are non public configuration options.
 	// If you add new options, check fileConsumerInfoJSON in order for them to
@@ -201,6 +207,9 @@ type Consumer struct {
 	filterWC          bool
 	dtmr              *time.Timer
 	dthresh           time.Duration
+	itmr              *time.Timer
+	lact              time.Time
+	recovered         bool
 	mch               chan struct{}
 	qch               chan struct{}
 	inch              chan bool
@@ -209,6 +218,11 @@ type Consumer struct {
 	deliveryExcEventT string
 	created           time.Time
 	closed            bool
+	// Shared delivery workers when they are capped. Set on creation and not
+	// changed, so it can be read without the lock.
+	dpool *deliveryPool
+	// Set while we are waiting for, or being served by, a delivery worker.
+	dready int32
 
 	// Clustered.
 	node RaftNode
@@ -278,6 +292,10 @@ func (mset *Stream) addConsumer(config *ConsumerConfig, oname string, node RaftN
 		}
 	}
 
+	if config.InactiveThreshold < 0 {
+		return nil, fmt.Errorf("consumer inactive threshold can not be negative")
+	}
+
 	// Setup proper default for ack wait if we are in explicit ack mode.
 	if config.AckWait == 0 && (config.AckPolicy == AckExplicit || config.AckPolicy == AckAll) {
 		config.AckWait = JsAckWaitDefault
@@ -428,10 +446,17 @@ func (mset *Stream) addConsumer(config *ConsumerConfig, oname string, node RaftN
 		}
 	}
 
+	// If delivery workers are capped we share them with all other consumers.
+	var dpool *deliveryPool
+	if js := s.getJetStream(); js != nil {
+		dpool = js.dpool
+	}
+
 	// Set name, which will be durable name if set, otherwise we create one at random.
 	o := &Consumer{
 		mset:    mset,
 		acc:     a,
+		dpool:   dpool,
 		client:  s.createInternalJetStreamClient(),
 		config:  *config,
 		dsubj:   config.DeliverSubject,
@@ -636,12 +661,19 @@ func (o *Consumer) setLeader(isLeader bool) {
 		o.sendq = make(chan *jsPubMsg, msetSendQSize)
 		// Recreate quit channel.
 		o.qch = make(chan struct{})
+		// Start watching for inactivity if requested.
+		if o.config.InactiveThreshold > 0 {
+			o.lact = time.Now()
+			o.itmr = time.AfterFunc(o.config.InactiveThreshold, o.checkInactive)
+		}
 		o.mu.Unlock()
 
 		// Now start up Go routine to deliver msgs.
 		go o.loopAndGatherMsgs()
-		// Startup our deliver loop.
-		go o.loopAndDeliverMsgs()
+		// Startup our deliver loop, unless we share capped delivery workers.
+		if o.dpool == nil {
+			go o.loopAndDeliverMsgs()
+		}
 
 	} else {
 		// Shutdown the go routines and the subscriptions.
@@ -656,6 +688,7 @@ func (o *Consumer) setLeader(isLeader bool) {
 		o.sendq = nil
 		close(o.qch)
 		o.qch = nil
+		stopAndClearTimer(&o.itmr)
 		o.mu.Unlock()
 	}
 }
@@ -692,10 +725,13 @@ func (o *Consumer) unsubscribe(sub *subscription) {
 // Do all advisory sends here.
 // Lock should be held on entry but will be released.
 func (o *Consumer) sendAdvisory(subj string, msg []byte) {
-	sendq := o.sendq
+	sendq, acc := o.sendq, o.acc
 	o.mu.Unlock()
 	if sendq != nil {
-		sendq <- &jsPubMsg{subj, subj, _EMPTY_, nil, msg, nil, 0}
+		o.queueMsg(sendq, &jsPubMsg{subj, subj, _EMPTY_, nil, msg, nil, 0})
+		if acc != nil {
+			acc.srv.sendAccountAdvisory(acc, subj, msg)
+		}
 	}
 	o.mu.Lock()
 }
@@ -753,8 +789,22 @@ func (o *Consumer) Created() time.Time {
 	return created
 }
 
+// Age returns how long ago the consumer was created.
+// Will return zero if the creation time is not known.
+func (o *Consumer) Age() time.Duration {
+	created := o.Created()
+	if created.IsZero() {
+		return 0
+	}
+	return time.Since(created)
+}
+
 // Internal to allow creation time to be restored.
+// A zero time will be ignored.
 func (o *Consumer) setCreated(created time.Time) {
+	if created.IsZero() {
+		return
+	}
 	o.mu.Lock()
 	o.created = created
 	o.mu.Unlock()
@@ -810,6 +860,11 @@ func (o *Consumer) updateDeliveryInterest(localInterest bool) {
 		o.signalNewMessages()
 	}
 	o.active = interest
+	o.lact = time.Now()
+	// A recovered ephemeral is claimed once there is interest again.
+	if interest {
+		o.recovered = false
+	}
 
 	// Stop and clear the delete timer always.
 	stopAndClearTimer(&o.dtmr)
@@ -821,6 +876,31 @@ func (o *Consumer) updateDeliveryInterest(localInterest bool) {
 	}
 }
 
+// checkInactive is called from the inactivity timer. It will delete the consumer
+// if it has had no interest or activity for its InactiveThreshold.
+func (o *Consumer) checkInactive() {
+	o.mu.Lock()
+	if o.mset == nil || o.itmr == nil {
+		o.mu.Unlock()
+		return
+	}
+	thresh := o.config.InactiveThreshold
+	// Interest or waiting requests count as activity.
+	if (o.isPushMode() && o.active) || (o.waiting != nil && o.waiting.len() > 0) {
+		o.lact = time.Now()
+	}
+	if wait := thresh - time.Since(o.lact); wait > 0 {
+		o.itmr.Reset(wait)
+		o.mu.Unlock()
+		return
+	}
+	s, name := o.acc.srv, o.name
+	o.mu.Unlock()
+
+	s.Debugf("Deleting JetStream consumer %q after being inactive for %v", name, thresh)
+	o.Delete()
+}
+
 // Config returns the consumer's configuration.
 func (o *Consumer) Config() ConsumerConfig {
 	o.mu.Lock()
@@ -895,6 +975,10 @@ func (o *Consumer) processAck(_ *subscription, c *client, subject, reply string,
 	_, msg := c.msgParts(rmsg)
 	sseq, dseq, dc := ackReplyInfo(subject)
 
+	o.mu.Lock()
+	o.lact = time.Now()
+	o.mu.Unlock()
+
 	skipAckReply := sseq == 0
 
 	switch {
@@ -1036,6 +1120,9 @@ func (o *Consumer) readStoredState() error {
 		return nil
 	}
 	state, err := o.store.State()
+	if err == nil && state != nil {
+		err = o.checkStoredState(state)
+	}
 
 	if err == nil && state != nil {
 		// FIXME(dlc) - re-apply state.
@@ -1054,6 +1141,29 @@ func (o *Consumer) readStoredState() error {
 	return err
 }
 
+// Make sure a stored state is consistent before we apply it.
+func (o *Consumer) checkStoredState(state *ConsumerState) error {
+	if state.AckFloor.Consumer > state.Delivered.Consumer || state.AckFloor.Stream > state.Delivered.Stream {
+		return fmt.Errorf("ack floor beyond delivered")
+	}
+	return nil
+}
+
+// resetStoredState is used on recovery when our stored state could not be read.
+// Any stored state is discarded and we start over based on our deliver policy.
+func (o *Consumer) resetStoredState() {
+	o.mu.Lock()
+	stopAndClearTimer(&o.ptmr)
+	o.pending, o.rdc = nil, nil
+	o.selectStartingSeqNo()
+	store, ok := o.store.(*consumerFileStore)
+	o.mu.Unlock()
+
+	if ok {
+		store.resetState()
+	}
+}
+
 // Update our state to the store.
 func (o *Consumer) writeState() {
 	o.mu.Lock()
@@ -1115,34 +1225,169 @@ func (o *Consumer) loopAndDeliverMsgs() {
 			if pm == nil {
 				return
 			}
-			c.pa.subject = []byte(pm.subj)
-			c.pa.deliver = []byte(pm.dsubj)
-			c.pa.size = len(pm.msg) + len(pm.hdr)
-			c.pa.szb = []byte(strconv.Itoa(c.pa.size))
-			c.pa.reply = []byte(pm.reply)
-
-			var msg []byte
-			if len(pm.hdr) > 0 {
-				c.pa.hdr = len(pm.hdr)
-				c.pa.hdb = []byte(strconv.Itoa(c.pa.hdr))
-				msg = append(pm.hdr, pm.msg...)
-				msg = append(msg, _CRLF_...)
-			} else {
-				c.pa.hdr = -1
-				c.pa.hdb = nil
-				msg = append(pm.msg, _CRLF_...)
-			}
+			deliverPubMsg(c, pm)
+		}
+	}
+}
+
+// deliverPubMsg will send a queued message through the internal client.
+func deliverPubMsg(c *client, pm *jsPubMsg) {
+	c.pa.subject = []byte(pm.subj)
+	c.pa.deliver = []byte(pm.dsubj)
+	c.pa.size = len(pm.msg) + len(pm.hdr)
+	c.pa.szb = []byte(strconv.Itoa(c.pa.size))
+	c.pa.reply = []byte(pm.reply)
+
+	var msg []byte
+	if len(pm.hdr) > 0 {
+		c.pa.hdr = len(pm.hdr)
+		c.pa.hdb = []byte(strconv.Itoa(c.pa.hdr))
+		msg = append(pm.hdr, pm.msg...)
+		msg = append(msg, _CRLF_...)
+	} else {
+		c.pa.hdr = -1
+		c.pa.hdb = nil
+		msg = append(pm.msg, _CRLF_...)
+	}
+
+	didDeliver := c.processInboundClientMsg(msg)
+	c.pa.szb = nil
+	c.flushClients(0)
+
+	// Check to see if this is a delivery for an observable and
+	// we failed to deliver the message. If so alert the observable.
+	if !didDeliver && pm.o != nil && pm.seq > 0 {
+		pm.o.didNotDeliver(pm.seq)
+	}
+}
+
+// queueMsg will place a message on the send queue. When delivery workers are
+// capped this will also make sure a worker will drain the queue.
+func (o *Consumer) queueMsg(sendq chan *jsPubMsg, pm *jsPubMsg) {
+	sendq <- pm
+	if o.dpool != nil {
+		o.dpool.schedule(o, sendq)
+	}
+}
+
+// How many messages a delivery worker sends for one consumer before it
+// moves on to the next one, so busy consumers do not starve the others.
+const deliveryPoolBatch = 64
+
+// deliveryPool is a fixed number of delivery workers shared by all consumers,
+// used in place of a loopAndDeliverMsgs go routine per consumer when
+// MaxDeliveryGoroutines is set. Consumers with queued messages wait in line
+// for a worker, and each worker keeps one internal client per account.
+type deliveryPool struct {
+	srv   *Server
+	mu    sync.Mutex
+	ready []deliveryPoolEntry
+	kick  chan struct{}
+	quit  chan struct{}
+	// Workers delivering right now and the most there have been, accessed atomically.
+	busy int32
+	peak int32
+}
+
+type deliveryPoolEntry struct {
+	o     *Consumer
+	sendq chan *jsPubMsg
+}
+
+func newDeliveryPool(s *Server, workers int) *deliveryPool {
+	p := &deliveryPool{
+		srv:  s,
+		kick: make(chan struct{}, workers),
+		quit: make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
 
-			didDeliver := c.processInboundClientMsg(msg)
-			c.pa.szb = nil
-			c.flushClients(0)
+// stop will have all workers exit once they are done with their current consumer.
+func (p *deliveryPool) stop() {
+	close(p.quit)
+}
+
+// schedule puts the consumer in line for a worker, unless it already is.
+func (p *deliveryPool) schedule(o *Consumer, sendq chan *jsPubMsg) {
+	if !atomic.CompareAndSwapInt32(&o.dready, 0, 1) {
+		return
+	}
+	p.mu.Lock()
+	p.ready = append(p.ready, deliveryPoolEntry{o, sendq})
+	p.mu.Unlock()
+	select {
+	case p.kick <- struct{}{}:
+	default:
+		// All workers have been kicked already and will check for more.
+	}
+}
 
-			// Check to see if this is a delivery for an observable and
-			// we failed to deliver the message. If so alert the observable.
-			if !didDeliver && pm.o != nil && pm.seq > 0 {
-				pm.o.didNotDeliver(pm.seq)
+// Returns the next consumer in line, if any.
+func (p *deliveryPool) next() (deliveryPoolEntry, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.ready) == 0 {
+		return deliveryPoolEntry{}, false
+	}
+	e := p.ready[0]
+	p.ready[0] = deliveryPoolEntry{}
+	p.ready = p.ready[1:]
+	return e, true
+}
+
+func (p *deliveryPool) work() {
+	clients := make(map[*Account]*client)
+	defer func() {
+		for _, c := range clients {
+			c.closeConnection(ClientClosed)
+		}
+	}()
+
+	for {
+		e, ok := p.next()
+		if !ok {
+			select {
+			case <-p.quit:
+				return
+			case <-p.kick:
 			}
+			continue
+		}
+		acc := e.o.acc
+		c := clients[acc]
+		if c == nil {
+			c = p.srv.createInternalJetStreamClient()
+			c.registerWithAccount(acc)
+			clients[acc] = c
+		}
+		if n := atomic.AddInt32(&p.busy, 1); n > atomic.LoadInt32(&p.peak) {
+			atomic.StoreInt32(&p.peak, n)
+		}
+		p.deliver(c, e)
+		atomic.AddInt32(&p.busy, -1)
+	}
+}
+
+// deliver sends up to a batch of the consumer's queued messages, and puts the
+// consumer back in line if there are more.
+func (p *deliveryPool) deliver(c *client, e deliveryPoolEntry) {
+	for i := 0; i < deliveryPoolBatch; i++ {
+		select {
+		case pm := <-e.sendq:
+			deliverPubMsg(c, pm)
+			continue
+		default:
 		}
+		break
+	}
+	atomic.StoreInt32(&e.o.dready, 0)
+	// Check for a message queued after we last looked.
+	if len(e.sendq) > 0 {
+		p.schedule(e.o, e.sendq)
 	}
 }
 
@@ -1162,9 +1407,10 @@ func (o *Consumer) Info() *ConsumerInfo {
 			Consumer: o.adflr,
 			Stream:   o.asflr,
 		},
-		NumAckPending:  len(o.pending),
-		NumRedelivered: len(o.rdc),
-		NumPending:     o.sgap,
+		NumAckPending:      len(o.pending),
+		NumRedelivered:     len(o.rdc),
+		NumPending:         o.sgap,
+		RecoveredEphemeral: o.recovered,
 	}
 	// If we are a pull mode consumer, report on number of waiting requests.
 	if o.isPullMode() {
@@ -1459,12 +1705,13 @@ func (o *Consumer) processNextMsgReq(_ *subscription, c *client, _, reply string
 		o.mu.Unlock()
 		return
 	}
+	o.lact = time.Now()
 
 	sendErr := func(status int, description string) {
 		o.mu.Unlock()
 		hdr := []byte(fmt.Sprintf("NATS/1.0 %d %s\r\n\r\n", status, description))
 		pmsg := &jsPubMsg{reply, reply, _EMPTY_, hdr, nil, nil, 0}
-		o.sendq <- pmsg // Send message.
+		o.queueMsg(o.sendq, pmsg) // Send message.
 	}
 
 	if o.waiting.isFull() {
@@ -1482,6 +1729,17 @@ func (o *Consumer) processNextMsgReq(_ *subscription, c *client, _, reply string
 		return
 	}
 
+	// Apply any account limit on the batch size.
+	if mset.jsa != nil {
+		if maxBatch, reject := mset.jsa.pullBatchLimit(); maxBatch > 0 && batchSize > maxBatch {
+			if reject {
+				sendErr(409, fmt.Sprintf("Exceeded MaxPullBatch of %d", maxBatch))
+				return
+			}
+			batchSize = maxBatch
+		}
+	}
+
 	// In case we have to queue up this request. This is all on stack pre-allocated.
 	wr := waitingRequest{client: c, reply: reply, n: batchSize, noWait: noWait, expires: expires}
 
@@ -1629,7 +1887,7 @@ func (o *Consumer) forceExpireFirstWaiting() *waitingRequest {
 		// We still appear to have interest, so send alert as courtesy.
 		hdr := []byte("NATS/1.0 408 Request Timeout\r\n\r\n")
 		pmsg := &jsPubMsg{wr.reply, wr.reply, _EMPTY_, hdr, nil, nil, 0}
-		o.sendq <- pmsg // Send message.
+		o.queueMsg(o.sendq, pmsg) // Send message.
 	}
 	return wr
 }
@@ -1774,12 +2032,19 @@ func (o *Consumer) loopAndGatherMsgs() {
 		// We will wait here for new messages to arrive.
 		mch := o.mch
 		qch := o.qch
+		// With capped delivery workers there is no deliver loop to watch interest.
+		var inch chan bool
+		if o.dpool != nil {
+			inch = o.inch
+		}
 		o.mu.Unlock()
 
 		select {
 		case <-qch:
 			return
 		case <-mch:
+		case interest := <-inch:
+			o.updateDeliveryInterest(interest)
 		}
 	}
 }
@@ -1792,7 +2057,8 @@ func (o *Consumer) ackReply(sseq, dseq, dc uint64, ts int64, pending uint64) str
 // Will return if the message was delivered or not.
 func (o *Consumer) deliverCurrentMsg(subj string, hdr, msg []byte, seq uint64, ts int64) bool {
 	o.mu.Lock()
-	if seq != o.sseq {
+	// If we are rate limited let the delivery loop pace us.
+	if seq != o.sseq || o.rlimit != nil {
 		o.mu.Unlock()
 		return false
 	}
@@ -1865,7 +2131,7 @@ func (o *Consumer) deliverMsg(dsubj, subj string, hdr, msg []byte, seq, dc uint6
 	// This needs to be unlocked since the other side may need this lock on a failed delivery.
 	o.mu.Unlock()
 	// Send message.
-	o.sendq <- pmsg
+	o.queueMsg(o.sendq, pmsg)
 	// If we are ack none and mset is interest only we should make sure stream removes interest.
 	if ap == AckNone && mset.config.Retention == InterestPolicy && !mset.checkInterest(seq, o) {
 		mset.store.RemoveMsg(seq)
@@ -2225,6 +2491,94 @@ func (o *Consumer) purge(sseq uint64) {
 	o.writeState()
 }
 
+// purgeBefore is called when all messages before sseq have been removed from
+// the stream. Anything we have not delivered or acked below it is skipped.
+// ackedPast returns true if messages after sseq have been acknowledged.
+func (o *Consumer) ackedPast(sseq uint64) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.config.AckPolicy != AckNone && o.asflr > sseq
+}
+
+// truncate is called when the stream has removed all messages after sseq.
+// Anything delivered past sseq is forgotten.
+func (o *Consumer) truncate(sseq uint64) {
+	o.mu.Lock()
+	if o.sseq > sseq+1 {
+		o.sseq = sseq + 1
+	}
+	if o.asflr > sseq {
+		o.asflr = sseq
+	}
+	for seq := range o.pending {
+		if seq > sseq {
+			delete(o.pending, seq)
+			delete(o.rdc, seq)
+		}
+	}
+	if len(o.pending) == 0 {
+		o.adflr = o.dseq - 1
+	}
+	if o.mset != nil && o.config.FilterSubject == _EMPTY_ {
+		if state := o.mset.store.State(); state.Msgs > 0 && o.sseq <= state.LastSeq {
+			o.sgap = state.Msgs - (o.sseq - state.FirstSeq)
+		} else {
+			o.sgap = 0
+		}
+	}
+	if len(o.rdq) > 0 {
+		var newRDQ []uint64
+		for _, seq := range o.rdq {
+			if seq <= sseq {
+				newRDQ = append(newRDQ, seq)
+			}
+		}
+		o.rdq = newRDQ
+	}
+	o.mu.Unlock()
+
+	o.writeState()
+}
+
+func (o *Consumer) purgeBefore(sseq uint64) {
+	o.mu.Lock()
+	if o.sseq < sseq {
+		o.sseq = sseq
+	}
+	if o.asflr < sseq-1 {
+		o.asflr = sseq - 1
+	}
+	for seq := range o.pending {
+		if seq < sseq {
+			delete(o.pending, seq)
+			delete(o.rdc, seq)
+		}
+	}
+	if len(o.pending) == 0 {
+		o.adflr = o.dseq - 1
+	}
+	// Not all stores report individual removals, so recalculate if we can.
+	if o.mset != nil && o.config.FilterSubject == _EMPTY_ {
+		if state := o.mset.store.State(); state.Msgs > 0 {
+			o.sgap = state.Msgs - (o.sseq - state.FirstSeq)
+		} else {
+			o.sgap = 0
+		}
+	}
+	if len(o.rdq) > 0 {
+		var newRDQ []uint64
+		for _, seq := range o.rdq {
+			if seq >= sseq {
+				newRDQ = append(newRDQ, seq)
+			}
+		}
+		o.rdq = newRDQ
+	}
+	o.mu.Unlock()
+
+	o.writeState()
+}
+
 func stopAndClearTimer(tp **time.Timer) {
 	if *tp == nil {
 		return
@@ -2279,6 +2633,7 @@ func (o *Consumer) stop(dflag, doSignal, advisory bool) error {
 	o.client = nil
 	stopAndClearTimer(&o.ptmr)
 	stopAndClearTimer(&o.dtmr)
+	stopAndClearTimer(&o.itmr)
 	delivery := o.config.DeliverSubject
 	o.waiting = nil
 	// Break us out of the readLoop.
@@ -2380,6 +2735,7 @@ func (o *Consumer) SetInActiveDeleteThreshold(dthresh time.Duration) error {
 func (o *Consumer) switchToEphemeral() {
 	o.mu.Lock()
 	o.config.Durable = _EMPTY_
+	o.recovered = true
 	store, ok := o.store.(*consumerFileStore)
 	rr := o.acc.sl.Match(o.config.DeliverSubject)
 	o.mu.Unlock()
@@ -2392,6 +2748,14 @@ func (o *Consumer) switchToEphemeral() {
 	}
 }
 
+// IsRecoveredEphemeral returns true if this is an ephemeral consumer that was
+// restored on startup and its client has not reconnected yet.
+func (o *Consumer) IsRecoveredEphemeral() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.recovered
+}
+
 // RequestNextMsgSubject returns the subject to request the next message when in pull or worker mode.
 // Returns empty otherwise.
 func (o *Consumer) RequestNextMsgSubject() string {
@@ -35,3 +35,12 @@ func diskAvailable(storeDir string) int64 {
 	}
 	return ba
 }
+
+// diskTotal returns the size of the filesystem holding dir, or 0 if unknown.
+func diskTotal(dir string) int64 {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0
+	}
+	return int64(uint64(fs.Blocks) * uint64(fs.Bsize))
+}
@@ -19,3 +19,8 @@ package server
 func diskAvailable(storeDir string) int64 {
 	return JetStreamMaxStoreDefault
 }
+
+// diskTotal is not known on windows.
+func diskTotal(_ string) int64 {
+	return 0
+}
@@ -0,0 +1,66 @@
+// Copyright 2021 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "syscall"
+
+// Filesystem magic numbers from statfs(2).
+const (
+	tmpfsMagic = 0x01021994
+	ramfsMagic = 0x858458f6
+	nfsMagic   = 0x6969
+	smbMagic   = 0x517b
+	cifsMagic  = 0xff534d42
+	smb2Magic  = 0xfe534d42
+	afsMagic   = 0x5346414f
+	codaMagic  = 0x73757245
+)
+
+// volatileFilesystem returns the name of the RAM backed filesystem
+// holding dir, or an empty string if it is not on one.
+func volatileFilesystem(dir string) string {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return _EMPTY_
+	}
+	switch uint32(fs.Type) {
+	case tmpfsMagic:
+		return "tmpfs"
+	case ramfsMagic:
+		return "ramfs"
+	}
+	return _EMPTY_
+}
+
+// networkFilesystem returns the name of the network filesystem holding dir,
+// or an empty string if it is not on one we know to be unsafe for storage.
+func networkFilesystem(dir string) string {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return _EMPTY_
+	}
+	switch uint32(fs.Type) {
+	case nfsMagic:
+		return "nfs"
+	case smbMagic, smb2Magic:
+		return "smb"
+	case cifsMagic:
+		return "cifs"
+	case afsMagic:
+		return "afs"
+	case codaMagic:
+		return "coda"
+	}
+	return _EMPTY_
+}
@@ -179,9 +179,16 @@ var (
 	// ErrJetStreamNotEnabled is returned when JetStream is not enabled.
 	ErrJetStreamNotEnabled = errors.New("jetstream not enabled")
 
+	// ErrJetStreamAlreadyEnabled is returned when JetStream is enabled more than once,
+	// either for the server or an account.
+	ErrJetStreamAlreadyEnabled = errors.New("jetstream already enabled")
+
 	// ErrJetStreamStreamNotFound is returned when a stream can not be found.
 	ErrJetStreamStreamNotFound = errors.New("stream not found")
 
+	// ErrJetStreamConsumerNotFound is returned when a consumer can not be found.
+	ErrJetStreamConsumerNotFound = errors.New("consumer not found")
+
 	// ErrJetStreamStreamAlreadyUsed is returned when a stream name has already been taken.
 	ErrJetStreamStreamAlreadyUsed = errors.New("stream name already in use")
 
@@ -196,6 +203,51 @@ var (
 
 	// ErrJetStreamNotClustered is returned when a call requires clustering and we are not.
 	ErrJetStreamNotClustered = errors.New("jetstream not in clustered mode")
+
+	// ErrJetStreamInsufficientMemory is returned when there are not enough memory resources available.
+	ErrJetStreamInsufficientMemory = errors.New("insufficient memory resources available")
+
+	// ErrJetStreamInsufficientStorage is returned when there are not enough storage resources available.
+	ErrJetStreamInsufficientStorage = errors.New("insufficient storage resources available")
+
+	// ErrMaxHeaderSize is returned when the headers of a message exceed the account limit.
+	ErrMaxHeaderSize = errors.New("message header size exceeds maximum allowed")
+
+	// ErrJetStreamReadOnly is returned when file based storage is unavailable due to lack of space.
+	ErrJetStreamReadOnly = errors.New("jetstream is in read only mode")
+
+	// ErrJetStreamAPIBusy is returned when an account has too many JetStream API requests in progress.
+	ErrJetStreamAPIBusy = errors.New("too many concurrent jetstream api requests")
+
+	// ErrJetStreamStreamSealed is returned when trying to change the messages of a sealed stream.
+	ErrJetStreamStreamSealed = errors.New("stream is sealed")
+
+	// ErrJetStreamSnapshotNotFound is returned when canceling a snapshot that is not in progress.
+	ErrJetStreamSnapshotNotFound = errors.New("snapshot not found")
+
+	// ErrJetStreamSnapshotCanceled is returned when reading from a snapshot that was canceled.
+	ErrJetStreamSnapshotCanceled = errors.New("snapshot canceled")
+
+	// ErrJetStreamMaxTemplatesReached is returned when an account has reached its maximum number of stream templates.
+	ErrJetStreamMaxTemplatesReached = errors.New("maximum number of stream templates reached")
+
+	// ErrJetStreamMemoryOnly is returned when file storage is requested while JetStream is memory only.
+	ErrJetStreamMemoryOnly = errors.New("jetstream is memory only, file storage not available")
+
+	// ErrJetStreamResourceGroupExists is returned when creating a resource group that already exists.
+	ErrJetStreamResourceGroupExists = errors.New("resource group already exists")
+
+	// ErrJetStreamResourceGroupNotFound is returned when a resource group can not be found.
+	ErrJetStreamResourceGroupNotFound = errors.New("resource group not found")
+
+	// ErrJetStreamInvalidStoreDir is returned when the storage directory can not be used.
+	ErrJetStreamInvalidStoreDir = errors.New("invalid jetstream storage directory")
+
+	// ErrJetStreamNetworkStoreDir is returned when the storage directory is on a network filesystem.
+	ErrJetStreamNetworkStoreDir = errors.New("jetstream storage directory is on a network filesystem")
+
+	// ErrJetStreamMemoryLimitTooLarge is returned when MaxMemory is far beyond the system's memory.
+	ErrJetStreamMemoryLimitTooLarge = errors.New("jetstream max memory is too large")
 )
 
 // configErr is a configuration error.
@@ -17,6 +17,9 @@ import (
 	"archive/tar"
 	"bufio"
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
@@ -33,6 +36,7 @@ import (
 	"sort"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/klauspost/compress/s2"
@@ -48,12 +52,20 @@ type FileStoreConfig struct {
 	CacheExpire time.Duration
 	// SyncInterval is how often we sync to disk in the background.
 	SyncInterval time.Duration
+
+	// Optional cipher used to encrypt new stores at rest.
+	aek cipher.AEAD
 }
 
 // FileStreamInfo allows us to remember created time.
 type FileStreamInfo struct {
 	Created time.Time
 	StreamConfig
+	// Name of the directory the stream is stored in.
+	dir string
+	// Set once a message with a TTL has been stored, so recovery
+	// only scans the messages for TTLs when there can be any.
+	msgTTLs bool
 }
 
 // Need an alias (which does not have MarshalJSON/UnmarshalJSON) to avoid
@@ -65,8 +77,10 @@ type fileStreamInfoAlias FileStreamInfo
 // and makes the non-public options public so they can be persisted/recovered.
 type fileStreamInfoJSON struct {
 	fileStreamInfoAlias
-	Internal       bool `json:"internal,omitempty"`
-	AllowNoSubject bool `json:"allow_no_subject,omitempty"`
+	Internal       bool   `json:"internal,omitempty"`
+	AllowNoSubject bool   `json:"allow_no_subject,omitempty"`
+	Dir            string `json:"dir,omitempty"`
+	MsgTTLs        bool   `json:"msg_ttls,omitempty"`
 }
 
 func (fsi FileStreamInfo) MarshalJSON() ([]byte, error) {
@@ -74,6 +88,8 @@ func (fsi FileStreamInfo) MarshalJSON() ([]byte, error) {
 		fileStreamInfoAlias(fsi),
 		fsi.internal,
 		fsi.allowNoSubject,
+		fsi.dir,
+		fsi.msgTTLs,
 	})
 }
 
@@ -85,6 +101,8 @@ func (fsi *FileStreamInfo) UnmarshalJSON(b []byte) error {
 	*fsi = FileStreamInfo(fsiJSON.fileStreamInfoAlias)
 	fsi.internal = fsiJSON.Internal
 	fsi.allowNoSubject = fsiJSON.AllowNoSubject
+	fsi.dir = fsiJSON.Dir
+	fsi.msgTTLs = fsiJSON.MsgTTLs
 	return nil
 }
 
@@ -125,6 +143,7 @@ type fileStore struct {
 	state    StreamState
 	scb      StorageUpdateHandler
 	ageChk   *time.Timer
+	ttls     msgTTLs
 	syncTmr  *time.Timer
 	cfg      FileStreamInfo
 	fcfg     FileStoreConfig
@@ -133,9 +152,21 @@ type fileStore struct {
 	hh       hash.Hash64
 	qch      chan struct{}
 	cfs      []*consumerFileStore
+	aek      cipher.AEAD
 	closed   bool
 	expiring bool
 	sips     int
+	fls      *flushStats
+	clock    *storeClock
+}
+
+// Tracks how message blocks are flushed to disk. Shared by all blocks
+// of a stream and accessed atomically.
+type flushStats struct {
+	size    int64
+	flushes uint64
+	bytes   uint64
+	last    int64
 }
 
 // Represents a message store block and its data.
@@ -155,6 +186,7 @@ type msgBlock struct {
 	llts    int64
 	lrts    int64
 	hh      hash.Hash64
+	aek     cipher.AEAD
 	cache   *cache
 	cloads  uint64
 	cexp    time.Duration
@@ -165,6 +197,8 @@ type msgBlock struct {
 	fch     chan struct{}
 	qch     chan struct{}
 	lchk    [8]byte
+	werr    error
+	fls     *flushStats
 }
 
 // Write through caching layer that is also used on loading messages.
@@ -265,6 +299,9 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 	if fcfg.CacheExpire == 0 {
 		fcfg.CacheExpire = defaultCacheBufferExpiration
 	}
+	if cfg.SyncInterval > 0 {
+		fcfg.SyncInterval = cfg.SyncInterval
+	}
 	if fcfg.SyncInterval == 0 {
 		fcfg.SyncInterval = defaultSyncInterval
 	}
@@ -289,9 +326,12 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 
 	fs := &fileStore{
 		fcfg: fcfg,
-		cfg:  FileStreamInfo{Created: created, StreamConfig: cfg},
+		cfg:  FileStreamInfo{Created: created, StreamConfig: cfg, dir: path.Base(fcfg.StoreDir)},
 		qch:  make(chan struct{}),
+		fls:  &flushStats{size: writeBufferSize(cfg.WriteBufferSize)},
 	}
+	fs.clock = jsClock
+	fs.ttls.clock = fs.clock
 
 	// Check if this is a new setup.
 	mdir := path.Join(fcfg.StoreDir, msgDir)
@@ -310,20 +350,41 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 		return nil, bootstrap, fmt.Errorf("could not create hash: %v", err)
 	}
 
+	// Existing stores keep whatever encryption they were created with, new ones
+	// will use the configured cipher if present.
+	meta := path.Join(fcfg.StoreDir, JetStreamMetaFile)
+	if buf, err := ioutil.ReadFile(meta); err == nil {
+		if isEncryptedMeta(buf) {
+			if buf, err = decryptMeta(fcfg.aek, buf); err != nil {
+				return nil, bootstrap, err
+			}
+			fs.aek = fcfg.aek
+		}
+		// Carry over what the store itself recorded.
+		var info FileStreamInfo
+		if err := json.Unmarshal(buf, &info); err == nil {
+			fs.cfg.msgTTLs = info.msgTTLs
+		}
+	} else {
+		fs.aek = fcfg.aek
+	}
+
 	// Recover our state.
 	if err := fs.recoverMsgs(); err != nil {
 		return nil, bootstrap, err
 	}
+	fs.recoverMsgTTLs()
 
 	// Write our meta data iff does not exist.
-	meta := path.Join(fcfg.StoreDir, JetStreamMetaFile)
 	if _, err := os.Stat(meta); err != nil && os.IsNotExist(err) {
 		if err := fs.writeStreamMeta(); err != nil {
 			return nil, bootstrap, err
 		}
 	}
 
-	fs.syncTmr = time.AfterFunc(fs.fcfg.SyncInterval, fs.syncBlocks)
+	if cfg.SyncPolicy != SyncNever {
+		fs.syncTmr = time.AfterFunc(fs.fcfg.SyncInterval, fs.syncBlocks)
+	}
 
 	return fs, bootstrap, nil
 }
@@ -341,7 +402,7 @@ func (fs *fileStore) UpdateConfig(cfg *StreamConfig) error {
 	}
 
 	fs.mu.Lock()
-	new_cfg := FileStreamInfo{Created: fs.cfg.Created, StreamConfig: *cfg}
+	new_cfg := FileStreamInfo{Created: fs.cfg.Created, StreamConfig: *cfg, dir: fs.cfg.dir, msgTTLs: fs.cfg.msgTTLs}
 	old_cfg := fs.cfg
 	fs.cfg = new_cfg
 	if err := fs.writeStreamMeta(); err != nil {
@@ -349,17 +410,38 @@ func (fs *fileStore) UpdateConfig(cfg *StreamConfig) error {
 		fs.mu.Unlock()
 		return err
 	}
-	// Limits checks and enforcement.
-	fs.enforceMsgLimit()
-	fs.enforceBytesLimit()
+	atomic.StoreInt64(&fs.fls.size, writeBufferSize(cfg.WriteBufferSize))
+	// Sealed streams never remove messages, so no limits or timers.
+	if cfg.Sealed {
+		fs.ttls.stop()
+	} else {
+		// Limits checks and enforcement.
+		fs.enforceMsgLimit()
+		fs.enforceBytesLimit()
+	}
 	// Do age timers.
-	if fs.ageChk == nil && fs.cfg.MaxAge != 0 {
+	if fs.ageChk == nil && fs.cfg.MaxAge != 0 && !cfg.Sealed {
 		fs.startAgeChk()
 	}
-	if fs.ageChk != nil && fs.cfg.MaxAge == 0 {
+	if fs.ageChk != nil && (fs.cfg.MaxAge == 0 || cfg.Sealed) {
 		fs.ageChk.Stop()
 		fs.ageChk = nil
 	}
+	// Restart background syncs to pick up any changes.
+	if old_cfg.SyncPolicy != cfg.SyncPolicy || old_cfg.SyncInterval != cfg.SyncInterval {
+		if cfg.SyncInterval > 0 {
+			fs.fcfg.SyncInterval = cfg.SyncInterval
+		} else if old_cfg.SyncInterval > 0 {
+			fs.fcfg.SyncInterval = defaultSyncInterval
+		}
+		if fs.syncTmr != nil {
+			fs.syncTmr.Stop()
+			fs.syncTmr = nil
+		}
+		if cfg.SyncPolicy != SyncNever {
+			fs.syncTmr = time.AfterFunc(fs.fcfg.SyncInterval, fs.syncBlocks)
+		}
+	}
 	fs.mu.Unlock()
 
 	if cfg.MaxAge != 0 {
@@ -404,6 +486,11 @@ func (fs *fileStore) writeStreamMeta() error {
 	if err != nil {
 		return err
 	}
+	if fs.aek != nil {
+		if b, err = encryptMeta(fs.aek, b); err != nil {
+			return err
+		}
+	}
 	if err := ioutil.WriteFile(meta, b, 0644); err != nil {
 		return err
 	}
@@ -426,7 +513,7 @@ const indexHdrSize = 7*binary.MaxVarintLen64 + hdrLen + checksumSize
 func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint64) *msgBlock {
 	var le = binary.LittleEndian
 
-	mb := &msgBlock{index: index, cexp: fs.fcfg.CacheExpire}
+	mb := &msgBlock{index: index, cexp: fs.fcfg.CacheExpire, aek: fs.aek, fls: fs.fls}
 
 	mdir := path.Join(fs.fcfg.StoreDir, msgDir)
 	mb.mfn = path.Join(mdir, fi.Name())
@@ -625,7 +712,11 @@ func (fs *fileStore) RegisterStorageUpdates(cb StorageUpdateHandler) {
 // Helper to get hash key for specific message block.
 // Lock should be held
 func (fs *fileStore) hashKeyForBlock(index uint64) []byte {
-	return []byte(fmt.Sprintf("%s-%d", fs.cfg.Name, index))
+	return blockHashKey(fs.cfg.Name, index)
+}
+
+func blockHashKey(name string, index uint64) []byte {
+	return []byte(fmt.Sprintf("%s-%d", name, index))
 }
 
 // This rolls to a new append msg block.
@@ -636,7 +727,7 @@ func (fs *fileStore) newMsgBlockForWrite() (*msgBlock, error) {
 		index = fs.lmb.index + 1
 	}
 
-	mb := &msgBlock{index: index, cexp: fs.fcfg.CacheExpire}
+	mb := &msgBlock{index: index, cexp: fs.fcfg.CacheExpire, aek: fs.aek, fls: fs.fls}
 
 	// Now do local hash.
 	key := sha256.Sum256(fs.hashKeyForBlock(index))
@@ -725,6 +816,35 @@ func (fs *fileStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts in
 		return ErrSequenceMismatch
 	}
 
+	// Record in our meta data that messages may have a TTL before the first one is stored.
+	if !fs.cfg.msgTTLs && len(hdr) > 0 {
+		if ttl, _ := getMsgTTL(hdr); ttl > 0 {
+			fs.cfg.msgTTLs = true
+			if err := fs.writeStreamMeta(); err != nil {
+				fs.cfg.msgTTLs = false
+				return err
+			}
+		}
+	}
+
+	// Encrypt the subject and payload if needed.
+	ohdr := hdr
+	if fs.aek != nil {
+		esubj, err := encryptBuf(fs.aek, []byte(subj))
+		if err != nil {
+			return err
+		}
+		subj = string(esubj)
+		if len(hdr) > 0 {
+			if hdr, err = encryptBuf(fs.aek, hdr); err != nil {
+				return err
+			}
+		}
+		if msg, err = encryptBuf(fs.aek, msg); err != nil {
+			return err
+		}
+	}
+
 	// Write msg record.
 	n, err := fs.writeMsgRecord(seq, ts, subj, hdr, msg)
 	if err != nil {
@@ -753,6 +873,8 @@ func (fs *fileStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts in
 	if fs.ageChk == nil && fs.cfg.MaxAge != 0 {
 		fs.startAgeChk()
 	}
+	// Messages can also carry their own TTL.
+	fs.ttls.track(seq, ts, ohdr, fs.expireMsgTTLs)
 
 	return nil
 }
@@ -761,11 +883,18 @@ func (fs *fileStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts in
 func (fs *fileStore) StoreRawMsg(subj string, hdr, msg []byte, seq uint64, ts int64) error {
 	fs.mu.Lock()
 	err := fs.storeRawMsg(subj, hdr, msg, seq, ts)
-	cb := fs.scb
+	var serr error
+	if err == nil {
+		serr = fs.syncIfAlways()
+	}
+	cb, sz := fs.scb, fs.recordSize(subj, hdr, msg)
 	fs.mu.Unlock()
 
 	if err == nil && cb != nil {
-		cb(1, int64(fileStoreMsgSize(subj, hdr, msg)), seq, subj)
+		cb(1, int64(sz), seq, subj)
+	}
+	if serr != nil {
+		return fs.removeUnsyncedMsg(seq, serr)
 	}
 
 	return err
@@ -774,20 +903,43 @@ func (fs *fileStore) StoreRawMsg(subj string, hdr, msg []byte, seq uint64, ts in
 // Store stores a message. We hold the main filestore lock for any write operation.
 func (fs *fileStore) StoreMsg(subj string, hdr, msg []byte) (uint64, int64, error) {
 	fs.mu.Lock()
-	seq, ts := fs.state.LastSeq+1, time.Now().UnixNano()
+	seq, ts := fs.state.LastSeq+1, wallClock()
 	err := fs.storeRawMsg(subj, hdr, msg, seq, ts)
-	cb := fs.scb
+	var serr error
+	if err == nil {
+		serr = fs.syncIfAlways()
+	}
+	cb, sz := fs.scb, fs.recordSize(subj, hdr, msg)
 	fs.mu.Unlock()
 
 	if err != nil {
 		seq, ts = 0, 0
 	} else if cb != nil {
-		cb(1, int64(fileStoreMsgSize(subj, hdr, msg)), seq, subj)
+		cb(1, int64(sz), seq, subj)
+	}
+	if serr != nil {
+		return 0, 0, fs.removeUnsyncedMsg(seq, serr)
 	}
 
 	return seq, ts, err
 }
 
+// Syncs the last message block if our sync policy is SyncAlways.
+// Lock should be held.
+func (fs *fileStore) syncIfAlways() error {
+	if fs.cfg.SyncPolicy != SyncAlways || fs.lmb == nil {
+		return nil
+	}
+	return fs.lmb.syncPendingMsgs()
+}
+
+// A stored message could not be synced to disk, so we remove it to make sure
+// it is never delivered. The sequence is not reused. Returns the sync error.
+func (fs *fileStore) removeUnsyncedMsg(seq uint64, err error) error {
+	fs.removeMsg(seq, false)
+	return fmt.Errorf("message could not be synced: %w", err)
+}
+
 // skipMsg will update this message block for a skipped message.
 // If we do not have any messages, just update the metadata, otherwise
 // we will place and empty record marking the sequence as used. The
@@ -1118,6 +1270,42 @@ func (mb *msgBlock) clearInFlusher() {
 }
 
 // flushLoop watches for messages, index info, or recently closed msg block updates.
+// Returns the configured write buffer size, or the default if not set.
+func writeBufferSize(size int) int64 {
+	if size <= 0 {
+		return coalesceMinimum
+	}
+	return int64(size)
+}
+
+// Returns how many pending bytes we try to coalesce before flushing.
+func (mb *msgBlock) writeBufferSize() int {
+	if mb.fls == nil {
+		return coalesceMinimum
+	}
+	return int(atomic.LoadInt64(&mb.fls.size))
+}
+
+// Returns the flush stats for this store.
+func (fs *fileStore) flushStats() *StreamFlushStats {
+	fs.mu.RLock()
+	lmb := fs.lmb
+	fs.mu.RUnlock()
+
+	stats := &StreamFlushStats{
+		BufferSize: int(atomic.LoadInt64(&fs.fls.size)),
+		Flushes:    atomic.LoadUint64(&fs.fls.flushes),
+		Bytes:      atomic.LoadUint64(&fs.fls.bytes),
+	}
+	if lmb != nil {
+		stats.Buffered = lmb.pendingWriteSize()
+	}
+	if last := atomic.LoadInt64(&fs.fls.last); last != 0 {
+		stats.Last = time.Unix(0, last).UTC()
+	}
+	return stats
+}
+
 func (mb *msgBlock) flushLoop(fch, qch chan struct{}) {
 	mb.setInFlusher()
 	defer mb.clearInFlusher()
@@ -1146,7 +1334,7 @@ func (mb *msgBlock) flushLoop(fch, qch chan struct{}) {
 				ts := 1 * time.Millisecond
 				var waited time.Duration
 
-				for waiting < coalesceMinimum {
+				for wbs := mb.writeBufferSize(); waiting < wbs; {
 					time.Sleep(ts)
 					select {
 					case <-qch:
@@ -1461,7 +1649,7 @@ func (fs *fileStore) expireMsgsLocked() {
 func (fs *fileStore) expireMsgs() {
 	// Make sure this is only running one at a time.
 	fs.mu.Lock()
-	if fs.expiring {
+	if fs.expiring || fs.cfg.Sealed {
 		fs.mu.Unlock()
 		return
 	}
@@ -1474,7 +1662,7 @@ func (fs *fileStore) expireMsgs() {
 		fs.mu.Unlock()
 	}()
 
-	now := time.Now().UnixNano()
+	now := fs.clock.now()
 	minAge := now - int64(fs.cfg.MaxAge)
 
 	for {
@@ -1489,7 +1677,7 @@ func (fs *fileStore) expireMsgs() {
 					fs.ageChk = nil
 				}
 			} else {
-				fireIn := time.Duration(sm.ts-now) + fs.cfg.MaxAge
+				fireIn := ageCheckIn(sm.ts, now, fs.cfg.MaxAge)
 				if fs.ageChk != nil {
 					fs.ageChk.Reset(fireIn)
 				} else {
@@ -1502,6 +1690,58 @@ func (fs *fileStore) expireMsgs() {
 	}
 }
 
+// Will expire msgs whose own TTL has elapsed.
+func (fs *fileStore) expireMsgTTLs() {
+	fs.mu.Lock()
+	if fs.closed || fs.cfg.Sealed {
+		fs.mu.Unlock()
+		return
+	}
+	seqs := fs.ttls.expired(fs.clock.now())
+	fs.mu.Unlock()
+
+	var retry []uint64
+	for _, seq := range seqs {
+		if _, err := fs.removeMsg(seq, false); err == ErrStoreSnapshotInProgress {
+			retry = append(retry, seq)
+		}
+	}
+
+	fs.mu.Lock()
+	if !fs.closed {
+		// Try again shortly for any we could not remove during a snapshot.
+		dl := fs.clock.now() + int64(time.Second)
+		for _, seq := range retry {
+			fs.ttls.dls[seq] = dl
+		}
+		fs.ttls.reset(fs.expireMsgTTLs)
+	}
+	fs.mu.Unlock()
+}
+
+// Per message TTLs are not part of the block index, so rebuild them
+// from the message headers on recovery.
+// Lock should NOT be held.
+func (fs *fileStore) recoverMsgTTLs() {
+	fs.mu.RLock()
+	first, last := fs.state.FirstSeq, fs.state.LastSeq
+	msgs, msgTTLs := fs.state.Msgs, fs.cfg.msgTTLs
+	fs.mu.RUnlock()
+
+	if msgs == 0 || !msgTTLs {
+		return
+	}
+	for seq := first; seq <= last; seq++ {
+		sm, _ := fs.msgForSeq(seq)
+		if sm == nil || len(sm.hdr) == 0 {
+			continue
+		}
+		fs.mu.Lock()
+		fs.ttls.track(seq, sm.ts, sm.hdr, fs.expireMsgTTLs)
+		fs.mu.Unlock()
+	}
+}
+
 // Check all the checksums for a message block.
 func checkMsgBlockFile(fp *os.File, hh hash.Hash) []uint64 {
 	var le = binary.LittleEndian
@@ -1581,6 +1821,290 @@ func (fs *fileStore) checkMsgs() []uint64 {
 	return bad
 }
 
+// Compacts all blocks that are no longer written to, verifies and rewrites the
+// checksums of the messages in them and recomputes the state from the blocks.
+// The store is only locked while compacting a single block, so new messages
+// are stored in between.
+func (fs *fileStore) maintain(rep *MaintenanceReport) error {
+	fs.mu.Lock()
+	if err := fs.canMaintain(); err != nil {
+		fs.mu.Unlock()
+		return err
+	}
+	fs.checkAndFlushAllBlocks()
+	blks := append([]*msgBlock(nil), fs.blks...)
+	lmb := fs.lmb
+	fs.mu.Unlock()
+
+	for _, mb := range blks {
+		if mb == lmb {
+			continue
+		}
+		fs.mu.Lock()
+		if err := fs.canMaintain(); err != nil {
+			fs.mu.Unlock()
+			return err
+		}
+		// Skip blocks removed since we started.
+		var err error
+		for _, b := range fs.blks {
+			if b == mb {
+				err = mb.compact(rep)
+				break
+			}
+		}
+		fs.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	fs.mu.Lock()
+	if err := fs.canMaintain(); err != nil {
+		fs.mu.Unlock()
+		return err
+	}
+	var msgs, bytes uint64
+	for _, mb := range fs.blks {
+		mb.mu.RLock()
+		msgs, bytes = msgs+mb.msgs, bytes+mb.bytes
+		mb.mu.RUnlock()
+	}
+
+	var md, bd int64
+	if msgs != fs.state.Msgs || bytes != fs.state.Bytes {
+		rep.Anomalies = append(rep.Anomalies, fmt.Sprintf("stream state had %d msgs and %d bytes, but blocks hold %d msgs and %d bytes",
+			fs.state.Msgs, fs.state.Bytes, msgs, bytes))
+		md, bd = int64(msgs)-int64(fs.state.Msgs), int64(bytes)-int64(fs.state.Bytes)
+		fs.state.Msgs, fs.state.Bytes = msgs, bytes
+	}
+	err := fs.writeStreamMeta()
+	cb := fs.scb
+	fs.mu.Unlock()
+
+	if cb != nil && (md != 0 || bd != 0) {
+		cb(md, bd, 0, _EMPTY_)
+	}
+	return err
+}
+
+// Returns why the store can not be maintained right now, if at all.
+// Lock should be held.
+func (fs *fileStore) canMaintain() error {
+	if fs.closed {
+		return ErrStoreClosed
+	}
+	if fs.sips > 0 {
+		return ErrStoreSnapshotInProgress
+	}
+	return nil
+}
+
+// Rewrites the block without the space held by removed messages. These are kept
+// as empty records so the remaining messages can still be located by sequence.
+// Records before the first sequence are dropped. Messages that fail their checksum
+// are kept as is and reported.
+func (mb *msgBlock) compact(rep *MaintenanceReport) error {
+	var le = binary.LittleEndian
+
+	mb.mu.Lock()
+	buf, err := ioutil.ReadFile(mb.mfn)
+	if err != nil {
+		mb.mu.Unlock()
+		return err
+	}
+	var rewritten uint64
+	nbuf := make([]byte, 0, len(buf))
+	for index := 0; index < len(buf); {
+		if index+msgHdrSize > len(buf) {
+			rep.Anomalies = append(rep.Anomalies, fmt.Sprintf("block %d has a truncated record at offset %d", mb.index, index))
+			nbuf = append(nbuf, buf[index:]...)
+			break
+		}
+		hdr := buf[index : index+msgHdrSize]
+		rl := int(le.Uint32(hdr[0:]) &^ hbit)
+		hasHeaders := le.Uint32(hdr[0:])&hbit != 0
+		seq := le.Uint64(hdr[4:])
+		slen := int(le.Uint16(hdr[20:]))
+		dlen := rl - msgHdrSize
+		if rl < emptyRecordLen || index+rl > len(buf) || slen > dlen-8 || (hasHeaders && slen+4 > dlen-8) {
+			rep.Anomalies = append(rep.Anomalies, fmt.Sprintf("block %d has a bad record at offset %d", mb.index, index))
+			nbuf = append(nbuf, buf[index:]...)
+			break
+		}
+		rec := buf[index : index+rl]
+		index += rl
+
+		rseq := seq &^ ebit
+		if rseq < mb.first.seq {
+			continue
+		}
+		if _, deleted := mb.dmap[rseq]; deleted || seq == 0 || seq&ebit != 0 {
+			nbuf = append(nbuf, mb.emptyRecord(rseq)...)
+			continue
+		}
+
+		data := rec[msgHdrSize:]
+		mb.hh.Reset()
+		mb.hh.Write(hdr[4:20])
+		mb.hh.Write(data[:slen])
+		if hasHeaders {
+			mb.hh.Write(data[slen+4 : dlen-8])
+		} else {
+			mb.hh.Write(data[slen : dlen-8])
+		}
+		checksum := mb.hh.Sum(nil)
+		if !bytes.Equal(checksum, data[dlen-8:]) {
+			rep.Anomalies = append(rep.Anomalies, fmt.Sprintf("message %d in block %d failed its checksum", seq, mb.index))
+			nbuf = append(nbuf, rec...)
+			continue
+		}
+		nbuf = append(nbuf, rec[:rl-8]...)
+		nbuf = append(nbuf, checksum...)
+		rewritten++
+	}
+
+	if len(nbuf) == len(buf) {
+		mb.mu.Unlock()
+		return nil
+	}
+	tmp := mb.mfn + ".tmp"
+	if err := ioutil.WriteFile(tmp, nbuf, 0644); err != nil {
+		os.Remove(tmp)
+		mb.mu.Unlock()
+		return err
+	}
+	if err := os.Rename(tmp, mb.mfn); err != nil {
+		os.Remove(tmp)
+		mb.mu.Unlock()
+		return err
+	}
+	rep.BytesReclaimed += uint64(len(buf) - len(nbuf))
+	rep.ChecksumsRewritten += rewritten
+	if len(nbuf) >= len(mb.lchk) {
+		copy(mb.lchk[0:], nbuf[len(nbuf)-len(mb.lchk):])
+	}
+	// Any open file refers to the old block.
+	if mb.mfd != nil {
+		mb.mfd.Close()
+		if mb.mfd, err = os.OpenFile(mb.mfn, os.O_RDWR, 0644); err != nil {
+			mb.mfd = nil
+		}
+	}
+	mb.clearCacheAndOffset()
+	mb.mu.Unlock()
+
+	return mb.writeIndexInfo()
+}
+
+// Returns an empty record for a removed message.
+// Lock should be held.
+func (mb *msgBlock) emptyRecord(seq uint64) []byte {
+	var le = binary.LittleEndian
+	var rec [emptyRecordLen]byte
+	le.PutUint32(rec[0:], emptyRecordLen)
+	le.PutUint64(rec[4:], seq|ebit)
+	mb.hh.Reset()
+	mb.hh.Write(rec[4:20])
+	copy(rec[msgHdrSize:], mb.hh.Sum(nil))
+	return rec[:]
+}
+
+// Directory under a stream's directory holding message blocks that failed verification.
+const corruptDir = "corrupt"
+
+// verifyMsgBlockFile checks the checksum of every message in the block file and
+// returns the sequences that fail. Unlike checkMsgBlockFile it accounts for
+// message headers and skips records that no longer hold a message.
+func verifyMsgBlockFile(fp *os.File, hh hash.Hash) []uint64 {
+	var le = binary.LittleEndian
+	var hdr [msgHdrSize]byte
+	var bad []uint64
+
+	r := bufio.NewReaderSize(fp, 64*1024*1024)
+
+	for {
+		if _, err := io.ReadFull(r, hdr[0:]); err != nil {
+			break
+		}
+		rl := le.Uint32(hdr[0:])
+		hasHeaders := rl&hbit != 0
+		rl &^= hbit
+		seq := le.Uint64(hdr[4:])
+		slen := le.Uint16(hdr[20:])
+		dlen := int(rl) - msgHdrSize
+		if dlen < 0 || int(slen) > dlen || dlen > int(rl) {
+			bad = append(bad, seq)
+			break
+		}
+		data := make([]byte, dlen)
+		if _, err := io.ReadFull(r, data); err != nil {
+			bad = append(bad, seq)
+			break
+		}
+		// Erased and skipped records no longer hold a message.
+		if seq == 0 || seq&ebit != 0 {
+			continue
+		}
+		hh.Reset()
+		hh.Write(hdr[4:20])
+		hh.Write(data[:slen])
+		if hasHeaders {
+			hh.Write(data[slen+4 : dlen-8])
+		} else {
+			hh.Write(data[slen : dlen-8])
+		}
+		checksum := hh.Sum(nil)
+		if !bytes.Equal(checksum, data[len(data)-8:]) {
+			bad = append(bad, seq)
+		}
+	}
+	return bad
+}
+
+// verifyMsgBlocks checks the checksums of every message block of the stream name stored
+// in storeDir before it is opened. Blocks with corrupt messages are moved aside along
+// with their index so they will not be loaded, and are returned with the bad sequences.
+func verifyMsgBlocks(storeDir, name string) (map[string][]uint64, error) {
+	mdir := path.Join(storeDir, msgDir)
+	fis, err := ioutil.ReadDir(mdir)
+	if err != nil {
+		return nil, err
+	}
+	var corrupt map[string][]uint64
+	for _, fi := range fis {
+		var index uint64
+		if n, err := fmt.Sscanf(fi.Name(), blkScan, &index); err != nil || n != 1 {
+			continue
+		}
+		fp, err := os.Open(path.Join(mdir, fi.Name()))
+		if err != nil {
+			continue
+		}
+		key := sha256.Sum256(blockHashKey(name, index))
+		hh, _ := highwayhash.New64(key[:])
+		bad := verifyMsgBlockFile(fp, hh)
+		fp.Close()
+		if len(bad) == 0 {
+			continue
+		}
+		cdir := path.Join(storeDir, corruptDir)
+		if err := os.MkdirAll(cdir, 0755); err != nil {
+			return corrupt, err
+		}
+		if err := os.Rename(path.Join(mdir, fi.Name()), path.Join(cdir, fi.Name())); err != nil {
+			return corrupt, err
+		}
+		ifn := fmt.Sprintf(indexScan, index)
+		os.Rename(path.Join(mdir, ifn), path.Join(cdir, ifn))
+		if corrupt == nil {
+			corrupt = make(map[string][]uint64)
+		}
+		corrupt[fi.Name()] = bad
+	}
+	return corrupt, nil
+}
+
 // Will write the message record to the underlying message block.
 // filestore lock will be held.
 func (mb *msgBlock) writeMsgRecord(rl, seq uint64, subj string, mhdr, msg []byte, ts int64) {
@@ -1747,6 +2271,15 @@ func (fs *fileStore) writeMsgRecord(seq uint64, ts int64, subj string, hdr, msg
 	}
 	// Grab our current last message block.
 	mb := fs.lmb
+
+	// If we could not flush because we ran out of space, try again before
+	// accepting anything new. This is also how we recover once space is freed.
+	if mb != nil && isOutOfSpaceErr(mb.writeErr()) {
+		if err := mb.flushPendingMsgsAndWait(); isOutOfSpaceErr(err) {
+			return 0, ErrStoreNoSpace
+		}
+	}
+
 	if mb == nil || mb.numBytes()+rl > fs.fcfg.BlockSize {
 		if mb, err = fs.newMsgBlockForWrite(); err != nil {
 			return 0, err
@@ -1759,6 +2292,32 @@ func (fs *fileStore) writeMsgRecord(seq uint64, ts int64, subj string, hdr, msg
 	return rl, nil
 }
 
+// Returns the last error we had writing out this block, if any.
+func (mb *msgBlock) writeErr() error {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+	return mb.werr
+}
+
+// Determines if the error is due to the underlying storage being full.
+func isOutOfSpaceErr(err error) bool {
+	return err != nil && (err == ErrStoreNoSpace || errors.Is(err, syscall.ENOSPC))
+}
+
+// syncPendingMsgs writes out any messages for this message block and syncs them to disk.
+func (mb *msgBlock) syncPendingMsgs() error {
+	if err := mb.flushPendingMsgsAndWait(); err != nil {
+		return err
+	}
+	mb.mu.RLock()
+	mfd := mb.mfd
+	mb.mu.RUnlock()
+	if mfd != nil {
+		return mfd.Sync()
+	}
+	return nil
+}
+
 // Sync msg and index files as needed. This is called from a timer.
 func (fs *fileStore) syncBlocks() {
 	fs.mu.RLock()
@@ -1795,7 +2354,9 @@ func (fs *fileStore) syncBlocks() {
 	}
 
 	fs.mu.Lock()
-	fs.syncTmr = time.AfterFunc(fs.fcfg.SyncInterval, fs.syncBlocks)
+	if fs.cfg.SyncPolicy != SyncNever {
+		fs.syncTmr = time.AfterFunc(fs.fcfg.SyncInterval, fs.syncBlocks)
+	}
 	fs.mu.Unlock()
 }
 
@@ -1956,6 +2517,7 @@ func (mb *msgBlock) flushPendingMsgs() error {
 			// FIXME(dlc) - What is the correct behavior here?
 			mb.removeIndexFile()
 			mb.mu.Lock()
+			mb.werr = err
 			mb.clearFlushing()
 			mb.mu.Unlock()
 			return err
@@ -1972,11 +2534,18 @@ func (mb *msgBlock) flushPendingMsgs() error {
 	}
 
 	// We did a successful write.
+	if mb.fls != nil {
+		atomic.AddUint64(&mb.fls.flushes, 1)
+		atomic.AddUint64(&mb.fls.bytes, uint64(tn))
+		atomic.StoreInt64(&mb.fls.last, time.Now().UnixNano())
+	}
+
 	// Re-acquire lock to update.
 	mb.mu.Lock()
 	defer mb.mu.Unlock()
 	// Clear on exit.
 	defer mb.clearFlushing()
+	mb.werr = nil
 
 	// Cache may be gone.
 	if mb.cache == nil || mb.mfd == nil {
@@ -2167,6 +2736,23 @@ func (mb *msgBlock) cacheLookupWithLock(seq uint64) (*fileStoredMsg, error) {
 	if seq != mseq {
 		return nil, fmt.Errorf("sequence numbers for cache load did not match, %d vs %d", seq, mseq)
 	}
+	if mb.aek != nil {
+		dsubj, err := decryptBuf(mb.aek, []byte(subj))
+		if err != nil {
+			return nil, err
+		}
+		subj = string(dsubj)
+		if len(hdr) > 0 {
+			if hdr, err = decryptBuf(mb.aek, hdr); err != nil {
+				return nil, err
+			}
+		}
+		if len(msg) > 0 {
+			if msg, err = decryptBuf(mb.aek, msg); err != nil {
+				return nil, err
+			}
+		}
+	}
 	sm := &fileStoredMsg{
 		subj: subj,
 		hdr:  hdr,
@@ -2312,6 +2898,21 @@ func fileStoreMsgSize(subj string, hdr, msg []byte) uint64 {
 	return uint64(22 + len(subj) + 4 + len(hdr) + len(msg) + 8)
 }
 
+// Returns the size of the record as written, which includes any encryption overhead.
+// Lock should be held.
+func (fs *fileStore) recordSize(subj string, hdr, msg []byte) uint64 {
+	sz := fileStoreMsgSize(subj, hdr, msg)
+	if fs.aek != nil {
+		// Subject and message, and headers if present, are encrypted separately.
+		overhead := uint64(fs.aek.NonceSize() + fs.aek.Overhead())
+		if len(hdr) > 0 {
+			sz += overhead
+		}
+		sz += 2 * overhead
+	}
+	return sz
+}
+
 func fileStoreMsgSizeEstimate(slen, maxPayload int) uint64 {
 	return uint64(emptyRecordLen + slen + 4 + maxPayload)
 }
@@ -2788,6 +3389,23 @@ func (mb *msgBlock) close(sync bool) {
 	mb.ifd = nil
 }
 
+// closeFiles syncs and closes the block's files but keeps its state,
+// they will be reopened when needed.
+func (mb *msgBlock) closeFiles() {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	// Close cache
+	mb.clearCacheAndOffset()
+	// Quit our loops.
+	if mb.qch != nil {
+		close(mb.qch)
+		mb.qch = nil
+	}
+	syncAndClose(mb.mfd, mb.ifd)
+	mb.mfd, mb.ifd = nil, nil
+}
+
 func (fs *fileStore) closeAllMsgBlocks(sync bool) {
 	for _, mb := range fs.blks {
 		mb.close(sync)
@@ -2825,6 +3443,7 @@ func (fs *fileStore) Stop() error {
 		fs.ageChk.Stop()
 		fs.ageChk = nil
 	}
+	fs.ttls.stop()
 
 	var _cfs [256]*consumerFileStore
 	cfs := append(_cfs[:0], fs.cfs...)
@@ -2838,6 +3457,44 @@ func (fs *fileStore) Stop() error {
 	return nil
 }
 
+// pause flushes and closes all files held open by the store and its consumers,
+// and holds the store until resume is called so that its directory can be moved.
+// Consumers are not held, their state is written again when the store resumes.
+func (fs *fileStore) pause() error {
+	fs.mu.Lock()
+	if fs.closed {
+		fs.mu.Unlock()
+		return ErrStoreClosed
+	}
+	fs.checkAndFlushAllBlocks()
+	for _, mb := range fs.blks {
+		mb.closeFiles()
+	}
+	for _, o := range fs.cfs {
+		o.closeStateFile()
+	}
+	return nil
+}
+
+// resume releases a store held by pause. Files are reopened from wherever
+// the store's directory is now.
+func (fs *fileStore) resume() error {
+	var err error
+	if fs.lmb != nil {
+		err = fs.enableLastMsgBlockForWriting()
+	}
+	var _cfs [256]*consumerFileStore
+	cfs := append(_cfs[:0], fs.cfs...)
+	fs.mu.Unlock()
+
+	// Consumers may have written to the old location while we were held.
+	for _, o := range cfs {
+		o.closeStateFile()
+		o.kickFlusher()
+	}
+	return err
+}
+
 const errFile = "errors.txt"
 
 // Stream our snapshot through S2 compression and tar.
@@ -3423,6 +4080,23 @@ func (o *consumerFileStore) writeState(buf []byte) error {
 	return err
 }
 
+// Will discard any state, including what has been written to disk.
+// Only used when our stored state could not be recovered.
+func (o *consumerFileStore) resetState() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.state = ConsumerState{}
+	if o.ifd != nil {
+		o.ifd.Close()
+		o.ifd = nil
+	}
+	o.lwsz = 0
+	if err := os.Remove(o.ifn); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
 // Will upodate the config. Only used when recovering ephemerals.
 func (o *consumerFileStore) updateConfig(cfg ConsumerConfig) error {
 	o.mu.Lock()
@@ -3442,6 +4116,11 @@ func (cfs *consumerFileStore) writeConsumerMeta() error {
 	if err != nil {
 		return err
 	}
+	if aek := cfs.fs.aek; aek != nil {
+		if b, err = encryptMeta(aek, b); err != nil {
+			return err
+		}
+	}
 	if err := ioutil.WriteFile(meta, b, 0644); err != nil {
 		return err
 	}
@@ -3465,6 +4144,19 @@ func (o *consumerFileStore) syncStateFile() {
 	o.mu.Unlock()
 }
 
+// closeStateFile syncs and closes the state file, it is reopened on the next write.
+func (o *consumerFileStore) closeStateFile() {
+	o.mu.Lock()
+	ifd := o.ifd
+	o.ifd = nil
+	o.mu.Unlock()
+
+	if ifd != nil {
+		ifd.Sync()
+		ifd.Close()
+	}
+}
+
 // Lock should be held.
 func (o *consumerFileStore) ensureStateFileOpen() error {
 	if o.ifd == nil {
@@ -3753,16 +4445,17 @@ func (fs *fileStore) removeConsumer(cfs *consumerFileStore) {
 type templateFileStore struct {
 	dir string
 	hh  hash.Hash64
+	aek cipher.AEAD
 }
 
-func newTemplateFileStore(storeDir string) *templateFileStore {
+func newTemplateFileStore(storeDir string, aek cipher.AEAD) *templateFileStore {
 	tdir := path.Join(storeDir, tmplsDir)
 	key := sha256.Sum256([]byte("templates"))
 	hh, err := highwayhash.New64(key[:])
 	if err != nil {
 		return nil
 	}
-	return &templateFileStore{dir: tdir, hh: hh}
+	return &templateFileStore{dir: tdir, hh: hh, aek: aek}
 }
 
 func (ts *templateFileStore) Store(t *StreamTemplate) error {
@@ -3771,12 +4464,10 @@ func (ts *templateFileStore) Store(t *StreamTemplate) error {
 		return fmt.Errorf("could not create templates storage directory for %q- %v", t.Name, err)
 	}
 	meta := path.Join(dir, JetStreamMetaFile)
-	if _, err := os.Stat(meta); (err != nil && !os.IsNotExist(err)) || err == nil {
+	if _, err := os.Stat(meta); err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	t.mu.Lock()
-	b, err := json.MarshalIndent(t, _EMPTY_, "  ")
-	t.mu.Unlock()
+	b, err := ts.encodeMeta(t)
 	if err != nil {
 		return err
 	}
@@ -3797,3 +4488,97 @@ func (ts *templateFileStore) Store(t *StreamTemplate) error {
 func (ts *templateFileStore) Delete(t *StreamTemplate) error {
 	return os.RemoveAll(path.Join(ts.dir, t.Name))
 }
+
+// Size returns the number of bytes the template's meta and checksum
+// files take up on disk.
+func (ts *templateFileStore) Size(t *StreamTemplate) (int64, error) {
+	b, err := ts.encodeMeta(t)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(b) + 2*ts.hh.Size()), nil
+}
+
+// Returns the contents of the template's meta file, encrypted if needed.
+func (ts *templateFileStore) encodeMeta(t *StreamTemplate) ([]byte, error) {
+	t.mu.Lock()
+	b, err := json.MarshalIndent(t, _EMPTY_, "  ")
+	t.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if ts.aek != nil {
+		if b, err = encryptMeta(ts.aek, b); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Encryption at rest
+////////////////////////////////////////////////////////////////////////////////
+
+// Metafiles that are encrypted will start with this prefix. Plaintext
+// metafiles are JSON and can never start with our magic byte.
+var encMetaPrefix = []byte{magic, 'E', 'N', 'C'}
+
+// Create an AES-GCM cipher from the given key.
+// Key needs to be 16, 24 or 32 bytes to select AES-128, AES-192 or AES-256.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypts buf with a random nonce that is prepended to the result.
+func encryptBuf(aek cipher.AEAD, buf []byte) ([]byte, error) {
+	ns := aek.NonceSize()
+	nonce := make([]byte, ns, ns+len(buf)+aek.Overhead())
+	if _, err := io.ReadFull(crand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("unable to generate nonce: %v", err)
+	}
+	return aek.Seal(nonce, nonce, buf, nil), nil
+}
+
+// Reverses encryptBuf.
+func decryptBuf(aek cipher.AEAD, buf []byte) ([]byte, error) {
+	ns := aek.NonceSize()
+	if len(buf) < ns+aek.Overhead() {
+		return nil, ErrStoreEncryptionKeyInvalid
+	}
+	out, err := aek.Open(nil, buf[:ns], buf[ns:], nil)
+	if err != nil {
+		return nil, ErrStoreEncryptionKeyInvalid
+	}
+	return out, nil
+}
+
+func isEncryptedMeta(buf []byte) bool {
+	return bytes.HasPrefix(buf, encMetaPrefix)
+}
+
+func encryptMeta(aek cipher.AEAD, buf []byte) ([]byte, error) {
+	if aek == nil {
+		return nil, ErrStoreEncryptionKeyRequired
+	}
+	ebuf, err := encryptBuf(aek, buf)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, encMetaPrefix...), ebuf...), nil
+}
+
+// Will return the plaintext for a metafile. Metafiles that were
+// never encrypted are returned as is.
+func decryptMeta(aek cipher.AEAD, buf []byte) ([]byte, error) {
+	if !isEncryptedMeta(buf) {
+		return buf, nil
+	}
+	if aek == nil {
+		return nil, ErrStoreEncryptionKeyRequired
+	}
+	return decryptBuf(aek, buf[len(encMetaPrefix):])
+}
@@ -1017,6 +1017,86 @@ func TestFileStoreAgeLimitRecovery(t *testing.T) {
 	})
 }
 
+func TestFileStoreMsgTTLRecovery(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	fs, _, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, StreamConfig{Name: "zzz", Storage: FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	subj, msg := "foo", []byte("Hello World")
+	hdr := []byte("NATS/1.0\r\nNats-TTL: 250ms\r\n\r\n")
+	fs.StoreMsg(subj, nil, msg)
+	fs.StoreMsg(subj, hdr, msg)
+	fs.StoreMsg(subj, nil, msg)
+	fs.Stop()
+
+	fs, _, err = newFileStore(FileStoreConfig{StoreDir: storeDir}, StreamConfig{Name: "zzz", Storage: FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	// The message with a TTL should still expire after recovery.
+	checkFor(t, time.Second, 50*time.Millisecond, func() error {
+		state := fs.State()
+		if state.Msgs != 2 {
+			return fmt.Errorf("Expected 2 msgs, got %d", state.Msgs)
+		}
+		if len(state.Deleted) != 1 || state.Deleted[0] != 2 {
+			return fmt.Errorf("Expected msg 2 to be deleted, got %v", state.Deleted)
+		}
+		return nil
+	})
+}
+
+func TestFileStoreMsgTTLRecoveryOnlyWhenUsed(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	fs, _, err := newFileStore(FileStoreConfig{StoreDir: storeDir, BlockSize: 1024}, StreamConfig{Name: "zzz", Storage: FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	subj, msg := "foo", []byte("Hello World")
+	for i := 0; i < 100; i++ {
+		fs.StoreMsg(subj, nil, msg)
+	}
+	fs.Stop()
+
+	fs, _, err = newFileStore(FileStoreConfig{StoreDir: storeDir, BlockSize: 1024}, StreamConfig{Name: "zzz", Storage: FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	// Without any TTLs the messages are not loaded to look for them.
+	if cl := fs.cacheLoads(); cl != 0 {
+		t.Fatalf("Expected no cache loads on recovery, got %d", cl)
+	}
+
+	// Once a message has a TTL the store remembers to look.
+	fs.StoreMsg(subj, []byte("NATS/1.0\r\nNats-TTL: 1h\r\n\r\n"), msg)
+	fs.Stop()
+	fs, _, err = newFileStore(FileStoreConfig{StoreDir: storeDir, BlockSize: 1024}, StreamConfig{Name: "zzz", Storage: FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	fs.mu.RLock()
+	_, ok := fs.ttls.dls[101]
+	fs.mu.RUnlock()
+	if !ok {
+		t.Fatalf("Expected the TTL of msg 101 to be recovered")
+	}
+}
+
 func TestFileStoreBitRot(t *testing.T) {
 	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
 	os.MkdirAll(storeDir, 0755)
@@ -1289,6 +1369,99 @@ func TestFileStoreMeta(t *testing.T) {
 	}
 }
 
+func TestFileStoreEncrypted(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	os.MkdirAll(storeDir, 0755)
+	defer os.RemoveAll(storeDir)
+
+	aek, err := newAEAD([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fcfg := FileStoreConfig{StoreDir: storeDir, aek: aek}
+	mconfig := StreamConfig{Name: "zzz", Storage: FileStorage}
+
+	fs, _, err := newFileStore(fcfg, mconfig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	subj, hdr, msg := "secret.subject", []byte("name:derek"), []byte("Hello World")
+	toStore := 10
+	for i := 0; i < toStore; i++ {
+		fs.StoreMsg(subj, hdr, msg)
+	}
+	if _, err := fs.ConsumerStore("dlc", &ConsumerConfig{Durable: "dlc"}); err != nil {
+		t.Fatalf("Unexepected error: %v", err)
+	}
+	fs.Stop()
+
+	// Nothing should be in the clear on disk.
+	for _, fn := range []string{
+		path.Join(storeDir, msgDir, fmt.Sprintf(blkScan, 1)),
+		path.Join(storeDir, JetStreamMetaFile),
+		path.Join(storeDir, consumerDir, "dlc", JetStreamMetaFile),
+	} {
+		buf, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatalf("Error reading %q: %v", fn, err)
+		}
+		if bytes.Contains(buf, msg) || bytes.Contains(buf, hdr) || bytes.Contains(buf, []byte(subj)) ||
+			bytes.Contains(buf, []byte("zzz")) || bytes.Contains(buf, []byte("dlc")) {
+			t.Fatalf("Expected %q to be encrypted", fn)
+		}
+	}
+
+	// Recover with the correct key.
+	fs, _, err = newFileStore(fcfg, mconfig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if state := fs.State(); state.Msgs != uint64(toStore) {
+		t.Fatalf("Expected %d msgs, got %d", toStore, state.Msgs)
+	}
+	ssubj, shdr, smsg, _, err := fs.LoadMsg(5)
+	if err != nil {
+		t.Fatalf("Unexpected error looking up msg: %v", err)
+	}
+	if ssubj != subj || !bytes.Equal(msg, smsg) || !bytes.Equal(hdr, shdr) {
+		t.Fatalf("Expected decrypted subject, msg and header, got %q, %q and %q", ssubj, smsg, shdr)
+	}
+	fs.Stop()
+
+	// Missing key.
+	if _, _, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, mconfig); err != ErrStoreEncryptionKeyRequired {
+		t.Fatalf("Expected missing key error, got %v", err)
+	}
+	// Wrong key.
+	wrong, _ := newAEAD([]byte("fedcba9876543210fedcba9876543210"))
+	if _, _, err := newFileStore(FileStoreConfig{StoreDir: storeDir, aek: wrong}, mconfig); err != ErrStoreEncryptionKeyInvalid {
+		t.Fatalf("Expected invalid key error, got %v", err)
+	}
+
+	// A plaintext store opened with a key stays plaintext.
+	pdir := path.Join(storeDir, "plain")
+	fs, _, err = newFileStore(FileStoreConfig{StoreDir: pdir}, mconfig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fs.StoreMsg(subj, nil, msg)
+	fs.Stop()
+
+	fs, _, err = newFileStore(FileStoreConfig{StoreDir: pdir, aek: aek}, mconfig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, _, smsg, _, err := fs.LoadMsg(1); err != nil || !bytes.Equal(msg, smsg) {
+		t.Fatalf("Expected plaintext msg, got %q: %v", smsg, err)
+	}
+	fs.StoreMsg(subj, nil, msg)
+	fs.Stop()
+	buf, _ := ioutil.ReadFile(path.Join(pdir, msgDir, fmt.Sprintf(blkScan, 1)))
+	if bytes.Count(buf, msg) != 2 {
+		t.Fatalf("Expected both msgs to be in plaintext")
+	}
+}
+
 func TestFileStoreWriteAndReadSameBlock(t *testing.T) {
 	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
 	os.MkdirAll(storeDir, 0755)
@@ -2551,3 +2724,378 @@ func TestFileStoreStreamIndexBug(t *testing.T) {
 		t.Fatalf("Expected error during readIndexInfo(): %v", err)
 	}
 }
+
+func TestFileStoreSyncPolicy(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	defer os.RemoveAll(storeDir)
+
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage, SyncPolicy: SyncAlways, SyncInterval: time.Minute}
+	fs, _, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	// Messages are written out before StoreMsg returns.
+	if _, _, err := fs.StoreMsg("foo", nil, []byte("Hello World")); err != nil {
+		t.Fatalf("Error storing msg: %v", err)
+	}
+	fs.mu.RLock()
+	mfn := fs.lmb.mfn
+	fs.mu.RUnlock()
+	if fi, err := os.Stat(mfn); err != nil || fi.Size() == 0 {
+		t.Fatalf("Expected message to be on disk, got %v", err)
+	}
+
+	// The policy is persisted with the stream.
+	buf, err := ioutil.ReadFile(path.Join(storeDir, JetStreamMetaFile))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var fsi FileStreamInfo
+	if err := json.Unmarshal(buf, &fsi); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if fsi.SyncPolicy != SyncAlways || fsi.SyncInterval != time.Minute {
+		t.Fatalf("Expected sync policy to be persisted, got %v every %v", fsi.SyncPolicy, fsi.SyncInterval)
+	}
+
+	// No background syncs when never syncing, and switching back restarts them.
+	cfg.SyncPolicy = SyncNever
+	if err := fs.UpdateConfig(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fs.mu.RLock()
+	noTimer := fs.syncTmr == nil
+	fs.mu.RUnlock()
+	if !noTimer {
+		t.Fatalf("Expected no sync timer with SyncNever")
+	}
+	cfg.SyncPolicy = SyncOnInterval
+	if err := fs.UpdateConfig(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fs.mu.RLock()
+	noTimer, ival := fs.syncTmr == nil, fs.fcfg.SyncInterval
+	fs.mu.RUnlock()
+	if noTimer || ival != time.Minute {
+		t.Fatalf("Expected a sync timer every minute, got %v", ival)
+	}
+
+	var sp SyncPolicy
+	if err := json.Unmarshal([]byte(`"bad"`), &sp); err == nil {
+		t.Fatalf("Expected an error for an unknown sync policy")
+	}
+}
+
+func TestFileStoreSyncAlwaysFailure(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	defer os.RemoveAll(storeDir)
+
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage, SyncPolicy: SyncAlways}
+	fs, _, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	if _, _, err := fs.StoreMsg("foo", nil, []byte("ok")); err != nil {
+		t.Fatalf("Error storing msg: %v", err)
+	}
+
+	// Swap in a closed file so the sync fails.
+	fs.mu.RLock()
+	mb := fs.lmb
+	fs.mu.RUnlock()
+	mb.mu.Lock()
+	mfd := mb.mfd
+	cfd, _ := os.Open(mb.mfn)
+	cfd.Close()
+	mb.mfd = cfd
+	mb.mu.Unlock()
+
+	if _, _, err := fs.StoreMsg("foo", nil, []byte("lost")); err == nil {
+		t.Fatalf("Expected an error when the sync fails")
+	}
+	// The message is not kept but its sequence is used.
+	if state := fs.State(); state.Msgs != 1 || state.LastSeq != 2 {
+		t.Fatalf("Expected 1 msg and last sequence 2, got %+v", state)
+	}
+	if _, _, _, _, err := fs.LoadMsg(2); err == nil {
+		t.Fatalf("Expected the unsynced message to be removed")
+	}
+
+	mb.mu.Lock()
+	mb.mfd = mfd
+	mb.mu.Unlock()
+
+	if seq, _, err := fs.StoreMsg("foo", nil, []byte("ok")); err != nil || seq != 3 {
+		t.Fatalf("Expected to store sequence 3, got %d: %v", seq, err)
+	}
+}
+
+func BenchmarkFileStoreSyncPolicy(b *testing.B) {
+	for _, sp := range []SyncPolicy{SyncOnInterval, SyncAlways, SyncNever} {
+		b.Run(sp.String(), func(b *testing.B) {
+			storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+			defer os.RemoveAll(storeDir)
+
+			fs, _, err := newFileStore(
+				FileStoreConfig{StoreDir: storeDir},
+				StreamConfig{Name: "zzz", Storage: FileStorage, SyncPolicy: sp})
+			if err != nil {
+				b.Fatalf("Unexpected error: %v", err)
+			}
+			defer fs.Stop()
+
+			msg := make([]byte, 128)
+			rand.Read(msg)
+			b.SetBytes(int64(len(msg)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := fs.StoreMsg("foo", nil, msg); err != nil {
+					b.Fatalf("Error storing msg: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFileStoreBlockSize(b *testing.B) {
+	for _, msz := range []int{16, 64 * 1024} {
+		for _, bc := range []struct {
+			name    string
+			blkSize uint64
+		}{
+			{"Default", 0},
+			{"Small", uint64(FileStoreMinBlkSize)},
+			{"Large", FileStoreMaxBlkSize},
+		} {
+			b.Run(fmt.Sprintf("%dB/%s", msz, bc.name), func(b *testing.B) {
+				storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+				defer os.RemoveAll(storeDir)
+
+				fs, _, err := newFileStore(
+					FileStoreConfig{StoreDir: storeDir, BlockSize: bc.blkSize},
+					StreamConfig{Name: "zzz", Storage: FileStorage})
+				if err != nil {
+					b.Fatalf("Unexpected error: %v", err)
+				}
+				defer fs.Stop()
+
+				msg := make([]byte, msz)
+				rand.Read(msg)
+				b.SetBytes(int64(msz))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, _, err := fs.StoreMsg("foo", nil, msg); err != nil {
+						b.Fatalf("Error storing msg: %v", err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestFileStoreWriteBufferSize(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	defer os.RemoveAll(storeDir)
+
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage, WriteBufferSize: 64 * 1024}
+	fs, _, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	if stats := fs.flushStats(); stats.BufferSize != 64*1024 || stats.Flushes != 0 || !stats.Last.IsZero() {
+		t.Fatalf("Unexpected initial flush stats: %+v", stats)
+	}
+
+	msg := []byte("Hello World")
+	for i := 0; i < 10; i++ {
+		if _, _, err := fs.StoreMsg("foo", nil, msg); err != nil {
+			t.Fatalf("Error storing msg: %v", err)
+		}
+	}
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		if stats := fs.flushStats(); stats.Flushes == 0 || stats.Buffered != 0 {
+			return fmt.Errorf("Expected messages to be flushed, got %+v", stats)
+		}
+		return nil
+	})
+	stats := fs.flushStats()
+	if stats.Bytes != fs.State().Bytes || stats.Last.IsZero() {
+		t.Fatalf("Expected %d bytes flushed, got %+v", fs.State().Bytes, stats)
+	}
+
+	// The size is persisted with the stream and can be updated.
+	buf, err := ioutil.ReadFile(path.Join(storeDir, JetStreamMetaFile))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var fsi FileStreamInfo
+	if err := json.Unmarshal(buf, &fsi); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if fsi.WriteBufferSize != 64*1024 {
+		t.Fatalf("Expected write buffer size to be persisted, got %d", fsi.WriteBufferSize)
+	}
+	cfg.WriteBufferSize = 0
+	if err := fs.UpdateConfig(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stats := fs.flushStats(); stats.BufferSize != coalesceMinimum {
+		t.Fatalf("Expected default buffer size of %d, got %d", coalesceMinimum, stats.BufferSize)
+	}
+}
+
+func BenchmarkFileStoreWriteBufferSize(b *testing.B) {
+	for _, wbs := range []int{0, 1024, 64 * 1024, 1024 * 1024} {
+		b.Run(fmt.Sprintf("%dB", wbs), func(b *testing.B) {
+			storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+			defer os.RemoveAll(storeDir)
+
+			fs, _, err := newFileStore(
+				FileStoreConfig{StoreDir: storeDir},
+				StreamConfig{Name: "zzz", Storage: FileStorage, WriteBufferSize: wbs})
+			if err != nil {
+				b.Fatalf("Unexpected error: %v", err)
+			}
+			defer fs.Stop()
+
+			msg := make([]byte, 128)
+			rand.Read(msg)
+			b.SetBytes(int64(len(msg)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := fs.StoreMsg("foo", nil, msg); err != nil {
+					b.Fatalf("Error storing msg: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestFileStoreMaintain(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 1024}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+	fs, _, err := newFileStoreWithCreated(fcfg, cfg, time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	msg := bytes.Repeat([]byte("Z"), 64)
+	for i := 0; i < 100; i++ {
+		if _, _, err := fs.StoreMsg("foo", nil, msg); err != nil {
+			t.Fatalf("Error storing msg: %v", err)
+		}
+	}
+	// Remove all even messages, keeping the first and last of each block.
+	for seq := uint64(2); seq < 100; seq += 2 {
+		if _, err := fs.RemoveMsg(seq); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	state := fs.State()
+
+	var rep MaintenanceReport
+	if err := fs.maintain(&rep); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if rep.BytesReclaimed == 0 || len(rep.Anomalies) != 0 {
+		t.Fatalf("Unexpected report: %+v", rep)
+	}
+	// Only the messages in the compacted blocks are counted.
+	fs.mu.RLock()
+	lmsgs := fs.lmb.msgs
+	fs.mu.RUnlock()
+	if rep.ChecksumsRewritten != state.Msgs-lmsgs {
+		t.Fatalf("Expected %d checksums rewritten, got %d", state.Msgs-lmsgs, rep.ChecksumsRewritten)
+	}
+
+	checkMsgs := func() {
+		t.Helper()
+		if ns := fs.State(); ns.Msgs != state.Msgs || ns.Bytes != state.Bytes {
+			t.Fatalf("Expected state %+v, got %+v", state, ns)
+		}
+		for seq := uint64(1); seq <= 100; seq++ {
+			_, _, m, _, err := fs.LoadMsg(seq)
+			if seq%2 == 0 && seq != 100 {
+				if err == nil {
+					t.Fatalf("Expected msg %d to be removed", seq)
+				}
+				continue
+			}
+			if err != nil || !bytes.Equal(m, msg) {
+				t.Fatalf("Unexpected msg %d: %q, %v", seq, m, err)
+			}
+		}
+	}
+	checkMsgs()
+
+	// Nothing left to reclaim.
+	rep = MaintenanceReport{}
+	if err := fs.maintain(&rep); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if rep.BytesReclaimed != 0 || rep.ChecksumsRewritten != 0 || len(rep.Anomalies) != 0 {
+		t.Fatalf("Unexpected report: %+v", rep)
+	}
+
+	// Make sure we recover the compacted blocks.
+	fs.Stop()
+	fs, _, err = newFileStoreWithCreated(fcfg, cfg, time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	checkMsgs()
+}
+
+func TestFileStoreMaintainWhileStoring(t *testing.T) {
+	storeDir, _ := ioutil.TempDir("", JetStreamStoreDir)
+	defer os.RemoveAll(storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 1024}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+	fs, _, err := newFileStoreWithCreated(fcfg, cfg, time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	msg := bytes.Repeat([]byte("Z"), 64)
+	for i := 0; i < 500; i++ {
+		if _, _, err := fs.StoreMsg("foo", nil, msg); err != nil {
+			t.Fatalf("Error storing msg: %v", err)
+		}
+	}
+	for seq := uint64(2); seq < 500; seq += 2 {
+		if _, err := fs.RemoveMsg(seq); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// Messages are stored while the blocks are compacted.
+	errCh := make(chan error, 1)
+	go func() {
+		var rep MaintenanceReport
+		errCh <- fs.maintain(&rep)
+	}()
+	for i := 0; i < 500; i++ {
+		if _, _, err := fs.StoreMsg("foo", nil, msg); err != nil {
+			t.Fatalf("Error storing msg: %v", err)
+		}
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if state := fs.State(); state.Msgs != 751 || state.LastSeq != 1000 {
+		t.Fatalf("Expected 751 msgs and last sequence 1000, got %+v", state)
+	}
+}
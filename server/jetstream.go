@@ -14,18 +14,27 @@
 package server
 
 import (
+	"crypto/cipher"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
+	"math/bits"
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/minio/highwayhash"
 	"github.com/nats-io/nats-server/v2/server/sysmem"
@@ -37,26 +46,271 @@ type JetStreamConfig struct {
 	MaxMemory int64
 	MaxStore  int64
 	StoreDir  string
+	// LazyRecovery will only register file based streams on startup and
+	// defer loading their messages and consumers until they are first used.
+	LazyRecovery bool
+	// RecoveryRetries is the number of additional passes made over streams that
+	// could not be recovered due to resource limits. Zero will use the default,
+	// negative disables retries.
+	RecoveryRetries int
+	// RecoveryConcurrency is the number of streams of an account that are
+	// recovered at the same time. Zero will use the number of CPUs.
+	RecoveryConcurrency int
+	// StreamCountAlarm is the fraction of an account's MaxStreams at which a
+	// warning is issued. Zero will use the default.
+	StreamCountAlarm float64
+	// MaxDeliveryGoroutines bounds the number of consumer delivery workers
+	// running concurrently across the server. Zero means unbounded.
+	MaxDeliveryGoroutines int
+	// RecoveryMemoryBudget bounds the memory, in bytes, that streams being
+	// recovered concurrently may use. Zero means unbounded.
+	RecoveryMemoryBudget int64
+	// RequireDurableStore refuses to enable JetStream when the storage
+	// directory is on a RAM backed filesystem such as tmpfs.
+	RequireDurableStore bool
+	// VerifyDataOnRecovery checks the checksums of all stored messages when
+	// recovering file based streams. Corrupt message blocks are moved aside
+	// and reported. This can slow down recovery considerably.
+	VerifyDataOnRecovery bool
+	// QuarantineCorrupt moves the directories of templates, streams and consumers
+	// whose metafiles fail their checksum or can not be decoded aside during
+	// recovery, renaming them to <name>.corrupt.<timestamp>. By default they are
+	// skipped and left in place.
+	QuarantineCorrupt bool
+	// DisableReservations turns off the reservation of resources for accounts
+	// and streams based on their limits. Usage is then only bounded by what is
+	// actually stored. This is meant for single tenant, non-clustered servers
+	// where one account may use everything. Clustered placement still relies
+	// on reservations and should not use this.
+	DisableReservations bool
+	// StoreDirProbeTimeout bounds the time spent checking that the storage
+	// directory can be written to, so a hung filesystem does not stall startup.
+	// Zero will use the default.
+	StoreDirProbeTimeout time.Duration
+	// UsageBatchSize lets each stream collect changes to the memory or storage
+	// it uses and only apply them to its account once they reach this many bytes
+	// or UsageBatchInterval has passed. This reduces contention on the account
+	// at high message rates. Zero applies every change right away.
+	UsageBatchSize int64
+	// UsageBatchInterval is the longest a stream holds on to batched usage.
+	// Zero will use the default.
+	UsageBatchInterval time.Duration
+	// OvercommitFactor scales the server limits that account reservations are
+	// checked against, so accounts can reserve more than the server has when they
+	// are not expected to all be full at once. Zero will use the default of 1.0.
+	OvercommitFactor float64
+	// AllowNetworkStoreDir allows the storage directory to be on a network
+	// filesystem such as NFS or SMB. These may not provide the locking and sync
+	// guarantees file storage needs, so only set this when the filesystem is
+	// known to provide them.
+	AllowNetworkStoreDir bool
+	// MemoryOnly runs JetStream without a storage directory. Nothing is read from
+	// or written to disk and only memory based streams can be created. This can
+	// not be used when clustered.
+	MemoryOnly bool
+	// RecoveryProgress is called as each stream of an account is recovered.
+	// It runs inline with recovery and should return quickly. Calls are not
+	// made concurrently, even when streams are recovered concurrently.
+	RecoveryProgress JetStreamRecoveryProgress
 }
 
+// JetStreamRecoveryProgress reports that a stream of an account was recovered, or
+// could not be. Done and total count the streams of the account, msgs is the number
+// of messages restored for this stream. Lazily recovered streams restore none.
+type JetStreamRecoveryProgress func(account, stream string, done, total int, msgs uint64)
+
 // TODO(dlc) - need to track and rollup against server limits, etc.
 type JetStreamAccountLimits struct {
 	MaxMemory    int64 `json:"max_memory"`
 	MaxStore     int64 `json:"max_storage"`
 	MaxStreams   int   `json:"max_streams"`
 	MaxConsumers int   `json:"max_consumers"`
+	// MaxHeaderSize limits the size of the headers of an inbound message. Zero is unlimited.
+	MaxHeaderSize int `json:"max_header_size,omitempty"`
+	// MaxDedupeWindow caps the duplicates window of any stream. Zero is unlimited.
+	MaxDedupeWindow time.Duration `json:"max_dedupe_window,omitempty"`
+	// DedupeWindow is used for streams that do not set a duplicates window.
+	DedupeWindow time.Duration `json:"dedupe_window,omitempty"`
+	// MaxConcurrentAPIOps bounds the JetStream API requests that change state
+	// being processed at the same time for the account. Zero is unlimited.
+	MaxConcurrentAPIOps int `json:"max_concurrent_api_ops,omitempty"`
+	// MaxTemplates limits the number of stream templates. Zero is unlimited.
+	MaxTemplates int `json:"max_templates,omitempty"`
+	// MaxPullBatch caps the batch size pull consumers can request. Larger requests
+	// are clamped to the limit unless RejectOversizedPull is set. Zero is unlimited.
+	MaxPullBatch int `json:"max_pull_batch,omitempty"`
+	// RejectOversizedPull rejects pull requests over MaxPullBatch instead of clamping them.
+	RejectOversizedPull bool `json:"reject_oversized_pull,omitempty"`
+	// OverLimitPolicy determines what happens to new messages once the account
+	// is over its memory or storage limit. The default is to reject them.
+	OverLimitPolicy OverLimitPolicy `json:"over_limit_policy,omitempty"`
+	// MaxMemoryHard and MaxStoreHard turn MaxMemory and MaxStore into soft limits
+	// when set above them. Streams may then reserve and use up to the hard limit,
+	// with a warning once the soft limit is crossed. Zero keeps the soft limit hard.
+	MaxMemoryHard int64 `json:"max_memory_hard,omitempty"`
+	MaxStoreHard  int64 `json:"max_storage_hard,omitempty"`
+}
+
+// Returns the memory and storage that can not be exceeded, which are the hard
+// limits when they are set above the soft ones. Unlimited stays unlimited.
+func (l *JetStreamAccountLimits) hardLimits() (mem, store int64) {
+	mem, store = l.MaxMemory, l.MaxStore
+	if mem >= 0 && l.MaxMemoryHard > mem {
+		mem = l.MaxMemoryHard
+	}
+	if store >= 0 && l.MaxStoreHard > store {
+		store = l.MaxStoreHard
+	}
+	return mem, store
+}
+
+// Returns what the limits reserve against the server and resource group limits,
+// which is everything up to the hard limits. Unlimited reserves nothing.
+func (l *JetStreamAccountLimits) reservation() (mem, store int64) {
+	mem, store = l.hardLimits()
+	if mem < 0 {
+		mem = 0
+	}
+	if store < 0 {
+		store = 0
+	}
+	return mem, store
+}
+
+// OverLimitPolicy determines how a new message is handled when storing it puts
+// the account over its limits.
+type OverLimitPolicy int
+
+const (
+	// OverLimitReject will reject the new message.
+	OverLimitReject OverLimitPolicy = iota
+	// OverLimitBlock will hold the publisher for a while, waiting for room.
+	OverLimitBlock
+	// OverLimitDiscardOld will remove the oldest messages of the stream to make room.
+	OverLimitDiscardOld
+)
+
+func (op OverLimitPolicy) String() string {
+	switch op {
+	case OverLimitReject:
+		return "Reject"
+	case OverLimitBlock:
+		return "Block"
+	case OverLimitDiscardOld:
+		return "DiscardOld"
+	default:
+		return "Unknown Over Limit Policy"
+	}
+}
+
+func (op OverLimitPolicy) MarshalJSON() ([]byte, error) {
+	switch op {
+	case OverLimitReject:
+		return json.Marshal("reject")
+	case OverLimitBlock:
+		return json.Marshal("block")
+	case OverLimitDiscardOld:
+		return json.Marshal("discard_old")
+	default:
+		return nil, fmt.Errorf("can not marshal %v", op)
+	}
+}
+
+func (op *OverLimitPolicy) UnmarshalJSON(data []byte) error {
+	switch strings.ToLower(string(data)) {
+	case jsonString("reject"):
+		*op = OverLimitReject
+	case jsonString("block"):
+		*op = OverLimitBlock
+	case jsonString("discard_old"):
+		*op = OverLimitDiscardOld
+	default:
+		return fmt.Errorf("can not unmarshal %q", data)
+	}
+	return nil
 }
 
 // JetStreamAccountStats returns current statistics about the account's JetStream usage.
 type JetStreamAccountStats struct {
-	Memory  uint64                 `json:"memory"`
-	Store   uint64                 `json:"storage"`
-	Streams int                    `json:"streams"`
-	Limits  JetStreamAccountLimits `json:"limits"`
+	Memory        uint64                 `json:"memory"`
+	Store         uint64                 `json:"storage"`
+	MemReserved   uint64                 `json:"reserved_memory,omitempty"`
+	StoreReserved uint64                 `json:"reserved_storage,omitempty"`
+	Streams       int                    `json:"streams"`
+	Limits        JetStreamAccountLimits `json:"limits"`
+	// OverSoftLimit is set when reservations or usage are over MaxMemory or MaxStore
+	// while still under MaxMemoryHard or MaxStoreHard.
+	OverSoftLimit bool `json:"over_soft_limit,omitempty"`
+	// StreamUsage is only set by JetStreamUsageDetailed.
+	StreamUsage []StreamUsage `json:"stream_usage,omitempty"`
+	// RecoveryErrors lists the problems found while recovering the account's
+	// templates, streams and consumers from disk.
+	RecoveryErrors []RecoveryError `json:"recovery_errors,omitempty"`
+}
+
+// RecoveryError describes a single problem found during recovery. Problems of
+// the same class are summarized in the log, but each one is kept here.
+type RecoveryError struct {
+	Class       string `json:"class"`
+	Description string `json:"description"`
+}
+
+// StreamUsage reports on the resources used by a single stream.
+type StreamUsage struct {
+	Name   string `json:"name"`
+	Memory uint64 `json:"memory"`
+	Store  uint64 `json:"storage"`
+	Msgs   uint64 `json:"messages"`
+}
+
+// JetStreamPersistedInfo reports on the JetStream data an account has stored on disk.
+type JetStreamPersistedInfo struct {
+	Store     uint64   `json:"storage"`
+	Streams   []string `json:"streams"`
+	Templates int      `json:"templates"`
+	// Limits are the ones persisted when they were last set for the account.
+	Limits *JetStreamAccountLimits `json:"limits,omitempty"`
+}
+
+// JetStreamAPILevel is the level of the JetStream API this server supports.
+// It is increased whenever features are added that clients may depend on.
+const JetStreamAPILevel = 1
+
+// JetStream features that can be reported by a server.
+const (
+	JSFeatureClustering    = "clustering"
+	JSFeatureEncryption    = "encryption"
+	JSFeatureMemoryOnly    = "memory_only"
+	JSFeatureSealedStreams = "sealed_streams"
+	JSFeatureSyncPolicy    = "sync_policy"
+	JSFeatureTemplates     = "stream_templates"
+	JSFeatureWriteBuffer   = "write_buffer"
+)
+
+// JetStreamInfo describes the JetStream capabilities of a server.
+type JetStreamInfo struct {
+	APILevel int      `json:"api_level"`
+	Features []string `json:"features"`
+}
+
+// Supports returns if the given feature is supported.
+func (ji *JetStreamInfo) Supports(feature string) bool {
+	for _, f := range ji.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
 }
 
 // This is for internal accounting for JetStream for this server.
 type jetStream struct {
+	// Here first because of use of atomics, and memory alignment.
+	// Last measured space available in the store directory while read only.
+	diskAvail int64
+	// Checked on every file based publish, so not protected by the lock.
+	readOnly int32
+
 	mu            sync.RWMutex
 	srv           *Server
 	config        JetStreamConfig
@@ -64,6 +318,25 @@ type jetStream struct {
 	accounts      map[*Account]*jsAccount
 	memReserved   int64
 	storeReserved int64
+	roTimer       *time.Timer
+	// Shared consumer delivery workers when capped.
+	dpool *deliveryPool
+	// Shared memory budget for stream recovery when bounded.
+	rbudget *recoveryBudget
+	// Internal subscriptions for the JetStream API.
+	apiSubs []*subscription
+	// Resource groups and the group of each member account by name.
+	groups  map[string]*jsResourceGroup
+	members map[string]string
+}
+
+// A resource group caps the reservations of all of its member accounts.
+type jsResourceGroup struct {
+	name          string
+	maxMemory     int64
+	maxStore      int64
+	memReserved   int64
+	storeReserved int64
 }
 
 // This represents a jetstream enabled account.
@@ -72,64 +345,133 @@ type jetStream struct {
 // and internal sub for a msgSet, so we will direct link to the msgSet
 // and walk backwards as needed vs multiple hash lookups and locks, etc.
 type jsAccount struct {
+	// Here first because of use of atomics, and memory alignment.
+	// Usage changes with every message, so it is not protected by the lock.
+	memUsed   int64
+	storeUsed int64
+	// Copy of limits.MaxHeaderSize, checked with every message.
+	maxHdrSize int64
+
 	mu            sync.RWMutex
 	js            *jetStream
 	account       *Account
 	limits        JetStreamAccountLimits
 	memReserved   int64
-	memUsed       int64
 	storeReserved int64
-	storeUsed     int64
 	storeDir      string
 	streams       map[string]*Stream
+	lazy          map[string]*lazyStream
+	loading       map[string]*lazyStream
 	templates     map[string]*StreamTemplate
+	orphans       map[string]struct{}
 	store         TemplateStore
+	aek           cipher.AEAD
+	defReplicas   int
+	streamsAlarm  bool
+	memExceeded   int32
+	storeExceeded int32
+	memOverSoft   int32
+	storeOverSoft int32
+	apiSem        chan struct{}
+	apiWaiting    int32
+	snaps         map[string]*activeSnapshot
+	recoveryErrs  []RecoveryError
+	moving        chan struct{}
+
+	// Empty streams are removed once idle for this long when set.
+	pruneIdle  time.Duration
+	ptmr       *time.Timer
+	emptySince map[string]time.Time
 }
 
 // EnableJetStream will enable JetStream support on this server with the given configuration.
 // A nil configuration will dynamically choose the limits and temporary file storage directory.
 // If this server is part of a cluster, a system account will need to be defined.
 func (s *Server) EnableJetStream(config *JetStreamConfig) error {
+	var storeDir string
+	if config != nil && config.StoreDir != _EMPTY_ && !config.MemoryOnly {
+		dir, err := expandStoreDir(config.StoreDir)
+		if err != nil {
+			return err
+		}
+		// Copy, don't change callers version.
+		ccopy := *config
+		storeDir, ccopy.StoreDir = config.StoreDir, dir
+		config = &ccopy
+	}
+	if err := ValidateJetStreamConfig(config); err != nil {
+		return err
+	}
+	s.warnStoreLimit(config)
 	s.mu.Lock()
 	if s.js != nil {
 		s.mu.Unlock()
-		return fmt.Errorf("jetstream already enabled")
+		return ErrJetStreamAlreadyEnabled
 	}
 	s.Noticef("Starting JetStream")
-	if config == nil || config.MaxMemory <= 0 || config.MaxStore <= 0 {
-		var storeDir string
-		var maxStore int64
-		if config != nil {
-			storeDir = config.StoreDir
-			maxStore = config.MaxStore
-		}
-		config = s.dynJetStreamConfig(storeDir, maxStore)
-		s.Debugf("JetStream creating dynamic configuration - %s memory, %s disk", FriendlyBytes(config.MaxMemory), FriendlyBytes(config.MaxStore))
+	if storeDir != _EMPTY_ && storeDir != config.StoreDir {
+		s.Noticef("  Storage directory %q expands to %q", storeDir, config.StoreDir)
 	}
-	// Copy, don't change callers version.
-	cfg := *config
-	if cfg.StoreDir == "" {
-		cfg.StoreDir = filepath.Join(os.TempDir(), JetStreamStoreDir)
+	cfg := s.resolveJetStreamConfig(config)
+	if config == nil || config.MaxMemory <= 0 || config.MaxStore <= 0 {
+		s.Debugf("JetStream creating dynamic configuration - %s memory, %s disk", FriendlyBytes(cfg.MaxMemory), FriendlyBytes(cfg.MaxStore))
 	}
 
 	s.js = &jetStream{srv: s, config: cfg, accounts: make(map[*Account]*jsAccount)}
+	if cfg.MaxDeliveryGoroutines > 0 {
+		s.js.dpool = newDeliveryPool(s, cfg.MaxDeliveryGoroutines)
+	}
+	if cfg.RecoveryMemoryBudget > 0 {
+		s.js.rbudget = newRecoveryBudget(cfg.RecoveryMemoryBudget)
+	}
 	s.mu.Unlock()
+	jsClock.setWarnf(s.Warnf)
 
-	// FIXME(dlc) - Allow memory only operation?
-	if stat, err := os.Stat(cfg.StoreDir); os.IsNotExist(err) {
-		if err := os.MkdirAll(cfg.StoreDir, 0755); err != nil {
-			return fmt.Errorf("could not create storage directory - %v", err)
+	// Hold onto any limits requested for the global account before we were enabled.
+	gacc := s.GlobalAccount()
+	gacc.mu.RLock()
+	glimits := gacc.jsLimits
+	gacc.mu.RUnlock()
+
+	if err := s.enableJetStream(cfg); err != nil {
+		s.rollbackJetStream(gacc, glimits)
+		return err
+	}
+	return nil
+}
+
+// rollbackJetStream will undo a failed enable, leaving the server disabled.
+// The global account's requested limits are restored so a later enable sees them.
+func (s *Server) rollbackJetStream(gacc *Account, glimits *JetStreamAccountLimits) {
+	s.Warnf("JetStream could not be enabled, rolling back")
+	s.DisableJetStream()
+	if s.globalAccountOnly() {
+		gacc.mu.Lock()
+		gacc.jsLimits = glimits
+		gacc.mu.Unlock()
+	}
+}
+
+// Will finish enabling JetStream with the resolved configuration.
+func (s *Server) enableJetStream(cfg JetStreamConfig) error {
+	var resolvedDir string
+	if cfg.MemoryOnly {
+		// Clustering keeps its state on disk.
+		if !s.standAloneMode() {
+			return fmt.Errorf("memory only jetstream can not be clustered")
 		}
 	} else {
-		// Make sure its a directory and that we can write to it.
-		if stat == nil || !stat.IsDir() {
-			return fmt.Errorf("storage directory is not a directory")
+		// Make sure where we actually end up is a directory we can write to.
+		var err error
+		if resolvedDir, err = probeStoreDir(cfg.StoreDir, cfg.StoreDirProbeTimeout); err != nil {
+			return err
 		}
-		tmpfile, err := ioutil.TempFile(cfg.StoreDir, "_test_")
-		if err != nil {
-			return fmt.Errorf("storage directory is not writable")
+		if err := s.checkStoreDirDurable(resolvedDir, cfg.RequireDurableStore); err != nil {
+			return err
+		}
+		if err := s.checkStoreLayout(cfg.StoreDir); err != nil {
+			return err
 		}
-		os.Remove(tmpfile.Name())
 	}
 
 	// JetStream is an internal service so we need to make sure we have a system account.
@@ -153,8 +495,15 @@ func (s *Server) EnableJetStream(config *JetStreamConfig) error {
 	s.Noticef("")
 	s.Noticef("----------- JETSTREAM -----------")
 	s.Noticef("  Max Memory:      %s", FriendlyBytes(cfg.MaxMemory))
-	s.Noticef("  Max Storage:     %s", FriendlyBytes(cfg.MaxStore))
-	s.Noticef("  Store Directory: %q", cfg.StoreDir)
+	if cfg.MemoryOnly {
+		s.Noticef("  Memory Only:     true")
+	} else {
+		s.Noticef("  Max Storage:     %s", FriendlyBytes(cfg.MaxStore))
+		s.Noticef("  Store Directory: %q", cfg.StoreDir)
+		if resolvedDir != cfg.StoreDir {
+			s.Noticef("  Resolved To:     %q", resolvedDir)
+		}
+	}
 	s.Noticef("---------------------------------")
 
 	// Setup our internal subscriptions.
@@ -183,13 +532,25 @@ func (s *Server) EnableJetStream(config *JetStreamConfig) error {
 
 	// If we have no configured accounts setup then setup imports on global account.
 	if s.globalAccountOnly() {
-		if err := s.GlobalAccount().EnableJetStream(nil); err != nil {
-			return fmt.Errorf("Error enabling jetstream on the global account")
+		// Pick up any limits requested before we were enabled.
+		gacc := s.GlobalAccount()
+		gacc.mu.Lock()
+		limits := gacc.jsLimits
+		gacc.jsLimits = nil
+		gacc.mu.Unlock()
+		if limits == dynamicJSAccountLimits {
+			limits = nil
+		}
+		if err := gacc.EnableJetStream(limits); err != nil {
+			return fmt.Errorf("Error enabling jetstream on the global account: %v", err)
 		}
 	} else if err := s.configAllJetStreamAccounts(); err != nil {
 		return fmt.Errorf("Error enabling jetstream on configured accounts: %v", err)
 	}
 
+	// Make sure our reservations reflect what was actually recovered.
+	s.getJetStream().reconcileReservations()
+
 	return nil
 }
 
@@ -204,12 +565,13 @@ func (a *Account) enableAllJetStreamServiceImports() error {
 	}
 
 	// In case the enabled import exists here.
-	a.removeServiceImport(JSApiAccountInfo)
+	a.removeServiceImport(a.jsAPISubject(JSApiAccountInfo))
 
 	sys := s.SystemAccount()
 	for _, export := range allJsExports {
-		if !a.serviceImportExists(sys, export) {
-			if err := a.AddServiceImport(sys, export, _EMPTY_); err != nil {
+		from := a.jsAPISubject(export)
+		if !a.serviceImportExists(sys, from) {
+			if err := a.AddServiceImport(sys, from, export); err != nil {
 				return fmt.Errorf("Error setting up jetstream service imports for account: %v", err)
 			}
 		}
@@ -217,6 +579,62 @@ func (a *Account) enableAllJetStreamServiceImports() error {
 	return nil
 }
 
+// removeAllJetStreamServiceImports removes the service imports for jetstream
+// for this account, including any under the account's API prefix.
+func (a *Account) removeAllJetStreamServiceImports() {
+	for _, export := range allJsExports {
+		a.removeServiceImport(export)
+		if from := a.jsAPISubject(export); from != export {
+			a.removeServiceImport(from)
+		}
+	}
+}
+
+// jsAPISubject returns the subject this account uses to access the given
+// jetstream API subject.
+func (a *Account) jsAPISubject(subject string) string {
+	a.mu.RLock()
+	prefix := a.jsPrefix
+	a.mu.RUnlock()
+	if prefix == _EMPTY_ {
+		return subject
+	}
+	return prefix + tsep + subject
+}
+
+// SetJetStreamAPIPrefix will make the jetstream API available to this account
+// under the given prefix, e.g. "tenant" will map "tenant.$JS.API.INFO" to
+// "$JS.API.INFO". An empty prefix restores the default subjects.
+func (a *Account) SetJetStreamAPIPrefix(prefix string) error {
+	if prefix != _EMPTY_ && (!IsValidLiteralSubject(prefix) || subjectIsSubsetMatch(prefix, "$JS.>")) {
+		return fmt.Errorf("invalid jetstream api prefix %q", prefix)
+	}
+	a.mu.RLock()
+	s, enabled, old := a.srv, a.js != nil, a.jsPrefix
+	a.mu.RUnlock()
+	if prefix == old {
+		return nil
+	}
+
+	// Remove any imports under the old prefix.
+	a.removeAllJetStreamServiceImports()
+
+	a.mu.Lock()
+	a.jsPrefix = prefix
+	a.mu.Unlock()
+
+	if s == nil || s.getJetStream() == nil {
+		return nil
+	}
+	if enabled {
+		return a.enableAllJetStreamServiceImports()
+	}
+	if a != s.SystemAccount() {
+		return a.enableJetStreamInfoServiceImportOnly()
+	}
+	return nil
+}
+
 // enableJetStreamEnabledServiceImportOnly will enable the single service import responder.
 // Should we do them all regardless?
 func (a *Account) enableJetStreamInfoServiceImportOnly() error {
@@ -228,7 +646,7 @@ func (a *Account) enableJetStreamInfoServiceImportOnly() error {
 		return fmt.Errorf("jetstream account not registered")
 	}
 	sys := s.SystemAccount()
-	if err := a.AddServiceImport(sys, JSApiAccountInfo, _EMPTY_); err != nil {
+	if err := a.AddServiceImport(sys, a.jsAPISubject(JSApiAccountInfo), JSApiAccountInfo); err != nil {
 		return fmt.Errorf("Error setting up jetstream service imports for account: %v", err)
 	}
 	return nil
@@ -261,8 +679,8 @@ func (s *Server) configJetStream(acc *Account) error {
 	return nil
 }
 
-// configAllJetStreamAccounts walk all configured accounts and turn on jetstream if requested.
-func (s *Server) configAllJetStreamAccounts() error {
+// enableJetStreamExports makes sure the system account exports the JetStream API.
+func (s *Server) enableJetStreamExports() error {
 	// Check to see if system account has been enabled. We could arrive here via reload and
 	// a non-default system account.
 	if sacc := s.SystemAccount(); sacc != nil && !sacc.IsExportService(JSApiAccountInfo) {
@@ -272,6 +690,14 @@ func (s *Server) configAllJetStreamAccounts() error {
 			}
 		}
 	}
+	return nil
+}
+
+// configAllJetStreamAccounts walk all configured accounts and turn on jetstream if requested.
+func (s *Server) configAllJetStreamAccounts() error {
+	if err := s.enableJetStreamExports(); err != nil {
+		return err
+	}
 
 	// Snapshot into our own list. Might not be needed.
 	s.mu.Lock()
@@ -299,6 +725,174 @@ func (s *Server) configAllJetStreamAccounts() error {
 	return nil
 }
 
+// beginJetStreamReload validates the complete set of account limits from the
+// new options against current usage and server resources. Either all of the
+// new limits can be applied or the reload is rejected.
+func (s *Server) beginJetStreamReload(newOpts *Options) error {
+	js := s.getJetStream()
+	if js == nil || len(s.trustedKeys) > 0 || len(newOpts.Accounts) == 0 {
+		return nil
+	}
+
+	js.mu.RLock()
+	maxMem, maxStore := js.config.MaxMemory, js.config.MaxStore
+	factor := js.overcommitFactor()
+	current := make(map[string]*jsAccount, len(js.accounts))
+	for _, jsa := range js.accounts {
+		current[jsa.account.Name] = jsa
+	}
+	// Resource groups are rolled up from scratch with the new limits.
+	groups := make(map[string]*jsResourceGroup, len(js.groups))
+	for name, g := range js.groups {
+		groups[name] = &jsResourceGroup{name: name, maxMemory: g.maxMemory, maxStore: g.maxStore}
+	}
+	members := make(map[string]string, len(js.members))
+	for a, g := range js.members {
+		members[a] = g
+	}
+	js.mu.RUnlock()
+
+	// Pick up any changes to the server limits as well.
+	oldOpts := s.getOpts()
+	if newOpts.JetStreamMaxMemory > 0 && newOpts.JetStreamMaxMemory != oldOpts.JetStreamMaxMemory {
+		maxMem = newOpts.JetStreamMaxMemory
+	}
+	if newOpts.JetStreamMaxStore > 0 && newOpts.JetStreamMaxStore != oldOpts.JetStreamMaxStore {
+		maxStore = newOpts.JetStreamMaxStore
+	}
+	maxMem, maxStore = overcommit(maxMem, factor), overcommit(maxStore, factor)
+
+	var mem, store int64
+	var errs []string
+	for _, acc := range newOpts.Accounts {
+		limits := acc.jsLimits
+		if limits == nil {
+			continue
+		}
+		amem, astore := limits.reservation()
+		mem, store = mem+amem, store+astore
+		if g := groups[members[acc.Name]]; g != nil {
+			g.memReserved, g.storeReserved = g.memReserved+amem, g.storeReserved+astore
+		}
+		jsa := current[acc.Name]
+		if jsa == nil {
+			continue
+		}
+		jsa.mu.RLock()
+		memUsed, storeUsed := jsa.usage()
+		streams := len(jsa.streams) + len(jsa.lazy)
+		jsa.mu.RUnlock()
+		// Usage only has to fit under the hard limits.
+		hardMem, hardStore := limits.hardLimits()
+		if hardMem >= 0 && hardMem < memUsed {
+			errs = append(errs, fmt.Sprintf("account %q max_memory %s is below usage of %s",
+				acc.Name, FriendlyBytes(hardMem), FriendlyBytes(memUsed)))
+		}
+		if hardStore >= 0 && hardStore < storeUsed {
+			errs = append(errs, fmt.Sprintf("account %q max_store %s is below usage of %s",
+				acc.Name, FriendlyBytes(hardStore), FriendlyBytes(storeUsed)))
+		}
+		if limits.MaxStreams >= 0 && limits.MaxStreams < streams {
+			errs = append(errs, fmt.Sprintf("account %q max_streams %d is below %d existing streams",
+				acc.Name, limits.MaxStreams, streams))
+		}
+	}
+	if mem > maxMem {
+		errs = append(errs, fmt.Sprintf("accounts reserve %s of memory, server limit is %s",
+			FriendlyBytes(mem), FriendlyBytes(maxMem)))
+	}
+	if store > maxStore {
+		errs = append(errs, fmt.Sprintf("accounts reserve %s of storage, server limit is %s",
+			FriendlyBytes(store), FriendlyBytes(maxStore)))
+	}
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := groups[name].sufficientResources(0, 0); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("config reload not supported for jetstream account limits: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// commitJetStreamReload applies account limits that were validated by
+// beginJetStreamReload. Existing accounts are updated as a unit and reservations
+// are recomputed before any newly enabled accounts are processed.
+func (s *Server) commitJetStreamReload() error {
+	js := s.getJetStream()
+	if js == nil {
+		return nil
+	}
+	if s.globalAccountOnly() {
+		// The global account may have been replaced by the reload, so release
+		// anything held for accounts that are no longer registered.
+		js.mu.Lock()
+		for a := range js.accounts {
+			if v, ok := s.accounts.Load(a.Name); !ok || v.(*Account) != a {
+				delete(js.accounts, a)
+			}
+		}
+		js.rebalanceReservationsLocked()
+		js.mu.Unlock()
+		return s.GlobalAccount().EnableJetStream(nil)
+	}
+	if err := s.enableJetStreamExports(); err != nil {
+		return err
+	}
+
+	var accounts []*Account
+	s.accounts.Range(func(k, v interface{}) bool {
+		accounts = append(accounts, v.(*Account))
+		return true
+	})
+
+	// Disable accounts that no longer have JetStream configured and
+	// update the limits for those that remain. Their limits stay pending
+	// on the account until they have been applied.
+	var enable []*Account
+	update := make(map[*Account]*JetStreamAccountLimits)
+	for _, acc := range accounts {
+		acc.mu.RLock()
+		limits, jsa := acc.jsLimits, acc.js
+		acc.mu.RUnlock()
+
+		switch {
+		case limits != nil && jsa != nil:
+			update[acc] = limits
+		case limits != nil:
+			enable = append(enable, acc)
+		default:
+			if err := s.configJetStream(acc); err != nil {
+				return err
+			}
+		}
+	}
+	if err := s.JetStreamApplyLimits(update); err != nil {
+		return err
+	}
+	for acc := range update {
+		acc.mu.Lock()
+		acc.jsLimits = nil
+		acc.mu.Unlock()
+		if err := acc.enableAllJetStreamServiceImports(); err != nil {
+			return err
+		}
+	}
+
+	for _, acc := range enable {
+		if err := s.configJetStream(acc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // JetStreamEnabled reports if jetstream is enabled.
 func (s *Server) JetStreamEnabled() bool {
 	s.mu.Lock()
@@ -307,6 +901,60 @@ func (s *Server) JetStreamEnabled() bool {
 	return enabled
 }
 
+// InternalJetStreamClient is an in-process client bound to an account with
+// JetStream enabled. It receives messages without a network connection.
+type InternalJetStreamClient struct {
+	c    *client
+	sids uint64
+}
+
+// NewInternalJetStreamClient creates an internal JetStream client bound to the
+// given account. This allows messages to be processed in-process without a
+// network connection. The account must have JetStream enabled, and the client
+// should be released with Close when no longer needed.
+func (s *Server) NewInternalJetStreamClient(acc *Account) (*InternalJetStreamClient, error) {
+	if !s.JetStreamEnabled() {
+		return nil, ErrJetStreamNotEnabled
+	}
+	if acc == nil {
+		return nil, fmt.Errorf("account can not be nil")
+	}
+	if !acc.JetStreamEnabled() {
+		return nil, ErrJetStreamNotEnabledForAccount
+	}
+	c := s.createInternalJetStreamClient()
+	if err := c.registerWithAccount(acc); err != nil {
+		c.closeConnection(ClientClosed)
+		return nil, err
+	}
+	return &InternalJetStreamClient{c: c}, nil
+}
+
+// Account returns the account the client is bound to.
+func (ic *InternalJetStreamClient) Account() *Account {
+	return ic.c.Account()
+}
+
+// Subscribe calls cb for each message published to subject in the client's account.
+// The callback runs inline with the publisher, so it should not block. The header
+// and message are copies and can be kept.
+func (ic *InternalJetStreamClient) Subscribe(subject string, cb func(subject, reply string, hdr, msg []byte)) error {
+	if cb == nil {
+		return fmt.Errorf("callback can not be nil")
+	}
+	sid := strconv.FormatUint(atomic.AddUint64(&ic.sids, 1), 10)
+	_, err := ic.c.processSub([]byte(subject), nil, []byte(sid), func(_ *subscription, pc *client, subject, reply string, rmsg []byte) {
+		hdr, msg := pc.msgParts(rmsg)
+		cb(subject, reply, copyBytes(hdr), copyBytes(msg))
+	}, false)
+	return err
+}
+
+// Close releases the client and drops its subscriptions.
+func (ic *InternalJetStreamClient) Close() {
+	ic.c.closeConnection(ClientClosed)
+}
+
 // Shutdown jetstream for this server.
 func (s *Server) shutdownJetStream() {
 	s.mu.Lock()
@@ -337,6 +985,13 @@ func (s *Server) shutdownJetStream() {
 
 	js.mu.Lock()
 	js.accounts = nil
+	if js.dpool != nil {
+		js.dpool.stop()
+	}
+	if js.roTimer != nil {
+		js.roTimer.Stop()
+		js.roTimer = nil
+	}
 	if cc := js.cluster; cc != nil {
 		js.stopUpdatesSub()
 		if cc.meta != nil {
@@ -351,6 +1006,61 @@ func (s *Server) shutdownJetStream() {
 	js.mu.Unlock()
 }
 
+// DisableJetStream will turn off JetStream for all accounts while leaving the
+// rest of the server running. JetStream can be enabled again afterwards, possibly
+// with a new configuration, and accounts will keep their current limits.
+func (s *Server) DisableJetStream() error {
+	js := s.getJetStream()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+
+	// Stop taking API requests first.
+	js.mu.Lock()
+	subs := js.apiSubs
+	js.apiSubs = nil
+	js.mu.Unlock()
+	for _, sub := range subs {
+		s.sysUnsubscribe(sub)
+	}
+
+	var accounts []*Account
+	s.accounts.Range(func(k, v interface{}) bool {
+		accounts = append(accounts, v.(*Account))
+		return true
+	})
+	gacc, globalOnly := s.GlobalAccount(), s.globalAccountOnly()
+
+	// Detach accounts so any requests in flight will fail. Hold onto the
+	// limits, same as configured accounts, in case we are enabled again.
+	for _, acc := range accounts {
+		acc.removeAllJetStreamServiceImports()
+		acc.mu.Lock()
+		if jsa := acc.js; jsa != nil {
+			if acc == gacc && globalOnly {
+				acc.jsLimits = dynamicJSAccountLimits
+			} else {
+				jsa.mu.RLock()
+				limits := jsa.limits
+				jsa.mu.RUnlock()
+				acc.jsLimits = &limits
+			}
+			acc.js = nil
+		}
+		acc.mu.Unlock()
+	}
+	if sacc := s.SystemAccount(); sacc != nil {
+		for _, export := range allJsExports {
+			sacc.removeServiceExport(export)
+		}
+	}
+
+	s.shutdownJetStream()
+
+	s.Noticef("JetStream disabled")
+	return nil
+}
+
 // JetStreamConfig will return the current config. Useful if the system
 // created a dynamic configuration. A copy is returned.
 func (s *Server) JetStreamConfig() *JetStreamConfig {
@@ -364,35 +1074,493 @@ func (s *Server) JetStreamConfig() *JetStreamConfig {
 	return c
 }
 
-func (s *Server) StoreDir() string {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if s.js == nil {
-		return _EMPTY_
+// JetStreamInfo returns the JetStream API level and supported features of this
+// server, or nil if JetStream is not enabled.
+func (s *Server) JetStreamInfo() *JetStreamInfo {
+	if !s.JetStreamEnabled() {
+		return nil
 	}
-	return s.js.config.StoreDir
+	features := []string{
+		JSFeatureEncryption,
+		JSFeatureSealedStreams,
+		JSFeatureSyncPolicy,
+		JSFeatureTemplates,
+		JSFeatureWriteBuffer,
+	}
+	if s.JetStreamIsClustered() {
+		features = append(features, JSFeatureClustering)
+	}
+	if js := s.getJetStream(); js != nil && js.memoryOnly() {
+		features = append(features, JSFeatureMemoryOnly)
+	}
+	sort.Strings(features)
+	return &JetStreamInfo{APILevel: JetStreamAPILevel, Features: features}
 }
 
-// JetStreamNumAccounts returns the number of enabled accounts this server is tracking.
-func (s *Server) JetStreamNumAccounts() int {
-	js := s.getJetStream()
-	if js == nil {
-		return 0
-	}
-	js.mu.Lock()
-	defer js.mu.Unlock()
-	return len(js.accounts)
+// jsConfigChange is a single difference between two JetStream configurations.
+type jsConfigChange struct {
+	Field string
+	Old   interface{}
+	New   interface{}
 }
 
-// JetStreamReservedResources returns the reserved resources if JetStream is enabled.
-func (s *Server) JetStreamReservedResources() (int64, int64, error) {
-	js := s.getJetStream()
-	if js == nil {
-		return -1, -1, ErrJetStreamNotEnabled
+func (c jsConfigChange) String() string {
+	switch o := c.Old.(type) {
+	case int64:
+		return fmt.Sprintf("%s: %s -> %s", c.Field, FriendlyBytes(o), FriendlyBytes(c.New.(int64)))
+	default:
+		return fmt.Sprintf("%s: %v -> %v", c.Field, c.Old, c.New)
 	}
-	js.mu.RLock()
-	defer js.mu.RUnlock()
-	return js.memReserved, js.storeReserved, nil
+}
+
+// diffJetStreamConfig returns the differences between the old and new configurations.
+func diffJetStreamConfig(old, new *JetStreamConfig) []jsConfigChange {
+	var changes []jsConfigChange
+	if old.MaxMemory != new.MaxMemory {
+		changes = append(changes, jsConfigChange{"max_memory", old.MaxMemory, new.MaxMemory})
+	}
+	if old.MaxStore != new.MaxStore {
+		changes = append(changes, jsConfigChange{"max_store", old.MaxStore, new.MaxStore})
+	}
+	if old.StoreDir != new.StoreDir {
+		changes = append(changes, jsConfigChange{"store_dir", old.StoreDir, new.StoreDir})
+	}
+	return changes
+}
+
+// Returns the account whose limits follow the server's, which is the
+// global account when no other accounts are configured.
+func (js *jetStream) serverLimitsAccount() *jsAccount {
+	s := js.srv
+	if !s.globalAccountOnly() {
+		return nil
+	}
+	gacc := s.GlobalAccount()
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	return js.accounts[gacc]
+}
+
+// checkConfigChanges will make sure the changes can be applied to a running JetStream.
+// Moving the storage directory is only allowed when no data would be left behind,
+// and limits can not drop below what has already been reserved by accounts.
+func (js *jetStream) checkConfigChanges(changes []jsConfigChange) error {
+	follow := js.serverLimitsAccount()
+
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+
+	memNeeded, storeNeeded := js.limitsNeeded(follow)
+	for _, c := range changes {
+		switch c.Field {
+		case "max_memory":
+			if nv := c.New.(int64); js.overcommit(nv) < memNeeded {
+				return fmt.Errorf("config reload not supported for jetstream max memory below %s in use", FriendlyBytes(memNeeded))
+			}
+		case "max_store":
+			if nv := c.New.(int64); js.overcommit(nv) < storeNeeded {
+				return fmt.Errorf("config reload not supported for jetstream max storage below %s in use", FriendlyBytes(storeNeeded))
+			}
+		case "store_dir":
+			for _, jsa := range js.accounts {
+				jsa.mu.RLock()
+				n := len(jsa.streams) + len(jsa.lazy) + len(jsa.templates)
+				jsa.mu.RUnlock()
+				if n > 0 {
+					return fmt.Errorf("config reload not supported for jetstream storage directory while streams exist")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// limitsNeeded returns the lowest server limits that would still cover what has
+// been reserved. An account following the server limits is held to its usage instead.
+// Lock should be held.
+func (js *jetStream) limitsNeeded(follow *jsAccount) (mem, store int64) {
+	mem, store = js.memReserved, js.storeReserved
+	if follow != nil {
+		follow.mu.RLock()
+		memUsed, storeUsed := follow.usage()
+		if follow.limits.MaxMemory == js.config.MaxMemory {
+			mem += memUsed - follow.limits.MaxMemory
+		}
+		if follow.limits.MaxStore == js.config.MaxStore {
+			store += storeUsed - follow.limits.MaxStore
+		}
+		follow.mu.RUnlock()
+	}
+	return mem, store
+}
+
+// applyConfig will switch a running JetStream to the new configuration.
+// Changes should have been checked with checkConfigChanges.
+func (js *jetStream) applyConfig(cfg JetStreamConfig) error {
+	follow := js.serverLimitsAccount()
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return js.applyConfigLocked(follow, cfg)
+}
+
+// Lock should be held.
+func (js *jetStream) applyConfigLocked(follow *jsAccount, cfg JetStreamConfig) error {
+	if cfg.StoreDir != js.config.StoreDir {
+		if err := os.MkdirAll(cfg.StoreDir, 0755); err != nil {
+			return fmt.Errorf("could not create storage directory - %v", err)
+		}
+		if err := js.srv.checkStoreDirDurable(cfg.StoreDir, cfg.RequireDurableStore); err != nil {
+			return err
+		}
+		if err := js.srv.checkStoreLayout(cfg.StoreDir); err != nil {
+			return err
+		}
+		for a, jsa := range js.accounts {
+			jsa.mu.Lock()
+			jsa.storeDir = path.Join(cfg.StoreDir, a.Name)
+			jsa.templates, jsa.store = nil, nil
+			jsa.mu.Unlock()
+		}
+	}
+	if follow != nil {
+		follow.mu.Lock()
+		if follow.limits.MaxMemory == js.config.MaxMemory {
+			follow.limits.MaxMemory = cfg.MaxMemory
+		}
+		if follow.limits.MaxStore == js.config.MaxStore {
+			follow.limits.MaxStore = cfg.MaxStore
+		}
+		follow.mu.Unlock()
+	}
+	js.config.StoreDir = cfg.StoreDir
+	js.config.MaxMemory = cfg.MaxMemory
+	js.config.MaxStore = cfg.MaxStore
+	js.rebalanceReservationsLocked()
+	return nil
+}
+
+// JetStreamSetMaxMemory will change the maximum memory JetStream may use on this
+// server without a config reload. With the overcommit factor applied, it can not
+// drop below what has been reserved.
+func (s *Server) JetStreamSetMaxMemory(n int64) error {
+	if n <= 0 {
+		return fmt.Errorf("jetstream max memory must be positive")
+	}
+	return s.setJetStreamMaxLimits(n, 0)
+}
+
+// JetStreamSetMaxStore will change the maximum storage JetStream may use on this
+// server without a config reload. With the overcommit factor applied, it can not
+// drop below what has been reserved.
+func (s *Server) JetStreamSetMaxStore(n int64) error {
+	if n <= 0 {
+		return fmt.Errorf("jetstream max storage must be positive")
+	}
+	return s.setJetStreamMaxLimits(0, n)
+}
+
+// Sets the server limits that are non-zero.
+func (s *Server) setJetStreamMaxLimits(mem, store int64) error {
+	js := s.getJetStream()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+	follow := js.serverLimitsAccount()
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	memNeeded, storeNeeded := js.limitsNeeded(follow)
+	cfg := js.config
+	if mem > 0 {
+		if js.overcommit(mem) < memNeeded {
+			return fmt.Errorf("jetstream max memory can not be below %s in use", FriendlyBytes(memNeeded))
+		}
+		cfg.MaxMemory = mem
+	}
+	if store > 0 {
+		if js.overcommit(store) < storeNeeded {
+			return fmt.Errorf("jetstream max storage can not be below %s in use", FriendlyBytes(storeNeeded))
+		}
+		cfg.MaxStore = store
+	}
+	return js.applyConfigLocked(follow, cfg)
+}
+
+func (s *Server) StoreDir() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.js == nil {
+		return _EMPTY_
+	}
+	return s.js.config.StoreDir
+}
+
+// JetStreamNumAccounts returns the number of enabled accounts this server is tracking.
+func (s *Server) JetStreamNumAccounts() int {
+	js := s.getJetStream()
+	if js == nil {
+		return 0
+	}
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return len(js.accounts)
+}
+
+// JetStreamReservedResources returns the reserved resources if JetStream is enabled.
+func (s *Server) JetStreamReservedResources() (int64, int64, error) {
+	js := s.getJetStream()
+	if js == nil {
+		return -1, -1, ErrJetStreamNotEnabled
+	}
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	return js.memReserved, js.storeReserved, nil
+}
+
+// JetStreamAccountReservations returns the resources each enabled account has
+// reserved from the server, keyed by account name. Only MaxMemory and MaxStore
+// are set, and they add up to what JetStreamReservedResources returns.
+func (s *Server) JetStreamAccountReservations() map[string]JetStreamAccountLimits {
+	js := s.getJetStream()
+	if js == nil {
+		return nil
+	}
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	reservations := make(map[string]JetStreamAccountLimits, len(js.accounts))
+	for a, jsa := range js.accounts {
+		var l JetStreamAccountLimits
+		if !js.reservationsDisabled() {
+			jsa.mu.RLock()
+			l.MaxMemory, l.MaxStore = jsa.reservation()
+			jsa.mu.RUnlock()
+		}
+		reservations[a.Name] = l
+	}
+	return reservations
+}
+
+// JetStreamOverReservedAccounts returns the accounts whose reservations can no
+// longer be honored within the server limits, e.g. after those were lowered.
+// Accounts are fitted in name order, the ones that do not fit are returned.
+func (s *Server) JetStreamOverReservedAccounts() []*Account {
+	js := s.getJetStream()
+	if js == nil || js.reservationsDisabled() {
+		return nil
+	}
+	js.mu.RLock()
+	maxMem, maxStore := js.overcommit(js.config.MaxMemory), js.overcommit(js.config.MaxStore)
+	accts := make([]*Account, 0, len(js.accounts))
+	jsas := make(map[*Account]*jsAccount, len(js.accounts))
+	for a, jsa := range js.accounts {
+		accts = append(accts, a)
+		jsas[a] = jsa
+	}
+	js.mu.RUnlock()
+	sort.Slice(accts, func(i, j int) bool { return accts[i].Name < accts[j].Name })
+
+	var over []*Account
+	var mem, store int64
+	for _, a := range accts {
+		jsa := jsas[a]
+		jsa.mu.RLock()
+		amem, astore := jsa.reservation()
+		jsa.mu.RUnlock()
+		if mem+amem > maxMem || store+astore > maxStore {
+			over = append(over, a)
+			continue
+		}
+		mem, store = mem+amem, store+astore
+	}
+	return over
+}
+
+// JetStreamPrometheus writes JetStream usage as gauges in the OpenMetrics text
+// format. Account level metrics are labeled with the account name.
+func (s *Server) JetStreamPrometheus(w io.Writer) error {
+	js := s.getJetStream()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+
+	// Values are in the order of jsPrometheusAccountMetrics.
+	type acctMetrics struct {
+		name string
+		vals [8]int64
+	}
+
+	js.mu.RLock()
+	cfg := js.config
+	memReserved, storeReserved := js.memReserved, js.storeReserved
+	jsas := make([]*jsAccount, 0, len(js.accounts))
+	for _, jsa := range js.accounts {
+		jsas = append(jsas, jsa)
+	}
+	js.mu.RUnlock()
+
+	accts := make([]acctMetrics, len(jsas))
+	var msets []*Stream
+	for i, jsa := range jsas {
+		am := &accts[i]
+		jsa.mu.RLock()
+		am.name = jsa.account.Name
+		memUsed, storeUsed := jsa.usage()
+		am.vals = [8]int64{
+			memUsed, storeUsed, jsa.memReserved, jsa.storeReserved,
+			jsa.limits.MaxMemory, jsa.limits.MaxStore, int64(len(jsa.streams) + len(jsa.lazy)),
+		}
+		msets = msets[:0]
+		for _, mset := range jsa.streams {
+			msets = append(msets, mset)
+		}
+		jsa.mu.RUnlock()
+		for _, mset := range msets {
+			am.vals[7] += int64(mset.NumConsumers())
+		}
+	}
+	sort.Slice(accts, func(i, j int) bool { return accts[i].name < accts[j].name })
+
+	b := make([]byte, 0, 4096)
+	gauge := func(name, help string) {
+		b = append(b, "# HELP "...)
+		b = append(b, name...)
+		b = append(b, ' ')
+		b = append(b, help...)
+		b = append(b, "\n# TYPE "...)
+		b = append(b, name...)
+		b = append(b, " gauge\n"...)
+	}
+	sample := func(name, acc string, v int64) {
+		b = append(b, name...)
+		if acc != _EMPTY_ {
+			b = append(b, `{account="`...)
+			b = appendLabelValue(b, acc)
+			b = append(b, `"}`...)
+		}
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, v, 10)
+		b = append(b, '\n')
+	}
+
+	for i, m := range jsPrometheusAccountMetrics {
+		gauge(m.name, m.help)
+		for _, am := range accts {
+			sample(m.name, am.name, am.vals[i])
+		}
+	}
+	for _, m := range []struct {
+		name, help string
+		v          int64
+	}{
+		{"nats_jetstream_server_memory_reserved_bytes", "Memory reserved by accounts on this server.", memReserved},
+		{"nats_jetstream_server_storage_reserved_bytes", "Storage reserved by accounts on this server.", storeReserved},
+		{"nats_jetstream_server_max_memory_bytes", "Configured maximum memory for this server.", cfg.MaxMemory},
+		{"nats_jetstream_server_max_storage_bytes", "Configured maximum storage for this server.", cfg.MaxStore},
+	} {
+		gauge(m.name, m.help)
+		sample(m.name, _EMPTY_, m.v)
+	}
+	b = append(b, "# EOF\n"...)
+
+	_, err := w.Write(b)
+	return err
+}
+
+// Per account metrics in the order they are collected.
+var jsPrometheusAccountMetrics = [8]struct{ name, help string }{
+	{"nats_jetstream_account_memory_bytes", "Memory used by the account."},
+	{"nats_jetstream_account_storage_bytes", "Storage used by the account."},
+	{"nats_jetstream_account_memory_reserved_bytes", "Memory reserved by the account."},
+	{"nats_jetstream_account_storage_reserved_bytes", "Storage reserved by the account."},
+	{"nats_jetstream_account_max_memory_bytes", "Maximum memory allowed for the account, -1 is unlimited."},
+	{"nats_jetstream_account_max_storage_bytes", "Maximum storage allowed for the account, -1 is unlimited."},
+	{"nats_jetstream_account_streams", "Number of streams in the account."},
+	{"nats_jetstream_account_consumers", "Number of consumers in the account."},
+}
+
+// appendLabelValue will append an escaped label value.
+func appendLabelValue(b []byte, v string) []byte {
+	for i := 0; i < len(v); i++ {
+		switch c := v[i]; c {
+		case '\\', '"':
+			b = append(b, '\\', c)
+		case '\n':
+			b = append(b, '\\', 'n')
+		default:
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
+// JetStreamReadOnly reports if JetStream is in read only mode, e.g. because
+// the storage directory has run out of space. Memory based streams are not affected.
+func (s *Server) JetStreamReadOnly() bool {
+	js := s.getJetStream()
+	if js == nil {
+		return false
+	}
+	return js.isReadOnly()
+}
+
+// How often we check to see if we can leave read only mode.
+var jsReadOnlyCheckInterval = 10 * time.Second
+
+// Amount of available storage we require before leaving read only mode.
+const jsReadOnlyMinAvailable = 32 * 1024 * 1024
+
+func (js *jetStream) isReadOnly() bool {
+	return atomic.LoadInt32(&js.readOnly) == 1
+}
+
+// Place JetStream into read only mode for file based storage.
+// We will periodically check available space and leave read only mode when possible.
+func (js *jetStream) enterReadOnly(reason string) {
+	js.mu.Lock()
+	if js.accounts == nil || !atomic.CompareAndSwapInt32(&js.readOnly, 0, 1) {
+		js.mu.Unlock()
+		return
+	}
+	atomic.StoreInt64(&js.diskAvail, 0)
+	js.roTimer = time.AfterFunc(jsReadOnlyCheckInterval, js.checkReadOnly)
+	s := js.srv
+	js.mu.Unlock()
+
+	s.Errorf("JetStream entering read only mode: %s", reason)
+	s.sendReadOnlyAdvisory(true, reason)
+}
+
+// Called from a timer when in read only mode.
+func (js *jetStream) checkReadOnly() {
+	if !js.isReadOnly() {
+		return
+	}
+	js.mu.RLock()
+	storeDir := js.config.StoreDir
+	js.mu.RUnlock()
+
+	avail := diskAvailable(storeDir)
+	atomic.StoreInt64(&js.diskAvail, avail)
+	if avail < jsReadOnlyMinAvailable {
+		js.mu.Lock()
+		if js.roTimer != nil {
+			js.roTimer.Reset(jsReadOnlyCheckInterval)
+		}
+		js.mu.Unlock()
+		return
+	}
+
+	js.mu.Lock()
+	atomic.StoreInt32(&js.readOnly, 0)
+	js.roTimer = nil
+	s := js.srv
+	js.mu.Unlock()
+
+	reason := fmt.Sprintf("%s of storage space is available", FriendlyBytes(avail))
+	s.Noticef("JetStream leaving read only mode, %s", reason)
+	s.sendReadOnlyAdvisory(false, reason)
 }
 
 func (s *Server) getJetStream() *jetStream {
@@ -404,6 +1572,9 @@ func (s *Server) getJetStream() *jetStream {
 
 // EnableJetStream will enable JetStream on this account with the defined limits.
 // This is a helper for JetStreamEnableAccount.
+// If JetStream has not yet been enabled for the server, ErrJetStreamNotEnabled is returned,
+// but the request will be held and applied when it is. The account will not be able to use
+// JetStream until then.
 func (a *Account) EnableJetStream(limits *JetStreamAccountLimits) error {
 	a.mu.RLock()
 	s := a.srv
@@ -411,34 +1582,71 @@ func (a *Account) EnableJetStream(limits *JetStreamAccountLimits) error {
 	if s == nil {
 		return fmt.Errorf("jetstream account not registered")
 	}
+	if s.SystemAccount() == a {
+		return fmt.Errorf("jetstream can not be enabled on the system account")
+	}
 	// FIXME(dlc) - cluster mode
 	js := s.getJetStream()
 	if js == nil {
+		// Hold onto these, same as configured accounts, until the server is enabled.
+		pending := dynamicJSAccountLimits
+		if limits != nil {
+			l := *limits
+			pending = &l
+		}
+		a.mu.Lock()
+		a.jsLimits = pending
+		a.mu.Unlock()
 		return ErrJetStreamNotEnabled
 	}
-	if s.SystemAccount() == a {
-		return fmt.Errorf("jetstream can not be enabled on the system account")
-	}
 
 	// No limits means we dynamically set up limits.
 	if limits == nil {
 		limits = js.dynamicAccountLimits()
 	}
 
+	// Pick up any encryption key that was set before we were enabled.
+	var aek cipher.AEAD
+	a.mu.RLock()
+	key := a.jsKey
+	a.mu.RUnlock()
+	if len(key) > 0 {
+		var err error
+		if aek, err = newAEAD(key); err != nil {
+			return fmt.Errorf("invalid jetstream encryption key: %v", err)
+		}
+	}
+
+	// Anything stored encrypted needs to be readable with our key.
+	js.mu.RLock()
+	adir, noStore := path.Join(js.config.StoreDir, a.Name), js.config.MemoryOnly
+	js.mu.RUnlock()
+	if !noStore {
+		if err := checkEncryptedMetas(adir, aek); err != nil {
+			return fmt.Errorf("jetstream for account %q can not be recovered: %w", a.Name, err)
+		}
+	}
+
 	js.mu.Lock()
 	// Check the limits against existing reservations.
 	if _, ok := js.accounts[a]; ok {
 		js.mu.Unlock()
-		return fmt.Errorf("jetstream already enabled for account")
+		return fmt.Errorf("%w for account", ErrJetStreamAlreadyEnabled)
 	}
-	if err := js.sufficientResources(limits); err != nil {
+	if err := js.sufficientResources(a, limits); err != nil {
 		js.mu.Unlock()
 		return err
 	}
-	jsa := &jsAccount{js: js, account: a, limits: *limits, streams: make(map[string]*Stream)}
-	jsa.storeDir = path.Join(js.config.StoreDir, a.Name)
+	jsa := &jsAccount{js: js, account: a, streams: make(map[string]*Stream), aek: aek}
+	jsa.setLimits(limits)
+	if !js.config.MemoryOnly {
+		jsa.storeDir = path.Join(js.config.StoreDir, a.Name)
+	}
 	js.accounts[a] = jsa
-	js.reserveResources(limits)
+	js.rebalanceReservationsLocked()
+	lazy, retries, onProgress := js.config.LazyRecovery, js.config.RecoveryRetries, js.config.RecoveryProgress
+	workers, quarantine := js.config.RecoveryConcurrency, js.config.QuarantineCorrupt
+	memoryOnly := js.config.MemoryOnly
 	js.mu.Unlock()
 
 	// Stamp inside account as well.
@@ -455,12 +1663,32 @@ func (a *Account) EnableJetStream(limits *JetStreamAccountLimits) error {
 	s.Debugf("  Max Memory:      %s", FriendlyBytes(limits.MaxMemory))
 	s.Debugf("  Max Storage:     %s", FriendlyBytes(limits.MaxStore))
 
+	// Nothing to recover without storage.
+	if memoryOnly {
+		return nil
+	}
+
+	// Account directories may be symlinked to other volumes.
+	if fi, err := os.Lstat(jsa.storeDir); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		rdir, err := checkStoreDir(jsa.storeDir)
+		if err != nil {
+			return fmt.Errorf("account %q %v", a.Name, err)
+		}
+		s.Noticef("JetStream storage directory %q for account %q resolves to %q", jsa.storeDir, a.Name, rdir)
+	}
+
 	sdir := path.Join(jsa.storeDir, streamsDir)
 	if _, err := os.Stat(sdir); os.IsNotExist(err) {
 		if err := os.MkdirAll(sdir, 0755); err != nil {
 			return fmt.Errorf("could not create storage streams directory - %v", err)
 		}
 	}
+	jsa.mu.RLock()
+	err := jsa.writeLimitsMeta()
+	jsa.mu.RUnlock()
+	if err != nil {
+		s.Warnf("Error persisting JetStream limits for account %q: %v", a.Name, err)
+	}
 
 	// Restore any state here.
 	s.Debugf("Recovering JetStream state for account %q", a.Name)
@@ -472,300 +1700,1877 @@ func (a *Account) EnableJetStream(limits *JetStreamAccountLimits) error {
 		key := sha256.Sum256([]byte("templates"))
 		hh, err := highwayhash.New64(key[:])
 		if err != nil {
-			return err
+			// Skip the templates, but still try to recover the streams below.
+			s.Warnf("  Error creating StreamTemplate checksum for account %q in %q: %v", a.Name, tdir, err)
+		}
+		var fis []os.FileInfo
+		if hh != nil {
+			fis, _ = ioutil.ReadDir(tdir)
 		}
-		fis, _ := ioutil.ReadDir(tdir)
+		trw := newRecoveryWarnings(s, jsa, "  ")
 		for _, fi := range fis {
+			if isQuarantined(fi.Name()) {
+				continue
+			}
 			metafile := path.Join(tdir, fi.Name(), JetStreamMetaFile)
 			metasum := path.Join(tdir, fi.Name(), JetStreamMetaFileSum)
-			buf, err := ioutil.ReadFile(metafile)
+			buf, err := readMetaFile(metafile)
 			if err != nil {
-				s.Warnf("  Error reading StreamTemplate metafile %q: %v", metasum, err)
+				trw.warn("template metafiles could not be read", "  Error reading StreamTemplate metafile %q: %v", metasum, err)
 				continue
 			}
 			if _, err := os.Stat(metasum); os.IsNotExist(err) {
-				s.Warnf("  Missing StreamTemplate checksum for %q", metasum)
+				trw.warn("template checksums missing", "  Missing StreamTemplate checksum for %q", metasum)
 				continue
 			}
-			sum, err := ioutil.ReadFile(metasum)
+			sum, err := readMetaFile(metasum)
 			if err != nil {
-				s.Warnf("  Error reading StreamTemplate checksum %q: %v", metasum, err)
+				trw.warn("template checksums could not be read", "  Error reading StreamTemplate checksum %q: %v", metasum, err)
 				continue
 			}
 			hh.Reset()
 			hh.Write(buf)
 			checksum := hex.EncodeToString(hh.Sum(nil))
 			if checksum != string(sum) {
-				s.Warnf("  StreamTemplate checksums do not match %q vs %q", sum, checksum)
+				if quarantine {
+					s.quarantineCorrupt("  ", "StreamTemplate", path.Join(tdir, fi.Name()), fmt.Errorf("checksums do not match %q vs %q", sum, checksum))
+					continue
+				}
+				trw.warn("template metafiles skipped due to checksum mismatch", "  StreamTemplate checksums do not match %q vs %q", sum, checksum)
+				continue
+			}
+			if buf, err = decryptMeta(aek, buf); err != nil {
+				trw.warn("template metafiles could not be decrypted", "  Error decrypting StreamTemplate metafile %q: %v", metafile, err)
 				continue
 			}
 			var cfg StreamTemplateConfig
 			if err := json.Unmarshal(buf, &cfg); err != nil {
-				s.Warnf("  Error unmarshalling StreamTemplate metafile: %v", err)
+				if quarantine {
+					s.quarantineCorrupt("  ", "StreamTemplate", path.Join(tdir, fi.Name()), err)
+					continue
+				}
+				trw.warn("template metafiles could not be decoded", "  Error unmarshalling StreamTemplate metafile: %v", err)
 				continue
 			}
 			cfg.Config.Name = _EMPTY_
 			if _, err := a.AddStreamTemplate(&cfg); err != nil {
-				s.Warnf("  Error recreating StreamTemplate %q: %v", cfg.Name, err)
+				trw.warn("templates could not be recreated", "  Error recreating StreamTemplate %q: %v", cfg.Name, err)
 				continue
 			}
 		}
+		trw.summarize()
 	}
 
-	// Now recover the streams.
+	// Now recover the streams. All directories are checked and registered with
+	// their templates first, then the streams are recovered concurrently.
+	srw := newRecoveryWarnings(s, jsa, "  ")
+	var pending, recovering []*streamRecoveryRetry
 	fis, _ := ioutil.ReadDir(sdir)
-	for _, fi := range fis {
-		mdir := path.Join(sdir, fi.Name())
-		key := sha256.Sum256([]byte(fi.Name()))
-		hh, err := highwayhash.New64(key[:])
-		if err != nil {
-			return err
+	var (
+		mu   sync.Mutex
+		done int
+	)
+	progress := func(stream string, mset *Stream) {
+		mu.Lock()
+		defer mu.Unlock()
+		done++
+		if onProgress == nil {
+			return
 		}
-		metafile := path.Join(mdir, JetStreamMetaFile)
-		metasum := path.Join(mdir, JetStreamMetaFileSum)
-		if _, err := os.Stat(metafile); os.IsNotExist(err) {
-			s.Warnf("  Missing Stream metafile for %q", metafile)
-			continue
+		var msgs uint64
+		if mset != nil {
+			msgs = mset.State().Msgs
 		}
-		buf, err := ioutil.ReadFile(metafile)
-		if err != nil {
-			s.Warnf("  Error reading metafile %q: %v", metasum, err)
+		onProgress(a.Name, stream, done, len(fis), msgs)
+	}
+	for _, fi := range fis {
+		if isQuarantined(fi.Name()) {
+			progress(fi.Name(), nil)
 			continue
 		}
-		if _, err := os.Stat(metasum); os.IsNotExist(err) {
-			s.Warnf("  Missing Stream checksum for %q", metasum)
-			continue
+		mdir := path.Join(sdir, fi.Name())
+		if fi.Mode()&os.ModeSymlink != 0 {
+			rdir, err := checkStoreDir(mdir)
+			if err != nil {
+				srw.warn("stream directories could not be resolved", "  Error with Stream directory %q: %v", mdir, err)
+				progress(fi.Name(), nil)
+				continue
+			}
+			s.Noticef("  Stream directory %q resolves to %q", mdir, rdir)
 		}
-		sum, err := ioutil.ReadFile(metasum)
+		cfg, class, err := readStreamMeta(mdir, aek)
 		if err != nil {
-			s.Warnf("  Error reading Stream metafile checksum %q: %v", metasum, err)
-			continue
-		}
-		hh.Write(buf)
-		checksum := hex.EncodeToString(hh.Sum(nil))
-		if checksum != string(sum) {
-			s.Warnf("  Stream metafile checksums do not match %q vs %q", sum, checksum)
+			if _, corrupt := err.(*corruptMetaError); corrupt && quarantine {
+				s.quarantineCorrupt("  ", "Stream", mdir, err)
+			} else {
+				srw.warn(class, "  %v", err)
+			}
+			progress(fi.Name(), nil)
 			continue
 		}
 
-		var cfg FileStreamInfo
-		if err := json.Unmarshal(buf, &cfg); err != nil {
-			s.Warnf("  Error unmarshalling Stream metafile: %v", err)
-			continue
+		// Make sure the directory is where the stream expects to be stored.
+		dname := fi.Name()
+		if want := streamDirName(cfg.Name); dname != want {
+			if cfg.dir != _EMPTY_ || dname != cfg.Name {
+				srw.warn("stream directories do not match their metafile", "  Stream %q found in unexpected directory %q", cfg.Name, mdir)
+				progress(cfg.Name, nil)
+				continue
+			}
+			// Stored before directory names were derived, move it into place.
+			if err := os.Rename(mdir, path.Join(sdir, want)); err != nil {
+				srw.warn("stream directories could not be moved", "  Error moving Stream %q to %q: %v", cfg.Name, want, err)
+				progress(cfg.Name, nil)
+				continue
+			}
+			s.Noticef("  Moved Stream %q into directory %q", cfg.Name, want)
+			dname = want
 		}
 
 		if cfg.Template != _EMPTY_ {
 			if err := jsa.addStreamNameToTemplate(cfg.Template, cfg.Name); err != nil {
 				s.Warnf("  Error adding Stream %q to Template %q: %v", cfg.Name, cfg.Template, err)
+				// Still recover it, see OrphanedTemplateStreams.
+				jsa.mu.Lock()
+				if jsa.orphans == nil {
+					jsa.orphans = make(map[string]struct{})
+				}
+				jsa.orphans[cfg.Name] = struct{}{}
+				jsa.mu.Unlock()
 			}
 		}
-		mset, err := a.AddStream(&cfg.StreamConfig)
-		if err != nil {
-			s.Warnf("  Error recreating Stream %q: %v", cfg.Name, err)
-			continue
+
+		// If we are lazy, only register the stream for now. It will be loaded on first access.
+		if lazy && cfg.Storage == FileStorage {
+			if err := a.addLazyStream(jsa, cfg, dname); err != nil {
+				srw.warn("streams could not be registered", "  Error registering Stream %q: %v", cfg.Name, err)
+			}
+			progress(cfg.Name, nil)
+			continue
+		}
+		recovering = append(recovering, &streamRecoveryRetry{cfg: *cfg, dname: dname})
+	}
+
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workers)
+	for _, sr := range recovering {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(sr *streamRecoveryRetry) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			mset, err := a.recoverStream(&sr.cfg, sr.dname)
+			if err != nil {
+				if isResourceErr(err) {
+					// Try these again once everything else has been recovered.
+					s.Debugf("  Stream %q could not be recreated, will retry: %v", sr.cfg.Name, err)
+					sr.err = err
+					mu.Lock()
+					pending = append(pending, sr)
+					mu.Unlock()
+					return
+				}
+				srw.warn("streams could not be recreated", "  Error recreating Stream %q: %v", sr.cfg.Name, err)
+			}
+			progress(sr.cfg.Name, mset)
+		}(sr)
+	}
+	wg.Wait()
+	if retries == 0 {
+		retries = JetStreamDefaultRecoveryRetries
+	}
+	pending = retryStreamRecovery(pending, retries, func(cfg *FileStreamInfo, dname string) error {
+		mset, err := a.recoverStream(cfg, dname)
+		if err == nil {
+			progress(cfg.Name, mset)
+		}
+		return err
+	})
+	for _, sr := range pending {
+		srw.warn("streams could not be recreated", "  Error recreating Stream %q: %v", sr.cfg.Name, sr.err)
+		progress(sr.cfg.Name, nil)
+	}
+	srw.summarize()
+
+	// Make sure to cleanup and old remaining snapshots.
+	os.RemoveAll(path.Join(jsa.storeDir, snapsDir))
+
+	// Report what is actually on disk, which also includes index, consumer and
+	// metadata files. Store usage only tracks messages, so it is left alone.
+	if used, err := storeDirUsage(jsa.storeDir); err != nil {
+		s.Warnf("  Error computing JetStream storage on disk for account %q: %v", a.Name, err)
+	} else if _, storeUsed := jsa.usage(); storeUsed != used {
+		s.Noticef("  JetStream storage on disk for account %q is %s, of which %s is in use by messages",
+			a.Name, FriendlyBytes(used), FriendlyBytes(storeUsed))
+	}
+
+	s.Debugf("JetStream state for account %q recovered", a.Name)
+
+	return nil
+}
+
+// storeDirUsage returns the total size of all regular files under dir.
+// Symlinked stream directories are followed.
+func storeDirUsage(dir string) (int64, error) {
+	var total int64
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if fi, err = os.Stat(p); err != nil {
+				return err
+			}
+			if fi.IsDir() {
+				size, err := storeDirUsage(p + string(os.PathSeparator))
+				total += size
+				return err
+			}
+		}
+		if fi.Mode().IsRegular() {
+			total += fi.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// readStreamMeta reads and verifies the stored configuration of the stream in mdir.
+// On failure the class of the problem is returned for recovery warnings.
+func readStreamMeta(mdir string, aek cipher.AEAD) (*FileStreamInfo, string, error) {
+	metafile := path.Join(mdir, JetStreamMetaFile)
+	metasum := path.Join(mdir, JetStreamMetaFileSum)
+	if _, err := os.Stat(metafile); os.IsNotExist(err) {
+		return nil, "stream metafiles missing", fmt.Errorf("Missing Stream metafile for %q", metafile)
+	}
+	buf, err := readMetaFile(metafile)
+	if err != nil {
+		return nil, "stream metafiles could not be read", fmt.Errorf("Error reading metafile %q: %v", metasum, err)
+	}
+	if _, err := os.Stat(metasum); os.IsNotExist(err) {
+		return nil, "stream checksums missing", fmt.Errorf("Missing Stream checksum for %q", metasum)
+	}
+	sum, err := readMetaFile(metasum)
+	if err != nil {
+		return nil, "stream checksums could not be read", fmt.Errorf("Error reading Stream metafile checksum %q: %v", metasum, err)
+	}
+	// The directory name may be derived from the stream name, so we need to
+	// decode the metafile to know the real name the checksum is keyed by.
+	plain, err := decryptMeta(aek, buf)
+	if err != nil {
+		return nil, "stream metafiles could not be decrypted", fmt.Errorf("Error decrypting Stream metafile %q: %v", metafile, err)
+	}
+	var cfg FileStreamInfo
+	if err := json.Unmarshal(plain, &cfg); err != nil {
+		return nil, "stream metafiles could not be decoded", &corruptMetaError{fmt.Errorf("Error unmarshalling Stream metafile: %v", err)}
+	}
+	key := sha256.Sum256([]byte(cfg.Name))
+	hh, err := highwayhash.New64(key[:])
+	if err != nil {
+		return nil, "stream checksums could not be created", fmt.Errorf("Error creating Stream checksum in %q: %v", mdir, err)
+	}
+	hh.Write(buf)
+	checksum := hex.EncodeToString(hh.Sum(nil))
+	if checksum != string(sum) {
+		return nil, "stream metafiles skipped due to checksum mismatch", &corruptMetaError{fmt.Errorf("Stream metafile checksums do not match %q vs %q", sum, checksum)}
+	}
+	return &cfg, _EMPTY_, nil
+}
+
+// RecoverStream will recover a single stream, along with its consumers, from its
+// directory in the account's storage. This is meant for restoring a stream that
+// was put back in place from a backup without recovering the whole account.
+func (a *Account) RecoverStream(name string) error {
+	_, jsa, err := a.checkForJetStream()
+	if err != nil {
+		return err
+	}
+	jsa.mu.RLock()
+	_, live := jsa.streams[name]
+	_, lazy := jsa.lazy[name]
+	mdir, aek := path.Join(jsa.storeDir, streamsDir, streamDirName(name)), jsa.aek
+	jsa.mu.RUnlock()
+
+	if live || lazy {
+		return ErrJetStreamStreamAlreadyUsed
+	}
+	if _, err := os.Stat(mdir); err != nil {
+		return fmt.Errorf("stream directory for %q not found", name)
+	}
+	cfg, _, err := readStreamMeta(mdir, aek)
+	if err != nil {
+		return err
+	}
+	if cfg.Name != name {
+		return fmt.Errorf("stream directory for %q holds stream %q", name, cfg.Name)
+	}
+	var t *StreamTemplate
+	if cfg.Template != _EMPTY_ {
+		if t, err = a.LookupStreamTemplate(cfg.Template); err != nil {
+			return err
+		}
+		t.mu.Lock()
+		t.streams = append(t.streams, cfg.Name)
+		t.mu.Unlock()
+	}
+	if _, err = a.recoverStream(cfg, streamDirName(name)); err != nil && t != nil {
+		a.validateStreams(t)
+	}
+	return err
+}
+
+// Returns true if JetStream runs without storage.
+func (js *jetStream) memoryOnly() bool {
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	return js.config.MemoryOnly
+}
+
+// Returns if directories with corrupt metafiles are moved aside during recovery.
+func (js *jetStream) quarantineCorrupt() bool {
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	return js.config.QuarantineCorrupt
+}
+
+// Returns if message data should be verified when recovering streams.
+func (js *jetStream) verifyDataOnRecovery() bool {
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	return js.config.VerifyDataOnRecovery
+}
+
+// JetStreamDefaultRecoveryRetries is the default number of passes made over
+// streams that failed to recover due to resource limits.
+const JetStreamDefaultRecoveryRetries = 2
+
+// streamRecoveryRetry is a stream to be recovered, and the error from the last
+// attempt when it failed and will be retried.
+type streamRecoveryRetry struct {
+	cfg   FileStreamInfo
+	dname string
+	err   error
+}
+
+// Returns true if the error is due to resource limits, which may be transient
+// while multiple streams and accounts are being recovered.
+func isResourceErr(err error) bool {
+	return errors.Is(err, ErrJetStreamInsufficientMemory) || errors.Is(err, ErrJetStreamInsufficientStorage)
+}
+
+// retryStreamRecovery will make up to passes attempts to recover the pending streams.
+// These are made once all other streams have been recovered, which is what may free
+// up resources, so there is no waiting between passes. Only resource errors are
+// retried. Returns the streams that could not be recovered.
+func retryStreamRecovery(pending []*streamRecoveryRetry, passes int, recover func(*FileStreamInfo, string) error) []*streamRecoveryRetry {
+	var failed []*streamRecoveryRetry
+	for pass := 0; pass < passes && len(pending) > 0; pass++ {
+		var retry []*streamRecoveryRetry
+		for _, sr := range pending {
+			if err := recover(&sr.cfg, sr.dname); err != nil {
+				sr.err = err
+				if isResourceErr(err) {
+					retry = append(retry, sr)
+				} else {
+					failed = append(failed, sr)
+				}
+			}
+		}
+		pending = retry
+	}
+	return append(failed, pending...)
+}
+
+// recoverStream will recreate a stream from its stored configuration, recovering
+// its messages and any consumers. dname is the name of the stream's directory.
+func (a *Account) recoverStream(cfg *FileStreamInfo, dname string) (*Stream, error) {
+	a.mu.RLock()
+	s, jsa := a.srv, a.js
+	a.mu.RUnlock()
+	if s == nil || jsa == nil {
+		return nil, ErrJetStreamNotEnabledForAccount
+	}
+	jsa.mu.RLock()
+	sdir, aek := path.Join(jsa.storeDir, streamsDir), jsa.aek
+	jsa.mu.RUnlock()
+
+	// Hold our share of the recovery budget while messages and consumers are loaded.
+	if rb := jsa.js.rbudget; rb != nil {
+		cost := rb.acquire(streamRecoveryCost(path.Join(sdir, dname)))
+		defer rb.release(cost)
+	}
+
+	if jsa.js.verifyDataOnRecovery() {
+		brw := newRecoveryWarnings(s, jsa, "    ")
+		corrupt, err := verifyMsgBlocks(path.Join(sdir, dname), cfg.Name)
+		if err != nil {
+			brw.warn("message data could not be verified", "    Error verifying message data for Stream %q: %v", dname, err)
+		}
+		for blk, bad := range corrupt {
+			brw.warn("corrupt message blocks moved aside", "    Corrupt message block %q for Stream %q with %d bad messages, moved to %q",
+				blk, dname, len(bad), path.Join(sdir, dname, corruptDir))
+		}
+		brw.summarize()
+	}
+
+	mset, err := a.AddStream(&cfg.StreamConfig)
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.Created.IsZero() {
+		mset.setCreated(cfg.Created)
+	}
+
+	stats := mset.State()
+	s.Noticef("  Restored %s messages for Stream %q", comma(int64(stats.Msgs)), dname)
+
+	// Now do the consumers.
+	odir := path.Join(sdir, dname, consumerDir)
+	ofis, _ := ioutil.ReadDir(odir)
+	if len(ofis) > 0 {
+		s.Noticef("  Recovering %d Consumers for Stream - %q", len(ofis), dname)
+	}
+	orw := newRecoveryWarnings(s, jsa, "    ")
+	defer orw.summarize()
+	quarantine := jsa.js.quarantineCorrupt()
+	for _, ofi := range ofis {
+		if isQuarantined(ofi.Name()) {
+			continue
+		}
+		metafile := path.Join(odir, ofi.Name(), JetStreamMetaFile)
+		metasum := path.Join(odir, ofi.Name(), JetStreamMetaFileSum)
+		if _, err := os.Stat(metafile); os.IsNotExist(err) {
+			orw.warn("consumer metafiles missing", "    Missing Consumer Metafile %q", metafile)
+			continue
+		}
+		buf, err := readMetaFile(metafile)
+		if err != nil {
+			orw.warn("consumer metafiles could not be read", "    Error reading consumer metafile %q: %v", metasum, err)
+			continue
+		}
+		if _, err := os.Stat(metasum); os.IsNotExist(err) {
+			orw.warn("consumer checksums missing", "    Missing Consumer checksum for %q", metasum)
+			continue
+		}
+		if buf, err = decryptMeta(aek, buf); err != nil {
+			orw.warn("consumer metafiles could not be decrypted", "    Error decrypting Consumer metafile %q: %v", metafile, err)
+			continue
+		}
+		var cfg FileConsumerInfo
+		if err := json.Unmarshal(buf, &cfg); err != nil {
+			if quarantine {
+				s.quarantineCorrupt("    ", "Consumer", path.Join(odir, ofi.Name()), err)
+				continue
+			}
+			orw.warn("consumer metafiles could not be decoded", "    Error unmarshalling Consumer metafile: %v", err)
+			continue
+		}
+		isEphemeral := !isDurableConsumer(&cfg.ConsumerConfig)
+		if isEphemeral {
+			// This is an ephermal consumer and this could fail on restart until
+			// the consumer can reconnect. We will create it as a durable and switch it.
+			cfg.ConsumerConfig.Durable = ofi.Name()
+		}
+		obs, err := mset.AddConsumer(&cfg.ConsumerConfig)
+		if err != nil {
+			orw.warn("consumers could not be added", "    Error adding Consumer: %v", err)
+			continue
+		}
+		if isEphemeral {
+			obs.switchToEphemeral()
+		}
+		if !cfg.Created.IsZero() {
+			obs.setCreated(cfg.Created)
+		}
+		if err := obs.readStoredState(); err != nil {
+			// Do not trust any part of the state, start over from the stream's current position.
+			orw.warn("consumer states could not be restored and were reset",
+				"    Error restoring Consumer %q state, starting as a new consumer per its deliver policy: %v", obs.Name(), err)
+			obs.resetStoredState()
+		}
+	}
+
+	return mset, nil
+}
+
+// checkEncryptedMetas makes sure that every encrypted template, stream and consumer
+// metafile in the account directory adir can be decrypted with aek, which
+// also covers the message blocks of encrypted streams.
+func checkEncryptedMetas(adir string, aek cipher.AEAD) error {
+	subdirs := func(dir string) []string {
+		fis, _ := ioutil.ReadDir(dir)
+		var dirs []string
+		for _, fi := range fis {
+			if !isQuarantined(fi.Name()) {
+				dirs = append(dirs, path.Join(dir, fi.Name()))
+			}
+		}
+		return dirs
+	}
+	dirs := subdirs(path.Join(adir, tmplsDir))
+	for _, sdir := range subdirs(path.Join(adir, streamsDir)) {
+		dirs = append(dirs, sdir)
+		dirs = append(dirs, subdirs(path.Join(sdir, consumerDir))...)
+	}
+	for _, dir := range dirs {
+		metafile := path.Join(dir, JetStreamMetaFile)
+		buf, err := readMetaFile(metafile)
+		if err != nil || !isEncryptedMeta(buf) {
+			continue
+		}
+		if _, err := decryptMeta(aek, buf); err != nil {
+			return fmt.Errorf("%w: %q", err, metafile)
+		}
+	}
+	return nil
+}
+
+// JetStreamMaxMetaFileSize is the largest metafile or checksum that will be read
+// during recovery. Anything larger is assumed to be corrupt.
+const JetStreamMaxMetaFileSize = 8 * 1024 * 1024
+
+// readMetaFile reads a metafile without trusting its size, so a corrupt
+// or runaway file can not exhaust memory during recovery.
+func readMetaFile(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf, err := ioutil.ReadAll(io.LimitReader(f, JetStreamMaxMetaFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > JetStreamMaxMetaFileSize {
+		return nil, fmt.Errorf("file exceeds maximum size of %s", FriendlyBytes(JetStreamMaxMetaFileSize))
+	}
+	return buf, nil
+}
+
+// streamRecoveryCost estimates the peak memory needed to recover the stream stored
+// in mdir. Message blocks are scanned and loaded one at a time, so only the largest
+// counts, while all consumer state is read in.
+func streamRecoveryCost(mdir string) int64 {
+	var largest, cost int64
+	fis, _ := ioutil.ReadDir(path.Join(mdir, msgDir))
+	for _, fi := range fis {
+		if fi.Size() > largest {
+			largest = fi.Size()
+		}
+	}
+	ofis, _ := ioutil.ReadDir(path.Join(mdir, consumerDir))
+	for _, ofi := range ofis {
+		fis, _ := ioutil.ReadDir(path.Join(mdir, consumerDir, ofi.Name()))
+		for _, fi := range fis {
+			cost += fi.Size()
+		}
+	}
+	return largest + cost
+}
+
+// recoveryBudget bounds the memory used by streams being recovered at the same time.
+type recoveryBudget struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	max  int64
+	used int64
+}
+
+func newRecoveryBudget(max int64) *recoveryBudget {
+	rb := &recoveryBudget{max: max}
+	rb.cond = sync.NewCond(&rb.mu)
+	return rb
+}
+
+// acquire will wait until n bytes fit within the budget and returns the amount taken.
+// Anything larger than the whole budget will wait until it can run by itself.
+func (rb *recoveryBudget) acquire(n int64) int64 {
+	if n > rb.max {
+		n = rb.max
+	}
+	rb.mu.Lock()
+	for rb.used > 0 && rb.used+n > rb.max {
+		rb.cond.Wait()
+	}
+	rb.used += n
+	rb.mu.Unlock()
+	return n
+}
+
+// release returns n bytes to the budget.
+func (rb *recoveryBudget) release(n int64) {
+	rb.mu.Lock()
+	rb.used -= n
+	rb.mu.Unlock()
+	rb.cond.Broadcast()
+}
+
+// corruptMetaError is returned for metafiles that do not match their checksum
+// or can not be decoded, as opposed to ones that are missing or unreadable.
+type corruptMetaError struct {
+	error
+}
+
+// Added to the names of directories moved aside due to corrupt metafiles.
+// Names of templates, streams and consumers can not contain a '.'.
+const quarantineSuffix = ".corrupt."
+
+func isQuarantined(name string) bool {
+	return strings.Contains(name, quarantineSuffix)
+}
+
+// quarantineCorrupt moves dir, which holds a corrupt metafile, aside so it is no
+// longer recovered and can be inspected.
+func (s *Server) quarantineCorrupt(indent, kind, dir string, err error) {
+	qdir := dir + quarantineSuffix + time.Now().UTC().Format("20060102T150405.000000000Z")
+	if rerr := os.Rename(dir, qdir); rerr != nil {
+		s.Errorf("%sCorrupt %s metafile in %q could not be moved aside: %v: %v", indent, kind, dir, err, rerr)
+		return
+	}
+	s.Errorf("%sCorrupt %s metafile in %q moved to %q: %v", indent, kind, dir, qdir, err)
+}
+
+// recoveryWarnings aggregates warnings during recovery. The first warning of each
+// class is logged in full, any others only at debug level followed by a summary.
+// Every warning is also recorded in the account's recovery errors.
+type recoveryWarnings struct {
+	mu     sync.Mutex
+	s      *Server
+	jsa    *jsAccount
+	indent string
+	counts map[string]int
+	order  []string
+}
+
+func newRecoveryWarnings(s *Server, jsa *jsAccount, indent string) *recoveryWarnings {
+	return &recoveryWarnings{s: s, jsa: jsa, indent: indent, counts: make(map[string]int)}
+}
+
+func (rw *recoveryWarnings) warn(class, format string, args ...interface{}) {
+	rw.jsa.addRecoveryError(class, strings.TrimSpace(fmt.Sprintf(format, args...)))
+
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.counts[class] == 0 {
+		rw.order = append(rw.order, class)
+		rw.s.Warnf(format, args...)
+	} else {
+		rw.s.Debugf(format, args...)
+	}
+	rw.counts[class]++
+}
+
+// Log a summary for any class that had more than one warning.
+func (rw *recoveryWarnings) summarize() {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	for _, class := range rw.order {
+		if n := rw.counts[class]; n > 1 {
+			rw.s.Warnf("%s%d %s", rw.indent, n, class)
+		}
+	}
+}
+
+// Maximum number of recovery errors we keep for an account.
+const maxRecoveryErrors = 1000
+
+// Records a problem found during recovery, up to maxRecoveryErrors.
+func (jsa *jsAccount) addRecoveryError(class, desc string) {
+	jsa.mu.Lock()
+	if len(jsa.recoveryErrs) < maxRecoveryErrors {
+		jsa.recoveryErrs = append(jsa.recoveryErrs, RecoveryError{Class: class, Description: desc})
+	}
+	jsa.mu.Unlock()
+}
+
+// SetJetStreamDefaultReplicas sets the number of replicas used for streams in this
+// account that do not specify any. Zero will restore the default of a single replica.
+func (a *Account) SetJetStreamDefaultReplicas(replicas int) error {
+	a.mu.RLock()
+	s, jsa := a.srv, a.js
+	a.mu.RUnlock()
+	if jsa == nil {
+		return ErrJetStreamNotEnabledForAccount
+	}
+	if replicas < 0 || replicas > StreamMaxReplicas {
+		return fmt.Errorf("default replicas must be between 0 and %d", StreamMaxReplicas)
+	}
+	if replicas > 1 {
+		if !s.JetStreamIsClustered() {
+			return fmt.Errorf("replicas > 1 not supported in non-clustered mode")
+		}
+		// Only the meta leader knows all of the peers.
+		if peers := s.JetStreamClusterPeers(); len(peers) > 0 && replicas > len(peers) {
+			return fmt.Errorf("default replicas of %d exceeds cluster size of %d", replicas, len(peers))
+		}
+	}
+	jsa.mu.Lock()
+	jsa.defReplicas = replicas
+	jsa.mu.Unlock()
+	return nil
+}
+
+// JetStreamDefaultReplicas returns the number of replicas used for streams
+// that do not specify any.
+func (a *Account) JetStreamDefaultReplicas() int {
+	a.mu.RLock()
+	jsa := a.js
+	a.mu.RUnlock()
+	if jsa == nil {
+		return 0
+	}
+	jsa.mu.RLock()
+	defer jsa.mu.RUnlock()
+	if jsa.defReplicas == 0 {
+		return 1
+	}
+	return jsa.defReplicas
+}
+
+// Will return a copy of config with any account defaults applied.
+func (a *Account) applyStreamDefaults(config *StreamConfig) *StreamConfig {
+	if config == nil {
+		return config
+	}
+	a.mu.RLock()
+	jsa := a.js
+	a.mu.RUnlock()
+	if jsa == nil {
+		return config
+	}
+	jsa.mu.RLock()
+	replicas := jsa.defReplicas
+	dedupe, maxDedupe := jsa.limits.DedupeWindow, jsa.limits.MaxDedupeWindow
+	jsa.mu.RUnlock()
+
+	cfg := *config
+	if cfg.Replicas == 0 && replicas != 0 {
+		cfg.Replicas = replicas
+	}
+	if cfg.Duplicates == 0 && (dedupe > 0 || maxDedupe > 0) {
+		if dedupe <= 0 {
+			dedupe = StreamDefaultDuplicatesWindow
+		}
+		if maxDedupe > 0 && dedupe > maxDedupe {
+			dedupe = maxDedupe
+		}
+		if cfg.MaxAge != 0 && dedupe > cfg.MaxAge {
+			dedupe = cfg.MaxAge
+		}
+		cfg.Duplicates = dedupe
+	}
+	return &cfg
+}
+
+// ResolveStorageType returns the storage type a stream created with config
+// would use once defaults have been applied.
+func (a *Account) ResolveStorageType(config *StreamConfig) StorageType {
+	if config == nil {
+		return defaultStorageType(0)
+	}
+	return defaultStorageType(a.applyStreamDefaults(config).Storage)
+}
+
+// checkStreamCfg will apply account defaults to the config and
+// make sure it is valid and within the account's limits.
+func (a *Account) checkStreamCfg(config *StreamConfig) (StreamConfig, error) {
+	cfg, err := checkStreamCfg(a.applyStreamDefaults(config))
+	if err != nil {
+		return cfg, err
+	}
+	a.mu.RLock()
+	jsa := a.js
+	a.mu.RUnlock()
+	if jsa == nil {
+		return cfg, nil
+	}
+	jsa.mu.RLock()
+	maxDedupe := jsa.limits.MaxDedupeWindow
+	jsa.mu.RUnlock()
+	if maxDedupe > 0 && cfg.Duplicates > maxDedupe {
+		return StreamConfig{}, fmt.Errorf("duplicates window can not be larger then account maximum of %v", maxDedupe)
+	}
+	return cfg, nil
+}
+
+// lazyStream is a stream that has been registered during recovery
+// but whose messages and consumers have not been loaded yet.
+type lazyStream struct {
+	cfg    FileStreamInfo
+	dname  string
+	bytes  int64
+	subs   []*subscription
+	loaded chan struct{}
+	// Set once the loaded stream has its own subscriptions.
+	subscribed int32
+}
+
+// Register a stream to be loaded on first access. We account for the storage
+// used based on the size of the message blocks on disk.
+func (a *Account) addLazyStream(jsa *jsAccount, cfg *FileStreamInfo, dname string) error {
+	var bytes int64
+	mdir := path.Join(jsa.storeDir, streamsDir, dname, msgDir)
+	fis, _ := ioutil.ReadDir(mdir)
+	for _, fi := range fis {
+		var index uint64
+		if n, err := fmt.Sscanf(fi.Name(), blkScan, &index); err == nil && n == 1 {
+			bytes += fi.Size()
+		}
+	}
+
+	ls := &lazyStream{cfg: *cfg, dname: dname, bytes: bytes}
+	name := cfg.Name
+
+	jsa.mu.Lock()
+	if _, ok := jsa.lazy[name]; ok {
+		jsa.mu.Unlock()
+		return ErrJetStreamStreamAlreadyUsed
+	}
+	if jsa.lazy == nil {
+		jsa.lazy = make(map[string]*lazyStream)
+	}
+	jsa.lazy[name] = ls
+	atomic.AddInt64(&jsa.storeUsed, bytes)
+	jsa.reserveStreamResources(&ls.cfg.StreamConfig)
+	jsa.mu.Unlock()
+
+	// Inbound messages will also trigger the load.
+	var subs []*subscription
+	for _, subj := range cfg.Subjects {
+		sub, err := a.subscribeInternal(subj, func(_ *subscription, c *client, subject, reply string, msg []byte) {
+			// The loaded stream's own subscription received this one.
+			if atomic.LoadInt32(&ls.subscribed) == 1 {
+				return
+			}
+			if mset, err := a.loadLazyStream(name); err == nil {
+				mset.processInboundJetStreamMsg(nil, c, subject, reply, msg)
+			}
+		})
+		if err != nil {
+			a.loadLazyStream(name)
+			return err
+		}
+		subs = append(subs, sub)
+	}
+
+	jsa.mu.Lock()
+	ls.subs = subs
+	_, ok := jsa.lazy[name]
+	jsa.mu.Unlock()
+
+	// If we were loaded while subscribing make sure these are cleaned up.
+	if !ok {
+		for _, sub := range subs {
+			sub.client.processUnsub(sub.sid)
+		}
+	}
+	return nil
+}
+
+// Loads a lazily registered stream. If the stream is not registered or is currently
+// being loaded we will return what is found once the load is complete.
+func (a *Account) loadLazyStream(name string) (*Stream, error) {
+	a.mu.RLock()
+	s, jsa := a.srv, a.js
+	a.mu.RUnlock()
+	if jsa == nil {
+		return nil, ErrJetStreamNotEnabled
+	}
+
+	jsa.mu.Lock()
+	// Wait for any move of the account's storage before loading from it.
+	for jsa.moving != nil {
+		moved := jsa.moving
+		jsa.mu.Unlock()
+		<-moved
+		jsa.mu.Lock()
+	}
+	ls := jsa.lazy[name]
+	if ls == nil {
+		ls = jsa.loading[name]
+		jsa.mu.Unlock()
+		if ls != nil {
+			<-ls.loaded
+		}
+		return a.LookupStream(name)
+	}
+	delete(jsa.lazy, name)
+	if jsa.loading == nil {
+		jsa.loading = make(map[string]*lazyStream)
+	}
+	ls.loaded = make(chan struct{})
+	jsa.loading[name] = ls
+	// The store will report its own usage and reservations once loaded.
+	atomic.AddInt64(&jsa.storeUsed, -ls.bytes)
+	jsa.releaseStreamResources(&ls.cfg.StreamConfig)
+	subs := ls.subs
+	jsa.mu.Unlock()
+
+	// The placeholder subscriptions stay in place until the stream has
+	// subscribed itself so inbound messages are not lost during the load.
+	s.Debugf("Loading JetStream stream %q for account %q", name, a.Name)
+	mset, err := a.recoverStream(&ls.cfg, ls.dname)
+	if err != nil {
+		s.Warnf("Error loading Stream %q for account %q: %v", name, a.Name, err)
+	}
+	for _, sub := range subs {
+		sub.client.processUnsub(sub.sid)
+	}
+
+	jsa.mu.Lock()
+	delete(jsa.loading, name)
+	jsa.mu.Unlock()
+	close(ls.loaded)
+
+	return mset, err
+}
+
+// Loads all lazily registered streams, optionally only those that
+// have subjects that collide with filter.
+func (a *Account) loadLazyStreams(filter string) {
+	a.mu.RLock()
+	jsa := a.js
+	a.mu.RUnlock()
+	if jsa == nil {
+		return
+	}
+
+	var names []string
+	jsa.mu.RLock()
+	for name, ls := range jsa.lazy {
+		if filter == _EMPTY_ {
+			names = append(names, name)
+			continue
+		}
+		for _, subj := range ls.cfg.Subjects {
+			if SubjectsCollide(filter, subj) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	jsa.mu.RUnlock()
+
+	for _, name := range names {
+		a.loadLazyStream(name)
+	}
+}
+
+// SetJetStreamEncryptionKey sets the key used to encrypt this account's
+// file based streams at rest. The key must be 16, 24 or 32 bytes to select
+// AES-128, AES-192 or AES-256 in GCM mode. Only stores created after the key
+// is set will be encrypted, existing plaintext stores remain plaintext.
+// The key also needs to be set before JetStream is enabled on the account,
+// which will fail if encrypted stores can not be decrypted with it.
+// An empty key clears the setting.
+func (a *Account) SetJetStreamEncryptionKey(key []byte) error {
+	var aek cipher.AEAD
+	if len(key) > 0 {
+		var err error
+		if aek, err = newAEAD(key); err != nil {
+			return fmt.Errorf("invalid jetstream encryption key: %v", err)
+		}
+		key = append([]byte(nil), key...)
+	} else {
+		key = nil
+	}
+
+	a.mu.Lock()
+	a.jsKey = key
+	jsa := a.js
+	a.mu.Unlock()
+
+	if jsa != nil {
+		jsa.mu.Lock()
+		jsa.aek = aek
+		jsa.mu.Unlock()
+	}
+	return nil
+}
+
+// NumStreams will return how many streams we have.
+func (a *Account) NumStreams() int {
+	a.mu.RLock()
+	jsa := a.js
+	a.mu.RUnlock()
+	if jsa == nil {
+		return 0
+	}
+	jsa.mu.Lock()
+	n := len(jsa.streams) + len(jsa.lazy)
+	jsa.mu.Unlock()
+	return n
+}
+
+// Mark a stream that is being loaded after a lazy recovery as subscribed.
+// From here on its placeholder subscriptions will drop inbound messages.
+func (jsa *jsAccount) lazyStreamSubscribed(name string) {
+	jsa.mu.RLock()
+	ls := jsa.loading[name]
+	jsa.mu.RUnlock()
+	if ls != nil {
+		atomic.StoreInt32(&ls.subscribed, 1)
+	}
+}
+
+// Returns the names of all known streams, optionally only those with subjects
+// that collide with filter. Unlike Streams this will not load any streams
+// that have only been registered by a lazy recovery.
+func (a *Account) streamNames(filter string) []string {
+	a.mu.RLock()
+	jsa := a.js
+	a.mu.RUnlock()
+
+	if jsa == nil {
+		return nil
+	}
+
+	matches := func(subjects []string) bool {
+		if filter == _EMPTY_ {
+			return true
+		}
+		for _, subj := range subjects {
+			if SubjectsCollide(filter, subj) {
+				return true
+			}
+		}
+		return false
+	}
+
+	jsa.mu.RLock()
+	defer jsa.mu.RUnlock()
+
+	var names []string
+	for name, mset := range jsa.streams {
+		if matches(mset.config.Subjects) {
+			names = append(names, name)
+		}
+	}
+	for name, ls := range jsa.lazy {
+		if matches(ls.cfg.Subjects) {
+			names = append(names, name)
+		}
+	}
+	for name, ls := range jsa.loading {
+		if _, ok := jsa.streams[name]; !ok && matches(ls.cfg.Subjects) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Streams will return all known streams.
+func (a *Account) Streams() []*Stream {
+	return a.filteredStreams(_EMPTY_)
+}
+
+func (a *Account) filteredStreams(filter string) []*Stream {
+	a.mu.RLock()
+	jsa := a.js
+	a.mu.RUnlock()
+
+	if jsa == nil {
+		return nil
+	}
+	a.loadLazyStreams(filter)
+
+	jsa.mu.Lock()
+	defer jsa.mu.Unlock()
+
+	var msets []*Stream
+	for _, mset := range jsa.streams {
+		if filter != _EMPTY_ {
+			for _, subj := range mset.config.Subjects {
+				if SubjectsCollide(filter, subj) {
+					msets = append(msets, mset)
+					break
+				}
+			}
+		} else {
+			msets = append(msets, mset)
+		}
+	}
+
+	return msets
+}
+
+// Consumers will return all known consumers across all streams for this account.
+func (a *Account) Consumers() []*Consumer {
+	var obs []*Consumer
+	for _, mset := range a.Streams() {
+		obs = append(obs, mset.Consumers()...)
+	}
+	return obs
+}
+
+// NumConsumers will return how many consumers we have across all streams.
+func (a *Account) NumConsumers() int {
+	var n int
+	for _, mset := range a.Streams() {
+		n += mset.NumConsumers()
+	}
+	return n
+}
+
+// LookupStream will lookup a stream by name.
+func (a *Account) LookupStream(name string) (*Stream, error) {
+	a.mu.RLock()
+	jsa := a.js
+	a.mu.RUnlock()
+
+	if jsa == nil {
+		return nil, ErrJetStreamNotEnabled
+	}
+	jsa.mu.Lock()
+	mset, ok := jsa.streams[name]
+	_, lazy := jsa.lazy[name]
+	_, loading := jsa.loading[name]
+	jsa.mu.Unlock()
+
+	if lazy || loading {
+		return a.loadLazyStream(name)
+	}
+	if !ok {
+		return nil, ErrJetStreamStreamNotFound
+	}
+	return mset, nil
+}
+
+// FindConsumer will find the durable consumer with the given name across all
+// streams in this account, returning it along with the stream that owns it.
+// An error is returned if more than one stream has a durable with that name.
+func (a *Account) FindConsumer(name string) (*Stream, *Consumer, error) {
+	if _, _, err := a.checkForJetStream(); err != nil {
+		return nil, nil, err
+	}
+	var (
+		mset *Stream
+		obs  *Consumer
+	)
+	for _, ms := range a.Streams() {
+		o := ms.LookupConsumer(name)
+		if o == nil || !o.isDurable() {
+			continue
+		}
+		if obs != nil {
+			return nil, nil, fmt.Errorf("consumer %q is ambiguous, found in streams %q and %q", name, mset.Name(), ms.Name())
+		}
+		mset, obs = ms, o
+	}
+	if obs == nil {
+		return nil, nil, ErrJetStreamConsumerNotFound
+	}
+	return mset, obs, nil
+}
+
+// LookupStreams returns all streams whose names match the glob style pattern,
+// e.g. "ORDERS-*". An empty slice is returned if nothing matches.
+func (a *Account) LookupStreams(pattern string) ([]*Stream, error) {
+	a.mu.RLock()
+	jsa := a.js
+	a.mu.RUnlock()
+
+	if jsa == nil {
+		return nil, ErrJetStreamNotEnabled
+	}
+	// Check the pattern up front.
+	if _, err := path.Match(pattern, _EMPTY_); err != nil {
+		return nil, fmt.Errorf("invalid stream name pattern %q", pattern)
+	}
+
+	var names []string
+	jsa.mu.RLock()
+	for name := range jsa.streams {
+		if ok, _ := path.Match(pattern, name); ok {
+			names = append(names, name)
+		}
+	}
+	for name := range jsa.lazy {
+		if ok, _ := path.Match(pattern, name); ok {
+			names = append(names, name)
+		}
+	}
+	jsa.mu.RUnlock()
+	sort.Strings(names)
+
+	msets := make([]*Stream, 0, len(names))
+	for _, name := range names {
+		// This will also load any lazy streams.
+		if mset, err := a.LookupStream(name); err == nil {
+			msets = append(msets, mset)
+		}
+	}
+	return msets, nil
+}
+
+// PurgeStreamBefore removes all messages from the named stream that were stored
+// before t. Consumers are moved past any purged messages. Returns the number of
+// messages purged. Clustered streams have to be purged on the stream leader.
+func (a *Account) PurgeStreamBefore(name string, t time.Time) (uint64, error) {
+	mset, err := a.LookupStream(name)
+	if err != nil {
+		return 0, err
+	}
+	return mset.purgeBefore(t)
+}
+
+// TruncateStream will remove all messages from the named stream after seq.
+// Consumers that delivered messages past seq will start again after seq, but
+// it is an error if any have acknowledged messages past seq.
+func (a *Account) TruncateStream(name string, seq uint64) error {
+	mset, err := a.LookupStream(name)
+	if err != nil {
+		return err
+	}
+	return mset.truncate(seq)
+}
+
+// SealStream will permanently seal the named stream. A sealed stream will
+// reject any new messages and removals, but can still be read by consumers.
+func (a *Account) SealStream(name string) error {
+	mset, err := a.LookupStream(name)
+	if err != nil {
+		return err
+	}
+	cfg := mset.Config()
+	if cfg.Sealed {
+		return nil
+	}
+	cfg.Sealed = true
+	return mset.Update(&cfg)
+}
+
+// UpdateJetStreamLimits will update the account limits for a JetStream enabled account.
+func (a *Account) UpdateJetStreamLimits(limits *JetStreamAccountLimits) error {
+	a.mu.RLock()
+	s := a.srv
+	jsa := a.js
+	a.mu.RUnlock()
+
+	if s == nil {
+		return fmt.Errorf("jetstream account not registered")
+	}
+	js := s.getJetStream()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+	if jsa == nil {
+		return ErrJetStreamNotEnabledForAccount
+	}
+
+	if limits == nil {
+		limits = js.dynamicAccountLimits()
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	// Calculate the delta between what we have and what we want.
+	jsa.mu.Lock()
+	dl := diffCheckedLimits(&jsa.limits, limits)
+	jsa.mu.Unlock()
+
+	// Check the limits against existing reservations.
+	if err := js.sufficientResources(a, &dl); err != nil {
+		return err
+	}
+	// FIXME(dlc) - If we drop and are over the max on memory or store, do we delete??
+	jsa.mu.Lock()
+	jsa.setLimits(limits)
+	if err := jsa.writeLimitsMeta(); err != nil {
+		s.Warnf("Error persisting JetStream limits for account %q: %v", a.Name, err)
+	}
+	jsa.mu.Unlock()
+	js.rebalanceReservationsLocked()
+
+	return nil
+}
+
+// Sets the limits for the account.
+// Lock should be held.
+func (jsa *jsAccount) setLimits(limits *JetStreamAccountLimits) {
+	jsa.limits = *limits
+	atomic.StoreInt64(&jsa.maxHdrSize, int64(limits.MaxHeaderSize))
+}
+
+// Metafiles for the limits of an account, kept in the account's storage directory.
+const (
+	jsLimitsMetaFile    = "limits.inf"
+	jsLimitsMetaFileSum = "limits.sum"
+)
+
+// writeLimitsMeta persists the account's limits, so they can be reported while
+// JetStream is not enabled for the account. See JetStreamPersistedInfo.
+// Lock should be held.
+func (jsa *jsAccount) writeLimitsMeta() error {
+	if jsa.storeDir == _EMPTY_ {
+		return nil
+	}
+	b, err := json.MarshalIndent(jsa.limits, _EMPTY_, "  ")
+	if err != nil {
+		return err
+	}
+	if jsa.aek != nil {
+		if b, err = encryptMeta(jsa.aek, b); err != nil {
+			return err
+		}
+	}
+	if err := ioutil.WriteFile(path.Join(jsa.storeDir, jsLimitsMetaFile), b, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(jsa.storeDir, jsLimitsMetaFileSum), []byte(limitsMetaChecksum(b)), 0644)
+}
+
+// readLimitsMeta returns the limits persisted in the account directory adir,
+// nil if there are none.
+func readLimitsMeta(adir string, aek cipher.AEAD) (*JetStreamAccountLimits, error) {
+	buf, err := ioutil.ReadFile(path.Join(adir, jsLimitsMetaFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sum, err := ioutil.ReadFile(path.Join(adir, jsLimitsMetaFileSum))
+	if err != nil {
+		return nil, err
+	}
+	if checksum := limitsMetaChecksum(buf); checksum != string(sum) {
+		return nil, fmt.Errorf("limits checksums do not match %q vs %q", sum, checksum)
+	}
+	if buf, err = decryptMeta(aek, buf); err != nil {
+		return nil, err
+	}
+	var limits JetStreamAccountLimits
+	if err := json.Unmarshal(buf, &limits); err != nil {
+		return nil, err
+	}
+	return &limits, nil
+}
+
+func limitsMetaChecksum(buf []byte) string {
+	key := sha256.Sum256([]byte("limits"))
+	hh, _ := highwayhash.New64(key[:])
+	hh.Write(buf)
+	return hex.EncodeToString(hh.Sum(nil))
+}
+
+// JetStreamApplyLimits updates the limits of many JetStream enabled accounts at once.
+// All of the new limits are checked together against the server and resource group
+// limits before any are applied, so either all are applied or none are. The error
+// names the first account, in name order, that could not be accommodated.
+func (s *Server) JetStreamApplyLimits(limits map[*Account]*JetStreamAccountLimits) error {
+	js := s.getJetStream()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+	// Accounts can be replaced on reload, so go through the account to its jsAccount.
+	accounts := make([]*Account, 0, len(limits))
+	jsas := make(map[*jsAccount]*JetStreamAccountLimits, len(limits))
+	for a, l := range limits {
+		a.mu.RLock()
+		jsa := a.js
+		a.mu.RUnlock()
+		if jsa == nil {
+			return fmt.Errorf("account %q: %w", a.Name, ErrJetStreamNotEnabledForAccount)
 		}
-		if !cfg.Created.IsZero() {
-			mset.setCreated(cfg.Created)
+		if l == nil {
+			return fmt.Errorf("account %q: no jetstream limits", a.Name)
 		}
+		accounts = append(accounts, a)
+		jsas[jsa] = l
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Name < accounts[j].Name })
 
-		stats := mset.State()
-		s.Noticef("  Restored %s messages for Stream %q", comma(int64(stats.Msgs)), fi.Name())
+	js.mu.Lock()
+	defer js.mu.Unlock()
 
-		// Now do the consumers.
-		odir := path.Join(sdir, fi.Name(), consumerDir)
-		ofis, _ := ioutil.ReadDir(odir)
-		if len(ofis) > 0 {
-			s.Noticef("  Recovering %d Consumers for Stream - %q", len(ofis), fi.Name())
+	if !js.reservationsDisabled() {
+		// Roll up what the accounts that are not changing reserve.
+		groups := make(map[string]*jsResourceGroup, len(js.groups))
+		for name, g := range js.groups {
+			groups[name] = &jsResourceGroup{name: name, maxMemory: g.maxMemory, maxStore: g.maxStore}
 		}
-		for _, ofi := range ofis {
-			metafile := path.Join(odir, ofi.Name(), JetStreamMetaFile)
-			metasum := path.Join(odir, ofi.Name(), JetStreamMetaFileSum)
-			if _, err := os.Stat(metafile); os.IsNotExist(err) {
-				s.Warnf("    Missing Consumer Metafile %q", metafile)
-				continue
-			}
-			buf, err := ioutil.ReadFile(metafile)
-			if err != nil {
-				s.Warnf("    Error reading consumer metafile %q: %v", metasum, err)
-				continue
-			}
-			if _, err := os.Stat(metasum); os.IsNotExist(err) {
-				s.Warnf("    Missing Consumer checksum for %q", metasum)
-				continue
-			}
-			var cfg FileConsumerInfo
-			if err := json.Unmarshal(buf, &cfg); err != nil {
-				s.Warnf("    Error unmarshalling Consumer metafile: %v", err)
+		var mem, store int64
+		for a, jsa := range js.accounts {
+			if _, ok := jsas[jsa]; ok {
 				continue
 			}
-			isEphemeral := !isDurableConsumer(&cfg.ConsumerConfig)
-			if isEphemeral {
-				// This is an ephermal consumer and this could fail on restart until
-				// the consumer can reconnect. We will create it as a durable and switch it.
-				cfg.ConsumerConfig.Durable = ofi.Name()
-			}
-			obs, err := mset.AddConsumer(&cfg.ConsumerConfig)
-			if err != nil {
-				s.Warnf("    Error adding Consumer: %v", err)
-				continue
+			jsa.mu.RLock()
+			amem, astore := jsa.reservation()
+			jsa.mu.RUnlock()
+			mem, store = mem+amem, store+astore
+			if g := groups[js.members[a.Name]]; g != nil {
+				g.memReserved, g.storeReserved = g.memReserved+amem, g.storeReserved+astore
 			}
-			if isEphemeral {
-				obs.switchToEphemeral()
+		}
+		// Then add the new limits.
+		for _, a := range accounts {
+			amem, astore := limits[a].reservation()
+			if mem+amem > js.overcommit(js.config.MaxMemory) {
+				return fmt.Errorf("account %q: %w", a.Name, ErrJetStreamInsufficientMemory)
 			}
-			if !cfg.Created.IsZero() {
-				obs.setCreated(cfg.Created)
+			if store+astore > js.overcommit(js.config.MaxStore) {
+				return fmt.Errorf("account %q: %w", a.Name, ErrJetStreamInsufficientStorage)
 			}
-			if err := obs.readStoredState(); err != nil {
-				s.Warnf("    Error restoring Consumer state: %v", err)
+			if g := groups[js.members[a.Name]]; g != nil {
+				if err := g.sufficientResources(amem, astore); err != nil {
+					return fmt.Errorf("account %q: %w", a.Name, err)
+				}
+				g.memReserved, g.storeReserved = g.memReserved+amem, g.storeReserved+astore
 			}
+			mem, store = mem+amem, store+astore
 		}
 	}
 
-	// Make sure to cleanup and old remaining snapshots.
-	os.RemoveAll(path.Join(jsa.storeDir, snapsDir))
-
-	s.Debugf("JetStream state for account %q recovered", a.Name)
-
+	for jsa, l := range jsas {
+		jsa.mu.Lock()
+		jsa.setLimits(l)
+		if err := jsa.writeLimitsMeta(); err != nil {
+			s.Warnf("Error persisting JetStream limits for account %q: %v", jsa.account.Name, err)
+		}
+		jsa.mu.Unlock()
+	}
+	js.rebalanceReservationsLocked()
 	return nil
 }
 
-// NumStreams will return how many streams we have.
-func (a *Account) NumStreams() int {
+// Returns how much more b reserves than a.
+func diffCheckedLimits(a, b *JetStreamAccountLimits) JetStreamAccountLimits {
+	amem, astore := a.reservation()
+	bmem, bstore := b.reservation()
+	return JetStreamAccountLimits{
+		MaxMemory: bmem - amem,
+		MaxStore:  bstore - astore,
+	}
+}
+
+// JetStreamPersistedInfo reports on what the account has stored on disk, which
+// also works when JetStream is not enabled for the account. Streams are listed by
+// name and limits are the ones last persisted for the account, if any.
+func (a *Account) JetStreamPersistedInfo() (*JetStreamPersistedInfo, error) {
 	a.mu.RLock()
-	jsa := a.js
+	s, key := a.srv, a.jsKey
 	a.mu.RUnlock()
-	if jsa == nil {
-		return 0
+	if s == nil {
+		return nil, fmt.Errorf("jetstream account not registered")
 	}
-	jsa.mu.Lock()
-	n := len(jsa.streams)
-	jsa.mu.Unlock()
-	return n
+	js := s.getJetStream()
+	if js == nil {
+		return nil, ErrJetStreamNotEnabled
+	}
+	js.mu.RLock()
+	adir := path.Join(js.config.StoreDir, a.Name)
+	js.mu.RUnlock()
+
+	if _, err := os.Stat(adir); err != nil {
+		return nil, fmt.Errorf("no jetstream data persisted for account %q", a.Name)
+	}
+	used, err := storeDirUsage(adir)
+	if err != nil {
+		return nil, err
+	}
+	var aek cipher.AEAD
+	if len(key) > 0 {
+		if aek, err = newAEAD(key); err != nil {
+			return nil, fmt.Errorf("invalid jetstream encryption key: %v", err)
+		}
+	}
+
+	limits, err := readLimitsMeta(adir, aek)
+	if err != nil {
+		return nil, fmt.Errorf("error reading jetstream limits for account %q: %v", a.Name, err)
+	}
+	info := &JetStreamPersistedInfo{Store: uint64(used), Streams: []string{}, Limits: limits}
+	fis, _ := ioutil.ReadDir(path.Join(adir, streamsDir))
+	for _, fi := range fis {
+		if cfg, _, err := readStreamMeta(path.Join(adir, streamsDir, fi.Name()), aek); err == nil {
+			info.Streams = append(info.Streams, cfg.Name)
+		}
+	}
+	sort.Strings(info.Streams)
+	fis, _ = ioutil.ReadDir(path.Join(adir, tmplsDir))
+	for _, fi := range fis {
+		if fi.IsDir() && !isQuarantined(fi.Name()) {
+			info.Templates++
+		}
+	}
+	return info, nil
 }
 
-// Streams will return all known streams.
-func (a *Account) Streams() []*Stream {
-	return a.filteredStreams(_EMPTY_)
+// JetStreamManifest is a declarative description of the JetStream configuration
+// of an account. It holds configuration only, never any stream data.
+type JetStreamManifest struct {
+	Limits    JetStreamAccountLimits `json:"limits"`
+	Streams   []StreamConfig         `json:"streams"`
+	Templates []StreamTemplateConfig `json:"templates"`
+	// Prune will delete streams and templates not in the manifest when applied.
+	Prune bool `json:"prune,omitempty"`
 }
 
-func (a *Account) filteredStreams(filter string) []*Stream {
-	a.mu.RLock()
-	jsa := a.js
-	a.mu.RUnlock()
+// ExportJetStreamManifest returns the limits, stream configurations and template
+// configurations of the account as a JSON manifest. Streams owned by a template
+// are left out since they are created by the template.
+func (a *Account) ExportJetStreamManifest() ([]byte, error) {
+	limits, ok := a.JetStreamLimits()
+	if !ok {
+		return nil, ErrJetStreamNotEnabledForAccount
+	}
+	m := &JetStreamManifest{Limits: limits, Streams: []StreamConfig{}, Templates: []StreamTemplateConfig{}}
+	for _, mset := range a.Streams() {
+		if cfg := mset.Config(); cfg.Template == _EMPTY_ && !cfg.internal {
+			m.Streams = append(m.Streams, cfg)
+		}
+	}
+	sort.Slice(m.Streams, func(i, j int) bool { return m.Streams[i].Name < m.Streams[j].Name })
+	for _, ti := range a.TemplateInfos() {
+		// Templates are created with an empty stream name.
+		ti.Config.Config.Name = _EMPTY_
+		m.Templates = append(m.Templates, *ti.Config)
+	}
+	return json.MarshalIndent(m, _EMPTY_, "  ")
+}
 
-	if jsa == nil {
-		return nil
+// ApplyJetStreamManifest reconciles the account with a manifest produced by
+// ExportJetStreamManifest. Missing templates and streams are created and changed
+// templates and streams are updated. Streams and templates not in the manifest are
+// only deleted if it has Prune set.
+func (a *Account) ApplyJetStreamManifest(data []byte) error {
+	var m JetStreamManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("invalid jetstream manifest: %v", err)
+	}
+	limits, ok := a.JetStreamLimits()
+	if !ok {
+		return ErrJetStreamNotEnabledForAccount
+	}
+	if limits != m.Limits {
+		if err := a.UpdateJetStreamLimits(&m.Limits); err != nil {
+			return err
+		}
 	}
 
-	jsa.mu.Lock()
-	defer jsa.mu.Unlock()
+	templates := make(map[string]struct{}, len(m.Templates))
+	for i := range m.Templates {
+		tc := &m.Templates[i]
+		if tc.Config == nil {
+			return fmt.Errorf("template %q is missing a stream configuration", tc.Name)
+		}
+		templates[tc.Name] = struct{}{}
+		t, err := a.LookupStreamTemplate(tc.Name)
+		if err != nil {
+			if _, err := a.AddStreamTemplate(tc); err != nil {
+				return fmt.Errorf("could not create template %q: %v", tc.Name, err)
+			}
+			continue
+		}
+		if !t.sameConfig(tc) {
+			if _, err := a.UpdateStreamTemplate(tc); err != nil {
+				return fmt.Errorf("could not update template %q: %v", tc.Name, err)
+			}
+		}
+	}
 
-	var msets []*Stream
-	for _, mset := range jsa.streams {
-		if filter != _EMPTY_ {
-			for _, subj := range mset.config.Subjects {
-				if SubjectsCollide(filter, subj) {
-					msets = append(msets, mset)
-					break
-				}
+	streams := make(map[string]struct{}, len(m.Streams))
+	for i := range m.Streams {
+		cfg := &m.Streams[i]
+		streams[cfg.Name] = struct{}{}
+		_, err := a.AddStream(cfg)
+		if err == ErrJetStreamStreamAlreadyUsed {
+			var mset *Stream
+			if mset, err = a.LookupStream(cfg.Name); err == nil {
+				err = mset.Update(cfg)
 			}
-		} else {
-			msets = append(msets, mset)
+		}
+		if err != nil {
+			return fmt.Errorf("could not apply stream %q: %v", cfg.Name, err)
 		}
 	}
 
-	return msets
+	if !m.Prune {
+		return nil
+	}
+	for _, ti := range a.TemplateInfos() {
+		name := ti.Config.Name
+		if _, ok := templates[name]; ok {
+			continue
+		}
+		if err := a.DeleteStreamTemplate(name); err != nil {
+			return fmt.Errorf("could not delete template %q: %v", name, err)
+		}
+	}
+	for _, mset := range a.Streams() {
+		cfg := mset.Config()
+		if _, ok := streams[cfg.Name]; ok || cfg.Template != _EMPTY_ || cfg.internal {
+			continue
+		}
+		if err := mset.Delete(); err != nil {
+			return fmt.Errorf("could not delete stream %q: %v", cfg.Name, err)
+		}
+	}
+	return nil
 }
 
-// LookupStream will lookup a stream by name.
-func (a *Account) LookupStream(name string) (*Stream, error) {
+// MaintenanceReport describes what Account.MaintainStream did.
+type MaintenanceReport struct {
+	Stream             string   `json:"stream"`
+	BytesReclaimed     uint64   `json:"bytes_reclaimed"`
+	ChecksumsRewritten uint64   `json:"checksums_rewritten"`
+	Anomalies          []string `json:"anomalies,omitempty"`
+}
+
+// MaintainStream compacts the named stream to reclaim the space held by removed
+// messages, verifies and rewrites the checksums of what remains and recomputes its
+// usage. Blocks are compacted one at a time, so new messages are only held up
+// briefly and it is safe on a live stream.
+func (a *Account) MaintainStream(name string) (MaintenanceReport, error) {
+	rep := MaintenanceReport{Stream: name}
+	mset, err := a.LookupStream(name)
+	if err != nil {
+		return rep, err
+	}
+	mset.mu.RLock()
+	store := mset.store
+	mset.mu.RUnlock()
+
+	switch st := store.(type) {
+	case *fileStore:
+		err = st.maintain(&rep)
+	case *memStore:
+		err = st.maintain(&rep)
+	}
+	return rep, err
+}
+
+// JetStreamUsage reports on JetStream usage and limits for an account.
+func (a *Account) JetStreamUsage() JetStreamAccountStats {
+	return a.jetStreamUsage(false)
+}
+
+// JetStreamUsageWithReserved reports on JetStream usage and limits for an account,
+// and also includes the resources reserved by streams with MaxBytes set.
+func (a *Account) JetStreamUsageWithReserved() JetStreamAccountStats {
+	return a.jetStreamUsage(true)
+}
+
+// JetStreamUsageDetailed reports on JetStream usage and limits for an account, and
+// also breaks usage down by stream, sorted by name. Streams that have not been
+// loaded yet after a lazy recovery are not included.
+func (a *Account) JetStreamUsageDetailed() JetStreamAccountStats {
+	stats := a.jetStreamUsage(false)
 	a.mu.RLock()
 	jsa := a.js
 	a.mu.RUnlock()
-
 	if jsa == nil {
-		return nil, ErrJetStreamNotEnabled
+		return stats
 	}
-	jsa.mu.Lock()
-	defer jsa.mu.Unlock()
+	jsa.mu.RLock()
+	msets := make([]*Stream, 0, len(jsa.streams))
+	for _, mset := range jsa.streams {
+		msets = append(msets, mset)
+	}
+	jsa.mu.RUnlock()
 
-	mset, ok := jsa.streams[name]
-	if !ok {
-		return nil, ErrJetStreamStreamNotFound
+	stats.StreamUsage = make([]StreamUsage, 0, len(msets))
+	for _, mset := range msets {
+		mset.mu.RLock()
+		name, storage := mset.config.Name, mset.config.Storage
+		mset.mu.RUnlock()
+		state := mset.State()
+		su := StreamUsage{Name: name, Msgs: state.Msgs}
+		if storage == MemoryStorage {
+			su.Memory = state.Bytes
+		} else {
+			su.Store = state.Bytes
+		}
+		stats.StreamUsage = append(stats.StreamUsage, su)
 	}
-	return mset, nil
+	sort.Slice(stats.StreamUsage, func(i, j int) bool { return stats.StreamUsage[i].Name < stats.StreamUsage[j].Name })
+	return stats
 }
 
-// UpdateJetStreamLimits will update the account limits for a JetStream enabled account.
-func (a *Account) UpdateJetStreamLimits(limits *JetStreamAccountLimits) error {
+func (a *Account) jetStreamUsage(withReserved bool) JetStreamAccountStats {
 	a.mu.RLock()
-	s := a.srv
 	jsa := a.js
 	a.mu.RUnlock()
 
-	if s == nil {
-		return fmt.Errorf("jetstream account not registered")
+	var stats JetStreamAccountStats
+	if jsa != nil {
+		memUsed, storeUsed := jsa.usage()
+		stats.Memory = uint64(memUsed)
+		stats.Store = uint64(storeUsed)
+		jsa.mu.RLock()
+		if withReserved {
+			stats.MemReserved = uint64(jsa.memReserved)
+			stats.StoreReserved = uint64(jsa.storeReserved)
+		}
+		stats.Streams = len(jsa.streams) + len(jsa.lazy)
+		stats.Limits = jsa.limits
+		stats.OverSoftLimit = jsa.overSoftLimit()
+		if len(jsa.recoveryErrs) > 0 {
+			stats.RecoveryErrors = append([]RecoveryError(nil), jsa.recoveryErrs...)
+		}
+		jsa.mu.RUnlock()
 	}
-	js := s.getJetStream()
-	if js == nil {
-		return ErrJetStreamNotEnabled
+	return stats
+}
+
+// JetStreamLimits returns a copy of the account's JetStream limits and
+// whether JetStream is enabled for the account.
+func (a *Account) JetStreamLimits() (JetStreamAccountLimits, bool) {
+	a.mu.RLock()
+	jsa := a.js
+	a.mu.RUnlock()
+
+	if jsa == nil {
+		return JetStreamAccountLimits{}, false
 	}
+	jsa.mu.RLock()
+	limits := jsa.limits
+	jsa.mu.RUnlock()
+	return limits, true
+}
+
+// JetStreamHeadroom returns how much more memory and storage the account can reserve,
+// up to its hard limits when set. Unlimited resources are reported as -1, and both are
+// zero if JetStream is not enabled.
+func (a *Account) JetStreamHeadroom() (memFree, storeFree int64) {
+	a.mu.RLock()
+	jsa := a.js
+	a.mu.RUnlock()
+
 	if jsa == nil {
-		return ErrJetStreamNotEnabledForAccount
+		return 0, 0
 	}
+	free := func(limit, reserved int64) int64 {
+		if limit < 0 {
+			return -1
+		}
+		if reserved >= limit {
+			return 0
+		}
+		return limit - reserved
+	}
+	jsa.mu.RLock()
+	hardMem, hardStore := jsa.limits.hardLimits()
+	memFree = free(hardMem, jsa.memReserved)
+	storeFree = free(hardStore, jsa.storeReserved)
+	jsa.mu.RUnlock()
+	return memFree, storeFree
+}
 
-	if limits == nil {
-		limits = js.dynamicAccountLimits()
+// JetStreamStoreOnDisk returns the size of all files in the account's storage
+// directory. Unlike the store usage, this includes index, consumer and metadata
+// files, and bytes of removed messages that have not been compacted yet.
+func (a *Account) JetStreamStoreOnDisk() (uint64, error) {
+	_, jsa, err := a.checkForJetStream()
+	if err != nil {
+		return 0, err
+	}
+	jsa.mu.RLock()
+	sdir := jsa.storeDir
+	jsa.mu.RUnlock()
+	if sdir == _EMPTY_ {
+		return 0, nil
 	}
+	used, err := storeDirUsage(sdir)
+	return uint64(used), err
+}
 
-	// Calculate the delta between what we have and what we want.
-	jsa.mu.Lock()
-	dl := diffCheckedLimits(&jsa.limits, limits)
-	jsaLimits := jsa.limits
-	jsa.mu.Unlock()
+// JetStreamBytes returns the bytes used by the account in memory and file
+// based storage along with their combined total.
+func (a *Account) JetStreamBytes() (mem, file, total uint64) {
+	a.mu.RLock()
+	jsa := a.js
+	a.mu.RUnlock()
 
-	js.mu.Lock()
-	// Check the limits against existing reservations.
-	if err := js.sufficientResources(&dl); err != nil {
-		js.mu.Unlock()
-		return err
+	if jsa == nil {
+		return 0, 0, 0
 	}
-	// FIXME(dlc) - If we drop and are over the max on memory or store, do we delete??
-	js.releaseResources(&jsaLimits)
-	js.reserveResources(limits)
-	js.mu.Unlock()
+	memUsed, storeUsed := jsa.usage()
+	mem, file = uint64(memUsed), uint64(storeUsed)
+	return mem, file, mem + file
+}
 
-	// Update
-	jsa.mu.Lock()
-	jsa.limits = *limits
-	jsa.mu.Unlock()
+// How often at most usage callbacks will be invoked.
+var jsUsageNotifyInterval = time.Second
 
-	return nil
+// jsUsageNotifier delivers usage updates to a registered callback.
+type jsUsageNotifier struct {
+	fn   func(stats JetStreamAccountStats)
+	ch   chan struct{}
+	qch  chan struct{}
+	ival time.Duration
 }
 
-func diffCheckedLimits(a, b *JetStreamAccountLimits) JetStreamAccountLimits {
-	return JetStreamAccountLimits{
-		MaxMemory: b.MaxMemory - a.MaxMemory,
-		MaxStore:  b.MaxStore - a.MaxStore,
+// OnJetStreamUsage registers a callback that is invoked when the memory or
+// storage used by the account changes. Calls are made from a dedicated Go
+// routine at most once per second. Only one callback is supported, a new one
+// replaces the old and nil will remove it.
+func (a *Account) OnJetStreamUsage(fn func(stats JetStreamAccountStats)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if n, _ := a.jsUsage.Load().(*jsUsageNotifier); n != nil {
+		close(n.qch)
+	}
+	if fn == nil {
+		a.jsUsage.Store((*jsUsageNotifier)(nil))
+		return
+	}
+	var sqch chan struct{}
+	if a.srv != nil {
+		sqch = a.srv.quitCh
 	}
+	n := &jsUsageNotifier{fn: fn, ch: make(chan struct{}, 1), qch: make(chan struct{}), ival: jsUsageNotifyInterval}
+	a.jsUsage.Store(n)
+	go a.jsUsageLoop(n, sqch)
 }
 
-// JetStreamUsage reports on JetStream usage and limits for an account.
-func (a *Account) JetStreamUsage() JetStreamAccountStats {
-	a.mu.RLock()
-	jsa := a.js
-	a.mu.RUnlock()
+// Signal the usage callback, if any, that our usage has changed.
+func (a *Account) notifyJetStreamUsage() {
+	if n, _ := a.jsUsage.Load().(*jsUsageNotifier); n != nil {
+		select {
+		case n.ch <- struct{}{}:
+		default:
+		}
+	}
+}
 
-	var stats JetStreamAccountStats
-	if jsa != nil {
-		jsa.mu.Lock()
-		stats.Memory = uint64(jsa.memUsed)
-		stats.Store = uint64(jsa.storeUsed)
-		stats.Streams = len(jsa.streams)
-		stats.Limits = jsa.limits
-		jsa.mu.Unlock()
+func (a *Account) jsUsageLoop(n *jsUsageNotifier, sqch chan struct{}) {
+	var last JetStreamAccountStats
+	var lastSent time.Time
+
+	for {
+		select {
+		case <-n.qch:
+			return
+		case <-sqch:
+			return
+		case <-n.ch:
+		}
+		// Coalesce updates so we only call out once per interval.
+		if wait := n.ival - time.Since(lastSent); wait > 0 {
+			select {
+			case <-n.qch:
+				return
+			case <-sqch:
+				return
+			case <-time.After(wait):
+			}
+		}
+		stats := a.JetStreamUsage()
+		if stats.Memory == last.Memory && stats.Store == last.Store {
+			continue
+		}
+		last, lastSent = stats, time.Now()
+		n.fn(stats)
 	}
-	return stats
 }
 
 // DisableJetStream will disable JetStream for this account.
@@ -785,13 +3590,185 @@ func (a *Account) DisableJetStream() error {
 	}
 
 	// Remove service imports.
-	for _, export := range allJsExports {
-		a.removeServiceImport(export)
-	}
+	a.removeAllJetStreamServiceImports()
 
 	return js.disableJetStream(js.lookupAccount(a))
 }
 
+// MoveJetStreamStoreDir moves the account's JetStream data to newDir. The account's
+// directory under the server's storage directory will link to the new location.
+// The account is paused during the move. Publishes to its streams and requests to
+// the JetStream API are held until the move is done, and streams reopen their files
+// from the new location after. On failure the data is left in, or moved back to,
+// its old location.
+func (a *Account) MoveJetStreamStoreDir(newDir string) error {
+	a.mu.RLock()
+	s, jsa := a.srv, a.js
+	a.mu.RUnlock()
+	if s == nil {
+		return fmt.Errorf("jetstream account not registered")
+	}
+	if jsa == nil {
+		return ErrJetStreamNotEnabledForAccount
+	}
+	if len(a.ActiveSnapshots()) > 0 {
+		return fmt.Errorf("jetstream storage can not be moved while snapshots are active")
+	}
+	newDir, err := filepath.Abs(newDir)
+	if err != nil {
+		return err
+	}
+	if fis, err := ioutil.ReadDir(newDir); err == nil && len(fis) > 0 {
+		return fmt.Errorf("jetstream storage directory %q is not empty", newDir)
+	}
+
+	jsa.mu.RLock()
+	link := jsa.storeDir
+	jsa.mu.RUnlock()
+	oldDir, err := checkStoreDir(link)
+	if err != nil {
+		return err
+	}
+	if oldDir == newDir {
+		return nil
+	}
+	if strings.HasPrefix(newDir, oldDir+string(os.PathSeparator)) {
+		return fmt.Errorf("jetstream storage can not be moved inside of %q", oldDir)
+	}
+
+	// Pause the account, streams being loaded are finished first.
+	moved := make(chan struct{})
+	jsa.mu.Lock()
+	if jsa.moving != nil {
+		jsa.mu.Unlock()
+		return fmt.Errorf("jetstream storage for account %q is already being moved", a.Name)
+	}
+	jsa.moving = moved
+	var loading []chan struct{}
+	for _, ls := range jsa.loading {
+		loading = append(loading, ls.loaded)
+	}
+	jsa.mu.Unlock()
+	for _, loaded := range loading {
+		<-loaded
+	}
+
+	jsa.mu.RLock()
+	var paused []*fileStore
+	for _, mset := range jsa.streams {
+		if fs, ok := mset.store.(*fileStore); ok && fs.pause() == nil {
+			paused = append(paused, fs)
+		}
+	}
+	jsa.mu.RUnlock()
+
+	s.Noticef("Moving JetStream storage for account %q from %q to %q", a.Name, oldDir, newDir)
+	if err = moveStoreDir(oldDir, newDir); err == nil {
+		if err = relinkStoreDir(link, newDir); err != nil {
+			if rerr := moveStoreDir(newDir, oldDir); rerr != nil {
+				s.Errorf("Error moving JetStream storage for account %q back to %q: %v", a.Name, oldDir, rerr)
+			}
+			if link != oldDir {
+				relinkStoreDir(link, oldDir)
+			}
+		}
+	}
+	if err != nil {
+		s.Warnf("Error moving JetStream storage for account %q: %v", a.Name, err)
+	}
+
+	for _, fs := range paused {
+		if rerr := fs.resume(); rerr != nil {
+			s.Warnf("Error resuming JetStream storage for account %q: %v", a.Name, rerr)
+			if err == nil {
+				err = rerr
+			}
+		}
+	}
+	jsa.mu.Lock()
+	jsa.moving = nil
+	jsa.mu.Unlock()
+	close(moved)
+
+	return err
+}
+
+// Used to move storage directories, replaceable for tests.
+var storeDirRename = os.Rename
+
+// moveStoreDir moves src to dst. Across filesystems the contents are copied and
+// verified first, and src is only removed once everything has been copied.
+func moveStoreDir(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := storeDirRename(src, dst); err == nil {
+		return nil
+	}
+	if err := copyStoreDir(src, dst); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// copyStoreDir copies the contents of src to dst, checking each file against the
+// checksum of what was read once written.
+func copyStoreDir(src, dst string) error {
+	return filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(target, fi.Mode().Perm())
+		case fi.Mode()&os.ModeSymlink != 0:
+			ldst, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(ldst, target)
+		case !fi.Mode().IsRegular():
+			return nil
+		}
+		buf, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(target, buf, fi.Mode().Perm()); err != nil {
+			return err
+		}
+		written, err := ioutil.ReadFile(target)
+		if err != nil {
+			return err
+		}
+		if sha256.Sum256(written) != sha256.Sum256(buf) {
+			return fmt.Errorf("checksum mismatch copying %q", p)
+		}
+		return nil
+	})
+}
+
+// relinkStoreDir points link to dir, unless link is dir itself.
+func relinkStoreDir(link, dir string) error {
+	if link == dir {
+		return nil
+	}
+	if fi, err := os.Lstat(link); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(link); err != nil {
+			return err
+		}
+	} else if err == nil {
+		return fmt.Errorf("jetstream storage directory %q still exists", link)
+	}
+	return os.Symlink(dir, link)
+}
+
 // Disable JetStream for the account.
 func (js *jetStream) disableJetStream(jsa *jsAccount) error {
 	if jsa == nil {
@@ -800,7 +3777,7 @@ func (js *jetStream) disableJetStream(jsa *jsAccount) error {
 
 	js.mu.Lock()
 	delete(js.accounts, jsa.account)
-	js.releaseResources(&jsa.limits)
+	js.rebalanceReservationsLocked()
 	js.mu.Unlock()
 
 	jsa.delete()
@@ -819,38 +3796,315 @@ func (a *Account) JetStreamEnabled() bool {
 	return enabled
 }
 
+// How long an API request will wait for others from the same account to finish.
+var jsAPIOpWait = 2 * time.Second
+
+// How many API requests per account can be waiting before new ones are rejected.
+const jsAPIOpMaxWaiting = 256
+
+// Returns the semaphore bounding concurrent API requests, nil if unbounded.
+func (jsa *jsAccount) apiOpSem() chan struct{} {
+	jsa.mu.Lock()
+	defer jsa.mu.Unlock()
+	max := jsa.limits.MaxConcurrentAPIOps
+	if max <= 0 {
+		return nil
+	}
+	// Limits may have changed, requests in flight will release to the one they took.
+	if cap(jsa.apiSem) != max {
+		jsa.apiSem = make(chan struct{}, max)
+	}
+	return jsa.apiSem
+}
+
+// tryAcquireAPIOp will take room to process an API request without waiting.
+// The returned function must be called when done. Returns false if there is no room.
+func (jsa *jsAccount) tryAcquireAPIOp() (func(), bool) {
+	sem := jsa.apiOpSem()
+	if sem == nil {
+		return func() {}, true
+	}
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, true
+	default:
+		return nil, false
+	}
+}
+
+// acquireAPIOp will wait for room to process an API request when the account
+// limits concurrent requests. The returned function must be called when done.
+// This should not be called from a readLoop.
+func (jsa *jsAccount) acquireAPIOp() (func(), error) {
+	if release, ok := jsa.tryAcquireAPIOp(); ok {
+		return release, nil
+	}
+	if n := atomic.AddInt32(&jsa.apiWaiting, 1); n > jsAPIOpMaxWaiting {
+		atomic.AddInt32(&jsa.apiWaiting, -1)
+		return nil, ErrJetStreamAPIBusy
+	}
+	defer atomic.AddInt32(&jsa.apiWaiting, -1)
+
+	sem := jsa.apiOpSem()
+	if sem == nil {
+		return func() {}, nil
+	}
+	t := time.NewTimer(jsAPIOpWait)
+	defer t.Stop()
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-t.C:
+		return nil, ErrJetStreamAPIBusy
+	}
+}
+
+// JetStreamLimitExceededHandler is called when an account's usage of a storage
+// type goes over its limit.
+type JetStreamLimitExceededHandler func(acc *Account, storeType StorageType, used, limit int64)
+
+// SetJetStreamLimitExceededHandler sets a handler that is called the first time an
+// account goes over its MaxMemory or MaxStore limit. It is not called again for
+// that storage type until usage has dropped back under the limit.
+// A nil handler removes the current one.
+func (s *Server) SetJetStreamLimitExceededHandler(h JetStreamLimitExceededHandler) {
+	s.jsLimitHandler.Store(h)
+}
+
+func (s *Server) jetStreamLimitExceededHandler() JetStreamLimitExceededHandler {
+	h, _ := s.jsLimitHandler.Load().(JetStreamLimitExceededHandler)
+	return h
+}
+
 // Updates accounting on in use memory and storage.
 func (jsa *jsAccount) updateUsage(storeType StorageType, delta int64) {
-	// TODO(dlc) - atomics? snapshot limits?
-	jsa.mu.Lock()
 	if storeType == MemoryStorage {
-		jsa.memUsed += delta
+		atomic.AddInt64(&jsa.memUsed, delta)
 	} else {
-		jsa.storeUsed += delta
+		atomic.AddInt64(&jsa.storeUsed, delta)
 	}
-	jsa.mu.Unlock()
+	jsa.account.notifyJetStreamUsage()
+}
+
+// Returns the memory and storage in use.
+func (jsa *jsAccount) usage() (mem, store int64) {
+	return atomic.LoadInt64(&jsa.memUsed), atomic.LoadInt64(&jsa.storeUsed)
+}
+
+// Returns the maximum pull batch size and whether oversized requests should be rejected.
+func (jsa *jsAccount) pullBatchLimit() (int, bool) {
+	jsa.mu.RLock()
+	defer jsa.mu.RUnlock()
+	return jsa.limits.MaxPullBatch, jsa.limits.RejectOversizedPull
 }
 
+// limitsExceeded is checked for each stored message. The first time the account
+// goes over its limit for storeType the limit exceeded handler is called, and
+// not again until a message is stored while under the limit.
+// Rejected messages are removed again, so usage alone would re-arm on each one.
 func (jsa *jsAccount) limitsExceeded(storeType StorageType) bool {
-	var exceeded bool
-	jsa.mu.Lock()
+	exceeded, soft := jsa.checkUsage(storeType)
+	jsa.checkSoftLimit(storeType, soft)
+
+	flag := &jsa.storeExceeded
 	if storeType == MemoryStorage {
-		if jsa.limits.MaxMemory > 0 && jsa.memUsed > jsa.limits.MaxMemory {
-			exceeded = true
+		flag = &jsa.memExceeded
+	}
+	var set int32
+	if exceeded {
+		set = 1
+	}
+	// Only the check that flips the flag on calls the handler.
+	if prev := atomic.SwapInt32(flag, set); prev == 1 || !exceeded || jsa.js == nil || jsa.js.srv == nil {
+		return exceeded
+	}
+	if h := jsa.js.srv.jetStreamLimitExceededHandler(); h != nil {
+		jsa.mu.RLock()
+		hardMem, hardStore := jsa.limits.hardLimits()
+		jsa.mu.RUnlock()
+		memUsed, storeUsed := jsa.usage()
+		used, limit := storeUsed, hardStore
+		if storeType == MemoryStorage {
+			used, limit = memUsed, hardMem
 		}
+		h(jsa.account, storeType, used, limit)
+	}
+	return exceeded
+}
+
+// Returns if usage is over the limit for storeType, without notifying.
+func (jsa *jsAccount) exceedsLimits(storeType StorageType) bool {
+	exceeded, _ := jsa.checkUsage(storeType)
+	return exceeded
+}
+
+// Returns if usage is over the hard limit and over the soft limit for storeType.
+func (jsa *jsAccount) checkUsage(storeType StorageType) (exceeded, soft bool) {
+	exceeded, near, soft := jsa.usageExceeded(storeType)
+	if near {
+		// Batched usage not yet applied could change the outcome.
+		jsa.flushBatchedUsage()
+		exceeded, _, soft = jsa.usageExceeded(storeType)
+	}
+	return exceeded, soft
+}
+
+// Returns if usage is over the limit, if usage that may still be batched
+// by the streams could change that, and if usage is over a soft limit.
+func (jsa *jsAccount) usageExceeded(storeType StorageType) (exceeded, near, soft bool) {
+	jsa.mu.RLock()
+	defer jsa.mu.RUnlock()
+	hardMem, hardStore := jsa.limits.hardLimits()
+	memUsed, storeUsed := jsa.usage()
+	used, max, softMax := storeUsed, hardStore, jsa.limits.MaxStore
+	if storeType == MemoryStorage {
+		used, max, softMax = memUsed, hardMem, jsa.limits.MaxMemory
+	}
+	if max <= 0 {
+		return false, false, false
+	}
+	var batched int64
+	if jsa.js != nil {
+		batched = jsa.js.config.UsageBatchSize * int64(len(jsa.streams))
+	}
+	soft = softMax >= 0 && softMax < max && used > softMax
+	return used > max, batched > 0 && used > max-batched && used <= max+batched, soft
+}
+
+// checkSoftLimit warns once when usage crosses the soft limit for storeType,
+// and again only after usage went back under it.
+func (jsa *jsAccount) checkSoftLimit(storeType StorageType, soft bool) {
+	flag := &jsa.storeOverSoft
+	if storeType == MemoryStorage {
+		flag = &jsa.memOverSoft
+	}
+	var set int32
+	if soft {
+		set = 1
+	}
+	if prev := atomic.SwapInt32(flag, set); prev == 1 || !soft || jsa.js == nil || jsa.js.srv == nil {
+		return
+	}
+	jsa.mu.RLock()
+	memSoft, storeSoft := jsa.limits.MaxMemory, jsa.limits.MaxStore
+	jsa.mu.RUnlock()
+	memUsed, storeUsed := jsa.usage()
+	if storeType == MemoryStorage {
+		jsa.js.srv.Warnf("JetStream memory usage of %s for account %q is over the soft limit of %s",
+			FriendlyBytes(memUsed), jsa.account.Name, FriendlyBytes(memSoft))
 	} else {
-		if jsa.limits.MaxStore > 0 && jsa.storeUsed > jsa.limits.MaxStore {
-			exceeded = true
+		jsa.js.srv.Warnf("JetStream storage usage of %s for account %q is over the soft limit of %s",
+			FriendlyBytes(storeUsed), jsa.account.Name, FriendlyBytes(storeSoft))
+	}
+}
+
+// Applies the usage batched by all streams to the account.
+func (jsa *jsAccount) flushBatchedUsage() {
+	jsa.mu.RLock()
+	msets := make([]*Stream, 0, len(jsa.streams))
+	for _, mset := range jsa.streams {
+		msets = append(msets, mset)
+	}
+	jsa.mu.RUnlock()
+	for _, mset := range msets {
+		mset.flushUsage()
+	}
+}
+
+// How long a publish may be held waiting for room under OverLimitBlock,
+// and how often the limits are checked again.
+var (
+	jsOverLimitMaxBlock      = 2 * time.Second
+	jsOverLimitBlockInterval = 10 * time.Millisecond
+)
+
+// Returns a channel that will be closed once the account's storage has been
+// moved, nil if no move is in progress.
+func (jsa *jsAccount) storeMoved() <-chan struct{} {
+	jsa.mu.RLock()
+	defer jsa.mu.RUnlock()
+	return jsa.moving
+}
+
+// Returns the account's over limit policy.
+func (jsa *jsAccount) overLimitPolicy() OverLimitPolicy {
+	jsa.mu.RLock()
+	defer jsa.mu.RUnlock()
+	return jsa.limits.OverLimitPolicy
+}
+
+// Returns if the account has room for sz more bytes of storeType.
+func (jsa *jsAccount) hasRoomFor(storeType StorageType, sz int64) bool {
+	jsa.mu.RLock()
+	hardMem, hardStore := jsa.limits.hardLimits()
+	jsa.mu.RUnlock()
+	memUsed, storeUsed := jsa.usage()
+	used, max := storeUsed, hardStore
+	if storeType == MemoryStorage {
+		used, max = memUsed, hardMem
+	}
+	return max <= 0 || used+sz <= max
+}
+
+// Returns how far usage is over the limit for storeType.
+func (jsa *jsAccount) overLimitBy(storeType StorageType) int64 {
+	jsa.mu.RLock()
+	hardMem, hardStore := jsa.limits.hardLimits()
+	jsa.mu.RUnlock()
+	memUsed, storeUsed := jsa.usage()
+	used, max := storeUsed, hardStore
+	if storeType == MemoryStorage {
+		used, max = memUsed, hardMem
+	}
+	if max <= 0 || used <= max {
+		return 0
+	}
+	return used - max
+}
+
+// Returns the size a message is accounted for in store.
+func storedMsgSize(store StreamStore, subj string, hdr, msg []byte) int64 {
+	if _, ok := store.(*fileStore); ok {
+		return int64(fileStoreMsgSize(subj, hdr, msg))
+	}
+	return int64(memStoreMsgSize(subj, hdr, msg))
+}
+
+// resolveOverLimit applies the account's over limit policy after message seq was
+// stored and put the account over its limits. Returns true if the account is back
+// within its limits and the message can be kept.
+// Only OverLimitDiscardOld can make room here, blocking happens before messages
+// are stored, see processInboundMsg.
+func (jsa *jsAccount) resolveOverLimit(store StreamStore, storeType StorageType, seq uint64) bool {
+	if jsa.overLimitPolicy() != OverLimitDiscardOld {
+		return false
+	}
+	subj, hdr, msg, _, err := store.LoadMsg(seq)
+	if err != nil {
+		return false
+	}
+	// A stream only makes room for its own new message. If the account was
+	// already over its limits because of other streams, reject instead.
+	if jsa.overLimitBy(storeType) > storedMsgSize(store, subj, hdr, msg) {
+		return false
+	}
+	for jsa.exceedsLimits(storeType) {
+		// Never remove the new message itself.
+		fseq := store.State().FirstSeq
+		if fseq == 0 || fseq >= seq {
+			return false
+		}
+		if removed, err := store.RemoveMsg(fseq); err != nil || !removed {
+			return false
 		}
 	}
-	jsa.mu.Unlock()
-	return exceeded
+	return true
 }
 
 // Check if a new proposed msg set while exceed our account limits.
 // Lock should be held.
 func (jsa *jsAccount) checkLimits(config *StreamConfig) error {
-	if jsa.limits.MaxStreams > 0 && len(jsa.streams) >= jsa.limits.MaxStreams {
+	if jsa.limits.MaxStreams > 0 && len(jsa.streams)+len(jsa.lazy) >= jsa.limits.MaxStreams {
 		return fmt.Errorf("maximum number of streams reached")
 	}
 	// Check MaxConsumers
@@ -858,28 +4112,143 @@ func (jsa *jsAccount) checkLimits(config *StreamConfig) error {
 		return fmt.Errorf("maximum consumers exceeds account limit")
 	}
 
-	// Check storage, memory or disk.
-	if config.MaxBytes > 0 {
-		return jsa.checkBytesLimits(config.MaxBytes*int64(config.Replicas), config.Storage)
-	}
-	return nil
+	// Check storage, memory or disk.
+	if config.MaxBytes > 0 {
+		return jsa.checkBytesLimits(config.MaxBytes*int64(config.Replicas), config.Storage)
+	}
+	return nil
+}
+
+// JetStreamDefaultStreamCountAlarm is the default fraction of MaxStreams at which we warn.
+const JetStreamDefaultStreamCountAlarm = 0.9
+
+// checkStreamCountAlarm will warn once when the number of streams crosses the
+// alarm threshold for the account. It is re-armed when the count drops back below.
+func (jsa *jsAccount) checkStreamCountAlarm() {
+	js := jsa.js
+	js.mu.RLock()
+	threshold := js.config.StreamCountAlarm
+	js.mu.RUnlock()
+	if threshold <= 0 {
+		threshold = JetStreamDefaultStreamCountAlarm
+	}
+
+	jsa.mu.Lock()
+	n, max := len(jsa.streams)+len(jsa.lazy), jsa.limits.MaxStreams
+	crossed := max > 0 && float64(n) >= threshold*float64(max)
+	fire := crossed && !jsa.streamsAlarm
+	jsa.streamsAlarm = crossed
+	acc := jsa.account
+	jsa.mu.Unlock()
+
+	if fire {
+		js.srv.sendStreamCountAlarm(acc, n, max)
+	}
+}
+
+// Check if additional bytes will exceed our account limits.
+// This should account for replicas.
+// Lock should be held.
+func (jsa *jsAccount) checkBytesLimits(addBytes int64, storage StorageType) error {
+	if jsa.js.reservationsDisabled() {
+		return nil
+	}
+	hardMem, hardStore := jsa.limits.hardLimits()
+	// Unlimited accounts, e.g. with dynamic limits, are only bound by the server.
+	switch storage {
+	case MemoryStorage:
+		if hardMem < 0 {
+			return nil
+		}
+		if jsa.memReserved+addBytes > hardMem {
+			return ErrJetStreamInsufficientMemory
+		}
+		if jsa.memReserved+addBytes > jsa.limits.MaxMemory {
+			jsa.js.srv.Warnf("JetStream memory reservations of %s for account %q are over the soft limit of %s",
+				FriendlyBytes(jsa.memReserved+addBytes), jsa.account.Name, FriendlyBytes(jsa.limits.MaxMemory))
+		}
+	case FileStorage:
+		if hardStore < 0 {
+			return nil
+		}
+		if jsa.storeReserved+addBytes > hardStore {
+			return ErrJetStreamInsufficientStorage
+		}
+		if jsa.storeReserved+addBytes > jsa.limits.MaxStore {
+			jsa.js.srv.Warnf("JetStream storage reservations of %s for account %q are over the soft limit of %s",
+				FriendlyBytes(jsa.storeReserved+addBytes), jsa.account.Name, FriendlyBytes(jsa.limits.MaxStore))
+		}
+	}
+	return nil
+}
+
+// Returns the storage type of the template store, which holds all templates of the account.
+// Lock should be held.
+func (jsa *jsAccount) templateStorage() StorageType {
+	if _, ok := jsa.store.(*templateFileStore); ok {
+		return FileStorage
+	}
+	return MemoryStorage
+}
+
+// Charges the account for a change in the size of template metadata.
+// Lock should be held.
+func (jsa *jsAccount) addTemplateSize(delta int64) {
+	if jsa.templateStorage() == FileStorage {
+		jsa.storeReserved += delta
+		atomic.AddInt64(&jsa.storeUsed, delta)
+	} else {
+		jsa.memReserved += delta
+		atomic.AddInt64(&jsa.memUsed, delta)
+	}
+}
+
+// Returns if reservations or usage are over the soft limits.
+// Lock should be held.
+func (jsa *jsAccount) overSoftLimit() bool {
+	l := &jsa.limits
+	memUsed, storeUsed := jsa.usage()
+	if l.MaxMemory >= 0 && l.MaxMemoryHard > l.MaxMemory && (jsa.memReserved > l.MaxMemory || memUsed > l.MaxMemory) {
+		return true
+	}
+	return l.MaxStore >= 0 && l.MaxStoreHard > l.MaxStore && (jsa.storeReserved > l.MaxStore || storeUsed > l.MaxStore)
+}
+
+// Reserve the resources a stream may consume based on its MaxBytes.
+// Lock should be held.
+func (jsa *jsAccount) reserveStreamResources(cfg *StreamConfig) {
+	jsa.adjustStreamResources(cfg, 1)
 }
 
-// Check if additional bytes will exceed our account limits.
-// This should account for replicas.
+// Release the resources reserved for a stream.
 // Lock should be held.
-func (jsa *jsAccount) checkBytesLimits(addBytes int64, storage StorageType) error {
-	switch storage {
+func (jsa *jsAccount) releaseStreamResources(cfg *StreamConfig) {
+	jsa.adjustStreamResources(cfg, -1)
+}
+
+// Lock should be held.
+func (jsa *jsAccount) adjustStreamResources(cfg *StreamConfig, sign int64) {
+	if cfg == nil || jsa.js.reservationsDisabled() {
+		return
+	}
+	switch cfg.Storage {
 	case MemoryStorage:
-		if jsa.memReserved+addBytes > jsa.limits.MaxMemory {
-			return fmt.Errorf("insufficient memory resources available")
-		}
+		jsa.memReserved += sign * streamReservation(cfg)
 	case FileStorage:
-		if jsa.storeReserved+addBytes > jsa.limits.MaxStore {
-			return fmt.Errorf("insufficient storage resources available")
-		}
+		jsa.storeReserved += sign * streamReservation(cfg)
 	}
-	return nil
+}
+
+// Returns the number of bytes reserved for a stream, including replicas.
+func streamReservation(cfg *StreamConfig) int64 {
+	if cfg == nil || cfg.MaxBytes <= 0 {
+		return 0
+	}
+	replicas := int64(cfg.Replicas)
+	if replicas <= 0 {
+		replicas = 1
+	}
+	return cfg.MaxBytes * replicas
 }
 
 func (jsa *jsAccount) acc() *Account {
@@ -894,20 +4263,30 @@ func (jsa *jsAccount) delete() {
 	var streams []*Stream
 	var ts []string
 
+	var subs []*subscription
+
 	jsa.mu.Lock()
 	for _, ms := range jsa.streams {
 		streams = append(streams, ms)
 	}
+	for _, ls := range jsa.lazy {
+		subs = append(subs, ls.subs...)
+	}
+	jsa.lazy = nil
 	acc := jsa.account
 	for _, t := range jsa.templates {
 		ts = append(ts, t.Name)
 	}
 	jsa.templates = nil
+	stopAndClearTimer(&jsa.ptmr)
 	jsa.mu.Unlock()
 
 	for _, ms := range streams {
 		ms.stop(false)
 	}
+	for _, sub := range subs {
+		sub.client.processUnsub(sub.sid)
+	}
 
 	for _, t := range ts {
 		acc.DeleteStreamTemplate(t)
@@ -926,66 +4305,270 @@ func (js *jetStream) lookupAccount(a *Account) *jsAccount {
 func (js *jetStream) dynamicAccountLimits() *JetStreamAccountLimits {
 	js.mu.RLock()
 	// For now used all resources. Mostly meant for $G in non-account mode.
-	limits := &JetStreamAccountLimits{js.config.MaxMemory, js.config.MaxStore, -1, -1}
+	limits := &JetStreamAccountLimits{MaxMemory: js.config.MaxMemory, MaxStore: js.config.MaxStore, MaxStreams: -1, MaxConsumers: -1}
 	js.mu.RUnlock()
 	return limits
 }
 
+// Returns true if resources are not reserved ahead of use. This is set when
+// JetStream is enabled and never changes, so no lock is needed.
+func (js *jetStream) reservationsDisabled() bool {
+	return js.config.DisableReservations
+}
+
 // Check to see if we have enough system resources for this account.
+// If the account is in a resource group, the group needs to have enough as well.
 // Lock should be held.
-func (js *jetStream) sufficientResources(limits *JetStreamAccountLimits) error {
-	if limits == nil {
+func (js *jetStream) sufficientResources(a *Account, limits *JetStreamAccountLimits) error {
+	if limits == nil || js.reservationsDisabled() {
 		return nil
 	}
-	if js.memReserved+limits.MaxMemory > js.config.MaxMemory {
-		return fmt.Errorf("insufficient memory resources available")
+	mem, store := limits.reservation()
+	if js.memReserved+mem > js.overcommit(js.config.MaxMemory) {
+		return ErrJetStreamInsufficientMemory
 	}
-	if js.storeReserved+limits.MaxStore > js.config.MaxStore {
-		return fmt.Errorf("insufficient storage resources available")
+	if js.storeReserved+store > js.overcommit(js.config.MaxStore) {
+		return ErrJetStreamInsufficientStorage
+	}
+	if a != nil {
+		if g := js.groups[js.members[a.Name]]; g != nil {
+			return g.sufficientResources(mem, store)
+		}
 	}
 	return nil
 }
 
-// This will (blindly) reserve the respources requested.
+// Returns the overcommit factor, which defaults to 1.0.
 // Lock should be held.
-func (js *jetStream) reserveResources(limits *JetStreamAccountLimits) error {
-	if limits == nil {
-		return nil
+func (js *jetStream) overcommitFactor() float64 {
+	if f := js.config.OvercommitFactor; f > 0 {
+		return f
+	}
+	return 1.0
+}
+
+// Returns how much can be reserved against the server limit max.
+// Lock should be held.
+func (js *jetStream) overcommit(max int64) int64 {
+	return overcommit(max, js.overcommitFactor())
+}
+
+func overcommit(max int64, factor float64) int64 {
+	if factor == 1.0 {
+		return max
 	}
-	if limits.MaxMemory > 0 {
-		js.memReserved += limits.MaxMemory
+	return int64(float64(max) * factor)
+}
+
+// Check to see if the group can take additional reservations.
+// A negative group limit is unlimited. JetStream lock should be held.
+func (g *jsResourceGroup) sufficientResources(mem, store int64) error {
+	if g.maxMemory >= 0 && g.memReserved+mem > g.maxMemory {
+		return fmt.Errorf("%w in resource group %q", ErrJetStreamInsufficientMemory, g.name)
 	}
-	if limits.MaxStore > 0 {
-		js.storeReserved += limits.MaxStore
+	if g.maxStore >= 0 && g.storeReserved+store > g.maxStore {
+		return fmt.Errorf("%w in resource group %q", ErrJetStreamInsufficientStorage, g.name)
 	}
 	return nil
 }
 
-// Lock should be held.
-func (js *jetStream) releaseResources(limits *JetStreamAccountLimits) error {
-	if limits == nil {
+// CreateJetStreamResourceGroup creates a named group of accounts whose combined
+// reservations can not exceed maxStore and maxMemory, in addition to the account
+// and server limits. A negative limit is unlimited.
+func (s *Server) CreateJetStreamResourceGroup(name string, maxStore, maxMemory int64) error {
+	js := s.getJetStream()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+	if name == _EMPTY_ {
+		return fmt.Errorf("resource group name required")
+	}
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if _, ok := js.groups[name]; ok {
+		return ErrJetStreamResourceGroupExists
+	}
+	if js.groups == nil {
+		js.groups = make(map[string]*jsResourceGroup)
+	}
+	js.groups[name] = &jsResourceGroup{name: name, maxMemory: maxMemory, maxStore: maxStore}
+	return nil
+}
+
+// AssignJetStreamResourceGroup places the named account in a resource group, an
+// empty group removes it from its group. The account does not need to be enabled
+// for JetStream yet, but if it is its limits need to fit within the group.
+func (s *Server) AssignJetStreamResourceGroup(account, group string) error {
+	js := s.getJetStream()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	if group == _EMPTY_ {
+		delete(js.members, account)
+		js.rebalanceReservationsLocked()
+		return nil
+	}
+	g := js.groups[group]
+	if g == nil {
+		return ErrJetStreamResourceGroupNotFound
+	}
+	if js.members[account] == group {
 		return nil
 	}
-	if limits.MaxMemory > 0 {
-		js.memReserved -= limits.MaxMemory
+	for a, jsa := range js.accounts {
+		if a.Name != account {
+			continue
+		}
+		jsa.mu.RLock()
+		mem, store := jsa.reservation()
+		jsa.mu.RUnlock()
+		if !js.reservationsDisabled() {
+			if err := g.sufficientResources(mem, store); err != nil {
+				return err
+			}
+		}
 	}
-	if limits.MaxStore > 0 {
-		js.storeReserved -= limits.MaxStore
+	if js.members == nil {
+		js.members = make(map[string]string)
 	}
+	js.members[account] = group
+	js.rebalanceReservationsLocked()
 	return nil
 }
 
-// Will clear the resource reservations. Mostly for reload of a config.
-func (js *jetStream) clearResources() {
+// JetStreamResourceGroupReservations returns the memory and storage reserved by
+// the accounts in the named resource group.
+func (s *Server) JetStreamResourceGroupReservations(name string) (int64, int64, error) {
+	js := s.getJetStream()
+	if js == nil {
+		return -1, -1, ErrJetStreamNotEnabled
+	}
+	js.mu.RLock()
+	defer js.mu.RUnlock()
+	g := js.groups[name]
+	if g == nil {
+		return -1, -1, ErrJetStreamResourceGroupNotFound
+	}
+	return g.memReserved, g.storeReserved, nil
+}
+
+// Returns what the account reserves, up to its hard limits.
+// Lock should be held.
+func (jsa *jsAccount) reservation() (mem, store int64) {
+	return jsa.limits.reservation()
+}
+
+// reconcileReservations will recompute the reservations of all enabled accounts
+// from the streams and templates that were actually recovered, followed by the
+// server level reservations. This corrects any drift between what we think we
+// have reserved and what is on disk, e.g. after a crash.
+func (js *jetStream) reconcileReservations() {
+	if js == nil {
+		return
+	}
+	js.mu.RLock()
+	jsas := make([]*jsAccount, 0, len(js.accounts))
+	for _, jsa := range js.accounts {
+		jsas = append(jsas, jsa)
+	}
+	s := js.srv
+	js.mu.RUnlock()
+
+	for _, jsa := range jsas {
+		mem, store := jsa.recoveredReservations()
+		jsa.mu.Lock()
+		memReserved, storeReserved := jsa.memReserved, jsa.storeReserved
+		jsa.memReserved, jsa.storeReserved = mem, store
+		name := jsa.account.Name
+		jsa.mu.Unlock()
+
+		if memReserved != mem {
+			s.Warnf("JetStream reserved memory for account %q corrected from %s to %s", name, FriendlyBytes(memReserved), FriendlyBytes(mem))
+		}
+		if storeReserved != store {
+			s.Warnf("JetStream reserved storage for account %q corrected from %s to %s", name, FriendlyBytes(storeReserved), FriendlyBytes(store))
+		}
+	}
+	js.rebalanceReservations()
+}
+
+// Returns what the streams, including lazily recovered ones, and the templates
+// of the account reserve, computed from scratch.
+func (jsa *jsAccount) recoveredReservations() (mem, store int64) {
+	jsa.mu.RLock()
+	cfgs := make([]*StreamConfig, 0, len(jsa.lazy))
+	for _, ls := range jsa.lazy {
+		cfgs = append(cfgs, &ls.cfg.StreamConfig)
+	}
+	msets := make([]*Stream, 0, len(jsa.streams))
+	for _, mset := range jsa.streams {
+		msets = append(msets, mset)
+	}
+	for _, t := range jsa.templates {
+		if jsa.templateStorage() == FileStorage {
+			store += t.size
+		} else {
+			mem += t.size
+		}
+	}
+	disabled := jsa.js.reservationsDisabled()
+	jsa.mu.RUnlock()
+
+	if disabled {
+		return mem, store
+	}
+	for _, mset := range msets {
+		cfg := mset.Config()
+		cfgs = append(cfgs, &cfg)
+	}
+	for _, cfg := range cfgs {
+		switch cfg.Storage {
+		case MemoryStorage:
+			mem += streamReservation(cfg)
+		case FileStorage:
+			store += streamReservation(cfg)
+		}
+	}
+	return mem, store
+}
+
+// rebalanceReservations sets the server level reservations to the sum of the
+// limits of all enabled accounts. Reservations are never adjusted incrementally,
+// so they can not drift from the accounts that are actually enabled.
+func (js *jetStream) rebalanceReservations() {
 	if js == nil {
 		return
 	}
 	js.mu.Lock()
-	js.memReserved = 0
-	js.storeReserved = 0
+	js.rebalanceReservationsLocked()
 	js.mu.Unlock()
 }
 
+// Returns the new reservations. Resource group reservations are recomputed as well.
+// Lock should be held.
+func (js *jetStream) rebalanceReservationsLocked() (mem, store int64) {
+	for _, g := range js.groups {
+		g.memReserved, g.storeReserved = 0, 0
+	}
+	// Nothing is reserved when reservations are disabled.
+	if !js.reservationsDisabled() {
+		for a, jsa := range js.accounts {
+			jsa.mu.RLock()
+			amem, astore := jsa.reservation()
+			jsa.mu.RUnlock()
+			mem, store = mem+amem, store+astore
+			if g := js.groups[js.members[a.Name]]; g != nil {
+				g.memReserved, g.storeReserved = g.memReserved+amem, g.storeReserved+astore
+			}
+		}
+	}
+	js.memReserved, js.storeReserved = mem, store
+	return mem, store
+}
+
 const (
 	// JetStreamStoreDir is the prefix we use.
 	JetStreamStoreDir = "jetstream"
@@ -995,6 +4578,279 @@ const (
 	JetStreamMaxMemDefault = 1024 * 1024 * 256
 )
 
+// JetStreamDefaultUsageBatchInterval is the default for JetStreamConfig.UsageBatchInterval.
+const JetStreamDefaultUsageBatchInterval = 100 * time.Millisecond
+
+// JetStreamDefaultStoreDirProbeTimeout is the default time allowed to check
+// the storage directory when enabling JetStream.
+const JetStreamDefaultStoreDirProbeTimeout = 5 * time.Second
+
+// Creates the storage directory if needed and checks it, replaceable for tests.
+var storeDirProbe = func(dir string) (string, error) {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return _EMPTY_, fmt.Errorf("could not create storage directory - %v", err)
+		}
+	}
+	return checkStoreDir(dir)
+}
+
+// probeStoreDir runs the storage directory probe, giving up after timeout.
+// A probe that timed out is left to finish on its own.
+func probeStoreDir(dir string, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		timeout = JetStreamDefaultStoreDirProbeTimeout
+	}
+	type probeResult struct {
+		dir string
+		err error
+	}
+	ch, probe := make(chan probeResult, 1), storeDirProbe
+	go func() {
+		rdir, err := probe(dir)
+		ch <- probeResult{rdir, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r.dir, r.err
+	case <-timer.C:
+		return _EMPTY_, fmt.Errorf("storage directory probe timed out after %v", timeout)
+	}
+}
+
+// checkStoreDir resolves any symlinks for dir and makes sure the target
+// is a directory we can write to. Returns the resolved path.
+func checkStoreDir(dir string) (string, error) {
+	rdir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return _EMPTY_, fmt.Errorf("could not resolve storage directory - %v", err)
+	}
+	if stat, err := os.Stat(rdir); err != nil || !stat.IsDir() {
+		return _EMPTY_, fmt.Errorf("storage directory is not a directory")
+	}
+	tmpfile, err := ioutil.TempFile(rdir, "_test_")
+	if err != nil {
+		return _EMPTY_, fmt.Errorf("storage directory is not writable")
+	}
+	tmpfile.Close()
+	os.Remove(tmpfile.Name())
+	return rdir, nil
+}
+
+// Detects the filesystem type of the storage directory, replaceable for tests.
+var storeDirVolatileFS = volatileFilesystem
+
+// Used to validate configurations, replaceable for tests.
+var (
+	storeDirNetworkFS = networkFilesystem
+	storeDirTotal     = diskTotal
+	jsSystemMemory    = sysmem.Memory
+)
+
+// jsConfigLimitFactor is how many times the system's memory, or the size of the
+// filesystem holding the storage directory, a limit may be before it is taken to
+// be a misconfiguration, such as the wrong unit. Overcommitting stays possible.
+const jsConfigLimitFactor = 1024
+
+// ValidateJetStreamConfig checks a configuration before JetStream is enabled with it.
+// A nil configuration is valid, as are limits of zero or less, which are chosen
+// dynamically. Errors wrap one of ErrJetStreamInvalidStoreDir, ErrJetStreamNetworkStoreDir
+// or ErrJetStreamMemoryLimitTooLarge.
+func ValidateJetStreamConfig(cfg *JetStreamConfig) error {
+	if cfg == nil {
+		return nil
+	}
+	if sysMem := jsSystemMemory(); sysMem > 0 && cfg.MaxMemory/jsConfigLimitFactor > sysMem {
+		return fmt.Errorf("%w: %s is more than %d times the system memory of %s",
+			ErrJetStreamMemoryLimitTooLarge, FriendlyBytes(cfg.MaxMemory), jsConfigLimitFactor, FriendlyBytes(sysMem))
+	}
+	if cfg.MemoryOnly {
+		return nil
+	}
+
+	dir := cfg.StoreDir
+	if dir == _EMPTY_ {
+		dir = os.TempDir()
+	}
+	adir, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("%w: %q can not be made absolute: %v", ErrJetStreamInvalidStoreDir, dir, err)
+	}
+	if fi, err := os.Stat(adir); err == nil && !fi.IsDir() {
+		return fmt.Errorf("%w: %q is not a directory", ErrJetStreamInvalidStoreDir, adir)
+	}
+	if cfg.AllowNetworkStoreDir {
+		return nil
+	}
+	if fstype := storeDirNetworkFS(existingDir(adir)); fstype != _EMPTY_ {
+		return fmt.Errorf("%w: %q is on a %s filesystem, which does not provide the locking and sync guarantees file storage needs",
+			ErrJetStreamNetworkStoreDir, dir, fstype)
+	}
+	return nil
+}
+
+// Returns dir, or the closest parent of dir that exists. The storage directory
+// may not exist yet, so this is where the filesystem it will be created on is checked.
+func existingDir(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
+	}
+}
+
+// warnStoreLimit warns when MaxStore is far beyond the size of the filesystem
+// holding the storage directory, which is likely the wrong unit. Filesystems can
+// grow, so this is not an error.
+func (s *Server) warnStoreLimit(cfg *JetStreamConfig) {
+	if cfg == nil || cfg.MemoryOnly || cfg.MaxStore <= 0 {
+		return
+	}
+	dir := cfg.StoreDir
+	if dir == _EMPTY_ {
+		dir = os.TempDir()
+	}
+	adir, err := filepath.Abs(dir)
+	if err != nil {
+		return
+	}
+	if total := storeDirTotal(existingDir(adir)); total > 0 && cfg.MaxStore/jsConfigLimitFactor > total {
+		s.Warnf("JetStream max storage of %s is more than %d times the size of the filesystem holding %q of %s",
+			FriendlyBytes(cfg.MaxStore), jsConfigLimitFactor, dir, FriendlyBytes(total))
+	}
+}
+
+// checkStoreDirDurable warns when dir is on a RAM backed filesystem, since file
+// storage there will not survive a reboot. In strict mode this is an error.
+func (s *Server) checkStoreDirDurable(dir string, strict bool) error {
+	fstype := storeDirVolatileFS(dir)
+	if fstype == _EMPTY_ {
+		return nil
+	}
+	if strict {
+		return fmt.Errorf("storage directory %q is on a %s filesystem and is not durable", dir, fstype)
+	}
+	s.Warnf("JetStream storage directory %q is on a %s filesystem, file based streams will not survive a reboot", dir, fstype)
+	return nil
+}
+
+// JetStreamLayoutFile marks the version of the directory layout under the storage directory.
+const JetStreamLayoutFile = "layout.ver"
+
+// JetStreamLayoutVersion is the storage directory layout this server uses.
+const JetStreamLayoutVersion = 1
+
+// jsLayoutMigrations upgrade a storage directory from the layout version
+// they are keyed by to the next one.
+var jsLayoutMigrations = map[int]func(storeDir string) error{
+	// Unversioned directories already match the first layout.
+	0: func(string) error { return nil },
+}
+
+// checkStoreLayout will make sure the storage directory uses our layout,
+// migrating older layouts. Newer layouts are refused.
+func (s *Server) checkStoreLayout(storeDir string) error {
+	lfile := filepath.Join(storeDir, JetStreamLayoutFile)
+	var v int
+	if buf, err := ioutil.ReadFile(lfile); err == nil {
+		if v, err = strconv.Atoi(strings.TrimSpace(string(buf))); err != nil || v <= 0 {
+			return fmt.Errorf("invalid storage layout version %q in %q", buf, lfile)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("could not read storage layout version - %v", err)
+	}
+
+	if v > JetStreamLayoutVersion {
+		return fmt.Errorf("storage layout version %d is newer than the supported version %d", v, JetStreamLayoutVersion)
+	}
+	for ; v < JetStreamLayoutVersion; v++ {
+		migrate := jsLayoutMigrations[v]
+		if migrate == nil {
+			return fmt.Errorf("no migration for storage layout version %d", v)
+		}
+		if v > 0 {
+			s.Noticef("Migrating JetStream storage layout from version %d to %d", v, v+1)
+		}
+		if err := migrate(storeDir); err != nil {
+			return fmt.Errorf("could not migrate storage layout from version %d - %v", v, err)
+		}
+		// Stamp each step so an interrupted migration picks up where it left off.
+		tmp := lfile + ".tmp"
+		if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(v+1)), 0644); err != nil {
+			return fmt.Errorf("could not write storage layout version - %v", err)
+		}
+		if err := os.Rename(tmp, lfile); err != nil {
+			return fmt.Errorf("could not write storage layout version - %v", err)
+		}
+	}
+	return nil
+}
+
+// Returns a copy of config with any dynamic values filled in.
+func (s *Server) resolveJetStreamConfig(config *JetStreamConfig) JetStreamConfig {
+	// Copy, don't change callers version.
+	var cfg JetStreamConfig
+	if config != nil {
+		cfg = *config
+	}
+	// Memory only uses no storage at all.
+	if cfg.MemoryOnly {
+		if cfg.MaxMemory <= 0 {
+			cfg.MaxMemory = dynJetStreamMaxMemory()
+		}
+		cfg.StoreDir, cfg.MaxStore = _EMPTY_, 0
+		return cfg
+	}
+	if cfg.MaxMemory <= 0 || cfg.MaxStore <= 0 {
+		dyn := s.dynJetStreamConfig(cfg.StoreDir, cfg.MaxStore)
+		cfg.StoreDir, cfg.MaxMemory, cfg.MaxStore = dyn.StoreDir, dyn.MaxMemory, dyn.MaxStore
+	}
+	if cfg.StoreDir == "" {
+		cfg.StoreDir = filepath.Join(os.TempDir(), JetStreamStoreDir)
+	}
+	// The temp directory could be relative.
+	if dir, err := filepath.Abs(cfg.StoreDir); err == nil {
+		cfg.StoreDir = dir
+	}
+	return cfg
+}
+
+// expandStoreDir expands a leading ~ and any environment variables in dir and
+// makes it absolute. An unset variable is an error, so we never create a
+// directory with the variable's name instead.
+func expandStoreDir(dir string) (string, error) {
+	if dir == "~" || strings.HasPrefix(dir, "~/") || strings.HasPrefix(dir, "~"+string(filepath.Separator)) {
+		home, err := homeDir()
+		if err != nil {
+			return _EMPTY_, fmt.Errorf("%w: %q can not be expanded: %v", ErrJetStreamInvalidStoreDir, dir, err)
+		}
+		dir = filepath.Join(home, dir[1:])
+	}
+	var unset string
+	edir := os.Expand(dir, func(name string) string {
+		v, ok := os.LookupEnv(name)
+		if !ok && unset == _EMPTY_ {
+			unset = name
+		}
+		return v
+	})
+	if unset != _EMPTY_ {
+		return _EMPTY_, fmt.Errorf("%w: %q uses environment variable %q which is not set", ErrJetStreamInvalidStoreDir, dir, unset)
+	}
+	adir, err := filepath.Abs(edir)
+	if err != nil {
+		return _EMPTY_, fmt.Errorf("%w: %q can not be made absolute: %v", ErrJetStreamInvalidStoreDir, edir, err)
+	}
+	return adir, nil
+}
+
 // Dynamically create a config with a tmp based directory (repeatable) and 75% of system memory.
 func (s *Server) dynJetStreamConfig(storeDir string, maxStore int64) *JetStreamConfig {
 	jsc := &JetStreamConfig{}
@@ -1010,13 +4866,16 @@ func (s *Server) dynJetStreamConfig(storeDir string, maxStore int64) *JetStreamC
 	} else {
 		jsc.MaxStore = diskAvailable(jsc.StoreDir)
 	}
-	// Estimate to 75% of total memory if we can determine system memory.
+	jsc.MaxMemory = dynJetStreamMaxMemory()
+	return jsc
+}
+
+// Estimate to 75% of total memory if we can determine system memory.
+func dynJetStreamMaxMemory() int64 {
 	if sysMem := sysmem.Memory(); sysMem > 0 {
-		jsc.MaxMemory = sysMem / 4 * 3
-	} else {
-		jsc.MaxMemory = JetStreamMaxMemDefault
+		return sysMem / 4 * 3
 	}
-	return jsc
+	return JetStreamMaxMemDefault
 }
 
 // Helper function.
@@ -1039,12 +4898,40 @@ type StreamTemplateConfig struct {
 	Name       string        `json:"name"`
 	Config     *StreamConfig `json:"config"`
 	MaxStreams uint32        `json:"max_streams"`
+	// CreateRetries is how many times creating a stream is retried after a transient
+	// failure, such as a lack of resources. Configuration errors are never retried.
+	CreateRetries int `json:"create_retries,omitempty"`
+	// CreateBackoff is the wait before the first retry, doubled for each retry after.
+	// Zero will use the default. Retries stop once they would wait more than 5s in total.
+	CreateBackoff time.Duration `json:"create_backoff,omitempty"`
+	// FailedBuffer is how many messages are held when a stream could not be created.
+	// They are stored once the stream for their subject is created. Zero drops them.
+	// Held messages are dropped after two minutes.
+	FailedBuffer int `json:"failed_buffer,omitempty"`
 }
 
+// JetStreamDefaultTemplateCreateBackoff is the default for StreamTemplateConfig.CreateBackoff.
+const JetStreamDefaultTemplateCreateBackoff = 50 * time.Millisecond
+
+var (
+	// The most time spent waiting to retry creating a template stream.
+	tmplCreateMaxRetryWait = 5 * time.Second
+	// How long messages are held after failing to create their stream.
+	tmplFailedMsgMaxAge = 2 * time.Minute
+)
+
 // StreamTemplateInfo
 type StreamTemplateInfo struct {
 	Config  *StreamTemplateConfig `json:"config"`
 	Streams []string              `json:"streams"`
+	Stats   StreamTemplateStats   `json:"stats"`
+}
+
+// StreamTemplateStats counts the streams a template has tried to create on demand.
+type StreamTemplateStats struct {
+	Created  uint64 `json:"created"`
+	HitLimit uint64 `json:"hit_limit"`
+	Failed   uint64 `json:"failed"`
 }
 
 // StreamTemplate
@@ -1054,27 +4941,79 @@ type StreamTemplate struct {
 	jsa *jsAccount
 	*StreamTemplateConfig
 	streams []string
+	// Bytes of account storage used by the template's metadata.
+	size int64
+	// Streams currently being created, keyed by canonical name.
+	creating map[string]*tmplStreamCreate
+	stats    StreamTemplateStats
+	// Messages held after failing to create their stream, oldest first.
+	failed []*tmplFailedMsg
+	ftmr   *time.Timer
 }
 
-func (t *StreamTemplateConfig) deepCopy() *StreamTemplateConfig {
-	copy := *t
-	cfg := *t.Config
-	copy.Config = &cfg
-	return &copy
+// tmplFailedMsg is a message held until its stream is created.
+type tmplFailedMsg struct {
+	cn      string
+	subject string
+	reply   string
+	hdr     []byte
+	msg     []byte
+	ts      time.Time
 }
 
-// AddStreamTemplate will add a stream template to this account that allows auto-creation of streams.
-func (a *Account) AddStreamTemplate(tc *StreamTemplateConfig) (*StreamTemplate, error) {
-	s, jsa, err := a.checkForJetStream()
-	if err != nil {
-		return nil, err
+func newTmplFailedMsg(cn, subject, reply string, hdr, msg []byte) *tmplFailedMsg {
+	return &tmplFailedMsg{cn, subject, reply, copyBytes(hdr), copyBytes(msg), time.Now()}
+}
+
+// If set, called before a template creates a stream and any error fails the creation.
+var templateCreateHook func(cfg *StreamConfig) error
+
+// Creates a stream for a template.
+func templateAddStream(acc *Account, cfg *StreamConfig) (*Stream, error) {
+	if hook := templateCreateHook; hook != nil {
+		if err := hook(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return acc.AddStream(cfg)
+}
+
+// Returns true if creating a stream may succeed when tried again later.
+func isTransientStreamCreateError(err error) bool {
+	if errors.Is(err, ErrJetStreamInsufficientMemory) || errors.Is(err, ErrJetStreamInsufficientStorage) || errors.Is(err, ErrJetStreamReadOnly) {
+		return true
 	}
+	var perr *os.PathError
+	return errors.As(err, &perr)
+}
+
+// tmplStreamCreate tracks an in-flight stream creation. Messages for the
+// same subject are held until the creation is done.
+type tmplStreamCreate struct {
+	pending []*tmplFailedMsg
+}
+
+func (t *StreamTemplateConfig) deepCopy() *StreamTemplateConfig {
+	copy := *t
+	cfg := t.Config.deepCopy()
+	copy.Config = &cfg
+	return &copy
+}
+
+// Checks a template configuration and returns a copy with the stream defaults applied.
+func (jsa *jsAccount) checkStreamTemplateCfg(tc *StreamTemplateConfig) (*StreamTemplateConfig, error) {
 	if tc.Config.Name != "" {
 		return nil, fmt.Errorf("template config name should be empty")
 	}
 	if len(tc.Name) > JSMaxNameLen {
 		return nil, fmt.Errorf("template name is too long, maximum allowed is %d", JSMaxNameLen)
 	}
+	if tc.Config != nil && tc.Config.Storage == FileStorage && jsa.js.memoryOnly() {
+		return nil, ErrJetStreamMemoryOnly
+	}
+	if tc.CreateRetries < 0 || tc.CreateBackoff < 0 || tc.FailedBuffer < 0 {
+		return nil, fmt.Errorf("template create retries, backoff and failed buffer can not be negative")
+	}
 
 	// FIXME(dlc) - Hacky
 	tcopy := tc.deepCopy()
@@ -1084,19 +5023,45 @@ func (a *Account) AddStreamTemplate(tc *StreamTemplateConfig) (*StreamTemplate,
 		return nil, err
 	}
 	tcopy.Config = &cfg
-	t := &StreamTemplate{
-		StreamTemplateConfig: tcopy,
-		tc:                   s.createInternalJetStreamClient(),
-		jsa:                  jsa,
+	return tcopy, nil
+}
+
+// Returns an error if any of the template's subjects overlap those of another template.
+// Lock should be held.
+func (jsa *jsAccount) checkTemplateOverlap(tc *StreamTemplateConfig) error {
+	for _, et := range jsa.templates {
+		if et.Name == tc.Name {
+			continue
+		}
+		for _, subj := range tc.Config.Subjects {
+			for _, esubj := range et.Config.Subjects {
+				if SubjectsCollide(subj, esubj) {
+					return fmt.Errorf("template subject %q overlaps existing template %q", subj, et.Name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// AddStreamTemplate will add a stream template to this account that allows auto-creation of streams.
+func (a *Account) AddStreamTemplate(tc *StreamTemplateConfig) (*StreamTemplate, error) {
+	s, jsa, err := a.checkForJetStream()
+	if err != nil {
+		return nil, err
+	}
+	tcopy, err := jsa.checkStreamTemplateCfg(tc)
+	if err != nil {
+		return nil, err
 	}
-	t.tc.registerWithAccount(a)
+	t := &StreamTemplate{StreamTemplateConfig: tcopy, jsa: jsa}
 
 	jsa.mu.Lock()
 	if jsa.templates == nil {
 		jsa.templates = make(map[string]*StreamTemplate)
 		// Create the appropriate store
-		if cfg.Storage == FileStorage {
-			jsa.store = newTemplateFileStore(jsa.storeDir)
+		if tcopy.Config.Storage == FileStorage {
+			jsa.store = newTemplateFileStore(jsa.storeDir, jsa.aek)
 		} else {
 			jsa.store = newTemplateMemStore()
 		}
@@ -1104,10 +5069,39 @@ func (a *Account) AddStreamTemplate(tc *StreamTemplateConfig) (*StreamTemplate,
 		jsa.mu.Unlock()
 		return nil, fmt.Errorf("template with name %q already exists", tcopy.Name)
 	}
+	if jsa.limits.MaxTemplates > 0 && len(jsa.templates) >= jsa.limits.MaxTemplates {
+		jsa.mu.Unlock()
+		return nil, ErrJetStreamMaxTemplatesReached
+	}
+	// Overlapping templates would race to create streams for the same subjects.
+	if err := jsa.checkTemplateOverlap(tcopy); err != nil {
+		jsa.mu.Unlock()
+		return nil, err
+	}
+	// Template metadata counts against the account's storage.
+	size, err := jsa.store.Size(t)
+	if err != nil {
+		jsa.mu.Unlock()
+		return nil, err
+	}
+	if size > 0 {
+		if err := jsa.checkBytesLimits(size, jsa.templateStorage()); err != nil {
+			jsa.mu.Unlock()
+			return nil, err
+		}
+		jsa.addTemplateSize(size)
+		t.size = size
+	}
 	jsa.templates[tcopy.Name] = t
 	jsa.mu.Unlock()
 
-	// FIXME(dlc) - we can not overlap subjects between templates. Need to have test.
+	// Only create the internal client once the template is registered, so it
+	// is always closed when the template is deleted.
+	c := s.createInternalJetStreamClient()
+	c.registerWithAccount(a)
+	t.mu.Lock()
+	t.tc = c
+	t.mu.Unlock()
 
 	// Setup the internal subscriptions to trap the messages.
 	if err := t.createTemplateSubscriptions(); err != nil {
@@ -1124,15 +5118,17 @@ func (t *StreamTemplate) createTemplateSubscriptions() error {
 	if t == nil {
 		return fmt.Errorf("no template")
 	}
-	if t.tc == nil {
+	t.mu.Lock()
+	c, subjects := t.tc, t.Config.Subjects
+	t.mu.Unlock()
+	if c == nil {
 		return fmt.Errorf("template not enabled")
 	}
-	c := t.tc
 	if !c.srv.eventsEnabled() {
 		return ErrNoSysAccount
 	}
 	sid := 1
-	for _, subject := range t.Config.Subjects {
+	for _, subject := range subjects {
 		// Now create the subscription
 		if _, err := c.processSub([]byte(subject), nil, []byte(strconv.Itoa(sid)), t.processInboundTemplateMsg, false); err != nil {
 			c.acc.DeleteStreamTemplate(t.Name)
@@ -1161,12 +5157,34 @@ func (t *StreamTemplate) processInboundTemplateMsg(_ *subscription, pc *client,
 
 	// Check if we are at the maximum and grab some variables.
 	t.mu.Lock()
+	// If someone else is creating this stream hold the message until they are done.
+	if tsc := t.creating[cn]; tsc != nil {
+		hdr, msg := pc.msgParts(msg)
+		tsc.pending = append(tsc.pending, newTmplFailedMsg(cn, subject, reply, hdr, msg))
+		t.mu.Unlock()
+		return
+	}
+	// Could have been created since we checked above.
+	for _, sname := range t.streams {
+		if sname == cn {
+			t.mu.Unlock()
+			return
+		}
+	}
 	c := t.tc
-	cfg := *t.Config
+	cfg := t.Config.deepCopy()
 	cfg.Template = t.Name
+	retries, backoff := t.CreateRetries, t.CreateBackoff
 	atLimit := len(t.streams) >= int(t.MaxStreams)
+	tsc := &tmplStreamCreate{}
 	if !atLimit {
 		t.streams = append(t.streams, cn)
+		if t.creating == nil {
+			t.creating = make(map[string]*tmplStreamCreate)
+		}
+		t.creating[cn] = tsc
+	} else {
+		t.stats.HitLimit++
 	}
 	t.mu.Unlock()
 
@@ -1179,15 +5197,145 @@ func (t *StreamTemplate) processInboundTemplateMsg(_ *subscription, pc *client,
 	// Change the config from the template and only use literal subject.
 	cfg.Name = cn
 	cfg.Subjects = []string{subject}
-	mset, err := acc.AddStream(&cfg)
+	mset, err := templateAddStream(acc, &cfg)
 	if err != nil {
-		acc.validateStreams(t)
-		c.Warnf("JetStream could not create stream for account %q on subject %q", acc.Name, subject)
+		// Hold this message in front of any that arrived while we were creating.
+		hdr, msg := pc.msgParts(msg)
+		t.mu.Lock()
+		tsc.pending = append([]*tmplFailedMsg{newTmplFailedMsg(cn, subject, reply, hdr, msg)}, tsc.pending...)
+		t.mu.Unlock()
+		if retries > 0 && isTransientStreamCreateError(err) {
+			if backoff == 0 {
+				backoff = JetStreamDefaultTemplateCreateBackoff
+			}
+			// Retries wait, so do not hold up the publisher's readLoop.
+			go t.retryStreamCreate(c, acc, &cfg, retries, backoff, err)
+		} else {
+			t.finishStreamCreate(c, acc, &cfg, nil, err)
+		}
 		return
 	}
 
-	// Process this message directly by invoking mset.
+	// Messages that failed earlier go first, then this one.
+	failed, pending := t.finishStreamCreate(c, acc, &cfg, mset, nil)
+	for _, fm := range failed {
+		mset.processInboundMsg(fm.subject, fm.reply, fm.hdr, fm.msg)
+	}
 	mset.processInboundJetStreamMsg(nil, pc, subject, reply, msg)
+	for _, fm := range pending {
+		mset.processInboundMsg(fm.subject, fm.reply, fm.hdr, fm.msg)
+	}
+}
+
+// retryStreamCreate will retry creating a template stream after a transient failure.
+// The backoff doubles for each retry and we stop once the total time spent waiting
+// would exceed tmplCreateMaxRetryWait.
+func (t *StreamTemplate) retryStreamCreate(c *client, acc *Account, cfg *StreamConfig, retries int, backoff time.Duration, err error) {
+	acc.mu.RLock()
+	quitCh := acc.srv.quitCh
+	acc.mu.RUnlock()
+
+	var mset *Stream
+	var waited time.Duration
+	for i := 0; i < retries && waited+backoff <= tmplCreateMaxRetryWait; i++ {
+		c.Debugf("JetStream retrying stream creation for account %q on subject %q in %v: %v", acc.Name, cfg.Subjects[0], backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-quitCh:
+			return
+		}
+		waited += backoff
+		backoff *= 2
+		if mset, err = templateAddStream(acc, cfg); err == nil || !isTransientStreamCreateError(err) {
+			break
+		}
+	}
+	failed, pending := t.finishStreamCreate(c, acc, cfg, mset, err)
+	if err != nil {
+		return
+	}
+	for _, fm := range append(failed, pending...) {
+		mset.processInboundMsg(fm.subject, fm.reply, fm.hdr, fm.msg)
+	}
+}
+
+// finishStreamCreate completes the creation of a template stream. On success the
+// messages held from earlier failures and those received during the creation are
+// returned in order. On failure the messages are held for the next attempt.
+func (t *StreamTemplate) finishStreamCreate(c *client, acc *Account, cfg *StreamConfig, mset *Stream, err error) (failed, pending []*tmplFailedMsg) {
+	cn := cfg.Name
+	t.mu.Lock()
+	if tsc := t.creating[cn]; tsc != nil {
+		pending = tsc.pending
+	}
+	delete(t.creating, cn)
+	if err != nil {
+		t.stats.Failed++
+		t.holdFailedMsgs(pending)
+		pending = nil
+	} else {
+		t.stats.Created++
+		failed = t.takeFailedMsgs(cn)
+	}
+	t.mu.Unlock()
+
+	if err != nil {
+		acc.validateStreams(t)
+		c.Warnf("JetStream could not create stream for account %q on subject %q: %v", acc.Name, cfg.Subjects[0], err)
+	}
+	return failed, pending
+}
+
+// Holds messages whose stream could not be created, up to the failed buffer.
+// Lock should be held.
+func (t *StreamTemplate) holdFailedMsgs(msgs []*tmplFailedMsg) {
+	for _, fm := range msgs {
+		if len(t.failed) >= t.FailedBuffer {
+			break
+		}
+		t.failed = append(t.failed, fm)
+	}
+	if len(t.failed) > 0 && t.ftmr == nil {
+		t.ftmr = time.AfterFunc(tmplFailedMsgMaxAge, t.expireFailedMsgs)
+	}
+}
+
+// Drops held messages that are older than tmplFailedMsgMaxAge.
+func (t *StreamTemplate) expireFailedMsgs() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	var n int
+	for n < len(t.failed) && now.Sub(t.failed[n].ts) >= tmplFailedMsgMaxAge {
+		t.failed[n] = nil
+		n++
+	}
+	t.failed = t.failed[n:]
+	if len(t.failed) == 0 {
+		t.failed, t.ftmr = nil, nil
+		return
+	}
+	t.ftmr.Reset(tmplFailedMsgMaxAge - now.Sub(t.failed[0].ts))
+}
+
+// Removes and returns the held messages for the named stream.
+// Lock should be held.
+func (t *StreamTemplate) takeFailedMsgs(cn string) []*tmplFailedMsg {
+	var held []*tmplFailedMsg
+	kept := t.failed[:0]
+	for _, fm := range t.failed {
+		if fm.cn == cn {
+			held = append(held, fm)
+		} else {
+			kept = append(kept, fm)
+		}
+	}
+	for i := len(kept); i < len(t.failed); i++ {
+		t.failed[i] = nil
+	}
+	t.failed = kept
+	return held
 }
 
 // LookupStreamTemplate looks up the names stream template.
@@ -1213,7 +5361,10 @@ func (a *Account) validateStreams(t *StreamTemplate) {
 	t.mu.Lock()
 	var vstreams []string
 	for _, sname := range t.streams {
-		if _, err := a.LookupStream(sname); err == nil {
+		// Keep any that are still being created.
+		if _, ok := t.creating[sname]; ok {
+			vstreams = append(vstreams, sname)
+		} else if _, err := a.LookupStream(sname); err == nil {
 			vstreams = append(vstreams, sname)
 		}
 	}
@@ -1230,6 +5381,8 @@ func (t *StreamTemplate) Delete() error {
 	jsa := t.jsa
 	c := t.tc
 	t.tc = nil
+	stopAndClearTimer(&t.ftmr)
+	t.failed = nil
 	defer func() {
 		if c != nil {
 			c.closeConnection(ClientClosed)
@@ -1251,6 +5404,7 @@ func (t *StreamTemplate) Delete() error {
 		return fmt.Errorf("template not found")
 	}
 	delete(jsa.templates, t.Name)
+	jsa.addTemplateSize(-t.size)
 	acc := jsa.account
 	jsa.mu.Unlock()
 
@@ -1287,6 +5441,296 @@ func (a *Account) DeleteStreamTemplate(name string) error {
 	return t.Delete()
 }
 
+// RenameStreamTemplate renames a stream template. Streams created by the template
+// are kept and will refer to the new name.
+func (a *Account) RenameStreamTemplate(oldName, newName string) error {
+	t, err := a.LookupStreamTemplate(oldName)
+	if err != nil {
+		return err
+	}
+	if !isValidName(newName) {
+		return fmt.Errorf("invalid template name %q", newName)
+	}
+	if len(newName) > JSMaxNameLen {
+		return fmt.Errorf("template name is too long, maximum allowed is %d", JSMaxNameLen)
+	}
+	if newName == oldName {
+		return nil
+	}
+
+	jsa := t.jsa
+	rename := func(from, to string) error {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		jsa.mu.Lock()
+		defer jsa.mu.Unlock()
+		if jsa.templates[from] != t {
+			return fmt.Errorf("template not found")
+		}
+		if _, ok := jsa.templates[to]; ok {
+			return fmt.Errorf("template with name %q already exists", to)
+		}
+		delete(jsa.templates, from)
+		jsa.templates[to] = t
+		t.Name = to
+		return nil
+	}
+	if err := rename(oldName, newName); err != nil {
+		return err
+	}
+
+	// Store under the new name before removing the old one.
+	jsa.mu.RLock()
+	store := jsa.store
+	jsa.mu.RUnlock()
+	if store != nil {
+		if err := store.Store(t); err != nil {
+			rename(newName, oldName)
+			return fmt.Errorf("error storing template: %v", err)
+		}
+		store.Delete(&StreamTemplate{StreamTemplateConfig: &StreamTemplateConfig{Name: oldName}})
+		if size, err := store.Size(t); err == nil {
+			jsa.mu.Lock()
+			jsa.addTemplateSize(size - t.size)
+			t.size = size
+			jsa.mu.Unlock()
+		}
+	}
+
+	t.mu.Lock()
+	snames := append([]string(nil), t.streams...)
+	t.mu.Unlock()
+	var lastErr error
+	for _, sname := range snames {
+		if mset, err := a.LookupStream(sname); err == nil {
+			if err := mset.setTemplate(newName); err != nil {
+				lastErr = err
+			}
+		}
+	}
+	return lastErr
+}
+
+// UpdateStreamTemplate updates the configuration of an existing stream template.
+// Streams already created by the template are kept and new streams will use the
+// new configuration. Lowering MaxStreams below the number of streams the template
+// has only stops more from being created.
+func (a *Account) UpdateStreamTemplate(tc *StreamTemplateConfig) (*StreamTemplate, error) {
+	s, jsa, err := a.checkForJetStream()
+	if err != nil {
+		return nil, err
+	}
+	tcopy, err := jsa.checkStreamTemplateCfg(tc)
+	if err != nil {
+		return nil, err
+	}
+	t, err := a.LookupStreamTemplate(tcopy.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	swap := func(cfg *StreamTemplateConfig) (*StreamTemplateConfig, error) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		jsa.mu.Lock()
+		defer jsa.mu.Unlock()
+		if jsa.templates[t.Name] != t {
+			return nil, fmt.Errorf("template not found")
+		}
+		if err := jsa.checkTemplateOverlap(cfg); err != nil {
+			return nil, err
+		}
+		prev := t.StreamTemplateConfig
+		t.StreamTemplateConfig = cfg
+		return prev, nil
+	}
+	prev, err := swap(tcopy)
+	if err != nil {
+		return nil, err
+	}
+
+	jsa.mu.RLock()
+	store := jsa.store
+	jsa.mu.RUnlock()
+	if store != nil {
+		if err := store.Store(t); err != nil {
+			swap(prev)
+			return nil, fmt.Errorf("error storing template: %v", err)
+		}
+		if size, err := store.Size(t); err == nil {
+			jsa.mu.Lock()
+			jsa.addTemplateSize(size - t.size)
+			t.size = size
+			jsa.mu.Unlock()
+		}
+	}
+
+	if reflect.DeepEqual(prev.Config.Subjects, tcopy.Config.Subjects) {
+		return t, nil
+	}
+	// Subscribe to the new subjects with a fresh internal client.
+	c := s.createInternalJetStreamClient()
+	c.registerWithAccount(a)
+	t.mu.Lock()
+	oc := t.tc
+	if oc != nil {
+		t.tc = c
+	}
+	t.mu.Unlock()
+	if oc == nil {
+		c.closeConnection(ClientClosed)
+		return nil, fmt.Errorf("template not found")
+	}
+	oc.closeConnection(ClientClosed)
+	if err := t.createTemplateSubscriptions(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// OrphanedTemplateStreams returns the streams owned by a template that no longer
+// exists, e.g. after a crash while the template was being deleted, sorted by name.
+func (a *Account) OrphanedTemplateStreams() []*Stream {
+	_, jsa, err := a.checkForJetStream()
+	if err != nil {
+		return nil
+	}
+	var orphans []*Stream
+	for _, mset := range a.Streams() {
+		tname := mset.Config().Template
+		if tname == _EMPTY_ {
+			continue
+		}
+		jsa.mu.RLock()
+		_, ok := jsa.templates[tname]
+		jsa.mu.RUnlock()
+		if !ok {
+			orphans = append(orphans, mset)
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].Name() < orphans[j].Name() })
+	return orphans
+}
+
+// EmptyStreams returns the streams of this account that hold no messages, sorted by name.
+func (a *Account) EmptyStreams() []*Stream {
+	var empty []*Stream
+	for _, mset := range a.Streams() {
+		if mset.State().Msgs == 0 {
+			empty = append(empty, mset)
+		}
+	}
+	sort.Slice(empty, func(i, j int) bool { return empty[i].Name() < empty[j].Name() })
+	return empty
+}
+
+// SetJetStreamEmptyStreamPrune will delete streams that have been empty, and had no
+// messages stored, for the idle duration. Zero turns this off. Streams owned by a
+// template and internal streams are never removed.
+func (a *Account) SetJetStreamEmptyStreamPrune(idle time.Duration) error {
+	if idle < 0 {
+		return fmt.Errorf("empty stream idle duration can not be negative")
+	}
+	_, jsa, err := a.checkForJetStream()
+	if err != nil {
+		return err
+	}
+	jsa.mu.Lock()
+	defer jsa.mu.Unlock()
+	jsa.pruneIdle = idle
+	jsa.emptySince = nil
+	stopAndClearTimer(&jsa.ptmr)
+	if idle > 0 {
+		jsa.ptmr = time.AfterFunc(jsa.pruneInterval(), jsa.pruneEmptyStreams)
+	}
+	return nil
+}
+
+// How often we check for idle empty streams.
+// Lock should be held.
+func (jsa *jsAccount) pruneInterval() time.Duration {
+	return jsa.pruneIdle / 2
+}
+
+// pruneEmptyStreams is called from the prune timer. It will delete the streams that
+// were empty on every check for at least the idle duration.
+func (jsa *jsAccount) pruneEmptyStreams() {
+	jsa.mu.Lock()
+	if jsa.ptmr == nil {
+		jsa.mu.Unlock()
+		return
+	}
+	acc, idle := jsa.account, jsa.pruneIdle
+	jsa.mu.Unlock()
+
+	now := time.Now()
+	var prune []*Stream
+	seen := make(map[string]time.Time)
+	for _, mset := range acc.EmptyStreams() {
+		mset.mu.RLock()
+		name, owned := mset.config.Name, mset.config.internal || mset.config.Template != _EMPTY_
+		mset.mu.RUnlock()
+		if owned {
+			continue
+		}
+		jsa.mu.RLock()
+		since, ok := jsa.emptySince[name]
+		jsa.mu.RUnlock()
+		if !ok {
+			since = now
+		}
+		// The last message counts as activity.
+		if last := mset.State().LastTime; last.After(since) {
+			since = last
+		}
+		if now.Sub(since) >= idle {
+			prune = append(prune, mset)
+		} else {
+			seen[name] = since
+		}
+	}
+
+	jsa.mu.Lock()
+	// Could have been turned off in the meantime.
+	if jsa.ptmr == nil {
+		jsa.mu.Unlock()
+		return
+	}
+	jsa.emptySince = seen
+	jsa.ptmr.Reset(jsa.pruneInterval())
+	jsa.mu.Unlock()
+
+	s := jsa.js.srv
+	for _, mset := range prune {
+		s.Debugf("Deleting JetStream stream %q for account %q after being empty for %v", mset.Name(), acc.Name, idle)
+		mset.Delete()
+	}
+}
+
+// ClearStreamTemplate detaches the named stream from the template that owned it.
+// This is only allowed once that template no longer exists.
+func (a *Account) ClearStreamTemplate(name string) error {
+	mset, err := a.LookupStream(name)
+	if err != nil {
+		return err
+	}
+	tname := mset.Config().Template
+	if tname == _EMPTY_ {
+		return fmt.Errorf("stream %q is not owned by a template", name)
+	}
+	if _, err := a.LookupStreamTemplate(tname); err == nil {
+		return fmt.Errorf("template %q for stream %q still exists", tname, name)
+	}
+	if err := mset.setTemplate(_EMPTY_); err != nil {
+		return err
+	}
+	jsa := mset.jsa
+	jsa.mu.Lock()
+	delete(jsa.orphans, name)
+	jsa.mu.Unlock()
+	return nil
+}
+
 func (a *Account) Templates() []*StreamTemplate {
 	var ts []*StreamTemplate
 	_, jsa, err := a.checkForJetStream()
@@ -1304,6 +5748,41 @@ func (a *Account) Templates() []*StreamTemplate {
 	return ts
 }
 
+// TemplateInfos returns the configuration and current streams for each template
+// in this account, sorted by name.
+func (a *Account) TemplateInfos() []*StreamTemplateInfo {
+	ts := a.Templates()
+	infos := make([]*StreamTemplateInfo, 0, len(ts))
+	for _, t := range ts {
+		infos = append(infos, t.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Config.Name < infos[j].Config.Name })
+	return infos
+}
+
+// Returns if the given configuration, once defaults are applied, is the same as the template's.
+func (t *StreamTemplate) sameConfig(tc *StreamTemplateConfig) bool {
+	tcopy := tc.deepCopy()
+	tcopy.Config.Name = "_"
+	cfg, err := checkStreamCfg(tcopy.Config)
+	if err != nil {
+		return false
+	}
+	tcopy.Config = &cfg
+	return reflect.DeepEqual(t.info().Config, tcopy)
+}
+
+// Returns a copy of the template's configuration and streams.
+func (t *StreamTemplate) info() *StreamTemplateInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return &StreamTemplateInfo{
+		Config:  t.StreamTemplateConfig.deepCopy(),
+		Streams: append([]string{}, t.streams...),
+		Stats:   t.stats,
+	}
+}
+
 // Will add a stream to a template, this is for recovery.
 func (jsa *jsAccount) addStreamNameToTemplate(tname, mname string) error {
 	if jsa.templates == nil {
@@ -1323,12 +5802,11 @@ func (jsa *jsAccount) addStreamNameToTemplate(tname, mname string) error {
 // This will check if a template owns this stream.
 // jsAccount lock should be held
 func (jsa *jsAccount) checkTemplateOwnership(tname, sname string) bool {
-	if jsa.templates == nil {
-		return false
-	}
 	t, ok := jsa.templates[tname]
 	if !ok {
-		return false
+		// Streams of templates that no longer exist were recovered as orphans.
+		_, ok = jsa.orphans[sname]
+		return ok
 	}
 	// We found template, make sure we are in streams.
 	for _, streamName := range t.streams {
@@ -1342,6 +5820,30 @@ func (jsa *jsAccount) checkTemplateOwnership(tname, sname string) bool {
 // FriendlyBytes returns a string with the given bytes int64
 // represented as a size, such as 1KB, 10MB, etc...
 func FriendlyBytes(bytes int64) string {
+	// Fast paths for small values and exact powers of 1024.
+	if bytes >= 0 && bytes < 1024 {
+		var buf [8]byte
+		b := strconv.AppendInt(buf[:0], bytes, 10)
+		return string(append(b, " B"...))
+	}
+	if bytes > 0 && bytes&(bytes-1) == 0 {
+		if tz := bits.TrailingZeros64(uint64(bytes)); tz%10 == 0 {
+			return friendlyPowers[tz/10-1]
+		}
+	}
+	return friendlyBytes(bytes)
+}
+
+// Results for 1KB through 1EB, computed once with the general path
+// so they are identical to it.
+var friendlyPowers = func() (pows [6]string) {
+	for i := range pows {
+		pows[i] = friendlyBytes(1 << (10 * uint(i+1)))
+	}
+	return pows
+}()
+
+func friendlyBytes(bytes int64) string {
 	fbytes := float64(bytes)
 	base := 1024
 	pre := []string{"K", "M", "G", "T", "P", "E"}
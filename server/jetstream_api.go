@@ -189,6 +189,17 @@ const (
 	// JSAdvisoryStreamRestoreCompletePre notification that a restore was completed
 	JSAdvisoryStreamRestoreCompletePre = "$JS.EVENT.ADVISORY.STREAM.RESTORE_COMPLETE"
 
+	// JSAdvisoryServerReadOnly notification that a server entered or left read only mode.
+	JSAdvisoryServerReadOnly = "$JS.EVENT.ADVISORY.SERVER.READ_ONLY"
+
+	// JSAdvisoryAccountStreamCount notification that an account is approaching its stream limit.
+	JSAdvisoryAccountStreamCount = "$JS.EVENT.ADVISORY.ACCOUNT.STREAM_COUNT"
+
+	// JSAdvisoryAccountPre is the per account feed of all JetStream advisories,
+	// followed by the account name and the original advisory subject without JSAdvisoryPrefix.
+	// This is outside of JSAdvisoryPrefix so advisory subscribers do not see them twice.
+	JSAdvisoryAccountPre = "$JS.EVENT.ACCOUNT"
+
 	// JSAuditAdvisory is a notification about JetStream API access.
 	// FIXME - Add in details about who..
 	JSAuditAdvisory = "$JS.EVENT.ADVISORY.API"
@@ -228,6 +239,7 @@ type ApiPagedRequest struct {
 type JSApiAccountInfoResponse struct {
 	ApiResponse
 	*JetStreamAccountStats
+	JetStream *JetStreamInfo `json:"jetstream,omitempty"`
 }
 
 const JSApiAccountInfoResponseType = "io.nats.jetstream.api.v1.account_info_response"
@@ -499,37 +511,125 @@ func (s *Server) setJetStreamExportSubs() error {
 		handler msgHandler
 	}{
 		{JSApiAccountInfo, s.jsAccountInfoRequest},
-		{JSApiTemplateCreate, s.jsTemplateCreateRequest},
+		{JSApiTemplateCreate, s.jsAPIOpLimited(s.jsTemplateCreateRequest)},
 		{JSApiTemplates, s.jsTemplateNamesRequest},
 		{JSApiTemplateInfo, s.jsTemplateInfoRequest},
-		{JSApiTemplateDelete, s.jsTemplateDeleteRequest},
-		{JSApiStreamCreate, s.jsStreamCreateRequest},
-		{JSApiStreamUpdate, s.jsStreamUpdateRequest},
+		{JSApiTemplateDelete, s.jsAPIOpLimited(s.jsTemplateDeleteRequest)},
+		{JSApiStreamCreate, s.jsAPIOpLimited(s.jsStreamCreateRequest)},
+		{JSApiStreamUpdate, s.jsAPIOpLimited(s.jsStreamUpdateRequest)},
 		{JSApiStreams, s.jsStreamNamesRequest},
 		{JSApiStreamList, s.jsStreamListRequest},
 		{JSApiStreamInfo, s.jsStreamInfoRequest},
-		{JSApiStreamDelete, s.jsStreamDeleteRequest},
-		{JSApiStreamPurge, s.jsStreamPurgeRequest},
-		{JSApiStreamSnapshot, s.jsStreamSnapshotRequest},
-		{JSApiStreamRestore, s.jsStreamRestoreRequest},
-		{JSApiMsgDelete, s.jsMsgDeleteRequest},
+		{JSApiStreamDelete, s.jsAPIOpLimited(s.jsStreamDeleteRequest)},
+		{JSApiStreamPurge, s.jsAPIOpLimited(s.jsStreamPurgeRequest)},
+		{JSApiStreamSnapshot, s.jsAPIOpLimited(s.jsStreamSnapshotRequest)},
+		{JSApiStreamRestore, s.jsAPIOpLimited(s.jsStreamRestoreRequest)},
+		{JSApiMsgDelete, s.jsAPIOpLimited(s.jsMsgDeleteRequest)},
 		{JSApiMsgGet, s.jsMsgGetRequest},
-		{JSApiConsumerCreate, s.jsConsumerCreateRequest},
-		{JSApiDurableCreate, s.jsDurableCreateRequest},
+		{JSApiConsumerCreate, s.jsAPIOpLimited(s.jsConsumerCreateRequest)},
+		{JSApiDurableCreate, s.jsAPIOpLimited(s.jsDurableCreateRequest)},
 		{JSApiConsumers, s.jsConsumerNamesRequest},
 		{JSApiConsumerList, s.jsConsumerListRequest},
 		{JSApiConsumerInfo, s.jsConsumerInfoRequest},
-		{JSApiConsumerDelete, s.jsConsumerDeleteRequest},
+		{JSApiConsumerDelete, s.jsAPIOpLimited(s.jsConsumerDeleteRequest)},
 	}
 
+	js := s.getJetStream()
 	for _, p := range pairs {
-		if _, err := s.sysSubscribe(p.subject, p.handler); err != nil {
+		sub, err := s.sysSubscribe(p.subject, s.jsAPIHeldForMove(p.handler))
+		if err != nil {
 			return err
 		}
+		// Track these so they can be removed if we are disabled.
+		js.mu.Lock()
+		js.apiSubs = append(js.apiSubs, sub)
+		js.mu.Unlock()
 	}
 	return nil
 }
 
+// jsAPIOpLimited wraps a handler for requests that change state so that accounts
+// can not process more of them at the same time than their limits allow.
+// Requests that have to wait do so in their own go routine, not on the readLoop.
+func (s *Server) jsAPIOpLimited(handler msgHandler) msgHandler {
+	return func(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+		if c == nil {
+			return
+		}
+		// Let the handler deal with any bad requests.
+		ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+		if err != nil {
+			handler(sub, c, subject, reply, rmsg)
+			return
+		}
+		acc.mu.RLock()
+		jsa := acc.js
+		acc.mu.RUnlock()
+		if jsa == nil {
+			handler(sub, c, subject, reply, rmsg)
+			return
+		}
+		if release, ok := jsa.tryAcquireAPIOp(); ok {
+			defer release()
+			handler(sub, c, subject, reply, rmsg)
+			return
+		}
+		dc, rmsg := s.detachAPIRequest(c, rmsg)
+		request := string(msg)
+		go func() {
+			release, err := jsa.acquireAPIOp()
+			if err != nil {
+				resp := ApiResponse{Error: &ApiError{Code: 503, Description: err.Error()}}
+				s.sendAPIResponse(ci, acc, subject, reply, request, s.jsonResponse(&resp))
+				return
+			}
+			defer release()
+			handler(sub, dc, subject, reply, rmsg)
+		}()
+	}
+}
+
+// jsAPIHeldForMove wraps a handler so that requests for an account whose storage
+// is being moved are processed once the move is done, instead of failing.
+// Held requests wait in their own go routine, not on the readLoop.
+func (s *Server) jsAPIHeldForMove(handler msgHandler) msgHandler {
+	return func(sub *subscription, c *client, subject, reply string, rmsg []byte) {
+		if c == nil {
+			return
+		}
+		// Let the handler deal with any bad requests.
+		_, acc, _, _, err := s.getRequestInfo(c, rmsg)
+		if err != nil {
+			handler(sub, c, subject, reply, rmsg)
+			return
+		}
+		acc.mu.RLock()
+		jsa := acc.js
+		acc.mu.RUnlock()
+		var moved <-chan struct{}
+		if jsa != nil {
+			moved = jsa.storeMoved()
+		}
+		if moved == nil {
+			handler(sub, c, subject, reply, rmsg)
+			return
+		}
+		dc, rmsg := s.detachAPIRequest(c, rmsg)
+		go func() {
+			<-moved
+			handler(sub, dc, subject, reply, rmsg)
+		}()
+	}
+}
+
+// detachAPIRequest copies what a handler needs from the client and request,
+// so the request can be processed once the readLoop has moved on.
+func (s *Server) detachAPIRequest(c *client, rmsg []byte) (*client, []byte) {
+	dc := &client{srv: s, kind: c.kind, acc: c.acc}
+	dc.pa.hdr, dc.pa.proxy = c.pa.hdr, c.pa.proxy
+	return dc, copyBytes(rmsg)
+}
+
 func (s *Server) sendAPIResponse(ci *ClientInfo, acc *Account, subject, reply, request, response string) {
 	s.sendInternalAccountMsg(nil, reply, response)
 	s.sendJetStreamAPIAuditAdvisory(ci, acc, subject, request, response)
@@ -576,6 +676,7 @@ func (s *Server) jsAccountInfoRequest(sub *subscription, c *client, subject, rep
 	} else {
 		stats := acc.JetStreamUsage()
 		resp.JetStreamAccountStats = &stats
+		resp.JetStream = s.JetStreamInfo()
 	}
 	b, err := json.MarshalIndent(resp, "", "  ")
 	if err != nil {
@@ -633,14 +734,7 @@ func (s *Server) jsTemplateCreateRequest(sub *subscription, c *client, subject,
 		s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
-	t.mu.Lock()
-	tcfg := t.StreamTemplateConfig.deepCopy()
-	streams := t.streams
-	if streams == nil {
-		streams = []string{}
-	}
-	t.mu.Unlock()
-	resp.StreamTemplateInfo = &StreamTemplateInfo{Config: tcfg, Streams: streams}
+	resp.StreamTemplateInfo = t.info()
 	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
 }
 
@@ -729,15 +823,7 @@ func (s *Server) jsTemplateInfoRequest(sub *subscription, c *client, subject, re
 		s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
-	t.mu.Lock()
-	cfg := t.StreamTemplateConfig.deepCopy()
-	streams := t.streams
-	if streams == nil {
-		streams = []string{}
-	}
-	t.mu.Unlock()
-
-	resp.StreamTemplateInfo = &StreamTemplateInfo{Config: cfg, Streams: streams}
+	resp.StreamTemplateInfo = t.info()
 	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
 }
 
@@ -838,7 +924,7 @@ func (s *Server) jsStreamCreateRequest(sub *subscription, c *client, subject, re
 		s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
-	resp.StreamInfo = &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config()}
+	resp.StreamInfo = &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config(), Flush: mset.FlushStats()}
 	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
 }
 
@@ -883,7 +969,7 @@ func (s *Server) jsStreamUpdateRequest(sub *subscription, c *client, subject, re
 		return
 	}
 
-	resp.StreamInfo = &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config()}
+	resp.StreamInfo = &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config(), Flush: mset.FlushStats()}
 	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
 }
 
@@ -964,21 +1050,18 @@ func (s *Server) jsStreamNamesRequest(sub *subscription, c *client, subject, rep
 			resp.Streams = resp.Streams[:offset]
 		}
 	} else {
-		msets := acc.filteredStreams(filter)
+		// Names are listed without loading any lazily recovered streams.
+		names := acc.streamNames(filter)
 		// Since we page results order matters.
-		if len(msets) > 1 {
-			sort.Slice(msets, func(i, j int) bool {
-				return strings.Compare(msets[i].config.Name, msets[j].config.Name) < 0
-			})
-		}
+		sort.Strings(names)
 
-		numStreams = len(msets)
+		numStreams = len(names)
 		if offset > numStreams {
 			offset = numStreams
 		}
 
-		for _, mset := range msets[offset:] {
-			resp.Streams = append(resp.Streams, mset.config.Name)
+		for _, name := range names[offset:] {
+			resp.Streams = append(resp.Streams, name)
 			if len(resp.Streams) >= JSApiNamesLimit {
 				break
 			}
@@ -1026,18 +1109,21 @@ func (s *Server) jsStreamListRequest(sub *subscription, c *client, subject, repl
 
 	// TODO(dlc) - Maybe hold these results for large results that we expect to be paged.
 	// TODO(dlc) - If this list is long maybe do this in a Go routine?
-	msets := acc.Streams()
-	sort.Slice(msets, func(i, j int) bool {
-		return strings.Compare(msets[i].config.Name, msets[j].config.Name) < 0
-	})
+	// Only streams on the returned page are loaded if they were lazily recovered.
+	names := acc.streamNames(_EMPTY_)
+	sort.Strings(names)
 
-	scnt := len(msets)
+	scnt := len(names)
 	if offset > scnt {
 		offset = scnt
 	}
 
-	for _, mset := range msets[offset:] {
-		resp.Streams = append(resp.Streams, &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config()})
+	for _, name := range names[offset:] {
+		mset, err := acc.LookupStream(name)
+		if err != nil {
+			continue
+		}
+		resp.Streams = append(resp.Streams, &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config(), Flush: mset.FlushStats()})
 		if len(resp.Streams) >= JSApiListLimit {
 			break
 		}
@@ -1095,7 +1181,7 @@ func (s *Server) jsStreamInfoRequest(sub *subscription, c *client, subject, repl
 	if config.allowNoSubject && len(config.Subjects) == 0 {
 		config.Subjects = []string{">"}
 	}
-	resp.StreamInfo = &StreamInfo{Created: mset.Created(), State: mset.State(), Config: config}
+	resp.StreamInfo = &StreamInfo{Created: mset.Created(), State: mset.State(), Config: config, Flush: mset.FlushStats()}
 	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
 }
 
@@ -1436,7 +1522,7 @@ func (s *Server) jsStreamRestoreRequest(sub *subscription, c *client, subject, r
 			if err != nil {
 				resp.Error = jsError(err)
 			} else {
-				resp.StreamInfo = &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config()}
+				resp.StreamInfo = &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config(), Flush: mset.FlushStats()}
 			}
 			s.sendInternalAccountMsg(acc, reply, s.jsonResponse(&resp))
 
@@ -92,6 +92,8 @@ type streamPurge struct {
 	Client *ClientInfo `json:"client,omitempty"`
 	Stream string      `json:"stream"`
 	Reply  string      `json:"reply"`
+	// Seq, if set, only purges the messages before it.
+	Seq uint64 `json:"seq,omitempty"`
 }
 
 // streamMsgDelete is what the stream leader will replicate when deleting a message.
@@ -252,6 +254,55 @@ func (s *Server) JetStreamClusterPeers() []string {
 	return nodes
 }
 
+// JetStreamClusterInfo describes the state of the JetStream meta group as seen by this server.
+type JetStreamClusterInfo struct {
+	Name     string   `json:"name,omitempty"`
+	Leader   string   `json:"leader,omitempty"`
+	IsLeader bool     `json:"is_leader"`
+	Current  bool     `json:"current"`
+	Peers    []string `json:"peers,omitempty"`
+}
+
+// JetStreamClusterInfo returns information about the JetStream meta group.
+// Peers are only known to the meta leader.
+func (s *Server) JetStreamClusterInfo() (*JetStreamClusterInfo, error) {
+	js := s.getJetStream()
+	if js == nil {
+		return nil, ErrJetStreamNotEnabled
+	}
+	meta := js.getMetaGroup()
+	if meta == nil {
+		return nil, ErrJetStreamNotClustered
+	}
+
+	ci := &JetStreamClusterInfo{
+		Name:     meta.Group(),
+		Leader:   meta.GroupLeader(),
+		IsLeader: meta.Leader(),
+		Current:  meta.Current(),
+	}
+	for _, p := range meta.Peers() {
+		ci.Peers = append(ci.Peers, p.ID)
+	}
+	return ci, nil
+}
+
+// JetStreamStepDown will have this server relinquish leadership of the meta group.
+func (s *Server) JetStreamStepDown() error {
+	js := s.getJetStream()
+	if js == nil {
+		return ErrJetStreamNotEnabled
+	}
+	meta := js.getMetaGroup()
+	if meta == nil {
+		return ErrJetStreamNotClustered
+	}
+	if !meta.Leader() {
+		return ErrJetStreamNotLeader
+	}
+	return meta.StepDown()
+}
+
 // Read lock should be held.
 func (cc *jetStreamCluster) isLeader() bool {
 	if cc == nil {
@@ -1038,14 +1089,19 @@ func (js *jetStream) applyStreamEntries(mset *Stream, ce *CommittedEntry) (bool,
 					panic(err.Error())
 				}
 				s := js.server()
-				purged, err := mset.Purge()
+				var purged uint64
+				if sp.Seq > 0 {
+					purged, err = mset.compactBefore(sp.Seq)
+				} else {
+					purged, err = mset.Purge()
+				}
 				if err != nil {
 					s.Warnf("JetStream cluster failed to purge stream %q for account %q: %v", sp.Stream, sp.Client.Account, err)
 				}
 				js.mu.RLock()
 				isLeader := js.cluster.isStreamLeader(sp.Client.Account, sp.Stream)
 				js.mu.RUnlock()
-				if isLeader {
+				if isLeader && sp.Reply != _EMPTY_ {
 					var resp = JSApiStreamPurgeResponse{ApiResponse: ApiResponse{Type: JSApiStreamPurgeResponseType}}
 					if err != nil {
 						resp.Error = jsError(err)
@@ -1089,7 +1145,7 @@ func (js *jetStream) processStreamLeaderChange(mset *Stream, sa *streamAssignmen
 	if err != nil {
 		resp.Error = jsError(err)
 	} else {
-		resp.StreamInfo = &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config()}
+		resp.StreamInfo = &StreamInfo{Created: mset.Created(), State: mset.State(), Config: mset.Config(), Flush: mset.FlushStats()}
 	}
 	s.sendAPIResponse(client, acc, _EMPTY_, reply, _EMPTY_, s.jsonResponse(&resp))
 }
@@ -1791,15 +1847,30 @@ func (js *jetStream) processLeaderChange(isLeader bool) {
 }
 
 // selectPeerGroup will select a group of peers to start a raft group.
+// Only peers matching the placement, if any, are selected.
 // TODO(dlc) - For now randomly select. Can be way smarter.
-func (cc *jetStreamCluster) selectPeerGroup(r int) []string {
+func (cc *jetStreamCluster) selectPeerGroup(r int, placement *Placement) []string {
 	var nodes []string
 	peers := cc.meta.Peers()
 	// Make sure they are active
 	s := cc.s
 	ourID := cc.meta.ID()
+	// All peers are in our cluster, which is always named when clustered.
+	if placement != nil && placement.Cluster != _EMPTY_ && placement.Cluster != s.getOpts().Cluster.Name {
+		return nil
+	}
 	for _, p := range peers {
-		if p.ID == ourID || s.getRouteByHash([]byte(p.ID)) != nil {
+		var tags []string
+		if p.ID == ourID {
+			tags = s.getOpts().Tags
+		} else if c := s.getRouteByHash([]byte(p.ID)); c != nil {
+			c.mu.Lock()
+			tags = c.route.tags
+			c.mu.Unlock()
+		} else {
+			continue
+		}
+		if placement == nil || hasAllTags(tags, placement.Tags) {
 			nodes = append(nodes, p.ID)
 		}
 	}
@@ -1811,6 +1882,23 @@ func (cc *jetStreamCluster) selectPeerGroup(r int) []string {
 	return nodes[:r]
 }
 
+// Returns true if tags contains all of the wanted tags.
+func hasAllTags(tags, wanted []string) bool {
+	for _, w := range wanted {
+		found := false
+		for _, t := range tags {
+			if t == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
 func groupNameForStream(peers []string, storage StorageType) string {
 	return groupName("S", peers, storage)
 }
@@ -1839,7 +1927,7 @@ func (cc *jetStreamCluster) createGroupForStream(cfg *StreamConfig) *raftGroup {
 
 	// Need to create a group here.
 	// TODO(dlc) - Can be way smarter here.
-	peers := cc.selectPeerGroup(replicas)
+	peers := cc.selectPeerGroup(replicas, cfg.Placement)
 	if len(peers) == 0 {
 		return nil
 	}
@@ -1870,6 +1958,7 @@ func (s *Server) jsClusteredStreamRequest(ci *ClientInfo, subject, reply string,
 	}
 
 	// Raft group selection and placement.
+	cfg = acc.applyStreamDefaults(cfg)
 	rg := cc.createGroupForStream(cfg)
 	if rg == nil {
 		resp.Error = jsInsufficientErr
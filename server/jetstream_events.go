@@ -2,7 +2,10 @@ package server
 
 import (
 	"encoding/json"
+	"strings"
 	"time"
+
+	"github.com/nats-io/nuid"
 )
 
 func (s *Server) publishAdvisory(acc *Account, subject string, adv interface{}) {
@@ -11,12 +14,59 @@ func (s *Server) publishAdvisory(acc *Account, subject string, adv interface{})
 		err = s.sendInternalAccountMsg(acc, subject, ej)
 		if err != nil {
 			s.Warnf("Advisory could not be sent for account %q: %v", acc.Name, err)
+		} else {
+			s.sendAccountAdvisory(acc, subject, ej)
 		}
 	} else {
 		s.Warnf("Advisory could not be serialized for account %q: %v", acc.Name, err)
 	}
 }
 
+// JSAccountAdvisory wraps any JetStream advisory republished on the account's
+// advisory feed, see JSAdvisoryAccountPre.
+type JSAccountAdvisory struct {
+	TypedEvent
+	Schema   string          `json:"schema"`
+	Account  string          `json:"account"`
+	Subject  string          `json:"subject"`
+	Advisory json.RawMessage `json:"advisory"`
+}
+
+// JSAccountAdvisoryType is the schema type for JSAccountAdvisory
+const JSAccountAdvisoryType = "io.nats.jetstream.advisory.v1.account_advisory"
+
+// sendAccountAdvisory republishes an advisory sent on subject to the account's
+// advisory feed. Anything that is not an advisory is ignored, as is everything
+// when no one is subscribed to the feed.
+func (s *Server) sendAccountAdvisory(acc *Account, subject string, msg []byte) {
+	if acc == nil || len(msg) == 0 || !strings.HasPrefix(subject, JSAdvisoryPrefix+".") {
+		return
+	}
+	subj := JSAdvisoryAccountPre + "." + acc.Name + subject[len(JSAdvisoryPrefix):]
+	if !acc.SubscriptionInterest(subj) {
+		return
+	}
+	var te TypedEvent
+	if err := json.Unmarshal(msg, &te); err != nil {
+		return
+	}
+	ej, err := json.MarshalIndent(&JSAccountAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSAccountAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Schema:   te.Type,
+		Account:  acc.Name,
+		Subject:  subject,
+		Advisory: msg,
+	}, "", "  ")
+	if err != nil {
+		return
+	}
+	s.sendInternalAccountMsg(acc, subj, ej)
+}
+
 // JSAPIAudit is an advisory about administrative actions taken on JetStream
 type JSAPIAudit struct {
 	TypedEvent
@@ -146,3 +196,59 @@ type JSRestoreCompleteAdvisory struct {
 
 // JSRestoreCompleteAdvisoryType is the schema type for JSSnapshotCreateAdvisory
 const JSRestoreCompleteAdvisoryType = "io.nats.jetstream.advisory.v1.restore_complete"
+
+// JSServerReadOnlyAdvisory is an advisory sent when a server enters or leaves read only mode
+type JSServerReadOnlyAdvisory struct {
+	TypedEvent
+	Server   string `json:"server"`
+	ReadOnly bool   `json:"read_only"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// JSServerReadOnlyAdvisoryType is the schema type for JSServerReadOnlyAdvisory
+const JSServerReadOnlyAdvisoryType = "io.nats.jetstream.advisory.v1.server_read_only"
+
+// Sends an advisory to the system account when we enter or leave read only mode.
+func (s *Server) sendReadOnlyAdvisory(readOnly bool, reason string) {
+	sacc := s.SystemAccount()
+	if sacc == nil {
+		return
+	}
+	s.publishAdvisory(sacc, JSAdvisoryServerReadOnly, &JSServerReadOnlyAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSServerReadOnlyAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Server:   s.Name(),
+		ReadOnly: readOnly,
+		Reason:   reason,
+	})
+}
+
+// JSAccountStreamCountAdvisory is an advisory sent when an account is close to its stream limit
+type JSAccountStreamCountAdvisory struct {
+	TypedEvent
+	Account    string `json:"account"`
+	Streams    int    `json:"streams"`
+	MaxStreams int    `json:"max_streams"`
+}
+
+// JSAccountStreamCountAdvisoryType is the schema type for JSAccountStreamCountAdvisory
+const JSAccountStreamCountAdvisoryType = "io.nats.jetstream.advisory.v1.stream_count"
+
+// sendStreamCountAlarm will warn and send an advisory to the account when it
+// approaches its maximum number of streams.
+func (s *Server) sendStreamCountAlarm(acc *Account, streams, max int) {
+	s.Warnf("JetStream account %q is using %d of %d allowed streams", acc.Name, streams, max)
+	s.publishAdvisory(acc, JSAdvisoryAccountStreamCount, &JSAccountStreamCountAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSAccountStreamCountAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Account:    acc.Name,
+		Streams:    streams,
+		MaxStreams: max,
+	})
+}
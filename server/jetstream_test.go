@@ -0,0 +1,3117 @@
+// Copyright 2021 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/minio/highwayhash"
+	"github.com/nats-io/nats.go"
+)
+
+func TestJetStreamReadOnlyMode(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-read-only-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	orgInterval := jsReadOnlyCheckInterval
+	defer func() { jsReadOnlyCheckInterval = orgInterval }()
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	o.JetStream = true
+	o.StoreDir = sd
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if !isOutOfSpaceErr(fmt.Errorf("write failed: %w", syscall.ENOSPC)) {
+		t.Fatalf("Expected ENOSPC to be detected as out of space")
+	}
+	if isOutOfSpaceErr(ErrStoreClosed) {
+		t.Fatalf("Did not expect a closed store to be detected as out of space")
+	}
+
+	acc := s.GlobalAccount()
+	if _, err := acc.AddStream(&StreamConfig{Name: "F", Storage: FileStorage}); err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	if _, err := acc.AddStream(&StreamConfig{Name: "M", Storage: MemoryStorage}); err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+
+	pubAck := func(subj string) *JSPubAckResponse {
+		t.Helper()
+		resp, err := nc.Request(subj, []byte("HELLO"), time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var pa JSPubAckResponse
+		if err := json.Unmarshal(resp.Data, &pa); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return &pa
+	}
+
+	if s.JetStreamReadOnly() {
+		t.Fatalf("Did not expect to be in read only mode")
+	}
+
+	js := s.getJetStream()
+	// Hold the timer off so we can check behavior while in read only mode.
+	jsReadOnlyCheckInterval = time.Hour
+	js.enterReadOnly("test")
+	if !s.JetStreamReadOnly() {
+		t.Fatalf("Expected to be in read only mode")
+	}
+
+	if pa := pubAck("F"); pa.Error == nil || pa.Error.Code != 503 || !strings.Contains(pa.Error.Description, "read only") {
+		t.Fatalf("Expected a read only error, got %+v", pa.Error)
+	}
+	if pa := pubAck("M"); pa.Error != nil {
+		t.Fatalf("Memory based streams should not be affected, got %+v", pa.Error)
+	}
+
+	// Now let the periodic check run, we should have enough space to leave read only mode.
+	jsReadOnlyCheckInterval = 50 * time.Millisecond
+	js.mu.Lock()
+	js.roTimer.Reset(jsReadOnlyCheckInterval)
+	js.mu.Unlock()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for s.JetStreamReadOnly() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.JetStreamReadOnly() {
+		t.Fatalf("Expected to leave read only mode")
+	}
+	if avail := atomic.LoadInt64(&js.diskAvail); avail < jsReadOnlyMinAvailable {
+		t.Fatalf("Expected the cached available space to be refreshed, got %d", avail)
+	}
+	if pa := pubAck("F"); pa.Error != nil {
+		t.Fatalf("Unexpected error after leaving read only mode: %+v", pa.Error)
+	}
+}
+
+func TestJetStreamLazyRecovery(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-lazy-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	acc := s.GlobalAccount()
+	for _, name := range []string{"F", "G"} {
+		mset, err := acc.AddStream(&StreamConfig{Name: name, Storage: FileStorage})
+		if err != nil {
+			t.Fatalf("Unexpected error adding stream: %v", err)
+		}
+		if _, err := mset.AddConsumer(&ConsumerConfig{Durable: "dlc", AckPolicy: AckExplicit}); err != nil {
+			t.Fatalf("Unexpected error adding consumer: %v", err)
+		}
+	}
+
+	nc := natsConnect(t, s.ClientURL())
+	for i := 0; i < 10; i++ {
+		if _, err := nc.Request("F", []byte("Hello World"), time.Second); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	nc.Close()
+	used := acc.JetStreamUsage().Store
+	s.Shutdown()
+
+	// Restart lazily.
+	s = RunServer(o)
+	defer s.Shutdown()
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd, LazyRecovery: true}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	acc = s.GlobalAccount()
+	jsa := acc.js
+
+	isLoaded := func(name string) bool {
+		t.Helper()
+		jsa.mu.RLock()
+		defer jsa.mu.RUnlock()
+		_, ok := jsa.streams[name]
+		return ok
+	}
+	if isLoaded("F") || isLoaded("G") {
+		t.Fatalf("Expected streams to not be loaded")
+	}
+	if n := acc.NumStreams(); n != 2 {
+		t.Fatalf("Expected 2 streams, got %d", n)
+	}
+	if stats := acc.JetStreamUsage(); stats.Store != used || stats.Streams != 2 {
+		t.Fatalf("Expected usage of %d bytes for 2 streams, got %+v", used, stats)
+	}
+
+	// Publishing should load the stream and store the message.
+	nc = natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	if _, err := nc.Request("F", []byte("Hello World"), time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !isLoaded("F") {
+		t.Fatalf("Expected stream F to be loaded")
+	}
+	if isLoaded("G") {
+		t.Fatalf("Expected stream G to not be loaded")
+	}
+	mset, _ := acc.LookupStream("F")
+	if state := mset.State(); state.Msgs != 11 {
+		t.Fatalf("Expected 11 messages, got %d", state.Msgs)
+	}
+	if o := mset.LookupConsumer("dlc"); o == nil {
+		t.Fatalf("Expected consumer to be recovered")
+	}
+	if stats := acc.JetStreamUsage(); stats.Store <= used {
+		t.Fatalf("Expected usage to grow past %d bytes, got %d", used, stats.Store)
+	}
+
+	// Lookup will also load the stream.
+	if mset, err := acc.LookupStream("G"); err != nil || mset == nil {
+		t.Fatalf("Unexpected error looking up stream: %v", err)
+	}
+	if !isLoaded("G") {
+		t.Fatalf("Expected stream G to be loaded")
+	}
+	if n := acc.NumStreams(); n != 2 {
+		t.Fatalf("Expected 2 streams, got %d", n)
+	}
+}
+
+func TestJetStreamLazyRecoveryNoLostMsgs(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-lazy-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	acc := s.GlobalAccount()
+	for _, name := range []string{"F", "G"} {
+		if _, err := acc.AddStream(&StreamConfig{Name: name, Storage: FileStorage}); err != nil {
+			t.Fatalf("Unexpected error adding stream: %v", err)
+		}
+	}
+	s.Shutdown()
+
+	// Restart lazily.
+	s = RunServer(o)
+	defer s.Shutdown()
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd, LazyRecovery: true, RecoveryMemoryBudget: 1024}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	acc = s.GlobalAccount()
+	jsa := acc.js
+
+	isLoaded := func(name string) bool {
+		t.Helper()
+		jsa.mu.RLock()
+		defer jsa.mu.RUnlock()
+		_, ok := jsa.streams[name]
+		return ok
+	}
+
+	// Listing the names should not load anything.
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	resp, err := nc.Request(JSApiStreams, nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var nresp JSApiStreamNamesResponse
+	if err := json.Unmarshal(resp.Data, &nresp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if nresp.Total != 2 || len(nresp.Streams) != 2 || nresp.Streams[0] != "F" || nresp.Streams[1] != "G" {
+		t.Fatalf("Expected streams F and G, got %+v", nresp)
+	}
+	if isLoaded("F") || isLoaded("G") {
+		t.Fatalf("Expected streams to not be loaded")
+	}
+
+	// Hold the whole recovery budget so the load will stall while messages arrive.
+	// Nothing sent during the load should be lost or stored twice.
+	rb := s.getJetStream().rbudget
+	held := rb.acquire(rb.max)
+	loaded := make(chan struct{})
+	go func() {
+		acc.LookupStream("F")
+		close(loaded)
+	}()
+	checkFor(t, time.Second, time.Millisecond, func() error {
+		jsa.mu.RLock()
+		defer jsa.mu.RUnlock()
+		if _, ok := jsa.streams["F"]; !ok && jsa.loading["F"] == nil {
+			return fmt.Errorf("stream F is not loading")
+		}
+		return nil
+	})
+	const toSend = 100
+	for i := 0; i < toSend; i++ {
+		nc.Publish("F", []byte("Hello World"))
+	}
+	time.Sleep(50 * time.Millisecond)
+	rb.release(held)
+	nc.Flush()
+	<-loaded
+
+	mset, _ := acc.LookupStream("F")
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if state := mset.State(); state.Msgs != toSend {
+			return fmt.Errorf("Expected %d messages, got %d", toSend, state.Msgs)
+		}
+		return nil
+	})
+	if isLoaded("G") {
+		t.Fatalf("Expected stream G to not be loaded")
+	}
+}
+
+type captureRecoveryLogger struct {
+	DummyLogger
+	warnings []string
+}
+
+func (l *captureRecoveryLogger) Warnf(format string, v ...interface{}) {
+	l.Lock()
+	l.warnings = append(l.warnings, fmt.Sprintf(format, v...))
+	l.Unlock()
+}
+
+func TestJetStreamReconcileStreamReservations(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-reconcile-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	acc := s.GlobalAccount()
+	for _, cfg := range []*StreamConfig{
+		{Name: "M", Storage: MemoryStorage, MaxBytes: 1024},
+		{Name: "F", Storage: FileStorage, MaxBytes: 4096},
+	} {
+		if _, err := acc.AddStream(cfg); err != nil {
+			t.Fatalf("Unexpected error adding stream: %v", err)
+		}
+	}
+	checkReserved := func() {
+		t.Helper()
+		if stats := acc.JetStreamUsageWithReserved(); stats.MemReserved != 1024 || stats.StoreReserved != 4096 {
+			t.Fatalf("Expected 1024 and 4096 bytes reserved, got %d and %d", stats.MemReserved, stats.StoreReserved)
+		}
+	}
+	checkReserved()
+
+	// Simulate reservations that were left behind, e.g. by a crash.
+	acc.mu.RLock()
+	jsa := acc.js
+	acc.mu.RUnlock()
+	jsa.mu.Lock()
+	jsa.memReserved += 100
+	jsa.storeReserved += 200
+	jsa.mu.Unlock()
+
+	s.getJetStream().reconcileReservations()
+	checkReserved()
+}
+
+func TestJetStreamRecoveryWarningsSummarized(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-recovery-warnings-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mset, err := s.GlobalAccount().AddStream(&StreamConfig{Name: "S", Storage: FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	numConsumers := 10
+	for i := 0; i < numConsumers; i++ {
+		if _, err := mset.AddConsumer(&ConsumerConfig{Durable: fmt.Sprintf("D%d", i), AckPolicy: AckExplicit}); err != nil {
+			t.Fatalf("Unexpected error adding consumer: %v", err)
+		}
+	}
+	s.Shutdown()
+
+	// Remove all of the consumer checksums.
+	odir := path.Join(sd, JetStreamStoreDir, globalAccountName, streamsDir, "S", consumerDir)
+	for i := 0; i < numConsumers; i++ {
+		os.Remove(path.Join(odir, fmt.Sprintf("D%d", i), JetStreamMetaFileSum))
+	}
+
+	s = RunServer(o)
+	defer s.Shutdown()
+	l := &captureRecoveryLogger{}
+	s.SetLogger(l, false, false)
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	var missing, summary int
+	for _, w := range l.warnings {
+		if strings.Contains(w, "Missing Consumer checksum") {
+			missing++
+		}
+		if strings.Contains(w, fmt.Sprintf("%d consumer checksums missing", numConsumers)) {
+			summary++
+		}
+	}
+	if missing != 1 || summary != 1 {
+		t.Fatalf("Expected a single warning and a summary, got %d and %d: %q", missing, summary, l.warnings)
+	}
+
+	// Each one is still recorded.
+	rerrs := s.GlobalAccount().JetStreamUsage().RecoveryErrors
+	if len(rerrs) != numConsumers {
+		t.Fatalf("Expected %d recovery errors, got %+v", numConsumers, rerrs)
+	}
+	for _, rerr := range rerrs {
+		if rerr.Class != "consumer checksums missing" || !strings.HasPrefix(rerr.Description, "Missing Consumer checksum") {
+			t.Fatalf("Unexpected recovery error: %+v", rerr)
+		}
+	}
+}
+
+type captureQuarantineLogger struct {
+	DummyLogger
+	errors []string
+}
+
+func (l *captureQuarantineLogger) Errorf(format string, v ...interface{}) {
+	l.Lock()
+	l.errors = append(l.errors, fmt.Sprintf(format, v...))
+	l.Unlock()
+}
+
+func TestJetStreamQuarantineCorrupt(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-quarantine-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	start := func(quarantine bool) (*Server, *captureQuarantineLogger) {
+		t.Helper()
+		s := RunServer(o)
+		l := &captureQuarantineLogger{}
+		s.SetLogger(l, false, false)
+		if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd, QuarantineCorrupt: quarantine}); err != nil {
+			s.Shutdown()
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return s, l
+	}
+
+	s, _ := start(false)
+	acc := s.GlobalAccount()
+	if _, err := acc.AddStreamTemplate(&StreamTemplateConfig{
+		Name:       "T",
+		Config:     &StreamConfig{Subjects: []string{"t.*"}, Storage: FileStorage},
+		MaxStreams: 2,
+	}); err != nil {
+		s.Shutdown()
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, name := range []string{"BAD", "GOOD"} {
+		mset, err := acc.AddStream(&StreamConfig{Name: name, Storage: FileStorage})
+		if err != nil {
+			s.Shutdown()
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		for _, dname := range []string{"BAD", "GOOD"} {
+			if _, err := mset.AddConsumer(&ConsumerConfig{Durable: dname, AckPolicy: AckExplicit}); err != nil {
+				s.Shutdown()
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+	}
+	s.Shutdown()
+
+	adir := path.Join(sd, JetStreamStoreDir, globalAccountName)
+	tdir := path.Join(adir, tmplsDir, "T")
+	sdir := path.Join(adir, streamsDir, "BAD")
+	odir := path.Join(adir, streamsDir, "GOOD", consumerDir, "BAD")
+	ioutil.WriteFile(path.Join(tdir, JetStreamMetaFileSum), []byte("bad"), 0644)
+	ioutil.WriteFile(path.Join(sdir, JetStreamMetaFileSum), []byte("bad"), 0644)
+	ioutil.WriteFile(path.Join(odir, JetStreamMetaFile), []byte("{bad"), 0644)
+
+	quarantined := func(dir string) []string {
+		t.Helper()
+		matches, err := filepath.Glob(dir + ".corrupt.*")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return matches
+	}
+	check := func(s *Server) {
+		t.Helper()
+		acc := s.GlobalAccount()
+		if _, err := acc.LookupStream("BAD"); err == nil {
+			t.Fatalf("Expected stream with a corrupt metafile not to be recovered")
+		}
+		mset, err := acc.LookupStream("GOOD")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if mset.LookupConsumer("BAD") != nil || mset.LookupConsumer("GOOD") == nil {
+			t.Fatalf("Expected only the consumer with a valid metafile to be recovered")
+		}
+		if len(acc.Templates()) != 0 {
+			t.Fatalf("Expected template with a corrupt metafile not to be recovered")
+		}
+	}
+
+	// By default they are skipped and left in place.
+	s, l := start(false)
+	check(s)
+	s.Shutdown()
+	for _, dir := range []string{tdir, sdir, odir} {
+		if _, err := os.Stat(dir); err != nil || len(quarantined(dir)) != 0 {
+			t.Fatalf("Expected %q to be left in place: %v", dir, err)
+		}
+	}
+	if len(l.errors) != 0 {
+		t.Fatalf("Expected no errors, got %q", l.errors)
+	}
+
+	s, l = start(true)
+	check(s)
+	s.Shutdown()
+	for _, dir := range []string{tdir, sdir, odir} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) || len(quarantined(dir)) != 1 {
+			t.Fatalf("Expected %q to be moved aside", dir)
+		}
+	}
+	if len(l.errors) != 3 {
+		t.Fatalf("Expected an error for each corrupt metafile, got %q", l.errors)
+	}
+
+	// Directories that were moved aside are not looked at again.
+	s, l = start(true)
+	check(s)
+	s.Shutdown()
+	for _, dir := range []string{tdir, sdir, odir} {
+		if len(quarantined(dir)) != 1 {
+			t.Fatalf("Expected %q to only be moved aside once", dir)
+		}
+	}
+	if len(l.errors) != 0 {
+		t.Fatalf("Expected no errors, got %q", l.errors)
+	}
+}
+
+func TestJetStreamConsumerBadStateRecovery(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-consumer-state-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mset, err := s.GlobalAccount().AddStream(&StreamConfig{Name: "S", Storage: FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	obs, err := mset.AddConsumer(&ConsumerConfig{Durable: "dlc", DeliverPolicy: DeliverAll, AckPolicy: AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+
+	nc := natsConnect(t, s.ClientURL())
+	for i := 0; i < 10; i++ {
+		if _, err := nc.Request("S", []byte("Hello World"), time.Second); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		m, err := nc.Request(obs.RequestNextMsgSubject(), nil, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		m.Respond(nil)
+	}
+	nc.Flush()
+	nc.Close()
+	s.Shutdown()
+
+	// Leave the metafile in place but corrupt the stored state.
+	odir := path.Join(sd, JetStreamStoreDir, globalAccountName, streamsDir, "S", consumerDir, "dlc")
+	if err := ioutil.WriteFile(path.Join(odir, consumerState), []byte("not a valid state"), 0644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	s = RunServer(o)
+	defer s.Shutdown()
+	l := &captureRecoveryLogger{}
+	s.SetLogger(l, false, false)
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	l.Lock()
+	var logged bool
+	for _, w := range l.warnings {
+		if strings.Contains(w, "starting as a new consumer") {
+			logged = true
+		}
+	}
+	l.Unlock()
+	if !logged {
+		t.Fatalf("Expected a warning about the consumer starting over, got %q", l.warnings)
+	}
+
+	mset, err = s.GlobalAccount().LookupStream("S")
+	if err != nil {
+		t.Fatalf("Unexpected error looking up stream: %v", err)
+	}
+	obs = mset.LookupConsumer("dlc")
+	if obs == nil {
+		t.Fatalf("Expected consumer to be recovered")
+	}
+	if info := obs.Info(); info.Delivered.Stream != 0 || info.AckFloor.Stream != 0 || info.NumAckPending != 0 {
+		t.Fatalf("Expected a fresh consumer, got %+v", info)
+	}
+	if _, err := os.Stat(path.Join(odir, consumerState)); !os.IsNotExist(err) {
+		t.Fatalf("Expected the bad state file to be removed, got %v", err)
+	}
+
+	nc = natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	m, err := nc.Request(obs.RequestNextMsgSubject(), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if sseq, _, _ := ackReplyInfo(m.Reply); sseq != 1 {
+		t.Fatalf("Expected to start with the first message, got stream sequence %d", sseq)
+	}
+}
+
+func TestJetStreamNewInternalClient(t *testing.T) {
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if _, err := s.NewInternalJetStreamClient(s.GlobalAccount()); err != ErrJetStreamNotEnabled {
+		t.Fatalf("Expected not enabled error, got %v", err)
+	}
+
+	sd, err := ioutil.TempDir("", "js-internal-client-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := s.NewInternalJetStreamClient(nil); err == nil {
+		t.Fatalf("Expected an error for a nil account")
+	}
+
+	acc := s.GlobalAccount()
+	if _, err := acc.AddStream(&StreamConfig{Name: "S", Subjects: []string{"foo"}, Storage: MemoryStorage}); err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	c, err := s.NewInternalJetStreamClient(acc)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if c.Account() != acc {
+		t.Fatalf("Expected client to be bound to the account")
+	}
+
+	received := make(chan string, 1)
+	cb := func(subject, _ string, _, msg []byte) {
+		received <- subject + " " + string(msg)
+	}
+	if err := c.Subscribe("foo", cb); err != nil {
+		t.Fatalf("Unexpected error subscribing: %v", err)
+	}
+
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	if _, err := nc.Request("foo", []byte("Hello World"), time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	select {
+	case m := <-received:
+		if m != "foo Hello World" {
+			t.Fatalf("Unexpected message %q", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Did not receive the message")
+	}
+
+	c.Close()
+	if !c.c.isClosed() {
+		t.Fatalf("Expected client to be closed")
+	}
+	nc.Publish("foo", nil)
+	nc.Flush()
+	select {
+	case <-received:
+		t.Fatalf("Did not expect a message after close")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestJetStreamRecoveryRetriesResourceErrors(t *testing.T) {
+	attempts := make(map[string]int)
+	recover := func(cfg *FileStreamInfo, _ string) error {
+		attempts[cfg.Name]++
+		switch cfg.Name {
+		case "TRANSIENT":
+			if attempts[cfg.Name] < 2 {
+				return ErrJetStreamInsufficientStorage
+			}
+			return nil
+		case "BAD":
+			return fmt.Errorf("bad config")
+		default:
+			return ErrJetStreamInsufficientMemory
+		}
+	}
+	var pending []*streamRecoveryRetry
+	for _, name := range []string{"TRANSIENT", "STUCK", "BAD"} {
+		pending = append(pending, &streamRecoveryRetry{cfg: FileStreamInfo{StreamConfig: StreamConfig{Name: name}}, dname: name})
+	}
+	// Simulate a first pass where everything hit resource limits.
+	failed := retryStreamRecovery(pending, 3, recover)
+
+	if attempts["TRANSIENT"] != 2 || attempts["STUCK"] != 3 || attempts["BAD"] != 1 {
+		t.Fatalf("Unexpected number of attempts: %+v", attempts)
+	}
+	if len(failed) != 2 {
+		t.Fatalf("Expected 2 streams to fail, got %d", len(failed))
+	}
+	for _, sr := range failed {
+		switch sr.cfg.Name {
+		case "STUCK":
+			if sr.err != ErrJetStreamInsufficientMemory {
+				t.Fatalf("Unexpected error for %q: %v", sr.cfg.Name, sr.err)
+			}
+		case "BAD":
+			if isResourceErr(sr.err) {
+				t.Fatalf("Did not expect a resource error for %q", sr.cfg.Name)
+			}
+		default:
+			t.Fatalf("Did not expect %q to fail", sr.cfg.Name)
+		}
+	}
+
+	// Now make sure recovery will retry and eventually report streams that can never fit.
+	sd, err := ioutil.TempDir("", "js-recovery-retry-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd, MaxMemory: 8 * 1024 * 1024, MaxStore: 8 * 1024 * 1024}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := s.GlobalAccount().AddStream(&StreamConfig{Name: "S", Storage: FileStorage, MaxBytes: 4 * 1024 * 1024}); err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	s.Shutdown()
+
+	s = RunServer(o)
+	defer s.Shutdown()
+	l := &captureRecoveryLogger{}
+	s.SetLogger(l, false, false)
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd, MaxMemory: 8 * 1024 * 1024, MaxStore: 1024 * 1024, RecoveryRetries: 3}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	l.Lock()
+	defer l.Unlock()
+	var n int
+	for _, w := range l.warnings {
+		if strings.Contains(w, "Error recreating Stream") {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Fatalf("Expected a single warning for the stream, got %q", l.warnings)
+	}
+}
+
+func TestJetStreamStreamDirNames(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-stream-dirs-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	acc := s.GlobalAccount()
+
+	long := strings.Repeat("A", JSMaxNameLen)
+	names := []string{"ORDERS", "foo/bar", "with space", long}
+	for i, name := range names {
+		if _, err := acc.AddStream(&StreamConfig{Name: name, Subjects: []string{fmt.Sprintf("s.%d", i)}, Storage: FileStorage}); err != nil {
+			t.Fatalf("Unexpected error adding stream %q: %v", name, err)
+		}
+	}
+
+	nc := natsConnect(t, s.ClientURL())
+	for i := range names {
+		if _, err := nc.Request(fmt.Sprintf("s.%d", i), []byte("Hello World"), time.Second); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	nc.Close()
+
+	sdir := path.Join(sd, JetStreamStoreDir, globalAccountName, streamsDir)
+	if _, err := os.Stat(path.Join(sdir, "ORDERS")); err != nil {
+		t.Fatalf("Expected plain names to be used as is: %v", err)
+	}
+	for _, name := range names[1:] {
+		dir := streamDirName(name)
+		if !strings.HasPrefix(dir, streamDirHashPrefix) {
+			t.Fatalf("Expected a hashed directory for %q, got %q", name, dir)
+		}
+		if _, err := os.Stat(path.Join(sdir, dir, JetStreamMetaFile)); err != nil {
+			t.Fatalf("Expected stream %q to be stored in %q: %v", name, dir, err)
+		}
+	}
+	s.Shutdown()
+
+	// Put one stream back where it was stored before directory names were derived.
+	legacy := "with space"
+	ldir := path.Join(sdir, legacy)
+	if err := os.Rename(path.Join(sdir, streamDirName(legacy)), ldir); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	buf, err := ioutil.ReadFile(path.Join(ldir, JetStreamMetaFile))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var fsi FileStreamInfo
+	if err := json.Unmarshal(buf, &fsi); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fsi.dir = _EMPTY_
+	if buf, err = json.Marshal(fsi); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	key := sha256.Sum256([]byte(legacy))
+	hh, _ := highwayhash.New64(key[:])
+	hh.Write(buf)
+	ioutil.WriteFile(path.Join(ldir, JetStreamMetaFile), buf, 0644)
+	ioutil.WriteFile(path.Join(ldir, JetStreamMetaFileSum), []byte(hex.EncodeToString(hh.Sum(nil))), 0644)
+
+	s = RunServer(o)
+	defer s.Shutdown()
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	acc = s.GlobalAccount()
+	for _, name := range names {
+		mset, err := acc.LookupStream(name)
+		if err != nil {
+			t.Fatalf("Expected stream %q to be recovered: %v", name, err)
+		}
+		if state := mset.State(); state.Msgs != 1 {
+			t.Fatalf("Expected 1 message for %q, got %d", name, state.Msgs)
+		}
+	}
+	if _, err := os.Stat(ldir); !os.IsNotExist(err) {
+		t.Fatalf("Expected legacy directory to be moved, got %v", err)
+	}
+}
+
+func TestJetStreamMaxDeliveryGoroutines(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-max-delivery-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd, MaxDeliveryGoroutines: 2}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mset, err := s.GlobalAccount().AddStream(&StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Storage: MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+
+	const numConsumers, numMsgs = 50, 20
+	for i := 0; i < numMsgs; i++ {
+		nc.Publish("foo", []byte("Hello World"))
+	}
+	nc.Flush()
+
+	var subs []*nats.Subscription
+	for i := 0; i < numConsumers; i++ {
+		dsubj := fmt.Sprintf("d.%d", i)
+		sub, _ := nc.SubscribeSync(dsubj)
+		nc.Flush()
+		subs = append(subs, sub)
+		if _, err := mset.AddConsumer(&ConsumerConfig{DeliverSubject: dsubj, AckPolicy: AckNone}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	for i, sub := range subs {
+		checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+			if n, _, _ := sub.Pending(); n != numMsgs {
+				return fmt.Errorf("Consumer %d received %d of %d messages", i, n, numMsgs)
+			}
+			return nil
+		})
+	}
+	// No more than the cap of workers delivered at the same time.
+	p := s.getJetStream().dpool
+	if peak := atomic.LoadInt32(&p.peak); peak < 1 || peak > 2 {
+		t.Fatalf("Expected at most 2 concurrent delivery workers, got %d", peak)
+	}
+	// Once drained no delivery workers should be busy.
+	checkFor(t, time.Second, 50*time.Millisecond, func() error {
+		if n := atomic.LoadInt32(&p.busy); n != 0 {
+			return fmt.Errorf("Expected no busy delivery workers, got %d", n)
+		}
+		return nil
+	})
+}
+
+func BenchmarkJetStreamDeliveryGoroutines(b *testing.B) {
+	const numConsumers = 1000
+
+	run := func(b *testing.B, max int) {
+		sd, err := ioutil.TempDir("", "js-bench-delivery-")
+		if err != nil {
+			b.Fatalf("Unexpected error: %v", err)
+		}
+		defer os.RemoveAll(sd)
+
+		o := DefaultOptions()
+		o.Cluster.Port = 0
+		s := RunServer(o)
+		defer s.Shutdown()
+
+		if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd, MaxDeliveryGoroutines: max}); err != nil {
+			b.Fatalf("Unexpected error: %v", err)
+		}
+		mset, err := s.GlobalAccount().AddStream(&StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Storage: MemoryStorage})
+		if err != nil {
+			b.Fatalf("Unexpected error: %v", err)
+		}
+
+		nc, err := nats.Connect(s.ClientURL())
+		if err != nil {
+			b.Fatalf("Unexpected error: %v", err)
+		}
+		defer nc.Close()
+
+		var received int64
+		total := int64(b.N) * numConsumers
+		done := make(chan struct{})
+		cb := func(_ *nats.Msg) {
+			if atomic.AddInt64(&received, 1) == total {
+				close(done)
+			}
+		}
+		for i := 0; i < numConsumers; i++ {
+			nc.Subscribe(fmt.Sprintf("d.%d", i), cb)
+		}
+		nc.Flush()
+
+		base := runtime.NumGoroutine()
+		for i := 0; i < numConsumers; i++ {
+			if _, err := mset.AddConsumer(&ConsumerConfig{DeliverSubject: fmt.Sprintf("d.%d", i), AckPolicy: AckNone}); err != nil {
+				b.Fatalf("Unexpected error: %v", err)
+			}
+		}
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			nc.Publish("foo", []byte("Hello World"))
+		}
+		select {
+		case <-done:
+		case <-time.After(30 * time.Second):
+			b.Fatalf("Only received %d of %d messages", atomic.LoadInt64(&received), total)
+		}
+		b.StopTimer()
+
+		b.ReportMetric(float64(runtime.NumGoroutine()-base)/numConsumers, "goroutines/consumer")
+	}
+
+	b.Run("Unbounded", func(b *testing.B) { run(b, 0) })
+	b.Run("Capped", func(b *testing.B) { run(b, 8) })
+}
+
+func TestJetStreamUsageCallback(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-usage-cb-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	orig := jsUsageNotifyInterval
+	jsUsageNotifyInterval = 100 * time.Millisecond
+	defer func() { jsUsageNotifyInterval = orig }()
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	acc := s.GlobalAccount()
+
+	updates := make(chan JetStreamAccountStats, 100)
+	acc.OnJetStreamUsage(func(stats JetStreamAccountStats) { updates <- stats })
+
+	if _, err := acc.AddStream(&StreamConfig{Name: "TEST", Storage: MemoryStorage}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+
+	start := time.Now()
+	for i := 0; i < 50; i++ {
+		if _, err := nc.Request("TEST", []byte("Hello World"), time.Second); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	// Wait for the final usage to be reported.
+	expected := acc.JetStreamUsage().Memory
+	var calls int
+	for done := false; !done; {
+		select {
+		case stats := <-updates:
+			calls++
+			done = stats.Memory == expected
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Did not receive usage of %d", expected)
+		}
+	}
+	// Updates should have been coalesced.
+	if max := int(time.Since(start)/jsUsageNotifyInterval) + 1; calls > max {
+		t.Fatalf("Expected at most %d calls, got %d", max, calls)
+	}
+
+	// Once removed we should not be called again.
+	acc.OnJetStreamUsage(nil)
+	nc.Request("TEST", []byte("Hello World"), time.Second)
+	select {
+	case stats := <-updates:
+		t.Fatalf("Unexpected usage callback: %+v", stats)
+	case <-time.After(2 * jsUsageNotifyInterval):
+	}
+}
+
+func TestJetStreamStoreDirSymlinks(t *testing.T) {
+	base, err := ioutil.TempDir("", "js-symlinks-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(base)
+
+	// Storage directory and account directory both live on other "volumes".
+	vol1, vol2 := filepath.Join(base, "vol1"), filepath.Join(base, "vol2")
+	for _, dir := range []string{filepath.Join(vol1, JetStreamStoreDir), vol2} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	sd := filepath.Join(base, "js")
+	if err := os.Symlink(vol1, sd); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := os.Symlink(vol2, filepath.Join(vol1, JetStreamStoreDir, globalAccountName)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	start := func() (*Server, *captureNoticeLogger) {
+		t.Helper()
+		o := DefaultOptions()
+		o.Cluster.Port = 0
+		s := RunServer(o)
+		l := &captureNoticeLogger{}
+		s.SetLogger(l, false, false)
+		if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+			s.Shutdown()
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return s, l
+	}
+	s, l := start()
+	if _, err := s.GlobalAccount().AddStream(&StreamConfig{Name: "TEST", Storage: FileStorage}); err != nil {
+		s.Shutdown()
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	s.Shutdown()
+
+	if _, err := os.Stat(filepath.Join(vol2, streamsDir, "TEST", JetStreamMetaFile)); err != nil {
+		t.Fatalf("Expected stream to be stored on the account volume: %v", err)
+	}
+
+	s, l = start()
+	defer s.Shutdown()
+	if _, err := s.GlobalAccount().LookupStream("TEST"); err != nil {
+		t.Fatalf("Expected stream to be recovered: %v", err)
+	}
+
+	rvol1, _ := filepath.EvalSymlinks(vol1)
+	rvol2, _ := filepath.EvalSymlinks(vol2)
+	l.Lock()
+	defer l.Unlock()
+	var storeLogged, accLogged bool
+	for _, n := range l.notices {
+		storeLogged = storeLogged || strings.Contains(n, fmt.Sprintf("Resolved To:     %q", filepath.Join(rvol1, JetStreamStoreDir)))
+		accLogged = accLogged || strings.Contains(n, fmt.Sprintf("resolves to %q", rvol2))
+	}
+	if !storeLogged || !accLogged {
+		t.Fatalf("Expected resolved paths to be logged, got %q", l.notices)
+	}
+}
+
+func TestJetStreamTemplateConcurrentStreamCreate(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-tmpl-race-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	l := &captureRecoveryLogger{}
+	s.SetLogger(l, false, false)
+
+	acc := s.GlobalAccount()
+	tmpl, err := acc.AddStreamTemplate(&StreamTemplateConfig{
+		Name:       "kv",
+		Config:     &StreamConfig{Subjects: []string{"kv.*"}, Storage: MemoryStorage},
+		MaxStreams: 10,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	const numSubjects, numPubs = 5, 20
+	for i := 0; i < numSubjects; i++ {
+		subj := fmt.Sprintf("kv.%d", i)
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for n := 0; n < numPubs; n++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				tmpl.processInboundTemplateMsg(nil, nil, subj, _EMPTY_, []byte("Hello World"))
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		mset, err := acc.LookupStream(CanonicalName(subj))
+		if err != nil {
+			t.Fatalf("Expected stream for %q: %v", subj, err)
+		}
+		// Those that arrived once the stream existed are left to its own subscription.
+		if msgs := mset.State().Msgs; msgs == 0 || msgs > numPubs {
+			t.Fatalf("Unexpected number of messages for %q: %d", subj, msgs)
+		}
+	}
+
+	tmpl.mu.Lock()
+	streams, creating := len(tmpl.streams), len(tmpl.creating)
+	tmpl.mu.Unlock()
+	if streams != numSubjects || creating != 0 {
+		t.Fatalf("Expected %d streams and none in flight, got %d and %d", numSubjects, streams, creating)
+	}
+	l.Lock()
+	defer l.Unlock()
+	if len(l.warnings) > 0 {
+		t.Fatalf("Unexpected warnings: %q", l.warnings)
+	}
+}
+
+func TestJetStreamTemplateSubjectOverlap(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-tmpl-overlap-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	acc := s.GlobalAccount()
+	addTemplate := func(name string, subjects ...string) error {
+		_, err := acc.AddStreamTemplate(&StreamTemplateConfig{
+			Name:       name,
+			Config:     &StreamConfig{Subjects: subjects, Storage: MemoryStorage},
+			MaxStreams: 10,
+		})
+		return err
+	}
+	if err := addTemplate("kv", "kv.*"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := addTemplate("orders", "orders.>", "bar.baz"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, test := range []struct {
+		name     string
+		subjects []string
+		existing string
+	}{
+		{"literal", []string{"kv.foo"}, "kv"},
+		{"wildcard", []string{"kv.>"}, "kv"},
+		{"full wildcard", []string{"orders.us.>"}, "orders"},
+		{"second subject", []string{"baz", "bar.*"}, "orders"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := addTemplate("overlap", test.subjects...)
+			if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("existing template %q", test.existing)) {
+				t.Fatalf("Expected overlap with %q, got %v", test.existing, err)
+			}
+		})
+	}
+	if n := len(acc.Templates()); n != 2 {
+		t.Fatalf("Expected 2 templates, got %d", n)
+	}
+	// Rejected templates should not leave internal clients behind.
+	if n := acc.NumConnections(); n != 2 {
+		t.Fatalf("Expected 2 internal clients, got %d", n)
+	}
+
+	// Subjects that do not collide are fine.
+	if err := addTemplate("other", "kv.foo.bar", "orders", "bar.baz.>"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestJetStreamTemplateCreateRetries(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-tmpl-retry-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Fail the first attempts for each stream with the given error.
+	var mu sync.Mutex
+	var failErr error
+	var fails, attempts int
+	templateCreateHook = func(cfg *StreamConfig) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if fails > 0 {
+			fails--
+			return failErr
+		}
+		return nil
+	}
+	defer func() { templateCreateHook = nil }()
+	failWith := func(err error, n int) {
+		mu.Lock()
+		failErr, fails, attempts = err, n, 0
+		mu.Unlock()
+	}
+	// Retries happen in the background.
+	var tmpl *StreamTemplate
+	checkAttempts := func(expected int) {
+		t.Helper()
+		checkFor(t, time.Second, 5*time.Millisecond, func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			if attempts != expected {
+				return fmt.Errorf("Expected %d attempts, got %d", expected, attempts)
+			}
+			return nil
+		})
+	}
+	checkFailed := func(expected uint64) {
+		t.Helper()
+		checkFor(t, time.Second, 5*time.Millisecond, func() error {
+			tmpl.mu.Lock()
+			defer tmpl.mu.Unlock()
+			if tmpl.stats.Failed != expected || len(tmpl.creating) != 0 {
+				return fmt.Errorf("Expected %d failed, got %d", expected, tmpl.stats.Failed)
+			}
+			return nil
+		})
+	}
+
+	acc := s.GlobalAccount()
+	if _, err := acc.AddStreamTemplate(&StreamTemplateConfig{
+		Name:          "bad",
+		Config:        &StreamConfig{Subjects: []string{"bad.*"}},
+		MaxStreams:    10,
+		CreateRetries: -1,
+	}); err == nil {
+		t.Fatalf("Expected an error with negative retries")
+	}
+	tmpl, err = acc.AddStreamTemplate(&StreamTemplateConfig{
+		Name:          "kv",
+		Config:        &StreamConfig{Subjects: []string{"kv.*"}, Storage: MemoryStorage},
+		MaxStreams:    10,
+		CreateRetries: 3,
+		CreateBackoff: time.Millisecond,
+		FailedBuffer:  2,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	msgs := func(subj string) uint64 {
+		t.Helper()
+		mset, err := acc.LookupStream(CanonicalName(subj))
+		if err != nil {
+			return 0
+		}
+		return mset.State().Msgs
+	}
+
+	// Transient failures are retried until the stream is created.
+	failWith(ErrJetStreamInsufficientMemory, 2)
+	tmpl.processInboundTemplateMsg(nil, nil, "kv.1", _EMPTY_, []byte("Hello World"))
+	checkAttempts(3)
+	checkFor(t, time.Second, 5*time.Millisecond, func() error {
+		if n := msgs("kv.1"); n != 1 {
+			return fmt.Errorf("Expected the message to be stored, got %d", n)
+		}
+		return nil
+	})
+
+	// Configuration errors are not.
+	failWith(errors.New("bad config"), 1)
+	tmpl.processInboundTemplateMsg(nil, nil, "kv.2", _EMPTY_, []byte("1"))
+	checkAttempts(1)
+	checkFailed(1)
+
+	// Retries are bounded, the message is held and stored once the stream is created.
+	failWith(ErrJetStreamInsufficientStorage, 4)
+	tmpl.processInboundTemplateMsg(nil, nil, "kv.3", _EMPTY_, []byte("2"))
+	checkAttempts(4)
+	checkFailed(2)
+	if n := msgs("kv.3"); n != 0 {
+		t.Fatalf("Expected no stream, got %d msgs", n)
+	}
+	tmpl.processInboundTemplateMsg(nil, nil, "kv.3", _EMPTY_, []byte("3"))
+	mset, err := acc.LookupStream("kv_3")
+	if err != nil {
+		t.Fatalf("Expected stream to be created: %v", err)
+	}
+	for seq, expected := range []string{"2", "3"} {
+		_, _, msg, _, err := mset.store.LoadMsg(uint64(seq + 1))
+		if err != nil || string(msg) != expected {
+			t.Fatalf("Expected %q at %d, got %q: %v", expected, seq+1, msg, err)
+		}
+	}
+
+	tmpl.mu.Lock()
+	stats, held := tmpl.stats, len(tmpl.failed)
+	tmpl.mu.Unlock()
+	if stats.Created != 2 || stats.Failed != 2 || held != 1 {
+		t.Fatalf("Unexpected stats %+v with %d held", stats, held)
+	}
+}
+
+func TestJetStreamTemplateCreateRetriesOffReadLoop(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-tmpl-retry-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	owait, oage := tmplCreateMaxRetryWait, tmplFailedMsgMaxAge
+	tmplCreateMaxRetryWait, tmplFailedMsgMaxAge = 100*time.Millisecond, 250*time.Millisecond
+	defer func() { tmplCreateMaxRetryWait, tmplFailedMsgMaxAge = owait, oage }()
+
+	var attempts int32
+	templateCreateHook = func(cfg *StreamConfig) error {
+		atomic.AddInt32(&attempts, 1)
+		return ErrJetStreamInsufficientMemory
+	}
+	defer func() { templateCreateHook = nil }()
+
+	acc := s.GlobalAccount()
+	tmpl, err := acc.AddStreamTemplate(&StreamTemplateConfig{
+		Name:          "kv",
+		Config:        &StreamConfig{Subjects: []string{"kv.*"}, Storage: MemoryStorage},
+		MaxStreams:    10,
+		CreateRetries: 100,
+		CreateBackoff: 10 * time.Millisecond,
+		FailedBuffer:  10,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The publisher is not held up by retries, nor are others publishing while they happen.
+	start := time.Now()
+	tmpl.processInboundTemplateMsg(nil, nil, "kv.1", _EMPTY_, []byte("1"))
+	tmpl.processInboundTemplateMsg(nil, nil, "kv.1", _EMPTY_, []byte("2"))
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("Expected the publisher to not wait on retries, took %v", elapsed)
+	}
+
+	// The total time spent retrying is capped, 10+20+40ms here, before both messages are held.
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		tmpl.mu.Lock()
+		defer tmpl.mu.Unlock()
+		if len(tmpl.failed) != 2 {
+			return fmt.Errorf("Expected 2 held messages, got %d", len(tmpl.failed))
+		}
+		return nil
+	})
+	if n := atomic.LoadInt32(&attempts); n != 4 {
+		t.Fatalf("Expected 4 attempts, got %d", n)
+	}
+
+	// Held messages are dropped once old enough, even without another publish.
+	checkFor(t, time.Second, 25*time.Millisecond, func() error {
+		tmpl.mu.Lock()
+		defer tmpl.mu.Unlock()
+		if len(tmpl.failed) != 0 {
+			return fmt.Errorf("Expected no held messages, got %d", len(tmpl.failed))
+		}
+		return nil
+	})
+}
+
+func TestJetStreamMaxConcurrentAPIOpsOffReadLoop(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-api-ops-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	acc := s.GlobalAccount()
+	limits, _ := acc.JetStreamLimits()
+	limits.MaxConcurrentAPIOps = 1
+	if err := acc.UpdateJetStreamLimits(&limits); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	acc.mu.RLock()
+	jsa := acc.js
+	acc.mu.RUnlock()
+
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	sub := natsSubSync(t, nc, nats.NewInbox())
+
+	// Take the only slot so the request has to wait.
+	release, err := jsa.acquireAPIOp()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	req, _ := json.Marshal(&StreamConfig{Name: "S", Storage: MemoryStorage})
+	if err := nc.PublishRequest(fmt.Sprintf(JSApiStreamCreateT, "S"), sub.Subject, req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The connection's readLoop should not be blocked while the request waits.
+	if err := nc.FlushTimeout(500 * time.Millisecond); err != nil {
+		t.Fatalf("Expected the readLoop to not be blocked: %v", err)
+	}
+	release()
+
+	resp, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var scResp JSApiStreamCreateResponse
+	if err := json.Unmarshal(resp.Data, &scResp); err != nil || scResp.Error != nil {
+		t.Fatalf("Unexpected response: %s", resp.Data)
+	}
+}
+
+func TestJetStreamRecoveryMemoryBudget(t *testing.T) {
+	rb := newRecoveryBudget(100)
+	if n := rb.acquire(60); n != 60 {
+		t.Fatalf("Expected to acquire 60, got %d", n)
+	}
+	acquired := make(chan int64)
+	go func() { acquired <- rb.acquire(50) }()
+	select {
+	case <-acquired:
+		t.Fatalf("Expected acquire to wait for the budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+	rb.release(60)
+	select {
+	case n := <-acquired:
+		rb.release(n)
+	case <-time.After(time.Second):
+		t.Fatalf("Expected acquire to proceed once released")
+	}
+	// Anything larger than the budget is capped so it can still run by itself.
+	if n := rb.acquire(1000); n != 100 {
+		t.Fatalf("Expected acquire to be capped at 100, got %d", n)
+	}
+	rb.release(100)
+
+	sd, err := ioutil.TempDir("", "js-budget-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	start := func() *Server {
+		t.Helper()
+		o := DefaultOptions()
+		o.Cluster.Port = 0
+		s := RunServer(o)
+		cfg := &JetStreamConfig{StoreDir: sd, LazyRecovery: true, RecoveryMemoryBudget: 256}
+		if err := s.EnableJetStream(cfg); err != nil {
+			s.Shutdown()
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return s
+	}
+	s := start()
+	acc := s.GlobalAccount()
+	names := []string{"S1", "S2", "S3", "S4"}
+	for _, name := range names {
+		mset, err := acc.AddStream(&StreamConfig{Name: name, Storage: FileStorage})
+		if err != nil {
+			s.Shutdown()
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		for i := 0; i < 10; i++ {
+			if _, _, err := mset.store.StoreMsg(name, nil, bytes.Repeat([]byte("Z"), 100)); err != nil {
+				s.Shutdown()
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+	}
+	s.Shutdown()
+
+	s = start()
+	defer s.Shutdown()
+	acc = s.GlobalAccount()
+
+	// Load all of the streams at once, each is larger than the budget.
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if _, err := acc.loadLazyStream(name); err != nil {
+				t.Errorf("Unexpected error loading %q: %v", name, err)
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	for _, name := range names {
+		mset, err := acc.LookupStream(name)
+		if err != nil {
+			t.Fatalf("Expected stream %q to be recovered: %v", name, err)
+		}
+		if state := mset.State(); state.Msgs != 10 {
+			t.Fatalf("Expected 10 msgs for %q, got %d", name, state.Msgs)
+		}
+	}
+	rb = s.getJetStream().rbudget
+	rb.mu.Lock()
+	used := rb.used
+	rb.mu.Unlock()
+	if used != 0 {
+		t.Fatalf("Expected the recovery budget to be returned, %d still used", used)
+	}
+
+	// Metafiles are read with a bounded size.
+	big := filepath.Join(sd, "big")
+	if err := ioutil.WriteFile(big, make([]byte, JetStreamMaxMetaFileSize+1), 0644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := readMetaFile(big); err == nil {
+		t.Fatalf("Expected an error reading an oversized metafile")
+	}
+}
+
+func TestJetStreamRecoveryProgress(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-progress-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	type progress struct {
+		account, stream string
+		done, total     int
+		msgs            uint64
+	}
+	var reported []progress
+	start := func(lazy bool) *Server {
+		t.Helper()
+		o := DefaultOptions()
+		o.Cluster.Port = 0
+		s := RunServer(o)
+		cfg := &JetStreamConfig{StoreDir: sd, LazyRecovery: lazy}
+		cfg.RecoveryProgress = func(account, stream string, done, total int, msgs uint64) {
+			reported = append(reported, progress{account, stream, done, total, msgs})
+		}
+		if err := s.EnableJetStream(cfg); err != nil {
+			s.Shutdown()
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return s
+	}
+	s := start(false)
+	acc := s.GlobalAccount()
+	expected := map[string]uint64{"S1": 1, "S2": 5, "S3": 10}
+	for name, n := range expected {
+		mset, err := acc.AddStream(&StreamConfig{Name: name, Storage: FileStorage})
+		if err != nil {
+			s.Shutdown()
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		for i := uint64(0); i < n; i++ {
+			if _, _, err := mset.store.StoreMsg(name, nil, []byte("OK")); err != nil {
+				s.Shutdown()
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+	}
+	s.Shutdown()
+	if len(reported) != 0 {
+		t.Fatalf("Expected no progress without streams to recover, got %+v", reported)
+	}
+
+	check := func(lazy bool) {
+		t.Helper()
+		if len(reported) != len(expected) {
+			t.Fatalf("Expected progress for %d streams, got %+v", len(expected), reported)
+		}
+		for i, p := range reported {
+			msgs, ok := expected[p.stream]
+			if lazy {
+				msgs = 0
+			}
+			if !ok || p.account != globalAccountName || p.done != i+1 || p.total != len(expected) || p.msgs != msgs {
+				t.Fatalf("Unexpected progress %+v", p)
+			}
+		}
+	}
+	s = start(false)
+	s.Shutdown()
+	check(false)
+
+	// Lazy streams have no messages restored yet.
+	reported = nil
+	s = start(true)
+	s.Shutdown()
+	check(true)
+}
+
+func TestJetStreamRecoveryConcurrency(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-concurrency-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	start := func(workers int) *Server {
+		t.Helper()
+		o := DefaultOptions()
+		o.Cluster.Port = 0
+		s := RunServer(o)
+		if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd, RecoveryConcurrency: workers}); err != nil {
+			s.Shutdown()
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return s
+	}
+	s := start(0)
+	acc := s.GlobalAccount()
+	numStreams := 12
+	for i := 0; i < numStreams; i++ {
+		name := fmt.Sprintf("S%d", i)
+		mset, err := acc.AddStream(&StreamConfig{Name: name, Storage: FileStorage})
+		if err != nil {
+			s.Shutdown()
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		for n := 0; n <= i; n++ {
+			if _, _, err := mset.store.StoreMsg(name, nil, []byte("OK")); err != nil {
+				s.Shutdown()
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+		if _, err := mset.AddConsumer(&ConsumerConfig{Durable: "dlc", AckPolicy: AckExplicit}); err != nil {
+			s.Shutdown()
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	s.Shutdown()
+
+	var usage JetStreamAccountStats
+	for _, workers := range []int{1, 4, 0} {
+		s = start(workers)
+		acc = s.GlobalAccount()
+		nusage := acc.JetStreamUsage()
+		for i := 0; i < numStreams; i++ {
+			mset, err := acc.LookupStream(fmt.Sprintf("S%d", i))
+			if err != nil {
+				s.Shutdown()
+				t.Fatalf("Expected stream to be recovered with %d workers: %v", workers, err)
+			}
+			if state := mset.State(); state.Msgs != uint64(i+1) {
+				s.Shutdown()
+				t.Fatalf("Expected %d msgs with %d workers, got %d", i+1, workers, state.Msgs)
+			}
+			if mset.LookupConsumer("dlc") == nil {
+				s.Shutdown()
+				t.Fatalf("Expected consumer to be recovered with %d workers", workers)
+			}
+		}
+		s.Shutdown()
+		if nusage.Streams != numStreams {
+			t.Fatalf("Expected %d streams with %d workers, got %d", numStreams, workers, nusage.Streams)
+		}
+		if workers == 1 {
+			usage = nusage
+		} else if nusage.Store != usage.Store || nusage.Memory != usage.Memory {
+			t.Fatalf("Expected usage to match serial recovery with %d workers, %+v vs %+v", workers, nusage, usage)
+		}
+	}
+}
+
+func TestJetStreamStoreLayoutVersion(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-layout-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	start := func() (*Server, error) {
+		t.Helper()
+		o := DefaultOptions()
+		o.Cluster.Port = 0
+		s := RunServer(o)
+		if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+			s.Shutdown()
+			return nil, err
+		}
+		return s, nil
+	}
+	lfile := filepath.Join(sd, JetStreamStoreDir, JetStreamLayoutFile)
+	checkVersion := func() {
+		t.Helper()
+		buf, err := ioutil.ReadFile(lfile)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if v := string(buf); v != strconv.Itoa(JetStreamLayoutVersion) {
+			t.Fatalf("Expected layout version %d, got %q", JetStreamLayoutVersion, v)
+		}
+	}
+
+	// A new storage directory is stamped.
+	s, err := start()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := s.GlobalAccount().AddStream(&StreamConfig{Name: "TEST", Storage: FileStorage}); err != nil {
+		s.Shutdown()
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	s.Shutdown()
+	checkVersion()
+
+	// Unversioned directories are migrated and keep their data.
+	os.Remove(lfile)
+	if s, err = start(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := s.GlobalAccount().LookupStream("TEST"); err != nil {
+		t.Fatalf("Expected stream to be recovered: %v", err)
+	}
+	s.Shutdown()
+	checkVersion()
+
+	// Newer layouts are refused.
+	if err := ioutil.WriteFile(lfile, []byte(strconv.Itoa(JetStreamLayoutVersion+1)), 0644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := start(); err == nil || !strings.Contains(err.Error(), "newer than the supported version") {
+		t.Fatalf("Expected an error for a newer layout, got %v", err)
+	}
+}
+
+func TestJetStreamMaxConcurrentAPIOps(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-api-ops-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	acc := s.GlobalAccount()
+	limits, _ := acc.JetStreamLimits()
+	limits.MaxConcurrentAPIOps = 2
+	if err := acc.UpdateJetStreamLimits(&limits); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	acc.mu.RLock()
+	jsa := acc.js
+	acc.mu.RUnlock()
+
+	// Concurrent operations are bounded by the limit.
+	var active, maxActive int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := jsa.acquireAPIOp()
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+			n := atomic.AddInt32(&active, 1)
+			for {
+				m := atomic.LoadInt32(&maxActive)
+				if n <= m || atomic.CompareAndSwapInt32(&maxActive, m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&active, -1)
+			release()
+		}()
+	}
+	wg.Wait()
+	if maxActive != 2 {
+		t.Fatalf("Expected at most 2 concurrent operations, got %d", maxActive)
+	}
+
+	// Requests waiting too long are rejected.
+	owait := jsAPIOpWait
+	jsAPIOpWait = 50 * time.Millisecond
+	defer func() { jsAPIOpWait = owait }()
+	r1, _ := jsa.acquireAPIOp()
+	r2, _ := jsa.acquireAPIOp()
+	if _, err := jsa.acquireAPIOp(); err != ErrJetStreamAPIBusy {
+		t.Fatalf("Expected busy error, got %v", err)
+	}
+	r1()
+	r2()
+	jsAPIOpWait = owait
+
+	// Concurrent API requests from many connections are queued and all succeed.
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			nc := natsConnect(t, s.ClientURL())
+			defer nc.Close()
+			name := fmt.Sprintf("S%d", i)
+			req, _ := json.Marshal(&StreamConfig{Name: name, Storage: MemoryStorage})
+			resp, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, name), req, 5*time.Second)
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+			var scResp JSApiStreamCreateResponse
+			if err := json.Unmarshal(resp.Data, &scResp); err != nil || scResp.Error != nil {
+				t.Errorf("Unexpected response: %s", resp.Data)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := acc.NumStreams(); n != 10 {
+		t.Fatalf("Expected 10 streams, got %d", n)
+	}
+}
+
+func TestJetStreamVolatileStoreDir(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-volatile-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	orig := storeDirVolatileFS
+	defer func() { storeDirVolatileFS = orig }()
+	storeDirVolatileFS = func(_ string) string { return "tmpfs" }
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	// Strict mode refuses a RAM backed storage directory.
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd, RequireDurableStore: true}); err == nil || !strings.Contains(err.Error(), "tmpfs") {
+		t.Fatalf("Expected an error about tmpfs, got %v", err)
+	}
+	s.Shutdown()
+
+	// Otherwise we only warn.
+	s = RunServer(o)
+	defer s.Shutdown()
+	l := &captureRecoveryLogger{}
+	s.SetLogger(l, false, false)
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	l.Lock()
+	defer l.Unlock()
+	var warned bool
+	for _, w := range l.warnings {
+		if strings.Contains(w, "tmpfs") {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Fatalf("Expected a warning about tmpfs, got %q", l.warnings)
+	}
+}
+
+func TestJetStreamValidateConfig(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-validate-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	onet, ototal, omem := storeDirNetworkFS, storeDirTotal, jsSystemMemory
+	defer func() { storeDirNetworkFS, storeDirTotal, jsSystemMemory = onet, ototal, omem }()
+	var netfs string
+	storeDirNetworkFS = func(_ string) string { return netfs }
+	storeDirTotal = func(_ string) int64 { return 1 << 30 }
+	jsSystemMemory = func() int64 { return 1 << 30 }
+
+	file := path.Join(sd, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, test := range []struct {
+		name  string
+		netfs string
+		cfg   *JetStreamConfig
+		err   error
+	}{
+		{"nil", _EMPTY_, nil, nil},
+		{"dynamic", _EMPTY_, &JetStreamConfig{StoreDir: sd, MaxMemory: -1, MaxStore: -1}, nil},
+		{"overcommitted", _EMPTY_, &JetStreamConfig{StoreDir: sd, MaxMemory: 64 << 30, MaxStore: 64 << 30}, nil},
+		{"missing dir", _EMPTY_, &JetStreamConfig{StoreDir: path.Join(sd, "a", "b")}, nil},
+		{"file", _EMPTY_, &JetStreamConfig{StoreDir: file}, ErrJetStreamInvalidStoreDir},
+		{"nfs", "nfs", &JetStreamConfig{StoreDir: sd}, ErrJetStreamNetworkStoreDir},
+		{"memory only ignores dir", "nfs", &JetStreamConfig{StoreDir: sd, MemoryOnly: true}, nil},
+		{"nfs allowed", "nfs", &JetStreamConfig{StoreDir: sd, AllowNetworkStoreDir: true}, nil},
+		{"memory", _EMPTY_, &JetStreamConfig{StoreDir: sd, MaxMemory: 2 << 40}, ErrJetStreamMemoryLimitTooLarge},
+		{"store only warns", _EMPTY_, &JetStreamConfig{StoreDir: sd, MaxStore: 2 << 40}, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			netfs = test.netfs
+			if err := ValidateJetStreamConfig(test.cfg); !errors.Is(err, test.err) || (err == nil) != (test.err == nil) {
+				t.Fatalf("Expected error %v, got %v", test.err, err)
+			}
+		})
+	}
+
+	// Enabling fails before anything is set up.
+	netfs = "nfs"
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); !errors.Is(err, ErrJetStreamNetworkStoreDir) {
+		t.Fatalf("Expected %v, got %v", ErrJetStreamNetworkStoreDir, err)
+	}
+	if s.JetStreamEnabled() {
+		t.Fatalf("Expected JetStream not to be enabled")
+	}
+
+	// A storage limit far beyond the filesystem only warns.
+	netfs = _EMPTY_
+	l := &captureWarnLogger{warn: make(chan string, 10)}
+	s.SetLogger(l, false, false)
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd, MaxStore: 2 << 40}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for warned := false; !warned; {
+		select {
+		case w := <-l.warn:
+			warned = strings.Contains(w, "times the size of the filesystem")
+		default:
+			t.Fatalf("Expected a warning about the storage limit")
+		}
+	}
+}
+
+func TestJetStreamStoreDirExpansion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.SkipNow()
+	}
+	sd, err := ioutil.TempDir("", "js-expand-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	origHome := os.Getenv("HOME")
+	defer os.Setenv("HOME", origHome)
+	os.Setenv("HOME", sd)
+	defer os.Unsetenv("JS_EXPAND_DATA_DIR")
+	os.Setenv("JS_EXPAND_DATA_DIR", sd)
+	os.Unsetenv("JS_EXPAND_UNSET_DIR")
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, test := range []struct {
+		dir      string
+		expected string
+	}{
+		{"~", sd},
+		{"~/nats", path.Join(sd, "nats")},
+		{"$JS_EXPAND_DATA_DIR/nats", path.Join(sd, "nats")},
+		{"${JS_EXPAND_DATA_DIR}/a/../nats", path.Join(sd, "nats")},
+		{"./data", path.Join(cwd, "data")},
+		{"data/", path.Join(cwd, "data")},
+		{"/tmp/~nats", "/tmp/~nats"},
+	} {
+		dir, err := expandStoreDir(test.dir)
+		if err != nil {
+			t.Fatalf("Unexpected error expanding %q: %v", test.dir, err)
+		}
+		if dir != test.expected {
+			t.Fatalf("Expected %q to expand to %q, got %q", test.dir, test.expected, dir)
+		}
+	}
+	if _, err := expandStoreDir("$JS_EXPAND_UNSET_DIR/nats"); !errors.Is(err, ErrJetStreamInvalidStoreDir) || !strings.Contains(err.Error(), "JS_EXPAND_UNSET_DIR") {
+		t.Fatalf("Expected an error for an unset variable, got %v", err)
+	}
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	// Nothing is created for an unset variable.
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: "$JS_EXPAND_UNSET_DIR"}); !errors.Is(err, ErrJetStreamInvalidStoreDir) {
+		t.Fatalf("Expected %v, got %v", ErrJetStreamInvalidStoreDir, err)
+	}
+	if _, err := os.Stat(path.Join(cwd, "$JS_EXPAND_UNSET_DIR")); !os.IsNotExist(err) {
+		t.Fatalf("Expected no directory to be created, got %v", err)
+	}
+
+	config := &JetStreamConfig{MaxMemory: 1 << 20, MaxStore: 1 << 20, StoreDir: "$JS_EXPAND_DATA_DIR/js"}
+	if err := s.EnableJetStream(config); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.StoreDir != "$JS_EXPAND_DATA_DIR/js" {
+		t.Fatalf("Expected the callers config to be unchanged, got %q", config.StoreDir)
+	}
+	if dir := s.JetStreamConfig().StoreDir; dir != path.Join(sd, "js") {
+		t.Fatalf("Expected the store directory to be %q, got %q", path.Join(sd, "js"), dir)
+	}
+}
+
+func TestJetStreamVerifyDataOnRecovery(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-verify-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, name := range []string{"GOOD", "BAD"} {
+		if _, err := s.GlobalAccount().AddStream(&StreamConfig{Name: name, Storage: FileStorage}); err != nil {
+			t.Fatalf("Unexpected error adding stream: %v", err)
+		}
+	}
+
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	for i := 0; i < 10; i++ {
+		for _, name := range []string{"GOOD", "BAD"} {
+			m := nats.NewMsg(name)
+			m.Header.Set("X-Index", strconv.Itoa(i))
+			m.Data = []byte("Hello World")
+			if _, err := nc.RequestMsg(m, time.Second); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		}
+	}
+	nc.Close()
+	s.Shutdown()
+
+	// Flip a byte in the payload of the last message of BAD.
+	sdir := filepath.Join(sd, JetStreamStoreDir, globalAccountName, streamsDir, "BAD")
+	blk := filepath.Join(sdir, msgDir, fmt.Sprintf(blkScan, 1))
+	buf, err := ioutil.ReadFile(blk)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	buf[len(buf)-10] ^= 0xff
+	if err := ioutil.WriteFile(blk, buf, 0644); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	s = RunServer(o)
+	defer s.Shutdown()
+	l := &captureRecoveryLogger{}
+	s.SetLogger(l, false, false)
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd, VerifyDataOnRecovery: true}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for name, msgs := range map[string]uint64{"GOOD": 10, "BAD": 0} {
+		mset, err := s.GlobalAccount().LookupStream(name)
+		if err != nil {
+			t.Fatalf("Expected stream %q to be recovered: %v", name, err)
+		}
+		if state := mset.State(); state.Msgs != msgs {
+			t.Fatalf("Expected %d msgs for %q, got %d", msgs, name, state.Msgs)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(sdir, corruptDir, fmt.Sprintf(blkScan, 1))); err != nil {
+		t.Fatalf("Expected the corrupt block to be moved aside: %v", err)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	var reported bool
+	for _, w := range l.warnings {
+		if strings.Contains(w, "Corrupt message block") {
+			reported = true
+		}
+	}
+	if !reported {
+		t.Fatalf("Expected the corrupt block to be reported, got %q", l.warnings)
+	}
+	rerrs := s.GlobalAccount().JetStreamUsage().RecoveryErrors
+	if len(rerrs) != 1 || rerrs[0].Class != "corrupt message blocks moved aside" || !strings.Contains(rerrs[0].Description, `"BAD"`) {
+		t.Fatalf("Expected the corrupt block in the recovery errors, got %+v", rerrs)
+	}
+}
+
+func TestJetStreamEnableRollback(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-rollback-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	// Request more than the server will have so enabling the global account fails.
+	gacc := s.GlobalAccount()
+	limits := &JetStreamAccountLimits{MaxMemory: 2 * 1024 * 1024, MaxStore: 1024 * 1024, MaxStreams: -1, MaxConsumers: -1}
+	if err := gacc.EnableJetStream(limits); err != ErrJetStreamNotEnabled {
+		t.Fatalf("Expected not enabled error while the request is held, got %v", err)
+	}
+	config := &JetStreamConfig{MaxMemory: 1024 * 1024, MaxStore: 1024 * 1024, StoreDir: sd}
+	if err := s.EnableJetStream(config); err == nil {
+		t.Fatalf("Expected an error enabling JetStream")
+	}
+
+	// We should be cleanly disabled.
+	if s.JetStreamEnabled() || s.getJetStream() != nil {
+		t.Fatalf("Expected JetStream to be disabled")
+	}
+	if gacc.JetStreamEnabled() {
+		t.Fatalf("Expected JetStream to be disabled for the global account")
+	}
+	if sacc := s.SystemAccount(); sacc.IsExportService(JSApiAccountInfo) {
+		t.Fatalf("Expected JetStream exports to be removed")
+	}
+	gacc.mu.RLock()
+	pending := gacc.jsLimits
+	gacc.mu.RUnlock()
+	if pending == nil || *pending != *limits {
+		t.Fatalf("Expected requested limits to be restored, got %+v", pending)
+	}
+
+	// Lower the request and we should be able to enable again.
+	limits.MaxMemory = 1024 * 1024
+	if err := gacc.EnableJetStream(limits); err != ErrJetStreamNotEnabled {
+		t.Fatalf("Expected not enabled error while the request is held, got %v", err)
+	}
+	if err := s.EnableJetStream(config); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !gacc.JetStreamEnabled() {
+		t.Fatalf("Expected JetStream to be enabled for the global account")
+	}
+}
+
+func TestJetStreamRecoverSingleStream(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-recover-stream-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	acc := s.GlobalAccount()
+	mset, err := acc.AddStream(&StreamConfig{Name: "S", Storage: FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	if _, err := mset.AddConsumer(&ConsumerConfig{Durable: "D", AckPolicy: AckExplicit}); err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	for i := 0; i < 10; i++ {
+		if _, err := nc.Request("S", []byte("Hello World"), time.Second); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	nc.Close()
+	s.Shutdown()
+
+	// Take a backup of the stream's directory.
+	sdir := filepath.Join(sd, JetStreamStoreDir, globalAccountName, streamsDir, "S")
+	bdir := filepath.Join(sd, "backup")
+	copyDir := func(src, dst string) {
+		t.Helper()
+		err := filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(src, p)
+			if fi.IsDir() {
+				return os.MkdirAll(filepath.Join(dst, rel), 0755)
+			}
+			buf, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			return ioutil.WriteFile(filepath.Join(dst, rel), buf, fi.Mode())
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error copying %q: %v", src, err)
+		}
+	}
+	copyDir(sdir, bdir)
+
+	s = RunServer(o)
+	defer s.Shutdown()
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	acc = s.GlobalAccount()
+	if err := acc.RecoverStream("S"); err != ErrJetStreamStreamAlreadyUsed {
+		t.Fatalf("Expected an error for a live stream, got %v", err)
+	}
+	if mset, err = acc.LookupStream("S"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mset.Delete()
+	if err := acc.RecoverStream("S"); err == nil {
+		t.Fatalf("Expected an error when the stream directory is gone")
+	}
+
+	// Put the backup in place and recover just that stream.
+	copyDir(bdir, sdir)
+	if err := acc.RecoverStream("S"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if mset, err = acc.LookupStream("S"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if state := mset.State(); state.Msgs != 10 {
+		t.Fatalf("Expected 10 msgs, got %d", state.Msgs)
+	}
+	if mset.LookupConsumer("D") == nil {
+		t.Fatalf("Expected the consumer to be recovered")
+	}
+}
+
+func TestJetStreamStoreOnDisk(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-store-usage-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mset, err := s.GlobalAccount().AddStream(&StreamConfig{Name: "S", Storage: FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	if _, err := mset.AddConsumer(&ConsumerConfig{Durable: "D", AckPolicy: AckExplicit}); err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	for i := 0; i < 100; i++ {
+		if _, err := nc.Request("S", []byte("Hello World"), time.Second); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	nc.Close()
+	used := s.GlobalAccount().JetStreamUsage().Store
+	s.Shutdown()
+
+	s = RunServer(o)
+	defer s.Shutdown()
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	acc := s.GlobalAccount()
+
+	var actual int64
+	adir := filepath.Join(sd, JetStreamStoreDir, globalAccountName)
+	filepath.Walk(adir, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			actual += int64(fi.Size())
+		}
+		return nil
+	})
+	if actual == 0 {
+		t.Fatalf("Expected files to be stored under %q", adir)
+	}
+	if onDisk, err := acc.JetStreamStoreOnDisk(); err != nil || int64(onDisk) != actual {
+		t.Fatalf("Expected %d bytes on disk, got %d: %v", actual, onDisk, err)
+	}
+	// Store usage only counts messages, so it is the same as before the restart.
+	if stats := acc.JetStreamUsage(); stats.Store != used {
+		t.Fatalf("Expected store usage to be %d, got %d", used, stats.Store)
+	}
+
+	// And all of it is given back once the stream is gone.
+	mset, err = acc.LookupStream("S")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := mset.Delete(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stats := acc.JetStreamUsage(); stats.Store != 0 {
+		t.Fatalf("Expected no store usage, got %d", stats.Store)
+	}
+}
+
+func TestJetStreamOverReservedAccounts(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-over-reserved-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if accts := s.JetStreamOverReservedAccounts(); accts != nil {
+		t.Fatalf("Expected no accounts without JetStream, got %v", accts)
+	}
+
+	foo, _ := s.LookupOrRegisterAccount("FOO")
+	bar, _ := s.LookupOrRegisterAccount("BAR")
+	if err := s.EnableJetStream(&JetStreamConfig{MaxMemory: 64 * 1024, MaxStore: 64 * 1024, StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	limits := &JetStreamAccountLimits{MaxMemory: 16 * 1024, MaxStore: 24 * 1024, MaxStreams: -1, MaxConsumers: -1}
+	for _, acc := range []*Account{foo, bar} {
+		if err := acc.EnableJetStream(limits); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if accts := s.JetStreamOverReservedAccounts(); len(accts) != 0 {
+		t.Fatalf("Expected no over reserved accounts, got %v", accts)
+	}
+
+	// Lower the server limits below what has been reserved.
+	js := s.getJetStream()
+	js.mu.Lock()
+	js.config.MaxStore = 32 * 1024
+	js.mu.Unlock()
+
+	accts := s.JetStreamOverReservedAccounts()
+	if len(accts) != 1 || accts[0] != foo {
+		t.Fatalf("Expected account FOO to be over reserved, got %v", accts)
+	}
+}
+
+func TestJetStreamAccountReservations(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-acc-reservations-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if r := s.JetStreamAccountReservations(); r != nil {
+		t.Fatalf("Expected no reservations without JetStream, got %v", r)
+	}
+
+	foo, _ := s.LookupOrRegisterAccount("FOO")
+	bar, _ := s.LookupOrRegisterAccount("BAR")
+	if err := s.EnableJetStream(&JetStreamConfig{MaxMemory: 64 * 1024, MaxStore: 64 * 1024, StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := foo.EnableJetStream(&JetStreamAccountLimits{MaxMemory: 16 * 1024, MaxStore: 24 * 1024, MaxStreams: -1, MaxConsumers: -1}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := bar.EnableJetStream(&JetStreamAccountLimits{MaxMemory: -1, MaxStore: 8 * 1024, MaxStreams: -1, MaxConsumers: -1}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	r := s.JetStreamAccountReservations()
+	if l := r["FOO"]; l.MaxMemory != 16*1024 || l.MaxStore != 24*1024 {
+		t.Fatalf("Unexpected reservation for FOO: %+v", l)
+	}
+	if l := r["BAR"]; l.MaxMemory != 0 || l.MaxStore != 8*1024 {
+		t.Fatalf("Unexpected reservation for BAR: %+v", l)
+	}
+	var mem, store int64
+	for _, l := range r {
+		mem, store = mem+l.MaxMemory, store+l.MaxStore
+	}
+	if rm, rs, _ := s.JetStreamReservedResources(); rm != mem || rs != store {
+		t.Fatalf("Expected reservations to add up to %d and %d, got %d and %d", rm, rs, mem, store)
+	}
+}
+
+func TestJetStreamFriendlyBytesFastPath(t *testing.T) {
+	sizes := []int64{-1024, -1, 0, 1, 512, 1023, 1024, 1025, 4096, 1 << 20, 1<<20 + 1, 3 << 30, 1 << 40, 1 << 50, 1 << 60, math.MaxInt64}
+	for i := 0; i < 1024; i++ {
+		sizes = append(sizes, int64(i))
+	}
+	for _, n := range sizes {
+		if got, want := FriendlyBytes(n), friendlyBytes(n); got != want {
+			t.Fatalf("Expected %q for %d, got %q", want, n, got)
+		}
+	}
+}
+
+func BenchmarkFriendlyBytes(b *testing.B) {
+	sizes := []int64{512, 1024, 1 << 20, 1 << 30, 1 << 40, 3 << 30, 1234567}
+	for _, n := range sizes {
+		b.Run(strconv.FormatInt(n, 10), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				FriendlyBytes(n)
+			}
+		})
+	}
+}
+
+func TestJetStreamMoveStoreDir(t *testing.T) {
+	for _, crossDevice := range []bool{false, true} {
+		t.Run(fmt.Sprintf("CrossDevice=%v", crossDevice), func(t *testing.T) {
+			if crossDevice {
+				storeDirRename = func(_, _ string) error { return fmt.Errorf("cross-device link") }
+				defer func() { storeDirRename = os.Rename }()
+			}
+			sd, err := ioutil.TempDir("", "js-move-store-")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer os.RemoveAll(sd)
+
+			o := DefaultOptions()
+			o.Cluster.Port = 0
+			s := RunServer(o)
+			defer s.Shutdown()
+
+			if err := s.EnableJetStream(&JetStreamConfig{StoreDir: filepath.Join(sd, "js")}); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			acc := s.GlobalAccount()
+			mset, err := acc.AddStream(&StreamConfig{Name: "S", Storage: FileStorage})
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			if _, err := mset.AddConsumer(&ConsumerConfig{Durable: "D", AckPolicy: AckExplicit}); err != nil {
+				t.Fatalf("Unexpected error adding consumer: %v", err)
+			}
+			nc := natsConnect(t, s.ClientURL())
+			defer nc.Close()
+			send := func(n int) {
+				t.Helper()
+				for i := 0; i < n; i++ {
+					if _, err := nc.Request("S", []byte("Hello World"), time.Second); err != nil {
+						t.Fatalf("Unexpected error: %v", err)
+					}
+				}
+			}
+			checkStream := func(msgs uint64) {
+				t.Helper()
+				mset, err := acc.LookupStream("S")
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if state := mset.State(); state.Msgs != msgs {
+					t.Fatalf("Expected %d msgs, got %d", msgs, state.Msgs)
+				}
+				if mset.LookupConsumer("D") == nil {
+					t.Fatalf("Expected the consumer to exist")
+				}
+			}
+			send(10)
+
+			// A failed move leaves everything in place.
+			blocker := filepath.Join(sd, "file")
+			ioutil.WriteFile(blocker, nil, 0644)
+			if err := acc.MoveJetStreamStoreDir(filepath.Join(blocker, "moved")); err == nil {
+				t.Fatalf("Expected an error moving below a file")
+			}
+			checkStream(10)
+
+			// Publishes and API requests are held while the data is moved.
+			rename := storeDirRename
+			held := make(chan error, 2)
+			storeDirRename = func(src, dst string) error {
+				go func() {
+					_, err := nc.Request("S", []byte("Hello World"), 5*time.Second)
+					held <- err
+				}()
+				go func() {
+					_, err := nc.Request(fmt.Sprintf(JSApiStreamInfoT, "S"), nil, 5*time.Second)
+					held <- err
+				}()
+				time.Sleep(100 * time.Millisecond)
+				return rename(src, dst)
+			}
+			ndir := filepath.Join(sd, "volume", "acc")
+			err = acc.MoveJetStreamStoreDir(ndir)
+			storeDirRename = rename
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			for i := 0; i < 2; i++ {
+				if err := <-held; err != nil {
+					t.Fatalf("Unexpected error for a request held during the move: %v", err)
+				}
+			}
+			checkStream(11)
+			if mset2, _ := acc.LookupStream("S"); mset2 != mset {
+				t.Fatalf("Expected the stream to be paused, not recreated")
+			}
+			send(5)
+			checkStream(16)
+
+			link := filepath.Join(sd, "js", JetStreamStoreDir, globalAccountName)
+			if rdir, err := filepath.EvalSymlinks(link); err != nil || rdir != ndir {
+				t.Fatalf("Expected %q to resolve to %q, got %q: %v", link, ndir, rdir, err)
+			}
+			if _, err := os.Stat(filepath.Join(ndir, streamsDir, "S", JetStreamMetaFile)); err != nil {
+				t.Fatalf("Expected stream data in the new location: %v", err)
+			}
+		})
+	}
+}
+
+func TestJetStreamOverLimitPolicy(t *testing.T) {
+	omb := jsOverLimitMaxBlock
+	jsOverLimitMaxBlock = 250 * time.Millisecond
+	defer func() { jsOverLimitMaxBlock = omb }()
+
+	for _, policy := range []OverLimitPolicy{OverLimitReject, OverLimitBlock, OverLimitDiscardOld} {
+		t.Run(policy.String(), func(t *testing.T) {
+			o := DefaultOptions()
+			o.Cluster.Port = 0
+			s := RunServer(o)
+			defer s.Shutdown()
+
+			sd, err := ioutil.TempDir("", "js-over-limit-")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer os.RemoveAll(sd)
+			if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			acc := s.GlobalAccount()
+			limits := &JetStreamAccountLimits{MaxMemory: 1024, MaxStore: -1, MaxStreams: -1, MaxConsumers: -1, OverLimitPolicy: policy}
+			if err := acc.UpdateJetStreamLimits(limits); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			mset, err := acc.AddStream(&StreamConfig{Name: "S", Storage: MemoryStorage})
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+
+			nc := natsConnect(t, s.ClientURL())
+			defer nc.Close()
+			publish := func() error {
+				resp, err := nc.Request("S", bytes.Repeat([]byte("Z"), 100), 5*time.Second)
+				if err != nil {
+					return err
+				}
+				var pa JSPubAckResponse
+				json.Unmarshal(resp.Data, &pa)
+				if pa.Error != nil {
+					return fmt.Errorf(pa.Error.Description)
+				}
+				return nil
+			}
+
+			// Fill up the account.
+			sent := 0
+			for ; sent < 20; sent++ {
+				if err := publish(); err != nil {
+					break
+				}
+			}
+			state := mset.State()
+			switch policy {
+			case OverLimitReject:
+				if sent == 20 || state.Msgs != uint64(sent) {
+					t.Fatalf("Expected messages to be rejected at the limit, sent %d, stored %d", sent, state.Msgs)
+				}
+			case OverLimitBlock:
+				if sent == 20 {
+					t.Fatalf("Expected messages to be rejected once blocking timed out")
+				}
+				// Free up space while a publish is held.
+				errCh := make(chan error, 1)
+				go func() { errCh <- publish() }()
+				time.Sleep(50 * time.Millisecond)
+				// The held publish must not block the connection.
+				if err := nc.FlushTimeout(50 * time.Millisecond); err != nil {
+					t.Fatalf("Expected the connection to not be blocked, got %v", err)
+				}
+				for seq := uint64(1); seq <= 3; seq++ {
+					mset.RemoveMsg(seq)
+				}
+				if err := <-errCh; err != nil {
+					t.Fatalf("Expected blocked publish to succeed, got %v", err)
+				}
+				// Rejected messages were never stored, so no sequence gaps.
+				if state := mset.State(); state.Msgs != uint64(sent-3+1) || state.LastSeq != uint64(sent+1) {
+					t.Fatalf("Expected %d msgs and last sequence %d, got %+v", sent-3+1, sent+1, state)
+				}
+			case OverLimitDiscardOld:
+				if sent != 20 {
+					t.Fatalf("Expected all messages to be accepted, sent %d", sent)
+				}
+				if state.Msgs == 20 || state.LastSeq != 20 || state.FirstSeq == 1 {
+					t.Fatalf("Expected the oldest messages to be discarded, got %+v", state)
+				}
+				if stats := acc.JetStreamUsage(); stats.Memory > 1024 {
+					t.Fatalf("Expected usage within limits, got %d", stats.Memory)
+				}
+				// Another stream putting the account over its limits is not
+				// made up for by discarding from this one.
+				other, err := acc.AddStream(&StreamConfig{Name: "O", Storage: MemoryStorage})
+				if err != nil {
+					t.Fatalf("Unexpected error adding stream: %v", err)
+				}
+				before := mset.State()
+				other.store.StoreMsg("O", nil, bytes.Repeat([]byte("Z"), 1024))
+				other.flushUsage()
+				if err := publish(); err == nil {
+					t.Fatalf("Expected the publish to be rejected")
+				}
+				if state := mset.State(); state.FirstSeq != before.FirstSeq {
+					t.Fatalf("Expected no messages to be discarded, first sequence went from %d to %d", before.FirstSeq, state.FirstSeq)
+				}
+			}
+		})
+	}
+}
+
+func TestJetStreamStreamDirCollision(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-dir-collision-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	acc := s.GlobalAccount()
+	if _, err := acc.AddStream(&StreamConfig{Name: "orders", Storage: FileStorage}); err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	// These would share a directory on case insensitive filesystems.
+	if _, err := acc.AddStream(&StreamConfig{Name: "ORDERS", Storage: FileStorage}); err == nil || !strings.Contains(err.Error(), `"orders"`) {
+		t.Fatalf("Expected a collision error naming both streams, got %v", err)
+	}
+	s.Shutdown()
+
+	// Leave the stream's data in a directory named after another stream.
+	sdir := filepath.Join(sd, JetStreamStoreDir, globalAccountName, streamsDir)
+	if err := os.Rename(filepath.Join(sdir, "orders"), filepath.Join(sdir, "sales")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	s = RunServer(o)
+	defer s.Shutdown()
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	acc = s.GlobalAccount()
+	_, err = acc.AddStream(&StreamConfig{Name: "sales", Storage: FileStorage})
+	if err == nil || !strings.Contains(err.Error(), `"sales"`) || !strings.Contains(err.Error(), `"orders"`) {
+		t.Fatalf("Expected a collision error naming both streams, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(sdir, "sales", JetStreamMetaFile)); err != nil {
+		t.Fatalf("Expected the existing data to be left alone: %v", err)
+	}
+	s.Shutdown()
+
+	// Memory only servers have no directories, so nothing on disk can collide,
+	// not even relative to the working directory.
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := os.Chdir(filepath.Dir(sdir)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.Chdir(cwd)
+	s = RunServer(o)
+	defer s.Shutdown()
+	if err := s.EnableJetStream(&JetStreamConfig{MemoryOnly: true, MaxMemory: 64 * 1024 * 1024}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := s.GlobalAccount().AddStream(&StreamConfig{Name: "sales", Storage: MemoryStorage}); err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+}
+
+func TestJetStreamStoreDirProbeTimeout(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-probe-timeout-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	// Simulate a hung filesystem.
+	hang := make(chan struct{})
+	defer close(hang)
+	probe := storeDirProbe
+	storeDirProbe = func(dir string) (string, error) {
+		<-hang
+		return probe(dir)
+	}
+	defer func() { storeDirProbe = probe }()
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	start := time.Now()
+	err = s.EnableJetStream(&JetStreamConfig{StoreDir: sd, StoreDirProbeTimeout: 50 * time.Millisecond})
+	if err == nil || !strings.Contains(err.Error(), "storage directory probe timed out") {
+		t.Fatalf("Expected a probe timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected to fail fast, took %v", elapsed)
+	}
+	if s.JetStreamEnabled() {
+		t.Fatalf("Expected JetStream to not be enabled")
+	}
+
+	// A responsive filesystem is not affected.
+	storeDirProbe = probe
+	if err := s.EnableJetStream(&JetStreamConfig{StoreDir: sd, StoreDirProbeTimeout: 50 * time.Millisecond}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestJetStreamRebalanceReservations(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-rebalance-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	var accs []*Account
+	for i := 0; i < 5; i++ {
+		acc, _ := s.LookupOrRegisterAccount(fmt.Sprintf("A%d", i))
+		accs = append(accs, acc)
+	}
+	maxBytes := int64(64 * 1024 * 1024)
+	if err := s.EnableJetStream(&JetStreamConfig{MaxMemory: maxBytes, MaxStore: maxBytes, StoreDir: sd}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	js := s.getJetStream()
+
+	checkRollup := func(op string) {
+		t.Helper()
+		var mem, store int64
+		for _, acc := range accs {
+			if limits, ok := acc.JetStreamLimits(); ok {
+				mem += limits.MaxMemory
+				store += limits.MaxStore
+			}
+		}
+		js.mu.RLock()
+		memReserved, storeReserved := js.memReserved, js.storeReserved
+		js.mu.RUnlock()
+		if memReserved != mem || storeReserved != store {
+			t.Fatalf("After %s expected reservations of %d/%d, got %d/%d", op, mem, store, memReserved, storeReserved)
+		}
+	}
+
+	randLimits := func() *JetStreamAccountLimits {
+		return &JetStreamAccountLimits{
+			MaxMemory:    int64(rand.Intn(4*1024*1024) + 1),
+			MaxStore:     int64(rand.Intn(4*1024*1024) + 1),
+			MaxStreams:   -1,
+			MaxConsumers: -1,
+		}
+	}
+
+	rand.Seed(time.Now().UnixNano())
+	for i := 0; i < 500; i++ {
+		acc := accs[rand.Intn(len(accs))]
+		switch op := rand.Intn(4); op {
+		case 0:
+			acc.EnableJetStream(randLimits())
+			checkRollup("enable")
+		case 1:
+			acc.DisableJetStream()
+			checkRollup("disable")
+		case 2:
+			acc.UpdateJetStreamLimits(randLimits())
+			checkRollup("update")
+		case 3:
+			cfg := s.JetStreamConfig()
+			cfg.MaxMemory = maxBytes + int64(rand.Intn(1024))
+			if err := js.applyConfig(*cfg); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			checkRollup("reload")
+		}
+	}
+}
+
+func TestJetStreamUsageBatching(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-usage-batch-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	s := RunServer(o)
+	defer s.Shutdown()
+	if err := s.EnableJetStream(&JetStreamConfig{
+		MaxMemory:          64 * 1024 * 1024,
+		MaxStore:           64 * 1024 * 1024,
+		StoreDir:           sd,
+		UsageBatchSize:     64 * 1024,
+		UsageBatchInterval: time.Hour,
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	acc := s.GlobalAccount()
+	mset, err := acc.AddStream(&StreamConfig{Name: "B", Storage: MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+
+	// Small changes are held by the stream.
+	msg := make([]byte, 1024)
+	mset.store.StoreMsg("B", nil, msg)
+	if used := acc.JetStreamUsage().Memory; used != 0 {
+		t.Fatalf("Expected usage to be batched, got %d", used)
+	}
+	// Until enough has been collected.
+	for i := 0; i < 64; i++ {
+		mset.store.StoreMsg("B", nil, msg)
+	}
+	state := mset.State()
+	if used := acc.JetStreamUsage().Memory; used == 0 || used > state.Bytes {
+		t.Fatalf("Expected batched usage to be applied, got %d of %d", used, state.Bytes)
+	}
+
+	// Near the limit the batched usage is taken into account.
+	limits, _ := acc.JetStreamLimits()
+	limits.MaxMemory = int64(state.Bytes) + 512
+	if err := acc.UpdateJetStreamLimits(&limits); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mset.store.StoreMsg("B", nil, msg)
+	if !mset.jsa.limitsExceeded(MemoryStorage) {
+		t.Fatalf("Expected limits to be exceeded")
+	}
+	if used, state := acc.JetStreamUsage().Memory, mset.State(); used != state.Bytes {
+		t.Fatalf("Expected all usage to be applied, got %d of %d", used, state.Bytes)
+	}
+
+	// Deleting the stream releases everything.
+	mset.store.StoreMsg("B", nil, msg)
+	if err := mset.Delete(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if used := acc.JetStreamUsage().Memory; used != 0 {
+		t.Fatalf("Expected no usage after delete, got %d", used)
+	}
+}
+
+func BenchmarkJetStreamUsageBatching(b *testing.B) {
+	for _, bc := range []struct {
+		name  string
+		batch int64
+	}{
+		{"PerMessage", 0},
+		{"Batched", 64 * 1024},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			sd, _ := ioutil.TempDir("", "js-usage-batch-")
+			defer os.RemoveAll(sd)
+
+			o := DefaultOptions()
+			o.Cluster.Port = 0
+			o.NoLog = true
+			s := RunServer(o)
+			defer s.Shutdown()
+			if err := s.EnableJetStream(&JetStreamConfig{MaxMemory: 1 << 40, MaxStore: 1 << 40, StoreDir: sd, UsageBatchSize: bc.batch}); err != nil {
+				b.Fatalf("Unexpected error: %v", err)
+			}
+			acc := s.GlobalAccount()
+			var msets []*Stream
+			for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+				name := fmt.Sprintf("S%d", i)
+				mset, err := acc.AddStream(&StreamConfig{Name: name, Storage: MemoryStorage, MaxMsgs: 1000})
+				if err != nil {
+					b.Fatalf("Unexpected error adding stream: %v", err)
+				}
+				msets = append(msets, mset)
+			}
+
+			var next int32
+			msg := make([]byte, 128)
+			b.SetBytes(int64(len(msg)))
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				mset := msets[int(atomic.AddInt32(&next, 1)-1)%len(msets)]
+				for pb.Next() {
+					mset.store.StoreMsg("foo", nil, msg)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkJetStreamUsageContention(b *testing.B) {
+	const numStreams = 16
+
+	sd, _ := ioutil.TempDir("", "js-usage-contention-")
+	defer os.RemoveAll(sd)
+
+	o := DefaultOptions()
+	o.Cluster.Port = 0
+	o.NoLog = true
+	s := RunServer(o)
+	defer s.Shutdown()
+	if err := s.EnableJetStream(&JetStreamConfig{MaxMemory: 1 << 30, MaxStore: 1 << 30, StoreDir: sd}); err != nil {
+		b.Fatalf("Unexpected error: %v", err)
+	}
+	acc := s.GlobalAccount()
+	var msets []*Stream
+	for i := 0; i < numStreams; i++ {
+		name := fmt.Sprintf("S%d", i)
+		mset, err := acc.AddStream(&StreamConfig{Name: name, Storage: MemoryStorage, MaxMsgs: 1000})
+		if err != nil {
+			b.Fatalf("Unexpected error adding stream: %v", err)
+		}
+		msets = append(msets, mset)
+	}
+	jsa := msets[0].jsa
+
+	// At least one writer per stream, all updating the same account.
+	if procs := runtime.GOMAXPROCS(0); procs < numStreams {
+		b.SetParallelism((numStreams + procs - 1) / procs)
+	}
+	var next int32
+	msg := make([]byte, 128)
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		mset := msets[int(atomic.AddInt32(&next, 1)-1)%len(msets)]
+		for pb.Next() {
+			mset.store.StoreMsg("foo", nil, msg)
+			jsa.limitsExceeded(MemoryStorage)
+		}
+	})
+}
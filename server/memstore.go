@@ -30,6 +30,8 @@ type memStore struct {
 	dmap      map[uint64]struct{}
 	scb       StorageUpdateHandler
 	ageChk    *time.Timer
+	ttls      msgTTLs
+	clock     *storeClock
 	consumers int
 }
 
@@ -48,7 +50,15 @@ func newMemStore(cfg *StreamConfig) (*memStore, error) {
 	if cfg.Storage != MemoryStorage {
 		return nil, fmt.Errorf("memStore requires memory storage type in config")
 	}
-	return &memStore{msgs: make(map[uint64]*storedMsg), dmap: make(map[uint64]struct{}), cfg: *cfg}, nil
+	clock := jsClock
+	ms := &memStore{
+		msgs:  make(map[uint64]*storedMsg),
+		dmap:  make(map[uint64]struct{}),
+		cfg:   *cfg,
+		ttls:  msgTTLs{clock: clock},
+		clock: clock,
+	}
+	return ms, nil
 }
 
 func (ms *memStore) UpdateConfig(cfg *StreamConfig) error {
@@ -61,6 +71,16 @@ func (ms *memStore) UpdateConfig(cfg *StreamConfig) error {
 
 	ms.mu.Lock()
 	ms.cfg = *cfg
+	// Sealed streams never remove messages, so no limits or timers.
+	if cfg.Sealed {
+		if ms.ageChk != nil {
+			ms.ageChk.Stop()
+			ms.ageChk = nil
+		}
+		ms.ttls.stop()
+		ms.mu.Unlock()
+		return nil
+	}
 	// Limits checks and enforcement.
 	ms.enforceMsgLimit()
 	ms.enforceBytesLimit()
@@ -127,6 +147,8 @@ func (ms *memStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts int
 	if ms.ageChk == nil && ms.cfg.MaxAge != 0 {
 		ms.startAgeChk()
 	}
+	// Messages can also carry their own TTL.
+	ms.ttls.track(seq, ts, hdr, ms.expireMsgTTLs)
 
 	return nil
 }
@@ -148,7 +170,7 @@ func (ms *memStore) StoreRawMsg(subj string, hdr, msg []byte, seq uint64, ts int
 // Store stores a message.
 func (ms *memStore) StoreMsg(subj string, hdr, msg []byte) (uint64, int64, error) {
 	ms.mu.Lock()
-	seq, ts := ms.state.LastSeq+1, time.Now().UnixNano()
+	seq, ts := ms.state.LastSeq+1, wallClock()
 	err := ms.storeRawMsg(subj, hdr, msg, seq, ts)
 	cb := ms.scb
 	ms.mu.Unlock()
@@ -250,7 +272,10 @@ func (ms *memStore) expireMsgs() {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 
-	now := time.Now().UnixNano()
+	if ms.cfg.Sealed {
+		return
+	}
+	now := ms.clock.now()
 	minAge := now - int64(ms.cfg.MaxAge)
 	for {
 		if sm, ok := ms.msgs[ms.state.FirstSeq]; ok && sm.ts <= minAge {
@@ -262,7 +287,7 @@ func (ms *memStore) expireMsgs() {
 					ms.ageChk = nil
 				}
 			} else {
-				fireIn := time.Duration(sm.ts-now) + ms.cfg.MaxAge
+				fireIn := ageCheckIn(sm.ts, now, ms.cfg.MaxAge)
 				if ms.ageChk != nil {
 					ms.ageChk.Reset(fireIn)
 				} else {
@@ -274,6 +299,45 @@ func (ms *memStore) expireMsgs() {
 	}
 }
 
+// Will expire msgs whose own TTL has elapsed.
+func (ms *memStore) expireMsgTTLs() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.msgs == nil || ms.cfg.Sealed {
+		return
+	}
+	for _, seq := range ms.ttls.expired(ms.clock.now()) {
+		ms.removeMsg(seq, false)
+	}
+	ms.ttls.reset(ms.expireMsgTTLs)
+}
+
+// Recomputes the state of the store from the messages it holds.
+// There is nothing to compact or checksum for memory based streams.
+func (ms *memStore) maintain(rep *MaintenanceReport) error {
+	ms.mu.Lock()
+	var bytes uint64
+	for _, sm := range ms.msgs {
+		bytes += memStoreMsgSize(sm.subj, sm.hdr, sm.msg)
+	}
+	msgs := uint64(len(ms.msgs))
+	var md, bd int64
+	if msgs != ms.state.Msgs || bytes != ms.state.Bytes {
+		rep.Anomalies = append(rep.Anomalies, fmt.Sprintf("stream state had %d msgs and %d bytes, but holds %d msgs and %d bytes",
+			ms.state.Msgs, ms.state.Bytes, msgs, bytes))
+		md, bd = int64(msgs)-int64(ms.state.Msgs), int64(bytes)-int64(ms.state.Bytes)
+		ms.state.Msgs, ms.state.Bytes = msgs, bytes
+	}
+	cb := ms.scb
+	ms.mu.Unlock()
+
+	if cb != nil && (md != 0 || bd != 0) {
+		cb(md, bd, 0, _EMPTY_)
+	}
+	return nil
+}
+
 // Purge will remove all messages from this store.
 // Will return the number of purged messages.
 func (ms *memStore) Purge() (uint64, error) {
@@ -364,7 +428,7 @@ func (ms *memStore) Truncate(seq uint64) error {
 		if sm := ms.msgs[i]; sm != nil {
 			purged++
 			bytes += memStoreMsgSize(sm.subj, sm.hdr, sm.msg)
-			delete(ms.msgs, seq)
+			delete(ms.msgs, i)
 		} else {
 			delete(ms.dmap, i)
 		}
@@ -525,6 +589,7 @@ func (ms *memStore) Stop() error {
 		ms.ageChk.Stop()
 		ms.ageChk = nil
 	}
+	ms.ttls.stop()
 	ms.msgs = nil
 	ms.mu.Unlock()
 	return nil
@@ -585,3 +650,6 @@ func newTemplateMemStore() *templateMemStore {
 // No-ops for memstore.
 func (ts *templateMemStore) Store(t *StreamTemplate) error  { return nil }
 func (ts *templateMemStore) Delete(t *StreamTemplate) error { return nil }
+func (ts *templateMemStore) Size(t *StreamTemplate) (int64, error) {
+	return 0, nil
+}
@@ -17,6 +17,7 @@ import (
 	"bytes"
 	"fmt"
 	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -390,3 +391,84 @@ func TestMemStoreStreamTruncate(t *testing.T) {
 		t.Fatalf("Expected deleted to be %+v, got %+v\n", expected, state.Deleted)
 	}
 }
+
+func TestMemStoreClockJump(t *testing.T) {
+	maxAge := 250 * time.Millisecond
+	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage, MaxAge: maxAge})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+	defer ms.Stop()
+
+	defer func(wc func() int64, rb time.Duration) { wallClock, clockRebaseAfter = wc, rb }(wallClock, clockRebaseAfter)
+	clockRebaseAfter = time.Hour
+	jump := func(d time.Duration) {
+		wallClock = func() int64 { return time.Now().Add(d).UnixNano() }
+	}
+
+	var warnings int32
+	ms.mu.Lock()
+	ms.clock = newStoreClock()
+	ms.clock.setWarnf(func(format string, v ...interface{}) { atomic.AddInt32(&warnings, 1) })
+	ms.ttls.clock = ms.clock
+	ms.mu.Unlock()
+
+	checkWarnings := func(expected int32) {
+		t.Helper()
+		if n := atomic.LoadInt32(&warnings); n != expected {
+			t.Fatalf("Expected %d clock warnings, got %d", expected, n)
+		}
+	}
+	checkMsgs := func(expected uint64) {
+		t.Helper()
+		checkFor(t, 2*time.Second, 10*time.Millisecond, func() error {
+			if state := ms.State(); state.Msgs != expected {
+				return fmt.Errorf("Expected %d msgs, got %d", expected, state.Msgs)
+			}
+			return nil
+		})
+	}
+
+	subj, msg := "foo", []byte("Hello World")
+	for i := 0; i < 10; i++ {
+		ms.StoreMsg(subj, nil, msg)
+	}
+
+	// A forward jump should not expire everything at once.
+	jump(time.Hour)
+	ms.expireMsgs()
+	if state := ms.State(); state.Msgs != 10 {
+		t.Fatalf("Expected no msgs to be expired after a clock jump, got %d", state.Msgs)
+	}
+	checkWarnings(1)
+	checkMsgs(0)
+
+	// Messages are still stamped with the wall clock.
+	_, ts, _ := ms.StoreMsg(subj, nil, msg)
+	if d := time.Duration(wallClock() - ts); d < -time.Second || d > time.Second {
+		t.Fatalf("Expected the message to be stamped with the wall clock, off by %v", d)
+	}
+
+	// Once the jump persisted, expiry follows the wall clock again.
+	clockRebaseAfter = 0
+	if d := time.Duration(wallClock() - ms.clock.now()); d < -time.Second || d > time.Second {
+		t.Fatalf("Expected the clock to follow the wall clock, off by %v", d)
+	}
+	checkWarnings(2)
+	checkMsgs(0)
+
+	// Going backwards should not expire the new messages early.
+	clockRebaseAfter = time.Hour
+	for i := 0; i < 10; i++ {
+		ms.StoreMsg(subj, nil, msg)
+	}
+	jump(-time.Hour)
+	for i := 0; i < 10; i++ {
+		ms.StoreMsg(subj, nil, msg)
+	}
+	ms.expireMsgs()
+	if state := ms.State(); state.Msgs != 20 {
+		t.Fatalf("Expected no msgs to be expired after a clock jump, got %d", state.Msgs)
+	}
+	checkWarnings(3)
+}
@@ -247,6 +247,10 @@ type Options struct {
 	// that this applies to reconnect events.
 	ReconnectErrorReports int
 
+	// Tags describe this server, e.g. its rack or zone, and are used to place
+	// clustered stream replicas.
+	Tags []string `json:"-"`
+
 	// private fields, used to know if bool options are explicitly
 	// defined in config and/or command line params.
 	inConfig  map[string]bool
@@ -634,6 +638,8 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 		o.Port = int(v.(int64))
 	case "server_name":
 		o.ServerName = v.(string)
+	case "server_tags":
+		o.Tags, _ = parseStringArray("server tags", tk, &lt, v, errors, warnings)
 	case "host", "net":
 		o.Host = v.(string)
 	case "debug":
@@ -1357,7 +1363,7 @@ func parseGateway(v interface{}, o *Options, errors *[]error, warnings *[]error)
 	return nil
 }
 
-var dynamicJSAccountLimits = &JetStreamAccountLimits{-1, -1, -1, -1}
+var dynamicJSAccountLimits = &JetStreamAccountLimits{MaxMemory: -1, MaxStore: -1, MaxStreams: -1, MaxConsumers: -1}
 
 // Parses jetstream account limits for an account. Simple setup with boolen is allowed, and we will
 // use dynamic account limits.
@@ -1382,7 +1388,7 @@ func parseJetStreamForAccount(v interface{}, acc *Account, errors *[]error, warn
 			return &configErr{tk, fmt.Sprintf("Expected 'enabled' or 'disabled' for string value, got '%s'", vv)}
 		}
 	case map[string]interface{}:
-		jsLimits := &JetStreamAccountLimits{-1, -1, -1, -1}
+		jsLimits := &JetStreamAccountLimits{MaxMemory: -1, MaxStore: -1, MaxStreams: -1, MaxConsumers: -1}
 		for mk, mv := range vv {
 			tk, mv = unwrapValue(mv, &lt)
 			switch strings.ToLower(mk) {
@@ -1398,6 +1404,18 @@ func parseJetStreamForAccount(v interface{}, acc *Account, errors *[]error, warn
 					return &configErr{tk, fmt.Sprintf("Expected a parseable size for %q, got %v", mk, mv)}
 				}
 				jsLimits.MaxStore = int64(vv)
+			case "max_memory_hard":
+				vv, ok := mv.(int64)
+				if !ok {
+					return &configErr{tk, fmt.Sprintf("Expected a parseable size for %q, got %v", mk, mv)}
+				}
+				jsLimits.MaxMemoryHard = int64(vv)
+			case "max_store_hard":
+				vv, ok := mv.(int64)
+				if !ok {
+					return &configErr{tk, fmt.Sprintf("Expected a parseable size for %q, got %v", mk, mv)}
+				}
+				jsLimits.MaxStoreHard = int64(vv)
 			case "max_streams", "streams":
 				vv, ok := mv.(int64)
 				if !ok {
@@ -1410,6 +1428,48 @@ func parseJetStreamForAccount(v interface{}, acc *Account, errors *[]error, warn
 					return &configErr{tk, fmt.Sprintf("Expected a parseable size for %q, got %v", mk, mv)}
 				}
 				jsLimits.MaxConsumers = int(vv)
+			case "max_header_size":
+				vv, ok := mv.(int64)
+				if !ok {
+					return &configErr{tk, fmt.Sprintf("Expected a parseable size for %q, got %v", mk, mv)}
+				}
+				jsLimits.MaxHeaderSize = int(vv)
+			case "max_templates":
+				vv, ok := mv.(int64)
+				if !ok {
+					return &configErr{tk, fmt.Sprintf("Expected an integer for %q, got %v", mk, mv)}
+				}
+				jsLimits.MaxTemplates = int(vv)
+			case "max_pull_batch":
+				vv, ok := mv.(int64)
+				if !ok {
+					return &configErr{tk, fmt.Sprintf("Expected an integer for %q, got %v", mk, mv)}
+				}
+				jsLimits.MaxPullBatch = int(vv)
+			case "reject_oversized_pull":
+				vv, ok := mv.(bool)
+				if !ok {
+					return &configErr{tk, fmt.Sprintf("Expected a boolean for %q, got %v", mk, mv)}
+				}
+				jsLimits.RejectOversizedPull = vv
+			case "max_concurrent_api_ops":
+				vv, ok := mv.(int64)
+				if !ok {
+					return &configErr{tk, fmt.Sprintf("Expected an integer for %q, got %v", mk, mv)}
+				}
+				jsLimits.MaxConcurrentAPIOps = int(vv)
+			case "over_limit_policy":
+				vv, ok := mv.(string)
+				if !ok {
+					return &configErr{tk, fmt.Sprintf("Expected a string for %q, got %v", mk, mv)}
+				}
+				if err := jsLimits.OverLimitPolicy.UnmarshalJSON([]byte(strconv.Quote(vv))); err != nil {
+					return &configErr{tk, fmt.Sprintf("Expected 'reject', 'block' or 'discard_old' for %q, got %q", mk, vv)}
+				}
+			case "max_dedupe_window":
+				jsLimits.MaxDedupeWindow = parseDuration(mk, tk, mv, errors, warnings)
+			case "dedupe_window":
+				jsLimits.DedupeWindow = parseDuration(mk, tk, mv, errors, warnings)
 			default:
 				if !tk.IsUsedVariable() {
 					err := &unknownConfigFieldErr{
@@ -558,6 +558,33 @@ func (jso jetStreamOption) IsJetStreamChange() bool {
 	return true
 }
 
+// jetStreamConfigOption implements the option interface for changes to
+// the limits and storage directory of a running JetStream.
+type jetStreamConfigOption struct {
+	noopOption
+	config  JetStreamConfig
+	changes []jsConfigChange
+}
+
+// Apply the new configuration to JetStream.
+func (jso *jetStreamConfigOption) Apply(s *Server) {
+	js := s.getJetStream()
+	if js == nil {
+		return
+	}
+	if err := js.applyConfig(jso.config); err != nil {
+		s.Errorf("Error reloading jetstream configuration: %v", err)
+		return
+	}
+	for _, c := range jso.changes {
+		s.Noticef("Reloaded: jetstream %s", c)
+	}
+}
+
+func (jso *jetStreamConfigOption) IsJetStreamChange() bool {
+	return true
+}
+
 // connectErrorReports implements the option interface for the `connect_error_reports`
 // setting.
 type connectErrorReports struct {
@@ -744,6 +771,16 @@ func (s *Server) reloadOptions(curOpts, newOpts *Options) error {
 		}
 	}
 
+	// Make sure any new JetStream account limits can be applied as a whole.
+	for _, opt := range changed {
+		if _, ok := opt.(*accountsOption); ok {
+			if err := s.beginJetStreamReload(newOpts); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
 	// Create a context that is used to pass special info that we may need
 	// while applying the new options.
 	ctx := reloadContext{oldClusterPerms: curOpts.Cluster.Permissions}
@@ -807,6 +844,7 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 		oldConfig = reflect.ValueOf(s.getOpts()).Elem()
 		newConfig = reflect.ValueOf(newOpts).Elem()
 		diffOpts  = []option{}
+		jsChanged = false
 	)
 	for i := 0; i < oldConfig.NumField(); i++ {
 		field := oldConfig.Type().Field(i)
@@ -985,18 +1023,15 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 				return nil, fmt.Errorf("config reload not supported for %s: old=%v, new=%v",
 					field.Name, oldValue, newValue)
 			}
-		case "storedir":
-			return nil, fmt.Errorf("config reload not supported for jetstream storage directory")
+		case "storedir", "jetstreammaxmemory", "jetstreammaxstore":
+			// These are checked together against the running JetStream below.
+			jsChanged = true
 		case "jetstream":
 			new := newValue.(bool)
 			old := oldValue.(bool)
 			if new != old {
 				diffOpts = append(diffOpts, &jetStreamOption{newValue: new})
 			}
-		case "jetstreammaxmemory":
-			return nil, fmt.Errorf("config reload not supported for jetstream max memory")
-		case "jetstreammaxstore":
-			return nil, fmt.Errorf("config reload not supported for jetstream max storage")
 		case "websocket":
 			// Similar to gateways
 			tmpOld := oldValue.(WebsocketOpts)
@@ -1036,6 +1071,11 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 			continue
 		case "maxtracedmsglen":
 			diffOpts = append(diffOpts, &maxTracedMsgLenOption{newValue: newValue.(int)})
+		case "tags":
+			// Tags are sent to other servers when routes connect, so a change would
+			// not be seen by the cluster until all routes are reestablished.
+			return nil, fmt.Errorf("config reload not supported for server tags, they are only exchanged when routes connect: old=%v, new=%v",
+				oldValue, newValue)
 		case "port":
 			// check to see if newValue == 0 and continue if so.
 			if newValue == 0 {
@@ -1055,9 +1095,68 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 		}
 	}
 
+	if jsChanged {
+		jso, err := s.diffJetStreamConfig(newOpts)
+		if err != nil {
+			return nil, err
+		}
+		if jso != nil {
+			diffOpts = append(diffOpts, jso)
+		}
+	}
+
 	return diffOpts, nil
 }
 
+// diffJetStreamConfig compares the running JetStream configuration against the
+// one the new options would produce. Returns nil if there is nothing to apply.
+func (s *Server) diffJetStreamConfig(newOpts *Options) (*jetStreamConfigOption, error) {
+	js := s.getJetStream()
+	if js == nil {
+		return nil, nil
+	}
+	old := s.JetStreamConfig()
+	storeDir := newOpts.StoreDir
+	if storeDir != _EMPTY_ && !old.MemoryOnly {
+		var err error
+		if storeDir, err = expandStoreDir(storeDir); err != nil {
+			return nil, err
+		}
+	}
+	cfg := s.resolveJetStreamConfig(&JetStreamConfig{
+		StoreDir:   storeDir,
+		MaxMemory:  newOpts.JetStreamMaxMemory,
+		MaxStore:   newOpts.JetStreamMaxStore,
+		MemoryOnly: old.MemoryOnly,
+	})
+	// Dynamic limits are recomputed on each call, so only carry
+	// over the ones that were explicitly changed.
+	oldOpts := s.getOpts()
+	if newOpts.JetStreamMaxMemory == oldOpts.JetStreamMaxMemory {
+		cfg.MaxMemory = old.MaxMemory
+	}
+	if newOpts.JetStreamMaxStore == oldOpts.JetStreamMaxStore {
+		cfg.MaxStore = old.MaxStore
+	}
+	if newOpts.StoreDir == oldOpts.StoreDir {
+		cfg.StoreDir = old.StoreDir
+	}
+	cfg.LazyRecovery = old.LazyRecovery
+	cfg.RequireDurableStore = old.RequireDurableStore
+	cfg.VerifyDataOnRecovery = old.VerifyDataOnRecovery
+	cfg.DisableReservations = old.DisableReservations
+	cfg.RecoveryProgress = old.RecoveryProgress
+
+	changes := diffJetStreamConfig(old, &cfg)
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	if err := js.checkConfigChanges(changes); err != nil {
+		return nil, err
+	}
+	return &jetStreamConfigOption{config: cfg, changes: changes}, nil
+}
+
 func copyRemoteGWConfigsWithoutTLSConfig(current []*RemoteGatewayOpts) []*RemoteGatewayOpts {
 	l := len(current)
 	if l == 0 {
@@ -1235,6 +1334,7 @@ func (s *Server) reloadAuthorization() {
 				newAcc.sl = acc.sl
 				newAcc.rm = acc.rm
 				newAcc.js = acc.js
+				newAcc.jsPrefix = acc.jsPrefix
 
 				if len(acc.imports.rrMap) > 0 {
 					newAcc.imports.rrMap = make(map[string][]*serviceRespEntry)
@@ -1364,14 +1464,7 @@ func (s *Server) reloadAuthorization() {
 
 	// We will double check all JetStream configs on a reload.
 	if checkJetStream {
-		var err error
-		s.getJetStream().clearResources()
-		if s.globalAccountOnly() {
-			err = s.GlobalAccount().EnableJetStream(nil)
-		} else {
-			err = s.configAllJetStreamAccounts()
-		}
-		if err != nil {
+		if err := s.commitJetStreamReload(); err != nil {
 			s.Errorf(err.Error())
 		}
 	}
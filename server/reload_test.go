@@ -1787,6 +1787,23 @@ func TestConfigReloadClusterName(t *testing.T) {
 	}
 }
 
+func TestConfigReloadServerTagsUnsupported(t *testing.T) {
+	s, _, conf := runReloadServerWithContent(t, []byte(`server_tags: ["rack:1"]`))
+	defer os.Remove(conf)
+	defer s.Shutdown()
+
+	// Reloading the same tags is fine.
+	reloadUpdateConfig(t, s, conf, `server_tags: ["rack:1"]`)
+
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(`server_tags: ["rack:2"]`))
+	if err := s.Reload(); err == nil || !strings.Contains(err.Error(), "not supported for server tags") {
+		t.Fatalf("Expected Reload to return a server tags error, got %v", err)
+	}
+	if tags := s.getOpts().Tags; len(tags) != 1 || tags[0] != "rack:1" {
+		t.Fatalf("Expected tags to be unchanged, got %v", tags)
+	}
+}
+
 func TestConfigReloadMaxSubsUnsupported(t *testing.T) {
 	s, _, conf := runReloadServerWithContent(t, []byte(`max_subs: 1`))
 	defer os.Remove(conf)
@@ -4550,3 +4567,124 @@ func TestConfigReloadAccountMappings(t *testing.T) {
 	checkPending(fsub, 1)
 	checkPending(sub, 0)
 }
+
+func TestConfigReloadJetStreamConfigChanges(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-reload-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+	nsd := filepath.Join(sd, "new")
+
+	template := `
+		listen: "127.0.0.1:-1"
+		jetstream: {max_mem_store: %d, max_file_store: %d, store_dir: %q}
+	`
+	conf := createConfFile(t, []byte(fmt.Sprintf(template, 64*1024*1024, 64*1024*1024, sd)))
+	defer os.Remove(conf)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	// Limits can be changed.
+	reloadUpdateConfig(t, s, conf, fmt.Sprintf(template, 32*1024*1024, 128*1024*1024, sd))
+	if cfg := s.JetStreamConfig(); cfg.MaxMemory != 32*1024*1024 || cfg.MaxStore != 128*1024*1024 {
+		t.Fatalf("Expected new limits, got %+v", cfg)
+	}
+
+	// Moving the storage directory with streams present is not allowed.
+	mset, err := s.GlobalAccount().AddStream(&StreamConfig{Name: "S", Storage: FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	if err := ioutil.WriteFile(conf, []byte(fmt.Sprintf(template, 32*1024*1024, 128*1024*1024, nsd)), 0666); err != nil {
+		t.Fatalf("Error writing config file: %v", err)
+	}
+	if err := s.Reload(); err == nil || !strings.Contains(err.Error(), "while streams exist") {
+		t.Fatalf("Expected an error moving the storage directory, got %v", err)
+	}
+	if cfg := s.JetStreamConfig(); cfg.StoreDir != sd {
+		t.Fatalf("Expected store dir to remain %q, got %q", sd, cfg.StoreDir)
+	}
+
+	// Once empty it is allowed.
+	if err := mset.Delete(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	if cfg := s.JetStreamConfig(); cfg.StoreDir != nsd {
+		t.Fatalf("Expected store dir of %q, got %q", nsd, cfg.StoreDir)
+	}
+	if _, err := s.GlobalAccount().AddStream(&StreamConfig{Name: "S", Storage: FileStorage}); err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(nsd, globalAccountName, streamsDir, "S")); err != nil {
+		t.Fatalf("Expected stream to be stored in the new directory: %v", err)
+	}
+}
+
+func TestConfigReloadJetStreamAccountLimitsAtomic(t *testing.T) {
+	sd, err := ioutil.TempDir("", "js-reload-limits-")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer os.RemoveAll(sd)
+
+	template := `
+		listen: "127.0.0.1:-1"
+		jetstream: {max_mem_store: 64MB, max_file_store: 64MB, store_dir: %q}
+		accounts {
+			A { jetstream: {max_mem: %s, max_store: 1MB}, users: [{user: a, password: a}] }
+			B { jetstream: {max_mem: %s, max_store: 1MB}, users: [{user: b, password: b}] }
+		}
+	`
+	conf := createConfFile(t, []byte(fmt.Sprintf(template, sd, "32MB", "32MB")))
+	defer os.Remove(conf)
+	s, o := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	accB, err := s.LookupAccount("B")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := accB.AddStream(&StreamConfig{Name: "S", Storage: MemoryStorage}); err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	nc := natsConnect(t, fmt.Sprintf("nats://b:b@%s:%d", o.Host, o.Port))
+	defer nc.Close()
+	for i := 0; i < 10; i++ {
+		if _, err := nc.Request("S", make([]byte, 1024), time.Second); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	checkLimits := func(amem, bmem int64) {
+		t.Helper()
+		for name, mem := range map[string]int64{"A": amem, "B": bmem} {
+			acc, err := s.LookupAccount(name)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if limits := acc.JetStreamUsage().Limits; limits.MaxMemory != mem {
+				t.Fatalf("Expected account %q max memory of %d, got %d", name, mem, limits.MaxMemory)
+			}
+		}
+		if mem, _, _ := s.JetStreamReservedResources(); mem != amem+bmem {
+			t.Fatalf("Expected reserved memory of %d, got %d", amem+bmem, mem)
+		}
+	}
+
+	// Growing A is only possible together with shrinking B.
+	reloadUpdateConfig(t, s, conf, fmt.Sprintf(template, sd, "48MB", "16MB"))
+	checkLimits(48*1024*1024, 16*1024*1024)
+
+	// Infeasible for B, so nothing should change for A either.
+	if err := ioutil.WriteFile(conf, []byte(fmt.Sprintf(template, sd, "60MB", "1KB")), 0666); err != nil {
+		t.Fatalf("Error writing config file: %v", err)
+	}
+	if err := s.Reload(); err == nil || !strings.Contains(err.Error(), `account "B" max_memory`) {
+		t.Fatalf("Expected an error for account B, got %v", err)
+	}
+	checkLimits(48*1024*1024, 16*1024*1024)
+}
@@ -76,6 +76,7 @@ type route struct {
 	authRequired bool
 	tlsRequired  bool
 	jetstream    bool
+	tags         []string
 	connectURLs  []string
 	wsConnURLs   []string
 	replySubs    map[*subscription]*time.Timer
@@ -606,6 +607,7 @@ func (c *client) processRouteInfo(info *Info) {
 	c.route.remoteName = info.Name
 	c.route.lnoc = info.LNOC
 	c.route.jetstream = info.JetStream
+	c.route.tags = info.Tags
 
 	// When sent through route INFO, if the field is set, it should be of size 1.
 	if len(info.LeafNodeURLs) == 1 {
@@ -1726,6 +1728,7 @@ func (s *Server) startRouteAcceptLoop() {
 		Cluster:      s.info.Cluster,
 		Dynamic:      s.isClusterNameDynamic(),
 		LNOC:         true,
+		Tags:         opts.Tags,
 	}
 	// Set this if only if advertise is not disabled
 	if !opts.Cluster.NoAdvertise {
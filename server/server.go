@@ -78,6 +78,7 @@ type Info struct {
 	Nonce             string   `json:"nonce,omitempty"`
 	Cluster           string   `json:"cluster,omitempty"`
 	Dynamic           bool     `json:"cluster_dynamic,omitempty"`
+	Tags              []string `json:"tags,omitempty"`
 	ClientConnectURLs []string `json:"connect_urls,omitempty"`    // Contains URLs a client can connect to.
 	WSConnectURLs     []string `json:"ws_connect_urls,omitempty"` // Contains URLs a ws client can connect to.
 	LameDuckMode      bool     `json:"ldm,omitempty"`
@@ -117,6 +118,7 @@ type Server struct {
 	gacc             *Account
 	sys              *internal
 	js               *jetStream
+	jsLimitHandler   atomic.Value // JetStreamLimitExceededHandler
 	accounts         sync.Map
 	tmpAccounts      sync.Map // Temporarily stores accounts that are being built
 	activeAccounts   int32
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -58,6 +59,12 @@ var (
 	ErrInvalidSequence = errors.New("invalid sequence")
 	// ErrSequenceMismatch is returned when storing a raw message and the expected sequence is wrong.
 	ErrSequenceMismatch = errors.New("expected sequence does not match store")
+	// ErrStoreNoSpace is returned when the underlying storage has run out of space.
+	ErrStoreNoSpace = errors.New("store has run out of space")
+	// ErrStoreEncryptionKeyRequired is returned when an encrypted store is accessed without a key.
+	ErrStoreEncryptionKeyRequired = errors.New("store is encrypted but no encryption key was provided")
+	// ErrStoreEncryptionKeyInvalid is returned when an encrypted store can not be decrypted with the provided key.
+	ErrStoreEncryptionKeyInvalid = errors.New("unable to decrypt store, encryption key is not valid")
 )
 
 // Used to call back into the upper layers to report on changes in storage resources.
@@ -108,6 +115,18 @@ const (
 	DiscardNew
 )
 
+// SyncPolicy determines when file based streams flush their messages to disk.
+type SyncPolicy int
+
+const (
+	// SyncOnInterval (default) will sync to disk in the background every SyncInterval.
+	SyncOnInterval SyncPolicy = iota
+	// SyncAlways will sync to disk before a message is acknowledged.
+	SyncAlways
+	// SyncNever leaves syncing to the operating system.
+	SyncNever
+)
+
 // StreamState is information about the given stream.
 type StreamState struct {
 	Msgs      uint64    `json:"messages"`
@@ -168,6 +187,167 @@ type Pending struct {
 type TemplateStore interface {
 	Store(*StreamTemplate) error
 	Delete(*StreamTemplate) error
+	Size(*StreamTemplate) (int64, error)
+}
+
+// clockJumpThreshold is how far the wall clock can drift from the monotonic
+// clock before we consider it to have jumped.
+const clockJumpThreshold = time.Second
+
+// clockRebaseAfter is how long a wall clock jump has to persist before message
+// expiry follows the wall clock again.
+var clockRebaseAfter = time.Minute
+
+// Reads the wall clock in nanoseconds, replaceable for tests.
+var wallClock = func() int64 { return time.Now().UnixNano() }
+
+// jsClock is the expiry clock shared by all stores.
+var jsClock = newStoreClock()
+
+// storeClock provides the time used to expire messages. Messages are always
+// stamped with the wall clock. When the wall clock jumps forward, expiry keeps
+// advancing with the monotonic clock instead so a misbehaving system clock can
+// not mass expire messages. Once the jump has persisted for clockRebaseAfter
+// the wall clock is trusted again. Expiry never runs ahead of the wall clock.
+type storeClock struct {
+	mu     sync.Mutex
+	wall   int64
+	mono   time.Time
+	skew   int64
+	jumped time.Time
+	warnf  func(format string, v ...interface{})
+}
+
+func newStoreClock() *storeClock {
+	return &storeClock{wall: wallClock(), mono: time.Now()}
+}
+
+// Will set the function used to report clock jumps.
+func (c *storeClock) setWarnf(warnf func(format string, v ...interface{})) {
+	c.mu.Lock()
+	c.warnf = warnf
+	c.mu.Unlock()
+}
+
+// Returns the current time for expiry in nanoseconds.
+func (c *storeClock) now() int64 {
+	if c == nil {
+		return wallClock()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	mono, wall := time.Now(), wallClock()
+	expected := c.wall + int64(mono.Sub(c.mono))
+	skew := wall - expected
+	if skew > -int64(clockJumpThreshold) && skew < int64(clockJumpThreshold) {
+		c.wall, c.mono, c.skew = wall, mono, 0
+		return wall
+	}
+	if d := skew - c.skew; d <= -int64(clockJumpThreshold) || d >= int64(clockJumpThreshold) {
+		// Only report a jump once.
+		c.skew, c.jumped = skew, mono
+		if c.warnf != nil {
+			c.warnf("Detected a wall clock jump of %v, message expiry will follow the monotonic clock for up to %v",
+				time.Duration(skew), clockRebaseAfter)
+		}
+	} else if mono.Sub(c.jumped) >= clockRebaseAfter {
+		c.wall, c.mono, c.skew = wall, mono, 0
+		if c.warnf != nil {
+			c.warnf("Wall clock jump of %v persisted, message expiry follows the wall clock again", time.Duration(skew))
+		}
+		return wall
+	}
+	// Going backwards would only keep messages longer, which is safe.
+	if wall < expected {
+		return wall
+	}
+	return expected
+}
+
+// Returns when the age check for a message with timestamp ts should run. Messages
+// from the future, e.g. after the clock went backwards, are checked again within maxAge.
+func ageCheckIn(ts, now int64, maxAge time.Duration) time.Duration {
+	fireIn := time.Duration(ts-now) + maxAge
+	if fireIn > maxAge {
+		fireIn = maxAge
+	}
+	return fireIn
+}
+
+// msgTTLs tracks the deadlines of messages stored with a per message TTL.
+// The owning store's lock should be held for all operations.
+type msgTTLs struct {
+	dls   map[uint64]int64
+	next  int64
+	tmr   *time.Timer
+	clock *storeClock
+}
+
+// Will track the deadline for seq if hdr carries a TTL, arming the timer if needed.
+// Any stale deadline for a reused sequence is dropped.
+func (t *msgTTLs) track(seq uint64, ts int64, hdr []byte, fire func()) {
+	ttl, _ := getMsgTTL(hdr)
+	if ttl <= 0 {
+		delete(t.dls, seq)
+		return
+	}
+	if t.dls == nil {
+		t.dls = make(map[uint64]int64)
+	}
+	dl := ts + int64(ttl)
+	t.dls[seq] = dl
+	if t.tmr == nil || dl < t.next {
+		t.schedule(dl, fire)
+	}
+}
+
+// Returns and stops tracking all sequences whose deadline is at or before now.
+func (t *msgTTLs) expired(now int64) []uint64 {
+	var seqs []uint64
+	for seq, dl := range t.dls {
+		if dl <= now {
+			seqs = append(seqs, seq)
+			delete(t.dls, seq)
+		}
+	}
+	return seqs
+}
+
+// Will arm the timer for the earliest remaining deadline, or stop it if none are left.
+func (t *msgTTLs) reset(fire func()) {
+	var next int64
+	for _, dl := range t.dls {
+		if next == 0 || dl < next {
+			next = dl
+		}
+	}
+	if next == 0 {
+		t.stop()
+		return
+	}
+	t.schedule(next, fire)
+}
+
+func (t *msgTTLs) schedule(dl int64, fire func()) {
+	fireIn := time.Duration(dl - t.clock.now())
+	if fireIn < 0 {
+		fireIn = 0
+	}
+	t.next = dl
+	if t.tmr != nil {
+		t.tmr.Reset(fireIn)
+	} else {
+		t.tmr = time.AfterFunc(fireIn, fire)
+	}
+}
+
+func (t *msgTTLs) stop() {
+	if t.tmr != nil {
+		t.tmr.Stop()
+		t.tmr = nil
+	}
+	t.next = 0
 }
 
 func jsonString(s string) string {
@@ -254,6 +434,46 @@ func (dp *DiscardPolicy) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+func (sp SyncPolicy) String() string {
+	switch sp {
+	case SyncOnInterval:
+		return "SyncOnInterval"
+	case SyncAlways:
+		return "SyncAlways"
+	case SyncNever:
+		return "SyncNever"
+	default:
+		return "Unknown Sync Policy"
+	}
+}
+
+func (sp SyncPolicy) MarshalJSON() ([]byte, error) {
+	switch sp {
+	case SyncOnInterval:
+		return json.Marshal("interval")
+	case SyncAlways:
+		return json.Marshal("always")
+	case SyncNever:
+		return json.Marshal("never")
+	default:
+		return nil, fmt.Errorf("can not marshal %v", sp)
+	}
+}
+
+func (sp *SyncPolicy) UnmarshalJSON(data []byte) error {
+	switch strings.ToLower(string(data)) {
+	case jsonString("interval"):
+		*sp = SyncOnInterval
+	case jsonString("always"):
+		*sp = SyncAlways
+	case jsonString("never"):
+		*sp = SyncNever
+	default:
+		return fmt.Errorf("can not unmarshal %q", data)
+	}
+	return nil
+}
+
 const (
 	memoryStorageString = "memory"
 	fileStorageString   = "file"
@@ -16,6 +16,8 @@ package server
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -26,8 +28,11 @@ import (
 	"path"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/klauspost/compress/s2"
@@ -51,6 +56,18 @@ type StreamConfig struct {
 	NoAck        bool            `json:"no_ack,omitempty"`
 	Template     string          `json:"template_owner,omitempty"`
 	Duplicates   time.Duration   `json:"duplicate_window,omitempty"`
+	BlockSize    uint64          `json:"block_size,omitempty"`
+	// Sealed streams permanently reject any new messages and removals.
+	// They require limits retention and never expire messages by age or limits.
+	Sealed bool `json:"sealed,omitempty"`
+	// SyncPolicy controls when file based streams sync messages to disk.
+	SyncPolicy SyncPolicy `json:"sync_policy,omitempty"`
+	// SyncInterval is how often to sync with SyncOnInterval. Zero will use the default.
+	SyncInterval time.Duration `json:"sync_interval,omitempty"`
+	// WriteBufferSize is how many bytes file based streams buffer before flushing. Zero will use the default.
+	WriteBufferSize int `json:"write_buffer_size,omitempty"`
+	// Placement restricts the replicas of clustered streams to matching servers.
+	Placement *Placement `json:"placement,omitempty"`
 
 	// These are non public configuration options.
 	// If you add new options, check fileStreamInfoJSON in order for them to
@@ -59,6 +76,13 @@ type StreamConfig struct {
 	allowNoSubject bool
 }
 
+// Placement selects the servers replicas of a stream can be placed on.
+// Servers need to be in the cluster, if set, and have all of the tags.
+type Placement struct {
+	Cluster string   `json:"cluster,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+}
+
 const JSApiPubAckResponseType = "io.nats.jetstream.api.v1.pub_ack_response"
 
 // JSPubAckResponse is a formal response to a publish operation.
@@ -77,14 +101,29 @@ type PubAck struct {
 
 // StreamInfo shows config and current state for this stream.
 type StreamInfo struct {
-	Config  StreamConfig `json:"config"`
-	Created time.Time    `json:"created"`
-	State   StreamState  `json:"state"`
+	Config  StreamConfig      `json:"config"`
+	Created time.Time         `json:"created"`
+	State   StreamState       `json:"state"`
+	Flush   *StreamFlushStats `json:"flush,omitempty"`
+}
+
+// StreamFlushStats shows how a file based stream is writing messages to disk.
+type StreamFlushStats struct {
+	BufferSize int       `json:"buffer_size"`
+	Buffered   int       `json:"buffered"`
+	Flushes    uint64    `json:"flushes"`
+	Bytes      uint64    `json:"bytes"`
+	Last       time.Time `json:"last,omitempty"`
 }
 
 // Stream is a jetstream stream of messages. When we receive a message internally destined
 // for a Stream we will direct link from the client to this Stream structure.
 type Stream struct {
+	// Usage not yet applied to the account, accessed atomically.
+	upend int64
+	// Set while a timer to apply batched usage is pending, accessed atomically.
+	utmr int32
+
 	mu        sync.RWMutex
 	jsa       *jsAccount
 	srv       *Server
@@ -105,6 +144,18 @@ type Stream struct {
 	ddtmr     *time.Timer
 	qch       chan struct{}
 
+	// Age when created was recorded and the monotonic reading at that time.
+	createdAge  time.Duration
+	createdMono time.Time
+
+	// Batched usage accounting, see JetStreamConfig.UsageBatchSize.
+	ubsz  int64
+	ubint time.Duration
+
+	// Messages held waiting for room under OverLimitBlock, in arrival order.
+	blocked  []*blockedMsg
+	blocking bool
+
 	// Clustered mode.
 	sa      *streamAssignment
 	node    RaftNode
@@ -119,8 +170,20 @@ const (
 	JSExpectedStream    = "Nats-Expected-Stream"
 	JSExpectedLastSeq   = "Nats-Expected-Last-Sequence"
 	JSExpectedLastMsgId = "Nats-Expected-Last-Msg-Id"
+	JSMsgTTL            = "Nats-TTL"
+
+	jsMsgTTLCanonical = "Nats-Ttl"
 )
 
+// A message held waiting for room in the account.
+type blockedMsg struct {
+	subject string
+	reply   string
+	hdr     []byte
+	msg     []byte
+	expires time.Time
+}
+
 // Dedupe entry
 type ddentry struct {
 	id  string
@@ -144,6 +207,138 @@ func (a *Account) AddStreamWithStore(config *StreamConfig, fsConfig *FileStoreCo
 	return a.addStream(config, fsConfig, nil)
 }
 
+// CopyStreamConfig creates a new empty stream with the configuration of the stream src,
+// but with the given name and subjects. No messages are copied. The new stream is not
+// owned by any template and is not sealed, since it would never be able to hold messages.
+func (a *Account) CopyStreamConfig(src, newName string, newSubjects []string) (*Stream, error) {
+	mset, err := a.LookupStream(src)
+	if err != nil {
+		return nil, err
+	}
+	cfg := mset.Config()
+	cfg.Name = newName
+	cfg.Subjects = append([]string(nil), newSubjects...)
+	cfg.Template = _EMPTY_
+	cfg.Sealed = false
+	return a.AddStream(&cfg)
+}
+
+// ApplyStreamConfigs will create or update the streams described by cfgs.
+// The complete set is validated against the account limits before any changes are made,
+// and if applying any of them fails, the changes that were already made will be rolled back.
+// Returns the names of the streams that were created, updated and left unchanged.
+func (a *Account) ApplyStreamConfigs(cfgs []*StreamConfig) (created, updated, unchanged []string, err error) {
+	_, jsa, err := a.checkForJetStream()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	type streamChange struct {
+		cfg  StreamConfig
+		mset *Stream
+		ocfg StreamConfig
+	}
+	var changes []*streamChange
+	names := make(map[string]struct{}, len(cfgs))
+
+	for _, config := range cfgs {
+		if config == nil {
+			return nil, nil, nil, fmt.Errorf("stream configuration can not be nil")
+		}
+		cfg, err := a.checkStreamCfg(config)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("stream %q: %v", config.Name, err)
+		}
+		if _, ok := names[cfg.Name]; ok {
+			return nil, nil, nil, fmt.Errorf("stream %q is defined more than once", cfg.Name)
+		}
+		names[cfg.Name] = struct{}{}
+		changes = append(changes, &streamChange{cfg: cfg})
+	}
+
+	// Make sure any streams that have not been loaded yet are before we compare.
+	for _, sc := range changes {
+		a.LookupStream(sc.cfg.Name)
+	}
+
+	// Diff against what we have and make sure the whole set fits within our limits.
+	var numNew int
+	var memDelta, storeDelta int64
+
+	jsa.mu.RLock()
+	for _, sc := range changes {
+		if mset, ok := jsa.streams[sc.cfg.Name]; ok {
+			sc.mset, sc.ocfg = mset, mset.Config()
+			if reflect.DeepEqual(sc.cfg, sc.ocfg) {
+				continue
+			}
+			switch sc.ocfg.Storage {
+			case MemoryStorage:
+				memDelta -= streamReservation(&sc.ocfg)
+			case FileStorage:
+				storeDelta -= streamReservation(&sc.ocfg)
+			}
+		} else {
+			numNew++
+		}
+		switch sc.cfg.Storage {
+		case MemoryStorage:
+			memDelta += streamReservation(&sc.cfg)
+		case FileStorage:
+			storeDelta += streamReservation(&sc.cfg)
+		}
+	}
+	if numNew > 0 && jsa.limits.MaxStreams > 0 && len(jsa.streams)+numNew > jsa.limits.MaxStreams {
+		err = fmt.Errorf("maximum number of streams reached")
+	} else if memDelta > 0 {
+		err = jsa.checkBytesLimits(memDelta, MemoryStorage)
+	}
+	if err == nil && storeDelta > 0 {
+		err = jsa.checkBytesLimits(storeDelta, FileStorage)
+	}
+	jsa.mu.RUnlock()
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var applied []*streamChange
+	rollback := func() {
+		for i := len(applied) - 1; i >= 0; i-- {
+			sc := applied[i]
+			if sc.mset == nil {
+				if mset, err := a.LookupStream(sc.cfg.Name); err == nil {
+					mset.Delete()
+				}
+			} else {
+				sc.mset.Update(&sc.ocfg)
+			}
+		}
+	}
+
+	for _, sc := range changes {
+		if sc.mset == nil {
+			if _, err := a.AddStream(&sc.cfg); err != nil {
+				rollback()
+				return nil, nil, nil, fmt.Errorf("stream %q: %v", sc.cfg.Name, err)
+			}
+			created = append(created, sc.cfg.Name)
+		} else if reflect.DeepEqual(sc.cfg, sc.ocfg) {
+			unchanged = append(unchanged, sc.cfg.Name)
+			continue
+		} else {
+			if err := sc.mset.Update(&sc.cfg); err != nil {
+				rollback()
+				return nil, nil, nil, fmt.Errorf("stream %q: %v", sc.cfg.Name, err)
+			}
+			updated = append(updated, sc.cfg.Name)
+		}
+		applied = append(applied, sc)
+	}
+
+	return created, updated, unchanged, nil
+}
+
 func (a *Account) addStream(config *StreamConfig, fsConfig *FileStoreConfig, sa *streamAssignment) (*Stream, error) {
 	s, jsa, err := a.checkForJetStream()
 	if err != nil {
@@ -157,10 +352,24 @@ func (a *Account) addStream(config *StreamConfig, fsConfig *FileStoreConfig, sa
 	}
 
 	// Sensible defaults.
-	cfg, err := checkStreamCfg(config)
+	cfg, err := a.checkStreamCfg(config)
 	if err != nil {
 		return nil, err
 	}
+	if cfg.Storage == FileStorage && jsa.js.memoryOnly() {
+		return nil, ErrJetStreamMemoryOnly
+	}
+
+	// If this stream has not been loaded yet do so now.
+	jsa.mu.RLock()
+	_, lazy := jsa.lazy[cfg.Name]
+	jsa.mu.RUnlock()
+	if lazy {
+		a.loadLazyStream(cfg.Name)
+	}
+	if err := jsa.checkStreamDirCollision(cfg.Name); err != nil {
+		return nil, err
+	}
 
 	jsa.mu.Lock()
 	if mset, ok := jsa.streams[cfg.Name]; ok {
@@ -195,9 +404,16 @@ func (a *Account) addStream(config *StreamConfig, fsConfig *FileStoreConfig, sa
 	// Setup the internal client.
 	c := s.createInternalJetStreamClient()
 	mset := &Stream{jsa: jsa, config: cfg, srv: s, client: c, consumers: make(map[string]*Consumer), qch: make(chan struct{})}
+	if mset.ubsz = jsa.js.config.UsageBatchSize; mset.ubsz > 0 {
+		if mset.ubint = jsa.js.config.UsageBatchInterval; mset.ubint <= 0 {
+			mset.ubint = JetStreamDefaultUsageBatchInterval
+		}
+	}
 
 	jsa.streams[cfg.Name] = mset
-	storeDir := path.Join(jsa.storeDir, streamsDir, cfg.Name)
+	jsa.reserveStreamResources(&cfg)
+	storeDir := path.Join(jsa.storeDir, streamsDir, streamDirName(cfg.Name))
+	aek := jsa.aek
 	jsa.mu.Unlock()
 
 	// Bind to the account.
@@ -214,6 +430,7 @@ func (a *Account) addStream(config *StreamConfig, fsConfig *FileStoreConfig, sa
 		}
 	}
 	fsCfg.StoreDir = storeDir
+	fsCfg.aek = aek
 	if err := mset.setupStore(fsCfg); err != nil {
 		mset.Delete()
 		return nil, err
@@ -242,6 +459,7 @@ func (a *Account) addStream(config *StreamConfig, fsConfig *FileStoreConfig, sa
 			mset.Delete()
 			return nil, err
 		}
+		jsa.lazyStreamSubscribed(cfg.Name)
 	}
 
 	// This is always true in single server mode.
@@ -249,6 +467,7 @@ func (a *Account) addStream(config *StreamConfig, fsConfig *FileStoreConfig, sa
 		// Send advisory.
 		mset.sendCreateAdvisory()
 	}
+	jsa.checkStreamCountAlarm()
 
 	return mset, nil
 }
@@ -365,6 +584,12 @@ func (mset *Stream) maxMsgSize() uint64 {
 func (mset *Stream) autoTuneFileStorageBlockSize(fsCfg *FileStoreConfig) {
 	var totalEstSize uint64
 
+	// An explicitly configured block size always wins.
+	if mset.config.BlockSize > 0 {
+		fsCfg.BlockSize = mset.config.BlockSize
+		return
+	}
+
 	// MaxBytes will take precedence for now.
 	if mset.config.MaxBytes > 0 {
 		totalEstSize = uint64(mset.config.MaxBytes)
@@ -435,6 +660,7 @@ func (mset *Stream) sendCreateAdvisory() {
 	name := mset.config.Name
 	template := mset.config.Template
 	sendq := mset.sendq
+	c := mset.client
 	mset.mu.Unlock()
 
 	if sendq == nil {
@@ -457,6 +683,9 @@ func (mset *Stream) sendCreateAdvisory() {
 	if err == nil {
 		subj := JSAdvisoryStreamCreatedPre + "." + name
 		sendq <- &jsPubMsg{subj, subj, _EMPTY_, nil, j, nil, 0}
+		if c != nil {
+			c.srv.sendAccountAdvisory(c.acc, subj, j)
+		}
 	}
 }
 
@@ -480,6 +709,7 @@ func (mset *Stream) sendDeleteAdvisoryLocked() {
 	if err == nil {
 		subj := JSAdvisoryStreamDeletedPre + "." + mset.config.Name
 		mset.sendq <- &jsPubMsg{subj, subj, _EMPTY_, nil, j, nil, 0}
+		mset.sendAccountAdvisory(subj, j)
 	}
 }
 
@@ -502,6 +732,15 @@ func (mset *Stream) sendUpdateAdvisoryLocked() {
 	if err == nil {
 		subj := JSAdvisoryStreamUpdatedPre + "." + mset.config.Name
 		mset.sendq <- &jsPubMsg{subj, subj, _EMPTY_, nil, j, nil, 0}
+		mset.sendAccountAdvisory(subj, j)
+	}
+}
+
+// Republish an advisory on the account's advisory feed.
+// Lock should be held.
+func (mset *Stream) sendAccountAdvisory(subj string, msg []byte) {
+	if c := mset.client; c != nil {
+		c.srv.sendAccountAdvisory(c.acc, subj, msg)
 	}
 }
 
@@ -513,22 +752,68 @@ func (mset *Stream) Created() time.Time {
 	return created
 }
 
+// Age returns how long ago the stream was created.
+// Will return zero if the creation time is not known.
+// The age follows the monotonic clock once the creation time has been recorded.
+// After a restart it is computed again from the stored wall clock creation time.
+func (mset *Stream) Age() time.Duration {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	if mset.created.IsZero() {
+		return 0
+	}
+	return mset.createdAge + time.Since(mset.createdMono)
+}
+
 // Internal to allow creation time to be restored.
+// A zero time will be ignored.
 func (mset *Stream) setCreated(created time.Time) {
+	if created.IsZero() {
+		return
+	}
 	mset.mu.Lock()
-	mset.created = created
+	mset.recordCreated(created)
+	s, name := mset.srv, mset.config.Name
 	mset.mu.Unlock()
+	// The monotonic clock does not survive a restart, so all we can do is point this out.
+	if ahead := created.Sub(time.Now()); ahead >= clockJumpThreshold && s != nil {
+		s.Warnf("JetStream stream %q was created %v in the future, the wall clock went backwards since", name, ahead.Round(time.Second))
+	}
+}
+
+// Records the creation time with the wall and monotonic clocks.
+// A creation time in the future, e.g. after the clock went backwards, counts as no age.
+// Lock should be held.
+func (mset *Stream) recordCreated(created time.Time) {
+	mset.created = created
+	mset.createdMono = time.Now()
+	if mset.createdAge = mset.createdMono.Round(0).Sub(created); mset.createdAge < 0 {
+		mset.createdAge = 0
+	}
 }
 
 // Check to see if these subjects overlap with existing subjects.
 // Lock should be held.
 func (jsa *jsAccount) subjectsOverlap(subjects []string) bool {
 	for _, mset := range jsa.streams {
-		for _, subj := range mset.config.Subjects {
-			for _, tsubj := range subjects {
-				if SubjectsCollide(tsubj, subj) {
-					return true
-				}
+		if subjectsCollide(mset.config.Subjects, subjects) {
+			return true
+		}
+	}
+	for _, ls := range jsa.lazy {
+		if subjectsCollide(ls.cfg.Subjects, subjects) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if any subject in a collides with any subject in b.
+func subjectsCollide(a, b []string) bool {
+	for _, subj := range a {
+		for _, tsubj := range b {
+			if SubjectsCollide(tsubj, subj) {
+				return true
 			}
 		}
 	}
@@ -538,6 +823,15 @@ func (jsa *jsAccount) subjectsOverlap(subjects []string) bool {
 // Default duplicates window.
 const StreamDefaultDuplicatesWindow = 2 * time.Minute
 
+// Returns the storage type used when a stream does not set one.
+func defaultStorageType(st StorageType) StorageType {
+	// Make file the default.
+	if st == 0 {
+		return FileStorage
+	}
+	return st
+}
+
 func checkStreamCfg(config *StreamConfig) (StreamConfig, error) {
 	if config == nil {
 		return StreamConfig{}, fmt.Errorf("stream configuration invalid")
@@ -550,10 +844,37 @@ func checkStreamCfg(config *StreamConfig) (StreamConfig, error) {
 	}
 	cfg := *config
 
-	// Make file the default.
-	if cfg.Storage == 0 {
-		cfg.Storage = FileStorage
+	// Zero and -1 both mean unlimited, anything lower is invalid.
+	if cfg.MaxConsumers < -1 {
+		return StreamConfig{}, fmt.Errorf("max consumers can not be less than -1")
+	}
+	if cfg.MaxMsgs < -1 {
+		return StreamConfig{}, fmt.Errorf("max messages can not be less than -1")
+	}
+	if cfg.MaxBytes < -1 {
+		return StreamConfig{}, fmt.Errorf("max bytes can not be less than -1")
+	}
+	if cfg.MaxAge < 0 {
+		return StreamConfig{}, fmt.Errorf("max age can not be negative")
+	}
+	if cfg.Replicas < 0 {
+		return StreamConfig{}, fmt.Errorf("replicas can not be negative")
 	}
+	if cfg.SyncPolicy < SyncOnInterval || cfg.SyncPolicy > SyncNever {
+		return StreamConfig{}, fmt.Errorf("unknown sync policy")
+	}
+	// Acks remove messages from interest and work queue streams.
+	if cfg.Sealed && cfg.Retention != LimitsPolicy {
+		return StreamConfig{}, fmt.Errorf("sealed streams require limits retention")
+	}
+	if cfg.SyncInterval < 0 {
+		return StreamConfig{}, fmt.Errorf("sync interval can not be negative")
+	}
+	if cfg.WriteBufferSize < 0 {
+		return StreamConfig{}, fmt.Errorf("write buffer size can not be negative")
+	}
+
+	cfg.Storage = defaultStorageType(cfg.Storage)
 	if cfg.Replicas == 0 {
 		cfg.Replicas = 1
 	}
@@ -569,6 +890,15 @@ func checkStreamCfg(config *StreamConfig) (StreamConfig, error) {
 	if cfg.MaxMsgSize == 0 {
 		cfg.MaxMsgSize = -1
 	}
+	if cfg.BlockSize != 0 {
+		if cfg.Storage != FileStorage {
+			return cfg, fmt.Errorf("block size is only valid for file storage")
+		}
+		if cfg.BlockSize < FileStoreMinBlkSize || cfg.BlockSize > FileStoreMaxBlkSize {
+			return cfg, fmt.Errorf("block size must be between %s and %s",
+				FriendlyBytes(FileStoreMinBlkSize), FriendlyBytes(FileStoreMaxBlkSize))
+		}
+	}
 	if cfg.MaxConsumers == 0 {
 		cfg.MaxConsumers = -1
 	}
@@ -609,10 +939,37 @@ func checkStreamCfg(config *StreamConfig) (StreamConfig, error) {
 }
 
 // Config returns the stream's configuration.
+// Config returns a copy of the stream's configuration that is safe to modify.
 func (mset *Stream) Config() StreamConfig {
-	mset.mu.Lock()
-	defer mset.mu.Unlock()
-	return mset.config
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return mset.config.deepCopy()
+}
+
+// Subjects returns a copy of the subjects of the stream.
+func (mset *Stream) Subjects() []string {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return copyStrings(mset.config.Subjects)
+}
+
+// Returns a copy that does not share any slices with the original.
+func (cfg *StreamConfig) deepCopy() StreamConfig {
+	ncfg := *cfg
+	ncfg.Subjects = copyStrings(cfg.Subjects)
+	if cfg.Placement != nil {
+		ncfg.Placement = &Placement{Cluster: cfg.Placement.Cluster, Tags: copyStrings(cfg.Placement.Tags)}
+	}
+	return ncfg
+}
+
+func copyStrings(src []string) []string {
+	if src == nil {
+		return nil
+	}
+	dst := make([]string, len(src))
+	copy(dst, src)
+	return dst
 }
 
 func (mset *Stream) FileStoreConfig() (FileStoreConfig, error) {
@@ -634,19 +991,124 @@ func (mset *Stream) Delete() error {
 		return ErrJetStreamNotEnabledForAccount
 	}
 	jsa.mu.Lock()
-	delete(jsa.streams, mset.config.Name)
+	if jsa.streams[mset.config.Name] == mset {
+		delete(jsa.streams, mset.config.Name)
+		jsa.releaseStreamResources(&mset.config)
+	}
 	jsa.mu.Unlock()
+	jsa.checkStreamCountAlarm()
 
 	return mset.delete()
 }
 
+// Points the stream to its template after the template was renamed.
+func (mset *Stream) setTemplate(name string) error {
+	mset.mu.Lock()
+	mset.config.Template = name
+	cfg, store := mset.config, mset.store
+	mset.mu.Unlock()
+	if store == nil {
+		return nil
+	}
+	return store.UpdateConfig(&cfg)
+}
+
+// Prefix for stream directories that are derived from a hash of the stream name.
+// This is not a valid character for names used as is, so the two can not collide.
+const streamDirHashPrefix = "#"
+
+// Longest stream name that will be used as is for its directory.
+const maxStreamDirNameLen = 128
+
+// streamDirName returns the name of the directory used to store a stream.
+// Names that may not be safe on all filesystems are replaced with a hash.
+func streamDirName(name string) string {
+	if isSafeDirName(name) {
+		return name
+	}
+	h := sha256.Sum256([]byte(name))
+	return streamDirHashPrefix + hex.EncodeToString(h[:16])
+}
+
+// checkStreamDirCollision makes sure the directory for the named stream is not
+// used by a different stream, e.g. on a case insensitive filesystem or when left
+// behind by a stream that could not be recovered.
+func (jsa *jsAccount) checkStreamDirCollision(name string) error {
+	dname := streamDirName(name)
+	collides := func(other string) bool {
+		return other != name && strings.EqualFold(streamDirName(other), dname)
+	}
+	jsa.mu.RLock()
+	// Nothing is stored in directories when memory only.
+	if jsa.storeDir == _EMPTY_ {
+		jsa.mu.RUnlock()
+		return nil
+	}
+	mdir, aek := path.Join(jsa.storeDir, streamsDir, dname), jsa.aek
+	var other string
+	for sname := range jsa.streams {
+		if collides(sname) {
+			other = sname
+		}
+	}
+	for sname := range jsa.lazy {
+		if collides(sname) {
+			other = sname
+		}
+	}
+	jsa.mu.RUnlock()
+	if other != _EMPTY_ {
+		return fmt.Errorf("stream %q would be stored in the same directory as stream %q", name, other)
+	}
+
+	if _, err := os.Stat(mdir); err != nil {
+		return nil
+	}
+	if cfg, _, err := readStreamMeta(mdir, aek); err == nil && cfg.Name != name {
+		return fmt.Errorf("stream %q would be stored in the same directory as stream %q", name, cfg.Name)
+	}
+	return nil
+}
+
+// Returns true if the name only uses characters that are safe in file names.
+func isSafeDirName(name string) bool {
+	if name == _EMPTY_ || len(name) > maxStreamDirNameLen {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '-', c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 // Update will allow certain configuration properties of an existing stream to be updated.
 func (mset *Stream) Update(config *StreamConfig) error {
-	cfg, err := checkStreamCfg(config)
+	if config == nil {
+		return fmt.Errorf("stream configuration invalid")
+	}
+	o_cfg := mset.Config()
+
+	// Keep the existing replicas when not specified instead of applying the defaults.
+	if config.Replicas == 0 {
+		ncfg := *config
+		ncfg.Replicas = o_cfg.Replicas
+		config = &ncfg
+	}
+
+	var cfg StreamConfig
+	var err error
+	if acc := mset.account(); acc != nil {
+		cfg, err = acc.checkStreamCfg(config)
+	} else {
+		cfg, err = checkStreamCfg(config)
+	}
 	if err != nil {
 		return err
 	}
-	o_cfg := mset.Config()
 
 	// Name must match.
 	if cfg.Name != o_cfg.Name {
@@ -660,10 +1122,18 @@ func (mset *Stream) Update(config *StreamConfig) error {
 	if cfg.Storage != o_cfg.Storage {
 		return fmt.Errorf("stream configuration update can not change storage type")
 	}
+	// Can't change replicas.
+	if cfg.Replicas != o_cfg.Replicas {
+		return fmt.Errorf("stream configuration update can not change replicas")
+	}
 	// Can't change retention.
 	if cfg.Retention != o_cfg.Retention {
 		return fmt.Errorf("stream configuration update can not change retention policy")
 	}
+	// Can't change block size.
+	if cfg.BlockSize != o_cfg.BlockSize {
+		return fmt.Errorf("stream configuration update can not change block size")
+	}
 	// Can not have a template owner for now.
 	if o_cfg.Template != "" {
 		return fmt.Errorf("stream configuration update not allowed on template owned stream")
@@ -671,6 +1141,14 @@ func (mset *Stream) Update(config *StreamConfig) error {
 	if cfg.Template != "" {
 		return fmt.Errorf("stream configuration update can not be owned by a template")
 	}
+	// Once sealed always sealed.
+	if o_cfg.Sealed && !cfg.Sealed {
+		return fmt.Errorf("stream configuration update can not unseal a stream")
+	}
+	// Changing limits could remove messages from a sealed stream.
+	if cfg.Sealed && (cfg.MaxMsgs != o_cfg.MaxMsgs || cfg.MaxBytes != o_cfg.MaxBytes || cfg.MaxAge != o_cfg.MaxAge) {
+		return fmt.Errorf("stream configuration update can not change limits of a sealed stream")
+	}
 
 	// Check limits.
 	mset.mu.Lock()
@@ -683,11 +1161,18 @@ func (mset *Stream) Update(config *StreamConfig) error {
 		return fmt.Errorf("stream configuration maximum consumers exceeds account limit")
 	}
 	if cfg.MaxBytes > 0 && cfg.MaxBytes > o_cfg.MaxBytes {
-		if err := jsa.checkBytesLimits(cfg.MaxBytes*int64(cfg.Replicas), cfg.Storage); err != nil {
+		// Only need to check what we add on top of our current reservation.
+		addBytes := cfg.MaxBytes
+		if o_cfg.MaxBytes > 0 {
+			addBytes -= o_cfg.MaxBytes
+		}
+		if err := jsa.checkBytesLimits(addBytes*int64(cfg.Replicas), cfg.Storage); err != nil {
 			jsa.mu.Unlock()
 			return err
 		}
 	}
+	jsa.releaseStreamResources(&o_cfg)
+	jsa.reserveStreamResources(&cfg)
 	jsa.mu.Unlock()
 
 	// Now check for subject interest differences.
@@ -739,6 +1224,10 @@ func (mset *Stream) Purge() (uint64, error) {
 		mset.mu.Unlock()
 		return 0, errors.New("stream closed")
 	}
+	if mset.config.Sealed {
+		mset.mu.Unlock()
+		return 0, ErrJetStreamStreamSealed
+	}
 	// Purge dedupe.
 	mset.ddmap = nil
 	var _obs [4]*Consumer
@@ -759,6 +1248,143 @@ func (mset *Stream) Purge() (uint64, error) {
 	return purged, nil
 }
 
+// purgeBefore will remove all messages stored before t.
+func (mset *Stream) purgeBefore(t time.Time) (uint64, error) {
+	mset.mu.Lock()
+	if mset.client == nil {
+		mset.mu.Unlock()
+		return 0, errors.New("stream closed")
+	}
+	if mset.config.Sealed {
+		mset.mu.Unlock()
+		return 0, ErrJetStreamStreamSealed
+	}
+	// When clustered the leader decides the cutoff and all replicas compact to it.
+	node, name, acc := mset.node, mset.config.Name, mset.jsa.account.Name
+	mset.mu.Unlock()
+	if node != nil && !node.Leader() {
+		return 0, ErrJetStreamNotLeader
+	}
+
+	// Find the first message at or after our cutoff. We walk here vs using
+	// GetSeqFromTime since the stores do not handle interior deletes there.
+	ts := t.UnixNano()
+	state := mset.store.State()
+	seq, msgs := state.LastSeq+1, uint64(0)
+	for sseq := state.FirstSeq; sseq <= state.LastSeq; sseq++ {
+		_, _, _, mts, err := mset.store.LoadMsg(sseq)
+		if err == ErrStoreMsgNotFound || err == errDeletedMsg {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if mts >= ts {
+			seq = sseq
+			break
+		}
+		msgs++
+	}
+	if seq <= state.FirstSeq {
+		return 0, nil
+	}
+
+	if node != nil {
+		sp := &streamPurge{Client: &ClientInfo{Account: acc}, Stream: name, Seq: seq}
+		if err := node.Propose(encodeStreamPurge(sp)); err != nil {
+			return 0, err
+		}
+		return msgs, nil
+	}
+	return mset.compactBefore(seq)
+}
+
+// compactBefore will remove all messages before seq and move consumers past them.
+func (mset *Stream) compactBefore(seq uint64) (uint64, error) {
+	mset.mu.Lock()
+	var _obs [4]*Consumer
+	obs := _obs[:0]
+	for _, o := range mset.consumers {
+		obs = append(obs, o)
+	}
+	mset.mu.Unlock()
+
+	purged, err := mset.store.Compact(seq)
+	if err != nil {
+		return purged, err
+	}
+	for _, o := range obs {
+		o.purgeBefore(seq)
+	}
+	return purged, nil
+}
+
+// truncate will remove all messages after seq. Consumers that have acknowledged
+// messages past seq will cause an error, others are moved back to seq.
+func (mset *Stream) truncate(seq uint64) error {
+	mset.mu.Lock()
+	if mset.client == nil {
+		mset.mu.Unlock()
+		return errors.New("stream closed")
+	}
+	if mset.config.Sealed {
+		mset.mu.Unlock()
+		return ErrJetStreamStreamSealed
+	}
+	var _obs [4]*Consumer
+	obs := _obs[:0]
+	for _, o := range mset.consumers {
+		obs = append(obs, o)
+	}
+	mset.mu.Unlock()
+
+	state := mset.store.State()
+	if seq >= state.LastSeq {
+		return nil
+	}
+	if state.Msgs == 0 || seq < state.FirstSeq {
+		return fmt.Errorf("truncate sequence %d is below the first sequence %d", seq, state.FirstSeq)
+	}
+	for _, o := range obs {
+		if o.ackedPast(seq) {
+			return fmt.Errorf("consumer %q has acknowledged messages past sequence %d", o.Name(), seq)
+		}
+	}
+
+	// The store needs a message to truncate to, so skip back over any interior deletes.
+	lseq := seq
+	for ; lseq > state.FirstSeq; lseq-- {
+		if _, _, _, _, err := mset.store.LoadMsg(lseq); err == nil {
+			break
+		}
+	}
+	if err := mset.store.Truncate(lseq); err != nil {
+		return err
+	}
+
+	mset.mu.Lock()
+	mset.lseq = lseq
+	mset.lmsgId = _EMPTY_
+	// Forget any message ids for messages we just removed.
+	for len(mset.ddarr) > 0 {
+		dde := mset.ddarr[len(mset.ddarr)-1]
+		if dde.seq <= lseq {
+			break
+		}
+		delete(mset.ddmap, dde.id)
+		mset.ddarr = mset.ddarr[:len(mset.ddarr)-1]
+	}
+	if mset.ddindex > len(mset.ddarr) {
+		mset.ddindex = len(mset.ddarr)
+	}
+	mset.mu.Unlock()
+
+	for _, o := range obs {
+		o.truncate(lseq)
+	}
+	return nil
+}
+
 // RemoveMsg will remove a message from a stream.
 // FIXME(dlc) - Should pick one and be consistent.
 func (mset *Stream) RemoveMsg(seq uint64) (bool, error) {
@@ -781,6 +1407,10 @@ func (mset *Stream) removeMsg(seq uint64, secure bool) (bool, error) {
 		mset.mu.RUnlock()
 		return false, fmt.Errorf("invalid stream")
 	}
+	if mset.config.Sealed {
+		mset.mu.RUnlock()
+		return false, ErrJetStreamStreamSealed
+	}
 	mset.mu.RUnlock()
 	if secure {
 		return mset.store.EraseMsg(seq)
@@ -881,7 +1511,7 @@ func (mset *Stream) unsubscribeUnlocked(sub *subscription) {
 
 func (mset *Stream) setupStore(fsCfg *FileStoreConfig) error {
 	mset.mu.Lock()
-	mset.created = time.Now().UTC()
+	mset.recordCreated(time.Now().UTC())
 
 	switch mset.config.Storage {
 	case MemoryStorage:
@@ -922,7 +1552,30 @@ func (mset *Stream) storeUpdates(md, bd int64, seq uint64, subj string) {
 	}
 
 	if mset.jsa != nil {
-		mset.jsa.updateUsage(mset.config.Storage, bd)
+		mset.addUsage(bd)
+	}
+}
+
+// Applies a change in usage to the account, batching it if configured.
+func (mset *Stream) addUsage(delta int64) {
+	if mset.ubsz <= 0 {
+		mset.jsa.updateUsage(mset.config.Storage, delta)
+		return
+	}
+	if pending := atomic.AddInt64(&mset.upend, delta); pending >= mset.ubsz || pending <= -mset.ubsz {
+		mset.flushUsage()
+	} else if atomic.CompareAndSwapInt32(&mset.utmr, 0, 1) {
+		time.AfterFunc(mset.ubint, func() {
+			atomic.StoreInt32(&mset.utmr, 0)
+			mset.flushUsage()
+		})
+	}
+}
+
+// Applies any batched usage to the account.
+func (mset *Stream) flushUsage() {
+	if delta := atomic.SwapInt64(&mset.upend, 0); delta != 0 && mset.jsa != nil {
+		mset.jsa.updateUsage(mset.config.Storage, delta)
 	}
 }
 
@@ -1022,6 +1675,31 @@ func getMsgId(hdr []byte) string {
 	return string(getHdrVal(JSMsgId, hdr))
 }
 
+// Fast lookup of the per message TTL. The value is either a duration
+// such as "30s" or a whole number of seconds. Returns 0 if not present.
+func getMsgTTL(hdr []byte) (time.Duration, error) {
+	v := getHdrVal(JSMsgTTL, hdr)
+	if v == nil {
+		// Clients that canonicalize header keys will send this form.
+		v = getHdrVal(jsMsgTTLCanonical, hdr)
+	}
+	if len(v) == 0 {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(string(v))
+	if err != nil {
+		secs, serr := strconv.ParseInt(string(v), 10, 64)
+		if serr != nil {
+			return 0, fmt.Errorf("invalid message TTL %q", v)
+		}
+		ttl = time.Duration(secs) * time.Second
+	}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("invalid message TTL %q", v)
+	}
+	return ttl, nil
+}
+
 // Fast lookup of expected last msgId.
 func getExpectedLastMsgId(hdr []byte) string {
 	return string(getHdrVal(JSExpectedLastMsgId, hdr))
@@ -1049,7 +1727,11 @@ func (mset *Stream) isClustered() bool {
 // processInboundJetStreamMsg handles processing messages bound for a stream.
 func (mset *Stream) processInboundJetStreamMsg(_ *subscription, pc *client, subject, reply string, rmsg []byte) {
 	hdr, msg := pc.msgParts(rmsg)
+	mset.processInboundMsg(subject, reply, hdr, msg)
+}
 
+// Processes an inbound message that has been split into headers and message.
+func (mset *Stream) processInboundMsg(subject, reply string, hdr, msg []byte) {
 	mset.mu.RLock()
 	isLeader, isClustered := mset.isLeader(), mset.node != nil
 	mset.mu.RUnlock()
@@ -1062,15 +1744,94 @@ func (mset *Stream) processInboundJetStreamMsg(_ *subscription, pc *client, subj
 	// If we are clustered we need to propose this message to the underlying raft group.
 	if isClustered {
 		mset.processClusteredInboundMsg(subject, reply, hdr, msg)
-	} else {
+	} else if !mset.blockForRoom(subject, reply, hdr, msg) {
 		mset.processJetStreamMsg(subject, reply, hdr, msg, 0, 0)
 	}
 }
 
+// blockForRoom will hold the message when the account is over its limits and
+// uses OverLimitBlock, or while the account's storage is being moved. Held messages
+// are stored in order by a separate go routine once there is room, so the
+// publisher's readLoop is never blocked.
+// Returns true if the message was held.
+func (mset *Stream) blockForRoom(subject, reply string, hdr, msg []byte) bool {
+	mset.mu.Lock()
+	jsa, stype := mset.jsa, mset.config.Storage
+	// Keep ordering behind anything already held.
+	if !mset.blocking {
+		mset.mu.Unlock()
+		if jsa == nil || jsa.storeMoved() == nil &&
+			(jsa.overLimitPolicy() != OverLimitBlock || jsa.hasRoomFor(stype, int64(len(subject)+len(hdr)+len(msg)))) {
+			return false
+		}
+		mset.mu.Lock()
+	}
+	// We do not own these buffers.
+	bm := &blockedMsg{
+		subject: subject,
+		reply:   reply,
+		hdr:     append([]byte(nil), hdr...),
+		msg:     append([]byte(nil), msg...),
+		expires: time.Now().Add(jsOverLimitMaxBlock),
+	}
+	mset.blocked = append(mset.blocked, bm)
+	if !mset.blocking {
+		mset.blocking = true
+		go mset.storeBlockedMsgs()
+	}
+	mset.mu.Unlock()
+	return true
+}
+
+// storeBlockedMsgs stores held messages as room frees up, and rejects any
+// that waited longer than jsOverLimitMaxBlock.
+func (mset *Stream) storeBlockedMsgs() {
+	for {
+		mset.mu.Lock()
+		if len(mset.blocked) == 0 || mset.client == nil {
+			mset.blocked, mset.blocking = nil, false
+			mset.mu.Unlock()
+			return
+		}
+		bm := mset.blocked[0]
+		jsa, stype, name := mset.jsa, mset.config.Storage, mset.config.Name
+		canRespond := !mset.config.NoAck && len(bm.reply) > 0
+		sendq := mset.sendq
+		mset.mu.Unlock()
+
+		// Nothing is stored until the account's storage has been moved.
+		if moved := jsa.storeMoved(); moved != nil {
+			<-moved
+			continue
+		}
+		sz := int64(len(bm.subject) + len(bm.hdr) + len(bm.msg))
+		if jsa.overLimitPolicy() != OverLimitBlock || jsa.hasRoomFor(stype, sz) {
+			mset.processJetStreamMsg(bm.subject, bm.reply, bm.hdr, bm.msg, 0, 0)
+		} else if time.Now().After(bm.expires) {
+			if canRespond {
+				resp := &JSPubAckResponse{PubAck: &PubAck{Stream: name}, Error: &ApiError{Code: 400, Description: "resource limits exceeded for account"}}
+				response, _ := json.Marshal(resp)
+				sendq <- &jsPubMsg{bm.reply, _EMPTY_, _EMPTY_, nil, response, nil, 0}
+			}
+		} else {
+			time.Sleep(jsOverLimitBlockInterval)
+			continue
+		}
+		mset.mu.Lock()
+		mset.blocked = mset.blocked[1:]
+		mset.mu.Unlock()
+	}
+}
+
 var errLastSeqMismatch = errors.New("last sequence mismatch")
 
 // processJetStreamMsg is where we try to actually process the stream msg.
 func (mset *Stream) processJetStreamMsg(subject, reply string, hdr, msg []byte, lseq uint64, ts int64) error {
+	var maxHdrSize int
+	if jsa := mset.jsa; jsa != nil && len(hdr) > 0 {
+		maxHdrSize = int(atomic.LoadInt64(&jsa.maxHdrSize))
+	}
+
 	mset.mu.Lock()
 	store := mset.store
 	c := mset.client
@@ -1155,6 +1916,17 @@ func (mset *Stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 			}
 			return fmt.Errorf("last msgid mismatch: %q vs %q", lmsgId, last)
 		}
+		// Per message TTL.
+		if _, err := getMsgTTL(hdr); err != nil {
+			mset.mu.Unlock()
+			if canRespond {
+				resp.PubAck = &PubAck{Stream: name}
+				resp.Error = &ApiError{Code: 400, Description: err.Error()}
+				b, _ := json.Marshal(resp)
+				sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, b, nil, 0}
+			}
+			return err
+		}
 	}
 
 	// Response Ack.
@@ -1176,6 +1948,42 @@ func (mset *Stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 		return ErrMaxPayload
 	}
 
+	// Check headers against the account limit.
+	if maxHdrSize > 0 && len(hdr) > maxHdrSize {
+		mset.mu.Unlock()
+		if canRespond {
+			resp.PubAck = &PubAck{Stream: name}
+			resp.Error = &ApiError{Code: 400, Description: ErrMaxHeaderSize.Error()}
+			b, _ := json.Marshal(resp)
+			mset.sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, b, nil, 0}
+		}
+		return ErrMaxHeaderSize
+	}
+
+	// Sealed streams do not take any new messages.
+	if mset.config.Sealed {
+		mset.mu.Unlock()
+		if canRespond {
+			resp.PubAck = &PubAck{Stream: name}
+			resp.Error = &ApiError{Code: 400, Description: ErrJetStreamStreamSealed.Error()}
+			b, _ := json.Marshal(resp)
+			mset.sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, b, nil, 0}
+		}
+		return ErrJetStreamStreamSealed
+	}
+
+	// Reject new messages for file based streams if we have run out of space.
+	if stype == FileStorage && jsa.js != nil && jsa.js.isReadOnly() {
+		mset.mu.Unlock()
+		if canRespond {
+			resp.PubAck = &PubAck{Stream: name}
+			resp.Error = &ApiError{Code: 503, Description: ErrJetStreamReadOnly.Error()}
+			b, _ := json.Marshal(resp)
+			mset.sendq <- &jsPubMsg{reply, _EMPTY_, _EMPTY_, nil, b, nil, 0}
+		}
+		return ErrJetStreamReadOnly
+	}
+
 	var noInterest bool
 
 	// If we are interest based retention and have no consumers then we can skip.
@@ -1235,10 +2043,14 @@ func (mset *Stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 	// Store actual msg.
 	err = store.StoreRawMsg(subject, hdr, msg, seq, ts)
 
-	// If we did not succeed put those values back.
+	// If we did not succeed put those values back, unless the store
+	// failed after using the sequence, e.g. on a failed sync.
 	if err != nil {
+		used := store.State().LastSeq >= seq
 		mset.mu.Lock()
-		mset.lseq = olseq
+		if !used {
+			mset.lseq = olseq
+		}
 		mset.lmsgId = olmsgId
 		mset.mu.Unlock()
 	}
@@ -1247,12 +2059,15 @@ func (mset *Stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 		if err != ErrStoreClosed {
 			c.Errorf("JetStream failed to store a msg on account: %q stream: %q -  %v", accName, name, err)
 		}
+		if isOutOfSpaceErr(err) && jsa.js != nil {
+			jsa.js.enterReadOnly(fmt.Sprintf("stream %q in account %q ran out of storage space", name, accName))
+		}
 		if canRespond {
 			resp.PubAck = &PubAck{Stream: name}
 			resp.Error = &ApiError{Code: 400, Description: err.Error()}
 			response, _ = json.Marshal(resp)
 		}
-	} else if jsa.limitsExceeded(stype) {
+	} else if jsa.limitsExceeded(stype) && !jsa.resolveOverLimit(store, stype, seq) {
 		c.Warnf("JetStream resource limits exceeded for account: %q", accName)
 		if canRespond {
 			resp.PubAck = &PubAck{Stream: name}
@@ -1476,15 +2291,16 @@ func (mset *Stream) stop(delete bool) error {
 		return nil
 	}
 
+	var err error
 	if delete {
-		if err := mset.store.Delete(); err != nil {
-			return err
-		}
-	} else if err := mset.store.Stop(); err != nil {
-		return err
+		err = mset.store.Delete()
+	} else {
+		err = mset.store.Stop()
 	}
+	// Apply any batched usage, including what a delete released.
+	mset.flushUsage()
 
-	return nil
+	return err
 }
 
 func (mset *Stream) GetMsg(seq uint64) (*StoredMsg, error) {
@@ -1554,6 +2370,17 @@ func (mset *Stream) State() StreamState {
 	return store.State()
 }
 
+// FlushStats returns the write buffer flush stats for file based streams, nil otherwise.
+func (mset *Stream) FlushStats() *StreamFlushStats {
+	mset.mu.RLock()
+	store := mset.store
+	mset.mu.RUnlock()
+	if fs, ok := store.(*fileStore); ok {
+		return fs.flushStats()
+	}
+	return nil
+}
+
 // Determines if the new proposed partition is unique amongst all observables.
 // Lock should be held.
 func (mset *Stream) partitionUnique(partition string) bool {
@@ -1602,24 +2429,148 @@ func (mset *Stream) Snapshot(deadline time.Duration, checkMsgs, includeConsumers
 		mset.mu.RUnlock()
 		return nil, fmt.Errorf("invalid stream")
 	}
-	store := mset.store
+	store, jsa, name := mset.store, mset.jsa, mset.config.Name
 	mset.mu.RUnlock()
 
-	return store.Snapshot(deadline, checkMsgs, includeConsumers)
+	sr, err := store.Snapshot(deadline, checkMsgs, includeConsumers)
+	if err != nil {
+		return nil, err
+	}
+	sr.Reader = jsa.trackSnapshot(name, false, sr.Reader, sr.Reader)
+	return sr, nil
 }
 
 const snapsDir = "__snapshots__"
 
+// SnapshotInfo describes a snapshot or restore in progress.
+type SnapshotInfo struct {
+	ID      string    `json:"id"`
+	Stream  string    `json:"stream"`
+	Restore bool      `json:"restore,omitempty"`
+	Started time.Time `json:"started"`
+	Bytes   uint64    `json:"bytes"`
+}
+
+// Tracks a snapshot or restore by wrapping the data flowing through it.
+type activeSnapshot struct {
+	mu       sync.Mutex
+	jsa      *jsAccount
+	info     SnapshotInfo
+	r        io.Reader
+	c        io.Closer
+	canceled bool
+}
+
+// Will register a snapshot or restore reading from r. The closer, if any, is
+// used to interrupt it on cancel.
+func (jsa *jsAccount) trackSnapshot(stream string, restore bool, r io.Reader, c io.Closer) *activeSnapshot {
+	as := &activeSnapshot{
+		jsa:  jsa,
+		info: SnapshotInfo{ID: nuid.Next(), Stream: stream, Restore: restore, Started: time.Now().UTC()},
+		r:    r,
+		c:    c,
+	}
+	jsa.mu.Lock()
+	if jsa.snaps == nil {
+		jsa.snaps = make(map[string]*activeSnapshot)
+	}
+	jsa.snaps[as.info.ID] = as
+	jsa.mu.Unlock()
+	return as
+}
+
+func (as *activeSnapshot) Read(p []byte) (int, error) {
+	as.mu.Lock()
+	canceled := as.canceled
+	as.mu.Unlock()
+	if canceled {
+		return 0, ErrJetStreamSnapshotCanceled
+	}
+	n, err := as.r.Read(p)
+	as.mu.Lock()
+	as.info.Bytes += uint64(n)
+	as.mu.Unlock()
+	if err != nil {
+		as.done()
+	}
+	return n, err
+}
+
+func (as *activeSnapshot) Close() error {
+	as.done()
+	if as.c != nil {
+		return as.c.Close()
+	}
+	return nil
+}
+
+// Will stop tracking this snapshot.
+func (as *activeSnapshot) done() {
+	as.jsa.mu.Lock()
+	delete(as.jsa.snaps, as.info.ID)
+	as.jsa.mu.Unlock()
+}
+
+// ActiveSnapshots returns the snapshots and restores in progress for this account.
+func (a *Account) ActiveSnapshots() []SnapshotInfo {
+	_, jsa, err := a.checkForJetStream()
+	if err != nil {
+		return nil
+	}
+	jsa.mu.RLock()
+	snaps := make([]*activeSnapshot, 0, len(jsa.snaps))
+	for _, as := range jsa.snaps {
+		snaps = append(snaps, as)
+	}
+	jsa.mu.RUnlock()
+
+	infos := make([]SnapshotInfo, 0, len(snaps))
+	for _, as := range snaps {
+		as.mu.Lock()
+		infos = append(infos, as.info)
+		as.mu.Unlock()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Started.Before(infos[j].Started) })
+	return infos
+}
+
+// CancelSnapshot interrupts the snapshot or restore with the given id.
+// A canceled restore will remove any partially restored files.
+func (a *Account) CancelSnapshot(id string) error {
+	_, jsa, err := a.checkForJetStream()
+	if err != nil {
+		return err
+	}
+	jsa.mu.RLock()
+	as := jsa.snaps[id]
+	jsa.mu.RUnlock()
+	if as == nil {
+		return ErrJetStreamSnapshotNotFound
+	}
+	as.mu.Lock()
+	as.canceled = true
+	as.mu.Unlock()
+	return as.Close()
+}
+
 // RestoreStream will restore a stream from a snapshot.
 func (a *Account) RestoreStream(stream string, r io.Reader) (*Stream, error) {
 	_, jsa, err := a.checkForJetStream()
 	if err != nil {
 		return nil, err
 	}
+	// Restores are staged on disk.
+	if jsa.js.memoryOnly() {
+		return nil, ErrJetStreamMemoryOnly
+	}
 
 	sd := path.Join(jsa.storeDir, snapsDir)
 	defer os.RemoveAll(sd)
 
+	as := jsa.trackSnapshot(stream, true, r, nil)
+	defer as.done()
+	r = as
+
 	if _, err := os.Stat(sd); os.IsNotExist(err) {
 		if err := os.MkdirAll(sd, 0755); err != nil {
 			return nil, fmt.Errorf("could not create snapshots directory - %v", err)
@@ -1664,6 +2615,12 @@ func (a *Account) RestoreStream(stream string, r io.Reader) (*Stream, error) {
 	if err != nil {
 		return nil, err
 	}
+	jsa.mu.RLock()
+	aek := jsa.aek
+	jsa.mu.RUnlock()
+	if b, err = decryptMeta(aek, b); err != nil {
+		return nil, err
+	}
 	if err := json.Unmarshal(b, &cfg); err != nil {
 		return nil, err
 	}
@@ -1677,7 +2634,7 @@ func (a *Account) RestoreStream(stream string, r io.Reader) (*Stream, error) {
 		return nil, ErrJetStreamStreamAlreadyUsed
 	}
 	// Move into the correct place here.
-	ndir := path.Join(jsa.storeDir, streamsDir, cfg.Name)
+	ndir := path.Join(jsa.storeDir, streamsDir, streamDirName(cfg.Name))
 	if err := os.Rename(sdir, ndir); err != nil {
 		return nil, err
 	}
@@ -1713,6 +2670,10 @@ func (a *Account) RestoreStream(stream string, r io.Reader) (*Stream, error) {
 			mset.Delete()
 			return nil, fmt.Errorf("error restoring consumer [%q]: %v", ofi.Name(), err)
 		}
+		if buf, err = decryptMeta(aek, buf); err != nil {
+			mset.Delete()
+			return nil, fmt.Errorf("error restoring consumer [%q]: %v", ofi.Name(), err)
+		}
 		var cfg FileConsumerInfo
 		if err := json.Unmarshal(buf, &cfg); err != nil {
 			mset.Delete()
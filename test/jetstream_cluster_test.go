@@ -74,6 +74,155 @@ func TestJetStreamClusterLeader(t *testing.T) {
 	c.expectNoLeader()
 }
 
+func TestJetStreamClusterInfoAndStepDown(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "JSC", 3)
+	defer c.shutdown()
+
+	leader := c.leader()
+	ci, err := leader.JetStreamClusterInfo()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !ci.IsLeader || ci.Leader == "" || len(ci.Peers) != 3 {
+		t.Fatalf("Unexpected cluster info from leader: %+v", ci)
+	}
+	for _, s := range c.servers {
+		if s == leader {
+			continue
+		}
+		if err := s.JetStreamStepDown(); err == nil {
+			t.Fatalf("Expected an error stepping down when not the leader")
+		}
+	}
+
+	if err := leader.JetStreamStepDown(); err != nil {
+		t.Fatalf("Unexpected error stepping down: %v", err)
+	}
+	c.waitOnLeader()
+
+	// Everyone should agree on who the leader is.
+	checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+		leader := c.leader()
+		if leader == nil {
+			return fmt.Errorf("No leader")
+		}
+		lci, _ := leader.JetStreamClusterInfo()
+		for _, s := range c.servers {
+			ci, err := s.JetStreamClusterInfo()
+			if err != nil {
+				return err
+			}
+			if ci.Leader != lci.Leader || ci.IsLeader != (s == leader) {
+				return fmt.Errorf("Server %q has unexpected cluster info: %+v", s.Name(), ci)
+			}
+		}
+		return nil
+	})
+
+	// Not clustered.
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+	if _, err := s.JetStreamClusterInfo(); err != server.ErrJetStreamNotClustered {
+		t.Fatalf("Expected not clustered error, got %v", err)
+	}
+}
+
+func TestJetStreamClusterDefaultReplicas(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "JSC", 3)
+	defer c.shutdown()
+
+	if err := c.leader().GlobalAccount().SetJetStreamDefaultReplicas(5); err == nil {
+		t.Fatalf("Expected an error with default replicas larger than the cluster")
+	}
+	for _, s := range c.servers {
+		if err := s.GlobalAccount().SetJetStreamDefaultReplicas(3); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if r := s.GlobalAccount().JetStreamDefaultReplicas(); r != 3 {
+			t.Fatalf("Expected default replicas of 3, got %d", r)
+		}
+	}
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	si, err := js.StreamInfo("TEST")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if si.Config.Replicas != 3 {
+		t.Fatalf("Expected the default of 3 replicas, got %d", si.Config.Replicas)
+	}
+
+	// Explicit replicas are left alone.
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "SINGLE", Subjects: []string{"bar"}, Replicas: 1}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if si, err = js.StreamInfo("SINGLE"); err != nil || si.Config.Replicas != 1 {
+		t.Fatalf("Expected 1 replica, got %+v, %v", si, err)
+	}
+
+	// Not clustered.
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+	if err := s.GlobalAccount().SetJetStreamDefaultReplicas(3); err == nil {
+		t.Fatalf("Expected an error setting default replicas when not clustered")
+	}
+	if r := s.GlobalAccount().JetStreamDefaultReplicas(); r != 1 {
+		t.Fatalf("Expected default replicas of 1, got %d", r)
+	}
+}
+
+func TestJetStreamClusterDefaultReplicasUpdate(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "JSC", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "SINGLE", Subjects: []string{"foo"}, Replicas: 1}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, s := range c.servers {
+		if err := s.GlobalAccount().SetJetStreamDefaultReplicas(3); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	sl := c.streamLeader("$G", "SINGLE")
+	if sl == nil {
+		t.Fatalf("Expected a stream leader")
+	}
+	mset, err := sl.GlobalAccount().LookupStream("SINGLE")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Omitting replicas on an update keeps what the stream has, not the account default.
+	if err := mset.Update(&server.StreamConfig{Name: "SINGLE", Subjects: []string{"foo", "bar"}, Storage: server.FileStorage}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if r := mset.Config().Replicas; r != 1 {
+		t.Fatalf("Expected 1 replica after the update, got %d", r)
+	}
+	// Changing the replicas is not allowed.
+	if err := mset.Update(&server.StreamConfig{Name: "SINGLE", Subjects: []string{"foo", "bar"}, Storage: server.FileStorage, Replicas: 3}); err == nil {
+		t.Fatalf("Expected an error changing the replicas")
+	}
+	if r := mset.Config().Replicas; r != 1 {
+		t.Fatalf("Expected 1 replica, got %d", r)
+	}
+}
+
 func TestJetStreamExpandCluster(t *testing.T) {
 	c := createJetStreamClusterExplicit(t, "JSC", 2)
 	defer c.shutdown()
@@ -232,6 +381,77 @@ func TestJetStreamClusterMultiReplicaStreams(t *testing.T) {
 	}
 }
 
+func TestJetStreamClusterPlacementTags(t *testing.T) {
+	c := createJetStreamTaggedCluster(t, "TAGS", [][]string{{"az:1", "ssd"}, {"az:2", "ssd"}, {"az:3"}, {"az:1"}, {}})
+	defer c.shutdown()
+
+	nc := clientConnectToServer(t, c.randomServer())
+	defer nc.Close()
+
+	addStream := func(cfg *server.StreamConfig) *server.ApiError {
+		t.Helper()
+		req, _ := json.Marshal(cfg)
+		rmsg, err := nc.Request(fmt.Sprintf(server.JSApiStreamCreateT, cfg.Name), req, 5*time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var resp server.JSApiStreamCreateResponse
+		if err := json.Unmarshal(rmsg.Data, &resp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		return resp.Error
+	}
+	placed := func(stream string) []int {
+		t.Helper()
+		var servers []int
+		for i, s := range c.servers {
+			if s.JetStreamIsStreamAssigned(server.DEFAULT_GLOBAL_ACCOUNT, stream) {
+				servers = append(servers, i)
+			}
+		}
+		return servers
+	}
+
+	for _, test := range []struct {
+		name     string
+		replicas int
+		tags     []string
+		expected []int
+	}{
+		{"SSD", 2, []string{"ssd"}, []int{0, 1}},
+		{"AZ1", 2, []string{"az:1"}, []int{0, 3}},
+		{"AZ1SSD", 1, []string{"az:1", "ssd"}, []int{0}},
+	} {
+		cfg := &server.StreamConfig{
+			Name:      test.name,
+			Replicas:  test.replicas,
+			Storage:   server.MemoryStorage,
+			Placement: &server.Placement{Cluster: "TAGS", Tags: test.tags},
+		}
+		if apiErr := addStream(cfg); apiErr != nil {
+			t.Fatalf("Unexpected error for %q: %+v", test.name, apiErr)
+		}
+		checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+			if servers := placed(test.name); fmt.Sprint(servers) != fmt.Sprint(test.expected) {
+				return fmt.Errorf("Expected %q on servers %v, got %v", test.name, test.expected, servers)
+			}
+			return nil
+		})
+	}
+
+	// Not enough tagged peers or the wrong cluster are rejected.
+	for _, p := range []*server.Placement{{Tags: []string{"ssd"}}, {Tags: []string{"az:4"}}, {Cluster: "OTHER"}} {
+		cfg := &server.StreamConfig{Name: "BAD", Replicas: 3, Storage: server.MemoryStorage, Placement: p}
+		if apiErr := addStream(cfg); apiErr == nil || apiErr.Code != 503 {
+			t.Fatalf("Expected insufficient resources for placement %+v, got %+v", p, apiErr)
+		}
+	}
+	// Without placement any of the servers can be used.
+	if apiErr := addStream(&server.StreamConfig{Name: "ANY", Replicas: 5, Storage: server.MemoryStorage}); apiErr != nil {
+		t.Fatalf("Unexpected error: %+v", apiErr)
+	}
+}
+
 func TestJetStreamClusterCompaction(t *testing.T) {
 	// This test takes a long time to observe compactions.
 	// Once moved to server we can adjust and re-enable.
@@ -410,6 +630,54 @@ func TestJetStreamClusterStreamPurge(t *testing.T) {
 	}
 }
 
+func TestJetStreamClusterStreamPurgeBefore(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	if _, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	msg := []byte("Hello JS Clustering")
+	for i := 0; i < 5; i++ {
+		if _, err := js.Publish("foo", msg); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		if _, err := js.Publish("foo", msg); err != nil {
+			t.Fatalf("Unexpected publish error: %v", err)
+		}
+	}
+
+	sl := c.streamLeader("$G", "TEST")
+	if _, err := c.randomNonLeader().GlobalAccount().PurgeStreamBefore("TEST", cutoff); err != server.ErrJetStreamNotLeader {
+		t.Fatalf("Expected %v, got %v", server.ErrJetStreamNotLeader, err)
+	}
+	if purged, err := sl.GlobalAccount().PurgeStreamBefore("TEST", cutoff); err != nil || purged != 5 {
+		t.Fatalf("Expected 5 messages purged, got %d: %v", purged, err)
+	}
+
+	// All replicas should have compacted.
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().LookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			if state := mset.State(); state.Msgs != 5 || state.FirstSeq != 6 {
+				return fmt.Errorf("Unexpected state on %q: %+v", s.Name(), state)
+			}
+		}
+		return nil
+	})
+}
+
 func TestJetStreamClusterConsumerState(t *testing.T) {
 	c := createJetStreamClusterExplicit(t, "R3S", 3)
 	defer c.shutdown()
@@ -1044,6 +1312,20 @@ var jsClusterTempl = `
 // This will create a cluster that is explicitly configured for the routes, etc.
 // and also has a defined clustername. All configs for routes and cluster name will be the same.
 func createJetStreamClusterExplicit(t *testing.T, clusterName string, numServers int) *cluster {
+	t.Helper()
+	return createJetStreamClusterWithConf(t, clusterName, numServers, nil)
+}
+
+// This will create a cluster where each server is tagged with the given tags.
+func createJetStreamTaggedCluster(t *testing.T, clusterName string, tags [][]string) *cluster {
+	t.Helper()
+	return createJetStreamClusterWithConf(t, clusterName, len(tags), func(i int) string {
+		return fmt.Sprintf("server_tags: [%s]", strings.Join(tags[i], ", "))
+	})
+}
+
+// Same as createJetStreamClusterExplicit, extra adds to the configuration of each server if set.
+func createJetStreamClusterWithConf(t *testing.T, clusterName string, numServers int, extra func(i int) string) *cluster {
 	t.Helper()
 	if clusterName == "" || numServers < 1 {
 		t.Fatalf("Bad params")
@@ -1064,6 +1346,9 @@ func createJetStreamClusterExplicit(t *testing.T, clusterName string, numServers
 		storeDir, _ := ioutil.TempDir("", server.JetStreamStoreDir)
 		sn := fmt.Sprintf("S-%d", cp-startClusterPort+1)
 		conf := fmt.Sprintf(jsClusterTempl, sn, storeDir, clusterName, cp, routeConfig)
+		if extra != nil {
+			conf += extra(cp-startClusterPort) + "\n"
+		}
 		s, o := RunServerWithConfig(createConfFile(t, []byte(conf)))
 		if doLog {
 			pre := fmt.Sprintf("[S-%d] - ", cp-startClusterPort+1)
@@ -17,7 +17,9 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/url"
@@ -875,6 +877,51 @@ func TestJetStreamAddStreamBadSubjects(t *testing.T) {
 	expectAPIErr(server.StreamConfig{Name: "MyStream", Storage: server.MemoryStorage, Subjects: []string{".>"}})
 }
 
+func TestJetStreamAddStreamNegativeLimits(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	acc := s.GlobalAccount()
+	for _, test := range []struct {
+		name string
+		cfg  server.StreamConfig
+		err  string
+	}{
+		{"MaxConsumers", server.StreamConfig{MaxConsumers: -2}, "max consumers can not be less than -1"},
+		{"MaxMsgs", server.StreamConfig{MaxMsgs: -2}, "max messages can not be less than -1"},
+		{"MaxBytes", server.StreamConfig{MaxBytes: -2}, "max bytes can not be less than -1"},
+		{"MaxAge", server.StreamConfig{MaxAge: -time.Second}, "max age can not be negative"},
+		{"Replicas", server.StreamConfig{Replicas: -1}, "replicas can not be negative"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := test.cfg
+			cfg.Name, cfg.Storage = "NEG", server.MemoryStorage
+			if _, err := acc.AddStream(&cfg); err == nil || err.Error() != test.err {
+				t.Fatalf("Expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+
+	// Unlimited values are still fine and replicas are normalized.
+	mset, err := acc.AddStream(&server.StreamConfig{
+		Name:         "NEG",
+		Storage:      server.MemoryStorage,
+		MaxConsumers: -1,
+		MaxMsgs:      -1,
+		MaxBytes:     -1,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	if cfg := mset.Config(); cfg.Replicas != 1 || cfg.MaxMsgs != -1 || cfg.MaxConsumers != -1 {
+		t.Fatalf("Unexpected config: %+v", cfg)
+	}
+}
+
 func TestJetStreamAddStreamMaxConsumers(t *testing.T) {
 	s := RunBasicJetStreamServer()
 	defer s.Shutdown()
@@ -3649,6 +3696,89 @@ func TestJetStreamConsumerRateLimit(t *testing.T) {
 	}
 }
 
+func TestJetStreamConsumerRateLimitRecovery(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mname := "RLR"
+	msgSize := 64 * 1024
+	// This will also limit the burst size of the limiter.
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: mname, Storage: server.FileStorage, MaxMsgSize: int32(2 * msgSize)})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+
+	// 16Mbit, or 2MB per second.
+	rateLimit := uint64(16 * 1024 * 1024)
+	if _, err := mset.AddConsumer(&server.ConsumerConfig{
+		Durable:        "rate",
+		DeliverSubject: "to",
+		RateLimit:      rateLimit,
+		AckPolicy:      server.AckNone,
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Stop current server.
+	sd := s.JetStreamConfig().StoreDir
+	s.Shutdown()
+	// Restart.
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+
+	mset, err = s.GlobalAccount().LookupStream(mname)
+	if err != nil {
+		t.Fatalf("Expected to find a stream for %q", mname)
+	}
+	o := mset.LookupConsumer("rate")
+	if o == nil {
+		t.Fatalf("Expected to recover the consumer")
+	}
+	if rl := o.Config().RateLimit; rl != rateLimit {
+		t.Fatalf("Expected rate limit of %d to be recovered, got %d", rateLimit, rl)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	var received int
+	done := make(chan bool)
+	totalSize := 2 * 1024 * 1024
+	toSend := totalSize / msgSize
+
+	nc.Subscribe("to", func(m *nats.Msg) {
+		received++
+		if received >= toSend {
+			done <- true
+		}
+	})
+	nc.Flush()
+
+	msg := make([]byte, msgSize)
+	rand.Read(msg)
+
+	start := time.Now()
+	for i := 0; i < toSend; i++ {
+		nc.Publish(mname, msg)
+	}
+	nc.Flush()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Did not receive all the messages in time")
+	}
+
+	// Should be close to a second, make sure we were actually paced.
+	if tt := time.Since(start); tt < 700*time.Millisecond {
+		t.Fatalf("Expected delivery of new messages to be paced by the recovered rate limit, took only %v", tt)
+	}
+}
+
 func TestJetStreamEphemeralConsumerRecoveryAfterServerRestart(t *testing.T) {
 	s := RunBasicJetStreamServer()
 	defer s.Shutdown()
@@ -3893,6 +4023,56 @@ func TestJetStreamConsumerMaxDeliveryAndServerRestart(t *testing.T) {
 	}
 }
 
+func TestJetStreamStreamAndConsumerAgeAndServerRestart(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	mname := "MYS"
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: mname, Storage: server.FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	o, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "D", AckPolicy: server.AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+	streamCreated, consumerCreated := mset.Created(), o.Created()
+
+	time.Sleep(50 * time.Millisecond)
+
+	checkAges := func() {
+		t.Helper()
+		// Ages are measured after their creation times, so can only be larger.
+		if age, min := mset.Age(), time.Since(streamCreated); age < min-time.Millisecond || age > min+time.Second {
+			t.Fatalf("Unexpected stream age of %v, expected at least %v", age, min)
+		}
+		if age, min := o.Age(), time.Since(consumerCreated); age < min-time.Millisecond || age > min+time.Second {
+			t.Fatalf("Unexpected consumer age of %v, expected at least %v", age, min)
+		}
+	}
+	checkAges()
+
+	// Ages should be based on the restored creation times.
+	sd := s.JetStreamConfig().StoreDir
+	u, _ := url.Parse(s.ClientURL())
+	port, _ := strconv.Atoi(u.Port())
+	s.Shutdown()
+	s = RunJetStreamServerOnPort(port, sd)
+	defer s.Shutdown()
+
+	if mset, err = s.GlobalAccount().LookupStream(mname); err != nil {
+		t.Fatalf("Expected to find a stream for %q", mname)
+	}
+	if o = mset.LookupConsumer("D"); o == nil {
+		t.Fatalf("Expected to find the consumer")
+	}
+	checkAges()
+}
+
 func TestJetStreamDeleteConsumerAndServerRestart(t *testing.T) {
 	s := RunBasicJetStreamServer()
 	defer s.Shutdown()
@@ -4114,7 +4294,7 @@ func TestJetStreamSnapshots(t *testing.T) {
 		t.Fatalf("Unexpected error: %v", err)
 	}
 	// Now compare to make sure they are equal.
-	if nusage := acc.JetStreamUsage(); nusage != pusage {
+	if nusage := acc.JetStreamUsage(); !reflect.DeepEqual(nusage, pusage) {
 		t.Fatalf("Usage does not match after restore: %+v vs %+v", nusage, pusage)
 	}
 	if state := mset.State(); !reflect.DeepEqual(state, info.state) {
@@ -6402,179 +6582,225 @@ func TestJetStreamConsumerReplayQuit(t *testing.T) {
 	}
 }
 
-func TestJetStreamSystemLimits(t *testing.T) {
-	s := RunRandClientPortServer()
-	defer s.Shutdown()
+func TestJetStreamAccountEncryptionKey(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: 127.0.0.1:-1
+		accounts: { FOO: { users: [ {user: foo, password: pwd} ] } }
+		no_auth_user: foo
+	`))
+	defer os.Remove(conf)
 
-	if config := s.JetStreamConfig(); config != nil {
-		defer os.RemoveAll(config.StoreDir)
-	}
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
 
-	if _, _, err := s.JetStreamReservedResources(); err == nil {
-		t.Fatalf("Expected error requesting jetstream reserved resources when not enabled")
-	}
-	// Create some accounts.
-	facc, _ := s.LookupOrRegisterAccount("FOO")
-	bacc, _ := s.LookupOrRegisterAccount("BAR")
-	zacc, _ := s.LookupOrRegisterAccount("BAZ")
+	storeDir, _ := ioutil.TempDir(os.TempDir(), "jstests-storedir-")
+	defer os.RemoveAll(storeDir)
 
-	jsconfig := &server.JetStreamConfig{MaxMemory: 1024, MaxStore: 8192}
+	jsconfig := &server.JetStreamConfig{MaxMemory: 64 * 1024 * 1024, MaxStore: 64 * 1024 * 1024, StoreDir: storeDir}
 	if err := s.EnableJetStream(jsconfig); err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
-
-	if rm, rd, err := s.JetStreamReservedResources(); err != nil {
-		t.Fatalf("Unexpected error requesting jetstream reserved resources: %v", err)
-	} else if rm != 0 || rd != 0 {
-		t.Fatalf("Expected reserved memory and store to be 0, got %d and %d", rm, rd)
+	acc, _ := s.LookupOrRegisterAccount("FOO")
+	if err := acc.SetJetStreamEncryptionKey([]byte("too short")); err == nil {
+		t.Fatalf("Expected an error with an invalid key")
 	}
-
-	limits := func(mem int64, store int64) *server.JetStreamAccountLimits {
-		return &server.JetStreamAccountLimits{
-			MaxMemory:    mem,
-			MaxStore:     store,
-			MaxStreams:   -1,
-			MaxConsumers: -1,
-		}
+	key := []byte("0123456789abcdef0123456789abcdef")
+	if err := acc.SetJetStreamEncryptionKey(key); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
-
-	if err := facc.EnableJetStream(limits(24, 192)); err != nil {
+	if err := acc.EnableJetStream(nil); err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
-	// Use up rest of our resources in memory
-	if err := bacc.EnableJetStream(limits(1000, 0)); err != nil {
+	mset, err := acc.AddStream(&server.StreamConfig{Name: "SECRET", Subjects: []string{"secret"}})
+	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
-
-	// Now ask for more memory. Should error.
-	if err := zacc.EnableJetStream(limits(1000, 0)); err == nil {
-		t.Fatalf("Expected an error when exhausting memory resource limits")
+	if _, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "dlc", AckPolicy: server.AckExplicit}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
-	// Disk too.
-	if err := zacc.EnableJetStream(limits(0, 10000)); err == nil {
-		t.Fatalf("Expected an error when exhausting memory resource limits")
+	nc := clientConnectToServer(t, s)
+	payload := "top secret payload"
+	for i := 0; i < 5; i++ {
+		sendStreamMsg(t, nc, "secret", payload)
 	}
-	facc.DisableJetStream()
-	bacc.DisableJetStream()
-	zacc.DisableJetStream()
+	nc.Close()
 
-	// Make sure we unreserved resources.
-	if rm, rd, err := s.JetStreamReservedResources(); err != nil {
-		t.Fatalf("Unexpected error requesting jetstream reserved resources: %v", err)
-	} else if rm != 0 || rd != 0 {
-		t.Fatalf("Expected reserved memory and store to be 0, got %v and %v", server.FriendlyBytes(rm), server.FriendlyBytes(rd))
+	// Restart without the key or with the wrong one, enabling should fail.
+	s.Shutdown()
+	s, _ = RunServerWithConfig(conf)
+	defer s.Shutdown()
+	if err := s.EnableJetStream(jsconfig); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	acc, _ = s.LookupOrRegisterAccount("FOO")
+	if err := acc.EnableJetStream(nil); !errors.Is(err, server.ErrStoreEncryptionKeyRequired) {
+		t.Fatalf("Expected missing key error, got %v", err)
+	}
+	acc.SetJetStreamEncryptionKey([]byte("fedcba9876543210fedcba9876543210"))
+	if err := acc.EnableJetStream(nil); !errors.Is(err, server.ErrStoreEncryptionKeyInvalid) {
+		t.Fatalf("Expected invalid key error, got %v", err)
+	}
+	if acc.JetStreamEnabled() {
+		t.Fatalf("Expected account to not be enabled")
 	}
 
-	if err := facc.EnableJetStream(limits(24, 192)); err != nil {
+	// Now with the key.
+	acc.SetJetStreamEncryptionKey(key)
+	if err := acc.EnableJetStream(nil); err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
-	// Test Adjust
-	l := limits(jsconfig.MaxMemory, jsconfig.MaxStore)
-	l.MaxStreams = 10
-	l.MaxConsumers = 10
+	mset, err = acc.LookupStream("SECRET")
+	if err != nil {
+		t.Fatalf("Expected stream to be recovered, got %v", err)
+	}
+	if state := mset.State(); state.Msgs != 5 {
+		t.Fatalf("Expected 5 msgs, got %d", state.Msgs)
+	}
+	if sm, err := mset.GetMsg(1); err != nil || string(sm.Data) != payload {
+		t.Fatalf("Expected decrypted payload, got %+v: %v", sm, err)
+	}
+	if o := mset.LookupConsumer("dlc"); o == nil {
+		t.Fatalf("Expected consumer to be recovered")
+	}
+}
 
-	if err := facc.UpdateJetStreamLimits(l); err != nil {
-		t.Fatalf("Unexpected error updating jetstream account limits: %v", err)
+func TestJetStreamAccountConsumers(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
 	}
 
-	var msets []*server.Stream
-	// Now test max streams and max consumers. Note max consumers is per stream.
-	for i := 0; i < 10; i++ {
-		mname := fmt.Sprintf("foo.%d", i)
-		mset, err := facc.AddStream(&server.StreamConfig{Name: strconv.Itoa(i), Storage: server.MemoryStorage, Subjects: []string{mname}})
+	acc := s.GlobalAccount()
+	if n := acc.NumConsumers(); n != 0 {
+		t.Fatalf("Expected no consumers, got %d", n)
+	}
+	for _, sname := range []string{"S1", "S2"} {
+		mset, err := acc.AddStream(&server.StreamConfig{Name: sname})
 		if err != nil {
 			t.Fatalf("Unexpected error adding stream: %v", err)
 		}
-		msets = append(msets, mset)
+		defer mset.Delete()
+		for _, oname := range []string{"A", "B"} {
+			if _, err := mset.AddConsumer(&server.ConsumerConfig{Durable: oname, AckPolicy: server.AckExplicit}); err != nil {
+				t.Fatalf("Unexpected error adding consumer: %v", err)
+			}
+		}
 	}
-
-	// This one should fail since over the limit for max number of streams.
-	if _, err := facc.AddStream(&server.StreamConfig{Name: "22", Storage: server.MemoryStorage, Subjects: []string{"foo.22"}}); err == nil {
-		t.Fatalf("Expected error adding stream over limit")
+	if n := acc.NumConsumers(); n != 4 {
+		t.Fatalf("Expected 4 consumers, got %d", n)
 	}
-
-	// Remove them all
-	for _, mset := range msets {
-		mset.Delete()
+	if obs := acc.Consumers(); len(obs) != 4 {
+		t.Fatalf("Expected 4 consumers, got %d", len(obs))
 	}
+}
 
-	// Now try to add one with bytes limit that would exceed the account limit.
-	if _, err := facc.AddStream(&server.StreamConfig{Name: "22", Storage: server.MemoryStorage, MaxBytes: jsconfig.MaxStore * 2}); err == nil {
-		t.Fatalf("Expected error adding stream over limit")
+func TestJetStreamStreamBlockSize(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
 	}
 
-	// Replicas can't be > 1
-	if _, err := facc.AddStream(&server.StreamConfig{Name: "22", Storage: server.MemoryStorage, Replicas: 10}); err == nil {
-		t.Fatalf("Expected error adding stream over limit")
+	acc := s.GlobalAccount()
+	for _, cfg := range []*server.StreamConfig{
+		{Name: "BS", BlockSize: 1024},
+		{Name: "BS", BlockSize: server.FileStoreMaxBlkSize + 1},
+		{Name: "BS", BlockSize: 1024 * 1024, Storage: server.MemoryStorage},
+	} {
+		if _, err := acc.AddStream(cfg); err == nil {
+			t.Fatalf("Expected an error for block size %d", cfg.BlockSize)
+		}
 	}
 
-	// Test consumers limit against account limit when the stream does not set a limit
-	mset, err := facc.AddStream(&server.StreamConfig{Name: "22", Storage: server.MemoryStorage, Subjects: []string{"foo.22"}})
+	blkSize := uint64(256 * 1024)
+	mset, err := acc.AddStream(&server.StreamConfig{Name: "BS", BlockSize: blkSize})
 	if err != nil {
 		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
-
-	for i := 0; i < 10; i++ {
-		oname := fmt.Sprintf("O:%d", i)
-		_, err := mset.AddConsumer(&server.ConsumerConfig{Durable: oname, AckPolicy: server.AckExplicit})
+	checkBlockSize := func() {
+		t.Helper()
+		fcfg, err := mset.FileStoreConfig()
 		if err != nil {
 			t.Fatalf("Unexpected error: %v", err)
 		}
+		if fcfg.BlockSize != blkSize {
+			t.Fatalf("Expected block size of %d, got %d", blkSize, fcfg.BlockSize)
+		}
 	}
+	checkBlockSize()
 
-	// This one should fail.
-	if _, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "O:22", AckPolicy: server.AckExplicit}); err == nil {
-		t.Fatalf("Expected error adding consumer over the limit")
+	cfg := mset.Config()
+	cfg.BlockSize = 2 * blkSize
+	if err := mset.Update(&cfg); err == nil {
+		t.Fatalf("Expected an error changing the block size")
 	}
 
-	// Test consumer limit against stream limit
-	mset.Delete()
-	mset, err = facc.AddStream(&server.StreamConfig{Name: "22", Storage: server.MemoryStorage, Subjects: []string{"foo.22"}, MaxConsumers: 5})
-	if err != nil {
-		t.Fatalf("Unexpected error adding stream: %v", err)
-	}
-
-	for i := 0; i < 5; i++ {
-		oname := fmt.Sprintf("O:%d", i)
-		_, err := mset.AddConsumer(&server.ConsumerConfig{Durable: oname, AckPolicy: server.AckExplicit})
-		if err != nil {
-			t.Fatalf("Unexpected error: %v", err)
-		}
-	}
+	// Restart and make sure we recover the block size from the metafile.
+	sd := s.JetStreamConfig().StoreDir
+	s.Shutdown()
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
 
-	// This one should fail.
-	if _, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "O:22", AckPolicy: server.AckExplicit}); err == nil {
-		t.Fatalf("Expected error adding consumer over the limit")
+	if mset, err = s.GlobalAccount().LookupStream("BS"); err != nil {
+		t.Fatalf("Expected to find a stream for %q", "BS")
 	}
+	checkBlockSize()
+}
 
-	// Test the account having smaller limits than the stream
-	mset.Delete()
+func TestJetStreamUsageWithReserved(t *testing.T) {
+	s := RunRandClientPortServer()
+	defer s.Shutdown()
 
-	mset, err = facc.AddStream(&server.StreamConfig{Name: "22", Storage: server.MemoryStorage, Subjects: []string{"foo.22"}, MaxConsumers: 10})
+	acc, _ := s.LookupOrRegisterAccount("FOO")
+	storeDir, _ := ioutil.TempDir(os.TempDir(), "jstests-storedir-")
+	defer os.RemoveAll(storeDir)
+	if err := s.EnableJetStream(&server.JetStreamConfig{MaxMemory: 64 * 1024, MaxStore: 64 * 1024, StoreDir: storeDir}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	limits := &server.JetStreamAccountLimits{MaxMemory: 4096, MaxStore: 8192, MaxStreams: -1, MaxConsumers: -1}
+	if err := acc.EnableJetStream(limits); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mset, err := acc.AddStream(&server.StreamConfig{Name: "M", Storage: server.MemoryStorage, MaxBytes: 1024})
 	if err != nil {
 		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
-
-	l.MaxConsumers = 5
-	if err := facc.UpdateJetStreamLimits(l); err != nil {
-		t.Fatalf("Unexpected error updating jetstream account limits: %v", err)
+	if _, err := acc.AddStream(&server.StreamConfig{Name: "F", MaxBytes: 2048}); err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
-
-	for i := 0; i < 5; i++ {
-		oname := fmt.Sprintf("O:%d", i)
-		_, err := mset.AddConsumer(&server.ConsumerConfig{Durable: oname, AckPolicy: server.AckExplicit})
-		if err != nil {
-			t.Fatalf("Unexpected error: %v", err)
+	checkReserved := func(mem, store uint64) {
+		t.Helper()
+		stats := acc.JetStreamUsageWithReserved()
+		if stats.MemReserved != mem || stats.StoreReserved != store {
+			t.Fatalf("Expected reserved of %d and %d, got %d and %d", mem, store, stats.MemReserved, stats.StoreReserved)
+		}
+		if stats := acc.JetStreamUsage(); stats.MemReserved != 0 || stats.StoreReserved != 0 {
+			t.Fatalf("Expected no reservations in plain usage, got %+v", stats)
 		}
 	}
+	checkReserved(1024, 2048)
 
-	// This one should fail.
-	if _, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "O:22", AckPolicy: server.AckExplicit}); err == nil {
-		t.Fatalf("Expected error adding consumer over the limit")
+	// Reservations are cumulative across streams.
+	if _, err := acc.AddStream(&server.StreamConfig{Name: "M2", Storage: server.MemoryStorage, MaxBytes: 3500}); err == nil {
+		t.Fatalf("Expected an error exceeding reserved memory")
+	}
+	checkReserved(1024, 2048)
+
+	cfg := mset.Config()
+	cfg.MaxBytes = 2048
+	if err := mset.Update(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
+	checkReserved(2048, 2048)
+
+	mset.Delete()
+	checkReserved(0, 2048)
 }
 
-func TestJetStreamStreamStorageTrackingAndLimits(t *testing.T) {
+func TestJetStreamAccountBytes(t *testing.T) {
 	s := RunBasicJetStreamServer()
 	defer s.Shutdown()
 
@@ -6582,947 +6808,1323 @@ func TestJetStreamStreamStorageTrackingAndLimits(t *testing.T) {
 		defer os.RemoveAll(config.StoreDir)
 	}
 
-	gacc := s.GlobalAccount()
-
-	al := &server.JetStreamAccountLimits{
-		MaxMemory:    8192,
-		MaxStore:     -1,
-		MaxStreams:   -1,
-		MaxConsumers: -1,
+	if mem, file, total := s.SystemAccount().JetStreamBytes(); mem != 0 || file != 0 || total != 0 {
+		t.Fatalf("Expected no usage without JetStream, got %d, %d, %d", mem, file, total)
 	}
 
-	if err := gacc.UpdateJetStreamLimits(al); err != nil {
-		t.Fatalf("Unexpected error updating jetstream account limits: %v", err)
+	acc := s.GlobalAccount()
+	if _, err := acc.AddStream(&server.StreamConfig{Name: "M", Storage: server.MemoryStorage}); err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
-
-	mset, err := gacc.AddStream(&server.StreamConfig{Name: "LIMITS", Storage: server.MemoryStorage, Retention: server.WorkQueuePolicy})
-	if err != nil {
+	if _, err := acc.AddStream(&server.StreamConfig{Name: "F", Storage: server.FileStorage}); err != nil {
 		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
-	defer mset.Delete()
 
 	nc := clientConnectToServer(t, s)
 	defer nc.Close()
+	for i := 0; i < 10; i++ {
+		sendStreamMsg(t, nc, "M", "Hello World")
+	}
+	for i := 0; i < 5; i++ {
+		sendStreamMsg(t, nc, "F", "Hello World")
+	}
 
-	toSend := 100
-	for i := 0; i < toSend; i++ {
-		sendStreamMsg(t, nc, "LIMITS", "Hello World!")
+	stats := acc.JetStreamUsage()
+	mem, file, total := acc.JetStreamBytes()
+	if mem == 0 || file == 0 {
+		t.Fatalf("Expected usage for both storage types, got %d and %d", mem, file)
+	}
+	if mem != stats.Memory || file != stats.Store || total != mem+file {
+		t.Fatalf("Expected %d, %d, %d to match usage %+v", mem, file, total, stats)
 	}
+}
 
-	state := mset.State()
-	usage := gacc.JetStreamUsage()
+func TestJetStreamPrometheus(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
 
-	// Make sure these are working correctly.
-	if state.Bytes != usage.Memory {
-		t.Fatalf("Expected to have stream bytes match memory usage, %d vs %d", state.Bytes, usage.Memory)
-	}
-	if usage.Streams != 1 {
-		t.Fatalf("Expected to have 1 stream, got %d", usage.Streams)
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
 	}
 
-	// Do second stream.
-	mset2, err := gacc.AddStream(&server.StreamConfig{Name: "NUM22", Storage: server.MemoryStorage, Retention: server.WorkQueuePolicy})
+	acc := s.GlobalAccount()
+	mset, err := acc.AddStream(&server.StreamConfig{Name: "M", Storage: server.MemoryStorage})
 	if err != nil {
 		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
-	defer mset2.Delete()
-
-	for i := 0; i < toSend; i++ {
-		sendStreamMsg(t, nc, "NUM22", "Hello World!")
+	if _, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "dlc", AckPolicy: server.AckExplicit}); err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
 	}
 
-	stats2 := mset2.State()
-	usage = gacc.JetStreamUsage()
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+	sendStreamMsg(t, nc, "M", "Hello World")
 
-	if usage.Memory != (state.Bytes + stats2.Bytes) {
-		t.Fatalf("Expected to track both streams, account is %v, stream1 is %v, stream2 is %v", usage.Memory, state.Bytes, stats2.Bytes)
+	var buf bytes.Buffer
+	if err := s.JetStreamPrometheus(&buf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
-
-	// Make sure delete works.
-	mset2.Delete()
-	stats2 = mset2.State()
-	usage = gacc.JetStreamUsage()
-
-	if usage.Memory != (state.Bytes + stats2.Bytes) {
-		t.Fatalf("Expected to track both streams, account is %v, stream1 is %v, stream2 is %v", usage.Memory, state.Bytes, stats2.Bytes)
+	out := buf.String()
+
+	stats := acc.JetStreamUsage()
+	for _, line := range []string{
+		"# TYPE nats_jetstream_account_memory_bytes gauge\n",
+		fmt.Sprintf("nats_jetstream_account_memory_bytes{account=\"$G\"} %d\n", stats.Memory),
+		"nats_jetstream_account_streams{account=\"$G\"} 1\n",
+		"nats_jetstream_account_consumers{account=\"$G\"} 1\n",
+		fmt.Sprintf("nats_jetstream_server_max_memory_bytes %d\n", s.JetStreamConfig().MaxMemory),
+	} {
+		if !strings.Contains(out, line) {
+			t.Fatalf("Expected output to contain %q, got:\n%s", line, out)
+		}
 	}
-
-	// Now drain the first one by consuming the messages.
-	o, err := mset.AddConsumer(workerModeConfig("WQ"))
-	if err != nil {
-		t.Fatalf("Expected no error with registered interest, got %v", err)
+	if !strings.HasSuffix(out, "# EOF\n") {
+		t.Fatalf("Expected output to end with EOF marker, got:\n%s", out)
 	}
-	defer o.Delete()
+}
 
-	for i := 0; i < toSend; i++ {
-		msg, err := nc.Request(o.RequestNextMsgSubject(), nil, time.Second)
-		if err != nil {
-			t.Fatalf("Unexpected error: %v", err)
-		}
-		msg.Respond(nil)
+func TestJetStreamPurgeStreamBefore(t *testing.T) {
+	cases := []struct {
+		name    string
+		mconfig *server.StreamConfig
+	}{
+		{"MemoryStore", &server.StreamConfig{Name: "P", Storage: server.MemoryStorage}},
+		{"FileStore", &server.StreamConfig{Name: "P", Storage: server.FileStorage}},
 	}
-	nc.Flush()
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := RunBasicJetStreamServer()
+			defer s.Shutdown()
 
-	state = mset.State()
-	usage = gacc.JetStreamUsage()
+			if config := s.JetStreamConfig(); config != nil {
+				defer os.RemoveAll(config.StoreDir)
+			}
 
-	if usage.Memory != 0 {
-		t.Fatalf("Expected usage memeory to be 0, got %d", usage.Memory)
-	}
+			acc := s.GlobalAccount()
+			mset, err := acc.AddStream(c.mconfig)
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			o, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "dlc", AckPolicy: server.AckExplicit})
+			if err != nil {
+				t.Fatalf("Unexpected error adding consumer: %v", err)
+			}
 
-	// Now send twice the number of messages. Should receive an error at some point, and we will check usage against limits.
-	var errSeen string
-	for i := 0; i < toSend*2; i++ {
-		resp, _ := nc.Request("LIMITS", []byte("The quick brown fox jumped over the..."), 50*time.Millisecond)
-		if string(resp.Data) != server.OK {
-			errSeen = string(resp.Data)
-			break
-		}
+			nc := clientConnectToServer(t, s)
+			defer nc.Close()
+
+			for i := 1; i <= 5; i++ {
+				sendStreamMsg(t, nc, "P", fmt.Sprintf("MSG-%d", i))
+			}
+			// Have one acked and one pending before the cutoff.
+			for i := 0; i < 2; i++ {
+				m, err := nc.Request(o.RequestNextMsgSubject(), nil, time.Second)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if i == 0 {
+					m.Respond(nil)
+				}
+			}
+			nc.Flush()
+
+			time.Sleep(10 * time.Millisecond)
+			cutoff := time.Now()
+			time.Sleep(10 * time.Millisecond)
+
+			for i := 6; i <= 10; i++ {
+				sendStreamMsg(t, nc, "P", fmt.Sprintf("MSG-%d", i))
+			}
+			before := acc.JetStreamUsage()
+
+			purged, err := acc.PurgeStreamBefore("P", cutoff)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if purged != 5 {
+				t.Fatalf("Expected 5 messages purged, got %d", purged)
+			}
+			if state := mset.State(); state.Msgs != 5 || state.FirstSeq != 6 {
+				t.Fatalf("Unexpected state after purge: %+v", state)
+			}
+			after := acc.JetStreamUsage()
+			if after.Memory+after.Store >= before.Memory+before.Store {
+				t.Fatalf("Expected usage to drop, got %+v vs %+v", after, before)
+			}
+
+			info := o.Info()
+			if info.AckFloor.Stream != 5 || info.NumAckPending != 0 || info.NumPending != 5 {
+				t.Fatalf("Unexpected consumer info after purge: %+v", info)
+			}
+			m, err := nc.Request(o.RequestNextMsgSubject(), nil, time.Second)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if string(m.Data) != "MSG-6" {
+				t.Fatalf("Expected next message to be %q, got %q", "MSG-6", m.Data)
+			}
+
+			// Nothing left to purge.
+			if purged, err := acc.PurgeStreamBefore("P", cutoff); err != nil || purged != 0 {
+				t.Fatalf("Expected nothing purged, got %d, %v", purged, err)
+			}
+			if _, err := acc.PurgeStreamBefore("NOPE", cutoff); err == nil {
+				t.Fatalf("Expected an error for an unknown stream")
+			}
+		})
 	}
+}
 
-	if errSeen == "" {
-		t.Fatalf("Expected to see an error when exceeding the account limits")
+func TestJetStreamPurgeStreamBeforeInteriorDeletes(t *testing.T) {
+	cases := []struct {
+		name    string
+		mconfig *server.StreamConfig
+	}{
+		{"MemoryStore", &server.StreamConfig{Name: "P", Storage: server.MemoryStorage}},
+		{"FileStore", &server.StreamConfig{Name: "P", Storage: server.FileStorage}},
 	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := RunBasicJetStreamServer()
+			defer s.Shutdown()
 
-	state = mset.State()
-	usage = gacc.JetStreamUsage()
+			if config := s.JetStreamConfig(); config != nil {
+				defer os.RemoveAll(config.StoreDir)
+			}
 
-	if usage.Memory > uint64(al.MaxMemory) {
-		t.Fatalf("Expected memory to not exceed limit of %d, got %d", al.MaxMemory, usage.Memory)
-	}
+			acc := s.GlobalAccount()
+			mset, err := acc.AddStream(c.mconfig)
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
 
-	// make sure that unlimited accounts work
-	al.MaxMemory = -1
+			nc := clientConnectToServer(t, s)
+			defer nc.Close()
 
-	if err := gacc.UpdateJetStreamLimits(al); err != nil {
-		t.Fatalf("Unexpected error updating jetstream account limits: %v", err)
-	}
+			for i := 1; i <= 5; i++ {
+				sendStreamMsg(t, nc, "P", fmt.Sprintf("MSG-%d", i))
+			}
+			for _, seq := range []uint64{2, 4} {
+				if removed, err := mset.DeleteMsg(seq); err != nil || !removed {
+					t.Fatalf("Expected message %d to be removed: %v", seq, err)
+				}
+			}
 
-	for i := 0; i < toSend; i++ {
-		sendStreamMsg(t, nc, "LIMITS", "Hello World!")
+			time.Sleep(10 * time.Millisecond)
+			cutoff := time.Now()
+			time.Sleep(10 * time.Millisecond)
+
+			for i := 6; i <= 10; i++ {
+				sendStreamMsg(t, nc, "P", fmt.Sprintf("MSG-%d", i))
+			}
+			purged, err := acc.PurgeStreamBefore("P", cutoff)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if purged != 3 {
+				t.Fatalf("Expected 3 messages purged, got %d", purged)
+			}
+			if state := mset.State(); state.Msgs != 5 || state.FirstSeq != 6 {
+				t.Fatalf("Unexpected state after purge: %+v", state)
+			}
+		})
 	}
 }
 
-func TestJetStreamStreamFileTrackingAndLimits(t *testing.T) {
+func TestJetStreamDisableAndReenable(t *testing.T) {
 	s := RunBasicJetStreamServer()
 	defer s.Shutdown()
 
-	if config := s.JetStreamConfig(); config != nil {
-		defer os.RemoveAll(config.StoreDir)
+	config := s.JetStreamConfig()
+	if config == nil {
+		t.Fatalf("Expected JetStream to be enabled")
 	}
+	defer os.RemoveAll(config.StoreDir)
 
-	gacc := s.GlobalAccount()
-
-	al := &server.JetStreamAccountLimits{
-		MaxMemory:    8192,
-		MaxStore:     9600,
-		MaxStreams:   -1,
-		MaxConsumers: -1,
+	acc := s.GlobalAccount()
+	if _, err := acc.AddStream(&server.StreamConfig{Name: "D", Storage: server.FileStorage}); err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
-
-	if err := gacc.UpdateJetStreamLimits(al); err != nil {
-		t.Fatalf("Unexpected error updating jetstream account limits: %v", err)
-	}
-
-	mconfig := &server.StreamConfig{Name: "LIMITS", Storage: server.FileStorage, Retention: server.WorkQueuePolicy}
-	mset, err := gacc.AddStream(mconfig)
-	if err != nil {
-		t.Fatalf("Unexpected error adding stream: %v", err)
-	}
-	defer mset.Delete()
-
 	nc := clientConnectToServer(t, s)
 	defer nc.Close()
-
-	toSend := 100
-	for i := 0; i < toSend; i++ {
-		sendStreamMsg(t, nc, "LIMITS", "Hello World!")
+	for i := 0; i < 10; i++ {
+		sendStreamMsg(t, nc, "D", "Hello World")
 	}
 
-	state := mset.State()
-	usage := gacc.JetStreamUsage()
+	// Keep the API busy while we disable.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				nc.Request(server.JSApiAccountInfo, nil, 100*time.Millisecond)
+				acc.LookupStream("D")
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := s.DisableJetStream(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	close(done)
+	wg.Wait()
 
-	// Make sure these are working correctly.
-	if usage.Store != state.Bytes {
-		t.Fatalf("Expected to have stream bytes match the store usage, %d vs %d", usage.Store, state.Bytes)
+	if s.JetStreamEnabled() || acc.JetStreamEnabled() {
+		t.Fatalf("Expected JetStream to be disabled")
 	}
-	if usage.Streams != 1 {
-		t.Fatalf("Expected to have 1 stream, got %d", usage.Streams)
+	if err := s.DisableJetStream(); err != server.ErrJetStreamNotEnabled {
+		t.Fatalf("Expected not enabled error, got %v", err)
+	}
+	if _, err := nc.Request(server.JSApiAccountInfo, nil, 250*time.Millisecond); err == nil {
+		t.Fatalf("Expected no response from the JetStream API")
+	}
+	// Core messaging is unaffected.
+	sub, _ := nc.SubscribeSync("core")
+	nc.Publish("core", []byte("ok"))
+	if _, err := sub.NextMsg(time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
 
-	// Do second stream.
-	mconfig2 := &server.StreamConfig{Name: "NUM22", Storage: server.FileStorage, Retention: server.WorkQueuePolicy}
-	mset2, err := gacc.AddStream(mconfig2)
+	// Enable again and make sure our data is still there.
+	if err := s.EnableJetStream(config); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mset, err := acc.LookupStream("D")
 	if err != nil {
-		t.Fatalf("Unexpected error adding stream: %v", err)
+		t.Fatalf("Expected stream to be recovered: %v", err)
 	}
-	defer mset2.Delete()
-
-	for i := 0; i < toSend; i++ {
-		sendStreamMsg(t, nc, "NUM22", "Hello World!")
+	if msgs := mset.State().Msgs; msgs != 10 {
+		t.Fatalf("Expected 10 messages, got %d", msgs)
 	}
+	sendStreamMsg(t, nc, "D", "Hello Again")
+}
 
-	stats2 := mset2.State()
-	usage = gacc.JetStreamUsage()
+func TestJetStreamAPIPrefix(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
 
-	if usage.Store != (state.Bytes + stats2.Bytes) {
-		t.Fatalf("Expected to track both streams, usage is %v, stream1 is %v, stream2 is %v", usage.Store, state.Bytes, stats2.Bytes)
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
 	}
 
-	// Make sure delete works.
-	mset2.Delete()
-	stats2 = mset2.State()
-	usage = gacc.JetStreamUsage()
+	acc := s.GlobalAccount()
+	if err := acc.SetJetStreamAPIPrefix("foo.*"); err == nil {
+		t.Fatalf("Expected an error for a wildcard prefix")
+	}
+	if err := acc.SetJetStreamAPIPrefix("acme"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
 
-	if usage.Store != (state.Bytes + stats2.Bytes) {
-		t.Fatalf("Expected to track both streams, account is %v, stream1 is %v, stream2 is %v", usage.Store, state.Bytes, stats2.Bytes)
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	if _, err := nc.Request(server.JSApiAccountInfo, nil, 250*time.Millisecond); err == nil {
+		t.Fatalf("Expected no response on the default API subject")
+	}
+	resp, err := nc.Request("acme."+server.JSApiAccountInfo, nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var info server.JSApiAccountInfoResponse
+	if err := json.Unmarshal(resp.Data, &info); err != nil || info.Error != nil {
+		t.Fatalf("Unexpected response: %q, %v", resp.Data, err)
 	}
 
-	// Now drain the first one by consuming the messages.
-	o, err := mset.AddConsumer(workerModeConfig("WQ"))
+	// Requests that carry tokens are mapped through as well.
+	req, _ := json.Marshal(&server.StreamConfig{Name: "ORDERS", Storage: server.MemoryStorage})
+	resp, err = nc.Request("acme."+fmt.Sprintf(server.JSApiStreamCreateT, "ORDERS"), req, time.Second)
 	if err != nil {
-		t.Fatalf("Expected no error with registered interest, got %v", err)
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var scResp server.JSApiStreamCreateResponse
+	if err := json.Unmarshal(resp.Data, &scResp); err != nil || scResp.Error != nil {
+		t.Fatalf("Unexpected response: %q, %v", resp.Data, err)
+	}
+	if _, err := acc.LookupStream("ORDERS"); err != nil {
+		t.Fatalf("Expected stream to be created: %v", err)
 	}
-	defer o.Delete()
 
-	for i := 0; i < toSend; i++ {
-		msg, err := nc.Request(o.RequestNextMsgSubject(), nil, time.Second)
-		if err != nil {
-			t.Fatalf("Unexpected error: %v", err)
-		}
-		msg.Respond(nil)
+	// Back to the default.
+	if err := acc.SetJetStreamAPIPrefix(""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
-	nc.Flush()
+	if _, err := nc.Request(server.JSApiAccountInfo, nil, time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := nc.Request("acme."+server.JSApiAccountInfo, nil, 250*time.Millisecond); err == nil {
+		t.Fatalf("Expected no response on the prefixed API subject")
+	}
+}
 
-	state = mset.State()
-	usage = gacc.JetStreamUsage()
+func TestJetStreamApplyStreamConfigs(t *testing.T) {
+	s := RunRandClientPortServer()
+	defer s.Shutdown()
 
-	if usage.Memory != 0 {
-		t.Fatalf("Expected usage memeory to be 0, got %d", usage.Memory)
+	acc, _ := s.LookupOrRegisterAccount("FOO")
+	storeDir, _ := ioutil.TempDir(os.TempDir(), "jstests-storedir-")
+	defer os.RemoveAll(storeDir)
+	if err := s.EnableJetStream(&server.JetStreamConfig{MaxMemory: 64 * 1024, MaxStore: 64 * 1024, StoreDir: storeDir}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	limits := &server.JetStreamAccountLimits{MaxMemory: 4096, MaxStore: 4096, MaxStreams: 3, MaxConsumers: -1}
+	if err := acc.EnableJetStream(limits); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
 
-	// Now send twice the number of messages. Should receive an error at some point, and we will check usage against limits.
-	var errSeen string
-	for i := 0; i < toSend*2; i++ {
-		resp, _ := nc.Request("LIMITS", []byte("The quick brown fox jumped over the..."), 50*time.Millisecond)
-		if string(resp.Data) != server.OK {
-			errSeen = string(resp.Data)
-			break
+	checkNames := func(kind string, got []string, expected ...string) {
+		t.Helper()
+		if len(got) != len(expected) {
+			t.Fatalf("Expected %s streams %v, got %v", kind, expected, got)
+		}
+		for i := range got {
+			if got[i] != expected[i] {
+				t.Fatalf("Expected %s streams %v, got %v", kind, expected, got)
+			}
 		}
 	}
 
-	if errSeen == "" {
-		t.Fatalf("Expected to see an error when exceeding the account limits")
+	created, updated, unchanged, err := acc.ApplyStreamConfigs([]*server.StreamConfig{
+		{Name: "A", Storage: server.MemoryStorage, MaxBytes: 1024},
+		{Name: "B", Storage: server.MemoryStorage, Subjects: []string{"b.>"}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
+	checkNames("created", created, "A", "B")
+	checkNames("updated", updated)
+	checkNames("unchanged", unchanged)
 
-	state = mset.State()
-	usage = gacc.JetStreamUsage()
+	created, updated, unchanged, err = acc.ApplyStreamConfigs([]*server.StreamConfig{
+		{Name: "A", Storage: server.MemoryStorage, MaxBytes: 1024},
+		{Name: "B", Storage: server.MemoryStorage, Subjects: []string{"b.>", "bb"}},
+		{Name: "C", Storage: server.MemoryStorage},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkNames("created", created, "C")
+	checkNames("updated", updated, "B")
+	checkNames("unchanged", unchanged, "A")
 
-	if usage.Memory > uint64(al.MaxMemory) {
-		t.Fatalf("Expected memory to not exceed limit of %d, got %d", al.MaxMemory, usage.Memory)
+	// The whole set must fit before anything is applied.
+	_, _, _, err = acc.ApplyStreamConfigs([]*server.StreamConfig{
+		{Name: "A", Storage: server.MemoryStorage, MaxBytes: 2048},
+		{Name: "C", Storage: server.MemoryStorage, MaxBytes: 3000},
+	})
+	if err == nil {
+		t.Fatalf("Expected an error exceeding account memory")
+	}
+	if mset, _ := acc.LookupStream("A"); mset.Config().MaxBytes != 1024 {
+		t.Fatalf("Expected stream A to be untouched, got %+v", mset.Config())
+	}
+	if _, _, _, err := acc.ApplyStreamConfigs([]*server.StreamConfig{{Name: "D"}}); err == nil {
+		t.Fatalf("Expected an error exceeding maximum streams")
+	}
+	if _, _, _, err := acc.ApplyStreamConfigs([]*server.StreamConfig{{Name: "A"}, {Name: "A"}}); err == nil {
+		t.Fatalf("Expected an error with duplicate stream names")
 	}
-}
 
-type obsi struct {
-	cfg server.ConsumerConfig
-	ack int
-}
-type info struct {
-	cfg   server.StreamConfig
-	state server.StreamState
-	obs   []obsi
+	// A failure while applying should roll back what was already applied.
+	if mset, _ := acc.LookupStream("C"); mset != nil {
+		mset.Delete()
+	}
+	_, _, _, err = acc.ApplyStreamConfigs([]*server.StreamConfig{
+		{Name: "B", Storage: server.MemoryStorage, Subjects: []string{"b.>"}},
+		{Name: "C", Storage: server.MemoryStorage, Subjects: []string{"c.>"}},
+		{Name: "A", Storage: server.FileStorage},
+	})
+	if err == nil {
+		t.Fatalf("Expected an error changing storage type")
+	}
+	if mset, _ := acc.LookupStream("C"); mset != nil {
+		t.Fatalf("Expected stream C to be removed on rollback")
+	}
+	if mset, _ := acc.LookupStream("B"); len(mset.Config().Subjects) != 2 {
+		t.Fatalf("Expected stream B to be restored on rollback, got %+v", mset.Config())
+	}
 }
 
-func TestJetStreamSimpleFileRecovery(t *testing.T) {
-	base := runtime.NumGoroutine()
-
+func TestJetStreamEnableAccountBeforeServer(t *testing.T) {
 	s := RunRandClientPortServer()
 	defer s.Shutdown()
 
-	jsconfig := &server.JetStreamConfig{MaxMemory: 128 * 1024 * 1024, MaxStore: 32 * 1024 * 1024 * 1024}
-	if err := s.EnableJetStream(jsconfig); err != nil {
+	acc, _ := s.LookupOrRegisterAccount("FOO")
+	limits := &server.JetStreamAccountLimits{MaxMemory: 4096, MaxStore: 8192, MaxStreams: 2, MaxConsumers: -1}
+	if err := acc.EnableJetStream(limits); err != server.ErrJetStreamNotEnabled {
+		t.Fatalf("Expected not enabled error while the request is held, got %v", err)
+	}
+	if acc.JetStreamEnabled() {
+		t.Fatalf("Did not expect account to be enabled before the server")
+	}
+	if _, err := acc.AddStream(&server.StreamConfig{Name: "S"}); err == nil {
+		t.Fatalf("Expected an error adding a stream before the server is enabled")
+	}
+
+	storeDir, _ := ioutil.TempDir(os.TempDir(), "jstests-storedir-")
+	defer os.RemoveAll(storeDir)
+	if err := s.EnableJetStream(&server.JetStreamConfig{MaxMemory: 64 * 1024, MaxStore: 64 * 1024, StoreDir: storeDir}); err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
+	if !acc.JetStreamEnabled() {
+		t.Fatalf("Expected account to be enabled along with the server")
+	}
+	if stats := acc.JetStreamUsage(); stats.Limits != *limits {
+		t.Fatalf("Expected limits of %+v, got %+v", limits, stats.Limits)
+	}
+	if _, err := acc.AddStream(&server.StreamConfig{Name: "S"}); err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+}
+
+func TestJetStreamAlreadyEnabledError(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
 
 	if config := s.JetStreamConfig(); config != nil {
 		defer os.RemoveAll(config.StoreDir)
 	}
 
-	acc := s.GlobalAccount()
+	err := s.EnableJetStream(nil)
+	if !errors.Is(err, server.ErrJetStreamAlreadyEnabled) {
+		t.Fatalf("Expected already enabled error, got %v", err)
+	}
+	if err.Error() != "jetstream already enabled" {
+		t.Fatalf("Unexpected error text: %q", err)
+	}
+	err = s.GlobalAccount().EnableJetStream(nil)
+	if !errors.Is(err, server.ErrJetStreamAlreadyEnabled) {
+		t.Fatalf("Expected already enabled error, got %v", err)
+	}
+	if err.Error() != "jetstream already enabled for account" {
+		t.Fatalf("Unexpected error text: %q", err)
+	}
+}
 
-	ostate := make(map[string]info)
+func TestJetStreamMaxHeaderSize(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: 127.0.0.1:-1
+		jetstream: {max_mem_store: 64GB, max_file_store: 10TB}
+		accounts: {
+			FOO: {
+				jetstream: {max_mem: 1GB, max_store: 1GB, max_header_size: 64}
+				users: [ {user: foo, password: pwd} ]
+			},
+		}
+		no_auth_user: foo
+	`))
+	defer os.Remove(conf)
 
-	nid := nuid.New()
-	randomSubject := func() string {
-		nid.RandomizePrefix()
-		return fmt.Sprintf("SUBJ.%s", nid.Next())
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	acc, err := s.LookupAccount("FOO")
+	if err != nil {
+		t.Fatalf("Unexpected error looking up account: %v", err)
+	}
+	if mhs := acc.JetStreamUsage().Limits.MaxHeaderSize; mhs != 64 {
+		t.Fatalf("Expected max header size of 64, got %d", mhs)
+	}
+	mset, err := acc.AddStream(&server.StreamConfig{Name: "HDRS", Storage: server.MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
 
 	nc := clientConnectToServer(t, s)
 	defer nc.Close()
 
-	numStreams := 10
-	for i := 1; i <= numStreams; i++ {
-		msetName := fmt.Sprintf("MMS-%d", i)
-		subjects := []string{randomSubject(), randomSubject(), randomSubject()}
-		msetConfig := server.StreamConfig{
-			Name:     msetName,
-			Storage:  server.FileStorage,
-			Subjects: subjects,
-			MaxMsgs:  100,
-		}
-		mset, err := acc.AddStream(&msetConfig)
+	pub := func(hv string) *server.JSPubAckResponse {
+		t.Helper()
+		m := nats.NewMsg("HDRS")
+		m.Header.Add("X-Test", hv)
+		m.Data = []byte("OK")
+		resp, err := nc.RequestMsg(m, time.Second)
 		if err != nil {
-			t.Fatalf("Unexpected error adding stream: %v", err)
-		}
-		defer mset.Delete()
-
-		toSend := rand.Intn(100) + 1
-		for n := 1; n <= toSend; n++ {
-			msg := fmt.Sprintf("Hello %d", n*i)
-			subj := subjects[rand.Intn(len(subjects))]
-			sendStreamMsg(t, nc, subj, msg)
+			t.Fatalf("Unexpected error: %v", err)
 		}
-		// Create up to 5 consumers.
-		numObs := rand.Intn(5) + 1
-		var obs []obsi
-		for n := 1; n <= numObs; n++ {
-			oname := fmt.Sprintf("WQ-%d", n)
-			o, err := mset.AddConsumer(workerModeConfig(oname))
-			if err != nil {
-				t.Fatalf("Unexpected error: %v", err)
-			}
-			// Now grab some messages.
-			toReceive := rand.Intn(toSend) + 1
-			for r := 0; r < toReceive; r++ {
-				resp, _ := nc.Request(o.RequestNextMsgSubject(), nil, time.Second)
-				if resp != nil {
-					resp.Respond(nil)
-				}
-			}
-			obs = append(obs, obsi{o.Config(), toReceive})
+		var pa server.JSPubAckResponse
+		if err := json.Unmarshal(resp.Data, &pa); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
 		}
-		ostate[msetName] = info{mset.Config(), mset.State(), obs}
+		return &pa
 	}
-	pusage := acc.JetStreamUsage()
 
-	// Shutdown the server. Restart and make sure things come back.
-	s.Shutdown()
+	if pa := pub("small"); pa.Error != nil {
+		t.Fatalf("Unexpected error: %+v", pa.Error)
+	}
+	pa := pub(strings.Repeat("X", 128))
+	if pa.Error == nil || pa.Error.Description != server.ErrMaxHeaderSize.Error() {
+		t.Fatalf("Expected a header size error, got %+v", pa.Error)
+	}
+	if state := mset.State(); state.Msgs != 1 {
+		t.Fatalf("Expected only 1 message, got %d", state.Msgs)
+	}
+}
 
-	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
-		delta := (runtime.NumGoroutine() - base)
-		if delta > 3 {
-			return fmt.Errorf("%d Go routines still exist post Shutdown()", delta)
+func TestJetStreamMaxDedupeWindow(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: 127.0.0.1:-1
+		jetstream: {max_mem_store: 64GB, max_file_store: 10TB}
+		accounts: {
+			FOO: {
+				jetstream: {max_mem: 1GB, max_store: 1GB, max_dedupe_window: "1m", dedupe_window: "30s"}
+				users: [ {user: foo, password: pwd} ]
+			},
+			BAR: {
+				jetstream: {max_mem: 1GB, max_store: 1GB, max_dedupe_window: "1m"}
+				users: [ {user: bar, password: pwd} ]
+			},
 		}
-		return nil
-	})
+	`))
+	defer os.Remove(conf)
 
-	s = RunRandClientPortServer()
+	s, _ := RunServerWithConfig(conf)
 	defer s.Shutdown()
-
-	if err := s.EnableJetStream(jsconfig); err != nil {
-		t.Fatalf("Expected no error, got %v", err)
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
 	}
 
-	acc = s.GlobalAccount()
+	foo, err := s.LookupAccount("FOO")
+	if err != nil {
+		t.Fatalf("Unexpected error looking up account: %v", err)
+	}
+	bar, err := s.LookupAccount("BAR")
+	if err != nil {
+		t.Fatalf("Unexpected error looking up account: %v", err)
+	}
+	if limits := foo.JetStreamUsage().Limits; limits.MaxDedupeWindow != time.Minute || limits.DedupeWindow != 30*time.Second {
+		t.Fatalf("Unexpected limits: %+v", limits)
+	}
 
-	nusage := acc.JetStreamUsage()
-	if nusage != pusage {
-		t.Fatalf("Usage does not match after restore: %+v vs %+v", nusage, pusage)
+	// Unset windows pick up the account default.
+	mset, err := foo.AddStream(&server.StreamConfig{Name: "S1", Storage: server.MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	if dw := mset.Config().Duplicates; dw != 30*time.Second {
+		t.Fatalf("Expected duplicates window of 30s, got %v", dw)
+	}
+	// But still respect max age.
+	mset, err = foo.AddStream(&server.StreamConfig{Name: "S2", Storage: server.MemoryStorage, MaxAge: 10 * time.Second})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	if dw := mset.Config().Duplicates; dw != 10*time.Second {
+		t.Fatalf("Expected duplicates window of 10s, got %v", dw)
+	}
+	// Without a default, the stream default is capped.
+	mset, err = bar.AddStream(&server.StreamConfig{Name: "S1", Storage: server.MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	if dw := mset.Config().Duplicates; dw != time.Minute {
+		t.Fatalf("Expected duplicates window of 1m, got %v", dw)
 	}
 
-	for mname, info := range ostate {
-		mset, err := acc.LookupStream(mname)
-		if err != nil {
-			t.Fatalf("Expected to find a stream for %q", mname)
-		}
-		if state := mset.State(); !reflect.DeepEqual(state, info.state) {
-			t.Fatalf("State does not match: %+v vs %+v", state, info.state)
-		}
-		if cfg := mset.Config(); !reflect.DeepEqual(cfg, info.cfg) {
-			t.Fatalf("Configs do not match: %+v vs %+v", cfg, info.cfg)
-		}
-		// Consumers.
-		if mset.NumConsumers() != len(info.obs) {
-			t.Fatalf("Number of consumers do not match: %d vs %d", mset.NumConsumers(), len(info.obs))
-		}
-		for _, oi := range info.obs {
-			if o := mset.LookupConsumer(oi.cfg.Durable); o != nil {
-				if uint64(oi.ack+1) != o.NextSeq() {
-					t.Fatalf("Consumer next seq is not correct: %d vs %d", oi.ack+1, o.NextSeq())
-				}
-			} else {
-				t.Fatalf("Expected to get an consumer")
-			}
-		}
+	// Explicit windows above the cap are rejected.
+	if _, err := foo.AddStream(&server.StreamConfig{Name: "S3", Storage: server.MemoryStorage, Duplicates: time.Hour}); err == nil {
+		t.Fatalf("Expected an error for a duplicates window above the account maximum")
+	}
+	if _, err := foo.AddStream(&server.StreamConfig{Name: "S3", Storage: server.MemoryStorage, Duplicates: time.Minute}); err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	cfg := mset.Config()
+	cfg.Duplicates = 2 * time.Minute
+	if err := mset.Update(&cfg); err == nil {
+		t.Fatalf("Expected an error updating to a duplicates window above the account maximum")
 	}
 }
 
-func TestJetStreamInfoAPIWithHeaders(t *testing.T) {
-	s := RunBasicJetStreamServer()
-	defer s.Shutdown()
+func TestJetStreamStreamCountAlarm(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: 127.0.0.1:-1
+		jetstream: {max_mem_store: 64GB, max_file_store: 10TB}
+		accounts: {
+			FOO: {
+				jetstream: {max_mem: 1GB, max_store: 1GB, max_streams: 10}
+				users: [ {user: foo, password: pwd} ]
+			},
+		}
+		no_auth_user: foo
+	`))
+	defer os.Remove(conf)
 
-	// Forced cleanup of all persisted state.
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
 	if config := s.JetStreamConfig(); config != nil {
 		defer os.RemoveAll(config.StoreDir)
 	}
 
-	// Client for API requests.
+	acc, err := s.LookupAccount("FOO")
+	if err != nil {
+		t.Fatalf("Unexpected error looking up account: %v", err)
+	}
+
 	nc := clientConnectToServer(t, s)
 	defer nc.Close()
+	sub, _ := nc.SubscribeSync(server.JSAdvisoryAccountStreamCount)
+	nc.Flush()
 
-	m := nats.NewMsg(server.JSApiAccountInfo)
-	m.Header.Add("Accept-Encoding", "json")
-	m.Header.Add("Authorization", "s3cr3t")
-	m.Data = []byte("HELLO-JS!")
+	addStreams := func(from, to int) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			if _, err := acc.AddStream(&server.StreamConfig{Name: fmt.Sprintf("S%d", i), Storage: server.MemoryStorage}); err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+		}
+	}
+	checkAlarms := func(expected int) {
+		t.Helper()
+		nc.Flush()
+		checkFor(t, time.Second, 10*time.Millisecond, func() error {
+			if n, _, _ := sub.Pending(); n != expected {
+				return fmt.Errorf("Expected %d advisories, got %d", expected, n)
+			}
+			return nil
+		})
+	}
 
-	resp, err := nc.RequestMsg(m, time.Second)
+	addStreams(0, 8)
+	checkAlarms(0)
+	addStreams(8, 10)
+	checkAlarms(1)
+
+	m, err := sub.NextMsg(time.Second)
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
-
-	var info server.JSApiAccountInfoResponse
-	if err := json.Unmarshal(resp.Data, &info); err != nil {
+	var adv server.JSAccountStreamCountAdvisory
+	if err := json.Unmarshal(m.Data, &adv); err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
-	if info.Error != nil {
-		t.Fatalf("Received an error: %+v", info.Error)
+	if adv.Type != server.JSAccountStreamCountAdvisoryType || adv.Account != "FOO" || adv.Streams != 9 || adv.MaxStreams != 10 {
+		t.Fatalf("Unexpected advisory: %+v", adv)
+	}
+
+	// Dropping below the threshold should re-arm the alarm.
+	for _, name := range []string{"S9", "S8"} {
+		mset, err := acc.LookupStream(name)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		mset.Delete()
 	}
+	checkAlarms(0)
+	addStreams(8, 9)
+	checkAlarms(1)
 }
 
-func TestJetStreamRequestAPI(t *testing.T) {
+func TestJetStreamLookupStreams(t *testing.T) {
 	s := RunBasicJetStreamServer()
 	defer s.Shutdown()
 
-	// Forced cleanup of all persisted state.
 	if config := s.JetStreamConfig(); config != nil {
 		defer os.RemoveAll(config.StoreDir)
 	}
 
-	// Client for API requests.
-	nc := clientConnectToServer(t, s)
-	defer nc.Close()
-
-	// This will get the current information about usage and limits for this account.
-	resp, err := nc.Request(server.JSApiAccountInfo, nil, time.Second)
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-	var info server.JSApiAccountInfoResponse
-	if err := json.Unmarshal(resp.Data, &info); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	acc := s.GlobalAccount()
+	for _, name := range []string{"ORDERS-EU", "ORDERS-US", "INVOICES"} {
+		if _, err := acc.AddStream(&server.StreamConfig{Name: name, Storage: server.MemoryStorage}); err != nil {
+			t.Fatalf("Unexpected error adding stream: %v", err)
+		}
 	}
 
-	// Now create a stream.
-	msetCfg := server.StreamConfig{
-		Name:     "MSET22",
-		Storage:  server.FileStorage,
-		Subjects: []string{"foo", "bar", "baz"},
-		MaxMsgs:  100,
-	}
-	req, err := json.Marshal(msetCfg)
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	check := func(pattern string, expected ...string) {
+		t.Helper()
+		msets, err := acc.LookupStreams(pattern)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if msets == nil || len(msets) != len(expected) {
+			t.Fatalf("Expected %d streams for %q, got %d", len(expected), pattern, len(msets))
+		}
+		for i, mset := range msets {
+			if mset.Name() != expected[i] {
+				t.Fatalf("Expected stream %q, got %q", expected[i], mset.Name())
+			}
+		}
 	}
-	resp, _ = nc.Request(fmt.Sprintf(server.JSApiStreamCreateT, msetCfg.Name), req, time.Second)
-	var scResp server.JSApiStreamCreateResponse
-	if err := json.Unmarshal(resp.Data, &scResp); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	check("ORDERS-*", "ORDERS-EU", "ORDERS-US")
+	check("*", "INVOICES", "ORDERS-EU", "ORDERS-US")
+	check("ORDERS-?U", "ORDERS-EU")
+	check("INVOICES", "INVOICES")
+	check("NOPE*")
+
+	if _, err := acc.LookupStreams("ORDERS-["); err == nil {
+		t.Fatalf("Expected an error with an invalid pattern")
 	}
-	if scResp.StreamInfo == nil || scResp.Error != nil {
-		t.Fatalf("Did not receive correct response: %+v", scResp.Error)
+	nacc, _ := s.LookupOrRegisterAccount("NOJS")
+	if _, err := nacc.LookupStreams("*"); err != server.ErrJetStreamNotEnabled {
+		t.Fatalf("Expected not enabled error, got %v", err)
 	}
-	if time.Since(scResp.Created) > time.Second {
-		t.Fatalf("Created time seems wrong: %v\n", scResp.Created)
+}
+
+func TestJetStreamSystemLimits(t *testing.T) {
+	s := RunRandClientPortServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
 	}
 
-	checkBadRequest := func(e *server.ApiError, description string) {
-		t.Helper()
-		if e == nil || e.Code != 400 || e.Description != description {
-			t.Fatalf("Did not get proper error: %+v", e)
-		}
+	if _, _, err := s.JetStreamReservedResources(); err == nil {
+		t.Fatalf("Expected error requesting jetstream reserved resources when not enabled")
 	}
+	// Create some accounts.
+	facc, _ := s.LookupOrRegisterAccount("FOO")
+	bacc, _ := s.LookupOrRegisterAccount("BAR")
+	zacc, _ := s.LookupOrRegisterAccount("BAZ")
 
-	checkServerError := func(e *server.ApiError, description string) {
-		t.Helper()
-		if e == nil || e.Code != 500 || e.Description != description {
-			t.Fatalf("Did not get proper server error: %+v\n", e)
-		}
+	jsconfig := &server.JetStreamConfig{MaxMemory: 1024, MaxStore: 8192}
+	if err := s.EnableJetStream(jsconfig); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
 	}
 
-	checkNotFound := func(e *server.ApiError, description string) {
-		t.Helper()
-		if e == nil || e.Code != 404 || e.Description != description {
-			t.Fatalf("Did not get proper server error: %+v\n", e)
-		}
+	if rm, rd, err := s.JetStreamReservedResources(); err != nil {
+		t.Fatalf("Unexpected error requesting jetstream reserved resources: %v", err)
+	} else if rm != 0 || rd != 0 {
+		t.Fatalf("Expected reserved memory and store to be 0, got %d and %d", rm, rd)
 	}
 
-	// Check that the name in config has to match the name in the subject
-	resp, _ = nc.Request(fmt.Sprintf(server.JSApiStreamCreateT, "BOB"), req, time.Second)
-	scResp.Error, scResp.StreamInfo = nil, nil
-	if err := json.Unmarshal(resp.Data, &scResp); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	limits := func(mem int64, store int64) *server.JetStreamAccountLimits {
+		return &server.JetStreamAccountLimits{
+			MaxMemory:    mem,
+			MaxStore:     store,
+			MaxStreams:   -1,
+			MaxConsumers: -1,
+		}
 	}
-	checkBadRequest(scResp.Error, "stream name in subject does not match request")
 
-	// Check that update works.
-	msetCfg.Subjects = []string{"foo", "bar", "baz"}
-	msetCfg.MaxBytes = 2222222
-	req, err = json.Marshal(msetCfg)
-	if err != nil {
+	if err := facc.EnableJetStream(limits(24, 192)); err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
-	resp, _ = nc.Request(fmt.Sprintf(server.JSApiStreamUpdateT, msetCfg.Name), req, time.Second)
-	scResp.Error, scResp.StreamInfo = nil, nil
-	if err := json.Unmarshal(resp.Data, &scResp); err != nil {
+	// Use up rest of our resources in memory
+	if err := bacc.EnableJetStream(limits(1000, 0)); err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
-	if scResp.StreamInfo == nil || scResp.Error != nil {
-		t.Fatalf("Did not receive correct response: %+v", scResp.Error)
-	}
 
-	// Now lookup info again and see that we can see the new stream.
-	resp, err = nc.Request(server.JSApiAccountInfo, nil, time.Second)
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	// Now ask for more memory. Should error.
+	if err := zacc.EnableJetStream(limits(1000, 0)); err == nil {
+		t.Fatalf("Expected an error when exhausting memory resource limits")
 	}
-	if err = json.Unmarshal(resp.Data, &info); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	// Disk too.
+	if err := zacc.EnableJetStream(limits(0, 10000)); err == nil {
+		t.Fatalf("Expected an error when exhausting memory resource limits")
 	}
-	if info.Streams != 1 {
-		t.Fatalf("Expected to see 1 Stream, got %d", info.Streams)
+	facc.DisableJetStream()
+	bacc.DisableJetStream()
+	zacc.DisableJetStream()
+
+	// Make sure we unreserved resources.
+	if rm, rd, err := s.JetStreamReservedResources(); err != nil {
+		t.Fatalf("Unexpected error requesting jetstream reserved resources: %v", err)
+	} else if rm != 0 || rd != 0 {
+		t.Fatalf("Expected reserved memory and store to be 0, got %v and %v", server.FriendlyBytes(rm), server.FriendlyBytes(rd))
 	}
 
-	// Make sure list names works.
-	resp, err = nc.Request(server.JSApiStreams, nil, time.Second)
-	var namesResponse server.JSApiStreamNamesResponse
-	if err = json.Unmarshal(resp.Data, &namesResponse); err != nil {
+	if err := facc.EnableJetStream(limits(24, 192)); err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
+	// Test Adjust
+	l := limits(jsconfig.MaxMemory, jsconfig.MaxStore)
+	l.MaxStreams = 10
+	l.MaxConsumers = 10
 
-	if len(namesResponse.Streams) != 1 {
-		t.Fatalf("Expected only 1 stream but got %d", len(namesResponse.Streams))
-	}
-	if namesResponse.Total != 1 {
-		t.Fatalf("Expected total to be 1 but got %d", namesResponse.Total)
+	if err := facc.UpdateJetStreamLimits(l); err != nil {
+		t.Fatalf("Unexpected error updating jetstream account limits: %v", err)
 	}
-	if namesResponse.Offset != 0 {
-		t.Fatalf("Expected offset to be 0 but got %d", namesResponse.Offset)
-	}
-	if namesResponse.Limit != server.JSApiNamesLimit {
-		t.Fatalf("Expected limit to be %d but got %d", server.JSApiNamesLimit, namesResponse.Limit)
-	}
-	if namesResponse.Streams[0] != msetCfg.Name {
-		t.Fatalf("Expected to get %q, but got %q", msetCfg.Name, namesResponse.Streams[0])
+
+	var msets []*server.Stream
+	// Now test max streams and max consumers. Note max consumers is per stream.
+	for i := 0; i < 10; i++ {
+		mname := fmt.Sprintf("foo.%d", i)
+		mset, err := facc.AddStream(&server.StreamConfig{Name: strconv.Itoa(i), Storage: server.MemoryStorage, Subjects: []string{mname}})
+		if err != nil {
+			t.Fatalf("Unexpected error adding stream: %v", err)
+		}
+		msets = append(msets, mset)
 	}
 
-	// Now do detailed version.
-	resp, err = nc.Request(server.JSApiStreamList, nil, time.Second)
-	var listResponse server.JSApiStreamListResponse
-	if err = json.Unmarshal(resp.Data, &listResponse); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	// This one should fail since over the limit for max number of streams.
+	if _, err := facc.AddStream(&server.StreamConfig{Name: "22", Storage: server.MemoryStorage, Subjects: []string{"foo.22"}}); err == nil {
+		t.Fatalf("Expected error adding stream over limit")
 	}
 
-	if len(listResponse.Streams) != 1 {
-		t.Fatalf("Expected only 1 stream but got %d", len(listResponse.Streams))
+	// Remove them all
+	for _, mset := range msets {
+		mset.Delete()
 	}
-	if listResponse.Total != 1 {
-		t.Fatalf("Expected total to be 1 but got %d", listResponse.Total)
+
+	// Now try to add one with bytes limit that would exceed the account limit.
+	if _, err := facc.AddStream(&server.StreamConfig{Name: "22", Storage: server.MemoryStorage, MaxBytes: jsconfig.MaxStore * 2}); err == nil {
+		t.Fatalf("Expected error adding stream over limit")
 	}
-	if listResponse.Offset != 0 {
-		t.Fatalf("Expected offset to be 0 but got %d", listResponse.Offset)
+
+	// Replicas can't be > 1
+	if _, err := facc.AddStream(&server.StreamConfig{Name: "22", Storage: server.MemoryStorage, Replicas: 10}); err == nil {
+		t.Fatalf("Expected error adding stream over limit")
 	}
-	if listResponse.Limit != server.JSApiListLimit {
-		t.Fatalf("Expected limit to be %d but got %d", server.JSApiListLimit, listResponse.Limit)
+
+	// Test consumers limit against account limit when the stream does not set a limit
+	mset, err := facc.AddStream(&server.StreamConfig{Name: "22", Storage: server.MemoryStorage, Subjects: []string{"foo.22"}})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
-	if listResponse.Streams[0].Config.Name != msetCfg.Name {
-		t.Fatalf("Expected to get %q, but got %q", msetCfg.Name, listResponse.Streams[0].Config.Name)
+
+	for i := 0; i < 10; i++ {
+		oname := fmt.Sprintf("O:%d", i)
+		_, err := mset.AddConsumer(&server.ConsumerConfig{Durable: oname, AckPolicy: server.AckExplicit})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
 	}
 
-	// Now send some messages, then we can poll for info on this stream.
-	toSend := 10
-	for i := 0; i < toSend; i++ {
-		nc.Request("foo", []byte("WELCOME JETSTREAM"), time.Second)
+	// This one should fail.
+	if _, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "O:22", AckPolicy: server.AckExplicit}); err == nil {
+		t.Fatalf("Expected error adding consumer over the limit")
 	}
 
-	resp, err = nc.Request(fmt.Sprintf(server.JSApiStreamInfoT, msetCfg.Name), nil, time.Second)
+	// Test consumer limit against stream limit
+	mset.Delete()
+	mset, err = facc.AddStream(&server.StreamConfig{Name: "22", Storage: server.MemoryStorage, Subjects: []string{"foo.22"}, MaxConsumers: 5})
 	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-	var msi server.StreamInfo
-	if err = json.Unmarshal(resp.Data, &msi); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
-	if msi.State.Msgs != uint64(toSend) {
-		t.Fatalf("Expected to get %d msgs, got %d", toSend, msi.State.Msgs)
+
+	for i := 0; i < 5; i++ {
+		oname := fmt.Sprintf("O:%d", i)
+		_, err := mset.AddConsumer(&server.ConsumerConfig{Durable: oname, AckPolicy: server.AckExplicit})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
 	}
-	if time.Since(msi.Created) > time.Second {
-		t.Fatalf("Created time seems wrong: %v\n", msi.Created)
+
+	// This one should fail.
+	if _, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "O:22", AckPolicy: server.AckExplicit}); err == nil {
+		t.Fatalf("Expected error adding consumer over the limit")
 	}
 
-	// Looking up one that is not there should yield an error.
-	resp, err = nc.Request(fmt.Sprintf(server.JSApiStreamInfoT, "BOB"), nil, time.Second)
+	// Test the account having smaller limits than the stream
+	mset.Delete()
+
+	mset, err = facc.AddStream(&server.StreamConfig{Name: "22", Storage: server.MemoryStorage, Subjects: []string{"foo.22"}, MaxConsumers: 10})
 	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-	var bResp server.JSApiStreamInfoResponse
-	if err = json.Unmarshal(resp.Data, &bResp); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
-	checkNotFound(bResp.Error, "stream not found")
 
-	// Now create a consumer.
-	delivery := nats.NewInbox()
-	obsReq := server.CreateConsumerRequest{
-		Stream: msetCfg.Name,
-		Config: server.ConsumerConfig{DeliverSubject: delivery},
+	l.MaxConsumers = 5
+	if err := facc.UpdateJetStreamLimits(l); err != nil {
+		t.Fatalf("Unexpected error updating jetstream account limits: %v", err)
 	}
-	req, err = json.Marshal(obsReq)
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+
+	for i := 0; i < 5; i++ {
+		oname := fmt.Sprintf("O:%d", i)
+		_, err := mset.AddConsumer(&server.ConsumerConfig{Durable: oname, AckPolicy: server.AckExplicit})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
 	}
-	resp, err = nc.Request(fmt.Sprintf(server.JSApiConsumerCreateT, msetCfg.Name), req, time.Second)
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+
+	// This one should fail.
+	if _, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "O:22", AckPolicy: server.AckExplicit}); err == nil {
+		t.Fatalf("Expected error adding consumer over the limit")
 	}
-	var ccResp server.JSApiConsumerCreateResponse
-	if err = json.Unmarshal(resp.Data, &ccResp); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+}
+
+func TestJetStreamStreamStorageTrackingAndLimits(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
 	}
-	checkServerError(ccResp.Error, "consumer requires interest for delivery subject when ephemeral")
 
-	// Now create subscription and make sure we get proper response.
-	sub, _ := nc.SubscribeSync(delivery)
-	nc.Flush()
+	gacc := s.GlobalAccount()
 
-	resp, err = nc.Request(fmt.Sprintf(server.JSApiConsumerCreateT, msetCfg.Name), req, time.Second)
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	al := &server.JetStreamAccountLimits{
+		MaxMemory:    8192,
+		MaxStore:     -1,
+		MaxStreams:   -1,
+		MaxConsumers: -1,
 	}
-	ccResp.Error, ccResp.ConsumerInfo = nil, nil
-	if err = json.Unmarshal(resp.Data, &ccResp); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+
+	if err := gacc.UpdateJetStreamLimits(al); err != nil {
+		t.Fatalf("Unexpected error updating jetstream account limits: %v", err)
 	}
-	if ccResp.ConsumerInfo == nil || ccResp.Error != nil {
-		t.Fatalf("Got a bad response %+v", ccResp)
+
+	mset, err := gacc.AddStream(&server.StreamConfig{Name: "LIMITS", Storage: server.MemoryStorage, Retention: server.WorkQueuePolicy})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
-	if time.Since(ccResp.Created) > time.Second {
-		t.Fatalf("Created time seems wrong: %v\n", ccResp.Created)
+	defer mset.Delete()
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	toSend := 100
+	for i := 0; i < toSend; i++ {
+		sendStreamMsg(t, nc, "LIMITS", "Hello World!")
 	}
 
-	checkFor(t, 250*time.Millisecond, 10*time.Millisecond, func() error {
-		if nmsgs, _, _ := sub.Pending(); err != nil || nmsgs != toSend {
-			return fmt.Errorf("Did not receive correct number of messages: %d vs %d", nmsgs, toSend)
-		}
-		return nil
-	})
+	state := mset.State()
+	usage := gacc.JetStreamUsage()
 
-	// Check that we get an error if the stream name in the subject does not match the config.
-	resp, err = nc.Request(fmt.Sprintf(server.JSApiConsumerCreateT, "BOB"), req, time.Second)
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	// Make sure these are working correctly.
+	if state.Bytes != usage.Memory {
+		t.Fatalf("Expected to have stream bytes match memory usage, %d vs %d", state.Bytes, usage.Memory)
 	}
-	ccResp.Error, ccResp.ConsumerInfo = nil, nil
-	if err = json.Unmarshal(resp.Data, &ccResp); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	if usage.Streams != 1 {
+		t.Fatalf("Expected to have 1 stream, got %d", usage.Streams)
 	}
-	// Since we do not have interest this should have failed.
-	checkBadRequest(ccResp.Error, "stream name in subject does not match request")
 
-	// Get the list of all of the consumers for our stream.
-	resp, err = nc.Request(fmt.Sprintf(server.JSApiConsumersT, msetCfg.Name), nil, time.Second)
+	// Do second stream.
+	mset2, err := gacc.AddStream(&server.StreamConfig{Name: "NUM22", Storage: server.MemoryStorage, Retention: server.WorkQueuePolicy})
 	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
-	var clResponse server.JSApiConsumerNamesResponse
-	if err = json.Unmarshal(resp.Data, &clResponse); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	defer mset2.Delete()
+
+	for i := 0; i < toSend; i++ {
+		sendStreamMsg(t, nc, "NUM22", "Hello World!")
 	}
-	if len(clResponse.Consumers) != 1 {
-		t.Fatalf("Expected only 1 consumer but got %d", len(clResponse.Consumers))
+
+	stats2 := mset2.State()
+	usage = gacc.JetStreamUsage()
+
+	if usage.Memory != (state.Bytes + stats2.Bytes) {
+		t.Fatalf("Expected to track both streams, account is %v, stream1 is %v, stream2 is %v", usage.Memory, state.Bytes, stats2.Bytes)
 	}
-	// Now let's get info about our consumer.
-	cName := clResponse.Consumers[0]
-	resp, err = nc.Request(fmt.Sprintf(server.JSApiConsumerInfoT, msetCfg.Name, cName), nil, time.Second)
+
+	// Make sure delete works.
+	mset2.Delete()
+	stats2 = mset2.State()
+	usage = gacc.JetStreamUsage()
+
+	if usage.Memory != (state.Bytes + stats2.Bytes) {
+		t.Fatalf("Expected to track both streams, account is %v, stream1 is %v, stream2 is %v", usage.Memory, state.Bytes, stats2.Bytes)
+	}
+
+	// Now drain the first one by consuming the messages.
+	o, err := mset.AddConsumer(workerModeConfig("WQ"))
 	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+		t.Fatalf("Expected no error with registered interest, got %v", err)
 	}
-	var oinfo server.ConsumerInfo
-	if err = json.Unmarshal(resp.Data, &oinfo); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	defer o.Delete()
+
+	for i := 0; i < toSend; i++ {
+		msg, err := nc.Request(o.RequestNextMsgSubject(), nil, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		msg.Respond(nil)
 	}
-	// Do some sanity checking.
-	// Must match consumer.go
-	const randConsumerNameLen = 8
-	if len(oinfo.Name) != randConsumerNameLen {
-		t.Fatalf("Expected ephemeral name, got %q", oinfo.Name)
-	}
-	if len(oinfo.Config.Durable) != 0 {
-		t.Fatalf("Expected no durable name, but got %q", oinfo.Config.Durable)
-	}
-	if oinfo.Config.DeliverSubject != delivery {
-		t.Fatalf("Expected to have delivery subject of %q, got %q", delivery, oinfo.Config.DeliverSubject)
-	}
-	if oinfo.Delivered.Consumer != 10 {
-		t.Fatalf("Expected consumer delivered sequence of 10, got %d", oinfo.Delivered.Consumer)
-	}
-	if oinfo.AckFloor.Consumer != 10 {
-		t.Fatalf("Expected ack floor to be 10, got %d", oinfo.AckFloor.Consumer)
+	nc.Flush()
+
+	state = mset.State()
+	usage = gacc.JetStreamUsage()
+
+	if usage.Memory != 0 {
+		t.Fatalf("Expected usage memeory to be 0, got %d", usage.Memory)
 	}
 
-	// Now delete the consumer.
-	resp, _ = nc.Request(fmt.Sprintf(server.JSApiConsumerDeleteT, msetCfg.Name, cName), nil, time.Second)
-	var cdResp server.JSApiConsumerDeleteResponse
-	if err = json.Unmarshal(resp.Data, &cdResp); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-	if !cdResp.Success || cdResp.Error != nil {
-		t.Fatalf("Got a bad response %+v", ccResp)
+	// Now send twice the number of messages. Should receive an error at some point, and we will check usage against limits.
+	var errSeen string
+	for i := 0; i < toSend*2; i++ {
+		resp, _ := nc.Request("LIMITS", []byte("The quick brown fox jumped over the..."), 50*time.Millisecond)
+		if string(resp.Data) != server.OK {
+			errSeen = string(resp.Data)
+			break
+		}
 	}
 
-	// Make sure we can't create a durable using the ephemeral API endpoint.
-	obsReq = server.CreateConsumerRequest{
-		Stream: msetCfg.Name,
-		Config: server.ConsumerConfig{Durable: "myd", DeliverSubject: delivery},
-	}
-	req, err = json.Marshal(obsReq)
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-	resp, err = nc.Request(fmt.Sprintf(server.JSApiConsumerCreateT, msetCfg.Name), req, time.Second)
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-	ccResp.Error, ccResp.ConsumerInfo = nil, nil
-	if err = json.Unmarshal(resp.Data, &ccResp); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	if errSeen == "" {
+		t.Fatalf("Expected to see an error when exceeding the account limits")
 	}
-	checkBadRequest(ccResp.Error, "consumer expected to be ephemeral but a durable name was set in request")
 
-	// Now make sure we can create a durable on the subject with the proper name.
-	resp, err = nc.Request(fmt.Sprintf(server.JSApiDurableCreateT, msetCfg.Name, obsReq.Config.Durable), req, time.Second)
-	ccResp.Error, ccResp.ConsumerInfo = nil, nil
-	if err = json.Unmarshal(resp.Data, &ccResp); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	state = mset.State()
+	usage = gacc.JetStreamUsage()
+
+	if usage.Memory > uint64(al.MaxMemory) {
+		t.Fatalf("Expected memory to not exceed limit of %d, got %d", al.MaxMemory, usage.Memory)
 	}
-	if ccResp.ConsumerInfo == nil || ccResp.Error != nil {
-		t.Fatalf("Did not receive correct response")
+
+	// make sure that unlimited accounts work
+	al.MaxMemory = -1
+
+	if err := gacc.UpdateJetStreamLimits(al); err != nil {
+		t.Fatalf("Unexpected error updating jetstream account limits: %v", err)
 	}
 
-	// Make sure empty durable in cfg does not work
-	obsReq2 := server.CreateConsumerRequest{
-		Stream: msetCfg.Name,
-		Config: server.ConsumerConfig{DeliverSubject: delivery},
+	for i := 0; i < toSend; i++ {
+		sendStreamMsg(t, nc, "LIMITS", "Hello World!")
 	}
-	req2, err := json.Marshal(obsReq2)
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+}
+
+func TestJetStreamStreamFileTrackingAndLimits(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
 	}
-	resp, err = nc.Request(fmt.Sprintf(server.JSApiDurableCreateT, msetCfg.Name, obsReq.Config.Durable), req2, time.Second)
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+
+	gacc := s.GlobalAccount()
+
+	al := &server.JetStreamAccountLimits{
+		MaxMemory:    8192,
+		MaxStore:     9600,
+		MaxStreams:   -1,
+		MaxConsumers: -1,
 	}
-	ccResp.Error, ccResp.ConsumerInfo = nil, nil
-	if err = json.Unmarshal(resp.Data, &ccResp); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+
+	if err := gacc.UpdateJetStreamLimits(al); err != nil {
+		t.Fatalf("Unexpected error updating jetstream account limits: %v", err)
 	}
-	checkBadRequest(ccResp.Error, "consumer expected to be durable but a durable name was not set")
 
-	// Now delete a msg.
-	dreq := server.JSApiMsgDeleteRequest{Seq: 2}
-	dreqj, err := json.Marshal(dreq)
+	mconfig := &server.StreamConfig{Name: "LIMITS", Storage: server.FileStorage, Retention: server.WorkQueuePolicy}
+	mset, err := gacc.AddStream(mconfig)
 	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-	resp, _ = nc.Request(fmt.Sprintf(server.JSApiMsgDeleteT, msetCfg.Name), dreqj, time.Second)
-	var delMsgResp server.JSApiMsgDeleteResponse
-	if err = json.Unmarshal(resp.Data, &delMsgResp); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-	if !delMsgResp.Success || delMsgResp.Error != nil {
-		t.Fatalf("Got a bad response %+v", delMsgResp.Error)
+		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
+	defer mset.Delete()
 
-	// Now purge the stream.
-	resp, _ = nc.Request(fmt.Sprintf(server.JSApiStreamPurgeT, msetCfg.Name), nil, time.Second)
-	var pResp server.JSApiStreamPurgeResponse
-	if err = json.Unmarshal(resp.Data, &pResp); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-	if !pResp.Success || pResp.Error != nil {
-		t.Fatalf("Got a bad response %+v", pResp)
-	}
-	if pResp.Purged != 9 {
-		t.Fatalf("Expected 9 purged, got %d", pResp.Purged)
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	toSend := 100
+	for i := 0; i < toSend; i++ {
+		sendStreamMsg(t, nc, "LIMITS", "Hello World!")
 	}
 
-	// Now delete the stream.
-	resp, _ = nc.Request(fmt.Sprintf(server.JSApiStreamDeleteT, msetCfg.Name), nil, time.Second)
-	var dResp server.JSApiStreamDeleteResponse
-	if err = json.Unmarshal(resp.Data, &dResp); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	state := mset.State()
+	usage := gacc.JetStreamUsage()
+
+	// Make sure these are working correctly.
+	if usage.Store != state.Bytes {
+		t.Fatalf("Expected to have stream bytes match the store usage, %d vs %d", usage.Store, state.Bytes)
 	}
-	if !dResp.Success || dResp.Error != nil {
-		t.Fatalf("Got a bad response %+v", dResp.Error)
+	if usage.Streams != 1 {
+		t.Fatalf("Expected to have 1 stream, got %d", usage.Streams)
 	}
 
-	// Now grab stats again.
-	// This will get the current information about usage and limits for this account.
-	resp, err = nc.Request(server.JSApiAccountInfo, nil, time.Second)
+	// Do second stream.
+	mconfig2 := &server.StreamConfig{Name: "NUM22", Storage: server.FileStorage, Retention: server.WorkQueuePolicy}
+	mset2, err := gacc.AddStream(mconfig2)
 	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-	if err := json.Unmarshal(resp.Data, &info); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-	if info.Streams != 0 {
-		t.Fatalf("Expected no remaining streams, got %d", info.Streams)
+		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
+	defer mset2.Delete()
 
-	// Now do templates.
-	mcfg := &server.StreamConfig{
-		Subjects:  []string{"kv.*"},
-		Retention: server.LimitsPolicy,
-		MaxAge:    time.Hour,
-		MaxMsgs:   4,
-		Storage:   server.MemoryStorage,
-		Replicas:  1,
-	}
-	template := &server.StreamTemplateConfig{
-		Name:       "kv",
-		Config:     mcfg,
-		MaxStreams: 4,
+	for i := 0; i < toSend; i++ {
+		sendStreamMsg(t, nc, "NUM22", "Hello World!")
 	}
-	req, err = json.Marshal(template)
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+
+	stats2 := mset2.State()
+	usage = gacc.JetStreamUsage()
+
+	if usage.Store != (state.Bytes + stats2.Bytes) {
+		t.Fatalf("Expected to track both streams, usage is %v, stream1 is %v, stream2 is %v", usage.Store, state.Bytes, stats2.Bytes)
 	}
 
-	// Check that the name in config has to match the name in the subject
-	resp, _ = nc.Request(fmt.Sprintf(server.JSApiTemplateCreateT, "BOB"), req, time.Second)
-	var stResp server.JSApiStreamTemplateCreateResponse
-	if err = json.Unmarshal(resp.Data, &stResp); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	// Make sure delete works.
+	mset2.Delete()
+	stats2 = mset2.State()
+	usage = gacc.JetStreamUsage()
+
+	if usage.Store != (state.Bytes + stats2.Bytes) {
+		t.Fatalf("Expected to track both streams, account is %v, stream1 is %v, stream2 is %v", usage.Store, state.Bytes, stats2.Bytes)
 	}
-	checkBadRequest(stResp.Error, "template name in subject does not match request")
 
-	resp, _ = nc.Request(fmt.Sprintf(server.JSApiTemplateCreateT, template.Name), req, time.Second)
-	stResp.Error, stResp.StreamTemplateInfo = nil, nil
-	if err = json.Unmarshal(resp.Data, &stResp); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	// Now drain the first one by consuming the messages.
+	o, err := mset.AddConsumer(workerModeConfig("WQ"))
+	if err != nil {
+		t.Fatalf("Expected no error with registered interest, got %v", err)
 	}
-	if stResp.StreamTemplateInfo == nil || stResp.Error != nil {
-		t.Fatalf("Did not receive correct response")
+	defer o.Delete()
+
+	for i := 0; i < toSend; i++ {
+		msg, err := nc.Request(o.RequestNextMsgSubject(), nil, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		msg.Respond(nil)
 	}
+	nc.Flush()
 
-	// Create a second one.
-	template.Name = "ss"
-	template.Config.Subjects = []string{"foo", "bar"}
+	state = mset.State()
+	usage = gacc.JetStreamUsage()
 
-	req, err = json.Marshal(template)
-	if err != nil {
-		t.Fatalf("Unexpected error: %s", err)
+	if usage.Memory != 0 {
+		t.Fatalf("Expected usage memeory to be 0, got %d", usage.Memory)
 	}
 
-	resp, _ = nc.Request(fmt.Sprintf(server.JSApiTemplateCreateT, template.Name), req, time.Second)
-	stResp.Error, stResp.StreamTemplateInfo = nil, nil
-	if err = json.Unmarshal(resp.Data, &stResp); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	// Now send twice the number of messages. Should receive an error at some point, and we will check usage against limits.
+	var errSeen string
+	for i := 0; i < toSend*2; i++ {
+		resp, _ := nc.Request("LIMITS", []byte("The quick brown fox jumped over the..."), 50*time.Millisecond)
+		if string(resp.Data) != server.OK {
+			errSeen = string(resp.Data)
+			break
+		}
 	}
-	if stResp.StreamTemplateInfo == nil || stResp.Error != nil {
-		t.Fatalf("Did not receive correct response")
+
+	if errSeen == "" {
+		t.Fatalf("Expected to see an error when exceeding the account limits")
 	}
 
-	// Now grab the list of templates
-	var tListResp server.JSApiStreamTemplateNamesResponse
-	resp, err = nc.Request(server.JSApiTemplates, nil, time.Second)
-	if err = json.Unmarshal(resp.Data, &tListResp); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-	if len(tListResp.Templates) != 2 {
-		t.Fatalf("Expected 2 templates but got %d", len(tListResp.Templates))
-	}
-	sort.Strings(tListResp.Templates)
-	if tListResp.Templates[0] != "kv" {
-		t.Fatalf("Expected to get %q, but got %q", "kv", tListResp.Templates[0])
-	}
-	if tListResp.Templates[1] != "ss" {
-		t.Fatalf("Expected to get %q, but got %q", "ss", tListResp.Templates[1])
+	state = mset.State()
+	usage = gacc.JetStreamUsage()
+
+	if usage.Memory > uint64(al.MaxMemory) {
+		t.Fatalf("Expected memory to not exceed limit of %d, got %d", al.MaxMemory, usage.Memory)
 	}
+}
 
-	// Now delete one.
-	// Test bad name.
-	resp, _ = nc.Request(fmt.Sprintf(server.JSApiTemplateDeleteT, "bob"), nil, time.Second)
-	var tDeleteResp server.JSApiStreamTemplateDeleteResponse
-	if err = json.Unmarshal(resp.Data, &tDeleteResp); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-	checkServerError(tDeleteResp.Error, "template not found")
+type obsi struct {
+	cfg server.ConsumerConfig
+	ack int
+}
+type info struct {
+	cfg   server.StreamConfig
+	state server.StreamState
+	obs   []obsi
+}
 
-	resp, _ = nc.Request(fmt.Sprintf(server.JSApiTemplateDeleteT, "ss"), nil, time.Second)
-	tDeleteResp.Error = nil
-	if err = json.Unmarshal(resp.Data, &tDeleteResp); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-	if !tDeleteResp.Success || tDeleteResp.Error != nil {
-		t.Fatalf("Did not receive correct response: %+v", tDeleteResp.Error)
-	}
+func TestJetStreamSimpleFileRecovery(t *testing.T) {
+	base := runtime.NumGoroutine()
 
-	resp, err = nc.Request(server.JSApiTemplates, nil, time.Second)
-	tListResp.Error, tListResp.Templates = nil, nil
-	if err = json.Unmarshal(resp.Data, &tListResp); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-	if len(tListResp.Templates) != 1 {
-		t.Fatalf("Expected 1 template but got %d", len(tListResp.Templates))
+	s := RunRandClientPortServer()
+	defer s.Shutdown()
+
+	jsconfig := &server.JetStreamConfig{MaxMemory: 128 * 1024 * 1024, MaxStore: 32 * 1024 * 1024 * 1024}
+	if err := s.EnableJetStream(jsconfig); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
 	}
-	if tListResp.Templates[0] != "kv" {
-		t.Fatalf("Expected to get %q, but got %q", "kv", tListResp.Templates[0])
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
 	}
 
-	// First create a stream from the template
-	sendStreamMsg(t, nc, "kv.22", "derek")
-	// Last do info
-	resp, err = nc.Request(fmt.Sprintf(server.JSApiTemplateInfoT, "kv"), nil, time.Second)
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	acc := s.GlobalAccount()
+
+	ostate := make(map[string]info)
+
+	nid := nuid.New()
+	randomSubject := func() string {
+		nid.RandomizePrefix()
+		return fmt.Sprintf("SUBJ.%s", nid.Next())
 	}
-	var ti server.StreamTemplateInfo
-	if err = json.Unmarshal(resp.Data, &ti); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	numStreams := 10
+	for i := 1; i <= numStreams; i++ {
+		msetName := fmt.Sprintf("MMS-%d", i)
+		subjects := []string{randomSubject(), randomSubject(), randomSubject()}
+		msetConfig := server.StreamConfig{
+			Name:     msetName,
+			Storage:  server.FileStorage,
+			Subjects: subjects,
+			MaxMsgs:  100,
+		}
+		mset, err := acc.AddStream(&msetConfig)
+		if err != nil {
+			t.Fatalf("Unexpected error adding stream: %v", err)
+		}
+		defer mset.Delete()
+
+		toSend := rand.Intn(100) + 1
+		for n := 1; n <= toSend; n++ {
+			msg := fmt.Sprintf("Hello %d", n*i)
+			subj := subjects[rand.Intn(len(subjects))]
+			sendStreamMsg(t, nc, subj, msg)
+		}
+		// Create up to 5 consumers.
+		numObs := rand.Intn(5) + 1
+		var obs []obsi
+		for n := 1; n <= numObs; n++ {
+			oname := fmt.Sprintf("WQ-%d", n)
+			o, err := mset.AddConsumer(workerModeConfig(oname))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			// Now grab some messages.
+			toReceive := rand.Intn(toSend) + 1
+			for r := 0; r < toReceive; r++ {
+				resp, _ := nc.Request(o.RequestNextMsgSubject(), nil, time.Second)
+				if resp != nil {
+					resp.Respond(nil)
+				}
+			}
+			obs = append(obs, obsi{o.Config(), toReceive})
+		}
+		ostate[msetName] = info{mset.Config(), mset.State(), obs}
 	}
-	if len(ti.Streams) != 1 {
-		t.Fatalf("Expected 1 stream, got %d", len(ti.Streams))
+	pusage := acc.JetStreamUsage()
+
+	// Shutdown the server. Restart and make sure things come back.
+	s.Shutdown()
+
+	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+		delta := (runtime.NumGoroutine() - base)
+		if delta > 3 {
+			return fmt.Errorf("%d Go routines still exist post Shutdown()", delta)
+		}
+		return nil
+	})
+
+	s = RunRandClientPortServer()
+	defer s.Shutdown()
+
+	if err := s.EnableJetStream(jsconfig); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
 	}
-	if ti.Streams[0] != server.CanonicalName("kv.22") {
-		t.Fatalf("Expected stream with name %q, but got %q", server.CanonicalName("kv.22"), ti.Streams[0])
+
+	acc = s.GlobalAccount()
+
+	nusage := acc.JetStreamUsage()
+	if !reflect.DeepEqual(nusage, pusage) {
+		t.Fatalf("Usage does not match after restore: %+v vs %+v", nusage, pusage)
 	}
 
-	// Test that we can send nil or an empty legal json for requests that take no args.
-	// We know this stream does not exist, this just checking request processing.
-	checkEmptyReqArg := func(arg string) {
-		t.Helper()
-		var req []byte
-		if len(arg) > 0 {
-			req = []byte(arg)
+	for mname, info := range ostate {
+		mset, err := acc.LookupStream(mname)
+		if err != nil {
+			t.Fatalf("Expected to find a stream for %q", mname)
 		}
-		resp, err = nc.Request(fmt.Sprintf(server.JSApiStreamDeleteT, "foo_bar_baz"), req, time.Second)
-		var dResp server.JSApiStreamDeleteResponse
-		if err = json.Unmarshal(resp.Data, &dResp); err != nil {
-			t.Fatalf("Unexpected error: %v", err)
+		if state := mset.State(); !reflect.DeepEqual(state, info.state) {
+			t.Fatalf("State does not match: %+v vs %+v", state, info.state)
 		}
-		if dResp.Error == nil || dResp.Error.Code != 404 {
-			t.Fatalf("Got a bad response, expected a 404 response %+v", dResp.Error)
+		if cfg := mset.Config(); !reflect.DeepEqual(cfg, info.cfg) {
+			t.Fatalf("Configs do not match: %+v vs %+v", cfg, info.cfg)
+		}
+		// Consumers.
+		if mset.NumConsumers() != len(info.obs) {
+			t.Fatalf("Number of consumers do not match: %d vs %d", mset.NumConsumers(), len(info.obs))
+		}
+		for _, oi := range info.obs {
+			if o := mset.LookupConsumer(oi.cfg.Durable); o != nil {
+				if uint64(oi.ack+1) != o.NextSeq() {
+					t.Fatalf("Consumer next seq is not correct: %d vs %d", oi.ack+1, o.NextSeq())
+				}
+			} else {
+				t.Fatalf("Expected to get an consumer")
+			}
 		}
 	}
-
-	checkEmptyReqArg("")
-	checkEmptyReqArg("{}")
-	checkEmptyReqArg(" {} ")
-	checkEmptyReqArg(" { } ")
 }
 
-func TestJetStreamFilteredStreamNames(t *testing.T) {
+func TestJetStreamInfoAPIWithHeaders(t *testing.T) {
 	s := RunBasicJetStreamServer()
 	defer s.Shutdown()
 
@@ -7535,47 +8137,26 @@ func TestJetStreamFilteredStreamNames(t *testing.T) {
 	nc := clientConnectToServer(t, s)
 	defer nc.Close()
 
-	// Create some streams.
-	var snid int
-	createStream := func(subjects []string) {
-		t.Helper()
-		snid++
-		name := fmt.Sprintf("S-%d", snid)
-		sc := &server.StreamConfig{Name: name, Subjects: subjects}
-		if _, err := s.GlobalAccount().AddStream(sc); err != nil {
-			t.Fatalf("Unexpected error adding stream: %v", err)
-		}
-	}
-
-	createStream([]string{"foo"})                  // S1
-	createStream([]string{"bar"})                  // S2
-	createStream([]string{"baz"})                  // S3
-	createStream([]string{"foo.*", "bar.*"})       // S4
-	createStream([]string{"foo-1.22", "bar-1.33"}) // S5
+	m := nats.NewMsg(server.JSApiAccountInfo)
+	m.Header.Add("Accept-Encoding", "json")
+	m.Header.Add("Authorization", "s3cr3t")
+	m.Data = []byte("HELLO-JS!")
 
-	expectStreams := func(filter string, streams []string) {
-		t.Helper()
-		req, _ := json.Marshal(&server.JSApiStreamNamesRequest{Subject: filter})
-		r, _ := nc.Request(server.JSApiStreams, req, time.Second)
-		var resp server.JSApiStreamNamesResponse
-		if err := json.Unmarshal(r.Data, &resp); err != nil {
-			t.Fatalf("Unexpected error: %v", err)
-		}
-		if len(resp.Streams) != len(streams) {
-			t.Fatalf("Expected %d results, got %d", len(streams), len(resp.Streams))
-		}
+	resp, err := nc.RequestMsg(m, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
 
-	expectStreams("foo", []string{"S1"})
-	expectStreams("bar", []string{"S2"})
-	expectStreams("baz", []string{"S3"})
-	expectStreams("*", []string{"S1", "S2", "S3"})
-	expectStreams(">", []string{"S1", "S2", "S3", "S4", "S5"})
-	expectStreams("*.*", []string{"S4", "S5"})
-	expectStreams("*.22", []string{"S4", "S5"})
+	var info server.JSApiAccountInfoResponse
+	if err := json.Unmarshal(resp.Data, &info); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info.Error != nil {
+		t.Fatalf("Received an error: %+v", info.Error)
+	}
 }
 
-func TestJetStreamAPIStreamListPaging(t *testing.T) {
+func TestJetStreamRequestAPI(t *testing.T) {
 	s := RunBasicJetStreamServer()
 	defer s.Shutdown()
 
@@ -7584,162 +8165,2237 @@ func TestJetStreamAPIStreamListPaging(t *testing.T) {
 		defer os.RemoveAll(config.StoreDir)
 	}
 
-	// Create 2X limit
-	streamsNum := 2 * server.JSApiNamesLimit
-	for i := 1; i <= streamsNum; i++ {
-		name := fmt.Sprintf("STREAM-%06d", i)
-		cfg := server.StreamConfig{Name: name, Storage: server.MemoryStorage}
-		_, err := s.GlobalAccount().AddStream(&cfg)
-		if err != nil {
-			t.Fatalf("Unexpected error adding stream: %v", err)
-		}
-	}
-
 	// Client for API requests.
 	nc := clientConnectToServer(t, s)
 	defer nc.Close()
 
-	reqList := func(offset int) []byte {
-		t.Helper()
-		var req []byte
-		if offset > 0 {
-			req, _ = json.Marshal(&server.ApiPagedRequest{Offset: offset})
-		}
-		resp, err := nc.Request(server.JSApiStreams, req, time.Second)
+	// This will get the current information about usage and limits for this account.
+	resp, err := nc.Request(server.JSApiAccountInfo, nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var info server.JSApiAccountInfoResponse
+	if err := json.Unmarshal(resp.Data, &info); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Now create a stream.
+	msetCfg := server.StreamConfig{
+		Name:     "MSET22",
+		Storage:  server.FileStorage,
+		Subjects: []string{"foo", "bar", "baz"},
+		MaxMsgs:  100,
+	}
+	req, err := json.Marshal(msetCfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp, _ = nc.Request(fmt.Sprintf(server.JSApiStreamCreateT, msetCfg.Name), req, time.Second)
+	var scResp server.JSApiStreamCreateResponse
+	if err := json.Unmarshal(resp.Data, &scResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if scResp.StreamInfo == nil || scResp.Error != nil {
+		t.Fatalf("Did not receive correct response: %+v", scResp.Error)
+	}
+	if time.Since(scResp.Created) > time.Second {
+		t.Fatalf("Created time seems wrong: %v\n", scResp.Created)
+	}
+
+	checkBadRequest := func(e *server.ApiError, description string) {
+		t.Helper()
+		if e == nil || e.Code != 400 || e.Description != description {
+			t.Fatalf("Did not get proper error: %+v", e)
+		}
+	}
+
+	checkServerError := func(e *server.ApiError, description string) {
+		t.Helper()
+		if e == nil || e.Code != 500 || e.Description != description {
+			t.Fatalf("Did not get proper server error: %+v\n", e)
+		}
+	}
+
+	checkNotFound := func(e *server.ApiError, description string) {
+		t.Helper()
+		if e == nil || e.Code != 404 || e.Description != description {
+			t.Fatalf("Did not get proper server error: %+v\n", e)
+		}
+	}
+
+	// Check that the name in config has to match the name in the subject
+	resp, _ = nc.Request(fmt.Sprintf(server.JSApiStreamCreateT, "BOB"), req, time.Second)
+	scResp.Error, scResp.StreamInfo = nil, nil
+	if err := json.Unmarshal(resp.Data, &scResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkBadRequest(scResp.Error, "stream name in subject does not match request")
+
+	// Check that update works.
+	msetCfg.Subjects = []string{"foo", "bar", "baz"}
+	msetCfg.MaxBytes = 2222222
+	req, err = json.Marshal(msetCfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp, _ = nc.Request(fmt.Sprintf(server.JSApiStreamUpdateT, msetCfg.Name), req, time.Second)
+	scResp.Error, scResp.StreamInfo = nil, nil
+	if err := json.Unmarshal(resp.Data, &scResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if scResp.StreamInfo == nil || scResp.Error != nil {
+		t.Fatalf("Did not receive correct response: %+v", scResp.Error)
+	}
+
+	// Now lookup info again and see that we can see the new stream.
+	resp, err = nc.Request(server.JSApiAccountInfo, nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err = json.Unmarshal(resp.Data, &info); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info.Streams != 1 {
+		t.Fatalf("Expected to see 1 Stream, got %d", info.Streams)
+	}
+
+	// Make sure list names works.
+	resp, err = nc.Request(server.JSApiStreams, nil, time.Second)
+	var namesResponse server.JSApiStreamNamesResponse
+	if err = json.Unmarshal(resp.Data, &namesResponse); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(namesResponse.Streams) != 1 {
+		t.Fatalf("Expected only 1 stream but got %d", len(namesResponse.Streams))
+	}
+	if namesResponse.Total != 1 {
+		t.Fatalf("Expected total to be 1 but got %d", namesResponse.Total)
+	}
+	if namesResponse.Offset != 0 {
+		t.Fatalf("Expected offset to be 0 but got %d", namesResponse.Offset)
+	}
+	if namesResponse.Limit != server.JSApiNamesLimit {
+		t.Fatalf("Expected limit to be %d but got %d", server.JSApiNamesLimit, namesResponse.Limit)
+	}
+	if namesResponse.Streams[0] != msetCfg.Name {
+		t.Fatalf("Expected to get %q, but got %q", msetCfg.Name, namesResponse.Streams[0])
+	}
+
+	// Now do detailed version.
+	resp, err = nc.Request(server.JSApiStreamList, nil, time.Second)
+	var listResponse server.JSApiStreamListResponse
+	if err = json.Unmarshal(resp.Data, &listResponse); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if len(listResponse.Streams) != 1 {
+		t.Fatalf("Expected only 1 stream but got %d", len(listResponse.Streams))
+	}
+	if listResponse.Total != 1 {
+		t.Fatalf("Expected total to be 1 but got %d", listResponse.Total)
+	}
+	if listResponse.Offset != 0 {
+		t.Fatalf("Expected offset to be 0 but got %d", listResponse.Offset)
+	}
+	if listResponse.Limit != server.JSApiListLimit {
+		t.Fatalf("Expected limit to be %d but got %d", server.JSApiListLimit, listResponse.Limit)
+	}
+	if listResponse.Streams[0].Config.Name != msetCfg.Name {
+		t.Fatalf("Expected to get %q, but got %q", msetCfg.Name, listResponse.Streams[0].Config.Name)
+	}
+
+	// Now send some messages, then we can poll for info on this stream.
+	toSend := 10
+	for i := 0; i < toSend; i++ {
+		nc.Request("foo", []byte("WELCOME JETSTREAM"), time.Second)
+	}
+
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiStreamInfoT, msetCfg.Name), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var msi server.StreamInfo
+	if err = json.Unmarshal(resp.Data, &msi); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if msi.State.Msgs != uint64(toSend) {
+		t.Fatalf("Expected to get %d msgs, got %d", toSend, msi.State.Msgs)
+	}
+	if time.Since(msi.Created) > time.Second {
+		t.Fatalf("Created time seems wrong: %v\n", msi.Created)
+	}
+
+	// Looking up one that is not there should yield an error.
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiStreamInfoT, "BOB"), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var bResp server.JSApiStreamInfoResponse
+	if err = json.Unmarshal(resp.Data, &bResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkNotFound(bResp.Error, "stream not found")
+
+	// Now create a consumer.
+	delivery := nats.NewInbox()
+	obsReq := server.CreateConsumerRequest{
+		Stream: msetCfg.Name,
+		Config: server.ConsumerConfig{DeliverSubject: delivery},
+	}
+	req, err = json.Marshal(obsReq)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiConsumerCreateT, msetCfg.Name), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var ccResp server.JSApiConsumerCreateResponse
+	if err = json.Unmarshal(resp.Data, &ccResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkServerError(ccResp.Error, "consumer requires interest for delivery subject when ephemeral")
+
+	// Now create subscription and make sure we get proper response.
+	sub, _ := nc.SubscribeSync(delivery)
+	nc.Flush()
+
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiConsumerCreateT, msetCfg.Name), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ccResp.Error, ccResp.ConsumerInfo = nil, nil
+	if err = json.Unmarshal(resp.Data, &ccResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ccResp.ConsumerInfo == nil || ccResp.Error != nil {
+		t.Fatalf("Got a bad response %+v", ccResp)
+	}
+	if time.Since(ccResp.Created) > time.Second {
+		t.Fatalf("Created time seems wrong: %v\n", ccResp.Created)
+	}
+
+	checkFor(t, 250*time.Millisecond, 10*time.Millisecond, func() error {
+		if nmsgs, _, _ := sub.Pending(); err != nil || nmsgs != toSend {
+			return fmt.Errorf("Did not receive correct number of messages: %d vs %d", nmsgs, toSend)
+		}
+		return nil
+	})
+
+	// Check that we get an error if the stream name in the subject does not match the config.
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiConsumerCreateT, "BOB"), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ccResp.Error, ccResp.ConsumerInfo = nil, nil
+	if err = json.Unmarshal(resp.Data, &ccResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Since we do not have interest this should have failed.
+	checkBadRequest(ccResp.Error, "stream name in subject does not match request")
+
+	// Get the list of all of the consumers for our stream.
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiConsumersT, msetCfg.Name), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var clResponse server.JSApiConsumerNamesResponse
+	if err = json.Unmarshal(resp.Data, &clResponse); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(clResponse.Consumers) != 1 {
+		t.Fatalf("Expected only 1 consumer but got %d", len(clResponse.Consumers))
+	}
+	// Now let's get info about our consumer.
+	cName := clResponse.Consumers[0]
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiConsumerInfoT, msetCfg.Name, cName), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var oinfo server.ConsumerInfo
+	if err = json.Unmarshal(resp.Data, &oinfo); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Do some sanity checking.
+	// Must match consumer.go
+	const randConsumerNameLen = 8
+	if len(oinfo.Name) != randConsumerNameLen {
+		t.Fatalf("Expected ephemeral name, got %q", oinfo.Name)
+	}
+	if len(oinfo.Config.Durable) != 0 {
+		t.Fatalf("Expected no durable name, but got %q", oinfo.Config.Durable)
+	}
+	if oinfo.Config.DeliverSubject != delivery {
+		t.Fatalf("Expected to have delivery subject of %q, got %q", delivery, oinfo.Config.DeliverSubject)
+	}
+	if oinfo.Delivered.Consumer != 10 {
+		t.Fatalf("Expected consumer delivered sequence of 10, got %d", oinfo.Delivered.Consumer)
+	}
+	if oinfo.AckFloor.Consumer != 10 {
+		t.Fatalf("Expected ack floor to be 10, got %d", oinfo.AckFloor.Consumer)
+	}
+
+	// Now delete the consumer.
+	resp, _ = nc.Request(fmt.Sprintf(server.JSApiConsumerDeleteT, msetCfg.Name, cName), nil, time.Second)
+	var cdResp server.JSApiConsumerDeleteResponse
+	if err = json.Unmarshal(resp.Data, &cdResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !cdResp.Success || cdResp.Error != nil {
+		t.Fatalf("Got a bad response %+v", ccResp)
+	}
+
+	// Make sure we can't create a durable using the ephemeral API endpoint.
+	obsReq = server.CreateConsumerRequest{
+		Stream: msetCfg.Name,
+		Config: server.ConsumerConfig{Durable: "myd", DeliverSubject: delivery},
+	}
+	req, err = json.Marshal(obsReq)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiConsumerCreateT, msetCfg.Name), req, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ccResp.Error, ccResp.ConsumerInfo = nil, nil
+	if err = json.Unmarshal(resp.Data, &ccResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkBadRequest(ccResp.Error, "consumer expected to be ephemeral but a durable name was set in request")
+
+	// Now make sure we can create a durable on the subject with the proper name.
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiDurableCreateT, msetCfg.Name, obsReq.Config.Durable), req, time.Second)
+	ccResp.Error, ccResp.ConsumerInfo = nil, nil
+	if err = json.Unmarshal(resp.Data, &ccResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ccResp.ConsumerInfo == nil || ccResp.Error != nil {
+		t.Fatalf("Did not receive correct response")
+	}
+
+	// Make sure empty durable in cfg does not work
+	obsReq2 := server.CreateConsumerRequest{
+		Stream: msetCfg.Name,
+		Config: server.ConsumerConfig{DeliverSubject: delivery},
+	}
+	req2, err := json.Marshal(obsReq2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiDurableCreateT, msetCfg.Name, obsReq.Config.Durable), req2, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ccResp.Error, ccResp.ConsumerInfo = nil, nil
+	if err = json.Unmarshal(resp.Data, &ccResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkBadRequest(ccResp.Error, "consumer expected to be durable but a durable name was not set")
+
+	// Now delete a msg.
+	dreq := server.JSApiMsgDeleteRequest{Seq: 2}
+	dreqj, err := json.Marshal(dreq)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp, _ = nc.Request(fmt.Sprintf(server.JSApiMsgDeleteT, msetCfg.Name), dreqj, time.Second)
+	var delMsgResp server.JSApiMsgDeleteResponse
+	if err = json.Unmarshal(resp.Data, &delMsgResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !delMsgResp.Success || delMsgResp.Error != nil {
+		t.Fatalf("Got a bad response %+v", delMsgResp.Error)
+	}
+
+	// Now purge the stream.
+	resp, _ = nc.Request(fmt.Sprintf(server.JSApiStreamPurgeT, msetCfg.Name), nil, time.Second)
+	var pResp server.JSApiStreamPurgeResponse
+	if err = json.Unmarshal(resp.Data, &pResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !pResp.Success || pResp.Error != nil {
+		t.Fatalf("Got a bad response %+v", pResp)
+	}
+	if pResp.Purged != 9 {
+		t.Fatalf("Expected 9 purged, got %d", pResp.Purged)
+	}
+
+	// Now delete the stream.
+	resp, _ = nc.Request(fmt.Sprintf(server.JSApiStreamDeleteT, msetCfg.Name), nil, time.Second)
+	var dResp server.JSApiStreamDeleteResponse
+	if err = json.Unmarshal(resp.Data, &dResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !dResp.Success || dResp.Error != nil {
+		t.Fatalf("Got a bad response %+v", dResp.Error)
+	}
+
+	// Now grab stats again.
+	// This will get the current information about usage and limits for this account.
+	resp, err = nc.Request(server.JSApiAccountInfo, nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := json.Unmarshal(resp.Data, &info); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info.Streams != 0 {
+		t.Fatalf("Expected no remaining streams, got %d", info.Streams)
+	}
+
+	// Now do templates.
+	mcfg := &server.StreamConfig{
+		Subjects:  []string{"kv.*"},
+		Retention: server.LimitsPolicy,
+		MaxAge:    time.Hour,
+		MaxMsgs:   4,
+		Storage:   server.MemoryStorage,
+		Replicas:  1,
+	}
+	template := &server.StreamTemplateConfig{
+		Name:       "kv",
+		Config:     mcfg,
+		MaxStreams: 4,
+	}
+	req, err = json.Marshal(template)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Check that the name in config has to match the name in the subject
+	resp, _ = nc.Request(fmt.Sprintf(server.JSApiTemplateCreateT, "BOB"), req, time.Second)
+	var stResp server.JSApiStreamTemplateCreateResponse
+	if err = json.Unmarshal(resp.Data, &stResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkBadRequest(stResp.Error, "template name in subject does not match request")
+
+	resp, _ = nc.Request(fmt.Sprintf(server.JSApiTemplateCreateT, template.Name), req, time.Second)
+	stResp.Error, stResp.StreamTemplateInfo = nil, nil
+	if err = json.Unmarshal(resp.Data, &stResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stResp.StreamTemplateInfo == nil || stResp.Error != nil {
+		t.Fatalf("Did not receive correct response")
+	}
+
+	// Create a second one.
+	template.Name = "ss"
+	template.Config.Subjects = []string{"foo", "bar"}
+
+	req, err = json.Marshal(template)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	resp, _ = nc.Request(fmt.Sprintf(server.JSApiTemplateCreateT, template.Name), req, time.Second)
+	stResp.Error, stResp.StreamTemplateInfo = nil, nil
+	if err = json.Unmarshal(resp.Data, &stResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stResp.StreamTemplateInfo == nil || stResp.Error != nil {
+		t.Fatalf("Did not receive correct response")
+	}
+
+	// Now grab the list of templates
+	var tListResp server.JSApiStreamTemplateNamesResponse
+	resp, err = nc.Request(server.JSApiTemplates, nil, time.Second)
+	if err = json.Unmarshal(resp.Data, &tListResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(tListResp.Templates) != 2 {
+		t.Fatalf("Expected 2 templates but got %d", len(tListResp.Templates))
+	}
+	sort.Strings(tListResp.Templates)
+	if tListResp.Templates[0] != "kv" {
+		t.Fatalf("Expected to get %q, but got %q", "kv", tListResp.Templates[0])
+	}
+	if tListResp.Templates[1] != "ss" {
+		t.Fatalf("Expected to get %q, but got %q", "ss", tListResp.Templates[1])
+	}
+
+	// Now delete one.
+	// Test bad name.
+	resp, _ = nc.Request(fmt.Sprintf(server.JSApiTemplateDeleteT, "bob"), nil, time.Second)
+	var tDeleteResp server.JSApiStreamTemplateDeleteResponse
+	if err = json.Unmarshal(resp.Data, &tDeleteResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkServerError(tDeleteResp.Error, "template not found")
+
+	resp, _ = nc.Request(fmt.Sprintf(server.JSApiTemplateDeleteT, "ss"), nil, time.Second)
+	tDeleteResp.Error = nil
+	if err = json.Unmarshal(resp.Data, &tDeleteResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !tDeleteResp.Success || tDeleteResp.Error != nil {
+		t.Fatalf("Did not receive correct response: %+v", tDeleteResp.Error)
+	}
+
+	resp, err = nc.Request(server.JSApiTemplates, nil, time.Second)
+	tListResp.Error, tListResp.Templates = nil, nil
+	if err = json.Unmarshal(resp.Data, &tListResp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(tListResp.Templates) != 1 {
+		t.Fatalf("Expected 1 template but got %d", len(tListResp.Templates))
+	}
+	if tListResp.Templates[0] != "kv" {
+		t.Fatalf("Expected to get %q, but got %q", "kv", tListResp.Templates[0])
+	}
+
+	// First create a stream from the template
+	sendStreamMsg(t, nc, "kv.22", "derek")
+	// Last do info
+	resp, err = nc.Request(fmt.Sprintf(server.JSApiTemplateInfoT, "kv"), nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var ti server.StreamTemplateInfo
+	if err = json.Unmarshal(resp.Data, &ti); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(ti.Streams) != 1 {
+		t.Fatalf("Expected 1 stream, got %d", len(ti.Streams))
+	}
+	if ti.Streams[0] != server.CanonicalName("kv.22") {
+		t.Fatalf("Expected stream with name %q, but got %q", server.CanonicalName("kv.22"), ti.Streams[0])
+	}
+
+	// Test that we can send nil or an empty legal json for requests that take no args.
+	// We know this stream does not exist, this just checking request processing.
+	checkEmptyReqArg := func(arg string) {
+		t.Helper()
+		var req []byte
+		if len(arg) > 0 {
+			req = []byte(arg)
+		}
+		resp, err = nc.Request(fmt.Sprintf(server.JSApiStreamDeleteT, "foo_bar_baz"), req, time.Second)
+		var dResp server.JSApiStreamDeleteResponse
+		if err = json.Unmarshal(resp.Data, &dResp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if dResp.Error == nil || dResp.Error.Code != 404 {
+			t.Fatalf("Got a bad response, expected a 404 response %+v", dResp.Error)
+		}
+	}
+
+	checkEmptyReqArg("")
+	checkEmptyReqArg("{}")
+	checkEmptyReqArg(" {} ")
+	checkEmptyReqArg(" { } ")
+}
+
+func TestJetStreamFilteredStreamNames(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	// Forced cleanup of all persisted state.
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	// Client for API requests.
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	// Create some streams.
+	var snid int
+	createStream := func(subjects []string) {
+		t.Helper()
+		snid++
+		name := fmt.Sprintf("S-%d", snid)
+		sc := &server.StreamConfig{Name: name, Subjects: subjects}
+		if _, err := s.GlobalAccount().AddStream(sc); err != nil {
+			t.Fatalf("Unexpected error adding stream: %v", err)
+		}
+	}
+
+	createStream([]string{"foo"})                  // S1
+	createStream([]string{"bar"})                  // S2
+	createStream([]string{"baz"})                  // S3
+	createStream([]string{"foo.*", "bar.*"})       // S4
+	createStream([]string{"foo-1.22", "bar-1.33"}) // S5
+
+	expectStreams := func(filter string, streams []string) {
+		t.Helper()
+		req, _ := json.Marshal(&server.JSApiStreamNamesRequest{Subject: filter})
+		r, _ := nc.Request(server.JSApiStreams, req, time.Second)
+		var resp server.JSApiStreamNamesResponse
+		if err := json.Unmarshal(r.Data, &resp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(resp.Streams) != len(streams) {
+			t.Fatalf("Expected %d results, got %d", len(streams), len(resp.Streams))
+		}
+	}
+
+	expectStreams("foo", []string{"S1"})
+	expectStreams("bar", []string{"S2"})
+	expectStreams("baz", []string{"S3"})
+	expectStreams("*", []string{"S1", "S2", "S3"})
+	expectStreams(">", []string{"S1", "S2", "S3", "S4", "S5"})
+	expectStreams("*.*", []string{"S4", "S5"})
+	expectStreams("*.22", []string{"S4", "S5"})
+}
+
+func TestJetStreamAPIStreamListPaging(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	// Forced cleanup of all persisted state.
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	// Create 2X limit
+	streamsNum := 2 * server.JSApiNamesLimit
+	for i := 1; i <= streamsNum; i++ {
+		name := fmt.Sprintf("STREAM-%06d", i)
+		cfg := server.StreamConfig{Name: name, Storage: server.MemoryStorage}
+		_, err := s.GlobalAccount().AddStream(&cfg)
+		if err != nil {
+			t.Fatalf("Unexpected error adding stream: %v", err)
+		}
+	}
+
+	// Client for API requests.
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	reqList := func(offset int) []byte {
+		t.Helper()
+		var req []byte
+		if offset > 0 {
+			req, _ = json.Marshal(&server.ApiPagedRequest{Offset: offset})
+		}
+		resp, err := nc.Request(server.JSApiStreams, req, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error getting stream list: %v", err)
+		}
+		return resp.Data
+	}
+
+	checkResp := func(resp []byte, expectedLen, expectedOffset int) {
+		t.Helper()
+		var listResponse server.JSApiStreamNamesResponse
+		if err := json.Unmarshal(resp, &listResponse); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(listResponse.Streams) != expectedLen {
+			t.Fatalf("Expected only %d streams but got %d", expectedLen, len(listResponse.Streams))
+		}
+		if listResponse.Total != streamsNum {
+			t.Fatalf("Expected total to be %d but got %d", streamsNum, listResponse.Total)
+		}
+		if listResponse.Offset != expectedOffset {
+			t.Fatalf("Expected offset to be %d but got %d", expectedOffset, listResponse.Offset)
+		}
+		if expectedLen < 1 {
+			return
+		}
+		// Make sure we get the right stream.
+		sname := fmt.Sprintf("STREAM-%06d", expectedOffset+1)
+		if listResponse.Streams[0] != sname {
+			t.Fatalf("Expected stream %q to be first, got %q", sname, listResponse.Streams[0])
+		}
+	}
+
+	checkResp(reqList(0), server.JSApiNamesLimit, 0)
+	checkResp(reqList(server.JSApiNamesLimit), server.JSApiNamesLimit, server.JSApiNamesLimit)
+	checkResp(reqList(streamsNum), 0, streamsNum)
+	checkResp(reqList(streamsNum-22), 22, streamsNum-22)
+	checkResp(reqList(streamsNum+22), 0, streamsNum)
+}
+
+func TestJetStreamAPIConsumerListPaging(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	// Forced cleanup of all persisted state.
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	sname := "MYSTREAM"
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: sname})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+
+	// Client for API requests.
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	consumersNum := server.JSApiNamesLimit
+	for i := 1; i <= consumersNum; i++ {
+		dsubj := fmt.Sprintf("d.%d", i)
+		sub, _ := nc.SubscribeSync(dsubj)
+		defer sub.Unsubscribe()
+		nc.Flush()
+
+		_, err := mset.AddConsumer(&server.ConsumerConfig{DeliverSubject: dsubj})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	reqListSubject := fmt.Sprintf(server.JSApiConsumersT, sname)
+	reqList := func(offset int) []byte {
+		t.Helper()
+		var req []byte
+		if offset > 0 {
+			req, _ = json.Marshal(&server.JSApiConsumersRequest{ApiPagedRequest: server.ApiPagedRequest{Offset: offset}})
+		}
+		resp, err := nc.Request(reqListSubject, req, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error getting stream list: %v", err)
+		}
+		return resp.Data
+	}
+
+	checkResp := func(resp []byte, expectedLen, expectedOffset int) {
+		t.Helper()
+		var listResponse server.JSApiConsumerNamesResponse
+		if err := json.Unmarshal(resp, &listResponse); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(listResponse.Consumers) != expectedLen {
+			t.Fatalf("Expected only %d streams but got %d", expectedLen, len(listResponse.Consumers))
+		}
+		if listResponse.Total != consumersNum {
+			t.Fatalf("Expected total to be %d but got %d", consumersNum, listResponse.Total)
+		}
+		if listResponse.Offset != expectedOffset {
+			t.Fatalf("Expected offset to be %d but got %d", expectedOffset, listResponse.Offset)
+		}
+	}
+
+	checkResp(reqList(0), server.JSApiNamesLimit, 0)
+	checkResp(reqList(consumersNum-22), 22, consumersNum-22)
+	checkResp(reqList(consumersNum+22), 0, consumersNum)
+}
+
+func TestJetStreamUpdateStream(t *testing.T) {
+	cases := []struct {
+		name    string
+		mconfig *server.StreamConfig
+	}{
+		{name: "MemoryStore",
+			mconfig: &server.StreamConfig{
+				Name:      "foo",
+				Retention: server.LimitsPolicy,
+				MaxAge:    time.Hour,
+				Storage:   server.MemoryStorage,
+				Replicas:  1,
+			}},
+		{name: "FileStore",
+			mconfig: &server.StreamConfig{
+				Name:      "foo",
+				Retention: server.LimitsPolicy,
+				MaxAge:    time.Hour,
+				Storage:   server.FileStorage,
+				Replicas:  1,
+			}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := RunBasicJetStreamServer()
+			defer s.Shutdown()
+
+			if config := s.JetStreamConfig(); config != nil && config.StoreDir != "" {
+				defer os.RemoveAll(config.StoreDir)
+			}
+
+			mset, err := s.GlobalAccount().AddStream(c.mconfig)
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			defer mset.Delete()
+
+			// Test basic updates. We allow changing the subjects, limits, and no_ack along with replicas(TBD w/ cluster)
+			cfg := *c.mconfig
+
+			// Can't change name.
+			cfg.Name = "bar"
+			if err := mset.Update(&cfg); err == nil || !strings.Contains(err.Error(), "name must match") {
+				t.Fatalf("Expected error trying to update name")
+			}
+			// Can't change max consumers for now.
+			cfg = *c.mconfig
+			cfg.MaxConsumers = 10
+			if err := mset.Update(&cfg); err == nil || !strings.Contains(err.Error(), "can not change") {
+				t.Fatalf("Expected error trying to change MaxConsumers")
+			}
+			// Can't change storage types.
+			cfg = *c.mconfig
+			if cfg.Storage == server.FileStorage {
+				cfg.Storage = server.MemoryStorage
+			} else {
+				cfg.Storage = server.FileStorage
+			}
+			if err := mset.Update(&cfg); err == nil || !strings.Contains(err.Error(), "can not change") {
+				t.Fatalf("Expected error trying to change Storage")
+			}
+			// Can't change replicas > 1 for now.
+			cfg = *c.mconfig
+			cfg.Replicas = 10
+			if err := mset.Update(&cfg); err == nil || !strings.Contains(err.Error(), "maximum replicas") {
+				t.Fatalf("Expected error trying to change Replicas")
+			}
+			// Can't have a template set for now.
+			cfg = *c.mconfig
+			cfg.Template = "baz"
+			if err := mset.Update(&cfg); err == nil || !strings.Contains(err.Error(), "template") {
+				t.Fatalf("Expected error trying to change Template owner")
+			}
+			// Can't change limits policy.
+			cfg = *c.mconfig
+			cfg.Retention = server.WorkQueuePolicy
+			if err := mset.Update(&cfg); err == nil || !strings.Contains(err.Error(), "can not change") {
+				t.Fatalf("Expected error trying to change Retention")
+			}
+
+			// Now test changing limits.
+			nc := clientConnectToServer(t, s)
+			defer nc.Close()
+
+			pending := uint64(100)
+			for i := uint64(0); i < pending; i++ {
+				sendStreamMsg(t, nc, "foo", "0123456789")
+			}
+			pendingBytes := mset.State().Bytes
+
+			checkPending := func(msgs, bts uint64) {
+				t.Helper()
+				state := mset.State()
+				if state.Msgs != msgs {
+					t.Fatalf("Expected %d messages, got %d", msgs, state.Msgs)
+				}
+				if state.Bytes != bts {
+					t.Fatalf("Expected %d bytes, got %d", bts, state.Bytes)
+				}
+			}
+			checkPending(pending, pendingBytes)
+
+			// Update msgs to higher.
+			cfg = *c.mconfig
+			cfg.MaxMsgs = int64(pending * 2)
+			if err := mset.Update(&cfg); err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if mset.Config().MaxMsgs != cfg.MaxMsgs {
+				t.Fatalf("Expected the change to take effect, %d vs %d", mset.Config().MaxMsgs, cfg.MaxMsgs)
+			}
+			checkPending(pending, pendingBytes)
+
+			// Update msgs to lower.
+			cfg = *c.mconfig
+			cfg.MaxMsgs = int64(pending / 2)
+			if err := mset.Update(&cfg); err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if mset.Config().MaxMsgs != cfg.MaxMsgs {
+				t.Fatalf("Expected the change to take effect, %d vs %d", mset.Config().MaxMsgs, cfg.MaxMsgs)
+			}
+			checkPending(pending/2, pendingBytes/2)
+			// Now do bytes.
+			cfg = *c.mconfig
+			cfg.MaxBytes = int64(pendingBytes / 4)
+			if err := mset.Update(&cfg); err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if mset.Config().MaxBytes != cfg.MaxBytes {
+				t.Fatalf("Expected the change to take effect, %d vs %d", mset.Config().MaxBytes, cfg.MaxBytes)
+			}
+			checkPending(pending/4, pendingBytes/4)
+
+			// Now do age.
+			cfg = *c.mconfig
+			cfg.MaxAge = time.Millisecond
+			if err := mset.Update(&cfg); err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			// Just wait a bit for expiration.
+			time.Sleep(25 * time.Millisecond)
+			if mset.Config().MaxAge != cfg.MaxAge {
+				t.Fatalf("Expected the change to take effect, %d vs %d", mset.Config().MaxAge, cfg.MaxAge)
+			}
+			checkPending(0, 0)
+
+			// Now put back to original.
+			cfg = *c.mconfig
+			if err := mset.Update(&cfg); err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			for i := uint64(0); i < pending; i++ {
+				sendStreamMsg(t, nc, "foo", "0123456789")
+			}
+
+			// subject changes.
+			// Add in a subject first.
+			cfg = *c.mconfig
+			cfg.Subjects = []string{"foo", "bar"}
+			if err := mset.Update(&cfg); err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			// Make sure we can still send to foo.
+			sendStreamMsg(t, nc, "foo", "0123456789")
+			// And we can now send to bar.
+			sendStreamMsg(t, nc, "bar", "0123456789")
+			// Now delete both and change to baz only.
+			cfg.Subjects = []string{"baz"}
+			if err := mset.Update(&cfg); err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			// Make sure we do not get response acks for "foo" or "bar".
+			if resp, err := nc.Request("foo", nil, 25*time.Millisecond); err == nil || resp != nil {
+				t.Fatalf("Expected no response from jetstream for deleted subject: %q", "foo")
+			}
+			if resp, err := nc.Request("bar", nil, 25*time.Millisecond); err == nil || resp != nil {
+				t.Fatalf("Expected no response from jetstream for deleted subject: %q", "bar")
+			}
+			// Make sure we can send to "baz"
+			sendStreamMsg(t, nc, "baz", "0123456789")
+			if nmsgs := mset.State().Msgs; nmsgs != pending+3 {
+				t.Fatalf("Expected %d msgs, got %d", pending+3, nmsgs)
+			}
+
+			// FileStore restarts for config save.
+			cfg = *c.mconfig
+			if cfg.Storage == server.FileStorage {
+				cfg.Subjects = []string{"foo", "bar"}
+				cfg.MaxMsgs = 2222
+				cfg.MaxBytes = 3333333
+				cfg.MaxAge = 22 * time.Hour
+				if err := mset.Update(&cfg); err != nil {
+					t.Fatalf("Unexpected error %v", err)
+				}
+				// Pull since certain defaults etc are set in processing.
+				cfg = mset.Config()
+
+				// Restart the server.
+				// Capture port since it was dynamic.
+				u, _ := url.Parse(s.ClientURL())
+				port, _ := strconv.Atoi(u.Port())
+
+				// Stop current server.
+				sd := s.JetStreamConfig().StoreDir
+				s.Shutdown()
+				// Restart.
+				s = RunJetStreamServerOnPort(port, sd)
+				defer s.Shutdown()
+
+				mset, err = s.GlobalAccount().LookupStream(cfg.Name)
+				if err != nil {
+					t.Fatalf("Expected to find a stream for %q", cfg.Name)
+				}
+				restored_cfg := mset.Config()
+				if !reflect.DeepEqual(cfg, restored_cfg) {
+					t.Fatalf("restored configuration does not match: \n%+v\n vs \n%+v", restored_cfg, cfg)
+				}
+			}
+		})
+	}
+}
+
+func TestJetStreamDeleteMsg(t *testing.T) {
+	cases := []struct {
+		name    string
+		mconfig *server.StreamConfig
+	}{
+		{name: "MemoryStore",
+			mconfig: &server.StreamConfig{
+				Name:      "foo",
+				Retention: server.LimitsPolicy,
+				MaxAge:    time.Hour,
+				Storage:   server.MemoryStorage,
+				Replicas:  1,
+			}},
+		{name: "FileStore",
+			mconfig: &server.StreamConfig{
+				Name:      "foo",
+				Retention: server.LimitsPolicy,
+				MaxAge:    time.Hour,
+				Storage:   server.FileStorage,
+				Replicas:  1,
+			}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+
+			s := RunBasicJetStreamServer()
+			defer s.Shutdown()
+
+			if config := s.JetStreamConfig(); config != nil && config.StoreDir != "" {
+				defer os.RemoveAll(config.StoreDir)
+			}
+
+			mset, err := s.GlobalAccount().AddStream(c.mconfig)
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+
+			nc := clientConnectToServer(t, s)
+			defer nc.Close()
+
+			pubTen := func() {
+				t.Helper()
+				for i := 0; i < 10; i++ {
+					nc.Publish("foo", []byte("Hello World!"))
+				}
+				nc.Flush()
+			}
+
+			pubTen()
+
+			state := mset.State()
+			if state.Msgs != 10 {
+				t.Fatalf("Expected 10 messages, got %d", state.Msgs)
+			}
+			bytesPerMsg := state.Bytes / 10
+			if bytesPerMsg == 0 {
+				t.Fatalf("Expected non-zero bytes for msg size")
+			}
+
+			deleteAndCheck := func(seq, expectedFirstSeq uint64) {
+				t.Helper()
+				beforeState := mset.State()
+				if removed, _ := mset.DeleteMsg(seq); !removed {
+					t.Fatalf("Expected the delete of sequence %d to succeed", seq)
+				}
+				expectedState := beforeState
+				expectedState.Msgs--
+				expectedState.Bytes -= bytesPerMsg
+				expectedState.FirstSeq = expectedFirstSeq
+
+				sm, err := mset.GetMsg(expectedFirstSeq)
+				if err != nil {
+					t.Fatalf("Error fetching message for seq: %d - %v", expectedFirstSeq, err)
+				}
+				expectedState.FirstTime = sm.Time
+				expectedState.Deleted = nil
+
+				afterState := mset.State()
+				afterState.Deleted = nil
+
+				// Ignore first time in this test.
+				if !reflect.DeepEqual(afterState, expectedState) {
+					t.Fatalf("Stats not what we expected. Expected %+v, got %+v\n", expectedState, afterState)
+				}
+			}
+
+			// Delete one from the middle
+			deleteAndCheck(5, 1)
+			// Now make sure sequences are updated properly.
+			// Delete first msg.
+			deleteAndCheck(1, 2)
+			// Now last
+			deleteAndCheck(10, 2)
+			// Now gaps.
+			deleteAndCheck(3, 2)
+			deleteAndCheck(2, 4)
+
+			mset.Purge()
+			// Put ten more one.
+			pubTen()
+			deleteAndCheck(11, 12)
+			deleteAndCheck(15, 12)
+			deleteAndCheck(16, 12)
+			deleteAndCheck(20, 12)
+
+			// Only file storage beyond here.
+			if c.mconfig.Storage == server.MemoryStorage {
+				return
+			}
+
+			// Capture port since it was dynamic.
+			u, _ := url.Parse(s.ClientURL())
+			port, _ := strconv.Atoi(u.Port())
+			sd := s.JetStreamConfig().StoreDir
+
+			// Shutdown the server.
+			s.Shutdown()
+
+			s = RunJetStreamServerOnPort(port, sd)
+			defer s.Shutdown()
+
+			mset, err = s.GlobalAccount().LookupStream("foo")
+			if err != nil {
+				t.Fatalf("Expected to get the stream back")
+			}
+
+			expected := server.StreamState{Msgs: 6, Bytes: 6 * bytesPerMsg, FirstSeq: 12, LastSeq: 20}
+			state = mset.State()
+			state.FirstTime, state.LastTime, state.Deleted = time.Time{}, time.Time{}, nil
+
+			if !reflect.DeepEqual(expected, state) {
+				t.Fatalf("State not what we expected. Expected %+v, got %+v\n", expected, state)
+			}
+
+			// Now create an consumer and make sure we get the right sequence.
+			nc = clientConnectToServer(t, s)
+			defer nc.Close()
+
+			delivery := nats.NewInbox()
+			sub, _ := nc.SubscribeSync(delivery)
+			nc.Flush()
+
+			o, err := mset.AddConsumer(&server.ConsumerConfig{DeliverSubject: delivery, FilterSubject: "foo"})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			expectedStoreSeq := []uint64{12, 13, 14, 17, 18, 19}
+
+			for i := 0; i < 6; i++ {
+				m, err := sub.NextMsg(time.Second)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if o.StreamSeqFromReply(m.Reply) != expectedStoreSeq[i] {
+					t.Fatalf("Expected store seq of %d, got %d", expectedStoreSeq[i], o.StreamSeqFromReply(m.Reply))
+				}
+			}
+		})
+	}
+}
+
+// https://github.com/nats-io/jetstream/issues/396
+func TestJetStreamLimitLockBug(t *testing.T) {
+	cases := []struct {
+		name    string
+		mconfig *server.StreamConfig
+	}{
+		{name: "MemoryStore",
+			mconfig: &server.StreamConfig{
+				Name:      "foo",
+				Retention: server.LimitsPolicy,
+				MaxMsgs:   10,
+				Storage:   server.MemoryStorage,
+				Replicas:  1,
+			}},
+		{name: "FileStore",
+			mconfig: &server.StreamConfig{
+				Name:      "foo",
+				Retention: server.LimitsPolicy,
+				MaxMsgs:   10,
+				Storage:   server.FileStorage,
+				Replicas:  1,
+			}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+
+			s := RunBasicJetStreamServer()
+			defer s.Shutdown()
+
+			if config := s.JetStreamConfig(); config != nil && config.StoreDir != "" {
+				defer os.RemoveAll(config.StoreDir)
+			}
+
+			mset, err := s.GlobalAccount().AddStream(c.mconfig)
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+
+			nc := clientConnectToServer(t, s)
+			defer nc.Close()
+
+			for i := 0; i < 100; i++ {
+				sendStreamMsg(t, nc, "foo", "ok")
+			}
+
+			state := mset.State()
+			if state.Msgs != 10 {
+				t.Fatalf("Expected 10 messages, got %d", state.Msgs)
+			}
+		})
+	}
+}
+
+func TestJetStreamNextMsgNoInterest(t *testing.T) {
+	cases := []struct {
+		name    string
+		mconfig *server.StreamConfig
+	}{
+		{name: "MemoryStore",
+			mconfig: &server.StreamConfig{
+				Name:      "foo",
+				Retention: server.LimitsPolicy,
+				MaxAge:    time.Hour,
+				Storage:   server.MemoryStorage,
+				Replicas:  1,
+			}},
+		{name: "FileStore",
+			mconfig: &server.StreamConfig{
+				Name:      "foo",
+				Retention: server.LimitsPolicy,
+				MaxAge:    time.Hour,
+				Storage:   server.FileStorage,
+				Replicas:  1,
+			}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := RunBasicJetStreamServer()
+			defer s.Shutdown()
+
+			if config := s.JetStreamConfig(); config != nil {
+				defer os.RemoveAll(config.StoreDir)
+			}
+
+			cfg := &server.StreamConfig{Name: "foo", Storage: server.FileStorage}
+			mset, err := s.GlobalAccount().AddStream(cfg)
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+
+			nc := clientConnectWithOldRequest(t, s)
+			defer nc.Close()
+
+			// Now create an consumer and make sure it functions properly.
+			o, err := mset.AddConsumer(workerModeConfig("WQ"))
+			if err != nil {
+				t.Fatalf("Expected no error with registered interest, got %v", err)
+			}
+			defer o.Delete()
+
+			nextSubj := o.RequestNextMsgSubject()
+
+			// Queue up a worker but use a short time out.
+			if _, err := nc.Request(nextSubj, nil, time.Millisecond); err != nats.ErrTimeout {
+				t.Fatalf("Expected a timeout error and no response with acks suppressed")
+			}
+			// Now send a message, the worker from above will still be known but we want to make
+			// sure the system detects that so we will do a request for next msg right behind it.
+			nc.Publish("foo", []byte("OK"))
+			if msg, err := nc.Request(nextSubj, nil, 5*time.Millisecond); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			} else {
+				msg.Respond(nil) // Ack
+			}
+			// Now queue up 10 workers.
+			for i := 0; i < 10; i++ {
+				if _, err := nc.Request(nextSubj, nil, time.Microsecond); err != nats.ErrTimeout {
+					t.Fatalf("Expected a timeout error and no response with acks suppressed")
+				}
+			}
+			// Now publish ten messages.
+			for i := 0; i < 10; i++ {
+				nc.Publish("foo", []byte("OK"))
+			}
+			nc.Flush()
+			for i := 0; i < 10; i++ {
+				if msg, err := nc.Request(nextSubj, nil, 10*time.Millisecond); err != nil {
+					t.Fatalf("Unexpected error for %d: %v", i, err)
+				} else {
+					msg.Respond(nil) // Ack
+				}
+			}
+			nc.Flush()
+			ostate := o.Info()
+			if ostate.AckFloor.Stream != 11 || ostate.NumAckPending > 0 {
+				t.Fatalf("Inconsistent ack state: %+v", ostate)
+			}
+		})
+	}
+}
+
+func TestJetStreamMsgHeaders(t *testing.T) {
+	cases := []struct {
+		name    string
+		mconfig *server.StreamConfig
+	}{
+		{name: "MemoryStore",
+			mconfig: &server.StreamConfig{
+				Name:      "foo",
+				Retention: server.LimitsPolicy,
+				MaxAge:    time.Hour,
+				Storage:   server.MemoryStorage,
+				Replicas:  1,
+			}},
+		{name: "FileStore",
+			mconfig: &server.StreamConfig{
+				Name:      "foo",
+				Retention: server.LimitsPolicy,
+				MaxAge:    time.Hour,
+				Storage:   server.FileStorage,
+				Replicas:  1,
+			}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := RunBasicJetStreamServer()
+			defer s.Shutdown()
+
+			if config := s.JetStreamConfig(); config != nil {
+				defer os.RemoveAll(config.StoreDir)
+			}
+
+			mset, err := s.GlobalAccount().AddStream(c.mconfig)
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			defer mset.Delete()
+
+			nc := clientConnectToServer(t, s)
+			defer nc.Close()
+
+			m := nats.NewMsg("foo")
+			m.Header.Add("Accept-Encoding", "json")
+			m.Header.Add("Authorization", "s3cr3t")
+			m.Data = []byte("Hello JetStream Headers - #1!")
+
+			nc.PublishMsg(m)
+			nc.Flush()
+
+			state := mset.State()
+			if state.Msgs != 1 {
+				t.Fatalf("Expected 1 message, got %d", state.Msgs)
+			}
+			if state.Bytes == 0 {
+				t.Fatalf("Expected non-zero bytes")
+			}
+
+			// Now access raw from stream.
+			sm, err := mset.GetMsg(1)
+			if err != nil {
+				t.Fatalf("Unexpected error getting stored message: %v", err)
+			}
+			// Calculate the []byte version of the headers.
+			var b bytes.Buffer
+			b.WriteString("NATS/1.0\r\n")
+			m.Header.Write(&b)
+			b.WriteString("\r\n")
+			hdr := b.Bytes()
+
+			if !bytes.Equal(sm.Header, hdr) {
+				t.Fatalf("Message headers do not match, %q vs %q", hdr, sm.Header)
+			}
+			if !bytes.Equal(sm.Data, m.Data) {
+				t.Fatalf("Message data do not match, %q vs %q", m.Data, sm.Data)
+			}
+
+			// Now do consumer based.
+			sub, _ := nc.SubscribeSync(nats.NewInbox())
+			defer sub.Unsubscribe()
+			nc.Flush()
+
+			o, err := mset.AddConsumer(&server.ConsumerConfig{DeliverSubject: sub.Subject})
+			if err != nil {
+				t.Fatalf("Expected no error with registered interest, got %v", err)
+			}
+			defer o.Delete()
+
+			cm, err := sub.NextMsg(time.Second)
+			if err != nil {
+				t.Fatalf("Error getting message: %v", err)
+			}
+			// Check the message.
+			// Check out original headers.
+			if cm.Header.Get("Accept-Encoding") != "json" ||
+				cm.Header.Get("Authorization") != "s3cr3t" {
+				t.Fatalf("Original headers not present")
+			}
+			if !bytes.Equal(m.Data, cm.Data) {
+				t.Fatalf("Message payloads are not the same: %q vs %q", cm.Data, m.Data)
+			}
+		})
+	}
+}
+
+func TestJetStreamTemplateBasics(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	acc := s.GlobalAccount()
+
+	mcfg := &server.StreamConfig{
+		Subjects:  []string{"kv.*"},
+		Retention: server.LimitsPolicy,
+		MaxAge:    time.Hour,
+		MaxMsgs:   4,
+		Storage:   server.MemoryStorage,
+		Replicas:  1,
+	}
+	template := &server.StreamTemplateConfig{
+		Name:       "kv",
+		Config:     mcfg,
+		MaxStreams: 4,
+	}
+
+	if _, err := acc.AddStreamTemplate(template); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if templates := acc.Templates(); len(templates) != 1 {
+		t.Fatalf("Expected to get array of 1 template, got %d", len(templates))
+	}
+	if err := acc.DeleteStreamTemplate("foo"); err == nil {
+		t.Fatalf("Expected an error for non-existent template")
+	}
+	if err := acc.DeleteStreamTemplate(template.Name); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if templates := acc.Templates(); len(templates) != 0 {
+		t.Fatalf("Expected to get array of no templates, got %d", len(templates))
+	}
+	// Add it back in and test basics
+	if _, err := acc.AddStreamTemplate(template); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Connect a client and send a message which should trigger the stream creation.
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	sendStreamMsg(t, nc, "kv.22", "derek")
+	sendStreamMsg(t, nc, "kv.33", "cat")
+	sendStreamMsg(t, nc, "kv.44", "sam")
+	sendStreamMsg(t, nc, "kv.55", "meg")
+
+	if nms := acc.NumStreams(); nms != 4 {
+		t.Fatalf("Expected 4 auto-created streams, got %d", nms)
+	}
+
+	// This one should fail due to max.
+	if resp, err := nc.Request("kv.99", nil, 100*time.Millisecond); err == nil {
+		t.Fatalf("Expected this to fail, but got %q", resp.Data)
+	}
+
+	// Now delete template and make sure the underlying streams go away too.
+	if err := acc.DeleteStreamTemplate(template.Name); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if nms := acc.NumStreams(); nms != 0 {
+		t.Fatalf("Expected no auto-created streams to remain, got %d", nms)
+	}
+}
+
+func TestJetStreamTemplateFileStoreRecovery(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	acc := s.GlobalAccount()
+
+	mcfg := &server.StreamConfig{
+		Subjects:  []string{"kv.*"},
+		Retention: server.LimitsPolicy,
+		MaxAge:    time.Hour,
+		MaxMsgs:   50,
+		Storage:   server.FileStorage,
+		Replicas:  1,
+	}
+	template := &server.StreamTemplateConfig{
+		Name:       "kv",
+		Config:     mcfg,
+		MaxStreams: 100,
+	}
+
+	if _, err := acc.AddStreamTemplate(template); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Make sure we can not add in a stream on our own with a template owner.
+	badCfg := *mcfg
+	badCfg.Name = "bad"
+	badCfg.Template = "kv"
+	if _, err := acc.AddStream(&badCfg); err == nil {
+		t.Fatalf("Expected error adding stream with direct template owner")
+	}
+
+	// Connect a client and send a message which should trigger the stream creation.
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	for i := 1; i <= 100; i++ {
+		subj := fmt.Sprintf("kv.%d", i)
+		for x := 0; x < 50; x++ {
+			sendStreamMsg(t, nc, subj, "Hello")
+		}
+	}
+	nc.Flush()
+
+	if nms := acc.NumStreams(); nms != 100 {
+		t.Fatalf("Expected 100 auto-created streams, got %d", nms)
+	}
+
+	// Capture port since it was dynamic.
+	u, _ := url.Parse(s.ClientURL())
+	port, _ := strconv.Atoi(u.Port())
+
+	restartServer := func() {
+		t.Helper()
+		sd := s.JetStreamConfig().StoreDir
+		// Stop current server.
+		s.Shutdown()
+		// Restart.
+		s = RunJetStreamServerOnPort(port, sd)
+	}
+
+	// Restart.
+	restartServer()
+	defer s.Shutdown()
+
+	acc = s.GlobalAccount()
+	if nms := acc.NumStreams(); nms != 100 {
+		t.Fatalf("Expected 100 auto-created streams, got %d", nms)
+	}
+	tmpl, err := acc.LookupStreamTemplate(template.Name)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Make sure t.Delete() survives restart.
+	tmpl.Delete()
+
+	// Restart.
+	restartServer()
+	defer s.Shutdown()
+
+	acc = s.GlobalAccount()
+	if nms := acc.NumStreams(); nms != 0 {
+		t.Fatalf("Expected no auto-created streams, got %d", nms)
+	}
+	if _, err := acc.LookupStreamTemplate(template.Name); err == nil {
+		t.Fatalf("Expected to not find the template after restart")
+	}
+}
+
+func TestJetStreamTemplateStorageUsage(t *testing.T) {
+	s := RunRandClientPortServer()
+	defer s.Shutdown()
+
+	acc, _ := s.LookupOrRegisterAccount("FOO")
+	storeDir, _ := ioutil.TempDir(os.TempDir(), "jstests-storedir-")
+	defer os.RemoveAll(storeDir)
+	if err := s.EnableJetStream(&server.JetStreamConfig{MaxMemory: 64 * 1024, MaxStore: 64 * 1024, StoreDir: storeDir}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	limits := &server.JetStreamAccountLimits{MaxMemory: 4096, MaxStore: 8192, MaxStreams: -1, MaxConsumers: -1}
+	if err := acc.EnableJetStream(limits); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	addTemplate := func(i int) error {
+		_, err := acc.AddStreamTemplate(&server.StreamTemplateConfig{
+			Name:       fmt.Sprintf("T%d", i),
+			Config:     &server.StreamConfig{Subjects: []string{fmt.Sprintf("t%d.*", i)}, Storage: server.FileStorage},
+			MaxStreams: 1,
+		})
+		return err
+	}
+
+	var last int64
+	var n int
+	for ; n < 100; n++ {
+		if err := addTemplate(n); err != nil {
+			if !strings.Contains(err.Error(), "insufficient storage") {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			break
+		}
+		stats := acc.JetStreamUsage()
+		if stats.Store <= uint64(last) {
+			t.Fatalf("Expected storage usage to rise above %d, got %d", last, stats.Store)
+		}
+		last = int64(stats.Store)
+	}
+	if n == 0 || n == 100 {
+		t.Fatalf("Expected templates to be limited by the account storage, added %d", n)
+	}
+	if last > limits.MaxStore {
+		t.Fatalf("Expected usage to stay within %d bytes, got %d", limits.MaxStore, last)
+	}
+
+	// Removing templates should give the storage back.
+	for i := 0; i < n; i++ {
+		if err := acc.DeleteStreamTemplate(fmt.Sprintf("T%d", i)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if stats := acc.JetStreamUsage(); stats.Store != 0 || stats.StoreReserved != 0 {
+		t.Fatalf("Expected no storage usage, got %+v", stats)
+	}
+	if err := addTemplate(n); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Accounts without limits, e.g. from `jetstream: enabled`, can add templates.
+	bar, _ := s.LookupOrRegisterAccount("BAR")
+	if err := bar.EnableJetStream(&server.JetStreamAccountLimits{MaxMemory: -1, MaxStore: -1, MaxStreams: -1, MaxConsumers: -1}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := bar.AddStreamTemplate(&server.StreamTemplateConfig{
+		Name:       "T",
+		Config:     &server.StreamConfig{Subjects: []string{"bar.*"}, Storage: server.FileStorage},
+		MaxStreams: 1,
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stats := bar.JetStreamUsage(); stats.Store == 0 || stats.Memory != 0 {
+		t.Fatalf("Expected template metadata to be charged to storage, got %+v", stats)
+	}
+}
+
+// This will be testing our ability to conditionally rewrite subjects for last mile
+// when working with JetStream. Consumers receive messages that have their subjects
+// rewritten to match the original subject. NATS routing is all subject based except
+// for the last mile to the client.
+func TestJetStreamSingleInstanceRemoteAccess(t *testing.T) {
+	ca := createClusterWithName(t, "A", 1)
+	defer shutdownCluster(ca)
+	cb := createClusterWithName(t, "B", 1, ca)
+	defer shutdownCluster(cb)
+
+	// Connect our leafnode server to cluster B.
+	opts := cb.opts[rand.Intn(len(cb.opts))]
+	s, _ := runSolicitLeafServer(opts)
+	defer s.Shutdown()
+
+	checkLeafNodeConnected(t, s)
+
+	if err := s.EnableJetStream(nil); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "foo", Storage: server.MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	toSend := 10
+	for i := 0; i < toSend; i++ {
+		sendStreamMsg(t, nc, "foo", "Hello World!")
+	}
+
+	// Now create a push based consumer. Connected to the non-jetstream server via a random server on cluster A.
+	sl := ca.servers[rand.Intn(len(ca.servers))]
+	nc2 := clientConnectToServer(t, sl)
+	defer nc2.Close()
+
+	sub, _ := nc2.SubscribeSync(nats.NewInbox())
+	defer sub.Unsubscribe()
+
+	// Need to wait for interest to propagate across GW.
+	nc2.Flush()
+	time.Sleep(25 * time.Millisecond)
+
+	o, err := mset.AddConsumer(&server.ConsumerConfig{DeliverSubject: sub.Subject})
+	if err != nil {
+		t.Fatalf("Expected no error with registered interest, got %v", err)
+	}
+	defer o.Delete()
+
+	checkSubPending := func(numExpected int) {
+		t.Helper()
+		checkFor(t, 200*time.Millisecond, 10*time.Millisecond, func() error {
+			if nmsgs, _, _ := sub.Pending(); err != nil || nmsgs != numExpected {
+				return fmt.Errorf("Did not receive correct number of messages: %d vs %d", nmsgs, numExpected)
+			}
+			return nil
+		})
+	}
+	checkSubPending(toSend)
+
+	checkMsg := func(m *nats.Msg, err error, i int) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("Got an error checking message: %v", err)
+		}
+		if m.Subject != "foo" {
+			t.Fatalf("Expected original subject of %q, but got %q", "foo", m.Subject)
+		}
+		// Now check that reply subject exists and has a sequence as the last token.
+		if seq := o.SeqFromReply(m.Reply); seq != uint64(i) {
+			t.Fatalf("Expected sequence of %d , got %d", i, seq)
+		}
+	}
+
+	// Now check the subject to make sure its the original one.
+	for i := 1; i <= toSend; i++ {
+		m, err := sub.NextMsg(time.Second)
+		checkMsg(m, err, i)
+	}
+
+	// Now do a pull based consumer.
+	o, err = mset.AddConsumer(workerModeConfig("p"))
+	if err != nil {
+		t.Fatalf("Expected no error with registered interest, got %v", err)
+	}
+	defer o.Delete()
+
+	nextMsg := o.RequestNextMsgSubject()
+	for i := 1; i <= toSend; i++ {
+		m, err := nc.Request(nextMsg, nil, time.Second)
+		checkMsg(m, err, i)
+	}
+}
+
+func clientConnectToServerWithUP(t *testing.T, opts *server.Options, user, pass string) *nats.Conn {
+	curl := fmt.Sprintf("nats://%s:%s@%s:%d", user, pass, opts.Host, opts.Port)
+	nc, err := nats.Connect(curl, nats.Name("JS-UP-TEST"), nats.ReconnectWait(5*time.Millisecond), nats.MaxReconnects(-1))
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+	return nc
+}
+
+func TestJetStreamCanNotEnableOnSystemAccount(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	sa := s.SystemAccount()
+	if err := sa.EnableJetStream(nil); err == nil {
+		t.Fatalf("Expected an error trying to enable on the system account")
+	}
+}
+
+func TestJetStreamMultipleAccountsBasics(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: 127.0.0.1:-1
+		jetstream: {max_mem_store: 64GB, max_file_store: 10TB}
+		accounts: {
+			A: {
+				jetstream: enabled
+				users: [ {user: ua, password: pwd} ]
+			},
+			B: {
+				jetstream: {max_mem: 1GB, max_store: 1TB, max_streams: 10, max_consumers: 1k}
+				users: [ {user: ub, password: pwd} ]
+			},
+			C: {
+				users: [ {user: uc, password: pwd} ]
+			},
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	if !s.JetStreamEnabled() {
+		t.Fatalf("Expected JetStream to be enabled")
+	}
+
+	nca := clientConnectToServerWithUP(t, opts, "ua", "pwd")
+	defer nca.Close()
+
+	ncb := clientConnectToServerWithUP(t, opts, "ub", "pwd")
+	defer ncb.Close()
+
+	resp, err := ncb.Request(server.JSApiAccountInfo, nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var info server.JSApiAccountInfoResponse
+	if err := json.Unmarshal(resp.Data, &info); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	limits := info.Limits
+	if limits.MaxStreams != 10 {
+		t.Fatalf("Expected 10 for MaxStreams, got %d", limits.MaxStreams)
+	}
+	if limits.MaxConsumers != 1000 {
+		t.Fatalf("Expected MaxConsumers of %d, got %d", 1000, limits.MaxConsumers)
+	}
+	gb := int64(1024 * 1024 * 1024)
+	if limits.MaxMemory != gb {
+		t.Fatalf("Expected MaxMemory to be 1GB, got %d", limits.MaxMemory)
+	}
+	if limits.MaxStore != 1024*gb {
+		t.Fatalf("Expected MaxStore to be 1TB, got %d", limits.MaxStore)
+	}
+
+	ncc := clientConnectToServerWithUP(t, opts, "uc", "pwd")
+	defer ncc.Close()
+
+	expectNotEnabled := func(resp *nats.Msg, err error) {
+		t.Helper()
 		if err != nil {
-			t.Fatalf("Unexpected error getting stream list: %v", err)
+			t.Fatalf("Unexpected error requesting enabled status: %v", err)
 		}
-		return resp.Data
+		if resp == nil {
+			t.Fatalf("No response, possible timeout?")
+		}
+		var iResp server.JSApiAccountInfoResponse
+		if err := json.Unmarshal(resp.Data, &iResp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if iResp.Error == nil {
+			t.Fatalf("Expected an error on not enabled account")
+		}
+	}
+
+	// Check C is not enabled. We expect a negative response, not a timeout.
+	expectNotEnabled(ncc.Request(server.JSApiAccountInfo, nil, 250*time.Millisecond))
+
+	// Now do simple reload and check that we do the right thing. Testing enable and disable and also change in limits
+	newConf := []byte(`
+		listen: 127.0.0.1:-1
+		jetstream: {max_mem_store: 64GB, max_file_store: 10TB}
+		accounts: {
+			A: {
+				jetstream: disabled
+				users: [ {user: ua, password: pwd} ]
+			},
+			B: {
+				jetstream: {max_mem: 32GB, max_store: 512GB, max_streams: 100, max_consumers: 4k}
+				users: [ {user: ub, password: pwd} ]
+			},
+			C: {
+				jetstream: {max_mem: 1GB, max_store: 1TB, max_streams: 10, max_consumers: 1k}
+				users: [ {user: uc, password: pwd} ]
+			},
+		}
+	`)
+	if err := ioutil.WriteFile(conf, newConf, 0600); err != nil {
+		t.Fatalf("Error rewriting server's config file: %v", err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on server reload: %v", err)
+	}
+	expectNotEnabled(nca.Request(server.JSApiAccountInfo, nil, 250*time.Millisecond))
+
+	resp, _ = ncb.Request(server.JSApiAccountInfo, nil, 250*time.Millisecond)
+	if err := json.Unmarshal(resp.Data, &info); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info.Error != nil {
+		t.Fatalf("Expected JetStream to be enabled, got %+v", info.Error)
+	}
+
+	resp, _ = ncc.Request(server.JSApiAccountInfo, nil, 250*time.Millisecond)
+	if err := json.Unmarshal(resp.Data, &info); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info.Error != nil {
+		t.Fatalf("Expected JetStream to be enabled, got %+v", info.Error)
+	}
+
+	// Now check that limits have been updated.
+	// Account B
+	resp, err = ncb.Request(server.JSApiAccountInfo, nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := json.Unmarshal(resp.Data, &info); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	limits = info.Limits
+	if limits.MaxStreams != 100 {
+		t.Fatalf("Expected 100 for MaxStreams, got %d", limits.MaxStreams)
+	}
+	if limits.MaxConsumers != 4000 {
+		t.Fatalf("Expected MaxConsumers of %d, got %d", 4000, limits.MaxConsumers)
+	}
+	if limits.MaxMemory != 32*gb {
+		t.Fatalf("Expected MaxMemory to be 32GB, got %d", limits.MaxMemory)
+	}
+	if limits.MaxStore != 512*gb {
+		t.Fatalf("Expected MaxStore to be 512GB, got %d", limits.MaxStore)
+	}
+
+	// Account C
+	resp, err = ncc.Request(server.JSApiAccountInfo, nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := json.Unmarshal(resp.Data, &info); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	limits = info.Limits
+	if limits.MaxStreams != 10 {
+		t.Fatalf("Expected 10 for MaxStreams, got %d", limits.MaxStreams)
+	}
+	if limits.MaxConsumers != 1000 {
+		t.Fatalf("Expected MaxConsumers of %d, got %d", 1000, limits.MaxConsumers)
+	}
+	if limits.MaxMemory != gb {
+		t.Fatalf("Expected MaxMemory to be 1GB, got %d", limits.MaxMemory)
+	}
+	if limits.MaxStore != 1024*gb {
+		t.Fatalf("Expected MaxStore to be 1TB, got %d", limits.MaxStore)
+	}
+}
+
+func TestJetStreamServerResourcesConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: 127.0.0.1:-1
+		jetstream: {max_mem_store: 2GB, max_file_store: 1TB}
+	`))
+	defer os.Remove(conf)
+
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	if !s.JetStreamEnabled() {
+		t.Fatalf("Expected JetStream to be enabled")
+	}
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	gb := int64(1024 * 1024 * 1024)
+	jsc := s.JetStreamConfig()
+	if jsc.MaxMemory != 2*gb {
+		t.Fatalf("Expected MaxMemory to be %d, got %d", 2*gb, jsc.MaxMemory)
+	}
+	if jsc.MaxStore != 1024*gb {
+		t.Fatalf("Expected MaxStore to be %d, got %d", 1024*gb, jsc.MaxStore)
+	}
+}
+
+////////////////////////////////////////
+// Benchmark placeholders
+// TODO(dlc) - move
+////////////////////////////////////////
+
+func TestJetStreamPubPerf(t *testing.T) {
+	// Comment out to run, holding place for now.
+	t.SkipNow()
+
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	acc := s.GlobalAccount()
+
+	msetConfig := server.StreamConfig{
+		Name:     "sr22",
+		Storage:  server.FileStorage,
+		Subjects: []string{"foo"},
+	}
+
+	if _, err := acc.AddStream(&msetConfig); err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	toSend := 5000000
+	numProducers := 1
+
+	payload := []byte("Hello World")
+
+	startCh := make(chan bool)
+	var wg sync.WaitGroup
+
+	for n := 0; n < numProducers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-startCh
+			for i := 0; i < int(toSend)/numProducers; i++ {
+				nc.Publish("foo", payload)
+			}
+			nc.Flush()
+		}()
+	}
+
+	// Wait for Go routines.
+	time.Sleep(10 * time.Millisecond)
+
+	start := time.Now()
+
+	close(startCh)
+	wg.Wait()
+
+	tt := time.Since(start)
+	fmt.Printf("time is %v\n", tt)
+	fmt.Printf("%.0f msgs/sec\n", float64(toSend)/tt.Seconds())
+}
+
+func TestJetStreamPubWithAsyncResponsePerf(t *testing.T) {
+	// Comment out to run, holding place for now.
+	t.SkipNow()
+
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	acc := s.GlobalAccount()
+
+	msetConfig := server.StreamConfig{
+		Name:     "sr33",
+		Storage:  server.MemoryStorage,
+		Subjects: []string{"foo"},
+	}
+
+	if _, err := acc.AddStream(&msetConfig); err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	toSend := 1000000
+	payload := []byte("Hello World")
+
+	start := time.Now()
+	for i := 0; i < toSend; i++ {
+		nc.PublishRequest("foo", "bar", payload)
+	}
+	nc.Flush()
+
+	tt := time.Since(start)
+	fmt.Printf("time is %v\n", tt)
+	fmt.Printf("%.0f msgs/sec\n", float64(toSend)/tt.Seconds())
+}
+
+func TestJetStreamConsumerPerf(t *testing.T) {
+	// Comment out to run, holding place for now.
+	t.SkipNow()
+
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
 	}
 
-	checkResp := func(resp []byte, expectedLen, expectedOffset int) {
-		t.Helper()
-		var listResponse server.JSApiStreamNamesResponse
-		if err := json.Unmarshal(resp, &listResponse); err != nil {
-			t.Fatalf("Unexpected error: %v", err)
-		}
-		if len(listResponse.Streams) != expectedLen {
-			t.Fatalf("Expected only %d streams but got %d", expectedLen, len(listResponse.Streams))
-		}
-		if listResponse.Total != streamsNum {
-			t.Fatalf("Expected total to be %d but got %d", streamsNum, listResponse.Total)
-		}
-		if listResponse.Offset != expectedOffset {
-			t.Fatalf("Expected offset to be %d but got %d", expectedOffset, listResponse.Offset)
-		}
-		if expectedLen < 1 {
-			return
-		}
-		// Make sure we get the right stream.
-		sname := fmt.Sprintf("STREAM-%06d", expectedOffset+1)
-		if listResponse.Streams[0] != sname {
-			t.Fatalf("Expected stream %q to be first, got %q", sname, listResponse.Streams[0])
-		}
+	acc := s.GlobalAccount()
+
+	msetConfig := server.StreamConfig{
+		Name:     "sr22",
+		Storage:  server.MemoryStorage,
+		Subjects: []string{"foo"},
 	}
 
-	checkResp(reqList(0), server.JSApiNamesLimit, 0)
-	checkResp(reqList(server.JSApiNamesLimit), server.JSApiNamesLimit, server.JSApiNamesLimit)
-	checkResp(reqList(streamsNum), 0, streamsNum)
-	checkResp(reqList(streamsNum-22), 22, streamsNum-22)
-	checkResp(reqList(streamsNum+22), 0, streamsNum)
+	mset, err := acc.AddStream(&msetConfig)
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	payload := []byte("Hello World")
+
+	toStore := 2000000
+	for i := 0; i < toStore; i++ {
+		nc.Publish("foo", payload)
+	}
+	nc.Flush()
+
+	_, err = mset.AddConsumer(&server.ConsumerConfig{
+		Durable:        "d",
+		DeliverSubject: "d",
+		AckPolicy:      server.AckNone,
+	})
+	if err != nil {
+		t.Fatalf("Error creating consumer: %v", err)
+	}
+
+	var received int
+	done := make(chan bool)
+
+	nc.Subscribe("d", func(m *nats.Msg) {
+		received++
+		if received >= toStore {
+			done <- true
+		}
+	})
+	start := time.Now()
+	nc.Flush()
+
+	<-done
+	tt := time.Since(start)
+	fmt.Printf("time is %v\n", tt)
+	fmt.Printf("%.0f msgs/sec\n", float64(toStore)/tt.Seconds())
 }
 
-func TestJetStreamAPIConsumerListPaging(t *testing.T) {
+func TestJetStreamConsumerAckFileStorePerf(t *testing.T) {
+	// Comment out to run, holding place for now.
+	t.SkipNow()
+
 	s := RunBasicJetStreamServer()
 	defer s.Shutdown()
 
-	// Forced cleanup of all persisted state.
 	if config := s.JetStreamConfig(); config != nil {
 		defer os.RemoveAll(config.StoreDir)
 	}
 
-	sname := "MYSTREAM"
-	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: sname})
+	acc := s.GlobalAccount()
+
+	msetConfig := server.StreamConfig{
+		Name:     "sr22",
+		Storage:  server.FileStorage,
+		Subjects: []string{"foo"},
+	}
+
+	mset, err := acc.AddStream(&msetConfig)
 	if err != nil {
 		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
 
-	// Client for API requests.
 	nc := clientConnectToServer(t, s)
 	defer nc.Close()
 
-	consumersNum := server.JSApiNamesLimit
-	for i := 1; i <= consumersNum; i++ {
-		dsubj := fmt.Sprintf("d.%d", i)
-		sub, _ := nc.SubscribeSync(dsubj)
-		defer sub.Unsubscribe()
-		nc.Flush()
+	payload := []byte("Hello World")
 
-		_, err := mset.AddConsumer(&server.ConsumerConfig{DeliverSubject: dsubj})
-		if err != nil {
-			t.Fatalf("Unexpected error: %v", err)
-		}
+	toStore := uint64(200000)
+	for i := uint64(0); i < toStore; i++ {
+		nc.Publish("foo", payload)
 	}
+	nc.Flush()
 
-	reqListSubject := fmt.Sprintf(server.JSApiConsumersT, sname)
-	reqList := func(offset int) []byte {
-		t.Helper()
-		var req []byte
-		if offset > 0 {
-			req, _ = json.Marshal(&server.JSApiConsumersRequest{ApiPagedRequest: server.ApiPagedRequest{Offset: offset}})
-		}
-		resp, err := nc.Request(reqListSubject, req, time.Second)
-		if err != nil {
-			t.Fatalf("Unexpected error getting stream list: %v", err)
-		}
-		return resp.Data
+	if msgs := mset.State().Msgs; msgs != uint64(toStore) {
+		t.Fatalf("Expected %d messages, got %d", toStore, msgs)
 	}
 
-	checkResp := func(resp []byte, expectedLen, expectedOffset int) {
-		t.Helper()
-		var listResponse server.JSApiConsumerNamesResponse
-		if err := json.Unmarshal(resp, &listResponse); err != nil {
-			t.Fatalf("Unexpected error: %v", err)
-		}
-		if len(listResponse.Consumers) != expectedLen {
-			t.Fatalf("Expected only %d streams but got %d", expectedLen, len(listResponse.Consumers))
-		}
-		if listResponse.Total != consumersNum {
-			t.Fatalf("Expected total to be %d but got %d", consumersNum, listResponse.Total)
+	o, err := mset.AddConsumer(&server.ConsumerConfig{
+		Durable:        "d",
+		DeliverSubject: "d",
+		AckPolicy:      server.AckExplicit,
+		AckWait:        10 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("Error creating consumer: %v", err)
+	}
+	defer o.Stop()
+
+	var received uint64
+	done := make(chan bool)
+
+	sub, _ := nc.Subscribe("d", func(m *nats.Msg) {
+		m.Respond(nil) // Ack
+		received++
+		if received >= toStore {
+			done <- true
 		}
-		if listResponse.Offset != expectedOffset {
-			t.Fatalf("Expected offset to be %d but got %d", expectedOffset, listResponse.Offset)
+	})
+	sub.SetPendingLimits(-1, -1)
+
+	start := time.Now()
+	nc.Flush()
+
+	<-done
+	tt := time.Since(start)
+	fmt.Printf("time is %v\n", tt)
+	fmt.Printf("%.0f msgs/sec\n", float64(toStore)/tt.Seconds())
+}
+
+func TestJetStreamPubSubPerf(t *testing.T) {
+	// Comment out to run, holding place for now.
+	t.SkipNow()
+
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	acc := s.GlobalAccount()
+
+	msetConfig := server.StreamConfig{
+		Name:     "MSET22",
+		Storage:  server.FileStorage,
+		Subjects: []string{"foo"},
+	}
+
+	mset, err := acc.AddStream(&msetConfig)
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	var toSend = 1000000
+	var received int
+	done := make(chan bool)
+
+	delivery := "d"
+
+	nc.Subscribe(delivery, func(m *nats.Msg) {
+		received++
+		if received >= toSend {
+			done <- true
 		}
+	})
+	nc.Flush()
+
+	_, err = mset.AddConsumer(&server.ConsumerConfig{
+		DeliverSubject: delivery,
+		AckPolicy:      server.AckNone,
+	})
+	if err != nil {
+		t.Fatalf("Error creating consumer: %v", err)
 	}
 
-	checkResp(reqList(0), server.JSApiNamesLimit, 0)
-	checkResp(reqList(consumersNum-22), 22, consumersNum-22)
-	checkResp(reqList(consumersNum+22), 0, consumersNum)
+	payload := []byte("Hello World")
+
+	start := time.Now()
+
+	for i := 0; i < toSend; i++ {
+		nc.Publish("foo", payload)
+	}
+
+	<-done
+	tt := time.Since(start)
+	fmt.Printf("time is %v\n", tt)
+	fmt.Printf("%.0f msgs/sec\n", float64(toSend)/tt.Seconds())
 }
 
-func TestJetStreamUpdateStream(t *testing.T) {
+func TestJetStreamAckExplicitMsgRemoval(t *testing.T) {
 	cases := []struct {
 		name    string
 		mconfig *server.StreamConfig
 	}{
-		{name: "MemoryStore",
-			mconfig: &server.StreamConfig{
-				Name:      "foo",
-				Retention: server.LimitsPolicy,
-				MaxAge:    time.Hour,
-				Storage:   server.MemoryStorage,
-				Replicas:  1,
-			}},
-		{name: "FileStore",
-			mconfig: &server.StreamConfig{
-				Name:      "foo",
-				Retention: server.LimitsPolicy,
-				MaxAge:    time.Hour,
-				Storage:   server.FileStorage,
-				Replicas:  1,
-			}},
+		{"MemoryStore", &server.StreamConfig{
+			Name:      "MY_STREAM",
+			Storage:   server.MemoryStorage,
+			Subjects:  []string{"foo.*"},
+			Retention: server.InterestPolicy,
+		}},
+		{"FileStore", &server.StreamConfig{
+			Name:      "MY_STREAM",
+			Storage:   server.FileStorage,
+			Subjects:  []string{"foo.*"},
+			Retention: server.InterestPolicy,
+		}},
 	}
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
 			s := RunBasicJetStreamServer()
 			defer s.Shutdown()
 
-			if config := s.JetStreamConfig(); config != nil && config.StoreDir != "" {
+			if config := s.JetStreamConfig(); config != nil {
 				defer os.RemoveAll(config.StoreDir)
 			}
 
@@ -7749,222 +10405,288 @@ func TestJetStreamUpdateStream(t *testing.T) {
 			}
 			defer mset.Delete()
 
-			// Test basic updates. We allow changing the subjects, limits, and no_ack along with replicas(TBD w/ cluster)
-			cfg := *c.mconfig
+			nc1 := clientConnectToServer(t, s)
+			defer nc1.Close()
 
-			// Can't change name.
-			cfg.Name = "bar"
-			if err := mset.Update(&cfg); err == nil || !strings.Contains(err.Error(), "name must match") {
-				t.Fatalf("Expected error trying to update name")
+			nc2 := clientConnectToServer(t, s)
+			defer nc2.Close()
+
+			// Create two durable consumers on the same subject
+			sub1, _ := nc1.SubscribeSync(nats.NewInbox())
+			defer sub1.Unsubscribe()
+			nc1.Flush()
+
+			o1, err := mset.AddConsumer(&server.ConsumerConfig{
+				Durable:        "dur1",
+				DeliverSubject: sub1.Subject,
+				FilterSubject:  "foo.bar",
+				AckPolicy:      server.AckExplicit,
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error adding consumer: %v", err)
 			}
-			// Can't change max consumers for now.
-			cfg = *c.mconfig
-			cfg.MaxConsumers = 10
-			if err := mset.Update(&cfg); err == nil || !strings.Contains(err.Error(), "can not change") {
-				t.Fatalf("Expected error trying to change MaxConsumers")
+			defer o1.Delete()
+
+			sub2, _ := nc2.SubscribeSync(nats.NewInbox())
+			defer sub2.Unsubscribe()
+			nc2.Flush()
+
+			o2, err := mset.AddConsumer(&server.ConsumerConfig{
+				Durable:        "dur2",
+				DeliverSubject: sub2.Subject,
+				FilterSubject:  "foo.bar",
+				AckPolicy:      server.AckExplicit,
+				AckWait:        100 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error adding consumer: %v", err)
 			}
-			// Can't change storage types.
-			cfg = *c.mconfig
-			if cfg.Storage == server.FileStorage {
-				cfg.Storage = server.MemoryStorage
-			} else {
-				cfg.Storage = server.FileStorage
+			defer o2.Delete()
+
+			// Send 2 messages
+			toSend := 2
+			for i := 0; i < toSend; i++ {
+				sendStreamMsg(t, nc1, "foo.bar", fmt.Sprintf("msg%v", i+1))
 			}
-			if err := mset.Update(&cfg); err == nil || !strings.Contains(err.Error(), "can not change") {
-				t.Fatalf("Expected error trying to change Storage")
+			state := mset.State()
+			if state.Msgs != uint64(toSend) {
+				t.Fatalf("Expected %v messages, got %d", toSend, state.Msgs)
 			}
-			// Can't change replicas > 1 for now.
-			cfg = *c.mconfig
-			cfg.Replicas = 10
-			if err := mset.Update(&cfg); err == nil || !strings.Contains(err.Error(), "maximum replicas") {
-				t.Fatalf("Expected error trying to change Replicas")
+
+			// Receive the messages and ack them.
+			subs := []*nats.Subscription{sub1, sub2}
+			for _, sub := range subs {
+				for i := 0; i < toSend; i++ {
+					m, err := sub.NextMsg(time.Second)
+					if err != nil {
+						t.Fatalf("Error acking message: %v", err)
+					}
+					m.Respond(nil)
+				}
 			}
-			// Can't have a template set for now.
-			cfg = *c.mconfig
-			cfg.Template = "baz"
-			if err := mset.Update(&cfg); err == nil || !strings.Contains(err.Error(), "template") {
-				t.Fatalf("Expected error trying to change Template owner")
+			// To make sure acks are processed for checking state after sending new ones.
+			checkFor(t, time.Second, 25*time.Millisecond, func() error {
+				if state = mset.State(); state.Msgs != 0 {
+					return fmt.Errorf("Stream still has messages")
+				}
+				return nil
+			})
+
+			// Now close the 2nd subscription...
+			sub2.Unsubscribe()
+			nc2.Flush()
+
+			// Send 2 more new messages
+			for i := 0; i < toSend; i++ {
+				sendStreamMsg(t, nc1, "foo.bar", fmt.Sprintf("msg%v", 2+i+1))
 			}
-			// Can't change limits policy.
-			cfg = *c.mconfig
-			cfg.Retention = server.WorkQueuePolicy
-			if err := mset.Update(&cfg); err == nil || !strings.Contains(err.Error(), "can not change") {
-				t.Fatalf("Expected error trying to change Retention")
+			state = mset.State()
+			if state.Msgs != uint64(toSend) {
+				t.Fatalf("Expected %v messages, got %d", toSend, state.Msgs)
 			}
 
-			// Now test changing limits.
-			nc := clientConnectToServer(t, s)
-			defer nc.Close()
+			// first subscription should get it and will ack it.
+			for i := 0; i < toSend; i++ {
+				m, err := sub1.NextMsg(time.Second)
+				if err != nil {
+					t.Fatalf("Error getting message to ack: %v", err)
+				}
+				m.Respond(nil)
+			}
+			// For acks from m.Respond above
+			nc1.Flush()
 
-			pending := uint64(100)
-			for i := uint64(0); i < pending; i++ {
-				sendStreamMsg(t, nc, "foo", "0123456789")
+			// Now recreate the subscription for the 2nd JS consumer
+			sub2, _ = nc2.SubscribeSync(nats.NewInbox())
+			defer sub2.Unsubscribe()
+
+			o2, err = mset.AddConsumer(&server.ConsumerConfig{
+				Durable:        "dur2",
+				DeliverSubject: sub2.Subject,
+				FilterSubject:  "foo.bar",
+				AckPolicy:      server.AckExplicit,
+				AckWait:        100 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error adding consumer: %v", err)
 			}
-			pendingBytes := mset.State().Bytes
+			defer o2.Delete()
 
-			checkPending := func(msgs, bts uint64) {
-				t.Helper()
-				state := mset.State()
-				if state.Msgs != msgs {
-					t.Fatalf("Expected %d messages, got %d", msgs, state.Msgs)
+			// Those messages should be redelivered to the 2nd consumer
+			for i := 1; i <= toSend; i++ {
+				m, err := sub2.NextMsg(time.Second)
+				if err != nil {
+					t.Fatalf("Error receiving message %d: %v", i, err)
 				}
-				if state.Bytes != bts {
-					t.Fatalf("Expected %d bytes, got %d", bts, state.Bytes)
+				m.Respond(nil)
+
+				sseq := o2.StreamSeqFromReply(m.Reply)
+				// Depending on timing from above we could receive stream sequences out of order but
+				// we know we want 3 & 4.
+				if sseq != 3 && sseq != 4 {
+					t.Fatalf("Expected stream sequence of 3 or 4 but got %d", sseq)
 				}
 			}
-			checkPending(pending, pendingBytes)
+		})
+	}
+}
 
-			// Update msgs to higher.
-			cfg = *c.mconfig
-			cfg.MaxMsgs = int64(pending * 2)
-			if err := mset.Update(&cfg); err != nil {
-				t.Fatalf("Unexpected error %v", err)
-			}
-			if mset.Config().MaxMsgs != cfg.MaxMsgs {
-				t.Fatalf("Expected the change to take effect, %d vs %d", mset.Config().MaxMsgs, cfg.MaxMsgs)
-			}
-			checkPending(pending, pendingBytes)
+// This test is in support fo clients that want to match on subject, they
+// can set the filter subject always and if the stream only has one subject
+// and they match the filter is cleared automatically. This eliminates us
+// needing to know if a subject is a subset of a stream when looking it up.
+func TestJetStreamConsumerFilterSubject(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
 
-			// Update msgs to lower.
-			cfg = *c.mconfig
-			cfg.MaxMsgs = int64(pending / 2)
-			if err := mset.Update(&cfg); err != nil {
-				t.Fatalf("Unexpected error %v", err)
-			}
-			if mset.Config().MaxMsgs != cfg.MaxMsgs {
-				t.Fatalf("Expected the change to take effect, %d vs %d", mset.Config().MaxMsgs, cfg.MaxMsgs)
-			}
-			checkPending(pending/2, pendingBytes/2)
-			// Now do bytes.
-			cfg = *c.mconfig
-			cfg.MaxBytes = int64(pendingBytes / 4)
-			if err := mset.Update(&cfg); err != nil {
-				t.Fatalf("Unexpected error %v", err)
-			}
-			if mset.Config().MaxBytes != cfg.MaxBytes {
-				t.Fatalf("Expected the change to take effect, %d vs %d", mset.Config().MaxBytes, cfg.MaxBytes)
-			}
-			checkPending(pending/4, pendingBytes/4)
+	sc := &server.StreamConfig{Name: "MY_STREAM", Subjects: []string{"foo"}}
+	mset, err := s.GlobalAccount().AddStream(sc)
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
+
+	cfg := &server.ConsumerConfig{
+		Durable:        "d",
+		DeliverSubject: "A",
+		AckPolicy:      server.AckExplicit,
+		FilterSubject:  "foo",
+	}
+
+	o, err := mset.AddConsumer(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+	defer o.Delete()
+
+	if o.Info().Config.FilterSubject != "" {
+		t.Fatalf("Expected the filter to be cleared")
+	}
+
+	// Now use the original cfg with updated delivery subject and make sure that works ok.
+	cfg = &server.ConsumerConfig{
+		Durable:        "d",
+		DeliverSubject: "B",
+		AckPolicy:      server.AckExplicit,
+		FilterSubject:  "foo",
+	}
+
+	o, err = mset.AddConsumer(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+	defer o.Delete()
+}
+
+func TestJetStreamStoredMsgsDontDisappearAfterCacheExpiration(t *testing.T) {
+	sc := &server.StreamConfig{
+		Name:      "MY_STREAM",
+		Storage:   server.FileStorage,
+		Subjects:  []string{"foo.>"},
+		Retention: server.InterestPolicy,
+	}
+
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
 
-			// Now do age.
-			cfg = *c.mconfig
-			cfg.MaxAge = time.Millisecond
-			if err := mset.Update(&cfg); err != nil {
-				t.Fatalf("Unexpected error %v", err)
-			}
-			// Just wait a bit for expiration.
-			time.Sleep(25 * time.Millisecond)
-			if mset.Config().MaxAge != cfg.MaxAge {
-				t.Fatalf("Expected the change to take effect, %d vs %d", mset.Config().MaxAge, cfg.MaxAge)
-			}
-			checkPending(0, 0)
+	mset, err := s.GlobalAccount().AddStreamWithStore(sc, &server.FileStoreConfig{BlockSize: 128, CacheExpire: 15 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
 
-			// Now put back to original.
-			cfg = *c.mconfig
-			if err := mset.Update(&cfg); err != nil {
-				t.Fatalf("Unexpected error %v", err)
-			}
-			for i := uint64(0); i < pending; i++ {
-				sendStreamMsg(t, nc, "foo", "0123456789")
-			}
+	nc1 := clientConnectWithOldRequest(t, s)
+	defer nc1.Close()
 
-			// subject changes.
-			// Add in a subject first.
-			cfg = *c.mconfig
-			cfg.Subjects = []string{"foo", "bar"}
-			if err := mset.Update(&cfg); err != nil {
-				t.Fatalf("Unexpected error %v", err)
-			}
-			// Make sure we can still send to foo.
-			sendStreamMsg(t, nc, "foo", "0123456789")
-			// And we can now send to bar.
-			sendStreamMsg(t, nc, "bar", "0123456789")
-			// Now delete both and change to baz only.
-			cfg.Subjects = []string{"baz"}
-			if err := mset.Update(&cfg); err != nil {
-				t.Fatalf("Unexpected error %v", err)
-			}
-			// Make sure we do not get response acks for "foo" or "bar".
-			if resp, err := nc.Request("foo", nil, 25*time.Millisecond); err == nil || resp != nil {
-				t.Fatalf("Expected no response from jetstream for deleted subject: %q", "foo")
-			}
-			if resp, err := nc.Request("bar", nil, 25*time.Millisecond); err == nil || resp != nil {
-				t.Fatalf("Expected no response from jetstream for deleted subject: %q", "bar")
-			}
-			// Make sure we can send to "baz"
-			sendStreamMsg(t, nc, "baz", "0123456789")
-			if nmsgs := mset.State().Msgs; nmsgs != pending+3 {
-				t.Fatalf("Expected %d msgs, got %d", pending+3, nmsgs)
-			}
+	// Create a durable consumers
+	sub, _ := nc1.SubscribeSync(nats.NewInbox())
+	defer sub.Unsubscribe()
+	nc1.Flush()
 
-			// FileStore restarts for config save.
-			cfg = *c.mconfig
-			if cfg.Storage == server.FileStorage {
-				cfg.Subjects = []string{"foo", "bar"}
-				cfg.MaxMsgs = 2222
-				cfg.MaxBytes = 3333333
-				cfg.MaxAge = 22 * time.Hour
-				if err := mset.Update(&cfg); err != nil {
-					t.Fatalf("Unexpected error %v", err)
-				}
-				// Pull since certain defaults etc are set in processing.
-				cfg = mset.Config()
+	o, err := mset.AddConsumer(&server.ConsumerConfig{
+		Durable:        "dur",
+		DeliverSubject: sub.Subject,
+		FilterSubject:  "foo.bar",
+		DeliverPolicy:  server.DeliverNew,
+		AckPolicy:      server.AckExplicit,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+	defer o.Delete()
 
-				// Restart the server.
-				// Capture port since it was dynamic.
-				u, _ := url.Parse(s.ClientURL())
-				port, _ := strconv.Atoi(u.Port())
+	nc2 := clientConnectWithOldRequest(t, s)
+	defer nc2.Close()
 
-				// Stop current server.
-				sd := s.JetStreamConfig().StoreDir
-				s.Shutdown()
-				// Restart.
-				s = RunJetStreamServerOnPort(port, sd)
-				defer s.Shutdown()
+	sendStreamMsg(t, nc2, "foo.bar", "msg1")
 
-				mset, err = s.GlobalAccount().LookupStream(cfg.Name)
-				if err != nil {
-					t.Fatalf("Expected to find a stream for %q", cfg.Name)
-				}
-				restored_cfg := mset.Config()
-				if !reflect.DeepEqual(cfg, restored_cfg) {
-					t.Fatalf("restored configuration does not match: \n%+v\n vs \n%+v", restored_cfg, cfg)
-				}
-			}
-		})
+	msg, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Did not get message: %v", err)
+	}
+	if string(msg.Data) != "msg1" {
+		t.Fatalf("Unexpected message: %q", msg.Data)
+	}
+
+	nc1.Close()
+
+	// Get the message from the stream
+	getMsgSeq := func(seq uint64) {
+		t.Helper()
+		mreq := &server.JSApiMsgGetRequest{Seq: seq}
+		req, err := json.Marshal(mreq)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		smsgj, err := nc2.Request(fmt.Sprintf(server.JSApiMsgGetT, sc.Name), req, time.Second)
+		if err != nil {
+			t.Fatalf("Could not retrieve stream message: %v", err)
+		}
+		if strings.Contains(string(smsgj.Data), "code") {
+			t.Fatalf("Error: %q", smsgj.Data)
+		}
 	}
+
+	getMsgSeq(1)
+
+	time.Sleep(time.Second)
+
+	sendStreamMsg(t, nc2, "foo.bar", "msg2")
+	sendStreamMsg(t, nc2, "foo.bar", "msg3")
+
+	getMsgSeq(1)
+	getMsgSeq(2)
+	getMsgSeq(3)
 }
 
-func TestJetStreamDeleteMsg(t *testing.T) {
+func TestJetStreamConsumerUpdateRedelivery(t *testing.T) {
 	cases := []struct {
 		name    string
 		mconfig *server.StreamConfig
 	}{
-		{name: "MemoryStore",
-			mconfig: &server.StreamConfig{
-				Name:      "foo",
-				Retention: server.LimitsPolicy,
-				MaxAge:    time.Hour,
-				Storage:   server.MemoryStorage,
-				Replicas:  1,
-			}},
-		{name: "FileStore",
-			mconfig: &server.StreamConfig{
-				Name:      "foo",
-				Retention: server.LimitsPolicy,
-				MaxAge:    time.Hour,
-				Storage:   server.FileStorage,
-				Replicas:  1,
-			}},
+		{"MemoryStore", &server.StreamConfig{
+			Name:      "MY_STREAM",
+			Storage:   server.MemoryStorage,
+			Subjects:  []string{"foo.>"},
+			Retention: server.InterestPolicy,
+		}},
+		{"FileStore", &server.StreamConfig{
+			Name:      "MY_STREAM",
+			Storage:   server.FileStorage,
+			Subjects:  []string{"foo.>"},
+			Retention: server.InterestPolicy,
+		}},
 	}
-
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
-
 			s := RunBasicJetStreamServer()
 			defer s.Shutdown()
 
-			if config := s.JetStreamConfig(); config != nil && config.StoreDir != "" {
+			if config := s.JetStreamConfig(); config != nil {
 				defer os.RemoveAll(config.StoreDir)
 			}
 
@@ -7972,163 +10694,171 @@ func TestJetStreamDeleteMsg(t *testing.T) {
 			if err != nil {
 				t.Fatalf("Unexpected error adding stream: %v", err)
 			}
+			defer mset.Delete()
 
 			nc := clientConnectToServer(t, s)
 			defer nc.Close()
 
-			pubTen := func() {
-				t.Helper()
-				for i := 0; i < 10; i++ {
-					nc.Publish("foo", []byte("Hello World!"))
-				}
-				nc.Flush()
-			}
-
-			pubTen()
-
-			state := mset.State()
-			if state.Msgs != 10 {
-				t.Fatalf("Expected 10 messages, got %d", state.Msgs)
-			}
-			bytesPerMsg := state.Bytes / 10
-			if bytesPerMsg == 0 {
-				t.Fatalf("Expected non-zero bytes for msg size")
-			}
-
-			deleteAndCheck := func(seq, expectedFirstSeq uint64) {
-				t.Helper()
-				beforeState := mset.State()
-				if removed, _ := mset.DeleteMsg(seq); !removed {
-					t.Fatalf("Expected the delete of sequence %d to succeed", seq)
-				}
-				expectedState := beforeState
-				expectedState.Msgs--
-				expectedState.Bytes -= bytesPerMsg
-				expectedState.FirstSeq = expectedFirstSeq
-
-				sm, err := mset.GetMsg(expectedFirstSeq)
-				if err != nil {
-					t.Fatalf("Error fetching message for seq: %d - %v", expectedFirstSeq, err)
-				}
-				expectedState.FirstTime = sm.Time
-				expectedState.Deleted = nil
-
-				afterState := mset.State()
-				afterState.Deleted = nil
+			// Create a durable consumer.
+			sub, _ := nc.SubscribeSync(nats.NewInbox())
+			defer sub.Unsubscribe()
 
-				// Ignore first time in this test.
-				if !reflect.DeepEqual(afterState, expectedState) {
-					t.Fatalf("Stats not what we expected. Expected %+v, got %+v\n", expectedState, afterState)
-				}
+			o, err := mset.AddConsumer(&server.ConsumerConfig{
+				Durable:        "dur22",
+				DeliverSubject: sub.Subject,
+				FilterSubject:  "foo.bar",
+				AckPolicy:      server.AckExplicit,
+				AckWait:        100 * time.Millisecond,
+				MaxDeliver:     3,
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error adding consumer: %v", err)
 			}
-
-			// Delete one from the middle
-			deleteAndCheck(5, 1)
-			// Now make sure sequences are updated properly.
-			// Delete first msg.
-			deleteAndCheck(1, 2)
-			// Now last
-			deleteAndCheck(10, 2)
-			// Now gaps.
-			deleteAndCheck(3, 2)
-			deleteAndCheck(2, 4)
-
-			mset.Purge()
-			// Put ten more one.
-			pubTen()
-			deleteAndCheck(11, 12)
-			deleteAndCheck(15, 12)
-			deleteAndCheck(16, 12)
-			deleteAndCheck(20, 12)
-
-			// Only file storage beyond here.
-			if c.mconfig.Storage == server.MemoryStorage {
-				return
+			defer o.Delete()
+
+			// Send 20 messages
+			toSend := 20
+			for i := 1; i <= toSend; i++ {
+				sendStreamMsg(t, nc, "foo.bar", fmt.Sprintf("msg-%v", i))
+			}
+			state := mset.State()
+			if state.Msgs != uint64(toSend) {
+				t.Fatalf("Expected %v messages, got %d", toSend, state.Msgs)
 			}
 
-			// Capture port since it was dynamic.
-			u, _ := url.Parse(s.ClientURL())
-			port, _ := strconv.Atoi(u.Port())
-			sd := s.JetStreamConfig().StoreDir
+			// Receive the messages and ack only every 4th
+			for i := 0; i < toSend; i++ {
+				m, err := sub.NextMsg(time.Second)
+				if err != nil {
+					t.Fatalf("Error getting message: %v", err)
+				}
+				seq, _, _, _, _ := o.ReplyInfo(m.Reply)
+				// 4, 8, 12, 16, 20
+				if seq%4 == 0 {
+					m.Respond(nil)
+				}
+			}
 
-			// Shutdown the server.
-			s.Shutdown()
+			// Now close the sub and open a new one and update the consumer.
+			sub.Unsubscribe()
 
-			s = RunJetStreamServerOnPort(port, sd)
-			defer s.Shutdown()
+			// Wait for it to become inactive
+			checkFor(t, 200*time.Millisecond, 10*time.Millisecond, func() error {
+				if o.Active() {
+					return fmt.Errorf("Consumer still active")
+				}
+				return nil
+			})
 
-			mset, err = s.GlobalAccount().LookupStream("foo")
-			if err != nil {
-				t.Fatalf("Expected to get the stream back")
+			// Send 20 more messages.
+			for i := toSend; i < toSend*2; i++ {
+				sendStreamMsg(t, nc, "foo.bar", fmt.Sprintf("msg-%v", i))
 			}
 
-			expected := server.StreamState{Msgs: 6, Bytes: 6 * bytesPerMsg, FirstSeq: 12, LastSeq: 20}
-			state = mset.State()
-			state.FirstTime, state.LastTime, state.Deleted = time.Time{}, time.Time{}, nil
+			// Create new subscription.
+			sub, _ = nc.SubscribeSync(nats.NewInbox())
+			defer sub.Unsubscribe()
+			nc.Flush()
 
-			if !reflect.DeepEqual(expected, state) {
-				t.Fatalf("State not what we expected. Expected %+v, got %+v\n", expected, state)
+			o, err = mset.AddConsumer(&server.ConsumerConfig{
+				Durable:        "dur22",
+				DeliverSubject: sub.Subject,
+				FilterSubject:  "foo.bar",
+				AckPolicy:      server.AckExplicit,
+				AckWait:        100 * time.Millisecond,
+				MaxDeliver:     3,
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error adding consumer: %v", err)
 			}
+			defer o.Delete()
 
-			// Now create an consumer and make sure we get the right sequence.
-			nc = clientConnectToServer(t, s)
-			defer nc.Close()
-
-			delivery := nats.NewInbox()
-			sub, _ := nc.SubscribeSync(delivery)
-			nc.Flush()
+			expect := toSend + toSend - 5 // mod 4 acks
+			checkFor(t, time.Second, 5*time.Millisecond, func() error {
+				if nmsgs, _, _ := sub.Pending(); err != nil || nmsgs != expect {
+					return fmt.Errorf("Did not receive correct number of messages: %d vs %d", nmsgs, expect)
+				}
+				return nil
+			})
 
-			o, err := mset.AddConsumer(&server.ConsumerConfig{DeliverSubject: delivery, FilterSubject: "foo"})
-			if err != nil {
-				t.Fatalf("Unexpected error: %v", err)
+			for i, eseq := 0, uint64(1); i < expect; i++ {
+				m, err := sub.NextMsg(time.Second)
+				if err != nil {
+					t.Fatalf("Error getting message: %v", err)
+				}
+				// Skip the ones we ack'd from above. We should not get them back here.
+				if eseq <= uint64(toSend) && eseq%4 == 0 {
+					eseq++
+				}
+				seq, _, dc, _, _ := o.ReplyInfo(m.Reply)
+				if seq != eseq {
+					t.Fatalf("Expected stream sequence of %d, got %d", eseq, seq)
+				}
+				if seq <= uint64(toSend) && dc != 2 {
+					t.Fatalf("Expected delivery count of 2 for sequence of %d, got %d", seq, dc)
+				}
+				if seq > uint64(toSend) && dc != 1 {
+					t.Fatalf("Expected delivery count of 1 for sequence of %d, got %d", seq, dc)
+				}
+				if seq > uint64(toSend) {
+					m.Respond(nil) // Ack
+				}
+				eseq++
 			}
 
-			expectedStoreSeq := []uint64{12, 13, 14, 17, 18, 19}
+			// We should get the second half back since we did not ack those from above.
+			expect = toSend - 5
+			checkFor(t, time.Second, 5*time.Millisecond, func() error {
+				if nmsgs, _, _ := sub.Pending(); err != nil || nmsgs != expect {
+					return fmt.Errorf("Did not receive correct number of messages: %d vs %d", nmsgs, expect)
+				}
+				return nil
+			})
 
-			for i := 0; i < 6; i++ {
+			for i, eseq := 0, uint64(1); i < expect; i++ {
 				m, err := sub.NextMsg(time.Second)
 				if err != nil {
-					t.Fatalf("Unexpected error: %v", err)
+					t.Fatalf("Error getting message: %v", err)
 				}
-				if o.StreamSeqFromReply(m.Reply) != expectedStoreSeq[i] {
-					t.Fatalf("Expected store seq of %d, got %d", expectedStoreSeq[i], o.StreamSeqFromReply(m.Reply))
+				// Skip the ones we ack'd from above. We should not get them back here.
+				if eseq <= uint64(toSend) && eseq%4 == 0 {
+					eseq++
+				}
+				seq, _, dc, _, _ := o.ReplyInfo(m.Reply)
+				if seq != eseq {
+					t.Fatalf("Expected stream sequence of %d, got %d", eseq, seq)
+				}
+				if dc != 3 {
+					t.Fatalf("Expected delivery count of 3 for sequence of %d, got %d", seq, dc)
 				}
+				eseq++
 			}
 		})
 	}
 }
 
-// https://github.com/nats-io/jetstream/issues/396
-func TestJetStreamLimitLockBug(t *testing.T) {
+func TestJetStreamConsumerMaxAckPending(t *testing.T) {
 	cases := []struct {
 		name    string
 		mconfig *server.StreamConfig
 	}{
-		{name: "MemoryStore",
-			mconfig: &server.StreamConfig{
-				Name:      "foo",
-				Retention: server.LimitsPolicy,
-				MaxMsgs:   10,
-				Storage:   server.MemoryStorage,
-				Replicas:  1,
-			}},
-		{name: "FileStore",
-			mconfig: &server.StreamConfig{
-				Name:      "foo",
-				Retention: server.LimitsPolicy,
-				MaxMsgs:   10,
-				Storage:   server.FileStorage,
-				Replicas:  1,
-			}},
+		{"MemoryStore", &server.StreamConfig{
+			Name:     "MY_STREAM",
+			Storage:  server.MemoryStorage,
+			Subjects: []string{"foo.*"},
+		}},
+		{"FileStore", &server.StreamConfig{
+			Name:     "MY_STREAM",
+			Storage:  server.FileStorage,
+			Subjects: []string{"foo.*"},
+		}},
 	}
-
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
-
 			s := RunBasicJetStreamServer()
 			defer s.Shutdown()
 
-			if config := s.JetStreamConfig(); config != nil && config.StoreDir != "" {
+			if config := s.JetStreamConfig(); config != nil {
 				defer os.RemoveAll(config.StoreDir)
 			}
 
@@ -8136,132 +10866,120 @@ func TestJetStreamLimitLockBug(t *testing.T) {
 			if err != nil {
 				t.Fatalf("Unexpected error adding stream: %v", err)
 			}
+			defer mset.Delete()
 
 			nc := clientConnectToServer(t, s)
 			defer nc.Close()
 
-			for i := 0; i < 100; i++ {
-				sendStreamMsg(t, nc, "foo", "ok")
+			// Do error scenarios.
+			_, err = mset.AddConsumer(&server.ConsumerConfig{
+				Durable:        "d22",
+				DeliverSubject: nats.NewInbox(),
+				AckPolicy:      server.AckNone,
+				MaxAckPending:  1,
+			})
+			if err == nil {
+				t.Fatalf("Expected error, MaxAckPending only applicable to ack != AckNone")
 			}
 
-			state := mset.State()
-			if state.Msgs != 10 {
-				t.Fatalf("Expected 10 messages, got %d", state.Msgs)
+			// Queue up 100 messages.
+			toSend := 100
+			for i := 0; i < toSend; i++ {
+				sendStreamMsg(t, nc, "foo.bar", fmt.Sprintf("MSG: %d", i+1))
 			}
-		})
-	}
-}
 
-func TestJetStreamNextMsgNoInterest(t *testing.T) {
-	cases := []struct {
-		name    string
-		mconfig *server.StreamConfig
-	}{
-		{name: "MemoryStore",
-			mconfig: &server.StreamConfig{
-				Name:      "foo",
-				Retention: server.LimitsPolicy,
-				MaxAge:    time.Hour,
-				Storage:   server.MemoryStorage,
-				Replicas:  1,
-			}},
-		{name: "FileStore",
-			mconfig: &server.StreamConfig{
-				Name:      "foo",
-				Retention: server.LimitsPolicy,
-				MaxAge:    time.Hour,
-				Storage:   server.FileStorage,
-				Replicas:  1,
-			}},
-	}
+			// Limit to 33
+			maxAckPending := 33
 
-	for _, c := range cases {
-		t.Run(c.name, func(t *testing.T) {
-			s := RunBasicJetStreamServer()
-			defer s.Shutdown()
+			o, err := mset.AddConsumer(&server.ConsumerConfig{
+				Durable:        "d22",
+				DeliverSubject: nats.NewInbox(),
+				AckPolicy:      server.AckExplicit,
+				MaxAckPending:  maxAckPending,
+			})
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			defer o.Delete()
 
-			if config := s.JetStreamConfig(); config != nil {
-				defer os.RemoveAll(config.StoreDir)
+			sub, _ := nc.SubscribeSync(o.Info().Config.DeliverSubject)
+			defer sub.Unsubscribe()
+
+			checkSubPending := func(numExpected int) {
+				t.Helper()
+				checkFor(t, time.Second, 20*time.Millisecond, func() error {
+					if nmsgs, _, _ := sub.Pending(); err != nil || nmsgs != numExpected {
+						return fmt.Errorf("Did not receive correct number of messages: %d vs %d", nmsgs, numExpected)
+					}
+					return nil
+				})
 			}
 
-			cfg := &server.StreamConfig{Name: "foo", Storage: server.FileStorage}
-			mset, err := s.GlobalAccount().AddStream(cfg)
-			if err != nil {
-				t.Fatalf("Unexpected error adding stream: %v", err)
+			checkSubPending(maxAckPending)
+			// We hit the limit, double check we stayed there.
+			if nmsgs, _, _ := sub.Pending(); err != nil || nmsgs != maxAckPending {
+				t.Fatalf("Too many messages received: %d vs %d", nmsgs, maxAckPending)
 			}
 
-			nc := clientConnectWithOldRequest(t, s)
-			defer nc.Close()
+			// Now ack them all.
+			for i := 0; i < maxAckPending; i++ {
+				m, err := sub.NextMsg(time.Second)
+				if err != nil {
+					t.Fatalf("Error receiving message %d: %v", i, err)
+				}
+				m.Respond(nil)
+			}
+			checkSubPending(maxAckPending)
+
+			o.Stop()
+			mset.Purge()
 
-			// Now create an consumer and make sure it functions properly.
-			o, err := mset.AddConsumer(workerModeConfig("WQ"))
+			// Now test a consumer that is live while we publish messages to the stream.
+			o, err = mset.AddConsumer(&server.ConsumerConfig{
+				Durable:        "d33",
+				DeliverSubject: nats.NewInbox(),
+				AckPolicy:      server.AckExplicit,
+				MaxAckPending:  maxAckPending,
+			})
 			if err != nil {
-				t.Fatalf("Expected no error with registered interest, got %v", err)
+				t.Fatalf("Expected no error, got %v", err)
 			}
 			defer o.Delete()
 
-			nextSubj := o.RequestNextMsgSubject()
-
-			// Queue up a worker but use a short time out.
-			if _, err := nc.Request(nextSubj, nil, time.Millisecond); err != nats.ErrTimeout {
-				t.Fatalf("Expected a timeout error and no response with acks suppressed")
-			}
-			// Now send a message, the worker from above will still be known but we want to make
-			// sure the system detects that so we will do a request for next msg right behind it.
-			nc.Publish("foo", []byte("OK"))
-			if msg, err := nc.Request(nextSubj, nil, 5*time.Millisecond); err != nil {
-				t.Fatalf("Unexpected error: %v", err)
-			} else {
-				msg.Respond(nil) // Ack
-			}
-			// Now queue up 10 workers.
-			for i := 0; i < 10; i++ {
-				if _, err := nc.Request(nextSubj, nil, time.Microsecond); err != nats.ErrTimeout {
-					t.Fatalf("Expected a timeout error and no response with acks suppressed")
-				}
-			}
-			// Now publish ten messages.
-			for i := 0; i < 10; i++ {
-				nc.Publish("foo", []byte("OK"))
-			}
+			sub, _ = nc.SubscribeSync(o.Info().Config.DeliverSubject)
+			defer sub.Unsubscribe()
 			nc.Flush()
-			for i := 0; i < 10; i++ {
-				if msg, err := nc.Request(nextSubj, nil, 10*time.Millisecond); err != nil {
-					t.Fatalf("Unexpected error for %d: %v", i, err)
-				} else {
-					msg.Respond(nil) // Ack
-				}
+
+			checkSubPending(0)
+
+			// Now stream more then maxAckPending.
+			for i := 0; i < toSend; i++ {
+				sendStreamMsg(t, nc, "foo.baz", fmt.Sprintf("MSG: %d", i+1))
 			}
-			nc.Flush()
-			ostate := o.Info()
-			if ostate.AckFloor.Stream != 11 || ostate.NumAckPending > 0 {
-				t.Fatalf("Inconsistent ack state: %+v", ostate)
+			checkSubPending(maxAckPending)
+			// We hit the limit, double check we stayed there.
+			if nmsgs, _, _ := sub.Pending(); err != nil || nmsgs != maxAckPending {
+				t.Fatalf("Too many messages received: %d vs %d", nmsgs, maxAckPending)
 			}
 		})
 	}
 }
 
-func TestJetStreamMsgHeaders(t *testing.T) {
+func TestJetStreamPullConsumerMaxAckPending(t *testing.T) {
 	cases := []struct {
 		name    string
 		mconfig *server.StreamConfig
 	}{
-		{name: "MemoryStore",
-			mconfig: &server.StreamConfig{
-				Name:      "foo",
-				Retention: server.LimitsPolicy,
-				MaxAge:    time.Hour,
-				Storage:   server.MemoryStorage,
-				Replicas:  1,
-			}},
-		{name: "FileStore",
-			mconfig: &server.StreamConfig{
-				Name:      "foo",
-				Retention: server.LimitsPolicy,
-				MaxAge:    time.Hour,
-				Storage:   server.FileStorage,
-				Replicas:  1,
-			}},
+		{"MemoryStore", &server.StreamConfig{
+			Name:     "MY_STREAM",
+			Storage:  server.MemoryStorage,
+			Subjects: []string{"foo.*"},
+		}},
+		{"FileStore", &server.StreamConfig{
+			Name:     "MY_STREAM",
+			Storage:  server.FileStorage,
+			Subjects: []string{"foo.*"},
+		}},
 	}
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
@@ -8281,256 +10999,188 @@ func TestJetStreamMsgHeaders(t *testing.T) {
 			nc := clientConnectToServer(t, s)
 			defer nc.Close()
 
-			m := nats.NewMsg("foo")
-			m.Header.Add("Accept-Encoding", "json")
-			m.Header.Add("Authorization", "s3cr3t")
-			m.Data = []byte("Hello JetStream Headers - #1!")
-
-			nc.PublishMsg(m)
-			nc.Flush()
-
-			state := mset.State()
-			if state.Msgs != 1 {
-				t.Fatalf("Expected 1 message, got %d", state.Msgs)
-			}
-			if state.Bytes == 0 {
-				t.Fatalf("Expected non-zero bytes")
+			// Queue up 100 messages.
+			toSend := 100
+			for i := 0; i < toSend; i++ {
+				sendStreamMsg(t, nc, "foo.bar", fmt.Sprintf("MSG: %d", i+1))
 			}
 
-			// Now access raw from stream.
-			sm, err := mset.GetMsg(1)
+			// Limit to 33
+			maxAckPending := 33
+
+			o, err := mset.AddConsumer(&server.ConsumerConfig{
+				Durable:       "d22",
+				AckPolicy:     server.AckExplicit,
+				MaxAckPending: maxAckPending,
+			})
 			if err != nil {
-				t.Fatalf("Unexpected error getting stored message: %v", err)
+				t.Fatalf("Expected no error, got %v", err)
 			}
-			// Calculate the []byte version of the headers.
-			var b bytes.Buffer
-			b.WriteString("NATS/1.0\r\n")
-			m.Header.Write(&b)
-			b.WriteString("\r\n")
-			hdr := b.Bytes()
+			defer o.Delete()
 
-			if !bytes.Equal(sm.Header, hdr) {
-				t.Fatalf("Message headers do not match, %q vs %q", hdr, sm.Header)
-			}
-			if !bytes.Equal(sm.Data, m.Data) {
-				t.Fatalf("Message data do not match, %q vs %q", m.Data, sm.Data)
-			}
+			getSubj := o.RequestNextMsgSubject()
 
-			// Now do consumer based.
-			sub, _ := nc.SubscribeSync(nats.NewInbox())
-			defer sub.Unsubscribe()
-			nc.Flush()
+			var toAck []*nats.Msg
 
-			o, err := mset.AddConsumer(&server.ConsumerConfig{DeliverSubject: sub.Subject})
-			if err != nil {
-				t.Fatalf("Expected no error with registered interest, got %v", err)
+			for i := 0; i < maxAckPending; i++ {
+				if m, err := nc.Request(getSubj, nil, time.Second); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				} else {
+					toAck = append(toAck, m)
+				}
 			}
-			defer o.Delete()
-
-			cm, err := sub.NextMsg(time.Second)
+			// This should fail.. But we do not want to queue up our request.
+			req := &server.JSApiConsumerGetNextRequest{Batch: 1, NoWait: true}
+			jreq, _ := json.Marshal(req)
+			m, err := nc.Request(getSubj, jreq, time.Second)
 			if err != nil {
-				t.Fatalf("Error getting message: %v", err)
-			}
-			// Check the message.
-			// Check out original headers.
-			if cm.Header.Get("Accept-Encoding") != "json" ||
-				cm.Header.Get("Authorization") != "s3cr3t" {
-				t.Fatalf("Original headers not present")
+				t.Fatalf("Unexpected error: %v", err)
 			}
-			if !bytes.Equal(m.Data, cm.Data) {
-				t.Fatalf("Message payloads are not the same: %q vs %q", cm.Data, m.Data)
+			if m.Header.Get("Status") != "409" {
+				t.Fatalf("Expected a 409 status code, got %q", m.Header.Get("Status"))
 			}
-		})
-	}
-}
-
-func TestJetStreamTemplateBasics(t *testing.T) {
-	s := RunBasicJetStreamServer()
-	defer s.Shutdown()
-
-	if config := s.JetStreamConfig(); config != nil {
-		defer os.RemoveAll(config.StoreDir)
-	}
-
-	acc := s.GlobalAccount()
-
-	mcfg := &server.StreamConfig{
-		Subjects:  []string{"kv.*"},
-		Retention: server.LimitsPolicy,
-		MaxAge:    time.Hour,
-		MaxMsgs:   4,
-		Storage:   server.MemoryStorage,
-		Replicas:  1,
-	}
-	template := &server.StreamTemplateConfig{
-		Name:       "kv",
-		Config:     mcfg,
-		MaxStreams: 4,
-	}
-
-	if _, err := acc.AddStreamTemplate(template); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-	if templates := acc.Templates(); len(templates) != 1 {
-		t.Fatalf("Expected to get array of 1 template, got %d", len(templates))
-	}
-	if err := acc.DeleteStreamTemplate("foo"); err == nil {
-		t.Fatalf("Expected an error for non-existent template")
-	}
-	if err := acc.DeleteStreamTemplate(template.Name); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-	if templates := acc.Templates(); len(templates) != 0 {
-		t.Fatalf("Expected to get array of no templates, got %d", len(templates))
-	}
-	// Add it back in and test basics
-	if _, err := acc.AddStreamTemplate(template); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-
-	// Connect a client and send a message which should trigger the stream creation.
-	nc := clientConnectToServer(t, s)
-	defer nc.Close()
-
-	sendStreamMsg(t, nc, "kv.22", "derek")
-	sendStreamMsg(t, nc, "kv.33", "cat")
-	sendStreamMsg(t, nc, "kv.44", "sam")
-	sendStreamMsg(t, nc, "kv.55", "meg")
-
-	if nms := acc.NumStreams(); nms != 4 {
-		t.Fatalf("Expected 4 auto-created streams, got %d", nms)
-	}
 
-	// This one should fail due to max.
-	if resp, err := nc.Request("kv.99", nil, 100*time.Millisecond); err == nil {
-		t.Fatalf("Expected this to fail, but got %q", resp.Data)
-	}
-
-	// Now delete template and make sure the underlying streams go away too.
-	if err := acc.DeleteStreamTemplate(template.Name); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-
-	if nms := acc.NumStreams(); nms != 0 {
-		t.Fatalf("Expected no auto-created streams to remain, got %d", nms)
-	}
-}
-
-func TestJetStreamTemplateFileStoreRecovery(t *testing.T) {
-	s := RunBasicJetStreamServer()
-	defer s.Shutdown()
+			// Now ack them all.
+			for _, m := range toAck {
+				m.Respond(nil)
+			}
 
-	if config := s.JetStreamConfig(); config != nil {
-		defer os.RemoveAll(config.StoreDir)
-	}
+			// Now do batch above the max.
+			sub, _ := nc.SubscribeSync(nats.NewInbox())
+			defer sub.Unsubscribe()
 
-	acc := s.GlobalAccount()
+			checkSubPending := func(numExpected int) {
+				t.Helper()
+				checkFor(t, time.Second, 10*time.Millisecond, func() error {
+					if nmsgs, _, _ := sub.Pending(); err != nil || nmsgs != numExpected {
+						return fmt.Errorf("Did not receive correct number of messages: %d vs %d", nmsgs, numExpected)
+					}
+					return nil
+				})
+			}
 
-	mcfg := &server.StreamConfig{
-		Subjects:  []string{"kv.*"},
-		Retention: server.LimitsPolicy,
-		MaxAge:    time.Hour,
-		MaxMsgs:   50,
-		Storage:   server.FileStorage,
-		Replicas:  1,
-	}
-	template := &server.StreamTemplateConfig{
-		Name:       "kv",
-		Config:     mcfg,
-		MaxStreams: 100,
-	}
+			req = &server.JSApiConsumerGetNextRequest{Batch: toSend}
+			jreq, _ = json.Marshal(req)
+			nc.PublishRequest(getSubj, sub.Subject, jreq)
 
-	if _, err := acc.AddStreamTemplate(template); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+			checkSubPending(maxAckPending)
+			// We hit the limit, double check we stayed there.
+			if nmsgs, _, _ := sub.Pending(); err != nil || nmsgs != maxAckPending {
+				t.Fatalf("Too many messages received: %d vs %d", nmsgs, maxAckPending)
+			}
+		})
 	}
+}
 
-	// Make sure we can not add in a stream on our own with a template owner.
-	badCfg := *mcfg
-	badCfg.Name = "bad"
-	badCfg.Template = "kv"
-	if _, err := acc.AddStream(&badCfg); err == nil {
-		t.Fatalf("Expected error adding stream with direct template owner")
+func TestJetStreamPullConsumerMaxAckPendingRedeliveries(t *testing.T) {
+	cases := []struct {
+		name    string
+		mconfig *server.StreamConfig
+	}{
+		{"MemoryStore", &server.StreamConfig{
+			Name:     "MY_STREAM",
+			Storage:  server.MemoryStorage,
+			Subjects: []string{"foo.*"},
+		}},
+		{"FileStore", &server.StreamConfig{
+			Name:     "MY_STREAM",
+			Storage:  server.FileStorage,
+			Subjects: []string{"foo.*"},
+		}},
 	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := RunBasicJetStreamServer()
+			defer s.Shutdown()
 
-	// Connect a client and send a message which should trigger the stream creation.
-	nc := clientConnectToServer(t, s)
-	defer nc.Close()
+			if config := s.JetStreamConfig(); config != nil {
+				defer os.RemoveAll(config.StoreDir)
+			}
 
-	for i := 1; i <= 100; i++ {
-		subj := fmt.Sprintf("kv.%d", i)
-		for x := 0; x < 50; x++ {
-			sendStreamMsg(t, nc, subj, "Hello")
-		}
-	}
-	nc.Flush()
+			mset, err := s.GlobalAccount().AddStream(c.mconfig)
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			defer mset.Delete()
 
-	if nms := acc.NumStreams(); nms != 100 {
-		t.Fatalf("Expected 100 auto-created streams, got %d", nms)
-	}
+			nc := clientConnectToServer(t, s)
+			defer nc.Close()
 
-	// Capture port since it was dynamic.
-	u, _ := url.Parse(s.ClientURL())
-	port, _ := strconv.Atoi(u.Port())
+			// Queue up 10 messages.
+			toSend := 10
+			for i := 0; i < toSend; i++ {
+				sendStreamMsg(t, nc, "foo.bar", fmt.Sprintf("MSG: %d", i+1))
+			}
 
-	restartServer := func() {
-		t.Helper()
-		sd := s.JetStreamConfig().StoreDir
-		// Stop current server.
-		s.Shutdown()
-		// Restart.
-		s = RunJetStreamServerOnPort(port, sd)
-	}
+			// Limit to 1
+			maxAckPending := 1
+			ackWait := 20 * time.Millisecond
+			expSeq := uint64(4)
 
-	// Restart.
-	restartServer()
-	defer s.Shutdown()
+			o, err := mset.AddConsumer(&server.ConsumerConfig{
+				Durable:       "d22",
+				DeliverPolicy: server.DeliverByStartSequence,
+				OptStartSeq:   expSeq,
+				AckPolicy:     server.AckExplicit,
+				AckWait:       ackWait,
+				MaxAckPending: maxAckPending,
+			})
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			defer o.Delete()
 
-	acc = s.GlobalAccount()
-	if nms := acc.NumStreams(); nms != 100 {
-		t.Fatalf("Expected 100 auto-created streams, got %d", nms)
-	}
-	tmpl, err := acc.LookupStreamTemplate(template.Name)
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-	// Make sure t.Delete() survives restart.
-	tmpl.Delete()
+			getSubj := o.RequestNextMsgSubject()
+			delivery := uint64(1)
 
-	// Restart.
-	restartServer()
-	defer s.Shutdown()
+			getNext := func() {
+				t.Helper()
+				m, err := nc.Request(getSubj, nil, time.Second)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				sseq, dseq, dcount, _, pending := o.ReplyInfo(m.Reply)
+				if sseq != expSeq {
+					t.Fatalf("Expected stream sequence of %d, got %d", expSeq, sseq)
+				}
+				if dseq != delivery {
+					t.Fatalf("Expected consumer sequence of %d, got %d", delivery, dseq)
+				}
+				if dcount != delivery {
+					t.Fatalf("Expected delivery count of %d, got %d", delivery, dcount)
+				}
+				if pending != uint64(toSend)-expSeq {
+					t.Fatalf("Expected pending to be %d, got %d", uint64(toSend)-expSeq, pending)
+				}
+				delivery++
+			}
 
-	acc = s.GlobalAccount()
-	if nms := acc.NumStreams(); nms != 0 {
-		t.Fatalf("Expected no auto-created streams, got %d", nms)
-	}
-	if _, err := acc.LookupStreamTemplate(template.Name); err == nil {
-		t.Fatalf("Expected to not find the template after restart")
+			getNext()
+			getNext()
+			getNext()
+			getNext()
+			getNext()
+		})
 	}
 }
 
-// This will be testing our ability to conditionally rewrite subjects for last mile
-// when working with JetStream. Consumers receive messages that have their subjects
-// rewritten to match the original subject. NATS routing is all subject based except
-// for the last mile to the client.
-func TestJetStreamSingleInstanceRemoteAccess(t *testing.T) {
-	ca := createClusterWithName(t, "A", 1)
-	defer shutdownCluster(ca)
-	cb := createClusterWithName(t, "B", 1, ca)
-	defer shutdownCluster(cb)
-
-	// Connect our leafnode server to cluster B.
-	opts := cb.opts[rand.Intn(len(cb.opts))]
-	s, _ := runSolicitLeafServer(opts)
+func TestJetStreamDeliveryAfterServerRestart(t *testing.T) {
+	opts := DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	s := RunServer(&opts)
 	defer s.Shutdown()
 
-	checkLeafNodeConnected(t, s)
-
-	if err := s.EnableJetStream(nil); err != nil {
-		t.Fatalf("Expected no error, got %v", err)
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
 	}
 
-	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "foo", Storage: server.MemoryStorage})
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{
+		Name:      "MY_STREAM",
+		Storage:   server.FileStorage,
+		Subjects:  []string{"foo.>"},
+		Retention: server.InterestPolicy,
+	})
 	if err != nil {
 		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
@@ -8539,538 +11189,571 @@ func TestJetStreamSingleInstanceRemoteAccess(t *testing.T) {
 	nc := clientConnectToServer(t, s)
 	defer nc.Close()
 
-	toSend := 10
-	for i := 0; i < toSend; i++ {
-		sendStreamMsg(t, nc, "foo", "Hello World!")
-	}
-
-	// Now create a push based consumer. Connected to the non-jetstream server via a random server on cluster A.
-	sl := ca.servers[rand.Intn(len(ca.servers))]
-	nc2 := clientConnectToServer(t, sl)
-	defer nc2.Close()
-
-	sub, _ := nc2.SubscribeSync(nats.NewInbox())
-	defer sub.Unsubscribe()
-
-	// Need to wait for interest to propagate across GW.
-	nc2.Flush()
-	time.Sleep(25 * time.Millisecond)
-
-	o, err := mset.AddConsumer(&server.ConsumerConfig{DeliverSubject: sub.Subject})
+	inbox := nats.NewInbox()
+	o, err := mset.AddConsumer(&server.ConsumerConfig{
+		Durable:        "dur",
+		DeliverSubject: inbox,
+		DeliverPolicy:  server.DeliverNew,
+		AckPolicy:      server.AckExplicit,
+	})
 	if err != nil {
-		t.Fatalf("Expected no error with registered interest, got %v", err)
+		t.Fatalf("Expected no error, got %v", err)
 	}
 	defer o.Delete()
 
-	checkSubPending := func(numExpected int) {
-		t.Helper()
-		checkFor(t, 200*time.Millisecond, 10*time.Millisecond, func() error {
-			if nmsgs, _, _ := sub.Pending(); err != nil || nmsgs != numExpected {
-				return fmt.Errorf("Did not receive correct number of messages: %d vs %d", nmsgs, numExpected)
-			}
-			return nil
-		})
-	}
-	checkSubPending(toSend)
-
-	checkMsg := func(m *nats.Msg, err error, i int) {
-		t.Helper()
-		if err != nil {
-			t.Fatalf("Got an error checking message: %v", err)
-		}
-		if m.Subject != "foo" {
-			t.Fatalf("Expected original subject of %q, but got %q", "foo", m.Subject)
-		}
-		// Now check that reply subject exists and has a sequence as the last token.
-		if seq := o.SeqFromReply(m.Reply); seq != uint64(i) {
-			t.Fatalf("Expected sequence of %d , got %d", i, seq)
-		}
+	sub, err := nc.SubscribeSync(inbox)
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
 	}
+	nc.Flush()
 
-	// Now check the subject to make sure its the original one.
-	for i := 1; i <= toSend; i++ {
-		m, err := sub.NextMsg(time.Second)
-		checkMsg(m, err, i)
-	}
+	// Send 1 message
+	sendStreamMsg(t, nc, "foo.bar", "msg1")
 
-	// Now do a pull based consumer.
-	o, err = mset.AddConsumer(workerModeConfig("p"))
+	// Make sure we receive it and ack it.
+	msg, err := sub.NextMsg(250 * time.Millisecond)
 	if err != nil {
-		t.Fatalf("Expected no error with registered interest, got %v", err)
+		t.Fatalf("Did not get message: %v", err)
 	}
-	defer o.Delete()
+	// Ack it!
+	msg.Respond(nil)
+	nc.Flush()
 
-	nextMsg := o.RequestNextMsgSubject()
-	for i := 1; i <= toSend; i++ {
-		m, err := nc.Request(nextMsg, nil, time.Second)
-		checkMsg(m, err, i)
+	// Shutdown client and server
+	nc.Close()
+
+	dir := strings.TrimSuffix(s.JetStreamConfig().StoreDir, server.JetStreamStoreDir)
+	s.Shutdown()
+
+	opts.Port = -1
+	opts.StoreDir = dir
+	s = RunServer(&opts)
+	defer s.Shutdown()
+
+	// Lookup stream.
+	mset, err = s.GlobalAccount().LookupStream("MY_STREAM")
+	if err != nil {
+		t.Fatalf("Error looking up stream: %v", err)
 	}
-}
 
-func clientConnectToServerWithUP(t *testing.T, opts *server.Options, user, pass string) *nats.Conn {
-	curl := fmt.Sprintf("nats://%s:%s@%s:%d", user, pass, opts.Host, opts.Port)
-	nc, err := nats.Connect(curl, nats.Name("JS-UP-TEST"), nats.ReconnectWait(5*time.Millisecond), nats.MaxReconnects(-1))
+	// Update consumer's deliver subject with new inbox
+	inbox = nats.NewInbox()
+	o, err = mset.AddConsumer(&server.ConsumerConfig{
+		Durable:        "dur",
+		DeliverSubject: inbox,
+		DeliverPolicy:  server.DeliverNew,
+		AckPolicy:      server.AckExplicit,
+	})
 	if err != nil {
-		t.Fatalf("Failed to create client: %v", err)
+		t.Fatalf("Expected no error, got %v", err)
 	}
-	return nc
-}
+	defer o.Delete()
 
-func TestJetStreamCanNotEnableOnSystemAccount(t *testing.T) {
-	s := RunBasicJetStreamServer()
-	defer s.Shutdown()
+	nc = clientConnectToServer(t, s)
+	defer nc.Close()
 
-	if config := s.JetStreamConfig(); config != nil {
-		defer os.RemoveAll(config.StoreDir)
+	// Send 2nd message
+	sendStreamMsg(t, nc, "foo.bar", "msg2")
+
+	// Start sub on new inbox
+	sub, err = nc.SubscribeSync(inbox)
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
 	}
+	nc.Flush()
 
-	sa := s.SystemAccount()
-	if err := sa.EnableJetStream(nil); err == nil {
-		t.Fatalf("Expected an error trying to enable on the system account")
+	// Should receive message 2.
+	if _, err := sub.NextMsg(500 * time.Millisecond); err != nil {
+		t.Fatalf("Did not get message: %v", err)
 	}
 }
 
-func TestJetStreamMultipleAccountsBasics(t *testing.T) {
+// This is for the basics of importing the ability to send to a stream and consume
+// from a consumer that is pull based on push based on a well known delivery subject.
+func TestJetStreamAccountImportBasics(t *testing.T) {
 	conf := createConfFile(t, []byte(`
 		listen: 127.0.0.1:-1
+		no_auth_user: rip
 		jetstream: {max_mem_store: 64GB, max_file_store: 10TB}
 		accounts: {
-			A: {
+			JS: {
 				jetstream: enabled
-				users: [ {user: ua, password: pwd} ]
-			},
-			B: {
-				jetstream: {max_mem: 1GB, max_store: 1TB, max_streams: 10, max_consumers: 1k}
-				users: [ {user: ub, password: pwd} ]
+				users: [ {user: dlc, password: foo} ]
+				exports [
+					# This is for sending into a stream from other accounts.
+					{ service: "ORDERS.*" }
+					# This is for accessing a pull based consumer.
+					{ service: "$JS.API.CONSUMER.MSG.NEXT.*.*" }
+					# This is streaming to a delivery subject for a push based consumer.
+					{ stream: "deliver.ORDERS" }
+					# This is to ack received messages. This is a service to ack acks..
+					{ service: "$JS.ACK.ORDERS.*.>" }
+				]
 			},
-			C: {
-				users: [ {user: uc, password: pwd} ]
+			IU: {
+				users: [ {user: rip, password: bar} ]
+				imports [
+					{ service: { subject: "ORDERS.*", account: JS }, to: "my.orders.$1" }
+					{ service: { subject: "$JS.API.CONSUMER.MSG.NEXT.ORDERS.d", account: JS }, to: "nxt.msg" }
+					{ stream:  { subject: "deliver.ORDERS", account: JS }, to: "d" }
+					{ service: { subject: "$JS.ACK.ORDERS.*.>", account: JS } }
+				]
 			},
 		}
 	`))
 	defer os.Remove(conf)
 
-	s, opts := RunServerWithConfig(conf)
+	s, _ := RunServerWithConfig(conf)
 	defer s.Shutdown()
 
 	if config := s.JetStreamConfig(); config != nil {
 		defer os.RemoveAll(config.StoreDir)
 	}
 
-	if !s.JetStreamEnabled() {
-		t.Fatalf("Expected JetStream to be enabled")
+	acc, err := s.LookupAccount("JS")
+	if err != nil {
+		t.Fatalf("Unexpected error looking up account: %v", err)
 	}
 
-	nca := clientConnectToServerWithUP(t, opts, "ua", "pwd")
-	defer nca.Close()
+	mset, err := acc.AddStream(&server.StreamConfig{Name: "ORDERS", Subjects: []string{"ORDERS.*"}})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
 
-	ncb := clientConnectToServerWithUP(t, opts, "ub", "pwd")
-	defer ncb.Close()
+	// This should be the rip user, the one that imports some JS.
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
 
-	resp, err := ncb.Request(server.JSApiAccountInfo, nil, time.Second)
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	// Simple publish to a stream.
+	pubAck := sendStreamMsg(t, nc, "my.orders.foo", "ORDERS-1")
+	if pubAck.Stream != "ORDERS" || pubAck.Sequence != 1 {
+		t.Fatalf("Bad pubAck received: %+v", pubAck)
 	}
-	var info server.JSApiAccountInfoResponse
-	if err := json.Unmarshal(resp.Data, &info); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	if msgs := mset.State().Msgs; msgs != 1 {
+		t.Fatalf("Expected 1 message, got %d", msgs)
 	}
-	limits := info.Limits
-	if limits.MaxStreams != 10 {
-		t.Fatalf("Expected 10 for MaxStreams, got %d", limits.MaxStreams)
+
+	total := 2
+	for i := 2; i <= total; i++ {
+		sendStreamMsg(t, nc, "my.orders.bar", fmt.Sprintf("ORDERS-%d", i))
 	}
-	if limits.MaxConsumers != 1000 {
-		t.Fatalf("Expected MaxConsumers of %d, got %d", 1000, limits.MaxConsumers)
+	if msgs := mset.State().Msgs; msgs != uint64(total) {
+		t.Fatalf("Expected %d messages, got %d", total, msgs)
 	}
-	gb := int64(1024 * 1024 * 1024)
-	if limits.MaxMemory != gb {
-		t.Fatalf("Expected MaxMemory to be 1GB, got %d", limits.MaxMemory)
+
+	// Now test access to a pull based consumer, e.g. workqueue.
+	o, err := mset.AddConsumer(&server.ConsumerConfig{
+		Durable:   "d",
+		AckPolicy: server.AckExplicit,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
 	}
-	if limits.MaxStore != 1024*gb {
-		t.Fatalf("Expected MaxStore to be 1TB, got %d", limits.MaxStore)
+	defer o.Delete()
+
+	// We mapped the next message request, "$JS.API.CONSUMER.MSG.NEXT.ORDERS.d" -> "nxt.msg"
+	m, err := nc.Request("nxt.msg", nil, time.Second)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(m.Data) != "ORDERS-1" {
+		t.Fatalf("Expected to receive %q, got %q", "ORDERS-1", m.Data)
 	}
 
-	ncc := clientConnectToServerWithUP(t, opts, "uc", "pwd")
-	defer ncc.Close()
+	// Now test access to a push based consumer
+	o, err = mset.AddConsumer(&server.ConsumerConfig{
+		Durable:        "p",
+		DeliverSubject: "deliver.ORDERS",
+		AckPolicy:      server.AckExplicit,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	defer o.Delete()
 
-	expectNotEnabled := func(resp *nats.Msg, err error) {
-		t.Helper()
-		if err != nil {
-			t.Fatalf("Unexpected error requesting enabled status: %v", err)
-		}
-		if resp == nil {
-			t.Fatalf("No response, possible timeout?")
-		}
-		var iResp server.JSApiAccountInfoResponse
-		if err := json.Unmarshal(resp.Data, &iResp); err != nil {
-			t.Fatalf("Unexpected error: %v", err)
-		}
-		if iResp.Error == nil {
-			t.Fatalf("Expected an error on not enabled account")
+	// We remapped from above, deliver.ORDERS -> d
+	sub, _ := nc.SubscribeSync("d")
+	defer sub.Unsubscribe()
+
+	checkFor(t, 250*time.Millisecond, 10*time.Millisecond, func() error {
+		if nmsgs, _, _ := sub.Pending(); err != nil || nmsgs != total {
+			return fmt.Errorf("Did not receive correct number of messages: %d vs %d", nmsgs, total)
 		}
+		return nil
+	})
+
+	m, _ = sub.NextMsg(time.Second)
+	// Make sure we remapped subject correctly across the account boundary.
+	if m.Subject != "ORDERS.foo" {
+		t.Fatalf("Expected subject of %q, got %q", "ORDERS.foo", m.Subject)
 	}
+	// Now make sure we can ack messages correctly.
+	m.Respond(server.AckAck)
+	nc.Flush()
 
-	// Check C is not enabled. We expect a negative response, not a timeout.
-	expectNotEnabled(ncc.Request(server.JSApiAccountInfo, nil, 250*time.Millisecond))
+	if info := o.Info(); info.AckFloor.Consumer != 1 {
+		t.Fatalf("Did not receive the ack properly")
+	}
 
-	// Now do simple reload and check that we do the right thing. Testing enable and disable and also change in limits
-	newConf := []byte(`
+	// Grab second one now.
+	m, _ = sub.NextMsg(time.Second)
+	// Make sure we remapped subject correctly across the account boundary.
+	if m.Subject != "ORDERS.bar" {
+		t.Fatalf("Expected subject of %q, got %q", "ORDERS.bar", m.Subject)
+	}
+	// Now make sure we can ack messages and get back an ack as well.
+	resp, _ := nc.Request(m.Reply, nil, 100*time.Millisecond)
+	if resp == nil {
+		t.Fatalf("No response, possible timeout?")
+	}
+	if info := o.Info(); info.AckFloor.Consumer != 2 {
+		t.Fatalf("Did not receive the ack properly")
+	}
+}
+
+// This is for importing all of JetStream into another account for admin purposes.
+func TestJetStreamAccountImportAll(t *testing.T) {
+	conf := createConfFile(t, []byte(`
 		listen: 127.0.0.1:-1
+		no_auth_user: rip
 		jetstream: {max_mem_store: 64GB, max_file_store: 10TB}
 		accounts: {
-			A: {
-				jetstream: disabled
-				users: [ {user: ua, password: pwd} ]
-			},
-			B: {
-				jetstream: {max_mem: 32GB, max_store: 512GB, max_streams: 100, max_consumers: 4k}
-				users: [ {user: ub, password: pwd} ]
-			},
-			C: {
-				jetstream: {max_mem: 1GB, max_store: 1TB, max_streams: 10, max_consumers: 1k}
-				users: [ {user: uc, password: pwd} ]
-			},
-		}
-	`)
-	if err := ioutil.WriteFile(conf, newConf, 0600); err != nil {
-		t.Fatalf("Error rewriting server's config file: %v", err)
-	}
-	if err := s.Reload(); err != nil {
-		t.Fatalf("Error on server reload: %v", err)
-	}
-	expectNotEnabled(nca.Request(server.JSApiAccountInfo, nil, 250*time.Millisecond))
+			JS: {
+				jetstream: enabled
+				users: [ {user: dlc, password: foo} ]
+				exports [ { service: "$JS.API.>" } ]
+			},
+			IU: {
+				users: [ {user: rip, password: bar} ]
+				imports [ { service: { subject: "$JS.API.>", account: JS }, to: "jsapi.>"} ]
+			},
+		}
+	`))
+	defer os.Remove(conf)
 
-	resp, _ = ncb.Request(server.JSApiAccountInfo, nil, 250*time.Millisecond)
-	if err := json.Unmarshal(resp.Data, &info); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
 	}
-	if info.Error != nil {
-		t.Fatalf("Expected JetStream to be enabled, got %+v", info.Error)
+
+	acc, err := s.LookupAccount("JS")
+	if err != nil {
+		t.Fatalf("Unexpected error looking up account: %v", err)
 	}
 
-	resp, _ = ncc.Request(server.JSApiAccountInfo, nil, 250*time.Millisecond)
-	if err := json.Unmarshal(resp.Data, &info); err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	mset, err := acc.AddStream(&server.StreamConfig{Name: "ORDERS", Subjects: []string{"ORDERS.*"}})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
-	if info.Error != nil {
-		t.Fatalf("Expected JetStream to be enabled, got %+v", info.Error)
+	defer mset.Delete()
+
+	// This should be the rip user, the one that imports all of JS.
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	mapSubj := func(subject string) string {
+		return strings.Replace(subject, "$JS.API.", "jsapi.", 1)
 	}
 
-	// Now check that limits have been updated.
-	// Account B
-	resp, err = ncb.Request(server.JSApiAccountInfo, nil, time.Second)
+	// This will get the current information about usage and limits for this account.
+	resp, err := nc.Request(mapSubj(server.JSApiAccountInfo), nil, time.Second)
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
+	var info server.JSApiAccountInfoResponse
 	if err := json.Unmarshal(resp.Data, &info); err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
-	limits = info.Limits
-	if limits.MaxStreams != 100 {
-		t.Fatalf("Expected 100 for MaxStreams, got %d", limits.MaxStreams)
-	}
-	if limits.MaxConsumers != 4000 {
-		t.Fatalf("Expected MaxConsumers of %d, got %d", 4000, limits.MaxConsumers)
-	}
-	if limits.MaxMemory != 32*gb {
-		t.Fatalf("Expected MaxMemory to be 32GB, got %d", limits.MaxMemory)
-	}
-	if limits.MaxStore != 512*gb {
-		t.Fatalf("Expected MaxStore to be 512GB, got %d", limits.MaxStore)
+	if info.Error != nil {
+		t.Fatalf("Unexpected error: %+v", info.Error)
 	}
-
-	// Account C
-	resp, err = ncc.Request(server.JSApiAccountInfo, nil, time.Second)
+	// Lookup streams.
+	resp, err = nc.Request(mapSubj(server.JSApiStreams), nil, time.Second)
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
-	if err := json.Unmarshal(resp.Data, &info); err != nil {
+	var namesResponse server.JSApiStreamNamesResponse
+	if err = json.Unmarshal(resp.Data, &namesResponse); err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
-	limits = info.Limits
-	if limits.MaxStreams != 10 {
-		t.Fatalf("Expected 10 for MaxStreams, got %d", limits.MaxStreams)
-	}
-	if limits.MaxConsumers != 1000 {
-		t.Fatalf("Expected MaxConsumers of %d, got %d", 1000, limits.MaxConsumers)
-	}
-	if limits.MaxMemory != gb {
-		t.Fatalf("Expected MaxMemory to be 1GB, got %d", limits.MaxMemory)
-	}
-	if limits.MaxStore != 1024*gb {
-		t.Fatalf("Expected MaxStore to be 1TB, got %d", limits.MaxStore)
+	if namesResponse.Error != nil {
+		t.Fatalf("Unexpected error: %+v", namesResponse.Error)
 	}
 }
 
-func TestJetStreamServerResourcesConfig(t *testing.T) {
+// https://github.com/nats-io/nats-server/issues/1736
+func TestJetStreamServerReload(t *testing.T) {
 	conf := createConfFile(t, []byte(`
 		listen: 127.0.0.1:-1
-		jetstream: {max_mem_store: 2GB, max_file_store: 1TB}
+		jetstream: {max_mem_store: 64GB, max_file_store: 10TB }
+		accounts: {
+			A: { users: [ {user: ua, password: pwd} ] },
+			B: {
+				jetstream: {max_mem: 1GB, max_store: 1TB, max_streams: 10, max_consumers: 1k}
+				users: [ {user: ub, password: pwd} ]
+			},
+			SYS: { users: [ {user: uc, password: pwd} ] },
+		}
+		no_auth_user: ub
+		system_account: SYS
 	`))
 	defer os.Remove(conf)
 
 	s, _ := RunServerWithConfig(conf)
 	defer s.Shutdown()
 
-	if !s.JetStreamEnabled() {
-		t.Fatalf("Expected JetStream to be enabled")
-	}
-
 	if config := s.JetStreamConfig(); config != nil {
 		defer os.RemoveAll(config.StoreDir)
 	}
 
-	gb := int64(1024 * 1024 * 1024)
-	jsc := s.JetStreamConfig()
-	if jsc.MaxMemory != 2*gb {
-		t.Fatalf("Expected MaxMemory to be %d, got %d", 2*gb, jsc.MaxMemory)
-	}
-	if jsc.MaxStore != 1024*gb {
-		t.Fatalf("Expected MaxStore to be %d, got %d", 1024*gb, jsc.MaxStore)
+	if !s.JetStreamEnabled() {
+		t.Fatalf("Expected JetStream to be enabled")
 	}
-}
-
-////////////////////////////////////////
-// Benchmark placeholders
-// TODO(dlc) - move
-////////////////////////////////////////
-
-func TestJetStreamPubPerf(t *testing.T) {
-	// Comment out to run, holding place for now.
-	t.SkipNow()
 
-	s := RunBasicJetStreamServer()
-	defer s.Shutdown()
+	// Client for API requests.
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
 
-	if config := s.JetStreamConfig(); config != nil {
-		defer os.RemoveAll(config.StoreDir)
+	checkJSAccount := func() {
+		t.Helper()
+		resp, err := nc.Request(server.JSApiAccountInfo, nil, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var info server.JSApiAccountInfoResponse
+		if err := json.Unmarshal(resp.Data, &info); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
 	}
 
-	acc := s.GlobalAccount()
+	checkJSAccount()
 
-	msetConfig := server.StreamConfig{
-		Name:     "sr22",
-		Storage:  server.FileStorage,
-		Subjects: []string{"foo"},
+	acc, err := s.LookupAccount("B")
+	if err != nil {
+		t.Fatalf("Unexpected error looking up account: %v", err)
 	}
-
-	if _, err := acc.AddStream(&msetConfig); err != nil {
-		t.Fatalf("Unexpected error adding stream: %v", err)
+	mset, err := acc.AddStream(&server.StreamConfig{Name: "22"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
 
-	nc := clientConnectToServer(t, s)
-	defer nc.Close()
-
-	toSend := 5000000
-	numProducers := 1
-
-	payload := []byte("Hello World")
-
-	startCh := make(chan bool)
-	var wg sync.WaitGroup
-
-	for n := 0; n < numProducers; n++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			<-startCh
-			for i := 0; i < int(toSend)/numProducers; i++ {
-				nc.Publish("foo", payload)
-			}
-			nc.Flush()
-		}()
+	toSend := 10
+	for i := 0; i < toSend; i++ {
+		sendStreamMsg(t, nc, "22", fmt.Sprintf("MSG: %d", i+1))
+	}
+	if msgs := mset.State().Msgs; msgs != uint64(toSend) {
+		t.Fatalf("Expected %d messages, got %d", toSend, msgs)
 	}
 
-	// Wait for Go routines.
-	time.Sleep(10 * time.Millisecond)
-
-	start := time.Now()
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on server reload: %v", err)
+	}
 
-	close(startCh)
-	wg.Wait()
+	// Wait to get reconnected.
+	checkFor(t, 5*time.Second, 10*time.Millisecond, func() error {
+		if !nc.IsConnected() {
+			return fmt.Errorf("Not connected")
+		}
+		return nil
+	})
 
-	tt := time.Since(start)
-	fmt.Printf("time is %v\n", tt)
-	fmt.Printf("%.0f msgs/sec\n", float64(toSend)/tt.Seconds())
+	checkJSAccount()
+	sendStreamMsg(t, nc, "22", "MSG: 22")
 }
 
-func TestJetStreamPubWithAsyncResponsePerf(t *testing.T) {
-	// Comment out to run, holding place for now.
-	t.SkipNow()
-
-	s := RunBasicJetStreamServer()
-	defer s.Shutdown()
+func TestJetStreamReservationsAfterRestart(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: 127.0.0.1:-1
+		jetstream: {max_mem_store: 64GB, max_file_store: 10TB }
+		accounts: {
+			A: {
+				jetstream: {max_mem: 2GB, max_store: 2TB}
+				users: [ {user: ua, password: pwd} ]
+			},
+			B: {
+				jetstream: {max_mem: 1GB, max_store: 1TB}
+				users: [ {user: ub, password: pwd} ]
+			},
+		}
+	`))
+	defer os.Remove(conf)
 
-	if config := s.JetStreamConfig(); config != nil {
-		defer os.RemoveAll(config.StoreDir)
+	s, _ := RunServerWithConfig(conf)
+	config := s.JetStreamConfig()
+	if config == nil {
+		s.Shutdown()
+		t.Fatalf("Expected JetStream to be enabled")
 	}
+	defer os.RemoveAll(config.StoreDir)
 
-	acc := s.GlobalAccount()
-
-	msetConfig := server.StreamConfig{
-		Name:     "sr33",
-		Storage:  server.MemoryStorage,
-		Subjects: []string{"foo"},
+	acc, err := s.LookupAccount("B")
+	if err != nil {
+		t.Fatalf("Unexpected error looking up account: %v", err)
 	}
-
-	if _, err := acc.AddStream(&msetConfig); err != nil {
-		t.Fatalf("Unexpected error adding stream: %v", err)
+	if _, err := acc.AddStream(&server.StreamConfig{Name: "RR"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
 
-	nc := clientConnectToServer(t, s)
-	defer nc.Close()
-
-	toSend := 1000000
-	payload := []byte("Hello World")
-
-	start := time.Now()
-	for i := 0; i < toSend; i++ {
-		nc.PublishRequest("foo", "bar", payload)
+	checkReserved := func() {
+		t.Helper()
+		gb := int64(1024 * 1024 * 1024)
+		rm, rd, err := s.JetStreamReservedResources()
+		if err != nil {
+			t.Fatalf("Unexpected error requesting jetstream reserved resources: %v", err)
+		}
+		if rm != 3*gb || rd != 3*1024*gb {
+			t.Fatalf("Expected reserved memory and store of 3GB and 3TB, got %v and %v",
+				server.FriendlyBytes(rm), server.FriendlyBytes(rd))
+		}
 	}
-	nc.Flush()
+	checkReserved()
 
-	tt := time.Since(start)
-	fmt.Printf("time is %v\n", tt)
-	fmt.Printf("%.0f msgs/sec\n", float64(toSend)/tt.Seconds())
+	// Restart and make sure the reservations match the recovered accounts.
+	s.Shutdown()
+	s, _ = RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	checkReserved()
 }
 
-func TestJetStreamConsumerPerf(t *testing.T) {
-	// Comment out to run, holding place for now.
-	t.SkipNow()
+func TestJetStreamConfigReloadResourceGroupLimits(t *testing.T) {
+	template := `
+		listen: 127.0.0.1:-1
+		jetstream: {max_mem_store: 64MB, max_file_store: 64MB}
+		accounts: {
+			A: { jetstream: {max_mem: 1MB, max_store: %s}, users: [ {user: ua, password: pwd} ] },
+			B: { jetstream: {max_mem: 1MB, max_store: %s}, users: [ {user: ub, password: pwd} ] },
+		}
+	`
+	conf := createConfFile(t, []byte(fmt.Sprintf(template, "1MB", "1MB")))
+	defer os.Remove(conf)
 
-	s := RunBasicJetStreamServer()
+	s, _ := RunServerWithConfig(conf)
 	defer s.Shutdown()
 
 	if config := s.JetStreamConfig(); config != nil {
 		defer os.RemoveAll(config.StoreDir)
 	}
 
-	acc := s.GlobalAccount()
-
-	msetConfig := server.StreamConfig{
-		Name:     "sr22",
-		Storage:  server.MemoryStorage,
-		Subjects: []string{"foo"},
+	const mb = 1024 * 1024
+	if err := s.CreateJetStreamResourceGroup("ORG", 3*mb, -1); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
-
-	mset, err := acc.AddStream(&msetConfig)
-	if err != nil {
-		t.Fatalf("Unexpected error adding stream: %v", err)
+	for _, name := range []string{"A", "B"} {
+		if err := s.AssignJetStreamResourceGroup(name, "ORG"); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
 	}
 
-	nc := clientConnectToServer(t, s)
-	defer nc.Close()
-
-	payload := []byte("Hello World")
-
-	toStore := 2000000
-	for i := 0; i < toStore; i++ {
-		nc.Publish("foo", payload)
+	// Both accounts growing would be over the group limit, so the reload
+	// is rejected up front and nothing changes.
+	if err := ioutil.WriteFile(conf, []byte(fmt.Sprintf(template, "2MB", "2MB")), 0666); err != nil {
+		t.Fatalf("Error writing config: %v", err)
 	}
-	nc.Flush()
-
-	_, err = mset.AddConsumer(&server.ConsumerConfig{
-		Durable:        "d",
-		DeliverSubject: "d",
-		AckPolicy:      server.AckNone,
-	})
-	if err != nil {
-		t.Fatalf("Error creating consumer: %v", err)
+	if err := s.Reload(); err == nil || !strings.Contains(err.Error(), "ORG") {
+		t.Fatalf("Expected a resource group error on reload, got %v", err)
 	}
-
-	var received int
-	done := make(chan bool)
-
-	nc.Subscribe("d", func(m *nats.Msg) {
-		received++
-		if received >= toStore {
-			done <- true
+	for _, name := range []string{"A", "B"} {
+		acc, err := s.LookupAccount(name)
+		if err != nil {
+			t.Fatalf("Unexpected error looking up account: %v", err)
 		}
-	})
-	start := time.Now()
-	nc.Flush()
+		if l, _ := acc.JetStreamLimits(); l.MaxStore != mb {
+			t.Fatalf("Expected limits of %q to be unchanged, got %+v", name, l)
+		}
+	}
 
-	<-done
-	tt := time.Since(start)
-	fmt.Printf("time is %v\n", tt)
-	fmt.Printf("%.0f msgs/sec\n", float64(toStore)/tt.Seconds())
+	if err := ioutil.WriteFile(conf, []byte(fmt.Sprintf(template, "2MB", "1MB")), 0666); err != nil {
+		t.Fatalf("Error writing config: %v", err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error during config reload: %v", err)
+	}
+	acc, _ := s.LookupAccount("A")
+	if l, _ := acc.JetStreamLimits(); l.MaxStore != 2*mb {
+		t.Fatalf("Expected the new limits to be applied, got %+v", l)
+	}
 }
 
-func TestJetStreamConsumerAckFileStorePerf(t *testing.T) {
-	// Comment out to run, holding place for now.
-	t.SkipNow()
+func TestJetStreamConfigReloadWithGlobalAccount(t *testing.T) {
+	template := `
+		authorization {
+			users [
+				{user: anonymous}
+				{user: user1, password: %s}
+			]
+		}
+		no_auth_user: anonymous
+		jetstream: enabled
+	`
+	conf := createConfFile(t, []byte(fmt.Sprintf(template, "pwd")))
+	defer os.Remove(conf)
 
-	s := RunBasicJetStreamServer()
+	s, _ := RunServerWithConfig(conf)
 	defer s.Shutdown()
 
-	if config := s.JetStreamConfig(); config != nil {
-		defer os.RemoveAll(config.StoreDir)
-	}
-
-	acc := s.GlobalAccount()
+	// Client for API requests.
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
 
-	msetConfig := server.StreamConfig{
-		Name:     "sr22",
-		Storage:  server.FileStorage,
-		Subjects: []string{"foo"},
+	checkJSAccount := func() {
+		t.Helper()
+		resp, err := nc.Request(server.JSApiAccountInfo, nil, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		var info server.JSApiAccountInfoResponse
+		if err := json.Unmarshal(resp.Data, &info); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
 	}
 
-	mset, err := acc.AddStream(&msetConfig)
+	checkJSAccount()
+
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "foo"})
 	if err != nil {
 		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
+	defer mset.Delete()
 
-	nc := clientConnectToServer(t, s)
-	defer nc.Close()
-
-	payload := []byte("Hello World")
+	toSend := 10
+	for i := 0; i < toSend; i++ {
+		sendStreamMsg(t, nc, "foo", fmt.Sprintf("MSG: %d", i+1))
+	}
+	if msgs := mset.State().Msgs; msgs != uint64(toSend) {
+		t.Fatalf("Expected %d messages, got %d", toSend, msgs)
+	}
 
-	toStore := uint64(200000)
-	for i := uint64(0); i < toStore; i++ {
-		nc.Publish("foo", payload)
+	if err := ioutil.WriteFile(conf, []byte(fmt.Sprintf(template, "pwd2")), 0666); err != nil {
+		t.Fatalf("Error writing config: %v", err)
 	}
-	nc.Flush()
 
-	if msgs := mset.State().Msgs; msgs != uint64(toStore) {
-		t.Fatalf("Expected %d messages, got %d", toStore, msgs)
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error during config reload: %v", err)
 	}
 
-	o, err := mset.AddConsumer(&server.ConsumerConfig{
-		Durable:        "d",
-		DeliverSubject: "d",
-		AckPolicy:      server.AckExplicit,
-		AckWait:        10 * time.Minute,
-	})
+	// Try to add a new stream to the global account
+	mset2, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "bar"})
 	if err != nil {
-		t.Fatalf("Error creating consumer: %v", err)
+		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
-	defer o.Stop()
-
-	var received uint64
-	done := make(chan bool)
+	defer mset2.Delete()
 
-	sub, _ := nc.Subscribe("d", func(m *nats.Msg) {
-		m.Respond(nil) // Ack
-		received++
-		if received >= toStore {
-			done <- true
+	// Wait to get reconnected.
+	checkFor(t, 5*time.Second, 10*time.Millisecond, func() error {
+		if !nc.IsConnected() {
+			return fmt.Errorf("Not connected")
 		}
+		return nil
 	})
-	sub.SetPendingLimits(-1, -1)
 
-	start := time.Now()
-	nc.Flush()
-
-	<-done
-	tt := time.Since(start)
-	fmt.Printf("time is %v\n", tt)
-	fmt.Printf("%.0f msgs/sec\n", float64(toStore)/tt.Seconds())
+	checkJSAccount()
 }
 
-func TestJetStreamPubSubPerf(t *testing.T) {
-	// Comment out to run, holding place for now.
-	t.SkipNow()
-
+func TestJetStreamAccountLimits(t *testing.T) {
 	s := RunBasicJetStreamServer()
 	defer s.Shutdown()
 
@@ -9078,272 +11761,299 @@ func TestJetStreamPubSubPerf(t *testing.T) {
 		defer os.RemoveAll(config.StoreDir)
 	}
 
-	acc := s.GlobalAccount()
-
-	msetConfig := server.StreamConfig{
-		Name:     "MSET22",
-		Storage:  server.FileStorage,
-		Subjects: []string{"foo"},
+	if _, enabled := s.SystemAccount().JetStreamLimits(); enabled {
+		t.Fatalf("Expected JetStream to not be enabled for the system account")
 	}
 
-	mset, err := acc.AddStream(&msetConfig)
-	if err != nil {
-		t.Fatalf("Unexpected error adding stream: %v", err)
+	acc := s.GlobalAccount()
+	limits := &server.JetStreamAccountLimits{MaxMemory: 1024 * 1024, MaxStore: 8 * 1024 * 1024, MaxStreams: 10, MaxConsumers: 20}
+	if err := acc.UpdateJetStreamLimits(limits); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
-
-	nc := clientConnectToServer(t, s)
-	defer nc.Close()
-
-	var toSend = 1000000
-	var received int
-	done := make(chan bool)
-
-	delivery := "d"
-
-	nc.Subscribe(delivery, func(m *nats.Msg) {
-		received++
-		if received >= toSend {
-			done <- true
-		}
-	})
-	nc.Flush()
-
-	_, err = mset.AddConsumer(&server.ConsumerConfig{
-		DeliverSubject: delivery,
-		AckPolicy:      server.AckNone,
-	})
-	if err != nil {
-		t.Fatalf("Error creating consumer: %v", err)
+	got, enabled := acc.JetStreamLimits()
+	if !enabled {
+		t.Fatalf("Expected JetStream to be enabled for the account")
 	}
-
-	payload := []byte("Hello World")
-
-	start := time.Now()
-
-	for i := 0; i < toSend; i++ {
-		nc.Publish("foo", payload)
+	if got != *limits {
+		t.Fatalf("Expected limits %+v, got %+v", limits, got)
 	}
-
-	<-done
-	tt := time.Since(start)
-	fmt.Printf("time is %v\n", tt)
-	fmt.Printf("%.0f msgs/sec\n", float64(toSend)/tt.Seconds())
-}
-
-func TestJetStreamAckExplicitMsgRemoval(t *testing.T) {
-	cases := []struct {
-		name    string
-		mconfig *server.StreamConfig
-	}{
-		{"MemoryStore", &server.StreamConfig{
-			Name:      "MY_STREAM",
-			Storage:   server.MemoryStorage,
-			Subjects:  []string{"foo.*"},
-			Retention: server.InterestPolicy,
-		}},
-		{"FileStore", &server.StreamConfig{
-			Name:      "MY_STREAM",
-			Storage:   server.FileStorage,
-			Subjects:  []string{"foo.*"},
-			Retention: server.InterestPolicy,
-		}},
+	if stats := acc.JetStreamUsage(); stats.Limits != got {
+		t.Fatalf("Expected limits to match usage %+v, got %+v", stats.Limits, got)
 	}
-	for _, c := range cases {
-		t.Run(c.name, func(t *testing.T) {
-			s := RunBasicJetStreamServer()
-			defer s.Shutdown()
-
-			if config := s.JetStreamConfig(); config != nil {
-				defer os.RemoveAll(config.StoreDir)
-			}
-
-			mset, err := s.GlobalAccount().AddStream(c.mconfig)
-			if err != nil {
-				t.Fatalf("Unexpected error adding stream: %v", err)
-			}
-			defer mset.Delete()
 
-			nc1 := clientConnectToServer(t, s)
-			defer nc1.Close()
+	// Changing the copy should not change the account.
+	got.MaxStreams = 1
+	if got, _ = acc.JetStreamLimits(); got.MaxStreams != 10 {
+		t.Fatalf("Expected account limits to be unchanged, got %+v", got)
+	}
+}
 
-			nc2 := clientConnectToServer(t, s)
-			defer nc2.Close()
+func TestJetStreamConsumerInactiveThreshold(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
 
-			// Create two durable consumers on the same subject
-			sub1, _ := nc1.SubscribeSync(nats.NewInbox())
-			defer sub1.Unsubscribe()
-			nc1.Flush()
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
 
-			o1, err := mset.AddConsumer(&server.ConsumerConfig{
-				Durable:        "dur1",
-				DeliverSubject: sub1.Subject,
-				FilterSubject:  "foo.bar",
-				AckPolicy:      server.AckExplicit,
-			})
-			if err != nil {
-				t.Fatalf("Unexpected error adding consumer: %v", err)
-			}
-			defer o1.Delete()
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "IT", Storage: server.FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	if _, err := mset.AddConsumer(&server.ConsumerConfig{
+		Durable:           "bad",
+		AckPolicy:         server.AckExplicit,
+		InactiveThreshold: -time.Second,
+	}); err == nil {
+		t.Fatalf("Expected an error for a negative inactive threshold")
+	}
 
-			sub2, _ := nc2.SubscribeSync(nats.NewInbox())
-			defer sub2.Unsubscribe()
-			nc2.Flush()
+	thresh := 250 * time.Millisecond
+	for _, name := range []string{"pull", "push"} {
+		cfg := &server.ConsumerConfig{Durable: name, AckPolicy: server.AckExplicit, InactiveThreshold: thresh}
+		if name == "push" {
+			cfg.DeliverSubject = "to"
+		}
+		if _, err := mset.AddConsumer(cfg); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
 
-			o2, err := mset.AddConsumer(&server.ConsumerConfig{
-				Durable:        "dur2",
-				DeliverSubject: sub2.Subject,
-				FilterSubject:  "foo.bar",
-				AckPolicy:      server.AckExplicit,
-				AckWait:        100 * time.Millisecond,
-			})
-			if err != nil {
-				t.Fatalf("Unexpected error adding consumer: %v", err)
-			}
-			defer o2.Delete()
+	// Make sure the threshold is persisted and recovered.
+	sd := s.JetStreamConfig().StoreDir
+	s.Shutdown()
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
 
-			// Send 2 messages
-			toSend := 2
-			for i := 0; i < toSend; i++ {
-				sendStreamMsg(t, nc1, "foo.bar", fmt.Sprintf("msg%v", i+1))
-			}
-			state := mset.State()
-			if state.Msgs != uint64(toSend) {
-				t.Fatalf("Expected %v messages, got %d", toSend, state.Msgs)
-			}
+	mset, err = s.GlobalAccount().LookupStream("IT")
+	if err != nil {
+		t.Fatalf("Expected to find a stream for %q", "IT")
+	}
+	for _, name := range []string{"pull", "push"} {
+		o := mset.LookupConsumer(name)
+		if o == nil {
+			t.Fatalf("Expected to recover consumer %q", name)
+		}
+		if it := o.Config().InactiveThreshold; it != thresh {
+			t.Fatalf("Expected inactive threshold of %v to be recovered, got %v", thresh, it)
+		}
+	}
 
-			// Receive the messages and ack them.
-			subs := []*nats.Subscription{sub1, sub2}
-			for _, sub := range subs {
-				for i := 0; i < toSend; i++ {
-					m, err := sub.NextMsg(time.Second)
-					if err != nil {
-						t.Fatalf("Error acking message: %v", err)
-					}
-					m.Respond(nil)
-				}
-			}
-			// To make sure acks are processed for checking state after sending new ones.
-			checkFor(t, time.Second, 25*time.Millisecond, func() error {
-				if state = mset.State(); state.Msgs != 0 {
-					return fmt.Errorf("Stream still has messages")
-				}
-				return nil
-			})
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
 
-			// Now close the 2nd subscription...
-			sub2.Unsubscribe()
-			nc2.Flush()
+	// Interest keeps the push consumer around, the idle pull consumer is removed.
+	sub, _ := nc.SubscribeSync("to")
+	nc.Flush()
 
-			// Send 2 more new messages
-			for i := 0; i < toSend; i++ {
-				sendStreamMsg(t, nc1, "foo.bar", fmt.Sprintf("msg%v", 2+i+1))
-			}
-			state = mset.State()
-			if state.Msgs != uint64(toSend) {
-				t.Fatalf("Expected %v messages, got %d", toSend, state.Msgs)
-			}
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if o := mset.LookupConsumer("pull"); o != nil {
+			return fmt.Errorf("Expected pull consumer to be deleted")
+		}
+		return nil
+	})
+	time.Sleep(2 * thresh)
+	if o := mset.LookupConsumer("push"); o == nil {
+		t.Fatalf("Expected push consumer with interest to remain")
+	}
 
-			// first subscription should get it and will ack it.
-			for i := 0; i < toSend; i++ {
-				m, err := sub1.NextMsg(time.Second)
-				if err != nil {
-					t.Fatalf("Error getting message to ack: %v", err)
-				}
-				m.Respond(nil)
-			}
-			// For acks from m.Respond above
-			nc1.Flush()
+	sub.Unsubscribe()
+	nc.Flush()
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if o := mset.LookupConsumer("push"); o != nil {
+			return fmt.Errorf("Expected push consumer to be deleted")
+		}
+		return nil
+	})
+}
 
-			// Now recreate the subscription for the 2nd JS consumer
-			sub2, _ = nc2.SubscribeSync(nats.NewInbox())
-			defer sub2.Unsubscribe()
+func TestJetStreamSetMaxMemoryAndStore(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
 
-			o2, err = mset.AddConsumer(&server.ConsumerConfig{
-				Durable:        "dur2",
-				DeliverSubject: sub2.Subject,
-				FilterSubject:  "foo.bar",
-				AckPolicy:      server.AckExplicit,
-				AckWait:        100 * time.Millisecond,
-			})
-			if err != nil {
-				t.Fatalf("Unexpected error adding consumer: %v", err)
-			}
-			defer o2.Delete()
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
 
-			// Those messages should be redelivered to the 2nd consumer
-			for i := 1; i <= toSend; i++ {
-				m, err := sub2.NextMsg(time.Second)
-				if err != nil {
-					t.Fatalf("Error receiving message %d: %v", i, err)
-				}
-				m.Respond(nil)
+	acc := s.GlobalAccount()
+	for _, st := range []server.StorageType{server.MemoryStorage, server.FileStorage} {
+		if _, err := acc.AddStream(&server.StreamConfig{Name: st.String(), Storage: st}); err != nil {
+			t.Fatalf("Unexpected error adding stream: %v", err)
+		}
+	}
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+	for i := 0; i < 10; i++ {
+		sendStreamMsg(t, nc, server.MemoryStorage.String(), "Hello World")
+		sendStreamMsg(t, nc, server.FileStorage.String(), "Hello World")
+	}
 
-				sseq := o2.StreamSeqFromReply(m.Reply)
-				// Depending on timing from above we could receive stream sequences out of order but
-				// we know we want 3 & 4.
-				if sseq != 3 && sseq != 4 {
-					t.Fatalf("Expected stream sequence of 3 or 4 but got %d", sseq)
-				}
-			}
-		})
+	// Grow both.
+	cfg := s.JetStreamConfig()
+	if err := s.JetStreamSetMaxMemory(2 * cfg.MaxMemory); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := s.JetStreamSetMaxStore(2 * cfg.MaxStore); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ncfg := s.JetStreamConfig()
+	if ncfg.MaxMemory != 2*cfg.MaxMemory || ncfg.MaxStore != 2*cfg.MaxStore {
+		t.Fatalf("Expected limits to be doubled, got %+v", ncfg)
+	}
+	// The global account follows the server limits.
+	if limits, _ := acc.JetStreamLimits(); limits.MaxMemory != ncfg.MaxMemory || limits.MaxStore != ncfg.MaxStore {
+		t.Fatalf("Expected account limits to follow the server, got %+v", limits)
+	}
+
+	// Shrinking below what is in use is not allowed.
+	if err := s.JetStreamSetMaxMemory(1); err == nil {
+		t.Fatalf("Expected an error shrinking max memory below usage")
+	}
+	if err := s.JetStreamSetMaxStore(1); err == nil {
+		t.Fatalf("Expected an error shrinking max storage below usage")
+	}
+	if err := s.JetStreamSetMaxMemory(0); err == nil {
+		t.Fatalf("Expected an error for a zero max memory")
+	}
+	if ccfg := s.JetStreamConfig(); ccfg.MaxMemory != ncfg.MaxMemory || ccfg.MaxStore != ncfg.MaxStore {
+		t.Fatalf("Expected limits to be unchanged, got %+v", ccfg)
 	}
 }
 
-// This test is in support fo clients that want to match on subject, they
-// can set the filter subject always and if the stream only has one subject
-// and they match the filter is cleared automatically. This eliminates us
-// needing to know if a subject is a subset of a stream when looking it up.
-func TestJetStreamConsumerFilterSubject(t *testing.T) {
+func TestJetStreamSealedStream(t *testing.T) {
 	s := RunBasicJetStreamServer()
 	defer s.Shutdown()
 
-	sc := &server.StreamConfig{Name: "MY_STREAM", Subjects: []string{"foo"}}
-	mset, err := s.GlobalAccount().AddStream(sc)
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	acc := s.GlobalAccount()
+	mset, err := acc.AddStream(&server.StreamConfig{Name: "SEALED", Storage: server.FileStorage})
 	if err != nil {
 		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
-	defer mset.Delete()
-
-	cfg := &server.ConsumerConfig{
-		Durable:        "d",
-		DeliverSubject: "A",
-		AckPolicy:      server.AckExplicit,
-		FilterSubject:  "foo",
+	o, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "dlc", AckPolicy: server.AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
 
-	o, err := mset.AddConsumer(cfg)
-	if err != nil {
-		t.Fatalf("Unexpected error adding consumer: %v", err)
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+	for i := 0; i < 5; i++ {
+		sendStreamMsg(t, nc, "SEALED", "Hello World")
+	}
+	if err := acc.SealStream("SEALED"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
-	defer o.Delete()
 
-	if o.Info().Config.FilterSubject != "" {
-		t.Fatalf("Expected the filter to be cleared")
+	checkSealed := func(mset *server.Stream) {
+		t.Helper()
+		if !mset.Config().Sealed {
+			t.Fatalf("Expected stream to be sealed")
+		}
+		resp, err := nc.Request("SEALED", []byte("Hello World"), time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if pa := getPubAckResponse(resp.Data); pa == nil || pa.Error == nil || pa.Error.Description != server.ErrJetStreamStreamSealed.Error() {
+			t.Fatalf("Expected a sealed error, got %q", resp.Data)
+		}
+		if _, err := mset.Purge(); err != server.ErrJetStreamStreamSealed {
+			t.Fatalf("Expected a sealed error on purge, got %v", err)
+		}
+		if _, err := mset.DeleteMsg(1); err != server.ErrJetStreamStreamSealed {
+			t.Fatalf("Expected a sealed error on delete, got %v", err)
+		}
+		cfg := mset.Config()
+		cfg.Sealed = false
+		if err := mset.Update(&cfg); err == nil {
+			t.Fatalf("Expected an error unsealing the stream")
+		}
+		if state := mset.State(); state.Msgs != 5 {
+			t.Fatalf("Expected 5 msgs, got %d", state.Msgs)
+		}
 	}
+	checkSealed(mset)
 
-	// Now use the original cfg with updated delivery subject and make sure that works ok.
-	cfg = &server.ConsumerConfig{
-		Durable:        "d",
-		DeliverSubject: "B",
-		AckPolicy:      server.AckExplicit,
-		FilterSubject:  "foo",
+	// Consumers can still read.
+	if _, err := nc.Request(o.RequestNextMsgSubject(), nil, time.Second); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
 
-	o, err = mset.AddConsumer(cfg)
+	// The seal survives a restart.
+	sd := s.JetStreamConfig().StoreDir
+	nc.Close()
+	s.Shutdown()
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+
+	nc = clientConnectToServer(t, s)
+	defer nc.Close()
+	mset, err = s.GlobalAccount().LookupStream("SEALED")
 	if err != nil {
-		t.Fatalf("Unexpected error adding consumer: %v", err)
+		t.Fatalf("Expected to find a stream for %q", "SEALED")
 	}
-	defer o.Delete()
+	checkSealed(mset)
 }
 
-func TestJetStreamStoredMsgsDontDisappearAfterCacheExpiration(t *testing.T) {
-	sc := &server.StreamConfig{
-		Name:      "MY_STREAM",
-		Storage:   server.FileStorage,
-		Subjects:  []string{"foo.>"},
-		Retention: server.InterestPolicy,
+func TestJetStreamSealedStreamNoRemovals(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	acc := s.GlobalAccount()
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	// Acks would remove messages from a work queue stream.
+	wq, err := acc.AddStream(&server.StreamConfig{Name: "WQ", Storage: server.MemoryStorage, Retention: server.WorkQueuePolicy})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer wq.Delete()
+	if err := acc.SealStream("WQ"); err == nil {
+		t.Fatalf("Expected an error sealing a work queue stream")
+	}
+	if _, err := acc.AddStream(&server.StreamConfig{Name: "IQ", Storage: server.MemoryStorage, Retention: server.InterestPolicy, Sealed: true}); err == nil {
+		t.Fatalf("Expected an error adding a sealed interest stream")
+	}
+
+	for _, storage := range []server.StorageType{server.MemoryStorage, server.FileStorage} {
+		t.Run(storage.String(), func(t *testing.T) {
+			mset, err := acc.AddStream(&server.StreamConfig{Name: "SEALED", Storage: storage, MaxAge: 250 * time.Millisecond})
+			if err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			defer mset.Delete()
+
+			for i := 0; i < 5; i++ {
+				sendStreamMsg(t, nc, "SEALED", "Hello World")
+			}
+			if err := acc.SealStream("SEALED"); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			// Shrinking the limits would truncate the stream.
+			cfg := mset.Config()
+			cfg.MaxMsgs = 1
+			if err := mset.Update(&cfg); err == nil {
+				t.Fatalf("Expected an error changing limits of a sealed stream")
+			}
+
+			// Nothing ages out.
+			time.Sleep(500 * time.Millisecond)
+			if state := mset.State(); state.Msgs != 5 {
+				t.Fatalf("Expected 5 msgs, got %d", state.Msgs)
+			}
+		})
 	}
+}
 
+func TestJetStreamRecoveredEphemeralConsumer(t *testing.T) {
 	s := RunBasicJetStreamServer()
 	defer s.Shutdown()
 
@@ -9351,93 +12061,63 @@ func TestJetStreamStoredMsgsDontDisappearAfterCacheExpiration(t *testing.T) {
 		defer os.RemoveAll(config.StoreDir)
 	}
 
-	mset, err := s.GlobalAccount().AddStreamWithStore(sc, &server.FileStoreConfig{BlockSize: 128, CacheExpire: 15 * time.Millisecond})
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "RE", Storage: server.FileStorage})
 	if err != nil {
 		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
-	defer mset.Delete()
 
-	nc1 := clientConnectWithOldRequest(t, s)
-	defer nc1.Close()
-
-	// Create a durable consumers
-	sub, _ := nc1.SubscribeSync(nats.NewInbox())
-	defer sub.Unsubscribe()
-	nc1.Flush()
+	nc := clientConnectToServer(t, s)
+	sub, _ := nc.SubscribeSync(nats.NewInbox())
+	nc.Flush()
 
-	o, err := mset.AddConsumer(&server.ConsumerConfig{
-		Durable:        "dur",
-		DeliverSubject: sub.Subject,
-		FilterSubject:  "foo.bar",
-		DeliverPolicy:  server.DeliverNew,
-		AckPolicy:      server.AckExplicit,
-	})
+	o, err := mset.AddConsumer(&server.ConsumerConfig{DeliverSubject: sub.Subject, AckPolicy: server.AckExplicit})
 	if err != nil {
-		t.Fatalf("Unexpected error adding consumer: %v", err)
+		t.Fatalf("Error creating consumer: %v", err)
 	}
-	defer o.Delete()
-
-	nc2 := clientConnectWithOldRequest(t, s)
-	defer nc2.Close()
+	if o.IsRecoveredEphemeral() || o.Info().RecoveredEphemeral {
+		t.Fatalf("Expected a new ephemeral to not be marked as recovered")
+	}
+	oname, dsubj := o.Name(), sub.Subject
+	nc.Close()
 
-	sendStreamMsg(t, nc2, "foo.bar", "msg1")
+	sd := s.JetStreamConfig().StoreDir
+	s.Shutdown()
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
 
-	msg, err := sub.NextMsg(time.Second)
+	mset, err = s.GlobalAccount().LookupStream("RE")
 	if err != nil {
-		t.Fatalf("Did not get message: %v", err)
+		t.Fatalf("Expected to find a stream for %q", "RE")
 	}
-	if string(msg.Data) != "msg1" {
-		t.Fatalf("Unexpected message: %q", msg.Data)
+	if o = mset.LookupConsumer(oname); o == nil {
+		t.Fatalf("Error looking up consumer %q", oname)
 	}
-
-	nc1.Close()
-
-	// Get the message from the stream
-	getMsgSeq := func(seq uint64) {
-		t.Helper()
-		mreq := &server.JSApiMsgGetRequest{Seq: seq}
-		req, err := json.Marshal(mreq)
-		if err != nil {
-			t.Fatalf("Unexpected error: %v", err)
-		}
-		smsgj, err := nc2.Request(fmt.Sprintf(server.JSApiMsgGetT, sc.Name), req, time.Second)
-		if err != nil {
-			t.Fatalf("Could not retrieve stream message: %v", err)
-		}
-		if strings.Contains(string(smsgj.Data), "code") {
-			t.Fatalf("Error: %q", smsgj.Data)
-		}
+	if !o.IsRecoveredEphemeral() || !o.Info().RecoveredEphemeral {
+		t.Fatalf("Expected the consumer to be marked as a recovered ephemeral")
 	}
 
-	getMsgSeq(1)
-
-	time.Sleep(time.Second)
-
-	sendStreamMsg(t, nc2, "foo.bar", "msg2")
-	sendStreamMsg(t, nc2, "foo.bar", "msg3")
+	// Once the client comes back the consumer is claimed.
+	nc = clientConnectToServer(t, s)
+	defer nc.Close()
+	sub, _ = nc.SubscribeSync(dsubj)
+	defer sub.Unsubscribe()
+	nc.Flush()
 
-	getMsgSeq(1)
-	getMsgSeq(2)
-	getMsgSeq(3)
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		if o.IsRecoveredEphemeral() || o.Info().RecoveredEphemeral {
+			return fmt.Errorf("Expected the consumer to no longer be marked as recovered")
+		}
+		return nil
+	})
 }
 
-func TestJetStreamConsumerUpdateRedelivery(t *testing.T) {
+func TestJetStreamTruncateStream(t *testing.T) {
 	cases := []struct {
 		name    string
 		mconfig *server.StreamConfig
 	}{
-		{"MemoryStore", &server.StreamConfig{
-			Name:      "MY_STREAM",
-			Storage:   server.MemoryStorage,
-			Subjects:  []string{"foo.>"},
-			Retention: server.InterestPolicy,
-		}},
-		{"FileStore", &server.StreamConfig{
-			Name:      "MY_STREAM",
-			Storage:   server.FileStorage,
-			Subjects:  []string{"foo.>"},
-			Retention: server.InterestPolicy,
-		}},
+		{"MemoryStore", &server.StreamConfig{Name: "TRUNC", Storage: server.MemoryStorage, Subjects: []string{"foo"}}},
+		{"FileStore", &server.StreamConfig{Name: "TRUNC", Storage: server.FileStorage, Subjects: []string{"foo"}}},
 	}
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
@@ -9448,168 +12128,134 @@ func TestJetStreamConsumerUpdateRedelivery(t *testing.T) {
 				defer os.RemoveAll(config.StoreDir)
 			}
 
-			mset, err := s.GlobalAccount().AddStream(c.mconfig)
+			acc := s.GlobalAccount()
+			mset, err := acc.AddStream(c.mconfig)
 			if err != nil {
 				t.Fatalf("Unexpected error adding stream: %v", err)
 			}
-			defer mset.Delete()
-
-			nc := clientConnectToServer(t, s)
-			defer nc.Close()
-
-			// Create a durable consumer.
-			sub, _ := nc.SubscribeSync(nats.NewInbox())
-			defer sub.Unsubscribe()
-
-			o, err := mset.AddConsumer(&server.ConsumerConfig{
-				Durable:        "dur22",
-				DeliverSubject: sub.Subject,
-				FilterSubject:  "foo.bar",
-				AckPolicy:      server.AckExplicit,
-				AckWait:        100 * time.Millisecond,
-				MaxDeliver:     3,
-			})
+			o, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "dlc", AckPolicy: server.AckExplicit})
 			if err != nil {
-				t.Fatalf("Unexpected error adding consumer: %v", err)
+				t.Fatalf("Unexpected error: %v", err)
 			}
-			defer o.Delete()
 
-			// Send 20 messages
-			toSend := 20
-			for i := 1; i <= toSend; i++ {
-				sendStreamMsg(t, nc, "foo.bar", fmt.Sprintf("msg-%v", i))
+			nc := clientConnectToServer(t, s)
+			defer nc.Close()
+			for i := 0; i < 10; i++ {
+				sendStreamMsg(t, nc, "foo", "OK")
 			}
-			state := mset.State()
-			if state.Msgs != uint64(toSend) {
-				t.Fatalf("Expected %v messages, got %d", toSend, state.Msgs)
+			usage := func() uint64 {
+				stats := acc.JetStreamUsage()
+				return stats.Memory + stats.Store
 			}
+			before := usage()
 
-			// Receive the messages and ack only every 4th
-			for i := 0; i < toSend; i++ {
-				m, err := sub.NextMsg(time.Second)
+			// Deliver 8 and ack the first 2.
+			for i := 0; i < 8; i++ {
+				m, err := nc.Request(o.RequestNextMsgSubject(), nil, time.Second)
 				if err != nil {
-					t.Fatalf("Error getting message: %v", err)
+					t.Fatalf("Unexpected error: %v", err)
 				}
-				seq, _, _, _, _ := o.ReplyInfo(m.Reply)
-				// 4, 8, 12, 16, 20
-				if seq%4 == 0 {
+				if i < 2 {
 					m.Respond(nil)
 				}
 			}
-
-			// Now close the sub and open a new one and update the consumer.
-			sub.Unsubscribe()
-
-			// Wait for it to become inactive
-			checkFor(t, 200*time.Millisecond, 10*time.Millisecond, func() error {
-				if o.Active() {
-					return fmt.Errorf("Consumer still active")
+			nc.Flush()
+			checkFor(t, time.Second, 10*time.Millisecond, func() error {
+				if info := o.Info(); info.AckFloor.Stream != 2 {
+					return fmt.Errorf("Expected ack floor of 2, got %d", info.AckFloor.Stream)
 				}
 				return nil
 			})
 
-			// Send 20 more messages.
-			for i := toSend; i < toSend*2; i++ {
-				sendStreamMsg(t, nc, "foo.bar", fmt.Sprintf("msg-%v", i))
+			if err := acc.TruncateStream("TRUNC", 1); err == nil {
+				t.Fatalf("Expected an error truncating past acknowledged messages")
+			}
+			if err := acc.TruncateStream("TRUNC", 5); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if state := mset.State(); state.Msgs != 5 || state.LastSeq != 5 {
+				t.Fatalf("Expected 5 msgs with last sequence 5, got %+v", state)
+			}
+			if after := usage(); after >= before {
+				t.Fatalf("Expected usage to drop from %d, got %d", before, after)
+			}
+			if info := o.Info(); info.NumAckPending != 3 {
+				t.Fatalf("Expected 3 pending acks, got %d", info.NumAckPending)
 			}
 
-			// Create new subscription.
-			sub, _ = nc.SubscribeSync(nats.NewInbox())
-			defer sub.Unsubscribe()
-			nc.Flush()
-
-			o, err = mset.AddConsumer(&server.ConsumerConfig{
-				Durable:        "dur22",
-				DeliverSubject: sub.Subject,
-				FilterSubject:  "foo.bar",
-				AckPolicy:      server.AckExplicit,
-				AckWait:        100 * time.Millisecond,
-				MaxDeliver:     3,
-			})
+			// New messages continue from the truncated sequence and are delivered next.
+			if pa := sendStreamMsg(t, nc, "foo", "NEW"); pa.Sequence != 6 {
+				t.Fatalf("Expected sequence 6, got %d", pa.Sequence)
+			}
+			m, err := nc.Request(o.RequestNextMsgSubject(), nil, time.Second)
 			if err != nil {
-				t.Fatalf("Unexpected error adding consumer: %v", err)
+				t.Fatalf("Unexpected error: %v", err)
 			}
-			defer o.Delete()
-
-			expect := toSend + toSend - 5 // mod 4 acks
-			checkFor(t, time.Second, 5*time.Millisecond, func() error {
-				if nmsgs, _, _ := sub.Pending(); err != nil || nmsgs != expect {
-					return fmt.Errorf("Did not receive correct number of messages: %d vs %d", nmsgs, expect)
-				}
-				return nil
-			})
-
-			for i, eseq := 0, uint64(1); i < expect; i++ {
-				m, err := sub.NextMsg(time.Second)
-				if err != nil {
-					t.Fatalf("Error getting message: %v", err)
-				}
-				// Skip the ones we ack'd from above. We should not get them back here.
-				if eseq <= uint64(toSend) && eseq%4 == 0 {
-					eseq++
-				}
-				seq, _, dc, _, _ := o.ReplyInfo(m.Reply)
-				if seq != eseq {
-					t.Fatalf("Expected stream sequence of %d, got %d", eseq, seq)
-				}
-				if seq <= uint64(toSend) && dc != 2 {
-					t.Fatalf("Expected delivery count of 2 for sequence of %d, got %d", seq, dc)
-				}
-				if seq > uint64(toSend) && dc != 1 {
-					t.Fatalf("Expected delivery count of 1 for sequence of %d, got %d", seq, dc)
-				}
-				if seq > uint64(toSend) {
-					m.Respond(nil) // Ack
-				}
-				eseq++
+			if string(m.Data) != "NEW" {
+				t.Fatalf("Expected the new message, got %q", m.Data)
 			}
 
-			// We should get the second half back since we did not ack those from above.
-			expect = toSend - 5
-			checkFor(t, time.Second, 5*time.Millisecond, func() error {
-				if nmsgs, _, _ := sub.Pending(); err != nil || nmsgs != expect {
-					return fmt.Errorf("Did not receive correct number of messages: %d vs %d", nmsgs, expect)
-				}
-				return nil
-			})
-
-			for i, eseq := 0, uint64(1); i < expect; i++ {
-				m, err := sub.NextMsg(time.Second)
-				if err != nil {
-					t.Fatalf("Error getting message: %v", err)
-				}
-				// Skip the ones we ack'd from above. We should not get them back here.
-				if eseq <= uint64(toSend) && eseq%4 == 0 {
-					eseq++
-				}
-				seq, _, dc, _, _ := o.ReplyInfo(m.Reply)
-				if seq != eseq {
-					t.Fatalf("Expected stream sequence of %d, got %d", eseq, seq)
-				}
-				if dc != 3 {
-					t.Fatalf("Expected delivery count of 3 for sequence of %d, got %d", seq, dc)
-				}
-				eseq++
+			// Can not truncate below the first message.
+			if _, err := mset.Purge(); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			sendStreamMsg(t, nc, "foo", "OK")
+			if err := acc.TruncateStream("TRUNC", 6); err == nil {
+				t.Fatalf("Expected an error truncating below the first sequence")
 			}
 		})
 	}
 }
 
-func TestJetStreamConsumerMaxAckPending(t *testing.T) {
-	cases := []struct {
-		name    string
-		mconfig *server.StreamConfig
-	}{
-		{"MemoryStore", &server.StreamConfig{
-			Name:     "MY_STREAM",
-			Storage:  server.MemoryStorage,
-			Subjects: []string{"foo.*"},
-		}},
-		{"FileStore", &server.StreamConfig{
-			Name:     "MY_STREAM",
-			Storage:  server.FileStorage,
-			Subjects: []string{"foo.*"},
-		}},
+func TestJetStreamHeadroom(t *testing.T) {
+	s := RunRandClientPortServer()
+	defer s.Shutdown()
+
+	acc, _ := s.LookupOrRegisterAccount("FOO")
+	if mem, store := acc.JetStreamHeadroom(); mem != 0 || store != 0 {
+		t.Fatalf("Expected no headroom without JetStream, got %d and %d", mem, store)
+	}
+
+	storeDir, _ := ioutil.TempDir(os.TempDir(), "jstests-storedir-")
+	defer os.RemoveAll(storeDir)
+	if err := s.EnableJetStream(&server.JetStreamConfig{MaxMemory: 64 * 1024, MaxStore: 64 * 1024, StoreDir: storeDir}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	limits := &server.JetStreamAccountLimits{MaxMemory: 4096, MaxStore: 8192, MaxStreams: -1, MaxConsumers: -1}
+	if err := acc.EnableJetStream(limits); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkHeadroom := func(mem, store int64) {
+		t.Helper()
+		if m, s := acc.JetStreamHeadroom(); m != mem || s != store {
+			t.Fatalf("Expected headroom of %d and %d, got %d and %d", mem, store, m, s)
+		}
+	}
+	checkHeadroom(4096, 8192)
+
+	if _, err := acc.AddStream(&server.StreamConfig{Name: "M", Storage: server.MemoryStorage, MaxBytes: 1024}); err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	if _, err := acc.AddStream(&server.StreamConfig{Name: "F", MaxBytes: 8192}); err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	checkHeadroom(3072, 0)
+
+	// Unlimited resources have no fixed headroom.
+	limits.MaxStore = -1
+	if err := acc.UpdateJetStreamLimits(limits); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkHeadroom(3072, -1)
+}
+
+func TestJetStreamMsgTTL(t *testing.T) {
+	cases := []struct {
+		name    string
+		mconfig *server.StreamConfig
+	}{
+		{"MemoryStore", &server.StreamConfig{Name: "TTL", Storage: server.MemoryStorage, MaxAge: time.Hour, Subjects: []string{"foo"}}},
+		{"FileStore", &server.StreamConfig{Name: "TTL", Storage: server.FileStorage, MaxAge: time.Hour, Subjects: []string{"foo"}}},
 	}
 	for _, c := range cases {
 		t.Run(c.name, func(t *testing.T) {
@@ -9620,7 +12266,8 @@ func TestJetStreamConsumerMaxAckPending(t *testing.T) {
 				defer os.RemoveAll(config.StoreDir)
 			}
 
-			mset, err := s.GlobalAccount().AddStream(c.mconfig)
+			acc := s.GlobalAccount()
+			mset, err := acc.AddStream(c.mconfig)
 			if err != nil {
 				t.Fatalf("Unexpected error adding stream: %v", err)
 			}
@@ -9629,316 +12276,792 @@ func TestJetStreamConsumerMaxAckPending(t *testing.T) {
 			nc := clientConnectToServer(t, s)
 			defer nc.Close()
 
-			// Do error scenarios.
-			_, err = mset.AddConsumer(&server.ConsumerConfig{
-				Durable:        "d22",
-				DeliverSubject: nats.NewInbox(),
-				AckPolicy:      server.AckNone,
-				MaxAckPending:  1,
-			})
-			if err == nil {
-				t.Fatalf("Expected error, MaxAckPending only applicable to ack != AckNone")
+			sendMsg := func(ttl string) *server.JSPubAckResponse {
+				t.Helper()
+				m := nats.NewMsg("foo")
+				if ttl != "" {
+					m.Header.Set(server.JSMsgTTL, ttl)
+				}
+				m.Data = []byte("HELLO")
+				resp, err := nc.RequestMsg(m, time.Second)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				pa := getPubAckResponse(resp.Data)
+				if pa == nil {
+					t.Fatalf("Expected a JetStreamPubAck, got %q", resp.Data)
+				}
+				return pa
 			}
 
-			// Queue up 100 messages.
-			toSend := 100
-			for i := 0; i < toSend; i++ {
-				sendStreamMsg(t, nc, "foo.bar", fmt.Sprintf("MSG: %d", i+1))
+			// Invalid TTLs are rejected.
+			for _, ttl := range []string{"bad", "-1s", "0"} {
+				if pa := sendMsg(ttl); pa.Error == nil {
+					t.Fatalf("Expected an error for TTL %q", ttl)
+				}
 			}
 
-			// Limit to 33
-			maxAckPending := 33
+			// Mix messages with their own TTL and ones that follow MaxAge.
+			sendMsg("250ms")
+			sendMsg("")
+			sendMsg("1")
+			sendMsg("")
 
-			o, err := mset.AddConsumer(&server.ConsumerConfig{
-				Durable:        "d22",
-				DeliverSubject: nats.NewInbox(),
-				AckPolicy:      server.AckExplicit,
-				MaxAckPending:  maxAckPending,
+			if state := mset.State(); state.Msgs != 4 {
+				t.Fatalf("Expected 4 msgs, got %d", state.Msgs)
+			}
+
+			checkFor(t, time.Second, 50*time.Millisecond, func() error {
+				if state := mset.State(); state.Msgs != 3 || state.FirstSeq != 2 {
+					return fmt.Errorf("Expected 3 msgs starting at 2, got %+v", state)
+				}
+				return nil
 			})
-			if err != nil {
+			checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+				if state := mset.State(); state.Msgs != 2 {
+					return fmt.Errorf("Expected 2 msgs, got %d", state.Msgs)
+				}
+				return nil
+			})
+			if _, err := mset.GetMsg(3); err == nil {
+				t.Fatalf("Expected msg 3 to have expired")
+			}
+
+			// Account usage should reflect the expired messages.
+			state := mset.State()
+			usage := acc.JetStreamUsage()
+			used := usage.Memory
+			if c.mconfig.Storage == server.FileStorage {
+				used = usage.Store
+			}
+			if used != state.Bytes {
+				t.Fatalf("Expected usage of %d, got %d", state.Bytes, used)
+			}
+		})
+	}
+}
+
+// Reader that invokes a callback before its first read.
+type callbackReader struct {
+	io.Reader
+	cb func()
+}
+
+func (r *callbackReader) Read(p []byte) (int, error) {
+	if r.cb != nil {
+		r.cb()
+		r.cb = nil
+	}
+	return r.Reader.Read(p)
+}
+
+func TestJetStreamActiveSnapshots(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	acc := s.GlobalAccount()
+	mset, err := acc.AddStream(&server.StreamConfig{Name: "SNAP", Storage: server.FileStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	for i := 0; i < 100; i++ {
+		sendStreamMsg(t, nc, "SNAP", "Hello World")
+	}
+
+	if snaps := acc.ActiveSnapshots(); len(snaps) != 0 {
+		t.Fatalf("Expected no active snapshots, got %+v", snaps)
+	}
+	if err := acc.CancelSnapshot("bad"); err != server.ErrJetStreamSnapshotNotFound {
+		t.Fatalf("Expected a not found error, got %v", err)
+	}
+
+	sr, err := mset.Snapshot(5*time.Second, false, true)
+	if err != nil {
+		t.Fatalf("Error getting snapshot: %v", err)
+	}
+	snaps := acc.ActiveSnapshots()
+	if len(snaps) != 1 || snaps[0].Stream != "SNAP" || snaps[0].Restore {
+		t.Fatalf("Expected one active snapshot for our stream, got %+v", snaps)
+	}
+	var buf [64]byte
+	if _, err := io.ReadFull(sr.Reader, buf[:]); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if snaps = acc.ActiveSnapshots(); len(snaps) != 1 || snaps[0].Bytes != 64 {
+		t.Fatalf("Expected 64 bytes read, got %+v", snaps)
+	}
+
+	// Cancel the snapshot and make sure it is interrupted.
+	if err := acc.CancelSnapshot(snaps[0].ID); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := sr.Reader.Read(buf[:]); err != server.ErrJetStreamSnapshotCanceled {
+		t.Fatalf("Expected a canceled error, got %v", err)
+	}
+	if snaps := acc.ActiveSnapshots(); len(snaps) != 0 {
+		t.Fatalf("Expected no active snapshots, got %+v", snaps)
+	}
+
+	// The store should release the snapshot so we can take a full one.
+	var snapshot []byte
+	checkFor(t, time.Second, 50*time.Millisecond, func() error {
+		sr, err := mset.Snapshot(5*time.Second, false, true)
+		if err != nil {
+			return err
+		}
+		snapshot, err = ioutil.ReadAll(sr.Reader)
+		return err
+	})
+	mset.Delete()
+
+	// Now cancel a restore once it has started.
+	r := &callbackReader{Reader: bytes.NewReader(snapshot)}
+	r.cb = func() {
+		snaps := acc.ActiveSnapshots()
+		if len(snaps) != 1 || !snaps[0].Restore {
+			t.Fatalf("Expected one active restore, got %+v", snaps)
+		}
+		acc.CancelSnapshot(snaps[0].ID)
+	}
+	if _, err := acc.RestoreStream("SNAP", r); err != server.ErrJetStreamSnapshotCanceled {
+		t.Fatalf("Expected a canceled error, got %v", err)
+	}
+	if _, err := acc.LookupStream("SNAP"); err == nil {
+		t.Fatalf("Expected the stream to not be restored")
+	}
+	if snaps := acc.ActiveSnapshots(); len(snaps) != 0 {
+		t.Fatalf("Expected no active snapshots, got %+v", snaps)
+	}
+}
+
+func TestJetStreamTemplateInfos(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	acc := s.GlobalAccount()
+	if infos := acc.TemplateInfos(); len(infos) != 0 {
+		t.Fatalf("Expected no templates, got %d", len(infos))
+	}
+
+	for _, name := range []string{"kv", "audit"} {
+		template := &server.StreamTemplateConfig{
+			Name:       name,
+			Config:     &server.StreamConfig{Subjects: []string{name + ".*"}, Storage: server.MemoryStorage},
+			MaxStreams: 4,
+		}
+		if _, err := acc.AddStreamTemplate(template); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+	sendStreamMsg(t, nc, "kv.a", "Hello World")
+	sendStreamMsg(t, nc, "kv.b", "Hello World")
+
+	infos := acc.TemplateInfos()
+	if len(infos) != 2 {
+		t.Fatalf("Expected 2 templates, got %d", len(infos))
+	}
+	if infos[0].Config.Name != "audit" || len(infos[0].Streams) != 0 {
+		t.Fatalf("Unexpected info for audit: %+v", infos[0])
+	}
+	if infos[1].Config.Name != "kv" || len(infos[1].Streams) != 2 || infos[1].Config.MaxStreams != 4 {
+		t.Fatalf("Unexpected info for kv: %+v", infos[1])
+	}
+
+	// Returned infos should be copies.
+	infos[1].Streams[0] = "bad"
+	infos[1].Config.MaxStreams = 1
+	if info := acc.TemplateInfos()[1]; info.Streams[0] == "bad" || info.Config.MaxStreams != 4 {
+		t.Fatalf("Expected template info to be a copy, got %+v", info)
+	}
+}
+
+func TestJetStreamFindConsumer(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	acc := s.GlobalAccount()
+	foo, err := acc.AddStream(&server.StreamConfig{Name: "FOO", Storage: server.MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	bar, err := acc.AddStream(&server.StreamConfig{Name: "BAR", Storage: server.MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+
+	if _, _, err := acc.FindConsumer("dlc"); err != server.ErrJetStreamConsumerNotFound {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+
+	o, err := bar.AddConsumer(&server.ConsumerConfig{Durable: "dlc", AckPolicy: server.AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mset, obs, err := acc.FindConsumer("dlc")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if mset != bar || obs != o {
+		t.Fatalf("Expected to find consumer on stream BAR, got %q", mset.Name())
+	}
+
+	// Ephemerals are not found by name.
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+	sub, _ := nc.SubscribeSync("d")
+	defer sub.Unsubscribe()
+	nc.Flush()
+
+	eo, err := foo.AddConsumer(&server.ConsumerConfig{DeliverSubject: "d", AckPolicy: server.AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, _, err := acc.FindConsumer(eo.Name()); err != server.ErrJetStreamConsumerNotFound {
+		t.Fatalf("Expected not found error, got %v", err)
+	}
+
+	// The same durable on two streams is ambiguous.
+	if _, err := foo.AddConsumer(&server.ConsumerConfig{Durable: "dlc", AckPolicy: server.AckExplicit}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, _, err := acc.FindConsumer("dlc"); err == nil || !strings.Contains(err.Error(), "ambiguous") {
+		t.Fatalf("Expected an ambiguous error, got %v", err)
+	}
+}
+
+func TestJetStreamDisableReservations(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Disabled=%v", disabled), func(t *testing.T) {
+			s := RunRandClientPortServer()
+			defer s.Shutdown()
+
+			foo, _ := s.LookupOrRegisterAccount("FOO")
+			bar, _ := s.LookupOrRegisterAccount("BAR")
+			storeDir, _ := ioutil.TempDir(os.TempDir(), "jstests-storedir-")
+			defer os.RemoveAll(storeDir)
+			config := &server.JetStreamConfig{MaxMemory: 64 * 1024, MaxStore: 64 * 1024, StoreDir: storeDir, DisableReservations: disabled}
+			if err := s.EnableJetStream(config); err != nil {
 				t.Fatalf("Expected no error, got %v", err)
 			}
-			defer o.Delete()
 
-			sub, _ := nc.SubscribeSync(o.Info().Config.DeliverSubject)
-			defer sub.Unsubscribe()
+			// Account limits that add up past the server's limits.
+			limits := &server.JetStreamAccountLimits{MaxMemory: 32 * 1024, MaxStore: 32 * 1024, MaxStreams: -1, MaxConsumers: -1}
+			if err := foo.EnableJetStream(limits); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			blimits := &server.JetStreamAccountLimits{MaxMemory: 40 * 1024, MaxStore: 40 * 1024, MaxStreams: -1, MaxConsumers: -1}
+			if err := bar.EnableJetStream(blimits); (err == nil) != disabled {
+				t.Fatalf("Unexpected result enabling second account: %v", err)
+			}
 
-			checkSubPending := func(numExpected int) {
-				t.Helper()
-				checkFor(t, time.Second, 20*time.Millisecond, func() error {
-					if nmsgs, _, _ := sub.Pending(); err != nil || nmsgs != numExpected {
-						return fmt.Errorf("Did not receive correct number of messages: %d vs %d", nmsgs, numExpected)
-					}
-					return nil
-				})
+			// Streams whose MaxBytes add up past the account's limit.
+			if _, err := foo.AddStream(&server.StreamConfig{Name: "S1", MaxBytes: 24 * 1024}); err != nil {
+				t.Fatalf("Unexpected error adding stream: %v", err)
+			}
+			if _, err := foo.AddStream(&server.StreamConfig{Name: "S2", MaxBytes: 24 * 1024}); (err == nil) != disabled {
+				t.Fatalf("Unexpected result adding second stream: %v", err)
 			}
 
-			checkSubPending(maxAckPending)
-			// We hit the limit, double check we stayed there.
-			if nmsgs, _, _ := sub.Pending(); err != nil || nmsgs != maxAckPending {
-				t.Fatalf("Too many messages received: %d vs %d", nmsgs, maxAckPending)
+			stats := foo.JetStreamUsageWithReserved()
+			if disabled && (stats.MemReserved != 0 || stats.StoreReserved != 0) {
+				t.Fatalf("Expected nothing reserved, got %+v", stats)
 			}
+		})
+	}
+}
+
+func TestJetStreamCopyStreamConfig(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	acc := s.GlobalAccount()
+	scfg := &server.StreamConfig{
+		Name:       "BLUE",
+		Subjects:   []string{"blue.*"},
+		Storage:    server.FileStorage,
+		MaxMsgs:    100,
+		MaxAge:     time.Hour,
+		Duplicates: time.Minute,
+		Retention:  server.WorkQueuePolicy,
+	}
+	mset, err := acc.AddStream(scfg)
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+	sendStreamMsg(t, nc, "blue.1", "Hello World")
+
+	if _, err := acc.CopyStreamConfig("RED", "GREEN", nil); err != server.ErrJetStreamStreamNotFound {
+		t.Fatalf("Expected stream not found error, got %v", err)
+	}
+	// Overlapping subjects are caught by the normal checks.
+	if _, err := acc.CopyStreamConfig("BLUE", "GREEN", []string{"blue.*"}); err == nil {
+		t.Fatalf("Expected an error for overlapping subjects")
+	}
+
+	green, err := acc.CopyStreamConfig("BLUE", "GREEN", []string{"green.*"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := mset.Config()
+	expected.Name, expected.Subjects = "GREEN", []string{"green.*"}
+	if cfg := green.Config(); !reflect.DeepEqual(cfg, expected) {
+		t.Fatalf("Expected config %+v, got %+v", expected, cfg)
+	}
+	if state := green.State(); state.Msgs != 0 {
+		t.Fatalf("Expected new stream to be empty, got %d msgs", state.Msgs)
+	}
+	if state := mset.State(); state.Msgs != 1 {
+		t.Fatalf("Expected source stream to be untouched, got %d msgs", state.Msgs)
+	}
+}
+
+func TestJetStreamTemplateStats(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	acc := s.GlobalAccount()
+	template := &server.StreamTemplateConfig{
+		Name:       "kv",
+		Config:     &server.StreamConfig{Subjects: []string{"kv.*"}, Storage: server.MemoryStorage},
+		MaxStreams: 2,
+	}
+	if _, err := acc.AddStreamTemplate(template); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// A stream already owning a subject will make the template's creation fail.
+	if _, err := acc.AddStream(&server.StreamConfig{Name: "OTHER", Subjects: []string{"kv.d"}, Storage: server.MemoryStorage}); err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	for _, subj := range []string{"kv.a", "kv.d", "kv.b", "kv.c"} {
+		nc.Publish(subj, []byte("Hello World"))
+		nc.Flush()
+	}
+
+	expected := server.StreamTemplateStats{Created: 2, HitLimit: 1, Failed: 1}
+	checkFor(t, time.Second, 50*time.Millisecond, func() error {
+		infos := acc.TemplateInfos()
+		if len(infos) != 1 {
+			return fmt.Errorf("Expected 1 template, got %d", len(infos))
+		}
+		if infos[0].Stats != expected {
+			return fmt.Errorf("Expected stats %+v, got %+v", expected, infos[0].Stats)
+		}
+		return nil
+	})
+}
 
-			// Now ack them all.
-			for i := 0; i < maxAckPending; i++ {
-				m, err := sub.NextMsg(time.Second)
-				if err != nil {
-					t.Fatalf("Error receiving message %d: %v", i, err)
-				}
-				m.Respond(nil)
-			}
-			checkSubPending(maxAckPending)
+func TestJetStreamAccountAdvisoryFeed(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
 
-			o.Stop()
-			mset.Purge()
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
 
-			// Now test a consumer that is live while we publish messages to the stream.
-			o, err = mset.AddConsumer(&server.ConsumerConfig{
-				Durable:        "d33",
-				DeliverSubject: nats.NewInbox(),
-				AckPolicy:      server.AckExplicit,
-				MaxAckPending:  maxAckPending,
-			})
-			if err != nil {
-				t.Fatalf("Expected no error, got %v", err)
-			}
-			defer o.Delete()
+	acc := s.GlobalAccount()
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+	sub, _ := nc.SubscribeSync(server.JSAdvisoryAccountPre + "." + acc.Name + ".>")
+	// Advisory subscribers should only see each advisory once.
+	asub, _ := nc.SubscribeSync(server.JSAdvisoryPrefix + ".>")
+	nc.Flush()
 
-			sub, _ = nc.SubscribeSync(o.Info().Config.DeliverSubject)
-			defer sub.Unsubscribe()
-			nc.Flush()
+	mset, err := acc.AddStream(&server.StreamConfig{Name: "ORDERS", Storage: server.MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	o, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "D", AckPolicy: server.AckExplicit})
+	if err != nil {
+		t.Fatalf("Unexpected error adding consumer: %v", err)
+	}
+	o.Delete()
+	mset.Delete()
 
-			checkSubPending(0)
+	expected := []struct {
+		subject, schema string
+	}{
+		{server.JSAdvisoryStreamCreatedPre + ".ORDERS", server.JSStreamActionAdvisoryType},
+		{server.JSAdvisoryConsumerCreatedPre + ".ORDERS.D", server.JSConsumerActionAdvisoryType},
+		{server.JSAdvisoryConsumerDeletedPre + ".ORDERS.D", server.JSConsumerActionAdvisoryType},
+		{server.JSAdvisoryStreamDeletedPre + ".ORDERS", server.JSStreamActionAdvisoryType},
+	}
+	for _, e := range expected {
+		m, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error waiting for %q: %v", e.subject, err)
+		}
+		var adv server.JSAccountAdvisory
+		if err := json.Unmarshal(m.Data, &adv); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if want := server.JSAdvisoryAccountPre + "." + acc.Name + strings.TrimPrefix(e.subject, server.JSAdvisoryPrefix); m.Subject != want {
+			t.Fatalf("Expected subject %q, got %q", want, m.Subject)
+		}
+		if adv.Type != server.JSAccountAdvisoryType || adv.Schema != e.schema || adv.Subject != e.subject || adv.Account != acc.Name {
+			t.Fatalf("Unexpected advisory: %+v", adv)
+		}
+		if adv.Time.IsZero() || len(adv.Advisory) == 0 {
+			t.Fatalf("Expected a timestamp and the original advisory, got %+v", adv)
+		}
+	}
 
-			// Now stream more then maxAckPending.
-			for i := 0; i < toSend; i++ {
-				sendStreamMsg(t, nc, "foo.baz", fmt.Sprintf("MSG: %d", i+1))
-			}
-			checkSubPending(maxAckPending)
-			// We hit the limit, double check we stayed there.
-			if nmsgs, _, _ := sub.Pending(); err != nil || nmsgs != maxAckPending {
-				t.Fatalf("Too many messages received: %d vs %d", nmsgs, maxAckPending)
-			}
-		})
+	// Nothing from the feed, and no advisory more than once.
+	seen := make(map[string]int)
+	for {
+		m, err := asub.NextMsg(250 * time.Millisecond)
+		if err != nil {
+			break
+		}
+		if seen[m.Subject]++; seen[m.Subject] > 1 || strings.HasPrefix(m.Subject, server.JSAdvisoryAccountPre+".") {
+			t.Fatalf("Unexpected advisory on %q", m.Subject)
+		}
+	}
+	if len(seen) == 0 {
+		t.Fatalf("Expected advisories")
 	}
 }
 
-func TestJetStreamPullConsumerMaxAckPending(t *testing.T) {
-	cases := []struct {
-		name    string
-		mconfig *server.StreamConfig
-	}{
-		{"MemoryStore", &server.StreamConfig{
-			Name:     "MY_STREAM",
-			Storage:  server.MemoryStorage,
-			Subjects: []string{"foo.*"},
-		}},
-		{"FileStore", &server.StreamConfig{
-			Name:     "MY_STREAM",
-			Storage:  server.FileStorage,
-			Subjects: []string{"foo.*"},
-		}},
+func TestJetStreamPersistedInfo(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
 	}
-	for _, c := range cases {
-		t.Run(c.name, func(t *testing.T) {
-			s := RunBasicJetStreamServer()
-			defer s.Shutdown()
 
-			if config := s.JetStreamConfig(); config != nil {
-				defer os.RemoveAll(config.StoreDir)
-			}
+	bar, _ := s.LookupOrRegisterAccount("BAR")
+	if _, err := bar.JetStreamPersistedInfo(); err == nil {
+		t.Fatalf("Expected an error for an account without data")
+	}
 
-			mset, err := s.GlobalAccount().AddStream(c.mconfig)
-			if err != nil {
-				t.Fatalf("Unexpected error adding stream: %v", err)
-			}
-			defer mset.Delete()
+	acc := s.GlobalAccount()
+	for _, name := range []string{"ORDERS", "INVOICES"} {
+		if _, err := acc.AddStream(&server.StreamConfig{Name: name, Storage: server.FileStorage}); err != nil {
+			t.Fatalf("Unexpected error adding stream: %v", err)
+		}
+	}
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+	for i := 0; i < 10; i++ {
+		sendStreamMsg(t, nc, "ORDERS", "Hello World")
+	}
+	limits := &server.JetStreamAccountLimits{MaxMemory: 1024 * 1024, MaxStore: 8 * 1024 * 1024, MaxStreams: 10, MaxConsumers: -1}
+	if err := acc.UpdateJetStreamLimits(limits); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := acc.DisableJetStream(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
 
-			nc := clientConnectToServer(t, s)
-			defer nc.Close()
+	info, err := acc.JetStreamPersistedInfo()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(info.Streams, []string{"INVOICES", "ORDERS"}) {
+		t.Fatalf("Expected both streams to be reported, got %v", info.Streams)
+	}
+	if info.Store < 10*uint64(len("Hello World")) || info.Templates != 0 {
+		t.Fatalf("Unexpected info: %+v", info)
+	}
+	if info.Limits == nil || *info.Limits != *limits {
+		t.Fatalf("Expected persisted limits %+v, got %+v", limits, info.Limits)
+	}
+}
 
-			// Queue up 100 messages.
-			toSend := 100
-			for i := 0; i < toSend; i++ {
-				sendStreamMsg(t, nc, "foo.bar", fmt.Sprintf("MSG: %d", i+1))
-			}
+func TestJetStreamMaxTemplates(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
 
-			// Limit to 33
-			maxAckPending := 33
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
 
-			o, err := mset.AddConsumer(&server.ConsumerConfig{
-				Durable:       "d22",
-				AckPolicy:     server.AckExplicit,
-				MaxAckPending: maxAckPending,
-			})
-			if err != nil {
-				t.Fatalf("Expected no error, got %v", err)
-			}
-			defer o.Delete()
+	acc := s.GlobalAccount()
+	limits, _ := acc.JetStreamLimits()
+	limits.MaxTemplates = 3
+	if err := acc.UpdateJetStreamLimits(&limits); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
 
-			getSubj := o.RequestNextMsgSubject()
+	addTemplate := func(i int) error {
+		_, err := acc.AddStreamTemplate(&server.StreamTemplateConfig{
+			Name:       fmt.Sprintf("T%d", i),
+			Config:     &server.StreamConfig{Subjects: []string{fmt.Sprintf("t%d.*", i)}, Storage: server.MemoryStorage},
+			MaxStreams: 10,
+		})
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		if err := addTemplate(i); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if err := addTemplate(3); err != server.ErrJetStreamMaxTemplatesReached {
+		t.Fatalf("Expected %v, got %v", server.ErrJetStreamMaxTemplatesReached, err)
+	}
+	// Making room allows another one.
+	if err := acc.DeleteStreamTemplate("T0"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := addTemplate(3); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
 
-			var toAck []*nats.Msg
+func TestJetStreamRenameStreamTemplate(t *testing.T) {
+	storeDir, _ := ioutil.TempDir(os.TempDir(), "jstests-storedir-")
+	defer os.RemoveAll(storeDir)
+	jsconfig := &server.JetStreamConfig{MaxMemory: 64 * 1024 * 1024, MaxStore: 64 * 1024 * 1024, StoreDir: storeDir}
 
-			for i := 0; i < maxAckPending; i++ {
-				if m, err := nc.Request(getSubj, nil, time.Second); err != nil {
-					t.Fatalf("Unexpected error: %v", err)
-				} else {
-					toAck = append(toAck, m)
-				}
-			}
-			// This should fail.. But we do not want to queue up our request.
-			req := &server.JSApiConsumerGetNextRequest{Batch: 1, NoWait: true}
-			jreq, _ := json.Marshal(req)
-			m, err := nc.Request(getSubj, jreq, time.Second)
-			if err != nil {
-				t.Fatalf("Unexpected error: %v", err)
-			}
-			if m.Header.Get("Status") != "409" {
-				t.Fatalf("Expected a 409 status code, got %q", m.Header.Get("Status"))
-			}
+	s := RunRandClientPortServer()
+	defer s.Shutdown()
+	if err := s.EnableJetStream(jsconfig); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
 
-			// Now ack them all.
-			for _, m := range toAck {
-				m.Respond(nil)
-			}
+	acc := s.GlobalAccount()
+	for _, tc := range []*server.StreamTemplateConfig{
+		{Name: "kv", Config: &server.StreamConfig{Subjects: []string{"kv.*"}, Storage: server.FileStorage}, MaxStreams: 10},
+		{Name: "other", Config: &server.StreamConfig{Subjects: []string{"other.*"}, Storage: server.FileStorage}, MaxStreams: 10},
+	} {
+		if _, err := acc.AddStreamTemplate(tc); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
 
-			// Now do batch above the max.
-			sub, _ := nc.SubscribeSync(nats.NewInbox())
-			defer sub.Unsubscribe()
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+	sendStreamMsg(t, nc, "kv.a", "Hello World")
+	sendStreamMsg(t, nc, "kv.b", "Hello World")
 
-			checkSubPending := func(numExpected int) {
-				t.Helper()
-				checkFor(t, time.Second, 10*time.Millisecond, func() error {
-					if nmsgs, _, _ := sub.Pending(); err != nil || nmsgs != numExpected {
-						return fmt.Errorf("Did not receive correct number of messages: %d vs %d", nmsgs, numExpected)
-					}
-					return nil
-				})
-			}
+	if err := acc.RenameStreamTemplate("kv", "other"); err == nil {
+		t.Fatalf("Expected an error renaming to an existing template")
+	}
+	if err := acc.RenameStreamTemplate("kv", strings.Repeat("A", server.JSMaxNameLen+1)); err == nil {
+		t.Fatalf("Expected an error for a name that is too long")
+	}
+	if err := acc.RenameStreamTemplate("missing", "kv2"); err == nil {
+		t.Fatalf("Expected an error for a missing template")
+	}
+	if err := acc.RenameStreamTemplate("kv", "kv2"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
 
-			req = &server.JSApiConsumerGetNextRequest{Batch: toSend}
-			jreq, _ = json.Marshal(req)
-			nc.PublishRequest(getSubj, sub.Subject, jreq)
+	if _, err := acc.LookupStreamTemplate("kv"); err == nil {
+		t.Fatalf("Expected the old name to be gone")
+	}
+	if _, err := acc.LookupStreamTemplate("kv2"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Spawned streams survive and belong to the renamed template.
+	for _, name := range []string{"kv_a", "kv_b"} {
+		mset, err := acc.LookupStream(name)
+		if err != nil {
+			t.Fatalf("Expected stream %q to survive the rename: %v", name, err)
+		}
+		if cfg := mset.Config(); cfg.Template != "kv2" {
+			t.Fatalf("Expected stream %q to refer to the new template, got %q", name, cfg.Template)
+		}
+		if state := mset.State(); state.Msgs != 1 {
+			t.Fatalf("Expected 1 msg in %q, got %d", name, state.Msgs)
+		}
+	}
+	// Subscriptions are intact and new streams use the new name.
+	sendStreamMsg(t, nc, "kv.c", "Hello World")
+	mset, err := acc.LookupStream("kv_c")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg := mset.Config(); cfg.Template != "kv2" {
+		t.Fatalf("Expected the new stream to refer to the new template, got %q", cfg.Template)
+	}
+	if infos := acc.TemplateInfos(); len(infos) != 2 || infos[0].Config.Name != "kv2" || len(infos[0].Streams) != 3 {
+		t.Fatalf("Expected the renamed template to own 3 streams, got %+v", infos[0])
+	}
+	nc.Close()
 
-			checkSubPending(maxAckPending)
-			// We hit the limit, double check we stayed there.
-			if nmsgs, _, _ := sub.Pending(); err != nil || nmsgs != maxAckPending {
-				t.Fatalf("Too many messages received: %d vs %d", nmsgs, maxAckPending)
-			}
-		})
+	// Everything comes back under the new name after a restart.
+	s.Shutdown()
+	s = RunRandClientPortServer()
+	defer s.Shutdown()
+	if err := s.EnableJetStream(jsconfig); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	acc = s.GlobalAccount()
+	if infos := acc.TemplateInfos(); len(infos) != 2 || infos[0].Config.Name != "kv2" || len(infos[0].Streams) != 3 {
+		t.Fatalf("Expected the renamed template to be recovered with 3 streams, got %+v", infos)
 	}
 }
 
-func TestJetStreamPullConsumerMaxAckPendingRedeliveries(t *testing.T) {
-	cases := []struct {
-		name    string
-		mconfig *server.StreamConfig
-	}{
-		{"MemoryStore", &server.StreamConfig{
-			Name:     "MY_STREAM",
-			Storage:  server.MemoryStorage,
-			Subjects: []string{"foo.*"},
-		}},
-		{"FileStore", &server.StreamConfig{
-			Name:     "MY_STREAM",
-			Storage:  server.FileStorage,
-			Subjects: []string{"foo.*"},
-		}},
+func TestJetStreamUpdateStreamTemplate(t *testing.T) {
+	storeDir, _ := ioutil.TempDir(os.TempDir(), "jstests-storedir-")
+	defer os.RemoveAll(storeDir)
+	jsconfig := &server.JetStreamConfig{MaxMemory: 64 * 1024 * 1024, MaxStore: 64 * 1024 * 1024, StoreDir: storeDir}
+
+	s := RunRandClientPortServer()
+	defer s.Shutdown()
+	if err := s.EnableJetStream(jsconfig); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
-	for _, c := range cases {
-		t.Run(c.name, func(t *testing.T) {
-			s := RunBasicJetStreamServer()
-			defer s.Shutdown()
 
-			if config := s.JetStreamConfig(); config != nil {
-				defer os.RemoveAll(config.StoreDir)
-			}
+	acc := s.GlobalAccount()
+	for _, tc := range []*server.StreamTemplateConfig{
+		{Name: "kv", Config: &server.StreamConfig{Subjects: []string{"kv.*"}, Storage: server.FileStorage}, MaxStreams: 1},
+		{Name: "other", Config: &server.StreamConfig{Subjects: []string{"other.*"}, Storage: server.FileStorage}, MaxStreams: 10},
+	} {
+		if _, err := acc.AddStreamTemplate(tc); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
 
-			mset, err := s.GlobalAccount().AddStream(c.mconfig)
-			if err != nil {
-				t.Fatalf("Unexpected error adding stream: %v", err)
-			}
-			defer mset.Delete()
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+	sendStreamMsg(t, nc, "kv.a", "Hello World")
+	nc.Request("kv.b", []byte("Hello World"), 100*time.Millisecond)
+	if _, err := acc.LookupStream("kv_b"); err == nil {
+		t.Fatalf("Expected no stream past MaxStreams")
+	}
 
-			nc := clientConnectToServer(t, s)
-			defer nc.Close()
+	if _, err := acc.UpdateStreamTemplate(&server.StreamTemplateConfig{
+		Name: "missing", Config: &server.StreamConfig{Subjects: []string{"missing.*"}}, MaxStreams: 10,
+	}); err == nil {
+		t.Fatalf("Expected an error for a missing template")
+	}
+	if _, err := acc.UpdateStreamTemplate(&server.StreamTemplateConfig{
+		Name: "kv", Config: &server.StreamConfig{Subjects: []string{"other.a"}}, MaxStreams: 10,
+	}); err == nil || !strings.Contains(err.Error(), "overlaps") {
+		t.Fatalf("Expected an overlap error, got %v", err)
+	}
 
-			// Queue up 10 messages.
-			toSend := 10
-			for i := 0; i < toSend; i++ {
-				sendStreamMsg(t, nc, "foo.bar", fmt.Sprintf("MSG: %d", i+1))
-			}
+	// Raising MaxStreams allows more streams and keeps the existing one.
+	if _, err := acc.UpdateStreamTemplate(&server.StreamTemplateConfig{
+		Name: "kv", Config: &server.StreamConfig{Subjects: []string{"kv.*"}, Storage: server.FileStorage, MaxMsgs: 5}, MaxStreams: 10,
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	sendStreamMsg(t, nc, "kv.b", "Hello World")
+	mset, err := acc.LookupStream("kv_b")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg := mset.Config(); cfg.MaxMsgs != 5 {
+		t.Fatalf("Expected the new stream to use the updated config, got MaxMsgs %d", cfg.MaxMsgs)
+	}
+	if mset, err := acc.LookupStream("kv_a"); err != nil || mset.State().Msgs != 1 {
+		t.Fatalf("Expected the existing stream to be kept: %v", err)
+	}
 
-			// Limit to 1
-			maxAckPending := 1
-			ackWait := 20 * time.Millisecond
-			expSeq := uint64(4)
+	// Changing the subjects moves the template subscriptions.
+	if _, err := acc.UpdateStreamTemplate(&server.StreamTemplateConfig{
+		Name: "kv", Config: &server.StreamConfig{Subjects: []string{"kv2.*"}, Storage: server.FileStorage}, MaxStreams: 10,
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	nc.Request("kv.c", []byte("Hello World"), 100*time.Millisecond)
+	if _, err := acc.LookupStream("kv_c"); err == nil {
+		t.Fatalf("Expected no stream for the old subjects")
+	}
+	sendStreamMsg(t, nc, "kv2.c", "Hello World")
+	if _, err := acc.LookupStream("kv2_c"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	nc.Close()
 
-			o, err := mset.AddConsumer(&server.ConsumerConfig{
-				Durable:       "d22",
-				DeliverPolicy: server.DeliverByStartSequence,
-				OptStartSeq:   expSeq,
-				AckPolicy:     server.AckExplicit,
-				AckWait:       ackWait,
-				MaxAckPending: maxAckPending,
-			})
-			if err != nil {
-				t.Fatalf("Expected no error, got %v", err)
-			}
-			defer o.Delete()
+	// The updated config is recovered after a restart.
+	s.Shutdown()
+	s = RunRandClientPortServer()
+	defer s.Shutdown()
+	if err := s.EnableJetStream(jsconfig); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tmpl, err := s.GlobalAccount().LookupStreamTemplate("kv")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if tmpl.MaxStreams != 10 || len(tmpl.Config.Subjects) != 1 || tmpl.Config.Subjects[0] != "kv2.*" {
+		t.Fatalf("Expected the updated config to be recovered, got %+v", tmpl.StreamTemplateConfig)
+	}
+}
 
-			getSubj := o.RequestNextMsgSubject()
-			delivery := uint64(1)
+func TestJetStreamResolveStorageType(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
 
-			getNext := func() {
-				t.Helper()
-				m, err := nc.Request(getSubj, nil, time.Second)
-				if err != nil {
-					t.Fatalf("Unexpected error: %v", err)
-				}
-				sseq, dseq, dcount, _, pending := o.ReplyInfo(m.Reply)
-				if sseq != expSeq {
-					t.Fatalf("Expected stream sequence of %d, got %d", expSeq, sseq)
-				}
-				if dseq != delivery {
-					t.Fatalf("Expected consumer sequence of %d, got %d", delivery, dseq)
-				}
-				if dcount != delivery {
-					t.Fatalf("Expected delivery count of %d, got %d", delivery, dcount)
-				}
-				if pending != uint64(toSend)-expSeq {
-					t.Fatalf("Expected pending to be %d, got %d", uint64(toSend)-expSeq, pending)
-				}
-				delivery++
-			}
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
 
-			getNext()
-			getNext()
-			getNext()
-			getNext()
-			getNext()
-		})
+	acc := s.GlobalAccount()
+	if st := acc.ResolveStorageType(nil); st != server.FileStorage {
+		t.Fatalf("Expected file storage for no config, got %v", st)
+	}
+	if st := acc.ResolveStorageType(&server.StreamConfig{Storage: server.MemoryStorage}); st != server.MemoryStorage {
+		t.Fatalf("Expected memory storage to be kept, got %v", st)
+	}
+	cfg := &server.StreamConfig{Name: "S"}
+	st := acc.ResolveStorageType(cfg)
+	if st != server.FileStorage || cfg.Storage != 0 {
+		t.Fatalf("Expected file storage without changing the config, got %v and %v", st, cfg.Storage)
+	}
+	mset, err := acc.AddStream(cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	if got := mset.Config().Storage; got != st {
+		t.Fatalf("Expected the stream to use %v, got %v", st, got)
 	}
 }
 
-func TestJetStreamDeliveryAfterServerRestart(t *testing.T) {
-	opts := DefaultTestOptions
-	opts.Port = -1
-	opts.JetStream = true
-	s := RunServer(&opts)
+func TestJetStreamMaxPullBatch(t *testing.T) {
+	s := RunBasicJetStreamServer()
 	defer s.Shutdown()
 
 	if config := s.JetStreamConfig(); config != nil {
 		defer os.RemoveAll(config.StoreDir)
 	}
 
-	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{
-		Name:      "MY_STREAM",
-		Storage:   server.FileStorage,
-		Subjects:  []string{"foo.>"},
-		Retention: server.InterestPolicy,
-	})
+	acc := s.GlobalAccount()
+	limits, _ := acc.JetStreamLimits()
+	limits.MaxPullBatch = 5
+	if err := acc.UpdateJetStreamLimits(&limits); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	mset, err := acc.AddStream(&server.StreamConfig{Name: "PB", Storage: server.MemoryStorage})
 	if err != nil {
 		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
@@ -9947,452 +13070,937 @@ func TestJetStreamDeliveryAfterServerRestart(t *testing.T) {
 	nc := clientConnectToServer(t, s)
 	defer nc.Close()
 
-	inbox := nats.NewInbox()
-	o, err := mset.AddConsumer(&server.ConsumerConfig{
-		Durable:        "dur",
-		DeliverSubject: inbox,
-		DeliverPolicy:  server.DeliverNew,
-		AckPolicy:      server.AckExplicit,
-	})
+	for i := 0; i < 20; i++ {
+		sendStreamMsg(t, nc, "PB", "Hello World!")
+	}
+
+	o, err := mset.AddConsumer(&server.ConsumerConfig{Durable: "d", AckPolicy: server.AckExplicit})
 	if err != nil {
 		t.Fatalf("Expected no error, got %v", err)
 	}
 	defer o.Delete()
+	getSubj := o.RequestNextMsgSubject()
 
-	sub, err := nc.SubscribeSync(inbox)
+	// Oversized requests are clamped by default.
+	sub, _ := nc.SubscribeSync(nats.NewInbox())
+	defer sub.Unsubscribe()
+	jreq, _ := json.Marshal(&server.JSApiConsumerGetNextRequest{Batch: 20})
+	nc.PublishRequest(getSubj, sub.Subject, jreq)
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		if nmsgs, _, _ := sub.Pending(); nmsgs != 5 {
+			return fmt.Errorf("Expected 5 messages, got %d", nmsgs)
+		}
+		return nil
+	})
+	time.Sleep(50 * time.Millisecond)
+	if nmsgs, _, _ := sub.Pending(); nmsgs != 5 {
+		t.Fatalf("Expected batch to be clamped to 5, got %d", nmsgs)
+	}
+
+	// Or rejected if configured.
+	limits.RejectOversizedPull = true
+	if err := acc.UpdateJetStreamLimits(&limits); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	m, err := nc.Request(getSubj, jreq, time.Second)
 	if err != nil {
-		t.Fatalf("Error on subscribe: %v", err)
+		t.Fatalf("Unexpected error: %v", err)
 	}
-	nc.Flush()
+	if m.Header.Get("Status") != "409" {
+		t.Fatalf("Expected a 409 status code, got %q", m.Header.Get("Status"))
+	}
+	// Requests within the limit are fine.
+	jreq, _ = json.Marshal(&server.JSApiConsumerGetNextRequest{Batch: 1})
+	if m, err := nc.Request(getSubj, jreq, time.Second); err != nil || m.Header.Get("Status") != "" {
+		t.Fatalf("Expected a message, got %v", err)
+	}
+}
 
-	// Send 1 message
-	sendStreamMsg(t, nc, "foo.bar", "msg1")
+func TestJetStreamServerInfo(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
 
-	// Make sure we receive it and ack it.
-	msg, err := sub.NextMsg(250 * time.Millisecond)
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	ji := s.JetStreamInfo()
+	if ji == nil {
+		t.Fatalf("Expected JetStream info")
+	}
+	if ji.APILevel != server.JetStreamAPILevel {
+		t.Fatalf("Expected API level %d, got %d", server.JetStreamAPILevel, ji.APILevel)
+	}
+	if !ji.Supports(server.JSFeatureEncryption) {
+		t.Fatalf("Expected encryption to be supported, got %v", ji.Features)
+	}
+	if ji.Supports(server.JSFeatureClustering) {
+		t.Fatalf("Expected clustering to not be reported, got %v", ji.Features)
+	}
+	if ji.Supports(server.JSFeatureMemoryOnly) {
+		t.Fatalf("Expected memory only to not be reported, got %v", ji.Features)
+	}
+
+	// Also reported with account info.
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	resp, err := nc.Request(server.JSApiAccountInfo, nil, time.Second)
 	if err != nil {
-		t.Fatalf("Did not get message: %v", err)
+		t.Fatalf("Unexpected error: %v", err)
 	}
-	// Ack it!
-	msg.Respond(nil)
+	var info server.JSApiAccountInfoResponse
+	if err := json.Unmarshal(resp.Data, &info); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info.JetStream == nil || !reflect.DeepEqual(info.JetStream, ji) {
+		t.Fatalf("Expected %+v in account info, got %+v", ji, info.JetStream)
+	}
+
+	// Nothing to report without JetStream.
+	s.DisableJetStream()
+	if ji := s.JetStreamInfo(); ji != nil {
+		t.Fatalf("Expected no JetStream info, got %+v", ji)
+	}
+
+	// Memory only operation is reported as well.
+	if err := s.EnableJetStream(&server.JetStreamConfig{MemoryOnly: true, MaxMemory: 64 * 1024 * 1024}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ji := s.JetStreamInfo(); ji == nil || !ji.Supports(server.JSFeatureMemoryOnly) {
+		t.Fatalf("Expected memory only to be reported, got %+v", ji)
+	}
+}
+
+func TestJetStreamManifest(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
+	}
+
+	acc := s.GlobalAccount()
+	limits, _ := acc.JetStreamLimits()
+	limits.MaxStreams = 20
+	if err := acc.UpdateJetStreamLimits(&limits); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, name := range []string{"S1", "S2"} {
+		if _, err := acc.AddStream(&server.StreamConfig{Name: name, Storage: server.MemoryStorage}); err != nil {
+			t.Fatalf("Unexpected error adding stream: %v", err)
+		}
+	}
+	if _, err := acc.AddStreamTemplate(&server.StreamTemplateConfig{
+		Name:       "T",
+		Config:     &server.StreamConfig{Subjects: []string{"t.*"}, Storage: server.MemoryStorage},
+		MaxStreams: 4,
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Streams created by the template are not part of the manifest.
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+	nc.Publish("t.1", []byte("ok"))
 	nc.Flush()
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		if n := acc.NumStreams(); n != 3 {
+			return fmt.Errorf("Expected 3 streams, got %d", n)
+		}
+		return nil
+	})
 
-	// Shutdown client and server
+	data, err := acc.ExportJetStreamManifest()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var m server.JetStreamManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(m.Streams) != 2 || m.Streams[0].Name != "S1" || m.Streams[1].Name != "S2" {
+		t.Fatalf("Unexpected streams in manifest: %+v", m.Streams)
+	}
+	if len(m.Templates) != 1 || m.Templates[0].Name != "T" || m.Limits.MaxStreams != 20 {
+		t.Fatalf("Unexpected manifest: %+v", m)
+	}
+
+	// Applying the manifest recreates what is missing.
+	if err := acc.DeleteStreamTemplate("T"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if mset, _ := acc.LookupStream("S2"); mset != nil {
+		mset.Delete()
+	}
+	if err := acc.ApplyJetStreamManifest(data); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := acc.LookupStream("S2"); err != nil {
+		t.Fatalf("Expected stream S2 to be recreated: %v", err)
+	}
+	if _, err := acc.LookupStreamTemplate("T"); err != nil {
+		t.Fatalf("Expected template T to be recreated: %v", err)
+	}
+	// Applying it again changes nothing.
+	if err := acc.ApplyJetStreamManifest(data); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if again, _ := acc.ExportJetStreamManifest(); !bytes.Equal(again, data) {
+		t.Fatalf("Expected the same manifest, got %s", again)
+	}
+
+	// Changed streams are updated, extras are only deleted when pruning.
+	if _, err := acc.AddStream(&server.StreamConfig{Name: "EXTRA", Storage: server.MemoryStorage}); err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	m.Streams[0].MaxMsgs = 10
+	data, _ = json.Marshal(&m)
+	if err := acc.ApplyJetStreamManifest(data); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if mset, _ := acc.LookupStream("S1"); mset == nil || mset.Config().MaxMsgs != 10 {
+		t.Fatalf("Expected stream S1 to be updated")
+	}
+	if _, err := acc.LookupStream("EXTRA"); err != nil {
+		t.Fatalf("Expected stream EXTRA to remain: %v", err)
+	}
+	m.Prune = true
+	data, _ = json.Marshal(&m)
+	if err := acc.ApplyJetStreamManifest(data); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := acc.LookupStream("EXTRA"); err == nil {
+		t.Fatalf("Expected stream EXTRA to be pruned")
+	}
+	if n := len(acc.Streams()); n != 2 {
+		t.Fatalf("Expected 2 streams after pruning, got %d", n)
+	}
+}
+
+func TestJetStreamOrphanedTemplateStreams(t *testing.T) {
+	storeDir, _ := ioutil.TempDir(os.TempDir(), "jstests-storedir-")
+	defer os.RemoveAll(storeDir)
+	jsconfig := &server.JetStreamConfig{MaxMemory: 64 * 1024 * 1024, MaxStore: 64 * 1024 * 1024, StoreDir: storeDir}
+
+	s := RunRandClientPortServer()
+	defer s.Shutdown()
+	if err := s.EnableJetStream(jsconfig); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	acc := s.GlobalAccount()
+	if _, err := acc.AddStreamTemplate(&server.StreamTemplateConfig{
+		Name:       "kv",
+		Config:     &server.StreamConfig{Subjects: []string{"kv.*"}, Storage: server.FileStorage},
+		MaxStreams: 10,
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+	sendStreamMsg(t, nc, "kv.a", "Hello World")
+	sendStreamMsg(t, nc, "kv.b", "Hello World")
 	nc.Close()
 
-	dir := strings.TrimSuffix(s.JetStreamConfig().StoreDir, server.JetStreamStoreDir)
+	if orphans := acc.OrphanedTemplateStreams(); len(orphans) != 0 {
+		t.Fatalf("Expected no orphaned streams, got %d", len(orphans))
+	}
+	if err := acc.ClearStreamTemplate("kv_a"); err == nil {
+		t.Fatalf("Expected an error clearing a live template")
+	}
+
+	// Simulate a crash while deleting the template, its streams are left behind.
+	sd := s.JetStreamConfig().StoreDir
 	s.Shutdown()
+	if err := os.RemoveAll(filepath.Join(sd, server.DEFAULT_GLOBAL_ACCOUNT, "templates", "kv")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
 
-	opts.Port = -1
-	opts.StoreDir = dir
-	s = RunServer(&opts)
+	restart := func() {
+		t.Helper()
+		s = RunRandClientPortServer()
+		if err := s.EnableJetStream(jsconfig); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		acc = s.GlobalAccount()
+	}
+	restart()
 	defer s.Shutdown()
 
-	// Lookup stream.
-	mset, err = s.GlobalAccount().LookupStream("MY_STREAM")
-	if err != nil {
-		t.Fatalf("Error looking up stream: %v", err)
+	orphans := acc.OrphanedTemplateStreams()
+	if len(orphans) != 2 || orphans[0].Name() != "kv_a" || orphans[1].Name() != "kv_b" {
+		t.Fatalf("Expected kv_a and kv_b to be orphaned, got %v", orphans)
+	}
+	if err := acc.ClearStreamTemplate("kv_a"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := acc.ClearStreamTemplate("kv_a"); err == nil {
+		t.Fatalf("Expected an error clearing a stream without a template")
+	}
+	if orphans := acc.OrphanedTemplateStreams(); len(orphans) != 1 || orphans[0].Name() != "kv_b" {
+		t.Fatalf("Expected only kv_b to be orphaned, got %v", orphans)
 	}
 
-	// Update consumer's deliver subject with new inbox
-	inbox = nats.NewInbox()
-	o, err = mset.AddConsumer(&server.ConsumerConfig{
-		Durable:        "dur",
-		DeliverSubject: inbox,
-		DeliverPolicy:  server.DeliverNew,
-		AckPolicy:      server.AckExplicit,
-	})
+	// The change is persisted and the data kept.
+	s.Shutdown()
+	restart()
+	mset, err := acc.LookupStream("kv_a")
 	if err != nil {
-		t.Fatalf("Expected no error, got %v", err)
+		t.Fatalf("Unexpected error: %v", err)
 	}
-	defer o.Delete()
+	if cfg := mset.Config(); cfg.Template != "" {
+		t.Fatalf("Expected no template, got %q", cfg.Template)
+	}
+	if state := mset.State(); state.Msgs != 1 {
+		t.Fatalf("Expected 1 msg, got %d", state.Msgs)
+	}
+}
 
-	nc = clientConnectToServer(t, s)
-	defer nc.Close()
+func TestJetStreamResourceGroups(t *testing.T) {
+	s := RunRandClientPortServer()
+	defer s.Shutdown()
 
-	// Send 2nd message
-	sendStreamMsg(t, nc, "foo.bar", "msg2")
+	// Create the accounts first so the global account does not take all resources.
+	foo, _ := s.LookupOrRegisterAccount("FOO")
+	bar, _ := s.LookupOrRegisterAccount("BAR")
+	baz, _ := s.LookupOrRegisterAccount("BAZ")
 
-	// Start sub on new inbox
-	sub, err = nc.SubscribeSync(inbox)
+	sd, _ := ioutil.TempDir("", "js-groups-")
+	defer os.RemoveAll(sd)
+	jsconfig := &server.JetStreamConfig{MaxMemory: 64 * 1024 * 1024, MaxStore: 64 * 1024 * 1024, StoreDir: sd}
+	if err := s.EnableJetStream(jsconfig); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if err := s.AssignJetStreamResourceGroup("FOO", "ORG"); err != server.ErrJetStreamResourceGroupNotFound {
+		t.Fatalf("Expected group not found error, got %v", err)
+	}
+	if err := s.CreateJetStreamResourceGroup("ORG", 10*1024*1024, -1); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := s.CreateJetStreamResourceGroup("ORG", 1, 1); err != server.ErrJetStreamResourceGroupExists {
+		t.Fatalf("Expected group exists error, got %v", err)
+	}
+	for _, name := range []string{"FOO", "BAR"} {
+		if err := s.AssignJetStreamResourceGroup(name, "ORG"); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	limits := func(store int64) *server.JetStreamAccountLimits {
+		return &server.JetStreamAccountLimits{MaxMemory: 1024 * 1024, MaxStore: store, MaxStreams: -1, MaxConsumers: -1}
+	}
+	if err := foo.EnableJetStream(limits(6 * 1024 * 1024)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The group only has 4MB of storage left.
+	if err := bar.EnableJetStream(limits(6 * 1024 * 1024)); !errors.Is(err, server.ErrJetStreamInsufficientStorage) {
+		t.Fatalf("Expected insufficient storage error, got %v", err)
+	}
+	if err := bar.EnableJetStream(limits(4 * 1024 * 1024)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mem, store, err := s.JetStreamResourceGroupReservations("ORG")
 	if err != nil {
-		t.Fatalf("Error on subscribe: %v", err)
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if mem != 2*1024*1024 || store != 10*1024*1024 {
+		t.Fatalf("Unexpected group reservations: %d memory, %d storage", mem, store)
+	}
+	if err := foo.UpdateJetStreamLimits(limits(7 * 1024 * 1024)); !errors.Is(err, server.ErrJetStreamInsufficientStorage) {
+		t.Fatalf("Expected insufficient storage error, got %v", err)
 	}
-	nc.Flush()
 
-	// Should receive message 2.
-	if _, err := sub.NextMsg(500 * time.Millisecond); err != nil {
-		t.Fatalf("Did not get message: %v", err)
+	// Ungrouped accounts are only held to the server limits.
+	if err := baz.EnableJetStream(limits(6 * 1024 * 1024)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// An enabled account that does not fit can not join the group.
+	if err := s.AssignJetStreamResourceGroup("BAZ", "ORG"); !errors.Is(err, server.ErrJetStreamInsufficientStorage) {
+		t.Fatalf("Expected insufficient storage error, got %v", err)
 	}
-}
 
-// This is for the basics of importing the ability to send to a stream and consume
-// from a consumer that is pull based on push based on a well known delivery subject.
-func TestJetStreamAccountImportBasics(t *testing.T) {
-	conf := createConfFile(t, []byte(`
-		listen: 127.0.0.1:-1
-		no_auth_user: rip
-		jetstream: {max_mem_store: 64GB, max_file_store: 10TB}
-		accounts: {
-			JS: {
-				jetstream: enabled
-				users: [ {user: dlc, password: foo} ]
-				exports [
-					# This is for sending into a stream from other accounts.
-					{ service: "ORDERS.*" }
-					# This is for accessing a pull based consumer.
-					{ service: "$JS.API.CONSUMER.MSG.NEXT.*.*" }
-					# This is streaming to a delivery subject for a push based consumer.
-					{ stream: "deliver.ORDERS" }
-					# This is to ack received messages. This is a service to ack acks..
-					{ service: "$JS.ACK.ORDERS.*.>" }
-				]
-			},
-			IU: {
-				users: [ {user: rip, password: bar} ]
-				imports [
-					{ service: { subject: "ORDERS.*", account: JS }, to: "my.orders.$1" }
-					{ service: { subject: "$JS.API.CONSUMER.MSG.NEXT.ORDERS.d", account: JS }, to: "nxt.msg" }
-					{ stream:  { subject: "deliver.ORDERS", account: JS }, to: "d" }
-					{ service: { subject: "$JS.ACK.ORDERS.*.>", account: JS } }
-				]
-			},
-		}
-	`))
-	defer os.Remove(conf)
+	// Leaving the group frees up its reservations.
+	if err := s.AssignJetStreamResourceGroup("BAR", ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := foo.UpdateJetStreamLimits(limits(7 * 1024 * 1024)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, store, _ := s.JetStreamResourceGroupReservations("ORG"); store != 7*1024*1024 {
+		t.Fatalf("Expected 7MB of group storage reserved, got %d", store)
+	}
+}
 
-	s, _ := RunServerWithConfig(conf)
+func TestJetStreamStreamConfigCopy(t *testing.T) {
+	s := RunBasicJetStreamServer()
 	defer s.Shutdown()
 
 	if config := s.JetStreamConfig(); config != nil {
 		defer os.RemoveAll(config.StoreDir)
 	}
 
-	acc, err := s.LookupAccount("JS")
-	if err != nil {
-		t.Fatalf("Unexpected error looking up account: %v", err)
-	}
-
-	mset, err := acc.AddStream(&server.StreamConfig{Name: "ORDERS", Subjects: []string{"ORDERS.*"}})
+	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "ORDERS", Subjects: []string{"orders.*"}})
 	if err != nil {
 		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
 	defer mset.Delete()
 
-	// This should be the rip user, the one that imports some JS.
+	// Changing the copies does not change the stream.
+	cfg := mset.Config()
+	cfg.Subjects[0] = "foo"
+	subjects := mset.Subjects()
+	subjects[0] = "bar"
+	if subjects := mset.Subjects(); len(subjects) != 1 || subjects[0] != "orders.*" {
+		t.Fatalf("Expected subjects to be unchanged, got %v", subjects)
+	}
+
 	nc := clientConnectToServer(t, s)
 	defer nc.Close()
 
-	// Simple publish to a stream.
-	pubAck := sendStreamMsg(t, nc, "my.orders.foo", "ORDERS-1")
-	if pubAck.Stream != "ORDERS" || pubAck.Sequence != 1 {
-		t.Fatalf("Bad pubAck received: %+v", pubAck)
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			sendStreamMsg(t, nc, fmt.Sprintf("orders.%d", i), "OK")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			cfg := mset.Config()
+			cfg.Subjects = append(cfg.Subjects[:1], "invoices.*")
+			if err := mset.Update(&cfg); err != nil {
+				t.Errorf("Unexpected error updating stream: %v", err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if subjects := mset.Subjects(); len(subjects) == 0 || subjects[0] != "orders.*" {
+			t.Fatalf("Unexpected subjects %v", subjects)
+		}
+		if cfg := mset.Config(); cfg.Name != "ORDERS" {
+			t.Fatalf("Unexpected config %+v", cfg)
+		}
 	}
-	if msgs := mset.State().Msgs; msgs != 1 {
-		t.Fatalf("Expected 1 message, got %d", msgs)
+	close(done)
+	wg.Wait()
+
+	if state := mset.State(); state.Msgs != 100 {
+		t.Fatalf("Expected 100 msgs, got %d", state.Msgs)
 	}
+}
 
-	total := 2
-	for i := 2; i <= total; i++ {
-		sendStreamMsg(t, nc, "my.orders.bar", fmt.Sprintf("ORDERS-%d", i))
+func TestJetStreamEmptyStreamPrune(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
 	}
-	if msgs := mset.State().Msgs; msgs != uint64(total) {
-		t.Fatalf("Expected %d messages, got %d", total, msgs)
+
+	acc := s.GlobalAccount()
+	for _, name := range []string{"FOO", "BAR", "BAZ"} {
+		if _, err := acc.AddStream(&server.StreamConfig{Name: name, Storage: server.MemoryStorage}); err != nil {
+			t.Fatalf("Unexpected error adding stream: %v", err)
+		}
 	}
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+	sendStreamMsg(t, nc, "BAR", "Hello World")
 
-	// Now test access to a pull based consumer, e.g. workqueue.
-	o, err := mset.AddConsumer(&server.ConsumerConfig{
-		Durable:   "d",
-		AckPolicy: server.AckExplicit,
-	})
-	if err != nil {
-		t.Fatalf("Expected no error, got %v", err)
+	names := func(msets []*server.Stream) string {
+		var names []string
+		for _, mset := range msets {
+			names = append(names, mset.Name())
+		}
+		return strings.Join(names, ",")
+	}
+	if empty := names(acc.EmptyStreams()); empty != "BAZ,FOO" {
+		t.Fatalf("Expected empty streams BAZ,FOO, got %q", empty)
 	}
-	defer o.Delete()
 
-	// We mapped the next message request, "$JS.API.CONSUMER.MSG.NEXT.ORDERS.d" -> "nxt.msg"
-	m, err := nc.Request("nxt.msg", nil, time.Second)
-	if err != nil {
+	if err := acc.SetJetStreamEmptyStreamPrune(-time.Second); err == nil {
+		t.Fatalf("Expected an error with a negative idle duration")
+	}
+	const idle = 200 * time.Millisecond
+	if err := acc.SetJetStreamEmptyStreamPrune(idle); err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
-	if string(m.Data) != "ORDERS-1" {
-		t.Fatalf("Expected to receive %q, got %q", "ORDERS-1", m.Data)
+	// Streams that receive messages are not idle.
+	start := time.Now()
+	for time.Since(start) < 2*idle {
+		sendStreamMsg(t, nc, "BAZ", "Hello World")
+		mset, err := acc.LookupStream("BAZ")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		mset.Purge()
+		time.Sleep(idle / 4)
 	}
-
-	// Now test access to a push based consumer
-	o, err = mset.AddConsumer(&server.ConsumerConfig{
-		Durable:        "p",
-		DeliverSubject: "deliver.ORDERS",
-		AckPolicy:      server.AckExplicit,
-	})
-	if err != nil {
-		t.Fatalf("Expected no error, got %v", err)
+	if _, err := acc.LookupStream("FOO"); err == nil {
+		t.Fatalf("Expected empty stream FOO to be removed")
 	}
-	defer o.Delete()
-
-	// We remapped from above, deliver.ORDERS -> d
-	sub, _ := nc.SubscribeSync("d")
-	defer sub.Unsubscribe()
-
-	checkFor(t, 250*time.Millisecond, 10*time.Millisecond, func() error {
-		if nmsgs, _, _ := sub.Pending(); err != nil || nmsgs != total {
-			return fmt.Errorf("Did not receive correct number of messages: %d vs %d", nmsgs, total)
+	if _, err := acc.LookupStream("BAZ"); err != nil {
+		t.Fatalf("Expected active stream BAZ to remain: %v", err)
+	}
+	checkFor(t, 4*idle, idle/4, func() error {
+		if _, err := acc.LookupStream("BAZ"); err == nil {
+			return fmt.Errorf("Expected BAZ to be removed once idle")
 		}
 		return nil
 	})
-
-	m, _ = sub.NextMsg(time.Second)
-	// Make sure we remapped subject correctly across the account boundary.
-	if m.Subject != "ORDERS.foo" {
-		t.Fatalf("Expected subject of %q, got %q", "ORDERS.foo", m.Subject)
-	}
-	// Now make sure we can ack messages correctly.
-	m.Respond(server.AckAck)
-	nc.Flush()
-
-	if info := o.Info(); info.AckFloor.Consumer != 1 {
-		t.Fatalf("Did not receive the ack properly")
+	if names := names(acc.Streams()); names != "BAR" {
+		t.Fatalf("Expected only BAR to remain, got %q", names)
 	}
 
-	// Grab second one now.
-	m, _ = sub.NextMsg(time.Second)
-	// Make sure we remapped subject correctly across the account boundary.
-	if m.Subject != "ORDERS.bar" {
-		t.Fatalf("Expected subject of %q, got %q", "ORDERS.bar", m.Subject)
+	// Turning it off stops pruning.
+	if err := acc.SetJetStreamEmptyStreamPrune(0); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
-	// Now make sure we can ack messages and get back an ack as well.
-	resp, _ := nc.Request(m.Reply, nil, 100*time.Millisecond)
-	if resp == nil {
-		t.Fatalf("No response, possible timeout?")
+	if _, err := acc.AddStream(&server.StreamConfig{Name: "FOO", Storage: server.MemoryStorage}); err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
-	if info := o.Info(); info.AckFloor.Consumer != 2 {
-		t.Fatalf("Did not receive the ack properly")
+	time.Sleep(2 * idle)
+	if _, err := acc.LookupStream("FOO"); err != nil {
+		t.Fatalf("Expected FOO to remain: %v", err)
 	}
 }
 
-// This is for importing all of JetStream into another account for admin purposes.
-func TestJetStreamAccountImportAll(t *testing.T) {
-	conf := createConfFile(t, []byte(`
-		listen: 127.0.0.1:-1
-		no_auth_user: rip
-		jetstream: {max_mem_store: 64GB, max_file_store: 10TB}
-		accounts: {
-			JS: {
-				jetstream: enabled
-				users: [ {user: dlc, password: foo} ]
-				exports [ { service: "$JS.API.>" } ]
-			},
-			IU: {
-				users: [ {user: rip, password: bar} ]
-				imports [ { service: { subject: "$JS.API.>", account: JS }, to: "jsapi.>"} ]
-			},
+func TestJetStreamApplyLimits(t *testing.T) {
+	s := RunRandClientPortServer()
+	defer s.Shutdown()
+
+	const numAccounts, mb = 20, 1024 * 1024
+	var accs []*server.Account
+	for i := 0; i < numAccounts; i++ {
+		acc, _ := s.LookupOrRegisterAccount(fmt.Sprintf("A%02d", i))
+		accs = append(accs, acc)
+	}
+	sd, _ := ioutil.TempDir("", "js-apply-limits-")
+	defer os.RemoveAll(sd)
+	if err := s.EnableJetStream(&server.JetStreamConfig{MaxMemory: 64 * mb, MaxStore: 64 * mb, StoreDir: sd}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	limits := func(mem, store int64) *server.JetStreamAccountLimits {
+		return &server.JetStreamAccountLimits{MaxMemory: mem, MaxStore: store, MaxStreams: -1, MaxConsumers: -1}
+	}
+	for _, acc := range accs {
+		if err := acc.EnableJetStream(limits(mb, mb)); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
 		}
-	`))
-	defer os.Remove(conf)
+	}
 
-	s, _ := RunServerWithConfig(conf)
+	// One account asks for more storage than is left once the others grow.
+	update := make(map[*server.Account]*server.JetStreamAccountLimits)
+	for _, acc := range accs {
+		update[acc] = limits(2*mb, 2*mb)
+	}
+	update[accs[numAccounts-1]] = limits(2*mb, 40*mb)
+	err := s.JetStreamApplyLimits(update)
+	if !errors.Is(err, server.ErrJetStreamInsufficientStorage) || !strings.Contains(err.Error(), accs[numAccounts-1].Name) {
+		t.Fatalf("Expected insufficient storage for %q, got %v", accs[numAccounts-1].Name, err)
+	}
+	// Nothing was applied.
+	for _, acc := range accs {
+		if l, _ := acc.JetStreamLimits(); l.MaxMemory != mb || l.MaxStore != mb {
+			t.Fatalf("Expected limits of %q to be unchanged, got %+v", acc.Name, l)
+		}
+	}
+	if mem, store, _ := s.JetStreamReservedResources(); mem != numAccounts*mb || store != numAccounts*mb {
+		t.Fatalf("Expected reservations to be unchanged, got %d and %d", mem, store)
+	}
+
+	// Accounts need to be enabled.
+	nacc, _ := s.LookupOrRegisterAccount("NOJS")
+	if err := s.JetStreamApplyLimits(map[*server.Account]*server.JetStreamAccountLimits{nacc: limits(mb, mb)}); !errors.Is(err, server.ErrJetStreamNotEnabledForAccount) {
+		t.Fatalf("Expected not enabled error, got %v", err)
+	}
+
+	update[accs[numAccounts-1]] = limits(2*mb, 20*mb)
+	if err := s.JetStreamApplyLimits(update); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, acc := range accs {
+		if l, _ := acc.JetStreamLimits(); l != *update[acc] {
+			t.Fatalf("Expected limits of %q to be %+v, got %+v", acc.Name, update[acc], l)
+		}
+	}
+	if mem, store, _ := s.JetStreamReservedResources(); mem != 40*mb || store != 58*mb {
+		t.Fatalf("Expected 40MB of memory and 58MB of storage reserved, got %d and %d", mem, store)
+	}
+}
+
+func TestJetStreamMemoryOnly(t *testing.T) {
+	s := RunRandClientPortServer()
 	defer s.Shutdown()
 
-	if config := s.JetStreamConfig(); config != nil {
-		defer os.RemoveAll(config.StoreDir)
+	// Make sure nothing is written relative to where we run.
+	wd, _ := os.Getwd()
+	dir, _ := ioutil.TempDir("", "js-memory-only-")
+	defer os.RemoveAll(dir)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
+	defer os.Chdir(wd)
 
-	acc, err := s.LookupAccount("JS")
-	if err != nil {
-		t.Fatalf("Unexpected error looking up account: %v", err)
+	if err := s.EnableJetStream(&server.JetStreamConfig{MemoryOnly: true, MaxMemory: 1 << 30}); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	config := s.JetStreamConfig()
+	if !config.MemoryOnly || config.StoreDir != "" || config.MaxStore != 0 || config.MaxMemory != 1<<30 {
+		t.Fatalf("Unexpected config %+v", config)
 	}
 
-	mset, err := acc.AddStream(&server.StreamConfig{Name: "ORDERS", Subjects: []string{"ORDERS.*"}})
+	acc := s.GlobalAccount()
+	if _, err := acc.AddStream(&server.StreamConfig{Name: "FILE", Storage: server.FileStorage}); err != server.ErrJetStreamMemoryOnly {
+		t.Fatalf("Expected memory only error, got %v", err)
+	}
+	if _, err := acc.AddStreamTemplate(&server.StreamTemplateConfig{
+		Name:       "kv",
+		Config:     &server.StreamConfig{Subjects: []string{"kv.*"}, Storage: server.FileStorage},
+		MaxStreams: 1,
+	}); err != server.ErrJetStreamMemoryOnly {
+		t.Fatalf("Expected memory only error, got %v", err)
+	}
+
+	mset, err := acc.AddStream(&server.StreamConfig{Name: "MEM", Storage: server.MemoryStorage})
 	if err != nil {
 		t.Fatalf("Unexpected error adding stream: %v", err)
 	}
-	defer mset.Delete()
-
-	// This should be the rip user, the one that imports all of JS.
 	nc := clientConnectToServer(t, s)
 	defer nc.Close()
+	sendStreamMsg(t, nc, "MEM", "Hello World")
+	if state := mset.State(); state.Msgs != 1 {
+		t.Fatalf("Expected 1 msg, got %d", state.Msgs)
+	}
 
-	mapSubj := func(subject string) string {
-		return strings.Replace(subject, "$JS.API.", "jsapi.", 1)
+	if fis, _ := ioutil.ReadDir(dir); len(fis) != 0 {
+		t.Fatalf("Expected nothing to be written to disk, got %d entries", len(fis))
 	}
+}
 
-	// This will get the current information about usage and limits for this account.
-	resp, err := nc.Request(mapSubj(server.JSApiAccountInfo), nil, time.Second)
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+func TestJetStreamOvercommitFactor(t *testing.T) {
+	s := RunRandClientPortServer()
+	defer s.Shutdown()
+
+	const numAccounts, mb = 10, 1024 * 1024
+	var accs []*server.Account
+	for i := 0; i <= numAccounts; i++ {
+		acc, _ := s.LookupOrRegisterAccount(fmt.Sprintf("A%02d", i))
+		accs = append(accs, acc)
 	}
-	var info server.JSApiAccountInfoResponse
-	if err := json.Unmarshal(resp.Data, &info); err != nil {
+	sd, _ := ioutil.TempDir("", "js-overcommit-")
+	defer os.RemoveAll(sd)
+	jsconfig := &server.JetStreamConfig{MaxMemory: 4 * mb, MaxStore: 4 * mb, StoreDir: sd, OvercommitFactor: 2.5}
+	if err := s.EnableJetStream(jsconfig); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	limits := func(mem, store int64) *server.JetStreamAccountLimits {
+		return &server.JetStreamAccountLimits{MaxMemory: mem, MaxStore: store, MaxStreams: -1, MaxConsumers: -1}
+	}
+
+	// Ten accounts of 1MB each fit on a 4MB server.
+	for _, acc := range accs[:numAccounts] {
+		if err := acc.EnableJetStream(limits(mb, mb)); err != nil {
+			t.Fatalf("Unexpected error enabling %q: %v", acc.Name, err)
+		}
+	}
+	if mem, store, _ := s.JetStreamReservedResources(); mem != numAccounts*mb || store != numAccounts*mb {
+		t.Fatalf("Expected 10MB reserved, got %d and %d", mem, store)
+	}
+	if err := accs[numAccounts].EnableJetStream(limits(mb, 0)); err != server.ErrJetStreamInsufficientMemory {
+		t.Fatalf("Expected insufficient memory, got %v", err)
+	}
+	if err := accs[numAccounts].EnableJetStream(limits(0, mb)); err != server.ErrJetStreamInsufficientStorage {
+		t.Fatalf("Expected insufficient storage, got %v", err)
+	}
+
+	// Updates are held to the factor as well.
+	if err := accs[0].UpdateJetStreamLimits(limits(2*mb, mb)); err != server.ErrJetStreamInsufficientMemory {
+		t.Fatalf("Expected insufficient memory, got %v", err)
+	}
+	if err := accs[1].UpdateJetStreamLimits(limits(0, mb)); err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
-	if info.Error != nil {
-		t.Fatalf("Unexpected error: %+v", info.Error)
+	if err := accs[0].UpdateJetStreamLimits(limits(2*mb, mb)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
-	// Lookup streams.
-	resp, err = nc.Request(mapSubj(server.JSApiStreams), nil, time.Second)
-	if err != nil {
+
+	// Server limits can shrink below what is reserved as long as the factor covers it.
+	if err := s.JetStreamSetMaxMemory(8 * mb); err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
-	var namesResponse server.JSApiStreamNamesResponse
-	if err = json.Unmarshal(resp.Data, &namesResponse); err != nil {
+	if err := s.JetStreamSetMaxStore(8 * mb); err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
-	if namesResponse.Error != nil {
-		t.Fatalf("Unexpected error: %+v", namesResponse.Error)
+	if err := s.JetStreamSetMaxMemory(4 * mb); err != nil {
+		t.Fatalf("Unexpected error shrinking max memory within the factor: %v", err)
+	}
+	if err := s.JetStreamSetMaxStore(4 * mb); err != nil {
+		t.Fatalf("Unexpected error shrinking max storage within the factor: %v", err)
+	}
+	if err := s.JetStreamSetMaxMemory(3 * mb); err == nil {
+		t.Fatalf("Expected an error shrinking max memory past the factor")
+	}
+	if err := s.JetStreamSetMaxStore(3 * mb); err == nil {
+		t.Fatalf("Expected an error shrinking max storage past the factor")
 	}
 }
 
-// https://github.com/nats-io/nats-server/issues/1736
-func TestJetStreamServerReload(t *testing.T) {
-	conf := createConfFile(t, []byte(`
-		listen: 127.0.0.1:-1
-		jetstream: {max_mem_store: 64GB, max_file_store: 10TB }
-		accounts: {
-			A: { users: [ {user: ua, password: pwd} ] },
-			B: {
-				jetstream: {max_mem: 1GB, max_store: 1TB, max_streams: 10, max_consumers: 1k}
-				users: [ {user: ub, password: pwd} ]
-			},
-			SYS: { users: [ {user: uc, password: pwd} ] },
-		}
-		no_auth_user: ub
-		system_account: SYS
-	`))
-	defer os.Remove(conf)
-
-	s, _ := RunServerWithConfig(conf)
+func TestJetStreamUsageDetailed(t *testing.T) {
+	s := RunBasicJetStreamServer()
 	defer s.Shutdown()
 
 	if config := s.JetStreamConfig(); config != nil {
 		defer os.RemoveAll(config.StoreDir)
 	}
 
-	if !s.JetStreamEnabled() {
-		t.Fatalf("Expected JetStream to be enabled")
+	acc := s.GlobalAccount()
+	for _, cfg := range []*server.StreamConfig{
+		{Name: "MEM", Storage: server.MemoryStorage},
+		{Name: "FILE", Storage: server.FileStorage},
+		{Name: "EMPTY", Storage: server.MemoryStorage},
+	} {
+		if _, err := acc.AddStream(cfg); err != nil {
+			t.Fatalf("Unexpected error adding stream: %v", err)
+		}
 	}
-
-	// Client for API requests.
 	nc := clientConnectToServer(t, s)
 	defer nc.Close()
+	for i := 0; i < 5; i++ {
+		sendStreamMsg(t, nc, "MEM", "Hello World")
+	}
+	for i := 0; i < 3; i++ {
+		sendStreamMsg(t, nc, "FILE", "Hello World")
+	}
 
-	checkJSAccount := func() {
-		t.Helper()
-		resp, err := nc.Request(server.JSApiAccountInfo, nil, time.Second)
+	if stats := acc.JetStreamUsage(); stats.StreamUsage != nil {
+		t.Fatalf("Expected no stream usage, got %+v", stats.StreamUsage)
+	}
+	stats := acc.JetStreamUsageDetailed()
+	if stats.Streams != 3 || len(stats.StreamUsage) != 3 {
+		t.Fatalf("Expected usage for 3 streams, got %+v", stats)
+	}
+	state := func(name string) server.StreamState {
+		mset, err := acc.LookupStream(name)
 		if err != nil {
 			t.Fatalf("Unexpected error: %v", err)
 		}
-		var info server.JSApiAccountInfoResponse
-		if err := json.Unmarshal(resp.Data, &info); err != nil {
-			t.Fatalf("Unexpected error: %v", err)
+		return mset.State()
+	}
+	mem, file := state("MEM"), state("FILE")
+	expected := []server.StreamUsage{
+		{Name: "EMPTY"},
+		{Name: "FILE", Store: file.Bytes, Msgs: 3},
+		{Name: "MEM", Memory: mem.Bytes, Msgs: 5},
+	}
+	for i, su := range stats.StreamUsage {
+		if su != expected[i] {
+			t.Fatalf("Expected %+v, got %+v", expected[i], su)
 		}
 	}
+	if stats.Memory != mem.Bytes {
+		t.Fatalf("Expected account memory of %d, got %d", mem.Bytes, stats.Memory)
+	}
+}
 
-	checkJSAccount()
+func TestJetStreamLimitExceededHandler(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
 
-	acc, err := s.LookupAccount("B")
-	if err != nil {
-		t.Fatalf("Unexpected error looking up account: %v", err)
-	}
-	mset, err := acc.AddStream(&server.StreamConfig{Name: "22"})
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
 	}
 
-	toSend := 10
-	for i := 0; i < toSend; i++ {
-		sendStreamMsg(t, nc, "22", fmt.Sprintf("MSG: %d", i+1))
-	}
-	if msgs := mset.State().Msgs; msgs != uint64(toSend) {
-		t.Fatalf("Expected %d messages, got %d", toSend, msgs)
+	gacc := s.GlobalAccount()
+	al := &server.JetStreamAccountLimits{
+		MaxMemory:    1024,
+		MaxStore:     -1,
+		MaxStreams:   -1,
+		MaxConsumers: -1,
 	}
-
-	if err := s.Reload(); err != nil {
-		t.Fatalf("Error on server reload: %v", err)
+	if err := gacc.UpdateJetStreamLimits(al); err != nil {
+		t.Fatalf("Unexpected error updating jetstream account limits: %v", err)
 	}
 
-	// Wait to get reconnected.
-	checkFor(t, 5*time.Second, 10*time.Millisecond, func() error {
-		if !nc.IsConnected() {
-			return fmt.Errorf("Not connected")
+	var mu sync.Mutex
+	var calls []int64
+	s.SetJetStreamLimitExceededHandler(func(acc *server.Account, storeType server.StorageType, used, limit int64) {
+		if acc != gacc || storeType != server.MemoryStorage || limit != 1024 {
+			t.Errorf("Unexpected handler call: %q %v %d %d", acc.Name, storeType, used, limit)
 		}
-		return nil
+		mu.Lock()
+		calls = append(calls, used)
+		mu.Unlock()
 	})
+	numCalls := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(calls)
+	}
 
-	checkJSAccount()
-	sendStreamMsg(t, nc, "22", "MSG: 22")
-}
-
-func TestJetStreamConfigReloadWithGlobalAccount(t *testing.T) {
-	template := `
-		authorization {
-			users [
-				{user: anonymous}
-				{user: user1, password: %s}
-			]
-		}
-		no_auth_user: anonymous
-		jetstream: enabled
-	`
-	conf := createConfFile(t, []byte(fmt.Sprintf(template, "pwd")))
-	defer os.Remove(conf)
-
-	s, _ := RunServerWithConfig(conf)
-	defer s.Shutdown()
+	mset, err := gacc.AddStream(&server.StreamConfig{Name: "LIMITS", Storage: server.MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error adding stream: %v", err)
+	}
+	defer mset.Delete()
 
-	// Client for API requests.
 	nc := clientConnectToServer(t, s)
 	defer nc.Close()
 
-	checkJSAccount := func() {
+	// Keep sending past the limit, the handler should only fire once.
+	fill := func() {
 		t.Helper()
-		resp, err := nc.Request(server.JSApiAccountInfo, nil, time.Second)
-		if err != nil {
-			t.Fatalf("Unexpected error: %v", err)
-		}
-		var info server.JSApiAccountInfoResponse
-		if err := json.Unmarshal(resp.Data, &info); err != nil {
-			t.Fatalf("Unexpected error: %v", err)
+		for i := 0; i < 50; i++ {
+			nc.Request("LIMITS", []byte("Hello World!"), time.Second)
 		}
 	}
+	fill()
+	if n := numCalls(); n != 1 {
+		t.Fatalf("Expected the handler to be called once, got %d", n)
+	}
+	mu.Lock()
+	used := calls[0]
+	mu.Unlock()
+	if used <= 1024 {
+		t.Fatalf("Expected usage over the limit, got %d", used)
+	}
 
-	checkJSAccount()
+	// Dropping back under the limit re-arms the handler.
+	mset.Purge()
+	fill()
+	if n := numCalls(); n != 2 {
+		t.Fatalf("Expected the handler to be called twice, got %d", n)
+	}
 
-	mset, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "foo"})
-	if err != nil {
-		t.Fatalf("Unexpected error adding stream: %v", err)
+	// Removing the handler stops the calls.
+	s.SetJetStreamLimitExceededHandler(nil)
+	mset.Purge()
+	fill()
+	if n := numCalls(); n != 2 {
+		t.Fatalf("Expected no more handler calls, got %d", n)
 	}
-	defer mset.Delete()
+}
 
-	toSend := 10
-	for i := 0; i < toSend; i++ {
-		sendStreamMsg(t, nc, "foo", fmt.Sprintf("MSG: %d", i+1))
+type captureSoftLimitLogger struct {
+	dummyLogger
+	warnings []string
+}
+
+func (l *captureSoftLimitLogger) Warnf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if strings.Contains(msg, "usage of") && strings.Contains(msg, "soft limit") {
+		l.Lock()
+		l.warnings = append(l.warnings, msg)
+		l.Unlock()
 	}
-	if msgs := mset.State().Msgs; msgs != uint64(toSend) {
-		t.Fatalf("Expected %d messages, got %d", toSend, msgs)
+}
+
+func TestJetStreamSoftLimits(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer s.Shutdown()
+
+	if config := s.JetStreamConfig(); config != nil {
+		defer os.RemoveAll(config.StoreDir)
 	}
+	l := &captureSoftLimitLogger{}
+	s.SetLogger(l, false, false)
 
-	if err := ioutil.WriteFile(conf, []byte(fmt.Sprintf(template, "pwd2")), 0666); err != nil {
-		t.Fatalf("Error writing config: %v", err)
+	mb := int64(1024 * 1024)
+	gacc := s.GlobalAccount()
+	limits := &server.JetStreamAccountLimits{
+		MaxMemory:    mb,
+		MaxStore:     mb,
+		MaxStreams:   -1,
+		MaxConsumers: -1,
+	}
+	if err := gacc.UpdateJetStreamLimits(limits); err != nil {
+		t.Fatalf("Unexpected error updating jetstream account limits: %v", err)
 	}
 
-	if err := s.Reload(); err != nil {
-		t.Fatalf("Error during config reload: %v", err)
+	// Without hard limits the soft ones are hard.
+	if _, err := gacc.AddStream(&server.StreamConfig{Name: "S1", Storage: server.FileStorage, MaxBytes: 3 * mb / 2}); err != server.ErrJetStreamInsufficientStorage {
+		t.Fatalf("Expected %v, got %v", server.ErrJetStreamInsufficientStorage, err)
 	}
 
-	// Try to add a new stream to the global account
-	mset2, err := s.GlobalAccount().AddStream(&server.StreamConfig{Name: "bar"})
-	if err != nil {
-		t.Fatalf("Unexpected error adding stream: %v", err)
+	limits.MaxStoreHard, limits.MaxMemoryHard = 2*mb, 2*mb
+	if err := gacc.UpdateJetStreamLimits(limits); err != nil {
+		t.Fatalf("Unexpected error updating jetstream account limits: %v", err)
+	}
+	if stats := gacc.JetStreamUsage(); stats.OverSoftLimit {
+		t.Fatalf("Expected not to be over the soft limit")
+	}
+	// The hard limits are what is reserved from the server.
+	if r := s.JetStreamAccountReservations()[gacc.Name]; r.MaxMemory != 2*mb || r.MaxStore != 2*mb {
+		t.Fatalf("Expected the hard limits to be reserved, got %+v", r)
+	}
+	over := *limits
+	over.MaxStoreHard = s.JetStreamConfig().MaxStore + 1
+	if err := gacc.UpdateJetStreamLimits(&over); err != server.ErrJetStreamInsufficientStorage {
+		t.Fatalf("Expected %v, got %v", server.ErrJetStreamInsufficientStorage, err)
+	}
+	for _, cfg := range []*server.StreamConfig{
+		{Name: "S1", Storage: server.FileStorage, MaxBytes: 3 * mb / 2},
+		{Name: "M1", Storage: server.MemoryStorage, MaxBytes: 3 * mb / 2},
+	} {
+		if _, err := gacc.AddStream(cfg); err != nil {
+			t.Fatalf("Unexpected error adding stream over the soft limit: %v", err)
+		}
+	}
+	if stats := gacc.JetStreamUsage(); !stats.OverSoftLimit {
+		t.Fatalf("Expected to be over the soft limit")
 	}
-	defer mset2.Delete()
 
-	// Wait to get reconnected.
-	checkFor(t, 5*time.Second, 10*time.Millisecond, func() error {
-		if !nc.IsConnected() {
-			return fmt.Errorf("Not connected")
+	// The hard limits still apply.
+	if _, err := gacc.AddStream(&server.StreamConfig{Name: "S2", Storage: server.FileStorage, MaxBytes: mb}); err != server.ErrJetStreamInsufficientStorage {
+		t.Fatalf("Expected %v, got %v", server.ErrJetStreamInsufficientStorage, err)
+	}
+	if _, err := gacc.AddStream(&server.StreamConfig{Name: "M2", Storage: server.MemoryStorage, MaxBytes: mb}); err != server.ErrJetStreamInsufficientMemory {
+		t.Fatalf("Expected %v, got %v", server.ErrJetStreamInsufficientMemory, err)
+	}
+
+	// Messages can be stored past the soft limit.
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+	msg := make([]byte, 64*1024)
+	for i := 0; i < 20; i++ {
+		resp, err := nc.Request("M1", msg, time.Second)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
 		}
-		return nil
-	})
+		if pa := getPubAckResponse(resp.Data); pa == nil || pa.Error != nil {
+			t.Fatalf("Expected a pub ack, got %q", resp.Data)
+		}
+	}
+	if stats := gacc.JetStreamUsage(); stats.Memory <= uint64(mb) {
+		t.Fatalf("Expected memory usage over the soft limit, got %d", stats.Memory)
+	}
+	// Crossing the soft limit warns once.
+	l.Lock()
+	warnings := l.warnings
+	l.Unlock()
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "memory usage") {
+		t.Fatalf("Expected one memory usage warning, got %q", warnings)
+	}
 
-	checkJSAccount()
+	// Once back under the soft limit the flag is cleared.
+	for _, name := range []string{"S1", "M1"} {
+		mset, err := gacc.LookupStream(name)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		mset.Delete()
+	}
+	if stats := gacc.JetStreamUsage(); stats.OverSoftLimit {
+		t.Fatalf("Expected not to be over the soft limit")
+	}
 }